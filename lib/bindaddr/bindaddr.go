@@ -0,0 +1,41 @@
+// Package bindaddr resolves the local addresses that meek-client
+// (--bind-addr) and meek-server (--out-bind-addr) make outgoing connections
+// from. An address may be given either as an IP address or as the name of a
+// network interface.
+package bindaddr
+
+import (
+	"fmt"
+	"net"
+)
+
+// Resolve spec, either an IP address or the name of a network interface, to a
+// local IP address. If an interface has more than one address, the first IPv4
+// address is preferred.
+func Resolve(spec string) (net.IP, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return ip, nil
+	}
+	ifi, err := net.InterfaceByName(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor an interface: %s", spec, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip == nil || (ip.To4() == nil && ipnet.IP.To4() != nil) {
+			ip = ipnet.IP
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("interface %q has no IP address", spec)
+	}
+	return ip, nil
+}
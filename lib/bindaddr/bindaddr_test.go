@@ -0,0 +1,38 @@
+package bindaddr
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	ip, err := Resolve("127.0.0.1")
+	if err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("got (%v, %v)", ip, err)
+	}
+	ip, err = Resolve("::1")
+	if err != nil || !ip.Equal(net.IPv6loopback) {
+		t.Errorf("got (%v, %v)", ip, err)
+	}
+
+	// Find the name of the loopback interface, whatever it is called.
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		ip, err = Resolve(ifi.Name)
+		if err != nil || !ip.IsLoopback() {
+			t.Errorf("%s: got (%v, %v)", ifi.Name, ip, err)
+		}
+		break
+	}
+
+	_, err = Resolve("no-such-interface0")
+	if err == nil {
+		t.Errorf("nonexistent interface unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,61 @@
+// Package buildinfo describes the build of meek-client or meek-server that is
+// running, for --version, the startup log line, fault reports, and the
+// server's admin API (GET /version). The git commit and build date are set at
+// link time, in the main package, by the Makefiles:
+//
+//	go build -ldflags "-X main.gitCommit=COMMIT -X main.buildDate=DATE"
+//
+// and passed to Get. Without them, they are taken from the version control
+// information that the go command embeds when building in a module, if there
+// is any.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the Info of the running program, of the given version, with the
+// commit and date set at link time, which may be "". Commit and Date are
+// "unknown" if they weren't recorded at all.
+func Get(version, commit, date string) Info {
+	info := Info{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+				if len(info.Commit) > 12 {
+					info.Commit = info.Commit[:12]
+				}
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Date == "" {
+		info.Date = "unknown"
+	}
+	return info
+}
+
+func (info Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", info.Version, info.Commit, info.Date, info.GoVersion)
+}
@@ -0,0 +1,21 @@
+package buildinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	info := Get("1.0", "0123abcd", "2024-05-01T00:00:00Z")
+	if info.Version != "1.0" || info.Commit != "0123abcd" || info.Date != "2024-05-01T00:00:00Z" || !strings.HasPrefix(info.GoVersion, "go") {
+		t.Errorf("got %+v", info)
+	}
+	if s := info.String(); !strings.HasPrefix(s, "1.0 (commit 0123abcd, built 2024-05-01T00:00:00Z, go") {
+		t.Errorf("String: %q", s)
+	}
+
+	// Test binaries have no version control information.
+	if info := Get("1.0", "", ""); info.Commit == "" || info.Date == "" {
+		t.Errorf("got %+v", info)
+	}
+}
@@ -0,0 +1,301 @@
+// Package faultreport writes fault reports: JSON files in the pluggable
+// transport state directory that describe why meek-client or meek-server
+// stopped, for attaching to bug reports after a crash that nobody was
+// watching. A report has the version, a hash of the configuration (which
+// identifies it without revealing it), the message, the stack of a crash, and
+// the last log lines.
+//
+// A fatal error (Fatalf) writes its report right away, and so does a panic
+// that the program recovers from and goes on (Report with kind "panic"). A
+// panic that isn't recovered, or a fatal runtime error, can't run any code, so the runtime
+// writes its stack traces to a crash output file instead, which starts with
+// the parts of the report that are known in advance; the next run turns a
+// crash output file that has a crash in it into a report. Those reports have
+// no log lines.
+package faultreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"../buildinfo"
+)
+
+const (
+	// How many log lines a fault report has.
+	LogLines = 100
+	// The most fault reports kept in the state directory; older ones are
+	// deleted when a new one is written.
+	MaxReports = 20
+)
+
+// A fault report, as written to a file.
+type Report struct {
+	Time       time.Time      `json:"time"`
+	Program    string         `json:"program"`
+	Build      buildinfo.Info `json:"build"`
+	ConfigHash string         `json:"config_hash"`
+	// "fatal" for a fatal error, "crash" for a panic or runtime error that
+	// stopped the program, "panic" for a panic it recovered from.
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message,omitempty"`
+	// The stack traces of a crash. A fatal error is an expected way to
+	// stop, and its report has no stack.
+	Stack string   `json:"stack,omitempty"`
+	Log   []string `json:"log,omitempty"`
+}
+
+// Reporter writes fault reports into a directory. It is an io.Writer that
+// keeps the last LogLines lines written to it, so that it can be added to the
+// log output. A nil *Reporter writes nothing.
+type Reporter struct {
+	dir        string
+	program    string
+	configHash string
+	build      buildinfo.Info
+	now        func() time.Time
+
+	lock sync.Mutex
+	// A ring of the last log lines, the next of which goes at lines[next].
+	lines []string
+	next  int
+	// The start of a line not yet ended.
+	partial []byte
+
+	// Held while choosing a report file name and writing the file.
+	saveLock sync.Mutex
+}
+
+// The Reporter used by Fatalf, or nil if there is no state directory. Set up
+// by the program's main.
+var Default *Reporter
+
+// Called by Fatalf before exiting, to stop what os.Exit would leave running,
+// like meek-client's helper browser.
+var BeforeExit = func() {}
+
+// New returns a Reporter that writes the reports of program into dir.
+// configHash identifies the program's configuration, and build is the build
+// information put into every report. If dir is "", reports can be made (Make),
+// but they aren't written, and crashes aren't watched.
+func New(dir, program, configHash string, build buildinfo.Info) *Reporter {
+	return &Reporter{
+		dir:        dir,
+		program:    program,
+		configHash: configHash,
+		build:      build,
+		now:        time.Now,
+		lines:      make([]string, 0, LogLines),
+	}
+}
+
+func (r *Reporter) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			r.partial = append(r.partial, p...)
+			break
+		}
+		line := string(append(r.partial, p[:i]...))
+		r.partial = r.partial[:0]
+		p = p[i+1:]
+		if len(r.lines) < LogLines {
+			r.lines = append(r.lines, line)
+		} else {
+			r.lines[r.next] = line
+		}
+		r.next = (r.next + 1) % LogLines
+	}
+	return n, nil
+}
+
+// Return the last log lines, oldest first.
+func (r *Reporter) logLines() []string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lines := make([]string, 0, len(r.lines))
+	if len(r.lines) == LogLines {
+		lines = append(lines, r.lines[r.next:]...)
+	}
+	return append(lines, r.lines[:r.next]...)
+}
+
+// Return a report with the parts that don't depend on the fault.
+func (r *Reporter) template() *Report {
+	if r == nil {
+		return &Report{Time: time.Now().UTC()}
+	}
+	return &Report{
+		Time:       r.now().UTC(),
+		Program:    r.program,
+		Build:      r.build,
+		ConfigHash: r.configHash,
+	}
+}
+
+// Report writes a report of a fault of the given kind, with the last log
+// lines. It returns the name of the report file.
+func (r *Reporter) Report(kind, message string, stack []byte) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	return r.Save(r.Make(kind, message, stack))
+}
+
+// Make returns a report of a fault of the given kind, with the last log lines,
+// without writing it. A nil *Reporter makes a report of only the fault.
+func (r *Reporter) Make(kind, message string, stack []byte) *Report {
+	report := r.template()
+	report.Kind = kind
+	report.Message = message
+	report.Stack = string(stack)
+	report.Log = r.logLines()
+	return report
+}
+
+// Save writes report into a new file, and deletes the oldest reports if there
+// are too many. It returns the name of the file, or "" if r has no directory.
+func (r *Reporter) Save(report *Report) (string, error) {
+	if r == nil || r.dir == "" {
+		return "", nil
+	}
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	r.saveLock.Lock()
+	defer r.saveLock.Unlock()
+	base := fmt.Sprintf("%s-fault-%s-%d", r.program, report.Time.Format("20060102T150405"), os.Getpid())
+	filename := filepath.Join(r.dir, base+".json")
+	// Don't overwrite another report from the same second.
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			break
+		}
+		filename = filepath.Join(r.dir, fmt.Sprintf("%s-%d.json", base, i))
+	}
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0600)
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	r.prune()
+	return filename, nil
+}
+
+// Delete all but the newest MaxReports reports. The names sort in the order
+// they were written.
+func (r *Reporter) prune() {
+	names, err := filepath.Glob(filepath.Join(r.dir, r.program+"-fault-*.json"))
+	if err != nil || len(names) <= MaxReports {
+		return
+	}
+	for _, name := range names[:len(names)-MaxReports] {
+		os.Remove(name)
+	}
+}
+
+// Return the name of the crash output file.
+func (r *Reporter) crashOutputFilename() string {
+	return filepath.Join(r.dir, r.program+"-crash-output.txt")
+}
+
+// WatchCrashes turns the crash output file of an earlier run into a report, if
+// that run crashed, then starts a new crash output file for this run and has
+// the runtime write to it. It returns the name of the report about the earlier
+// run, or "" if there is none.
+func (r *Reporter) WatchCrashes() (string, error) {
+	if r == nil || r.dir == "" {
+		return "", nil
+	}
+	filename := r.crashOutputFilename()
+	report, err := r.salvage(filename)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(r.template())
+	if err != nil {
+		return report, err
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+	_, err = file.Write(append(header, '\n'))
+	if err != nil {
+		return report, err
+	}
+	// The runtime keeps its own copy of the file descriptor.
+	return report, debug.SetCrashOutput(file, debug.CrashOptions{})
+}
+
+// Make a report from the crash output file filename, if it has a crash in it.
+func (r *Reporter) salvage(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	header, crash, _ := bytes.Cut(data, []byte("\n"))
+	crash = bytes.TrimSpace(crash)
+	if len(crash) == 0 {
+		// The run ended without crashing.
+		return "", nil
+	}
+	var report Report
+	if json.Unmarshal(header, &report) != nil {
+		// Not something we wrote; keep what we can.
+		report = Report{Program: r.program}
+		crash = bytes.TrimSpace(data)
+	}
+	if info, err := os.Stat(filename); err == nil {
+		report.Time = info.ModTime().UTC()
+	}
+	report.Kind = "crash"
+	// The first line is like "panic: ..." or "fatal error: ...".
+	first, _, _ := bytes.Cut(crash, []byte("\n"))
+	report.Message = string(first)
+	report.Stack = string(crash)
+	return r.Save(&report)
+}
+
+// Fatalf logs a fatal error, writes a report about it with Default, and exits,
+// like log.Fatalf.
+func Fatalf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	log.Print(message)
+	filename, err := Default.Report("fatal", strings.TrimSpace(message), nil)
+	if err != nil {
+		log.Printf("error writing fault report: %s", err)
+	} else if filename != "" {
+		log.Printf("fault report in %s", filename)
+	}
+	BeforeExit()
+	os.Exit(1)
+}
+
+// Fatal is to Fatalf as log.Fatal is to log.Fatalf.
+func Fatal(v ...interface{}) {
+	Fatalf("%s", fmt.Sprint(v...))
+}
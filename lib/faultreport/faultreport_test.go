@@ -0,0 +1,180 @@
+package faultreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../buildinfo"
+)
+
+// The build information of the test reports.
+var testBuild = buildinfo.Info{Version: "1.0"}
+
+func readReport(t *testing.T, filename string) *Report {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &report
+}
+
+func TestReporterNil(t *testing.T) {
+	var f *Reporter
+	if filename, err := f.Report("fatal", "message", nil); filename != "" || err != nil {
+		t.Errorf("got %q, %v", filename, err)
+	}
+	if filename, err := f.WatchCrashes(); filename != "" || err != nil {
+		t.Errorf("got %q, %v", filename, err)
+	}
+}
+
+func TestReporterLogLines(t *testing.T) {
+	f := New(t.TempDir(), "test", "hash", testBuild)
+	logger := log.New(f, "", 0)
+	for i := 0; i < LogLines+10; i++ {
+		logger.Printf("line %d", i)
+	}
+	// A line written in pieces.
+	f.Write([]byte("the last "))
+	f.Write([]byte("line\nunfinished"))
+	lines := f.logLines()
+	if len(lines) != LogLines {
+		t.Fatalf("%d lines", len(lines))
+	}
+	if lines[0] != "line 11" || lines[len(lines)-2] != fmt.Sprintf("line %d", LogLines+9) || lines[len(lines)-1] != "the last line" {
+		t.Errorf("lines %q ... %q", lines[:2], lines[len(lines)-2:])
+	}
+}
+
+func TestReporterReport(t *testing.T) {
+	dir := t.TempDir()
+	f := New(dir, "test", "0123456789abcdef", testBuild)
+	f.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	log.New(f, "", 0).Print("before the fault")
+	filename, err := f.Report("fatal", "it broke", []byte("goroutine 1 [running]:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(filename) != dir || !strings.HasPrefix(filepath.Base(filename), "test-fault-20200102T030405-") {
+		t.Errorf("report file %s", filename)
+	}
+	report := readReport(t, filename)
+	if report.Kind != "fatal" || report.Message != "it broke" || report.ConfigHash != "0123456789abcdef" ||
+		report.Build.Version != "1.0" || report.Stack != "goroutine 1 [running]:" ||
+		len(report.Log) != 1 || report.Log[0] != "before the fault" {
+		t.Errorf("report %+v", report)
+	}
+}
+
+// Reports made in the same second get files of their own.
+func TestReporterSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	f := New(dir, "test", "hash", testBuild)
+	f.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		filename, err := f.Report("panic", fmt.Sprintf("panic %d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[filename] {
+			t.Errorf("%s written twice", filename)
+		}
+		seen[filename] = true
+		if report := readReport(t, filename); report.Message != fmt.Sprintf("panic %d", i) {
+			t.Errorf("%s: message %q", filename, report.Message)
+		}
+	}
+}
+
+// Without a directory, or without a Reporter, reports are made but not
+// written.
+func TestReporterMake(t *testing.T) {
+	f := New("", "test", "hash", testBuild)
+	log.New(f, "", 0).Print("before the fault")
+	report := f.Make("panic", "it broke", []byte("goroutine 1 [running]:"))
+	if report.Program != "test" || report.Build.Version != "1.0" || report.Kind != "panic" ||
+		report.Stack != "goroutine 1 [running]:" || len(report.Log) != 1 {
+		t.Errorf("report %+v", report)
+	}
+	if filename, err := f.Save(report); filename != "" || err != nil {
+		t.Errorf("got %q, %v", filename, err)
+	}
+	if filename, err := f.WatchCrashes(); filename != "" || err != nil {
+		t.Errorf("got %q, %v", filename, err)
+	}
+	var nilReporter *Reporter
+	if report := nilReporter.Make("panic", "it broke", nil); report.Message != "it broke" || report.Time.IsZero() {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestReporterPrune(t *testing.T) {
+	dir := t.TempDir()
+	f := New(dir, "test", "hash", testBuild)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	f.now = func() time.Time { return now }
+	for i := 0; i < MaxReports+5; i++ {
+		_, err := f.Report("fatal", "again", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "test-fault-*.json"))
+	if len(names) != MaxReports {
+		t.Fatalf("%d reports kept", len(names))
+	}
+	// The newest were kept.
+	if report := readReport(t, names[0]); !report.Time.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("oldest kept report is from %s", report.Time)
+	}
+}
+
+// A crash output file with a crash in it becomes a report on the next run; one
+// without becomes nothing.
+func TestReporterSalvage(t *testing.T) {
+	dir := t.TempDir()
+	earlier := New(dir, "test", "earlierhash", testBuild)
+	header, _ := json.Marshal(earlier.template())
+	crash := "panic: runtime error: index out of range\n\ngoroutine 7 [running]:\nmain.handler()\n"
+	err := os.WriteFile(earlier.crashOutputFilename(), append(append(header, '\n'), crash...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(dir, "test", "laterhash", testBuild)
+	filename, err := f.salvage(f.crashOutputFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename == "" {
+		t.Fatalf("no report")
+	}
+	report := readReport(t, filename)
+	if report.Kind != "crash" || report.ConfigHash != "earlierhash" ||
+		report.Message != "panic: runtime error: index out of range" || !strings.Contains(report.Stack, "main.handler()") {
+		t.Errorf("report %+v", report)
+	}
+
+	err = os.WriteFile(f.crashOutputFilename(), append(header, '\n'), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename, err := f.salvage(f.crashOutputFilename()); filename != "" || err != nil {
+		t.Errorf("got %q, %v without a crash", filename, err)
+	}
+}
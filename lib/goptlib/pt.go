@@ -957,3 +957,37 @@ func DialOr(info *ServerInfo, addr, methodName string) (*net.TCPConn, error) {
 
 	return s, nil
 }
+
+// Dialer is the interface of the dialer passed to DialOrWithDialer. It is
+// satisfied by *net.Dialer and by golang.org/x/net/proxy.Dialer.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Like DialOr, but dial using the given Dialer rather than directly, for
+// example to go through a proxy or to bind a local address. The returned
+// net.Conn is a *net.TCPConn only if the Dialer returns one.
+func DialOrWithDialer(dialer Dialer, info *ServerInfo, addr, methodName string) (net.Conn, error) {
+	if info.ExtendedOrAddr == nil || info.AuthCookiePath == "" {
+		return dialer.Dial("tcp", info.OrAddr.String())
+	}
+
+	s, err := dialer.Dial("tcp", info.ExtendedOrAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	err = extOrPortAuthenticate(s, info)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	err = extOrPortSetup(s, addr, methodName)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.SetDeadline(time.Time{})
+
+	return s, nil
+}
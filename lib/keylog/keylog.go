@@ -0,0 +1,69 @@
+// Package keylog writes TLS session secrets to a file, in the NSS key log
+// format that Wireshark reads, so that developers can decrypt captures of
+// their own test traffic. meek-client and meek-server use it for --keylog, or
+// else the SSLKEYLOGFILE environment variable, as in browsers and curl. Anyone
+// with the file can decrypt every connection made while it was written, so a
+// warning is logged whenever it is on.
+package keylog
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// The environment variable that names a key log file if there is no --keylog.
+const EnvVar = "SSLKEYLOGFILE"
+
+// File is a key log file that is safe for concurrent use, so that lines
+// written by different connections don't interleave. Use it as a
+// tls.Config.KeyLogWriter.
+type File struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// Return the name of the key log file: option if not "", else the value of
+// SSLKEYLOGFILE. "" means not to log keys.
+func filename(option string) string {
+	if option != "" {
+		return option
+	}
+	return os.Getenv(EnvVar)
+}
+
+// Open opens the key log file named by option (the value of --keylog), or
+// else by SSLKEYLOGFILE, and logs a warning that keys are being written to it.
+// It returns nil, and no error, if neither names a file.
+func Open(option string) (*File, error) {
+	name := filename(option)
+	if name == "" {
+		return nil, nil
+	}
+	kl, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("WARNING: writing TLS session secrets to %s; anyone with this file can decrypt the traffic", name)
+	return kl, nil
+}
+
+// Open name for appending key log lines, creating it, readable only by the
+// owner, if it doesn't exist.
+func openFile(name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &File{f: f}, nil
+}
+
+func (kl *File) Write(p []byte) (int, error) {
+	kl.lock.Lock()
+	defer kl.lock.Unlock()
+	return kl.f.Write(p)
+}
+
+func (kl *File) Close() error {
+	return kl.f.Close()
+}
@@ -0,0 +1,80 @@
+package keylog
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFilename(t *testing.T) {
+	t.Setenv(EnvVar, "")
+	if got := filename(""); got != "" {
+		t.Errorf("no option or environment: got %q", got)
+	}
+	t.Setenv(EnvVar, "/tmp/env.keys")
+	if got := filename(""); got != "/tmp/env.keys" {
+		t.Errorf("environment: got %q", got)
+	}
+	if got := filename("/tmp/option.keys"); got != "/tmp/option.keys" {
+		t.Errorf("option: got %q", got)
+	}
+}
+
+func TestOpenNone(t *testing.T) {
+	t.Setenv(EnvVar, "")
+	kl, err := Open("")
+	if kl != nil || err != nil {
+		t.Errorf("got (%v, %v)", kl, err)
+	}
+}
+
+// A TLS handshake writes its secrets to the key log, which is readable only by
+// its owner.
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "keys")
+	t.Setenv(EnvVar, name)
+	kl, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kl.Close()
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{KeyLogWriter: kl}
+	server.StartTLS()
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); runtime.GOOS != "windows" && perm&0077 != 0 {
+		t.Errorf("key log has permissions %o", perm)
+	}
+	labels := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		labels[strings.Fields(scanner.Text())[0]] = true
+	}
+	for _, label := range []string{"CLIENT_HANDSHAKE_TRAFFIC_SECRET", "SERVER_TRAFFIC_SECRET_0"} {
+		if !labels[label] {
+			t.Errorf("no %s line in key log", label)
+		}
+	}
+}
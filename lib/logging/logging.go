@@ -0,0 +1,164 @@
+// Package logging keeps the log verbosity of meek-client and meek-server and
+// logs messages at each level (Debugf, Infof, Warnf). The level can be changed
+// while the program runs, for a while or for good: both programs toggle debug
+// logging on SIGHUP (ToggleDebug), and meek-server's admin API sets the level
+// (Change). Keeping sensitive information out of the log is up to each
+// program.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log verbosity levels, from most to least verbose.
+const (
+	Debug int32 = iota
+	Info
+	Warn
+)
+
+var levelNames = map[string]int32{
+	"debug": Debug,
+	"info":  Info,
+	"warn":  Warn,
+}
+
+// The current log level. Accessed atomically.
+var level = Info
+
+// How long debug logging turned on by ToggleDebug lasts.
+const DebugDuration = 10 * time.Minute
+
+// A temporary change of the log level, which goes back to the level that was
+// in effect before it when its timer fires.
+var change struct {
+	lock  sync.Mutex
+	timer *time.Timer
+	// The level to go back to, and when.
+	saved int32
+	until time.Time
+}
+
+// ParseLevel returns the level named s: "debug", "info", or "warn".
+func ParseLevel(s string) (int32, error) {
+	l, ok := levelNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (must be debug, info, or warn)", s)
+	}
+	return l, nil
+}
+
+// LevelName returns the name of a log level.
+func LevelName(l int32) string {
+	for name, value := range levelNames {
+		if value == l {
+			return name
+		}
+	}
+	return fmt.Sprintf("level %d", l)
+}
+
+// SetLevel sets the log level, without logging it.
+func SetLevel(l int32) {
+	atomic.StoreInt32(&level, l)
+}
+
+// Enabled returns whether messages of level l are logged.
+func Enabled(l int32) bool {
+	return atomic.LoadInt32(&level) <= l
+}
+
+// Change changes the log level of the running program. If d is positive, the
+// change lasts for d, then the level goes back to what it was before the first
+// of any temporary changes in a row; otherwise the change is permanent.
+// Returns when a temporary change ends, or the zero time.
+func Change(l int32, d time.Duration) time.Time {
+	change.lock.Lock()
+	defer change.lock.Unlock()
+	return changeLocked(l, d)
+}
+
+// Like Change, but must be called with change.lock held.
+func changeLocked(l int32, d time.Duration) time.Time {
+	if change.timer != nil {
+		change.timer.Stop()
+		change.timer = nil
+	} else {
+		change.saved = atomic.LoadInt32(&level)
+	}
+	SetLevel(l)
+	if d <= 0 {
+		log.Printf("log level set to %s", LevelName(l))
+		change.until = time.Time{}
+		return change.until
+	}
+	log.Printf("log level set to %s for %s", LevelName(l), d)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		change.lock.Lock()
+		defer change.lock.Unlock()
+		// A later change may have replaced this one.
+		if change.timer == timer {
+			revert()
+		}
+	})
+	change.timer = timer
+	change.until = time.Now().Add(d)
+	return change.until
+}
+
+// End a temporary change of the log level. Must be called with change.lock
+// held.
+func revert() {
+	change.timer.Stop()
+	change.timer = nil
+	change.until = time.Time{}
+	SetLevel(change.saved)
+	log.Printf("log level back to %s", LevelName(change.saved))
+}
+
+// Current returns the current log level, and when it will change back if it
+// was changed temporarily, or the zero time.
+func Current() (int32, time.Time) {
+	change.lock.Lock()
+	defer change.lock.Unlock()
+	return atomic.LoadInt32(&level), change.until
+}
+
+// ToggleDebug turns debug logging on for DebugDuration, or, if the log level
+// was already changed temporarily, changes it back now. This is what SIGHUP
+// does.
+func ToggleDebug() {
+	change.lock.Lock()
+	defer change.lock.Unlock()
+	if change.timer != nil {
+		revert()
+	} else {
+		changeLocked(Debug, DebugDuration)
+	}
+}
+
+// Debugf logs verbose traces, useful only when debugging.
+func Debugf(format string, v ...interface{}) {
+	if Enabled(Debug) {
+		log.Printf(format, v...)
+	}
+}
+
+// Infof logs routine events.
+func Infof(format string, v ...interface{}) {
+	if Enabled(Info) {
+		log.Printf(format, v...)
+	}
+}
+
+// Warnf logs errors that don't stop the program.
+func Warnf(format string, v ...interface{}) {
+	if Enabled(Warn) {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected int32
+	}{
+		{"debug", Debug},
+		{"info", Info},
+		{"warn", Warn},
+	} {
+		l, err := ParseLevel(test.input)
+		if err != nil || l != test.expected {
+			t.Errorf("%q → (%d, %v), expected (%d, nil)", test.input, l, err, test.expected)
+		}
+		if name := LevelName(l); name != test.input {
+			t.Errorf("%d: name %q", l, name)
+		}
+	}
+	for _, input := range []string{"", "DEBUG", "error", "verbose"} {
+		_, err := ParseLevel(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetLevel(level)
+
+	SetLevel(Info)
+	if Enabled(Debug) {
+		t.Errorf("debug enabled at info level")
+	}
+	if !Enabled(Info) || !Enabled(Warn) {
+		t.Errorf("info or warn disabled at info level")
+	}
+}
+
+func TestChange(t *testing.T) {
+	defer SetLevel(level)
+	SetLevel(Info)
+
+	// Temporary changes in a row go back to the level before the first.
+	Change(Debug, time.Hour)
+	until := Change(Warn, 50*time.Millisecond)
+	if l, u := Current(); l != Warn || !u.Equal(until) || until.IsZero() {
+		t.Errorf("temporary change: level %d until %v", l, u)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l, u := Current()
+		if l == Info && u.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("level %d until %v after the change ended", l, u)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A permanent change ends a temporary one.
+	Change(Debug, time.Hour)
+	if until := Change(Warn, 0); !until.IsZero() {
+		t.Errorf("permanent change until %v", until)
+	}
+	if l, u := Current(); l != Warn || !u.IsZero() {
+		t.Errorf("permanent change: level %d until %v", l, u)
+	}
+
+	ToggleDebug()
+	if l, u := Current(); l != Debug || u.IsZero() {
+		t.Errorf("toggled on: level %d until %v", l, u)
+	}
+	ToggleDebug()
+	if l, u := Current(); l != Warn || !u.IsZero() {
+		t.Errorf("toggled off: level %d until %v", l, u)
+	}
+}
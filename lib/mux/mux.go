@@ -0,0 +1,518 @@
+// Package mux implements a simple stream multiplexer, which meek-client and
+// meek-server use with --mux to carry many connections over one meek session.
+//
+// The multiplexer runs over any reliable byte stream, and sends frames:
+//
+//	version  1 byte, version
+//	command  1 byte
+//	length   2 bytes, big-endian: the length of the payload
+//	stream   4 bytes, big-endian: the stream id
+//	payload  length bytes
+//
+// The commands are
+//
+//	SYN  open a new stream (only the client opens streams; their ids are odd)
+//	PSH  data for a stream
+//	UPD  give back receive window: the payload is a 4-byte big-endian count of
+//	     bytes read
+//	EOF  half-close a stream: the sender will send no more, but still reads
+//	FIN  close a stream: the sender will neither send nor read any more
+//
+// Each stream has a receive window of window bytes. A sender has no more than
+// that in flight on a stream until the receiver gives it back with UPD, after
+// reading the data, so that a stream whose reader is slow can't hold up the
+// others.
+//
+// Frames are queued and written together, up to writeBuffer bytes at a time,
+// so that a reader of the connection (such as a meek session reading for one
+// HTTP body) gets many frames in one Read.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	version = 1
+
+	cmdSYN = 0
+	cmdFIN = 1
+	cmdPSH = 2
+	cmdUPD = 3
+	cmdEOF = 4
+
+	headerLen = 8
+	// The largest payload of a PSH frame.
+	maxFrame = 16 * 1024
+	// The receive window of each stream.
+	window = 256 * 1024
+	// How many opened streams may wait for Accept.
+	acceptBacklog = 256
+	// The most bytes of frames that may be queued for writing.
+	writeBuffer = 256 * 1024
+)
+
+// ErrClosed is returned by operations on a closed Session.
+var ErrClosed = errors.New("mux session closed")
+
+// Session multiplexes streams over a connection.
+type Session struct {
+	conn io.ReadWriteCloser
+	// Frames queued for sendLoop, and whether it has stopped.
+	writeLock    sync.Mutex
+	writeCond    *sync.Cond
+	pending      []byte
+	writeStopped bool
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	// Why the peer's frames were refused, if they were.
+	err error
+
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession starts a Session over conn. Only a client may open streams; only
+// a server may accept them.
+func NewSession(conn io.ReadWriteCloser, client bool) *Session {
+	sess := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		closed:  make(chan struct{}),
+	}
+	sess.writeCond = sync.NewCond(&sess.writeLock)
+	if !client {
+		sess.accept = make(chan *Stream, acceptBacklog)
+	}
+	go sess.recvLoop()
+	go sess.sendLoop()
+	return sess
+}
+
+// Make the header of a frame.
+func makeHeader(cmd byte, id uint32, length int) [headerLen]byte {
+	var header [headerLen]byte
+	header[0] = version
+	header[1] = cmd
+	binary.BigEndian.PutUint16(header[2:4], uint16(length))
+	binary.BigEndian.PutUint32(header[4:8], id)
+	return header
+}
+
+// Parse the header of a frame. Fails if the version is unknown.
+func parseHeader(header [headerLen]byte) (cmd byte, id uint32, length int, err error) {
+	if header[0] != version {
+		return 0, 0, 0, fmt.Errorf("unknown version %d", header[0])
+	}
+	return header[1], binary.BigEndian.Uint32(header[4:8]), int(binary.BigEndian.Uint16(header[2:4])), nil
+}
+
+// Queue one frame for writing, waiting while the queue is full.
+func (sess *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	header := makeHeader(cmd, id, len(payload))
+
+	sess.writeLock.Lock()
+	defer sess.writeLock.Unlock()
+	for len(sess.pending) >= writeBuffer && !sess.writeStopped {
+		sess.writeCond.Wait()
+	}
+	if sess.writeStopped {
+		return ErrClosed
+	}
+	sess.pending = append(sess.pending, header[:]...)
+	sess.pending = append(sess.pending, payload...)
+	sess.writeCond.Broadcast()
+	return nil
+}
+
+// Write queued frames until the session is closed. A write error closes the
+// session.
+func (sess *Session) sendLoop() {
+	defer sess.Close()
+	for {
+		sess.writeLock.Lock()
+		for len(sess.pending) == 0 && !sess.writeStopped {
+			sess.writeCond.Wait()
+		}
+		if sess.writeStopped {
+			sess.writeLock.Unlock()
+			return
+		}
+		buf := sess.pending
+		sess.pending = nil
+		sess.writeCond.Broadcast()
+		sess.writeLock.Unlock()
+
+		_, err := sess.conn.Write(buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read and dispatch frames until the connection fails or the peer breaks the
+// protocol. This never waits to write, so that it can't block on a peer that
+// is itself blocked writing to us.
+func (sess *Session) recvLoop() {
+	defer sess.Close()
+	r := bufio.NewReader(sess.conn)
+	var header [headerLen]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return
+		}
+		cmd, id, length, err := parseHeader(header)
+		if err != nil {
+			sess.setErr(err)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return
+		}
+		err = sess.dispatch(cmd, id, payload)
+		if err != nil {
+			sess.setErr(err)
+			return
+		}
+	}
+}
+
+// Remember why the session is being closed.
+func (sess *Session) setErr(err error) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.err = err
+}
+
+// Act on one received frame.
+func (sess *Session) dispatch(cmd byte, id uint32, payload []byte) error {
+	if cmd == cmdSYN {
+		if sess.accept == nil || id%2 != 1 {
+			return fmt.Errorf("unexpected SYN for stream %d", id)
+		}
+		sess.lock.Lock()
+		if _, ok := sess.streams[id]; ok {
+			sess.lock.Unlock()
+			return fmt.Errorf("SYN for open stream %d", id)
+		}
+		stream := newStream(sess, id)
+		sess.streams[id] = stream
+		sess.lock.Unlock()
+		select {
+		case sess.accept <- stream:
+		default:
+			// Too many waiting; refuse the stream.
+			go stream.Close()
+		}
+		return nil
+	}
+
+	sess.lock.Lock()
+	stream := sess.streams[id]
+	sess.lock.Unlock()
+	if stream == nil {
+		// Frames for a stream closed at both ends may still be on the
+		// way.
+		return nil
+	}
+	switch cmd {
+	case cmdPSH:
+		return stream.push(payload)
+	case cmdUPD:
+		if len(payload) != 4 {
+			return fmt.Errorf("UPD with %d-byte payload", len(payload))
+		}
+		stream.addCredit(int(binary.BigEndian.Uint32(payload)))
+	case cmdEOF:
+		stream.remoteCloseWrite()
+	case cmdFIN:
+		stream.remoteClose()
+	default:
+		return fmt.Errorf("unknown command %d", cmd)
+	}
+	return nil
+}
+
+// Open a new stream.
+func (sess *Session) Open() (*Stream, error) {
+	sess.lock.Lock()
+	select {
+	case <-sess.closed:
+		sess.lock.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	id := sess.nextID
+	sess.nextID += 2
+	stream := newStream(sess, id)
+	sess.streams[id] = stream
+	sess.lock.Unlock()
+	err := sess.writeFrame(cmdSYN, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (sess *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-sess.accept:
+		return stream, nil
+	case <-sess.closed:
+		return nil, ErrClosed
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (sess *Session) NumStreams() int {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return len(sess.streams)
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (sess *Session) Done() <-chan struct{} {
+	return sess.closed
+}
+
+// Err returns the protocol error that closed the session, or nil if it was
+// closed for another reason or is still open.
+func (sess *Session) Err() error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return sess.err
+}
+
+// Close the session, its connection, and all its streams.
+func (sess *Session) Close() error {
+	sess.closeOnce.Do(func() {
+		close(sess.closed)
+		sess.writeLock.Lock()
+		sess.writeStopped = true
+		sess.pending = nil
+		sess.writeCond.Broadcast()
+		sess.writeLock.Unlock()
+		sess.conn.Close()
+		sess.lock.Lock()
+		defer sess.lock.Unlock()
+		for _, stream := range sess.streams {
+			stream.sessionClose()
+		}
+	})
+	return nil
+}
+
+// Forget a stream that is closed at both ends.
+func (sess *Session) remove(id uint32) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	delete(sess.streams, id)
+}
+
+// Stream is one stream of a Session. It is an io.ReadWriteCloser.
+type Stream struct {
+	sess *Session
+	id   uint32
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// Received data not yet read, and data read but not yet given back
+	// to the sender with UPD.
+	buf      []byte
+	consumed int
+	// How much more we may send.
+	credit int
+	// Whether CloseWrite has been called, Close has been called, the
+	// peer has sent EOF, the peer has sent FIN, and the session has
+	// closed.
+	localWriteClosed  bool
+	localClosed       bool
+	remoteWriteClosed bool
+	remoteClosed      bool
+	sessionClosed     bool
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	stream := &Stream{sess: sess, id: id, credit: window}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+// Session returns the session the stream belongs to.
+func (stream *Stream) Session() *Session {
+	return stream.sess
+}
+
+// Read data. Returns io.EOF once the peer has closed the stream, or closed it
+// for writing, and all its data has been read.
+func (stream *Stream) Read(p []byte) (int, error) {
+	stream.lock.Lock()
+	for len(stream.buf) == 0 && !stream.localClosed && !stream.remoteWriteClosed && !stream.remoteClosed && !stream.sessionClosed {
+		stream.cond.Wait()
+	}
+	switch {
+	case stream.localClosed:
+		stream.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	case len(stream.buf) > 0:
+	case stream.remoteWriteClosed || stream.remoteClosed:
+		stream.lock.Unlock()
+		return 0, io.EOF
+	default:
+		stream.lock.Unlock()
+		return 0, ErrClosed
+	}
+	n := copy(p, stream.buf)
+	stream.buf = stream.buf[n:]
+	stream.consumed += n
+	update := 0
+	if stream.consumed >= window/2 {
+		update, stream.consumed = stream.consumed, 0
+	}
+	stream.lock.Unlock()
+	if update > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(update))
+		stream.sess.writeFrame(cmdUPD, stream.id, payload[:])
+	}
+	return n, nil
+}
+
+// Is the stream closed for writing, at either end? Called with the stream lock
+// held.
+func (stream *Stream) writeClosed() bool {
+	return stream.localWriteClosed || stream.localClosed || stream.remoteClosed || stream.sessionClosed
+}
+
+// Write data, waiting for window as needed.
+func (stream *Stream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		stream.lock.Lock()
+		for stream.credit == 0 && !stream.writeClosed() {
+			stream.cond.Wait()
+		}
+		if stream.writeClosed() {
+			stream.lock.Unlock()
+			return total, io.ErrClosedPipe
+		}
+		n := min(len(p), stream.credit, maxFrame)
+		stream.credit -= n
+		stream.lock.Unlock()
+		err := stream.sess.writeFrame(cmdPSH, stream.id, p[:n])
+		if err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// CloseWrite closes the stream for writing, telling the peer, which reads EOF
+// once it has read the data sent before. The stream may still be read, and
+// must still be closed with Close.
+func (stream *Stream) CloseWrite() error {
+	stream.lock.Lock()
+	if stream.writeClosed() {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.localWriteClosed = true
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+	err := stream.sess.writeFrame(cmdEOF, stream.id, nil)
+	if err == ErrClosed {
+		err = nil
+	}
+	return err
+}
+
+// Close the stream, telling the peer.
+func (stream *Stream) Close() error {
+	stream.lock.Lock()
+	if stream.localClosed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	stream.buf = nil
+	stream.cond.Broadcast()
+	remoteClosed := stream.remoteClosed
+	stream.lock.Unlock()
+	if remoteClosed {
+		stream.sess.remove(stream.id)
+	}
+	err := stream.sess.writeFrame(cmdFIN, stream.id, nil)
+	if err == ErrClosed {
+		err = nil
+	}
+	return err
+}
+
+// Add received data, which must fit in the window.
+func (stream *Stream) push(data []byte) error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.remoteWriteClosed {
+		return fmt.Errorf("data for stream %d after EOF", stream.id)
+	}
+	if stream.localClosed {
+		return nil
+	}
+	if len(stream.buf)+stream.consumed+len(data) > window {
+		return fmt.Errorf("stream %d overflowed its window", stream.id)
+	}
+	stream.buf = append(stream.buf, data...)
+	stream.cond.Broadcast()
+	return nil
+}
+
+// Take back window given back by the peer.
+func (stream *Stream) addCredit(n int) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.credit += n
+	stream.cond.Broadcast()
+}
+
+// Note that the peer has closed the stream for writing.
+func (stream *Stream) remoteCloseWrite() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.remoteWriteClosed = true
+	stream.cond.Broadcast()
+}
+
+// Note that the peer has closed the stream.
+func (stream *Stream) remoteClose() {
+	stream.lock.Lock()
+	stream.remoteClosed = true
+	stream.cond.Broadcast()
+	localClosed := stream.localClosed
+	stream.lock.Unlock()
+	if localClosed {
+		stream.sess.remove(stream.id)
+	}
+}
+
+// Note that the session has closed. Called with the session lock held.
+func (stream *Stream) sessionClose() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.sessionClosed = true
+	stream.cond.Broadcast()
+}
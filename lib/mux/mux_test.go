@@ -0,0 +1,295 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return a client and a server Session connected to each other.
+func newPair(t *testing.T) (*Session, *Session) {
+	c, s := net.Pipe()
+	client := NewSession(c, true)
+	server := NewSession(s, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// Many streams carry data both ways at once, each more than a window.
+func TestStreams(t *testing.T) {
+	client, server := newPair(t)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	const numStreams = 10
+	const size = 3*window + 1234
+	var wg sync.WaitGroup
+	errs := make(chan error, numStreams)
+	for i := 0; i < numStreams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := client.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			data := bytes.Repeat([]byte{byte(i)}, size)
+			go stream.Write(data)
+			got := make([]byte, size)
+			_, err = io.ReadFull(stream, got)
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: %s", i, err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("stream %d: wrong data", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// A stream whose reader doesn't read doesn't hold up the others.
+func TestStreamWindow(t *testing.T) {
+	client, server := newPair(t)
+	stalled, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalledServer, _ := server.Accept()
+	done := make(chan struct{})
+	go func() {
+		// Blocks once the window is full.
+		stalled.Write(make([]byte, 2*window))
+		close(done)
+	}()
+
+	other, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherServer, _ := server.Accept()
+	go other.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(otherServer, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("write of two windows finished without a reader")
+	default:
+	}
+
+	// Reading the stalled stream lets the write finish.
+	io.CopyN(io.Discard, stalledServer, 2*window)
+	<-done
+}
+
+// Closing a stream gives the peer EOF after the data sent before, and ends
+// writes in both directions.
+func TestStreamClose(t *testing.T) {
+	client, server := newPair(t)
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+	stream.Write([]byte("last words"))
+	stream.Close()
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "last words" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := peer.Write([]byte("x")); err == nil {
+		t.Errorf("write to a stream closed by the peer succeeded")
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Errorf("write to a closed stream succeeded")
+	}
+	peer.Close()
+	// Closed at both ends, the stream is forgotten.
+	for i := 0; client.NumStreams() != 0 || server.NumStreams() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d and %d streams after close", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Closing a stream for writing gives the peer EOF, but data still flows the
+// other way.
+func TestStreamCloseWrite(t *testing.T) {
+	client, server := newPair(t)
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+	stream.Write([]byte("request"))
+	stream.CloseWrite()
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Errorf("write to a stream closed for writing succeeded")
+	}
+	go func() {
+		peer.Write([]byte("response"))
+		peer.Close()
+	}()
+	got, err = io.ReadAll(stream)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	stream.Close()
+	for i := 0; client.NumStreams() != 0 || server.NumStreams() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d and %d streams after close", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Closing the session ends its streams.
+func TestSessionClose(t *testing.T) {
+	client, server := newPair(t)
+	stream, _ := client.Open()
+	server.Accept()
+	errc := make(chan error)
+	go func() {
+		_, err := stream.Read(make([]byte, 10))
+		errc <- err
+	}()
+	server.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("read succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read not unblocked")
+	}
+	<-client.Done()
+	if _, err := client.Open(); err == nil {
+		t.Errorf("opened a stream on a closed session")
+	}
+}
+
+// A peer that breaks the protocol has its session closed.
+func TestProtocolError(t *testing.T) {
+	for _, frame := range [][]byte{
+		// Unknown version.
+		{2, cmdSYN, 0, 0, 0, 0, 0, 1},
+		// Even stream id.
+		{version, cmdSYN, 0, 0, 0, 0, 0, 2},
+		// Unknown command on an open stream.
+		{version, 9, 0, 0, 0, 0, 0, 1},
+		// Data after EOF.
+		{version, cmdEOF, 0, 0, 0, 0, 0, 1, version, cmdPSH, 0, 1, 0, 0, 0, 1, 'x'},
+	} {
+		c, s := net.Pipe()
+		server := NewSession(s, false)
+		go func() {
+			c.Write([]byte{version, cmdSYN, 0, 0, 0, 0, 0, 1})
+			c.Write(frame)
+		}()
+		go io.Copy(io.Discard, c)
+		select {
+		case <-server.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("%x: session not closed", frame)
+		}
+		if server.Err() == nil {
+			t.Errorf("%x: no error", frame)
+		}
+		c.Close()
+		server.Close()
+	}
+}
+
+func FuzzHeader(f *testing.F) {
+	f.Add(byte(cmdPSH), uint32(1), uint16(maxFrame))
+	f.Add(byte(0xff), uint32(0xffffffff), uint16(0xffff))
+	f.Fuzz(func(t *testing.T, cmd byte, id uint32, length uint16) {
+		header := makeHeader(cmd, id, int(length))
+		c, i, n, err := parseHeader(header)
+		if err != nil || c != cmd || i != id || n != int(length) {
+			t.Fatalf("%d %d %d: got %d %d %d %v", cmd, id, length, c, i, n, err)
+		}
+		header[0]++
+		if _, _, _, err := parseHeader(header); err == nil {
+			t.Fatalf("version %d accepted", header[0])
+		}
+	})
+}
+
+// fuzzConn is a connection that reads from a Reader and discards what is
+// written to it.
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (fuzzConn) Close() error {
+	return nil
+}
+
+// A server session given any input ends when the input does, or sooner.
+func FuzzSession(f *testing.F) {
+	frame := func(cmd byte, id uint32, payload []byte) []byte {
+		header := makeHeader(cmd, id, len(payload))
+		return append(header[:], payload...)
+	}
+	f.Add([]byte{})
+	f.Add(frame(cmdSYN, 1, nil))
+	f.Add(bytes.Join([][]byte{
+		frame(cmdSYN, 1, nil),
+		frame(cmdPSH, 1, []byte("hello")),
+		frame(cmdUPD, 1, []byte{0, 0, 1, 0}),
+		frame(cmdFIN, 1, nil),
+		frame(cmdPSH, 1, []byte("late")),
+	}, nil))
+	f.Add(bytes.Join([][]byte{
+		frame(cmdSYN, 1, nil),
+		frame(cmdEOF, 1, nil),
+		frame(cmdPSH, 1, []byte("after EOF")),
+	}, nil))
+	f.Add(frame(cmdSYN, 2, nil))
+	f.Add(append(frame(cmdSYN, 1, nil), frame(cmdSYN, 1, nil)...))
+	f.Add(append(frame(cmdSYN, 1, nil), frame(cmdUPD, 1, []byte{1})...))
+	f.Add(append(frame(cmdSYN, 1, nil), frame(9, 1, nil)...))
+	f.Add(frame(cmdPSH, 1, bytes.Repeat([]byte{0}, 10)))
+	f.Add([]byte{version + 1, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{version, cmdPSH, 0xff, 0xff, 0, 0, 0, 1, 'x'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sess := NewSession(fuzzConn{bytes.NewReader(data)}, false)
+		defer sess.Close()
+		select {
+		case <-sess.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session still open at the end of its input")
+		}
+	})
+}
@@ -0,0 +1,4 @@
+// Package parent watches the process that started this one, for the
+// --exit-with-parent option of meek-client and meek-server, which is for
+// launchers that don't close the transport's stdin when they exit.
+package parent
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package parent
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// How often to check whether the parent process has exited.
+const parentPollInterval = time.Second
+
+// Replaced in tests.
+var getppid = os.Getppid
+
+// WaitExit blocks until the process that started this one exits. There's no
+// way to wait on a process that is not a child, so poll the parent PID: when
+// the parent exits, the process is reparented (to init or a subreaper) and the
+// parent PID changes.
+func WaitExit() error {
+	ppid := getppid()
+	if ppid == 1 {
+		return errors.New("parent process is init")
+	}
+	for getppid() == ppid {
+		time.Sleep(parentPollInterval)
+	}
+	return nil
+}
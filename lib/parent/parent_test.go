@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package parent
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitParentExit(t *testing.T) {
+	defer func() { getppid = os.Getppid }()
+	var ppid atomic.Int64
+	ppid.Store(1000)
+	getppid = func() int { return int(ppid.Load()) }
+
+	done := make(chan error, 1)
+	go func() {
+		done <- WaitExit()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("returned while the parent was alive: %v", err)
+	case <-time.After(parentPollInterval * 2):
+	}
+	// Reparented to init.
+	ppid.Store(1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(parentPollInterval * 3):
+		t.Errorf("didn't return after the parent exited")
+	}
+
+	// Already orphaned: nothing to watch.
+	if err := WaitExit(); err == nil {
+		t.Errorf("no error with init as the parent")
+	}
+}
@@ -0,0 +1,20 @@
+package parent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// WaitExit blocks until the process that started this one exits, by waiting
+// on a handle to it.
+func WaitExit() error {
+	ppid := os.Getppid()
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(ppid))
+	if err != nil {
+		return fmt.Errorf("opening parent process %d: %s", ppid, err)
+	}
+	defer syscall.CloseHandle(h)
+	_, err = syscall.WaitForSingleObject(h, syscall.INFINITE)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+// The code in this file backs off from fronts that are rate-limiting us. A CDN
+// edge that answers 429 Too Many Requests or 503 Service Unavailable, often
+// with a Retry-After header, wants fewer requests, and keeps penalizing a
+// client that goes on sending them. Such a status puts the front (the host the
+// request was sent to) in backoff for the time Retry-After asks for, or, if
+// there is none, for retryDelay, doubling with every further such status up to
+// maxBackoff. Until the backoff is over, no session sends requests to the
+// front, and a front selector (see fronts.go) prefers other fronts. A 200
+// status ends the doubling.
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// The longest backoff, whatever Retry-After says.
+const maxBackoff = 15 * time.Minute
+
+// frontBackoff keeps the backoff state of fronts.
+type frontBackoff struct {
+	lock sync.Mutex
+	// When each front's backoff is over, and how many rate-limiting
+	// statuses in a row it has sent.
+	until   map[string]time.Time
+	strikes map[string]int
+}
+
+// The backoff state of all fronts.
+var frontBackoffs = newFrontBackoff()
+
+func newFrontBackoff() *frontBackoff {
+	return &frontBackoff{
+		until:   make(map[string]time.Time),
+		strikes: make(map[string]int),
+	}
+}
+
+// Is status one with which an edge asks for fewer requests?
+func isRateLimitStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// Parse a Retry-After header value: a number of seconds, or an HTTP date.
+// Returns false if there is no usable value.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(maxBackoff/time.Second) {
+			return maxBackoff, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// Record the response from front to a request. Returns the backoff that a
+// rate-limiting status starts, or 0.
+func (b *frontBackoff) Update(front string, resp *http.Response, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !isRateLimitStatus(resp.StatusCode) {
+		if resp.StatusCode == http.StatusOK {
+			delete(b.strikes, front)
+		}
+		return 0
+	}
+	b.strikes[front]++
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		d = retryDelay
+		for i := 1; i < b.strikes[front] && d < maxBackoff; i++ {
+			d *= 2
+		}
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	if until := now.Add(d); until.After(b.until[front]) {
+		b.until[front] = until
+	}
+	return d
+}
+
+// Return how long front's backoff still lasts at now, or 0 if it is over.
+func (b *frontBackoff) Remaining(front string, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	until, ok := b.until[front]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(b.until, front)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// Wait, timed by clock, until front's backoff is over. Returns an error if ctx
+// is canceled first.
+func (b *frontBackoff) Wait(ctx context.Context, front string, clock Clock) error {
+	for {
+		d := b.Remaining(front, clock.Now())
+		if d <= 0 {
+			return nil
+		}
+		logging.Debugf("%s is rate-limiting; waiting %.f seconds", front, d.Seconds())
+		select {
+		case <-clock.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value string
+		d     time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"86400", maxBackoff, true},
+		{"Wed, 01 May 2024 12:01:30 GMT", 90 * time.Second, true},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	} {
+		d, ok := parseRetryAfter(test.value, now)
+		if d != test.d || ok != test.ok {
+			t.Errorf("%q: got %v, %v", test.value, d, ok)
+		}
+	}
+}
+
+func statusResponse(status int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestFrontBackoffUpdate(t *testing.T) {
+	b := newFrontBackoff()
+	now := time.Now()
+	// Without Retry-After, the backoff doubles with each status.
+	for i, expected := range []time.Duration{retryDelay, 2 * retryDelay, 4 * retryDelay} {
+		if d := b.Update("a.example", statusResponse(http.StatusTooManyRequests, ""), now); d != expected {
+			t.Errorf("strike %d: backoff %v, expected %v", i+1, d, expected)
+		}
+	}
+	if d := b.Remaining("a.example", now); d != 4*retryDelay {
+		t.Errorf("remaining %v", d)
+	}
+	if d := b.Remaining("b.example", now); d != 0 {
+		t.Errorf("other front: remaining %v", d)
+	}
+	// Retry-After is used as given, but doesn't shorten a backoff.
+	if d := b.Update("a.example", statusResponse(http.StatusServiceUnavailable, "5"), now); d != 5*time.Second {
+		t.Errorf("Retry-After: backoff %v", d)
+	}
+	if d := b.Remaining("a.example", now); d != 4*retryDelay {
+		t.Errorf("remaining %v after a shorter Retry-After", d)
+	}
+	// Other statuses don't start a backoff, and 200 starts the doubling
+	// over.
+	if d := b.Update("a.example", statusResponse(http.StatusNotFound, ""), now); d != 0 {
+		t.Errorf("404: backoff %v", d)
+	}
+	b.Update("a.example", statusResponse(http.StatusOK, ""), now)
+	if d := b.Update("a.example", statusResponse(http.StatusTooManyRequests, ""), now); d != retryDelay {
+		t.Errorf("after 200: backoff %v", d)
+	}
+	if d := b.Remaining("a.example", now.Add(time.Hour)); d != 0 {
+		t.Errorf("remaining %v after the backoff", d)
+	}
+}
+
+// A RoundTripper that returns the given responses in turn.
+type sequenceRoundTripper struct {
+	responses []*http.Response
+	times     []time.Time
+}
+
+func (rt *sequenceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.times = append(rt.times, time.Now())
+	resp := rt.responses[0]
+	rt.responses = rt.responses[1:]
+	resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	return resp, nil
+}
+
+// roundTripRetries waits as long as Retry-After says before trying again,
+// and requests to the front wait out the backoff.
+func TestRoundTripRetriesRetryAfter(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	rt := &sequenceRoundTripper{responses: []*http.Response{
+		statusResponse(http.StatusTooManyRequests, "1"),
+		statusResponse(http.StatusOK, ""),
+	}}
+	req, _ := http.NewRequest("POST", "https://front.example/", nil)
+	resp, err := roundTripRetries(rt, systemClock{}, req, maxTries)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+	if d := rt.times[1].Sub(rt.times[0]); d < time.Second || d > retryDelay/2 {
+		t.Errorf("tried again after %v", d)
+	}
+
+	// A request to a front in backoff waits, and gives up if canceled.
+	frontBackoffs.Update("front.example", statusResponse(http.StatusTooManyRequests, "60"), time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "POST", "https://front.example/", nil)
+	if _, err := roundTripRetries(rt, systemClock{}, req, maxTries); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+	if len(rt.times) != 2 {
+		t.Errorf("sent a request during the backoff")
+	}
+}
+
+// The front selector passes over a front in backoff.
+func TestFrontSelectorBackoff(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	sel := newFrontSelector([]string{"a.example", "b.example"}, "", "https", nil)
+	now := time.Now()
+	sel.results["a.example"] = frontResult{Healthy: true, Successes: 10, RTT: 10 * time.Millisecond, Checked: now}
+	sel.results["b.example"] = frontResult{Healthy: true, Successes: 10, RTT: 100 * time.Millisecond, Checked: now}
+	if best := sel.Best(); best != "a.example" {
+		t.Errorf("best %q", best)
+	}
+	frontBackoffs.Update("a.example", statusResponse(http.StatusTooManyRequests, ""), now)
+	if best := sel.Best(); best != "b.example" {
+		t.Errorf("best %q during a.example's backoff", best)
+	}
+}
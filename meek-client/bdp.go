@@ -0,0 +1,128 @@
+package main
+
+// The code in this file sizes a session's requests to the path's
+// bandwidth-delay product (BDP). On a long fronted path, one 64 KiB request per
+// round trip caps throughput at 64 KiB per RTT, however fast the path. We
+// measure each session's round-trip time and the goodput it achieves (payload
+// bytes in both directions per second), and aim to keep about twice their
+// product in flight: first by reading larger chunks from the local connection
+// for each request, up to the payload size negotiated with the server, and
+// then, for pipelining sessions, by having more requests in flight, up to
+// --pipeline. The factor of two lets the window grow while the goodput keeps
+// up with it, and it stops growing once the path is full. An idle or
+// interactive session shrinks back to small chunks and one request in flight.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// The smallest chunk and window.
+	bdpMinChunk = 16 * 1024
+	// How much more than the estimated BDP to keep in flight.
+	bdpGain = 2
+	// How much the maximum goodput decays at each new sample, so that the
+	// estimate follows a path that gets slower.
+	bdpRateDecay = 0.9
+	// How long a minimum RTT is kept before being measured again, in case
+	// the path has changed.
+	bdpMinRTTLifetime = 10 * time.Second
+	// The shortest window over which to measure goodput.
+	bdpMinSampleWindow = 10 * time.Millisecond
+	// How much a new RTT counts for in the smoothed RTT.
+	bdpRTTWeight = 0.125
+)
+
+// bdpEstimator keeps RTT and goodput measurements for one session, and the
+// window (bytes in flight) computed from them. It is safe for concurrent use.
+// A nil *bdpEstimator doesn't adapt: it always gives the largest chunk and
+// number of requests allowed.
+type bdpEstimator struct {
+	now func() time.Time
+
+	lock sync.Mutex
+	// Smoothed RTT, and the smallest RTT since minRTTTime.
+	srtt       time.Duration
+	minRTT     time.Duration
+	minRTTTime time.Time
+	// Bytes delivered since sampleStart, for the current goodput sample.
+	sampleStart time.Time
+	sampleBytes int64
+	// The decayed maximum goodput, in bytes per second.
+	maxRate float64
+	// The target number of bytes in flight.
+	window int
+}
+
+// Make a bdpEstimator with an initial window of window bytes.
+func newBDPEstimator(window int) *bdpEstimator {
+	return &bdpEstimator{now: time.Now, window: max(window, bdpMinChunk)}
+}
+
+// Record a completed request that was sent at start and carried n payload
+// bytes in both directions together.
+func (est *bdpEstimator) Record(start time.Time, n int64) {
+	if est == nil {
+		return
+	}
+	est.lock.Lock()
+	defer est.lock.Unlock()
+	now := est.now()
+	rtt := now.Sub(start)
+	if est.srtt == 0 {
+		est.srtt = rtt
+	} else {
+		est.srtt = time.Duration((1-bdpRTTWeight)*float64(est.srtt) + bdpRTTWeight*float64(rtt))
+	}
+	if est.minRTT == 0 || rtt < est.minRTT || now.Sub(est.minRTTTime) > bdpMinRTTLifetime {
+		est.minRTT = rtt
+		est.minRTTTime = now
+	}
+
+	if est.sampleStart.IsZero() {
+		est.sampleStart = start
+	}
+	est.sampleBytes += n
+	elapsed := now.Sub(est.sampleStart)
+	if elapsed < max(est.srtt, bdpMinSampleWindow) {
+		return
+	}
+	rate := float64(est.sampleBytes) / elapsed.Seconds()
+	est.maxRate = max(rate, est.maxRate*bdpRateDecay)
+	est.sampleStart = now
+	est.sampleBytes = 0
+
+	bdp := est.maxRate * est.minRTT.Seconds()
+	est.window = max(int(bdpGain*bdp), bdpMinChunk)
+}
+
+// Return the number of bytes to read from the local connection for one
+// request, given the largest the server accepts, and the number of requests
+// in flight allowed.
+func (est *bdpEstimator) ChunkSize(maxChunk, maxInFlight int) int {
+	if est == nil {
+		return maxChunk
+	}
+	est.lock.Lock()
+	defer est.lock.Unlock()
+	n := est.inFlight(maxChunk, maxInFlight)
+	return min(max((est.window+n-1)/n, bdpMinChunk), maxChunk)
+}
+
+// Return the number of requests to have in flight, given the largest chunk the
+// server accepts and the most requests allowed in flight.
+func (est *bdpEstimator) InFlight(maxChunk, maxInFlight int) int {
+	if est == nil {
+		return maxInFlight
+	}
+	est.lock.Lock()
+	defer est.lock.Unlock()
+	return est.inFlight(maxChunk, maxInFlight)
+}
+
+// Like InFlight, but with the lock held: the window in chunks of the largest
+// size, rounded up.
+func (est *bdpEstimator) inFlight(maxChunk, maxInFlight int) int {
+	return min(max((est.window+maxChunk-1)/maxChunk, 1), maxInFlight)
+}
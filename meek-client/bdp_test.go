@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Simulate a path with the given RTT and bandwidth (bytes per second), keeping
+// est's window in flight, for the given number of round trips. Returns the
+// final window.
+func simulateBDP(est *bdpEstimator, now *time.Time, rtt time.Duration, bandwidth float64, rounds int) int {
+	for i := 0; i < rounds; i++ {
+		start := *now
+		// What the path carries in one RTT is the smaller of the window
+		// and the BDP.
+		n := min(float64(est.window), bandwidth*rtt.Seconds())
+		*now = now.Add(rtt)
+		est.Record(start, int64(n))
+	}
+	return est.window
+}
+
+func TestBDPEstimatorGrowsToBDP(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	est := newBDPEstimator(maxPayloadLength)
+	est.now = func() time.Time { return now }
+
+	// 200 ms and 5 MB/s: a BDP of 1 MB.
+	const bdp = 1000000
+	window := simulateBDP(est, &now, 200*time.Millisecond, 5000000, 50)
+	if window < bdp || window > 3*bdp {
+		t.Errorf("window %d for a BDP of %d", window, bdp)
+	}
+	if n := est.InFlight(maxPayloadLength, 8); n != 8 {
+		t.Errorf("%d in flight with 64 KiB chunks", n)
+	}
+	if n := est.InFlight(1<<20, 8); n < 1 || n > 3 {
+		t.Errorf("%d in flight with 1 MiB chunks", n)
+	}
+	if size := est.ChunkSize(1<<20, 8); size*est.InFlight(1<<20, 8) < bdp {
+		t.Errorf("chunk size %d too small", size)
+	}
+
+	// Idle, the window shrinks back to the minimum.
+	window = simulateBDP(est, &now, 200*time.Millisecond, 0, 100)
+	if window != bdpMinChunk {
+		t.Errorf("idle window %d", window)
+	}
+	if n := est.InFlight(maxPayloadLength, 8); n != 1 {
+		t.Errorf("%d in flight when idle", n)
+	}
+	if size := est.ChunkSize(maxPayloadLength, 8); size != bdpMinChunk {
+		t.Errorf("chunk size %d when idle", size)
+	}
+}
+
+// A short, slow path doesn't get a large window.
+func TestBDPEstimatorSmallPath(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	est := newBDPEstimator(maxPayloadLength * 8)
+	est.now = func() time.Time { return now }
+	// 20 ms and 1 MB/s: a BDP of 20 kB.
+	window := simulateBDP(est, &now, 20*time.Millisecond, 1000000, 50)
+	if window > 3*20000 {
+		t.Errorf("window %d for a BDP of 20000", window)
+	}
+	if n := est.InFlight(maxPayloadLength, 8); n != 1 {
+		t.Errorf("%d in flight", n)
+	}
+}
+
+func TestBDPEstimatorNil(t *testing.T) {
+	var est *bdpEstimator
+	est.Record(time.Now(), 100)
+	if size := est.ChunkSize(maxPayloadLength, 4); size != maxPayloadLength {
+		t.Errorf("chunk size %d", size)
+	}
+	if n := est.InFlight(maxPayloadLength, 4); n != 4 {
+		t.Errorf("%d in flight", n)
+	}
+}
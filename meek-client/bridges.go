@@ -0,0 +1,148 @@
+package main
+
+// The code in this file has to do with fetching a list of url/front
+// combinations from an operator at startup (--bridges-url), so that endpoints
+// can be rotated without reconfiguring every client.
+//
+// The list is a JSON document signed with Ed25519. What is served at the
+// bridges URL is an envelope
+//
+//	{"payload": "<base64 JSON>", "signature": "<base64 signature of payload>"}
+//
+// and the payload, once its signature is verified against the key given with
+// --bridges-key, is
+//
+//	{"expires": "2026-01-02T15:04:05Z", "bridges": [{"url": "https://forbidden.example/", "front": "allowed.example"}, ...]}
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// The largest bridge list document we will accept.
+	maxBridgesLength = 1 << 20
+	// How long we wait for the bridge list to download.
+	bridgesFetchTimeout = 60 * time.Second
+)
+
+// One url/front combination.
+type bridgeSpec struct {
+	URL   string `json:"url"`
+	Front string `json:"front,omitempty"`
+}
+
+type bridgesEnvelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type bridgesPayload struct {
+	Expires time.Time    `json:"expires"`
+	Bridges []bridgeSpec `json:"bridges"`
+}
+
+// Parse a base64-encoded Ed25519 public key.
+func parseBridgesKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad bridges key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bridges key has length %d, not %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Verify and decode a signed bridge list. now is used to check the expiry
+// time.
+func parseBridges(data []byte, key ed25519.PublicKey, now time.Time) ([]bridgeSpec, error) {
+	var envelope bridgesEnvelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("bad payload encoding: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("bad signature encoding: %s", err)
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	var p bridgesPayload
+	err = json.Unmarshal(payload, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(p.Expires) {
+		return nil, fmt.Errorf("bridge list expired at %s", p.Expires)
+	}
+	if len(p.Bridges) == 0 {
+		return nil, fmt.Errorf("bridge list is empty")
+	}
+	for _, bridge := range p.Bridges {
+		u, err := url.Parse(bridge.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("bridge URL %q is not http or https", bridge.URL)
+		}
+	}
+	return p.Bridges, nil
+}
+
+// Download and verify the bridge list at u using rt. If front is not "", the
+// domain in u is replaced by front, as for ordinary requests.
+func fetchBridges(u *url.URL, front string, rt http.RoundTripper, key ed25519.PublicKey) ([]bridgeSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bridgesFetchTimeout)
+	defer cancel()
+
+	fetchURL := *u
+	if front != "" {
+		fetchURL.Host = front
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fetchURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = u.Host
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code was %d, not %d", resp.StatusCode, http.StatusOK)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBridgesLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBridgesLength {
+		return nil, fmt.Errorf("bridge list is longer than %d bytes", maxBridgesLength)
+	}
+	return parseBridges(data, key, time.Now())
+}
+
+// Return a random bridge from the list, or nil if the list is empty.
+func pickBridge(bridges []bridgeSpec) *bridgeSpec {
+	if len(bridges) == 0 {
+		return nil
+	}
+	return &bridges[rand.Intn(len(bridges))]
+}
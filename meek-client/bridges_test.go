@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Make a signed bridge list envelope.
+func signBridges(t *testing.T, priv ed25519.PrivateKey, p *bridgesPayload) []byte {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&bridgesEnvelope{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseBridges(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	good := &bridgesPayload{
+		Expires: now.Add(24 * time.Hour),
+		Bridges: []bridgeSpec{
+			{URL: "https://forbidden.example/", Front: "allowed.example"},
+			{URL: "https://other.example/"},
+		},
+	}
+
+	bridges, err := parseBridges(signBridges(t, priv, good), pub, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 2 || bridges[0] != good.Bridges[0] || bridges[1] != good.Bridges[1] {
+		t.Errorf("got %+v", bridges)
+	}
+
+	// Wrong key.
+	_, err = parseBridges(signBridges(t, priv, good), otherPub, now)
+	if err == nil {
+		t.Errorf("wrong key: unexpectedly succeeded")
+	}
+	// Expired.
+	_, err = parseBridges(signBridges(t, priv, good), pub, now.Add(48*time.Hour))
+	if err == nil {
+		t.Errorf("expired: unexpectedly succeeded")
+	}
+	// Empty.
+	_, err = parseBridges(signBridges(t, priv, &bridgesPayload{Expires: good.Expires}), pub, now)
+	if err == nil {
+		t.Errorf("empty: unexpectedly succeeded")
+	}
+	// Bad URL scheme.
+	_, err = parseBridges(signBridges(t, priv, &bridgesPayload{
+		Expires: good.Expires,
+		Bridges: []bridgeSpec{{URL: "ftp://forbidden.example/"}},
+	}), pub, now)
+	if err == nil {
+		t.Errorf("bad scheme: unexpectedly succeeded")
+	}
+	// Tampered payload.
+	var envelope bridgesEnvelope
+	json.Unmarshal(signBridges(t, priv, good), &envelope)
+	envelope.Payload = base64.StdEncoding.EncodeToString([]byte(`{"expires":"2030-01-01T00:00:00Z","bridges":[{"url":"https://evil.example/"}]}`))
+	data, _ := json.Marshal(&envelope)
+	_, err = parseBridges(data, pub, now)
+	if err == nil {
+		t.Errorf("tampered: unexpectedly succeeded")
+	}
+}
+
+func TestParseBridgesKey(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, err := parseBridgesKey(base64.StdEncoding.EncodeToString(pub))
+	if err != nil || !key.Equal(pub) {
+		t.Errorf("got (%v, %v)", key, err)
+	}
+	for _, input := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err := parseBridgesKey(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestFetchBridges(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	data := signBridges(t, priv, &bridgesPayload{
+		Expires: time.Now().Add(time.Hour),
+		Bridges: []bridgeSpec{{URL: "https://forbidden.example/", Front: "allowed.example"}},
+	})
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+		w.Write(data)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	// Fronted: connect to the test server, with the Host header of the
+	// bridges URL.
+	u, _ := url.Parse("http://bridges.example/list.json")
+	bridges, err := fetchBridges(u, serverURL.Host, http.DefaultTransport, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 1 || bridges[0].Front != "allowed.example" {
+		t.Errorf("got %+v", bridges)
+	}
+	if host != "bridges.example" {
+		t.Errorf("Host was %q", host)
+	}
+}
+
+func TestMakeRequestInfoBridges(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://configured.example/"
+	options.Front = "configured-front.example"
+	options.Pipeline = 1
+	options.Bridges = []bridgeSpec{{URL: "https://bridge.example/", Front: "bridge-front.example"}}
+
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL.Host != "bridge-front.example" || info.Host != "bridge.example" {
+		t.Errorf("got URL %s, Host %q", info.URL, info.Host)
+	}
+
+	// A url= SOCKS arg overrides the bridge list.
+	info, err = makeRequestInfo(map[string][]string{"url": {"https://arg.example/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL.Host != "configured-front.example" || info.Host != "arg.example" {
+		t.Errorf("got URL %s, Host %q", info.URL, info.Host)
+	}
+
+	// A bridge without a front is not fronted.
+	options.Bridges = []bridgeSpec{{URL: "https://bridge.example/"}}
+	info, err = makeRequestInfo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL.Host != "bridge.example" || info.Host != "" {
+		t.Errorf("got URL %s, Host %q", info.URL, info.Host)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+// The code in this file describes the build that is running, for --version
+// and the startup log line (see lib/buildinfo). The git commit and build date
+// are set at link time by the Makefile:
+//	go build -ldflags "-X main.gitCommit=COMMIT -X main.buildDate=DATE"
+
+import (
+	"../lib/buildinfo"
+)
+
+// Set with -ldflags -X.
+var (
+	gitCommit string
+	buildDate string
+)
+
+// Return the buildinfo.Info of the running program.
+func getBuildInfo() buildinfo.Info {
+	return buildinfo.Get(programVersion, gitCommit, buildDate)
+}
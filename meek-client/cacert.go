@@ -0,0 +1,59 @@
+package main
+
+// The code in this file has to do with which server certificates the client
+// trusts, for lab and enterprise deployments whose servers (or fronts, or
+// HTTPS proxies) have certificates from a private CA, or self-signed ones.
+// --cacert trusts the CA certificates in a PEM bundle instead of the system's.
+// --insecure trusts any certificate at all; anyone on the path can then
+// intercept the traffic, so it is for test setups only, and a warning is
+// logged whenever it is on. Neither applies to --helper, where the browser
+// checks certificates.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+var (
+	// The CAs to trust instead of the system's, or nil for the system's.
+	rootCAs *x509.CertPool
+	// Whether not to check server certificates at all.
+	insecureSkipVerify bool
+)
+
+// Read a bundle of PEM CA certificates from filename.
+func loadCACerts(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+// Return a new crypto/tls Config with the certificate checks and key log (see
+// keylog.go) of command-line options.
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: insecureSkipVerify,
+		KeyLogWriter:       keyLogWriter,
+	}
+}
+
+// Like newTLSConfig, but for uTLS. Each connection needs a Config of its own,
+// because uTLS changes the Config it is given.
+func newUTLSConfig() *utls.Config {
+	return &utls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: insecureSkipVerify,
+		KeyLogWriter:       keyLogWriter,
+	}
+}
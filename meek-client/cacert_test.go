@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// A proxy.Dialer that connects to one address, whatever address it is given.
+type fixedDialer string
+
+func (d fixedDialer) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, string(d))
+}
+
+func TestLoadCACerts(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := loadCACerts(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("missing file unexpectedly succeeded")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate\n"), 0644)
+	if _, err := loadCACerts(empty); err == nil {
+		t.Errorf("file without certificates unexpectedly succeeded")
+	}
+}
+
+// Connections with crypto/tls and uTLS trust the --cacert CAs, and anything
+// with --insecure, but not a self-signed certificate otherwise.
+func TestCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	pool, err := loadCACerts(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedRootCAs, savedInsecure := rootCAs, insecureSkipVerify
+	defer func() { rootCAs, insecureSkipVerify = savedRootCAs, savedInsecure }()
+	for _, test := range []struct {
+		name     string
+		setup    func()
+		expected bool
+	}{
+		{"system roots", func() {}, false},
+		{"cacert", func() { rootCAs = pool }, true},
+		{"insecure", func() { insecureSkipVerify = true }, true},
+	} {
+		rootCAs, insecureSkipVerify = nil, false
+		test.setup()
+
+		cfg := newTLSConfig()
+		// A name in the test server's certificate.
+		cfg.ServerName = "example.com"
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if (err == nil) != test.expected {
+			t.Errorf("%s: crypto/tls: got %v", test.name, err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+
+		uconn, err := dialUTLS("tcp", "example.com:443", nil, &utls.HelloChrome_Auto, fixedDialer(addr), false)
+		if (err == nil) != test.expected {
+			t.Errorf("%s: uTLS: got %v", test.name, err)
+		}
+		if err == nil {
+			uconn.Close()
+		}
+	}
+}
+
+// Each uTLS connection gets a Config of its own, because uTLS sets the server
+// name in it.
+func TestNewUTLSConfig(t *testing.T) {
+	a, b := newUTLSConfig(), newUTLSConfig()
+	if a == b {
+		t.Errorf("shared Config")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// The code in this file makes the configuration hash of fault reports, which
+// identifies a configuration without revealing it. Secrets are left out of the
+// hash, because a short hash of a low-entropy secret could be reversed by
+// trying every value.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+)
+
+// Flags whose values are secret. Only whether they are set goes into the
+// hash.
+var secretFlags = map[string]bool{
+	"credential": true,
+}
+
+// Flags whose values are URLs, which may have a user name and password in
+// them.
+var urlFlags = map[string]bool{
+	"bridges-url": true,
+	"doh-url":     true,
+	"proxy":       true,
+	"url":         true,
+}
+
+// Return the value of flag f with any secrets removed.
+func redactedFlagValue(f *flag.Flag) string {
+	value := f.Value.String()
+	switch {
+	case secretFlags[f.Name]:
+		if value != "" {
+			return "set"
+		}
+	case urlFlags[f.Name]:
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			u.User = nil
+			return u.String()
+		}
+	}
+	return value
+}
+
+// Return a short hash of the values of all flags, set or not, with secrets
+// removed.
+func hashConfig(flags *flag.FlagSet) string {
+	h := sha256.New()
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%q\n", f.Name, redactedFlagValue(f))
+	})
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
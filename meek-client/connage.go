@@ -0,0 +1,180 @@
+package main
+
+// The code in this file implements --conn-max-age, which rotates the
+// connections that requests are sent on. Some CDNs silently stop forwarding
+// data on connections that have been open for a few minutes, and a session
+// whose requests go on such a connection stalls. With a maximum age, a
+// connection that has been open longer is closed as soon as no request is
+// using it, so that the next request makes a new one; a connection that is
+// never unused (an HTTP/2 connection shared by busy sessions) is closed
+// anyway at twice the maximum age, and the requests on it fail.
+//
+// The connection a request uses is learned through httptrace, so this works
+// the same with net/http, HTTP/2, h2c, and uTLS transports. The age of a
+// connection counts from the first request that used it. Requests through
+// --helper are not affected.
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// The longest time between checks for connections over the maximum age.
+const maxConnAgeSweepInterval = 10 * time.Second
+
+// The requests using a connection, and when it was first used.
+type connAgeState struct {
+	born     time.Time
+	requests int
+}
+
+// connAger closes connections over a maximum age. A nil *connAger closes
+// nothing.
+type connAger struct {
+	maxAge time.Duration
+	now    func() time.Time
+
+	lock  sync.Mutex
+	conns map[net.Conn]*connAgeState
+}
+
+// The connAger for --conn-max-age, or nil if it was not given. Set up in main.
+var connAging *connAger
+
+func newConnAger(maxAge time.Duration) *connAger {
+	return &connAger{
+		maxAge: maxAge,
+		now:    time.Now,
+		conns:  make(map[net.Conn]*connAgeState),
+	}
+}
+
+// Return rt wrapped so that the connections its requests use are rotated.
+func (a *connAger) Wrap(rt http.RoundTripper) http.RoundTripper {
+	if a == nil {
+		return rt
+	}
+	return &agingRoundTripper{ager: a, rt: rt}
+}
+
+// Note that a request is using conn.
+func (a *connAger) use(conn net.Conn) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	state := a.conns[conn]
+	if state == nil {
+		state = &connAgeState{born: a.now()}
+		a.conns[conn] = state
+	}
+	state.requests++
+}
+
+// Note that a request is done with conn, and close conn if it is unused and
+// over the maximum age.
+func (a *connAger) release(conn net.Conn) {
+	a.lock.Lock()
+	state := a.conns[conn]
+	if state == nil {
+		a.lock.Unlock()
+		return
+	}
+	state.requests--
+	age := a.now().Sub(state.born)
+	retire := state.requests <= 0 && age >= a.maxAge
+	if retire {
+		delete(a.conns, conn)
+	}
+	a.lock.Unlock()
+	if retire {
+		logging.Debugf("rotating connection to %s after %.f s", conn.RemoteAddr(), age.Seconds())
+		// Closing a TLS connection writes an alert, which may block
+		// for a while on a connection that is not getting through.
+		go conn.Close()
+	}
+}
+
+// Close the unused connections over the maximum age, and all over twice the
+// maximum age. This also forgets connections that were closed by someone
+// else. Returns the number closed.
+func (a *connAger) sweep() int {
+	now := a.now()
+	var closing []net.Conn
+	a.lock.Lock()
+	for conn, state := range a.conns {
+		age := now.Sub(state.born)
+		if (state.requests <= 0 && age >= a.maxAge) || age >= 2*a.maxAge {
+			if state.requests > 0 {
+				logging.Warnf("closing connection to %s with %d requests in progress after %.f s", conn.RemoteAddr(), state.requests, age.Seconds())
+			}
+			delete(a.conns, conn)
+			closing = append(closing, conn)
+		}
+	}
+	a.lock.Unlock()
+	for _, conn := range closing {
+		go conn.Close()
+	}
+	return len(closing)
+}
+
+// Sweep every interval. Never returns.
+func (a *connAger) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.sweep()
+	}
+}
+
+// Return how often to sweep for connections over maxAge.
+func connAgeSweepInterval(maxAge time.Duration) time.Duration {
+	return min(maxAge/4, maxConnAgeSweepInterval)
+}
+
+// agingRoundTripper tells a connAger which connections the requests of
+// another RoundTripper use.
+type agingRoundTripper struct {
+	ager *connAger
+	rt   http.RoundTripper
+}
+
+func (t *agingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A transport may try more than one connection for a request;
+	// only the last counts.
+	var lock sync.Mutex
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil {
+				return
+			}
+			lock.Lock()
+			prev := conn
+			conn = info.Conn
+			lock.Unlock()
+			t.ager.use(info.Conn)
+			if prev != nil {
+				t.ager.release(prev)
+			}
+		},
+	}
+	done := func() {
+		lock.Lock()
+		c := conn
+		conn = nil
+		lock.Unlock()
+		if c != nil {
+			t.ager.release(c)
+		}
+	}
+	resp, err := t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &watchedBody{ReadCloser: resp.Body, done: func(int64, error) { done() }}
+	return resp, nil
+}
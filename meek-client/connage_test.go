@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnAgerNil(t *testing.T) {
+	var a *connAger
+	if rt := a.Wrap(http.DefaultTransport); rt != http.DefaultTransport {
+		t.Errorf("nil connAger wrapped the RoundTripper")
+	}
+}
+
+func TestConnAgerSweep(t *testing.T) {
+	now := time.Now()
+	a := newConnAger(time.Minute)
+	a.now = func() time.Time { return now }
+	idle, idleFar := net.Pipe()
+	busy, busyFar := net.Pipe()
+	a.use(idle)
+	a.release(idle)
+	a.use(busy)
+
+	now = now.Add(59 * time.Second)
+	if n := a.sweep(); n != 0 {
+		t.Errorf("closed %d under the maximum age", n)
+	}
+	now = now.Add(time.Second)
+	if n := a.sweep(); n != 1 {
+		t.Errorf("closed %d at the maximum age, expected only the unused one", n)
+	}
+	if _, err := idleFar.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("unused connection not closed: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if n := a.sweep(); n != 1 {
+		t.Errorf("closed %d at twice the maximum age", n)
+	}
+	if _, err := busyFar.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("busy connection not closed: %v", err)
+	}
+	// Releasing a connection that is already gone does nothing.
+	a.release(busy)
+	if len(a.conns) != 0 {
+		t.Errorf("%d connections left", len(a.conns))
+	}
+}
+
+// A connection over the maximum age is closed after the request that is
+// using it, and the next request makes a new one.
+func TestConnAgerRotates(t *testing.T) {
+	var lock sync.Mutex
+	states := make(map[http.ConnState]int)
+	closed := make(chan struct{}, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		lock.Lock()
+		states[state]++
+		lock.Unlock()
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	now := time.Now()
+	a := newConnAger(time.Minute)
+	a.now = func() time.Time { return now }
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	rt := a.Wrap(tr)
+	get := func() {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	newConns := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return states[http.StateNew]
+	}
+
+	get()
+	get()
+	if n := newConns(); n != 1 {
+		t.Fatalf("%d connections, expected 1", n)
+	}
+	now = now.Add(time.Minute)
+	// This one still uses the old connection, and closes it after.
+	get()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("old connection not closed")
+	}
+	get()
+	if n := newConns(); n != 2 {
+		t.Errorf("%d connections, expected 2", n)
+	}
+	if len(a.conns) != 1 {
+		t.Errorf("%d connections tracked, expected 1", len(a.conns))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+// The code in this file implements cover traffic (--cover-paths). Transport
+// requests alone are a steady stream of POSTs to one path, which doesn't look
+// like anyone browsing the front domain. With cover traffic, each session also
+// fetches real assets of the front domain (images, scripts, style sheets),
+// interleaved with its transport requests, in the pattern of page loads: a
+// burst of a few GETs at once, then a pause. The bursts are a Poisson process
+// with mean interval --cover-interval, and each has between 1 and --cover-burst
+// requests. Cover requests go through the same RoundTripper, so they share
+// connections with transport requests. Normally they carry the front's own
+// Host header and so are answered by the front; with --cover-to-server, they
+// carry the Host of transport requests and are answered by meek-server, which
+// must be run with the same paths in its --cover-paths. The responses are
+// discarded.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The most response body read from any one cover request.
+	maxCoverBodyLength = 4 << 20
+	// Requests in a burst start up to this long after the first, as a
+	// browser fetches assets as it finds them in a page.
+	coverBurstSpread = 500 * time.Millisecond
+)
+
+// coverModel describes when and what to fetch as cover traffic.
+type coverModel struct {
+	// Paths of assets on the front domain (or on meek-server).
+	Paths []string
+	// The mean time between bursts.
+	Interval time.Duration
+	// The most requests in one burst.
+	Burst int
+	// Send cover requests to meek-server rather than to the front.
+	ToServer bool
+}
+
+// Parse the comma-separated --cover-paths list.
+func parseCoverPaths(s string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("cover path %q does not start with \"/\"", p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// Return a random time until the next burst.
+func (model *coverModel) nextDelay(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(model.Interval))
+}
+
+// Return a random set of paths for one burst.
+func (model *coverModel) burstPaths(r *rand.Rand) []string {
+	n := 1
+	if model.Burst > 1 {
+		n += r.Intn(model.Burst)
+	}
+	if n > len(model.Paths) {
+		n = len(model.Paths)
+	}
+	paths := make([]string, n)
+	for i, j := range r.Perm(len(model.Paths))[:n] {
+		paths[i] = model.Paths[j]
+	}
+	return paths
+}
+
+// Fetch path from the front domain of info, or from meek-server if toServer,
+// and discard the response.
+func fetchCover(ctx context.Context, info *RequestInfo, path string, toServer bool) error {
+	u := *info.URL
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if toServer && info.Host != "" {
+		req.Host = info.Host
+	}
+	resp, err := info.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxCoverBodyLength))
+	return err
+}
+
+// Send bursts of cover requests for the session described by info until ctx is
+// canceled.
+func (model *coverModel) Run(ctx context.Context, info *RequestInfo) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		timer := time.NewTimer(model.nextDelay(r))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		for i, path := range model.burstPaths(r) {
+			var delay time.Duration
+			if i > 0 {
+				delay = time.Duration(r.Int63n(int64(coverBurstSpread)))
+			}
+			go func(path string, delay time.Duration) {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+				err := fetchCover(ctx, info, path, model.ToServer)
+				if err != nil && ctx.Err() == nil {
+					logging.Debugf("cover request for %s: %s", path, err)
+				}
+			}(path, delay)
+		}
+	}
+}
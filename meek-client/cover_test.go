@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCoverPaths(t *testing.T) {
+	paths, err := parseCoverPaths("/favicon.ico, /static/app.js,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/favicon.ico", "/static/app.js"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("got %q, expected %q", paths, expected)
+	}
+	if _, err := parseCoverPaths("favicon.ico"); err == nil {
+		t.Errorf("relative path accepted")
+	}
+}
+
+func TestCoverModelBurstPaths(t *testing.T) {
+	model := &coverModel{Paths: []string{"/a", "/b", "/c"}, Interval: time.Second, Burst: 5}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		paths := model.burstPaths(r)
+		if len(paths) < 1 || len(paths) > len(model.Paths) {
+			t.Fatalf("burst of %d paths", len(paths))
+		}
+		seen := make(map[string]bool)
+		for _, p := range paths {
+			if seen[p] {
+				t.Fatalf("path %q repeated in %q", p, paths)
+			}
+			seen[p] = true
+		}
+	}
+}
+
+func TestCoverModelNextDelay(t *testing.T) {
+	model := &coverModel{Interval: 10 * time.Second}
+	r := rand.New(rand.NewSource(1))
+	var total time.Duration
+	const n = 10000
+	for i := 0; i < n; i++ {
+		total += model.nextDelay(r)
+	}
+	if mean := total / n; mean < 9*time.Second || mean > 11*time.Second {
+		t.Errorf("mean delay %s, expected about %s", mean, model.Interval)
+	}
+}
+
+func TestFetchCover(t *testing.T) {
+	type request struct{ method, path, host string }
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- request{req.Method, req.URL.Path, req.Host}
+		w.Write([]byte("GIF89a"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/meek/?x=1")
+
+	info := &RequestInfo{URL: u, Host: "meek.example", RoundTripper: http.DefaultTransport}
+	err := fetchCover(context.Background(), info, "/img/logo.gif", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cover requests go to the front itself, not to the Host of
+	// transport requests.
+	if r := <-requests; r != (request{"GET", "/img/logo.gif", u.Host}) {
+		t.Errorf("got %+v", r)
+	}
+
+	// Unless they are for the server.
+	err = fetchCover(context.Background(), info, "/img/logo.gif", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-requests; r != (request{"GET", "/img/logo.gif", "meek.example"}) {
+		t.Errorf("to server: got %+v", r)
+	}
+}
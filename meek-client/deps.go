@@ -0,0 +1,40 @@
+package main
+
+// The code in this file has to do with the things a session depends on that
+// can be replaced, by anything embedding the client or by tests. A session's
+// requests go through RequestInfo.RoundTripper, which is normally chosen by
+// chooseRoundTripper but may be any http.RoundTripper, such as an in-memory
+// server. Its poll intervals, retry delays, backoff waits, and round-trip
+// times are timed by RequestInfo.Clock, which main sets to the system clock;
+// a test can use a clock that only moves when told to, to step through
+// retries without waiting for them.
+
+import (
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	Now() time.Time
+	// Return a channel that gets the time after d.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the operating system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Return info.Clock, or the system clock if it is nil.
+func (info *RequestInfo) clock() Clock {
+	if info.Clock == nil {
+		return systemClock{}
+	}
+	return info.Clock
+}
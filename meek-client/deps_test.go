@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose timers only fire when the test says. Every
+// After sends the timer on waits.
+type fakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), waits: make(chan fakeWait, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.waits <- fakeWait{d: d, c: ch}
+	return ch
+}
+
+// Wait for the next timer, check that it is for d, and fire it.
+func (c *fakeClock) expect(t *testing.T, d time.Duration) {
+	t.Helper()
+	var w fakeWait
+	select {
+	case w = <-c.waits:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no timer, expected one of %s", d)
+	}
+	if w.d != d {
+		t.Fatalf("timer of %s, expected %s", w.d, d)
+	}
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.lock.Unlock()
+	w.c <- now
+}
+
+// roundTripRetries waits retryDelay between tries, on the given clock.
+func TestRoundTripRetriesClock(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	clock := newFakeClock()
+	rt := &sequenceRoundTripper{responses: []*http.Response{
+		statusResponse(http.StatusInternalServerError, ""),
+		statusResponse(http.StatusBadGateway, ""),
+		statusResponse(http.StatusOK, ""),
+	}}
+	req, _ := http.NewRequest("POST", "https://front.example/", nil)
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := roundTripRetries(rt, clock, req, maxTries)
+		done <- result{resp, err}
+	}()
+	clock.expect(t, retryDelay)
+	clock.expect(t, retryDelay)
+	r := <-done
+	if r.err != nil || r.resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v", r.resp, r.err)
+	}
+	if len(rt.times) != 3 {
+		t.Errorf("%d tries", len(rt.times))
+	}
+}
+
+// A front's backoff is waited out on the given clock.
+func TestRoundTripRetriesBackoffClock(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	clock := newFakeClock()
+	rt := &sequenceRoundTripper{responses: []*http.Response{
+		statusResponse(http.StatusTooManyRequests, "30"),
+		statusResponse(http.StatusOK, ""),
+	}}
+	req, _ := http.NewRequest("POST", "https://front.example/", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := roundTripRetries(rt, clock, req, maxTries)
+		done <- err
+	}()
+	clock.expect(t, 30*time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.times) != 2 {
+		t.Errorf("%d tries", len(rt.times))
+	}
+}
+
+// The polling interval grows by pollIntervalMultiplier while the session is
+// idle, up to maxPollInterval; drops to 0 after data; and starts over from
+// initPollInterval.
+func TestCopyLoopPollIntervals(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	clock := newFakeClock()
+	local, remote := net.Pipe()
+	u, _ := url.Parse("http://example.com/")
+	info := &RequestInfo{
+		SessionID:    "session",
+		URL:          u,
+		RoundTripper: statusRoundTripper(http.StatusOK),
+		Clock:        clock,
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- copyLoop(remote, info)
+	}()
+
+	interval := initPollInterval
+	for {
+		clock.expect(t, interval)
+		if interval == maxPollInterval {
+			break
+		}
+		interval = min(time.Duration(float64(interval)*pollIntervalMultiplier), maxPollInterval)
+	}
+	clock.expect(t, maxPollInterval)
+	// Data arrives during the wait.
+	w := <-clock.waits
+	if w.d != maxPollInterval {
+		t.Fatalf("timer of %s", w.d)
+	}
+	local.Write([]byte("data"))
+	clock.expect(t, 0)
+	clock.expect(t, initPollInterval)
+
+	local.Close()
+	if err := <-errChan; err != nil {
+		t.Errorf("copyLoop returned %v", err)
+	}
+}
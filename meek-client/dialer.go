@@ -0,0 +1,118 @@
+package main
+
+// The code in this file has to do with how outgoing connections (to the
+// server, the front, or an upstream proxy) are made: how host names are
+// resolved, from which local address, and, on Linux, with which firewall
+// mark. Policy-routing setups and VPN apps use these to keep the transport's
+// own traffic from being routed back into a tunnel that it is carrying.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"../lib/bindaddr"
+	"../lib/logging"
+)
+
+// The dialer used for all outgoing connections except those to the helper.
+// The timeouts are those of http.DefaultTransport.
+var outboundDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// cachingDialer dials with a net.Dialer, resolving host names through a
+// dnsCache if there is one.
+type cachingDialer struct {
+	dialer *net.Dialer
+	cache  *dnsCache
+}
+
+// The dialer for all outgoing connections except those to the helper. Its
+// cache is set up in main.
+var outbound = &cachingDialer{dialer: outboundDialer}
+
+func (d *cachingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// Leak protection; see strict.go. This comes before anything that
+	// might resolve addr's host name.
+	if strictGuard != nil {
+		err := strictGuard.Check(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Domain shadowing; see shadow.go. The address actually connected to
+	// is checked too, before it is resolved.
+	if target := connectOverrides.Lookup(addr); target != addr {
+		if strictGuard != nil {
+			err := strictGuard.Check(target)
+			if err != nil {
+				return nil, err
+			}
+		}
+		logging.Debugf("connecting to %s for %s", target, addr)
+		addr = target
+	}
+	if d.cache == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := d.cache.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// Try each address in turn, like net.Dialer does.
+	err = fmt.Errorf("no addresses for %s", host)
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// Set up outboundDialer to bind to bindAddr (if not "") and to set the
+// firewall mark fwmark (if not 0) on its sockets.
+func configureOutboundDialer(bindAddr string, fwmark int) error {
+	if bindAddr != "" {
+		ip, err := bindaddr.Resolve(bindAddr)
+		if err != nil {
+			return err
+		}
+		outboundDialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if fwmark != 0 {
+		if !fwmarkSupported {
+			return fmt.Errorf("setting a firewall mark is not supported on this platform")
+		}
+		outboundDialer.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setFwmark(fd, fwmark)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("setting SO_MARK: %s", sockErr)
+			}
+			return nil
+		}
+	}
+	return nil
+}
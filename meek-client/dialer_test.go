@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConfigureOutboundDialer(t *testing.T) {
+	saved := *outboundDialer
+	defer func() { *outboundDialer = saved }()
+
+	err := configureOutboundDialer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outboundDialer.Control != nil {
+		t.Errorf("Control set without a fwmark")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := outboundDialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("connection is from %v", ip)
+	}
+
+	err = configureOutboundDialer("", 1234)
+	if fwmarkSupported != (err == nil) {
+		t.Errorf("fwmarkSupported %v, got error %v", fwmarkSupported, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+// The code in this file implements an in-process cache of DNS answers for the
+// host names we connect to (the front domain, or a proxy). Every session would
+// otherwise do its own lookups. The cache also keeps answers around past their
+// freshness, so that if a later lookup fails (for example because of DNS
+// interference), the last answer that worked can be reused.
+//
+// Go's resolver does not expose record TTLs, so freshness is set by
+// configuration rather than by the DNS records themselves.
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// Defaults for the --dns-min-ttl, --dns-max-ttl, and --dns-negative-ttl
+// options.
+const (
+	defaultDNSMinTTL      = 1 * time.Minute
+	defaultDNSMaxTTL      = 1 * time.Hour
+	defaultDNSNegativeTTL = 10 * time.Second
+)
+
+type dnsEntry struct {
+	ips []net.IP
+	err error
+	// Until this time, the entry is used without a new lookup.
+	fresh time.Time
+	// Until this time, a successful answer may be reused if a new lookup
+	// fails.
+	stale time.Time
+}
+
+type dnsCache struct {
+	// How long an answer is used before looking up again.
+	minTTL time.Duration
+	// How long a successful answer may be reused when lookups fail.
+	maxTTL time.Duration
+	// How long a failed lookup is remembered.
+	negativeTTL time.Duration
+
+	// Hooks for testing.
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	now    func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache(minTTL, maxTTL, negativeTTL time.Duration) *dnsCache {
+	if maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+	return &dnsCache{
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		lookup:      lookupIP,
+		now:         time.Now,
+		entries:     make(map[string]*dnsEntry),
+	}
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Return the IP addresses for host, from the cache if there is a fresh entry,
+// otherwise from a new lookup.
+func (c *dnsCache) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	c.lock.Lock()
+	entry := c.entries[host]
+	c.lock.Unlock()
+	if entry != nil && c.now().Before(entry.fresh) {
+		return entry.ips, entry.err
+	}
+
+	ips, err := c.lookup(ctx, host)
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		if entry != nil && entry.err == nil && now.Before(entry.stale) {
+			logging.Debugf("DNS lookup for %s failed (%s); reusing previous answer", host, err)
+			return entry.ips, nil
+		}
+		// Don't remember a failure that was only our own cancellation.
+		if ctx.Err() == nil && c.negativeTTL > 0 {
+			c.entries[host] = &dnsEntry{err: err, fresh: now.Add(c.negativeTTL)}
+		}
+		return nil, err
+	}
+	c.entries[host] = &dnsEntry{
+		ips:   ips,
+		fresh: now.Add(c.minTTL),
+		stale: now.Add(c.maxTTL),
+	}
+	return ips, nil
+}
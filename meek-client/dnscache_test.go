@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// A dnsCache with a fake clock and a fake resolver that counts lookups and
+// returns whatever answer and error are currently set.
+type fakeResolver struct {
+	now     time.Time
+	ips     []net.IP
+	err     error
+	lookups int
+}
+
+func newTestDNSCache(r *fakeResolver) *dnsCache {
+	c := newDNSCache(time.Minute, time.Hour, 10*time.Second)
+	c.now = func() time.Time { return r.now }
+	c.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		r.lookups++
+		return r.ips, r.err
+	}
+	return c
+}
+
+func TestDNSCacheFresh(t *testing.T) {
+	r := &fakeResolver{now: time.Unix(0, 0), ips: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	c := newTestDNSCache(r)
+	for i := 0; i < 3; i++ {
+		ips, err := c.Lookup(context.Background(), "front.example")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(r.ips[0]) {
+			t.Fatalf("got (%v, %v)", ips, err)
+		}
+		r.now = r.now.Add(10 * time.Second)
+	}
+	if r.lookups != 1 {
+		t.Errorf("%d lookups, expected 1", r.lookups)
+	}
+
+	// After minTTL, look up again and take the new answer.
+	r.now = r.now.Add(time.Minute)
+	r.ips = []net.IP{net.IPv4(192, 0, 2, 2)}
+	ips, err := c.Lookup(context.Background(), "front.example")
+	if err != nil || !ips[0].Equal(r.ips[0]) || r.lookups != 2 {
+		t.Errorf("got (%v, %v) after %d lookups", ips, err, r.lookups)
+	}
+}
+
+func TestDNSCacheStale(t *testing.T) {
+	r := &fakeResolver{now: time.Unix(0, 0), ips: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	c := newTestDNSCache(r)
+	c.Lookup(context.Background(), "front.example")
+
+	// Lookups fail: reuse the old answer until maxTTL.
+	r.ips, r.err = nil, errors.New("SERVFAIL")
+	r.now = r.now.Add(30 * time.Minute)
+	ips, err := c.Lookup(context.Background(), "front.example")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("stale: got (%v, %v)", ips, err)
+	}
+
+	r.now = r.now.Add(time.Hour)
+	_, err = c.Lookup(context.Background(), "front.example")
+	if err == nil {
+		t.Errorf("expired: lookup unexpectedly succeeded")
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	r := &fakeResolver{now: time.Unix(0, 0), err: errors.New("NXDOMAIN")}
+	c := newTestDNSCache(r)
+	for i := 0; i < 3; i++ {
+		_, err := c.Lookup(context.Background(), "front.example")
+		if err == nil {
+			t.Fatalf("lookup unexpectedly succeeded")
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("%d lookups, expected 1", r.lookups)
+	}
+
+	// After negativeTTL, try again.
+	r.now = r.now.Add(11 * time.Second)
+	r.ips, r.err = []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+	ips, err := c.Lookup(context.Background(), "front.example")
+	if err != nil || len(ips) != 1 || r.lookups != 2 {
+		t.Errorf("got (%v, %v) after %d lookups", ips, err, r.lookups)
+	}
+}
+
+func TestDNSCacheCanceled(t *testing.T) {
+	r := &fakeResolver{now: time.Unix(0, 0), err: context.Canceled}
+	c := newTestDNSCache(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Lookup(ctx, "front.example")
+	// A canceled lookup must not be cached as a failure.
+	r.err = nil
+	r.ips = []net.IP{net.IPv4(192, 0, 2, 1)}
+	_, err := c.Lookup(context.Background(), "front.example")
+	if err != nil || r.lookups != 2 {
+		t.Errorf("got %v after %d lookups", err, r.lookups)
+	}
+}
+
+func TestCachingDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The first address refuses connections; the dialer must move on to
+	// the second.
+	r := &fakeResolver{now: time.Unix(0, 0), ips: []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}}
+	unused, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err == nil {
+		unused.Close()
+	} else {
+		r.ips = r.ips[1:]
+	}
+	d := &cachingDialer{dialer: &net.Dialer{}, cache: newTestDNSCache(r)}
+	conn, err := d.Dial("tcp", net.JoinHostPort("front.example", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("connected to %v", ip)
+	}
+}
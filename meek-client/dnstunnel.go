@@ -0,0 +1,295 @@
+package main
+
+// The code in this file implements the DNS carrier mode (mode=dns), a last
+// resort for when every HTTP front is blocked. The session's requests are
+// encoded in DNS queries for names under a domain whose name server is
+// meek-server (its --dns-addr and --dns-domain options), and sent through a
+// public DNS-over-HTTPS resolver (--doh-url or the doh= SOCKS arg), which
+// looks like any other use of encrypted DNS. Each round trip carries only a
+// hundred or so bytes up and a kilobyte down, so it is slow, but enough to
+// fetch new bridge lines or keep a trickle of traffic going.
+//
+// The DNS domain comes from --dns-domain or the dns-domain= SOCKS arg. The
+// url= and front= arguments are still needed, but are not used to connect.
+// The DoH requests go through --proxy and --utls like any other. See
+// meek-server's dnstunnel.go for the encoding.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/goptlib"
+	"../lib/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Carrier mode for DNS.
+	modeDNS = "dns"
+	// The DoH resolver to use if there is no --doh-url or doh= SOCKS arg.
+	defaultDoHURL = "https://dns.google/dns-query"
+	// Flags in queries.
+	dnsFlagClose = 1 << 0
+	dnsFlagMux   = 1 << 1
+	// Flags in answers.
+	dnsFlagMoreData = 1 << 0
+	// The answer size to ask for.
+	dnsResponseSize = 1232
+	// The longest domain name, in presentation format without the final
+	// dot, and the longest label.
+	dnsMaxNameLength  = 253
+	dnsMaxLabelLength = 63
+	// How many times to send a query that gets no answer, and how long to
+	// wait between tries.
+	dnsMaxTries   = 5
+	dnsRetryDelay = time.Second
+	// The media type of DoH messages (RFC 8484).
+	dnsMessageType = "application/dns-message"
+	// The length of a session's token, which the server checks on every
+	// query after the first.
+	dnsTokenLength = 8
+)
+
+// Base32 without padding, lowercase in names.
+var dnsBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Return the largest payload that fits in a query under domain, with a session
+// id of idLen bytes.
+func dnsMaxPayload(domain string, idLen int) int {
+	// Characters of base32 that fit, with a dot after every label.
+	room := dnsMaxNameLength - len(domain)
+	chars := room - (room+dnsMaxLabelLength)/(dnsMaxLabelLength+1)
+	return chars*5/8 - 6 - dnsTokenLength - idLen
+}
+
+// Return the name under domain encoding data.
+func dnsEncodeName(data []byte, domain string) string {
+	encoded := strings.ToLower(dnsBase32.EncodeToString(data))
+	var labels []string
+	for len(encoded) > dnsMaxLabelLength {
+		labels = append(labels, encoded[:dnsMaxLabelLength])
+		encoded = encoded[dnsMaxLabelLength:]
+	}
+	labels = append(labels, encoded, domain)
+	return strings.Join(labels, ".") + "."
+}
+
+// dnsRoundTripper carries the requests of one session in DNS queries, sent
+// with DoH through another RoundTripper. It makes an HTTP response from each
+// answer, so that the rest of the polling code works the same.
+type dnsRoundTripper struct {
+	// The DoH resolver's URL.
+	dohURL string
+	// The domain, without the final dot.
+	domain string
+	// The RoundTripper for DoH requests.
+	rt http.RoundTripper
+	// A random token sent in every query of the session.
+	token [dnsTokenLength]byte
+
+	// Serializes requests, which must be answered in order.
+	lock sync.Mutex
+	seq  uint32
+}
+
+// Make a dnsRoundTripper for one session.
+func newDNSRoundTripper(dohURL, domain string, rt http.RoundTripper) (*dnsRoundTripper, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > dnsMaxLabelLength {
+			return nil, fmt.Errorf("bad DNS domain %q", domain)
+		}
+	}
+	// An encoded session id is shorter than twice its length in bytes.
+	if dnsMaxPayload(domain, sessionIDLength*2) < 16 {
+		return nil, fmt.Errorf("DNS domain %q is too long to leave room for data", domain)
+	}
+	if !strings.HasPrefix(dohURL, "https://") {
+		return nil, fmt.Errorf("DoH URL %q is not https", dohURL)
+	}
+	t := &dnsRoundTripper{dohURL: dohURL, domain: domain, rt: rt}
+	if _, err := rand.Read(t.token[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Send the body of req in a DNS query, and return the answer as an HTTP
+// response.
+func (t *dnsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var payload []byte
+	if req.Body != nil {
+		var err error
+		payload, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sessionID := req.Header.Get("X-Session-Id")
+	if len(payload) > dnsMaxPayload(t.domain, len(sessionID)) {
+		return nil, fmt.Errorf("payload of %d bytes is too large for a DNS query", len(payload))
+	}
+	var flags byte
+	if req.Header.Get("X-Session-Close") != "" {
+		flags |= dnsFlagClose
+	}
+	if req.Header.Get(muxHeader) != "" {
+		flags |= dnsFlagMux
+	}
+	data := binary.BigEndian.AppendUint32(nil, t.seq)
+	data = append(data, flags, byte(len(sessionID)))
+	data = append(data, sessionID...)
+	data = append(data, t.token[:]...)
+	data = append(data, payload...)
+	name, err := dnsmessage.NewName(dnsEncodeName(data, t.domain))
+	if err != nil {
+		return nil, err
+	}
+
+	var answer []byte
+	for try := 1; ; try++ {
+		answer, err = t.exchange(req.Context(), name)
+		if err == nil || try == dnsMaxTries {
+			break
+		}
+		logging.Debugf("DNS query %d: %s; trying again", t.seq, err)
+		select {
+		case <-time.After(dnsRetryDelay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.seq++
+
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(answer[1:])),
+		ContentLength: int64(len(answer) - 1),
+		Request:       req,
+	}
+	if answer[0]&dnsFlagMoreData != 0 {
+		resp.Header.Set(moreDataHeader, "1")
+	}
+	return resp, nil
+}
+
+// Send one DoH query for a TXT record at name, and return the joined strings
+// of the answer.
+func (t *dnsRoundTripper) exchange(ctx context.Context, name dnsmessage.Name) ([]byte, error) {
+	var id [2]byte
+	rand.Read(id[:])
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+	})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var rh dnsmessage.ResourceHeader
+	rh.SetEDNS0(dnsResponseSize, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(rh, dnsmessage.OPTResource{})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.dohURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH status code was %d, not %d", resp.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 0x10000))
+	if err != nil {
+		return nil, err
+	}
+
+	var m dnsmessage.Message
+	err = m.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response || m.ID != binary.BigEndian.Uint16(id[:]) {
+		return nil, fmt.Errorf("DoH response does not match query")
+	}
+	if m.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DNS error %v", m.RCode)
+	}
+	for _, rr := range m.Answers {
+		txt, ok := rr.Body.(*dnsmessage.TXTResource)
+		if !ok || !strings.EqualFold(rr.Header.Name.String(), name.String()) {
+			continue
+		}
+		answer := []byte(strings.Join(txt.TXT, ""))
+		if len(answer) < 1 {
+			break
+		}
+		return answer, nil
+	}
+	return nil, fmt.Errorf("no TXT answer")
+}
+
+// Set up info, with the resolver and domain from args, to carry its session
+// over DNS.
+func setupDNSMode(info *RequestInfo, args pt.Args) error {
+	// First check dns-domain= and doh= SOCKS args, then --dns-domain and
+	// --doh-url options.
+	domain, ok := args.Get("dns-domain")
+	if !ok {
+		domain = options.DNSDomain
+	}
+	if domain == "" {
+		return fmt.Errorf("mode=%s needs a dns-domain", modeDNS)
+	}
+	dohURL, ok := args.Get("doh")
+	if !ok {
+		dohURL = options.DoHURL
+	}
+	rt, err := newDNSRoundTripper(dohURL, domain, info.RoundTripper)
+	if err != nil {
+		return err
+	}
+	if strictGuard != nil {
+		u, err := url.Parse(rt.dohURL)
+		if err != nil {
+			return err
+		}
+		strictGuard.AllowURL(u, "")
+	}
+	info.RoundTripper = rt
+	info.MaxPayload = dnsMaxPayload(rt.domain, len(info.SessionID))
+	// Queries are answered one at a time, and the size of answers is fixed.
+	info.Pipeline = 1
+	info.PayloadSize = nil
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"../lib/goptlib"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testDNSDomain = "t.example.com"
+
+// A DoH resolver that answers tunnel queries itself, echoing each payload back
+// with the more-data flag set. It fails the first query it gets, to check that
+// queries are tried again. It records the sequence numbers, flags, and tokens
+// of the queries it answers.
+type testDoHServer struct {
+	lock   sync.Mutex
+	failed bool
+	seqs   []uint32
+	flags  []byte
+	tokens []string
+}
+
+func (s *testDoHServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.failed {
+		s.failed = true
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Header.Get("Content-Type") != dnsMessageType {
+		http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	var m dnsmessage.Message
+	if err := m.Unpack(body); err != nil || len(m.Questions) != 1 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	name := strings.ToUpper(strings.TrimSuffix(m.Questions[0].Name.String(), "."+testDNSDomain+"."))
+	data, err := dnsBase32.DecodeString(strings.ReplaceAll(name, ".", ""))
+	if err != nil || len(data) < 6 || len(data) < 6+int(data[5])+dnsTokenLength {
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	}
+	s.seqs = append(s.seqs, binary.BigEndian.Uint32(data))
+	s.flags = append(s.flags, data[4])
+	s.tokens = append(s.tokens, string(data[6+int(data[5]):6+int(data[5])+dnsTokenLength]))
+	payload := data[6+int(data[5])+dnsTokenLength:]
+
+	m.Response = true
+	m.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.TXTResource{TXT: []string{string([]byte{dnsFlagMoreData}), string(payload)}},
+	}}
+	m.Additionals = nil
+	resp, _ := m.Pack()
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(resp)
+}
+
+func TestDNSMaxPayload(t *testing.T) {
+	for _, domain := range []string{"t.example.com", strings.Repeat("x", 63) + "." + strings.Repeat("y", 63)} {
+		n := dnsMaxPayload(domain, 11)
+		data := make([]byte, 6+11+dnsTokenLength+n)
+		name := dnsEncodeName(data, domain)
+		if len(name) > dnsMaxNameLength+1 {
+			t.Errorf("%s: largest payload %d makes a name of %d characters", domain, n, len(name))
+		}
+		if _, err := dnsmessage.NewName(name); err != nil {
+			t.Errorf("%s: %s", domain, err)
+		}
+		if len(dnsEncodeName(append(data, make([]byte, 5)...), domain)) <= dnsMaxNameLength+1 {
+			t.Errorf("%s: largest payload %d is not the largest", domain, n)
+		}
+	}
+}
+
+func TestNewDNSRoundTripper(t *testing.T) {
+	for _, test := range []struct {
+		dohURL, domain string
+		ok             bool
+	}{
+		{defaultDoHURL, testDNSDomain, true},
+		{defaultDoHURL, testDNSDomain + ".", true},
+		{"http://dns.example/dns-query", testDNSDomain, false},
+		{defaultDoHURL, "bad..example", false},
+		{defaultDoHURL, strings.Repeat("a.", 100) + "com", false},
+	} {
+		_, err := newDNSRoundTripper(test.dohURL, test.domain, http.DefaultTransport)
+		if (err == nil) != test.ok {
+			t.Errorf("%q %q: got %v", test.dohURL, test.domain, err)
+		}
+	}
+}
+
+// Requests are carried in DoH queries, numbered in order, and answers come
+// back as responses.
+func TestDNSRoundTripper(t *testing.T) {
+	doh := &testDoHServer{}
+	server := httptest.NewTLSServer(doh)
+	defer server.Close()
+	rt, err := newDNSRoundTripper(server.URL+"/dns-query", testDNSDomain, server.Client().Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, msg := range []string{"hello", "", "goodbye"} {
+		var body io.Reader
+		if msg != "" {
+			body = strings.NewReader(msg)
+		}
+		req := httptest.NewRequest("POST", "https://meek.example/", body)
+		req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+		if i == 2 {
+			req.Header.Set("X-Session-Close", "1")
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != msg || resp.Header.Get(moreDataHeader) == "" {
+			t.Errorf("got %q, %v", got, resp.Header)
+		}
+	}
+	if len(doh.seqs) != 3 || doh.seqs[0] != 0 || doh.seqs[1] != 1 || doh.seqs[2] != 2 {
+		t.Errorf("sequence numbers %v", doh.seqs)
+	}
+	if !bytes.Equal(doh.flags, []byte{0, 0, dnsFlagClose}) {
+		t.Errorf("flags %v", doh.flags)
+	}
+	if len(doh.tokens) != 3 || doh.tokens[0] != string(rt.token[:]) || doh.tokens[1] != doh.tokens[0] || doh.tokens[2] != doh.tokens[0] {
+		t.Errorf("tokens %q", doh.tokens)
+	}
+
+	req := httptest.NewRequest("POST", "https://meek.example/", bytes.NewReader(make([]byte, 1000)))
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Errorf("oversized payload unexpectedly succeeded")
+	}
+}
+
+func TestMakeRequestInfoDNS(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 4
+	options.DoHURL = defaultDoHURL
+
+	if _, err := makeRequestInfo(pt.Args{"mode": {modeDNS}}); err == nil {
+		t.Errorf("mode=dns without a domain unexpectedly succeeded")
+	}
+	info, err := makeRequestInfo(pt.Args{"mode": {modeDNS}, "dns-domain": {testDNSDomain}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.RoundTripper.(*dnsRoundTripper); !ok {
+		t.Errorf("RoundTripper is %T", info.RoundTripper)
+	}
+	if info.Pipeline != 1 || info.MaxPayload <= 0 || info.chunkSize() > info.MaxPayload {
+		t.Errorf("pipeline %d, max payload %d, chunk size %d", info.Pipeline, info.MaxPayload, info.chunkSize())
+	}
+	if _, err := makeRequestInfo(pt.Args{"mode": {modeDNS}, "dns-domain": {testDNSDomain}, "doh": {"http://dns.example/"}}); err == nil {
+		t.Errorf("doh=http:// unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// The code in this file lets the client shut down without dropping sessions
+// mid-request. On SIGTERM or SIGINT, main closes the listeners and starts a
+// drain: every open session finishes the round trips it has in flight, writes
+// their responses to its local connection, and tells the server it is over
+// (see sendClose), instead of leaving the server to wait for it to expire.
+// main waits up to drainTimeout for that, or until another signal.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long to wait for open sessions to finish when shutting down.
+const drainTimeout = 20 * time.Second
+
+// sessionGroup keeps count of open sessions, and tells them when to finish.
+type sessionGroup struct {
+	lock sync.Mutex
+	n    int
+	// Closed when a drain starts.
+	draining chan struct{}
+	// Closed when there are no sessions left during a drain.
+	idle chan struct{}
+}
+
+// The sessions run by copyLoop.
+var openSessions = newSessionGroup()
+
+func newSessionGroup() *sessionGroup {
+	return &sessionGroup{
+		draining: make(chan struct{}),
+		idle:     make(chan struct{}),
+	}
+}
+
+// Count a new session. Returns an error if a drain has started. A successful
+// Enter must be matched by a Leave.
+func (g *sessionGroup) Enter() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.draining:
+		return fmt.Errorf("shutting down")
+	default:
+	}
+	g.n++
+	return nil
+}
+
+// Uncount a session counted by Enter.
+func (g *sessionGroup) Leave() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.n--
+	if g.n == 0 {
+		select {
+		case <-g.draining:
+			close(g.idle)
+		default:
+		}
+	}
+}
+
+// A channel that is closed when sessions should finish.
+func (g *sessionGroup) Draining() <-chan struct{} {
+	return g.draining
+}
+
+// Start a drain. Returns the number of open sessions, and a channel that is
+// closed when they have all finished. Calling Drain again returns the same
+// channel.
+func (g *sessionGroup) Drain() (int, <-chan struct{}) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.draining:
+	default:
+		close(g.draining)
+		if g.n == 0 {
+			close(g.idle)
+		}
+	}
+	return g.n, g.idle
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSessionGroup(t *testing.T) {
+	g := newSessionGroup()
+	if n, idle := newSessionGroup().Drain(); n != 0 || !isClosed(idle) {
+		t.Errorf("empty group: %d sessions", n)
+	}
+	if err := g.Enter(); err != nil {
+		t.Fatal(err)
+	}
+	if isClosed(g.Draining()) {
+		t.Errorf("draining before Drain")
+	}
+	n, idle := g.Drain()
+	if n != 1 || isClosed(idle) || !isClosed(g.Draining()) {
+		t.Errorf("Drain: %d sessions, idle %v", n, isClosed(idle))
+	}
+	if err := g.Enter(); err == nil {
+		t.Errorf("Enter during a drain succeeded")
+	}
+	g.Leave()
+	if !isClosed(idle) {
+		t.Errorf("not idle after the last Leave")
+	}
+	if _, again := g.Drain(); again != idle {
+		t.Errorf("second Drain returned another channel")
+	}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// A RoundTripper that holds requests with a body until release is closed, then
+// answers them with "reply". It answers other requests at once, with an empty
+// body. It sends every request on requests.
+type gatedRoundTripper struct {
+	requests chan *http.Request
+	release  chan struct{}
+}
+
+func (rt gatedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests <- req
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+	var reply []byte
+	if len(body) > 0 {
+		<-rt.release
+		reply = []byte("reply")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(reply)),
+	}, nil
+}
+
+// Test that copyLoop, when a drain starts, finishes the request in flight,
+// writes its response, and closes the session without waiting for the local
+// connection to close.
+func TestCopyLoopDrain(t *testing.T) {
+	defer func(g *sessionGroup) { openSessions = g }(openSessions)
+	for _, pipeline := range []int{1, 4} {
+		openSessions = newSessionGroup()
+		local, remote := net.Pipe()
+		u, _ := url.Parse("http://example.com/")
+		rt := gatedRoundTripper{make(chan *http.Request, 100), make(chan struct{})}
+		info := &RequestInfo{
+			SessionID:    "session",
+			URL:          u,
+			RoundTripper: rt,
+			Pipeline:     pipeline,
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- copyLoop(remote, info)
+		}()
+		received := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(local)
+			received <- b
+		}()
+		go io.WriteString(local, "data")
+		for req := range rt.requests {
+			if req.ContentLength > 0 {
+				break
+			}
+		}
+
+		n, idle := openSessions.Drain()
+		if n != 1 {
+			t.Errorf("pipeline %d: Drain: %d sessions", pipeline, n)
+		}
+		close(rt.release)
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Errorf("pipeline %d: copyLoop returned %v", pipeline, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pipeline %d: copyLoop did not return after the drain", pipeline)
+		}
+		if !isClosed(idle) {
+			t.Errorf("pipeline %d: not idle after copyLoop returned", pipeline)
+		}
+		remote.Close()
+		if b := <-received; string(b) != "reply" {
+			t.Errorf("pipeline %d: local connection got %q", pipeline, b)
+		}
+		close(rt.requests)
+		var last *http.Request
+		for req := range rt.requests {
+			last = req
+		}
+		if last == nil || last.Header.Get("X-Session-Close") != "1" {
+			t.Errorf("pipeline %d: last request was not a close request", pipeline)
+		}
+		local.Close()
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+// The code in this file has to do with choosing among several front domains
+// (--front with a comma-separated list). Each front is probed periodically
+// with a HEAD request for its own root page—an innocuous request that does
+// not involve the meek server—and new sessions use the healthy front with the
+// best health score. Probe results are saved to a file so that a restarted
+// client can start with a good choice rather than probing first.
+//
+// A front's health score combines its recent probe success rate with its
+// latency. Older probes count for less than recent ones, so a front that was
+// blocked and then unblocked recovers. The kind of error of the last failed
+// probe (timeout, reset, DNS, and so on) is kept as well, as a hint of how the
+// front is being blocked. At startup, the fronts are put in order of their
+// saved scores, so that the client doesn't have to learn again which fronts
+// are dead.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"../lib/goptlib"
+	"../lib/logging"
+)
+
+const (
+	// How often to probe fronts by default.
+	defaultFrontProbeInterval = 10 * time.Minute
+	// How long to wait for a probe response.
+	frontProbeTimeout = 10 * time.Second
+	// Name of the probe results file in the pluggable transport state
+	// directory.
+	frontStateFilename = "meek-fronts.json"
+	// How much the earlier probes of a front count for at each new probe.
+	frontHealthDecay = 0.8
+	// How much a new RTT counts for in the smoothed RTT.
+	frontRTTWeight = 0.3
+	// The RTT at which the latency part of the health score is one half.
+	frontRTTScale = 500 * time.Millisecond
+)
+
+// The probe history of one front.
+type frontResult struct {
+	// Time from sending the request to receiving the response header,
+	// smoothed over successful probes.
+	RTT time.Duration `json:"rtt"`
+	// Whether any HTTP response was received on the last probe.
+	Healthy bool      `json:"healthy"`
+	Checked time.Time `json:"checked"`
+	// Successful and failed probes, decayed by frontHealthDecay at each
+	// probe.
+	Successes float64 `json:"successes"`
+	Failures  float64 `json:"failures"`
+	// The kind of error of the last failed probe (see blockSignature),
+	// and when it happened.
+	LastBlock     string    `json:"last_block,omitempty"`
+	LastBlockTime time.Time `json:"last_block_time,omitempty"`
+}
+
+// Add the outcome of a probe at time now to the history.
+func (result *frontResult) record(rtt time.Duration, err error, now time.Time) {
+	result.Successes *= frontHealthDecay
+	result.Failures *= frontHealthDecay
+	result.Healthy = err == nil
+	result.Checked = now
+	if err != nil {
+		result.Failures++
+		result.LastBlock = blockSignature(err)
+		result.LastBlockTime = now
+		return
+	}
+	result.Successes++
+	if result.RTT == 0 {
+		result.RTT = rtt
+	} else {
+		result.RTT = time.Duration((1-frontRTTWeight)*float64(result.RTT) + frontRTTWeight*float64(rtt))
+	}
+}
+
+// Return the health score, between 0 and 1: the success rate (counting, as a
+// prior, one success and one failure), times a factor that decreases with the
+// RTT.
+func (result *frontResult) Score() float64 {
+	successes, failures := result.Successes, result.Failures
+	if successes == 0 && failures == 0 && result.Healthy {
+		// Saved by a version without counts.
+		successes = 1
+	}
+	rate := (successes + 1) / (successes + failures + 2)
+	return rate / (1 + float64(result.RTT)/float64(frontRTTScale))
+}
+
+// Classify a probe error by the way a censor might have caused it.
+func blockSignature(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return "certificate"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	default:
+		return "error"
+	}
+}
+
+// frontSelector keeps probe results for a list of fronts and picks the best
+// one.
+type frontSelector struct {
+	fronts []string
+	// The file to save results in, or "" not to save them.
+	statePath string
+	// Probe a front. Replaceable for tests.
+	probe func(ctx context.Context, front string) (time.Duration, error)
+
+	lock    sync.Mutex
+	results map[string]frontResult
+}
+
+// Parse a --front value: one front, or a comma-separated list.
+func parseFronts(s string) []string {
+	var fronts []string
+	for _, front := range strings.Split(s, ",") {
+		front = strings.TrimSpace(front)
+		if front != "" {
+			fronts = append(fronts, front)
+		}
+	}
+	return fronts
+}
+
+// Make a frontSelector that probes fronts by making HEAD requests with rt,
+// using the given URL scheme.
+func newFrontSelector(fronts []string, statePath string, scheme string, rt http.RoundTripper) *frontSelector {
+	return &frontSelector{
+		fronts:    fronts,
+		statePath: statePath,
+		probe: func(ctx context.Context, front string) (time.Duration, error) {
+			return probeFront(ctx, rt, scheme, front)
+		},
+		results: make(map[string]frontResult),
+	}
+}
+
+// Make a HEAD request for the root page of front and return how long it took
+// to get a response. Any response, whatever its status, shows the front is
+// reachable.
+func probeFront(ctx context.Context, rt http.RoundTripper, scheme, front string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, frontProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", scheme+"://"+front+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	resp.Body.Close()
+	return rtt, nil
+}
+
+// Return the best front: the healthy one with the highest score that is not in
+// backoff (see backoff.go); failing that, one not yet probed; failing that, the
+// one with the highest score. Ties go to the front that comes first. Returns
+// "" if there are no fronts.
+func (sel *frontSelector) Best() string {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+	best, bestScore := "", 0.0
+	unprobed := ""
+	now := time.Now()
+	for _, front := range sel.fronts {
+		result, ok := sel.results[front]
+		if !ok {
+			if unprobed == "" {
+				unprobed = front
+			}
+			continue
+		}
+		if frontBackoffs.Remaining(front, now) > 0 {
+			continue
+		}
+		if score := result.Score(); result.Healthy && (best == "" || score > bestScore) {
+			best, bestScore = front, score
+		}
+	}
+	if best != "" {
+		return best
+	}
+	if unprobed != "" {
+		return unprobed
+	}
+	if len(sel.fronts) == 0 {
+		return ""
+	}
+	best, bestScore = sel.fronts[0], -1
+	for _, front := range sel.fronts {
+		result := sel.results[front]
+		if score := result.Score(); score > bestScore {
+			best, bestScore = front, score
+		}
+	}
+	return best
+}
+
+// Replace the list of fronts (see reload.go). Results for fronts that were in
+// the old list are kept.
+func (sel *frontSelector) SetFronts(fronts []string) {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+	sel.fronts = append([]string(nil), fronts...)
+}
+
+// Probe all fronts at once, record the results, and save them.
+func (sel *frontSelector) ProbeAll(ctx context.Context) {
+	sel.lock.Lock()
+	fronts := sel.fronts
+	sel.lock.Unlock()
+	var wg sync.WaitGroup
+	for _, front := range fronts {
+		wg.Add(1)
+		go func(front string) {
+			defer wg.Done()
+			rtt, err := sel.probe(ctx, front)
+			if err != nil {
+				logging.Debugf("front %s failed probe (%s): %s", front, blockSignature(err), err)
+			} else {
+				logging.Debugf("front %s: %.0f ms", front, rtt.Seconds()*1000)
+			}
+			sel.lock.Lock()
+			result := sel.results[front]
+			result.record(rtt, err, time.Now().UTC())
+			sel.results[front] = result
+			sel.lock.Unlock()
+		}(front)
+	}
+	wg.Wait()
+	logging.Infof("probed fronts: %s; best is %s", sel, sel.Best())
+
+	if err := sel.save(); err != nil {
+		logging.Warnf("error saving front probe results: %s", err)
+	}
+}
+
+// Probe all fronts every interval, forever.
+func (sel *frontSelector) Run(interval time.Duration) {
+	for {
+		sel.ProbeAll(context.Background())
+		time.Sleep(interval)
+	}
+}
+
+// Load previously saved results for the fronts in sel, and put the fronts in
+// order of their saved scores. Results for fronts no longer configured are
+// ignored, and fronts without results keep their place relative to each other
+// after those with a healthy last probe. A missing file is not an error.
+func (sel *frontSelector) load() error {
+	if sel.statePath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(sel.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]frontResult
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("%s: %s", sel.statePath, err)
+	}
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+	for _, front := range sel.fronts {
+		if result, ok := saved[front]; ok {
+			sel.results[front] = result
+		}
+	}
+	sort.SliceStable(sel.fronts, func(i, j int) bool {
+		return sel.rank(sel.fronts[i]) > sel.rank(sel.fronts[j])
+	})
+	return nil
+}
+
+// Return a number for ordering fronts at startup: the score of a front whose
+// last probe succeeded, plus 2, so those come first; then 1 for an unprobed
+// front; then the score of a front whose last probe failed. Must be called
+// with the lock held.
+func (sel *frontSelector) rank(front string) float64 {
+	result, ok := sel.results[front]
+	switch {
+	case !ok:
+		return 1
+	case result.Healthy:
+		return 2 + result.Score()
+	default:
+		return result.Score()
+	}
+}
+
+// Save the current results, replacing the file atomically.
+func (sel *frontSelector) save() error {
+	if sel.statePath == "" {
+		return nil
+	}
+	sel.lock.Lock()
+	data, err := json.MarshalIndent(sel.results, "", "\t")
+	sel.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := sel.statePath + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, sel.statePath)
+}
+
+// Return the sorted list of fronts with their results, for logging.
+func (sel *frontSelector) String() string {
+	sel.lock.Lock()
+	defer sel.lock.Unlock()
+	fronts := append([]string(nil), sel.fronts...)
+	sort.Strings(fronts)
+	var parts []string
+	for _, front := range fronts {
+		result, ok := sel.results[front]
+		switch {
+		case !ok:
+			parts = append(parts, front+" (unprobed)")
+		case !result.Healthy:
+			parts = append(parts, fmt.Sprintf("%s (down: %s, score %.2f)", front, result.LastBlock, result.Score()))
+		default:
+			parts = append(parts, fmt.Sprintf("%s (%.0f ms, score %.2f)", front, result.RTT.Seconds()*1000, result.Score()))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Return the default path of the probe results file: in the pluggable
+// transport state directory, if running under tor; otherwise "" (not saved).
+func defaultFrontStatePath() (string, error) {
+	if os.Getenv("TOR_PT_STATE_LOCATION") == "" {
+		return "", nil
+	}
+	dir, err := pt.MakeStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, frontStateFilename), nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseFronts(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"a.example", []string{"a.example"}},
+		{"a.example, b.example,,c.example", []string{"a.example", "b.example", "c.example"}},
+	} {
+		if output := parseFronts(test.input); !reflect.DeepEqual(output, test.expected) {
+			t.Errorf("%q → %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+// Make a frontSelector whose probes return fixed results.
+func newFakeFrontSelector(fronts []string, statePath string, rtts map[string]time.Duration) *frontSelector {
+	sel := newFrontSelector(fronts, statePath, "https", nil)
+	sel.probe = func(ctx context.Context, front string) (time.Duration, error) {
+		rtt, ok := rtts[front]
+		if !ok {
+			return 0, fmt.Errorf("unreachable")
+		}
+		return rtt, nil
+	}
+	return sel
+}
+
+func TestFrontSelectorBest(t *testing.T) {
+	fronts := []string{"a.example", "b.example", "c.example"}
+	sel := newFakeFrontSelector(fronts, "", map[string]time.Duration{
+		"b.example": 80 * time.Millisecond,
+		"c.example": 40 * time.Millisecond,
+	})
+	if best := sel.Best(); best != "a.example" {
+		t.Errorf("before probing: got %q", best)
+	}
+	sel.ProbeAll(context.Background())
+	if best := sel.Best(); best != "c.example" {
+		t.Errorf("after probing: got %q", best)
+	}
+
+	// If none is healthy, fall back to the first.
+	sel = newFakeFrontSelector(fronts, "", nil)
+	sel.ProbeAll(context.Background())
+	if best := sel.Best(); best != "a.example" {
+		t.Errorf("none healthy: got %q", best)
+	}
+
+	sel.SetFronts(nil)
+	if best := sel.Best(); best != "" {
+		t.Errorf("no fronts: got %q", best)
+	}
+}
+
+func TestFrontSelectorPersist(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), frontStateFilename)
+	sel := newFakeFrontSelector([]string{"a.example", "b.example"}, statePath, map[string]time.Duration{
+		"a.example": 90 * time.Millisecond,
+		"b.example": 30 * time.Millisecond,
+	})
+	sel.ProbeAll(context.Background())
+
+	// A new selector, as after a restart, starts with the saved results.
+	// "c.example" was not configured before and so is unprobed.
+	sel = newFakeFrontSelector([]string{"a.example", "b.example", "c.example"}, statePath, nil)
+	err := sel.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best := sel.Best(); best != "b.example" {
+		t.Errorf("after load: got %q", best)
+	}
+
+	// A missing file is fine.
+	sel = newFakeFrontSelector([]string{"a.example"}, filepath.Join(t.TempDir(), "missing"), nil)
+	if err := sel.load(); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestFrontResultScore(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	var fast, slow, flaky frontResult
+	for i := 0; i < 5; i++ {
+		fast.record(50*time.Millisecond, nil, now)
+		slow.record(900*time.Millisecond, nil, now)
+		if i%2 == 0 {
+			flaky.record(0, fmt.Errorf("unreachable"), now)
+		} else {
+			flaky.record(50*time.Millisecond, nil, now)
+		}
+	}
+	if !(fast.Score() > slow.Score() && fast.Score() > flaky.Score()) {
+		t.Errorf("scores fast %.3f, slow %.3f, flaky %.3f", fast.Score(), slow.Score(), flaky.Score())
+	}
+	if flaky.Healthy || flaky.LastBlock != "error" || !flaky.LastBlockTime.Equal(now) {
+		t.Errorf("flaky: %+v", flaky)
+	}
+
+	// Recent probes count for more than old ones.
+	var recovered frontResult
+	for i := 0; i < 10; i++ {
+		recovered.record(0, fmt.Errorf("unreachable"), now)
+	}
+	before := recovered.Score()
+	for i := 0; i < 10; i++ {
+		recovered.record(50*time.Millisecond, nil, now)
+	}
+	if recovered.Score() < 2*before || recovered.Successes < 2*recovered.Failures {
+		t.Errorf("score %.3f before, %+v after", before, recovered)
+	}
+
+	// Results saved without counts.
+	old := frontResult{RTT: 50 * time.Millisecond, Healthy: true}
+	if old.Score() <= (&frontResult{RTT: 50 * time.Millisecond}).Score() {
+		t.Errorf("healthy result without counts scores %.3f", old.Score())
+	}
+}
+
+func TestBlockSignature(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "a.example"}, "dns"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{fmt.Errorf("probe: %w", context.DeadlineExceeded), "timeout"},
+		{x509.UnknownAuthorityError{}, "certificate"},
+		{io.ErrUnexpectedEOF, "eof"},
+		{fmt.Errorf("remote error: tls: handshake failure"), "tls"},
+		{fmt.Errorf("something else"), "error"},
+	} {
+		if output := blockSignature(test.err); output != test.expected {
+			t.Errorf("%v → %q, expected %q", test.err, output, test.expected)
+		}
+	}
+}
+
+// At startup, fronts are ordered by their saved results.
+func TestFrontSelectorLoadOrder(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), frontStateFilename)
+	sel := newFakeFrontSelector([]string{"a.example", "b.example", "c.example"}, statePath, map[string]time.Duration{
+		"b.example": 300 * time.Millisecond,
+		"c.example": 30 * time.Millisecond,
+	})
+	sel.ProbeAll(context.Background())
+
+	sel = newFakeFrontSelector([]string{"a.example", "b.example", "c.example", "d.example"}, statePath, nil)
+	if err := sel.load(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"c.example", "b.example", "d.example", "a.example"}
+	if !reflect.DeepEqual(sel.fronts, expected) {
+		t.Errorf("got order %q, expected %q", sel.fronts, expected)
+	}
+}
+
+func TestProbeFront(t *testing.T) {
+	methods := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		methods <- req.Method
+		http.NotFound(w, req)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	_, err := probeFront(context.Background(), http.DefaultTransport, "http", u.Host)
+	if err != nil {
+		t.Errorf("a 404 should count as healthy: %v", err)
+	}
+	if method := <-methods; method != "HEAD" {
+		t.Errorf("probe used %s", method)
+	}
+
+	server.Close()
+	_, err = probeFront(context.Background(), http.DefaultTransport, "http", u.Host)
+	if err == nil {
+		t.Errorf("probe of a closed server succeeded")
+	}
+}
+
+func TestMakeRequestInfoFrontSelector(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Front = "a.example"
+	options.Pipeline = 1
+	options.FrontSelector = newFakeFrontSelector([]string{"a.example", "b.example"}, "", map[string]time.Duration{
+		"b.example": time.Millisecond,
+	})
+	options.FrontSelector.ProbeAll(context.Background())
+
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL.Host != "b.example" || info.Host != "meek.example" {
+		t.Errorf("got URL host %q, Host %q", info.URL.Host, info.Host)
+	}
+}
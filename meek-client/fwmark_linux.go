@@ -0,0 +1,10 @@
+package main
+
+import "syscall"
+
+const fwmarkSupported = true
+
+// Set the SO_MARK socket option, which requires CAP_NET_ADMIN.
+func setFwmark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
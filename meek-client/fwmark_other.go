@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+const fwmarkSupported = false
+
+func setFwmark(fd uintptr, mark int) error {
+	return errors.New("setting a firewall mark is not supported on this platform")
+}
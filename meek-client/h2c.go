@@ -0,0 +1,86 @@
+package main
+
+// The code in this file implements HTTP/2 over cleartext TCP with prior
+// knowledge ("h2c", RFC 9113 section 3.3) for http:// URLs. It is for
+// topologies where TLS is terminated before the meek server, such as a local
+// stunnel or a hop inside a CDN, so that requests can still be multiplexed
+// over one connection. meek-server accepts h2c when run with --disable-tls.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// h2cRoundTripper sends http:// requests using h2c, and all other requests
+// using another RoundTripper.
+type h2cRoundTripper struct {
+	h2c      http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (rt *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return rt.h2c.RoundTrip(req)
+	}
+	return rt.fallback.RoundTrip(req)
+}
+
+// The shared h2c transport, made on first use, after main has configured the
+// proxy.
+var (
+	h2cTransport     *http2.Transport
+	h2cTransportErr  error
+	h2cTransportOnce sync.Once
+)
+
+// Make an h2c transport that connects through the proxy at options.ProxyURL,
+// if any.
+func makeH2CTransport() (*http2.Transport, error) {
+	var dialer proxy.ContextDialer = outbound
+	if options.ProxyURL != nil {
+		switch options.ProxyURL.Scheme {
+		case "socks5", "http":
+		default:
+			return nil, fmt.Errorf("cannot use proxy scheme %q with h2c", options.ProxyURL.Scheme)
+		}
+		d, err := makeProxyDialer(options.ProxyURL, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		dialer = contextDialer{d}
+	}
+	return &http2.Transport{
+		AllowHTTP:       true,
+		IdleConnTimeout: httpRoundTripper.IdleConnTimeout,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			// Despite the name, make a plain TCP connection.
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+func getH2CTransport() (*http2.Transport, error) {
+	h2cTransportOnce.Do(func() {
+		h2cTransport, h2cTransportErr = makeH2CTransport()
+	})
+	return h2cTransport, h2cTransportErr
+}
+
+// contextDialer adapts a proxy.Dialer that may not support contexts.
+type contextDialer struct {
+	proxy.Dialer
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cd, ok := d.Dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
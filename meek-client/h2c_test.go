@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestH2CRoundTripper(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), &http2.Server{}))
+	defer server.Close()
+
+	saved := options
+	defer func() { options = saved }()
+	options.ProxyURL = nil
+
+	rt, err := chooseRoundTripper("", false, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" {
+		t.Errorf("got %s, expected HTTP/2.0", resp.Proto)
+	}
+
+	// https:// requests go to the fallback.
+	if fallback := rt.(*h2cRoundTripper).fallback; fallback != httpRoundTripper {
+		t.Errorf("fallback is %p, expected httpRoundTripper", fallback)
+	}
+}
+
+func TestMakeH2CTransportProxy(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	for _, test := range []struct {
+		proxy string
+		ok    bool
+	}{
+		{"socks5://127.0.0.1:1080", true},
+		{"http://127.0.0.1:8080", true},
+		{"https://127.0.0.1:8443", false},
+	} {
+		options.ProxyURL, _ = url.Parse(test.proxy)
+		_, err := makeH2CTransport()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.proxy, err)
+		}
+	}
+}
+
+func TestChooseRoundTripperHelperHTTPVersion(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.UseHelper = true
+
+	for _, versions := range [][2]bool{{true, false}, {false, true}} {
+		_, err := chooseRoundTripper("", false, versions[0], versions[1])
+		if err == nil {
+			t.Errorf("http1=%v h2c=%v with helper unexpectedly succeeded", versions[0], versions[1])
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+// The code in this file makes HTTP/2 connections made with uTLS look like they
+// come from the browser whose TLS fingerprint uTLS imitates. Go's HTTP/2
+// client has a fingerprint of its own, visible to the front and to anyone it
+// shares logs with: the values and order of its SETTINGS, the size of its
+// first connection WINDOW_UPDATE, the lack of a priority in its HEADERS, and
+// the order of its pseudo-headers (:authority, :method, :path, :scheme). A
+// Chrome ClientHello followed by that is a sure sign of a Go program.
+//
+// http2.Transport has no options for any of these, so instead its connection
+// is wrapped in an h2FingerprintConn, which rewrites the frames it writes: the
+// first SETTINGS and WINDOW_UPDATE are replaced with the browser's, and each
+// header block is decoded, its pseudo-headers are put in the browser's order,
+// and it is encoded again, with the browser's stream priority. Other frames
+// pass through unchanged.
+//
+// The Transport still acts on its own settings, so the browser's must not
+// allow the server anything the Transport doesn't expect. Every profile
+// disables server push, as the browsers do, because the Transport treats a
+// PUSH_PROMISE as a connection error. A larger header table is made safe by
+// configuring the Transport with it. A larger stream
+// window (Chrome's) is safe because meek response bodies are far smaller than
+// either window, and the Transport gives back window as it reads. Firefox's
+// PRIORITY frames for idle streams, which would fix the ids of later streams,
+// are not imitated.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// The length of an HTTP/2 frame header.
+	h2FrameHeaderLength = 9
+	// The largest frame to write, which every server accepts.
+	h2MaxFrameLength = 16384
+	// The header table size Go's encoder starts with.
+	h2DefaultHeaderTableSize = 4096
+)
+
+// h2Profile is the HTTP/2 fingerprint of one browser.
+type h2Profile struct {
+	// The SETTINGS of the connection preface, in order.
+	Settings []http2.Setting
+	// The increment of the WINDOW_UPDATE that follows.
+	ConnWindowUpdate uint32
+	// The priority of every HEADERS frame.
+	Priority http2.PriorityParam
+	// The order of pseudo-headers in requests.
+	PseudoHeaderOrder []string
+}
+
+var (
+	h2ProfileChrome = &h2Profile{
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 6291456},
+			{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+		},
+		ConnWindowUpdate:  15663105,
+		Priority:          http2.PriorityParam{Exclusive: true, Weight: 255},
+		PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	}
+	h2ProfileFirefox = &h2Profile{
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 131072},
+			{ID: http2.SettingMaxFrameSize, Val: 16384},
+		},
+		ConnWindowUpdate:  12517377,
+		Priority:          http2.PriorityParam{Weight: 41},
+		PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+	}
+	h2ProfileSafari = &h2Profile{
+		Settings: []http2.Setting{
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 4194304},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+		},
+		ConnWindowUpdate:  10485760,
+		Priority:          http2.PriorityParam{Weight: 254},
+		PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+	}
+)
+
+// Return the family of browser whose Client Hello clientHelloID imitates:
+// "chrome" (including browsers based on Chromium), "firefox", or "safari"
+// (including iOS), or "" if it isn't a browser's.
+func browserFamily(clientHelloID *utls.ClientHelloID) string {
+	if clientHelloID == nil {
+		return ""
+	}
+	switch clientHelloID.Client {
+	case "Chrome", "Edge", "360Browser", "QQBrowser":
+		return "chrome"
+	case "Firefox":
+		return "firefox"
+	case "iOS", "Safari":
+		return "safari"
+	}
+	return ""
+}
+
+// Return the HTTP/2 profile of the browser that clientHelloID imitates, or nil
+// if it isn't a browser's.
+func h2ProfileFor(clientHelloID *utls.ClientHelloID) *h2Profile {
+	switch browserFamily(clientHelloID) {
+	case "chrome":
+		return h2ProfileChrome
+	case "firefox":
+		return h2ProfileFirefox
+	case "safari":
+		return h2ProfileSafari
+	}
+	return nil
+}
+
+// Return the value of setting id in the profile, and whether it has one.
+func (profile *h2Profile) setting(id http2.SettingID) (uint32, bool) {
+	for _, s := range profile.Settings {
+		if s.ID == id {
+			return s.Val, true
+		}
+	}
+	return 0, false
+}
+
+// Configure tr to accept what the profile's settings allow the server.
+func (profile *h2Profile) configureTransport(tr *http2.Transport) {
+	if profile == nil {
+		return
+	}
+	if size, ok := profile.setting(http2.SettingHeaderTableSize); ok {
+		tr.MaxDecoderHeaderTableSize = size
+	}
+	if size, ok := profile.setting(http2.SettingMaxHeaderListSize); ok {
+		tr.MaxHeaderListSize = size
+	}
+}
+
+// Wrap conn, a connection for an http2.Transport, to rewrite its frames to
+// match the profile. A nil profile leaves conn alone.
+func (profile *h2Profile) wrapConn(conn net.Conn) net.Conn {
+	if profile == nil {
+		return conn
+	}
+	c := &h2FingerprintConn{
+		Conn:    conn,
+		profile: profile,
+		dec:     hpack.NewDecoder(h2DefaultHeaderTableSize, nil),
+	}
+	c.enc = hpack.NewEncoder(&c.encBuf)
+	return c
+}
+
+// h2FingerprintConn rewrites the frames an http2.Transport writes to it.
+type h2FingerprintConn struct {
+	net.Conn
+	profile *h2Profile
+
+	lock sync.Mutex
+	// Written bytes that don't yet make a whole frame.
+	pending []byte
+	// Whether the client preface, the first SETTINGS, and the first
+	// connection WINDOW_UPDATE have been written.
+	prefaceDone, settingsDone, windowDone bool
+	// The header block being collected from HEADERS and CONTINUATION
+	// frames, and the stream and flags of its HEADERS.
+	block      []byte
+	blockFlags http2.Flags
+	blockID    uint32
+	// Decodes header blocks as the Transport encoded them, and encodes them
+	// again.
+	dec    *hpack.Decoder
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+}
+
+func (c *h2FingerprintConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pending = append(c.pending, p...)
+	var out []byte
+	if !c.prefaceDone {
+		if len(c.pending) < len(http2.ClientPreface) {
+			return len(p), nil
+		}
+		out = append(out, c.pending[:len(http2.ClientPreface)]...)
+		c.pending = c.pending[len(http2.ClientPreface):]
+		c.prefaceDone = true
+	}
+	for len(c.pending) >= h2FrameHeaderLength {
+		length := int(c.pending[0])<<16 | int(c.pending[1])<<8 | int(c.pending[2])
+		if len(c.pending) < h2FrameHeaderLength+length {
+			break
+		}
+		frame := c.pending[:h2FrameHeaderLength+length]
+		var err error
+		out, err = c.rewriteFrame(out, frame)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[len(frame):]
+	}
+	// Don't hold on to a large buffer once it is used up.
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Append the rewritten form of frame to out.
+func (c *h2FingerprintConn) rewriteFrame(out, frame []byte) ([]byte, error) {
+	frameType := http2.FrameType(frame[3])
+	flags := http2.Flags(frame[4])
+	streamID := binary.BigEndian.Uint32(frame[5:9]) & (1<<31 - 1)
+	payload := frame[h2FrameHeaderLength:]
+
+	switch {
+	case frameType == http2.FrameSettings && !flags.Has(http2.FlagSettingsAck) && !c.settingsDone:
+		c.settingsDone = true
+		var settings []byte
+		for _, s := range c.profile.Settings {
+			settings = binary.BigEndian.AppendUint16(settings, uint16(s.ID))
+			settings = binary.BigEndian.AppendUint32(settings, s.Val)
+		}
+		return appendH2Frame(out, http2.FrameSettings, 0, 0, settings), nil
+	case frameType == http2.FrameWindowUpdate && streamID == 0 && c.settingsDone && !c.windowDone:
+		c.windowDone = true
+		return appendH2Frame(out, http2.FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, c.profile.ConnWindowUpdate)), nil
+	case frameType == http2.FrameHeaders:
+		if flags.Has(http2.FlagHeadersPadded) || flags.Has(http2.FlagHeadersPriority) {
+			return nil, fmt.Errorf("unexpected HEADERS flags %v", flags)
+		}
+		c.block = append(c.block[:0], payload...)
+		c.blockFlags = flags
+		c.blockID = streamID
+		if !flags.Has(http2.FlagHeadersEndHeaders) {
+			return out, nil
+		}
+		return c.rewriteHeaders(out)
+	case frameType == http2.FrameContinuation:
+		if streamID != c.blockID {
+			return nil, fmt.Errorf("CONTINUATION for stream %d, not %d", streamID, c.blockID)
+		}
+		c.block = append(c.block, payload...)
+		if !flags.Has(http2.FlagContinuationEndHeaders) {
+			return out, nil
+		}
+		return c.rewriteHeaders(out)
+	}
+	return append(out, frame...), nil
+}
+
+// Append the collected header block, rewritten, as HEADERS and CONTINUATION
+// frames to out.
+func (c *h2FingerprintConn) rewriteHeaders(out []byte) ([]byte, error) {
+	// When the server shrinks the header table, the Transport's encoder
+	// starts the next block with a size update. Do the same.
+	for i := 0; i < len(c.block) && c.block[i]&0xe0 == 0x20; {
+		size, n, err := hpackReadInt(c.block[i:], 5)
+		if err != nil {
+			return nil, err
+		}
+		c.enc.SetMaxDynamicTableSize(size)
+		i += n
+	}
+	fields, err := c.dec.DecodeFull(c.block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.encBuf.Reset()
+	for _, name := range c.profile.PseudoHeaderOrder {
+		for _, f := range fields {
+			if f.Name == name {
+				c.enc.WriteField(f)
+			}
+		}
+	}
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			c.enc.WriteField(f)
+		} else if !containsString(c.profile.PseudoHeaderOrder, f.Name) {
+			return nil, fmt.Errorf("unexpected pseudo-header %q", f.Name)
+		}
+	}
+	block := c.encBuf.Bytes()
+
+	priority := c.profile.Priority
+	dep := priority.StreamDep
+	if priority.Exclusive {
+		dep |= 1 << 31
+	}
+	first := binary.BigEndian.AppendUint32(nil, dep)
+	first = append(first, priority.Weight)
+	n := len(block)
+	if n > h2MaxFrameLength-len(first) {
+		n = h2MaxFrameLength - len(first)
+	}
+	first = append(first, block[:n]...)
+	block = block[n:]
+	flags := c.blockFlags&http2.FlagHeadersEndStream | http2.FlagHeadersPriority
+	if len(block) == 0 {
+		flags |= http2.FlagHeadersEndHeaders
+	}
+	out = appendH2Frame(out, http2.FrameHeaders, flags, c.blockID, first)
+	for len(block) > 0 {
+		n := len(block)
+		if n > h2MaxFrameLength {
+			n = h2MaxFrameLength
+		}
+		var flags http2.Flags
+		if n == len(block) {
+			flags = http2.FlagContinuationEndHeaders
+		}
+		out = appendH2Frame(out, http2.FrameContinuation, flags, c.blockID, block[:n])
+		block = block[n:]
+	}
+	c.block = c.block[:0]
+	return out, nil
+}
+
+// Append a frame to out.
+func appendH2Frame(out []byte, frameType http2.FrameType, flags http2.Flags, streamID uint32, payload []byte) []byte {
+	out = append(out, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), byte(frameType), byte(flags))
+	out = binary.BigEndian.AppendUint32(out, streamID)
+	return append(out, payload...)
+}
+
+// Read an HPACK integer with an n-bit prefix from the start of b. Return the
+// integer and the number of bytes it took.
+func hpackReadInt(b []byte, n uint) (uint32, int, error) {
+	mask := byte(1<<n - 1)
+	v := uint64(b[0] & mask)
+	if v < uint64(mask) {
+		return uint32(v), 1, nil
+	}
+	for i, shift := 1, uint(0); i < len(b) && shift <= 28; i, shift = i+1, shift+7 {
+		v += uint64(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			if v > 1<<32-1 {
+				break
+			}
+			return uint32(v), i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("bad HPACK integer")
+}
+
+// Is s in list?
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// What a fake HTTP/2 server saw of one request.
+type h2SeenRequest struct {
+	priority http2.PriorityParam
+	fields   []hpack.HeaderField
+	body     string
+}
+
+// What a fake HTTP/2 server saw of a connection.
+type h2SeenConn struct {
+	settings []http2.Setting
+	window   uint32
+	requests []h2SeenRequest
+}
+
+// Run a fake HTTP/2 server on conn that answers n requests with an empty 200,
+// then sends what it saw on the returned channel.
+func runH2Server(t *testing.T, conn net.Conn, n int) <-chan *h2SeenConn {
+	ch := make(chan *h2SeenConn, 1)
+	go func() {
+		defer conn.Close()
+		defer close(ch)
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+			t.Errorf("bad preface %q, %v", preface, err)
+			return
+		}
+		fr := http2.NewFramer(conn, conn)
+		fr.ReadMetaHeaders = hpack.NewDecoder(65536, nil)
+
+		var buf bytes.Buffer
+		enc := hpack.NewEncoder(&buf)
+		enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+		status := buf.Bytes()
+
+		seen := &h2SeenConn{}
+		streams := make(map[uint32]*h2SeenRequest)
+		for len(seen.requests) < n {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Errorf("ReadFrame: %v", err)
+				return
+			}
+			switch f := f.(type) {
+			case *http2.SettingsFrame:
+				if f.IsAck() {
+					continue
+				}
+				f.ForeachSetting(func(s http2.Setting) error {
+					seen.settings = append(seen.settings, s)
+					return nil
+				})
+			case *http2.WindowUpdateFrame:
+				if f.StreamID == 0 && seen.window == 0 {
+					seen.window = f.Increment
+					// Send a small header table, to make the
+					// client shrink its own.
+					fr.WriteSettings(http2.Setting{ID: http2.SettingHeaderTableSize, Val: 256})
+					fr.WriteSettingsAck()
+				}
+			case *http2.MetaHeadersFrame:
+				streams[f.StreamID] = &h2SeenRequest{priority: f.Priority, fields: f.Fields}
+			case *http2.DataFrame:
+				streams[f.StreamID].body += string(f.Data())
+			}
+			if f.Header().Flags.Has(http2.FlagDataEndStream) && (f.Header().Type == http2.FrameHeaders || f.Header().Type == http2.FrameData) {
+				id := f.Header().StreamID
+				seen.requests = append(seen.requests, *streams[id])
+				fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: status, EndHeaders: true, EndStream: true})
+			}
+		}
+		ch <- seen
+	}()
+	return ch
+}
+
+func TestH2ProfileFor(t *testing.T) {
+	for _, test := range []struct {
+		id      *utls.ClientHelloID
+		profile *h2Profile
+	}{
+		{nil, nil},
+		{&utls.HelloChrome_133, h2ProfileChrome},
+		{&utls.HelloEdge_85, h2ProfileChrome},
+		{&utls.HelloFirefox_105, h2ProfileFirefox},
+		{&utls.HelloIOS_14, h2ProfileSafari},
+		{&utls.HelloSafari_16_0, h2ProfileSafari},
+		{&utls.HelloRandomizedALPN, nil},
+	} {
+		if got := h2ProfileFor(test.id); got != test.profile {
+			t.Errorf("%v: got %p, expected %p", test.id, got, test.profile)
+		}
+	}
+}
+
+// Every profile must disable server push, which the Transport doesn't
+// support.
+func TestH2ProfileEnablePush(t *testing.T) {
+	for name, profile := range map[string]*h2Profile{
+		"chrome":  h2ProfileChrome,
+		"firefox": h2ProfileFirefox,
+		"safari":  h2ProfileSafari,
+	} {
+		if val, ok := profile.setting(http2.SettingEnablePush); !ok || val != 0 {
+			t.Errorf("%s: ENABLE_PUSH %d, %v", name, val, ok)
+		}
+	}
+}
+
+func TestHPACKReadInt(t *testing.T) {
+	for _, test := range []struct {
+		b []byte
+		v uint32
+		n int
+	}{
+		{[]byte{0x2a}, 10, 1},
+		{[]byte{0x3f, 0x00}, 31, 2},
+		{[]byte{0x3f, 0x9a, 0x0a}, 1337, 3},
+		{[]byte{0x3f, 0xe1, 0x1f, 0xff}, 4096, 3},
+	} {
+		v, n, err := hpackReadInt(test.b, 5)
+		if err != nil || v != test.v || n != test.n {
+			t.Errorf("%x: got %d, %d, %v", test.b, v, n, err)
+		}
+	}
+	for _, b := range [][]byte{{0x3f}, {0x3f, 0x80}, {0x3f, 0xff, 0xff, 0xff, 0xff, 0xff}} {
+		if _, _, err := hpackReadInt(b, 5); err == nil {
+			t.Errorf("%x: unexpected success", b)
+		}
+	}
+}
+
+// An http2.Transport over a wrapped connection sends the profile's settings,
+// window update, priority, and pseudo-header order, and the rest of its
+// requests unchanged.
+func TestH2FingerprintConn(t *testing.T) {
+	for _, profile := range []*h2Profile{h2ProfileChrome, h2ProfileFirefox, h2ProfileSafari} {
+		// net.Pipe has no buffer, and the client and server would block
+		// writing to each other.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := runH2Server(t, c2, 3)
+		tr := &http2.Transport{
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return profile.wrapConn(c1), nil
+			},
+		}
+		profile.configureTransport(tr)
+		for i, body := range []string{"hello", "", strings.Repeat("x", 100)} {
+			req, _ := http.NewRequest("POST", "https://meek.example/p", strings.NewReader(body))
+			req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+			req.Header.Set("X-Long", strings.Repeat("y", 20000*(i%2)))
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		seen := <-ch
+		tr.CloseIdleConnections()
+		if seen == nil {
+			continue
+		}
+
+		if len(seen.settings) != len(profile.Settings) {
+			t.Errorf("settings %v, expected %v", seen.settings, profile.Settings)
+		} else {
+			for i := range seen.settings {
+				if seen.settings[i] != profile.Settings[i] {
+					t.Errorf("settings %v, expected %v", seen.settings, profile.Settings)
+					break
+				}
+			}
+		}
+		if seen.window != profile.ConnWindowUpdate {
+			t.Errorf("window update %d, expected %d", seen.window, profile.ConnWindowUpdate)
+		}
+		for i, req := range seen.requests {
+			if req.priority != profile.Priority {
+				t.Errorf("request %d: priority %+v, expected %+v", i, req.priority, profile.Priority)
+			}
+			var pseudo []string
+			var sessionID string
+			for _, f := range req.fields {
+				if strings.HasPrefix(f.Name, ":") {
+					pseudo = append(pseudo, f.Name)
+				} else if f.Name == "x-session-id" {
+					sessionID = f.Value
+				}
+			}
+			if strings.Join(pseudo, ",") != strings.Join(profile.PseudoHeaderOrder, ",") {
+				t.Errorf("request %d: pseudo-headers %v, expected %v", i, pseudo, profile.PseudoHeaderOrder)
+			}
+			if sessionID != "Y2FyZ28gdHJ1Y2s" {
+				t.Errorf("request %d: X-Session-Id %q", i, sessionID)
+			}
+		}
+		if seen.requests[2].body != strings.Repeat("x", 100) {
+			t.Errorf("body %q", seen.requests[2].body)
+		}
+	}
+}
+
+// A nil profile leaves connections alone.
+func TestH2ProfileNil(t *testing.T) {
+	var profile *h2Profile
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if profile.wrapConn(c1) != c1 {
+		t.Errorf("nil profile wrapped the connection")
+	}
+	tr := &http2.Transport{}
+	profile.configureTransport(tr)
+	if tr.MaxDecoderHeaderTableSize != 0 {
+		t.Errorf("nil profile configured the transport")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+// The code in this file records the client's HTTP transactions to a file in
+// the HTTP Archive (HAR) format (--har), for reporting and reproducing
+// failures that depend on a particular CDN. Each transport request, cover
+// request, bridge list fetch, front probe, and DoH query (for mode=dns) is an
+// entry with its timings, the request and response headers, the status, and
+// the body sizes. Bodies are never recorded. Secrets are scrubbed from the
+// headers: X-Session-Token, X-Credential, Authorization, Proxy-Authorization,
+// Cookie, and Set-Cookie values are replaced with "[scrubbed]", and session
+// ids with labels ("session-1", "session-2", ...) that are the same for all
+// requests of a session. The file still has the URL and Host of requests, so
+// check it before sharing it. WebSocket sessions are not recorded, and
+// neither are requests made through the --helper browser, which doesn't
+// report their timings.
+//
+// The file is rewritten (as a whole, so that it is always a complete HAR
+// document) at most every harSaveInterval while there are new entries, and at
+// exit. Only the latest harMaxEntries entries are kept.
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The most entries kept in the file.
+	harMaxEntries = 10000
+	// The longest the file goes without new entries being saved.
+	harSaveInterval = time.Second
+	// The value of scrubbed headers.
+	harScrubbed = "[scrubbed]"
+)
+
+// Headers whose values are never recorded.
+var harScrubbedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"Set-Cookie":          true,
+	"X-Credential":        true,
+	"X-Session-Token":     true,
+}
+
+// The types below are those of the HAR 1.2 format, with only the fields we
+// use. Custom fields start with "_".
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	// The error of a failed transaction, which has response status 0.
+	Error string `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// Times in milliseconds; -1 means the phase didn't happen.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harRecorder keeps the entries and writes them to the file. A nil
+// *harRecorder records nothing.
+type harRecorder struct {
+	path    string
+	creator harCreator
+
+	lock    sync.Mutex
+	entries []harEntry
+	dirty   bool
+	// Labels of session ids.
+	sessions map[string]string
+}
+
+// The recorder for --har, or nil if it was not given. Set up in main.
+var harCapture *harRecorder
+
+// Make a harRecorder that writes to path, and write the empty file, so that
+// a bad path is noticed at once.
+func newHARRecorder(path string) (*harRecorder, error) {
+	h := &harRecorder{
+		path:     path,
+		creator:  harCreator{Name: "meek-client", Version: getBuildInfo().Version},
+		sessions: make(map[string]string),
+	}
+	return h, h.Save()
+}
+
+// Return rt wrapped so that its transactions are recorded.
+func (h *harRecorder) Wrap(rt http.RoundTripper) http.RoundTripper {
+	if h == nil {
+		return rt
+	}
+	return &harRoundTripper{rec: h, rt: rt}
+}
+
+// Add an entry.
+func (h *harRecorder) Add(entry harEntry) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > harMaxEntries {
+		h.entries = append([]harEntry(nil), h.entries[len(h.entries)-harMaxEntries:]...)
+	}
+	h.dirty = true
+}
+
+// Return the label of a session id.
+func (h *harRecorder) sessionLabel(id string) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	label, ok := h.sessions[id]
+	if !ok {
+		label = fmt.Sprintf("session-%d", len(h.sessions)+1)
+		h.sessions[id] = label
+	}
+	return label
+}
+
+// Write the file, through a temporary file so that it is never left half
+// written.
+func (h *harRecorder) Save() error {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	entries := h.entries
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{Version: "1.2", Creator: h.creator, Entries: entries}}, "", "  ")
+	h.dirty = false
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Save the file every interval while there are new entries. Never returns.
+func (h *harRecorder) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.lock.Lock()
+		dirty := h.dirty
+		h.lock.Unlock()
+		if !dirty {
+			continue
+		}
+		err := h.Save()
+		if err != nil {
+			logging.Warnf("error saving --har file: %s", err)
+		}
+	}
+}
+
+// Return header as HAR name–value pairs, sorted, with secrets scrubbed.
+func (h *harRecorder) headers(header http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			switch {
+			case harScrubbedHeaders[name]:
+				value = harScrubbed
+			case name == "X-Session-Id":
+				value = h.sessionLabel(value)
+			}
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+// harTrace collects the times of the phases of one transaction.
+type harTrace struct {
+	lock                    sync.Mutex
+	start                   time.Time
+	dnsStart, dnsDone       time.Time
+	connectStart, connected time.Time
+	tlsStart, tlsDone       time.Time
+	gotConn, wroteRequest   time.Time
+	firstByte               time.Time
+	remoteIP                string
+}
+
+// Record the time of an event in *t, unless it already has one.
+func (tr *harTrace) mark(t *time.Time) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+func (tr *harTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { tr.mark(&tr.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { tr.mark(&tr.dnsDone) },
+		ConnectStart:      func(string, string) { tr.mark(&tr.connectStart) },
+		ConnectDone:       func(string, string, error) { tr.mark(&tr.connected) },
+		TLSHandshakeStart: func() { tr.mark(&tr.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { tr.mark(&tr.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			tr.mark(&tr.gotConn)
+			if info.Conn != nil {
+				tr.lock.Lock()
+				tr.remoteIP = info.Conn.RemoteAddr().String()
+				tr.lock.Unlock()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { tr.mark(&tr.wroteRequest) },
+		GotFirstResponseByte: func() { tr.mark(&tr.firstByte) },
+	}
+}
+
+// Milliseconds from a to b, or -1 if either is missing.
+func harMillis(a, b time.Time) float64 {
+	if a.IsZero() || b.IsZero() {
+		return -1
+	}
+	return float64(b.Sub(a)) / float64(time.Millisecond)
+}
+
+// Fill in the timings of entry, which ended at end.
+func (tr *harTrace) fill(entry *harEntry, end time.Time) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	entry.Time = harMillis(tr.start, end)
+	firstDial := tr.gotConn
+	for _, t := range []time.Time{tr.connectStart, tr.dnsStart} {
+		if !t.IsZero() {
+			firstDial = t
+		}
+	}
+	connectEnd := tr.connected
+	if !tr.tlsDone.IsZero() {
+		// In HAR, connect includes ssl.
+		connectEnd = tr.tlsDone
+	}
+	entry.Timings = harTimings{
+		Blocked: harMillis(tr.start, firstDial),
+		DNS:     harMillis(tr.dnsStart, tr.dnsDone),
+		Connect: harMillis(tr.connectStart, connectEnd),
+		SSL:     harMillis(tr.tlsStart, tr.tlsDone),
+		// These three may not be missing.
+		Send:    max(0, harMillis(tr.gotConn, tr.wroteRequest)),
+		Wait:    max(0, harMillis(tr.wroteRequest, tr.firstByte)),
+		Receive: max(0, harMillis(tr.firstByte, end)),
+	}
+	if host, _, err := net.SplitHostPort(tr.remoteIP); err == nil {
+		entry.ServerIPAddress = host
+	}
+}
+
+// harRoundTripper records the transactions of another RoundTripper.
+type harRoundTripper struct {
+	rec *harRecorder
+	rt  http.RoundTripper
+}
+
+func (t *harRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := &harTrace{start: time.Now()}
+	u := *req.URL
+	u.User = nil
+	header := req.Header.Clone()
+	if req.Host != "" {
+		header.Set("Host", req.Host)
+	} else {
+		header.Set("Host", req.URL.Host)
+	}
+	entry := harEntry{
+		StartedDateTime: tr.start,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     t.rec.headers(header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+
+	resp, err := t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), tr.clientTrace())))
+	if err != nil {
+		entry.Error = err.Error()
+		tr.fill(&entry, time.Now())
+		t.rec.Add(entry)
+		return nil, err
+	}
+	entry.Request.HTTPVersion = resp.Proto
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = http.StatusText(resp.StatusCode)
+	entry.Response.HTTPVersion = resp.Proto
+	entry.Response.Headers = t.rec.headers(resp.Header)
+	entry.Response.Content.MimeType = resp.Header.Get("Content-Type")
+	resp.Body = &watchedBody{ReadCloser: resp.Body, done: func(n int64, err error) {
+		entry.Response.BodySize = n
+		entry.Response.Content.Size = n
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		tr.fill(&entry, time.Now())
+		t.rec.Add(entry)
+	}}
+	return resp, nil
+}
+
+// watchedBody counts the bytes of a response body, and calls done once, at EOF,
+// a read error, or Close, whichever is first.
+type watchedBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64, err error)
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.n, nil) })
+	} else if err != nil {
+		b.once.Do(func() { b.done(b.n, err) })
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	b.once.Do(func() { b.done(b.n, nil) })
+	return b.ReadCloser.Close()
+}
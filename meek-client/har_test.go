@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readHARFile(t *testing.T, path string) harFile {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	err = json.Unmarshal(data, &har)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return har
+}
+
+func harHeader(pairs []harNameValue, name string) string {
+	for _, pair := range pairs {
+		if pair.Name == name {
+			return pair.Value
+		}
+	}
+	return ""
+}
+
+func TestHARRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "secret=1")
+		w.Header().Set("X-Cache", "MISS")
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "meek.har")
+	rec, err := newHARRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if har := readHARFile(t, path); har.Log.Version != "1.2" || len(har.Log.Entries) != 0 {
+		t.Fatalf("new file: %+v", har)
+	}
+
+	rt := rec.Wrap(http.DefaultTransport)
+	for _, id := range []string{"abc", "def", "abc"} {
+		req, _ := http.NewRequest("POST", server.URL+"/meek", strings.NewReader("payload"))
+		req.Header.Set("X-Session-Id", id)
+		req.Header.Set("X-Session-Token", "token")
+		req.Header.Set("X-Credential", "credential")
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatalf("request to a closed port succeeded")
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readHARFile(t, path).Log.Entries
+	if len(entries) != 4 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	for i, label := range []string{"session-1", "session-2", "session-1"} {
+		entry := entries[i]
+		if got := harHeader(entry.Request.Headers, "X-Session-Id"); got != label {
+			t.Errorf("entry %d: session %q, expected %q", i, got, label)
+		}
+		for _, name := range []string{"X-Session-Token", "X-Credential"} {
+			if got := harHeader(entry.Request.Headers, name); got != harScrubbed {
+				t.Errorf("entry %d: %s %q", i, name, got)
+			}
+		}
+		if got := harHeader(entry.Response.Headers, "Set-Cookie"); got != harScrubbed {
+			t.Errorf("entry %d: Set-Cookie %q", i, got)
+		}
+		if got := harHeader(entry.Response.Headers, "X-Cache"); got != "MISS" {
+			t.Errorf("entry %d: X-Cache %q", i, got)
+		}
+		if entry.Response.Status != 200 || entry.Request.BodySize != 7 || entry.Response.BodySize != 5 {
+			t.Errorf("entry %d: status %d, sizes %d and %d", i, entry.Response.Status, entry.Request.BodySize, entry.Response.BodySize)
+		}
+		if entry.ServerIPAddress != "127.0.0.1" || entry.Error != "" {
+			t.Errorf("entry %d: address %q, error %q", i, entry.ServerIPAddress, entry.Error)
+		}
+		if entry.Timings.Wait < 0 || entry.Time < 0 {
+			t.Errorf("entry %d: timings %+v", i, entry.Timings)
+		}
+	}
+	// The first request connected, and the others reused its connection.
+	if entries[0].Timings.Connect < 0 || entries[1].Timings.Connect != -1 {
+		t.Errorf("connect timings %g and %g", entries[0].Timings.Connect, entries[1].Timings.Connect)
+	}
+	if failed := entries[3]; failed.Error == "" || failed.Response.Status != 0 {
+		t.Errorf("failed request: %+v", failed)
+	}
+	data, _ := ioutil.ReadFile(path)
+	for _, secret := range []string{"abc", "token", "credential", "secret=1"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("file contains %q", secret)
+		}
+	}
+	matches, _ := filepath.Glob(path + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("temporary files left: %q", matches)
+	}
+}
+
+func TestHARRecorderLimit(t *testing.T) {
+	rec, err := newHARRecorder(filepath.Join(t.TempDir(), "meek.har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < harMaxEntries+10; i++ {
+		rec.Add(harEntry{Time: float64(i)})
+	}
+	if len(rec.entries) != harMaxEntries || rec.entries[0].Time != 10 {
+		t.Errorf("%d entries, first %g", len(rec.entries), rec.entries[0].Time)
+	}
+}
+
+func TestHARRecorderNil(t *testing.T) {
+	var rec *harRecorder
+	if rt := rec.Wrap(http.DefaultTransport); rt != http.DefaultTransport {
+		t.Errorf("nil recorder wrapped the RoundTripper")
+	}
+	if err := rec.Save(); err != nil {
+		t.Error(err)
+	}
+	if _, err := newHARRecorder(filepath.Join(t.TempDir(), "missing", "meek.har")); !os.IsNotExist(err) {
+		t.Errorf("bad path: got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+// The code in this file controls the order and capitalization of the header
+// fields of HTTP/1.1 requests made with uTLS. Go's http.Transport writes Host
+// and User-Agent first, then the other fields sorted by name, all in
+// canonical capitalization, which no browser does; on a front that speaks
+// HTTP/1.1 to the client, that gives away a Go program behind a browser's
+// Client Hello. The request heads are rewritten on their way to the
+// connection, with the fields in the order, and with the capitalization, of a
+// list. By default the list is that of the browser whose Client Hello is
+// used; --header-order names another browser's, or gives a list of its own.
+// Fields not in the list follow those that are, in the order Go wrote them.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http/httpguts"
+)
+
+// headerOrder is a list of header field names, in the order and
+// capitalization to write them in.
+type headerOrder []string
+
+var (
+	headerOrderChrome = headerOrder{
+		"Host", "Connection", "Content-Length", "Cache-Control",
+		"sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform", "User-Agent",
+		"Content-Type", "Accept", "Origin", "Sec-Fetch-Site",
+		"Sec-Fetch-Mode", "Sec-Fetch-Dest", "Referer", "Accept-Encoding",
+		"Accept-Language", "Cookie",
+	}
+	headerOrderFirefox = headerOrder{
+		"Host", "User-Agent", "Accept", "Accept-Language", "Accept-Encoding",
+		"Content-Type", "Content-Length", "Origin", "Connection", "Referer",
+		"Cookie", "Sec-Fetch-Dest", "Sec-Fetch-Mode", "Sec-Fetch-Site",
+		"Cache-Control",
+	}
+	headerOrderSafari = headerOrder{
+		"Host", "Content-Type", "Origin", "Accept-Encoding", "Connection",
+		"Accept", "User-Agent", "Referer", "Content-Length",
+		"Accept-Language", "Cookie",
+	}
+)
+
+// The header orders that --header-order may name.
+var headerOrdersByName = map[string]headerOrder{
+	"chrome":  headerOrderChrome,
+	"firefox": headerOrderFirefox,
+	"safari":  headerOrderSafari,
+}
+
+// Return the header order of the browser that clientHelloID imitates, or nil
+// if it isn't a browser's.
+func headerOrderFor(clientHelloID *utls.ClientHelloID) headerOrder {
+	return headerOrdersByName[browserFamily(clientHelloID)]
+}
+
+// Parse --header-order: the name of a browser, or a comma-separated list of
+// header field names.
+func parseHeaderOrder(s string) (headerOrder, error) {
+	if order, ok := headerOrdersByName[strings.ToLower(s)]; ok {
+		return order, nil
+	}
+	var order headerOrder
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("bad header field name %q", name)
+		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("header field %q is listed twice", name)
+		}
+		seen[strings.ToLower(name)] = true
+		order = append(order, name)
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no header fields")
+	}
+	return order, nil
+}
+
+// Rewrite head, an HTTP/1.1 request head without its final blank line, to
+// put its fields in order.
+func (order headerOrder) rewrite(head []byte) []byte {
+	lines := strings.Split(string(head), "\r\n")
+	fields := lines[1:]
+	out := make([]string, 0, len(lines))
+	out = append(out, lines[0])
+	used := make([]bool, len(fields))
+	for _, name := range order {
+		for i, field := range fields {
+			fieldName, value, ok := strings.Cut(field, ":")
+			if !used[i] && ok && strings.EqualFold(fieldName, name) {
+				out = append(out, name+":"+value)
+				used[i] = true
+			}
+		}
+	}
+	for i, field := range fields {
+		if !used[i] {
+			out = append(out, field)
+		}
+	}
+	return []byte(strings.Join(out, "\r\n"))
+}
+
+// Wrap conn, a connection for an http.Transport, to rewrite the heads of the
+// requests written to it. A nil order leaves conn alone.
+func (order headerOrder) wrapConn(conn net.Conn) net.Conn {
+	if order == nil {
+		return conn
+	}
+	return &headerOrderConn{Conn: conn, order: order}
+}
+
+// headerOrderConn rewrites the heads of the HTTP/1.1 requests written to it.
+// It follows the framing of request bodies to find where each head starts.
+type headerOrderConn struct {
+	net.Conn
+	order headerOrder
+
+	lock sync.Mutex
+	// Written bytes not yet passed on.
+	pending []byte
+	// The bytes of body left to pass on unchanged: of the whole body, or
+	// of the current chunk and its CRLF for a chunked body.
+	bodyLeft int64
+	// Whether the current request body is chunked, and whether its last
+	// chunk has been passed on, so that the trailer comes next.
+	chunked, trailer bool
+}
+
+func (c *headerOrderConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pending = append(c.pending, p...)
+	var out []byte
+	for {
+		var ok bool
+		var err error
+		out, ok, err = c.step(out)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+	}
+	// Don't hold on to a large buffer once it is used up.
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Pass on the next piece of pending bytes, a head, line, or run of body,
+// appending it to out. Return false if there isn't a whole piece yet.
+func (c *headerOrderConn) step(out []byte) ([]byte, bool, error) {
+	if len(c.pending) == 0 {
+		return out, false, nil
+	}
+	if c.bodyLeft > 0 {
+		n := int64(len(c.pending))
+		if n > c.bodyLeft {
+			n = c.bodyLeft
+		}
+		out = append(out, c.pending[:n]...)
+		c.pending = c.pending[n:]
+		c.bodyLeft -= n
+		return out, true, nil
+	}
+	if c.chunked {
+		i := bytes.Index(c.pending, []byte("\r\n"))
+		if i < 0 {
+			return out, false, nil
+		}
+		line := c.pending[:i]
+		out = append(out, c.pending[:i+2]...)
+		c.pending = c.pending[i+2:]
+		if c.trailer {
+			// The trailer ends with a blank line.
+			if len(line) == 0 {
+				c.chunked, c.trailer = false, false
+			}
+			return out, true, nil
+		}
+		sizeStr, _, _ := strings.Cut(string(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return nil, false, fmt.Errorf("bad chunk size line %q", line)
+		}
+		if size == 0 {
+			c.trailer = true
+		} else {
+			c.bodyLeft = size + 2
+		}
+		return out, true, nil
+	}
+
+	i := bytes.Index(c.pending, []byte("\r\n\r\n"))
+	if i < 0 {
+		return out, false, nil
+	}
+	head := c.order.rewrite(c.pending[:i])
+	c.pending = c.pending[i+4:]
+	for _, field := range strings.Split(string(head), "\r\n")[1:] {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			c.chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case strings.EqualFold(name, "Content-Length"):
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false, fmt.Errorf("bad Content-Length %q", value)
+			}
+			c.bodyLeft = n
+		}
+	}
+	if c.chunked {
+		c.bodyLeft = 0
+	}
+	out = append(out, head...)
+	out = append(out, "\r\n\r\n"...)
+	return out, true, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestParseHeaderOrder(t *testing.T) {
+	order, err := parseHeaderOrder("Firefox")
+	if err != nil || order[1] != "User-Agent" {
+		t.Errorf("Firefox: got %v, %v", order, err)
+	}
+	order, err = parseHeaderOrder("host, x-session-id ,Content-Length")
+	if err != nil || strings.Join(order, ",") != "host,x-session-id,Content-Length" {
+		t.Errorf("got %v, %v", order, err)
+	}
+	for _, s := range []string{"", " , ", "Host,Bad Name", "Host,host"} {
+		if _, err := parseHeaderOrder(s); err == nil {
+			t.Errorf("%q: unexpected success", s)
+		}
+	}
+}
+
+func TestHeaderOrderFor(t *testing.T) {
+	if order := headerOrderFor(&utls.HelloChrome_Auto); order[1] != "Connection" {
+		t.Errorf("Chrome: %v", order)
+	}
+	if order := headerOrderFor(&utls.HelloRandomizedALPN); order != nil {
+		t.Errorf("randomized: %v", order)
+	}
+}
+
+func TestHeaderOrderRewrite(t *testing.T) {
+	order := headerOrder{"host", "X-SESSION-ID", "Content-Length"}
+	head := "POST /p HTTP/1.1\r\nHost: a\r\nUser-Agent: b\r\nContent-Length: 5\r\nX-Session-Id: c\r\nAccept-Encoding: gzip"
+	expected := "POST /p HTTP/1.1\r\nhost: a\r\nX-SESSION-ID: c\r\nContent-Length: 5\r\nUser-Agent: b\r\nAccept-Encoding: gzip"
+	if got := string(order.rewrite([]byte(head))); got != expected {
+		t.Errorf("got %q", got)
+	}
+}
+
+// A reader with no known length, which makes http.Transport send a chunked
+// body.
+type unknownLengthReader struct {
+	io.Reader
+}
+
+// Requests sent by an http.Transport over a wrapped connection have their
+// fields in order, and their bodies, of known length or chunked, unchanged.
+func TestHeaderOrderConn(t *testing.T) {
+	order := headerOrder{"Host", "x-session-id", "Content-Length", "Transfer-Encoding", "User-Agent"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	bodies := []string{"hello", strings.Repeat("x", 10000), "chunked body", ""}
+	type result struct {
+		raw    string
+		bodies []string
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer close(ch)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		var raw bytes.Buffer
+		br := bufio.NewReader(io.TeeReader(conn, &raw))
+		var got []string
+		for range bodies {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got = append(got, string(body))
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		}
+		ch <- result{raw.String(), got}
+	}()
+
+	tr := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, ln.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			return order.wrapConn(conn), nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	for i, body := range bodies {
+		var r io.Reader = strings.NewReader(body)
+		if i == 2 {
+			r = unknownLengthReader{r}
+		}
+		req, _ := http.NewRequest("POST", "http://meek.example/", r)
+		req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	res := <-ch
+	if strings.Join(res.bodies, "|") != strings.Join(bodies, "|") {
+		t.Errorf("bodies %q", res.bodies)
+	}
+	heads := strings.Split(res.raw, "POST / HTTP/1.1\r\n")[1:]
+	if len(heads) != len(bodies) {
+		t.Fatalf("%d heads", len(heads))
+	}
+	for i, head := range heads {
+		head, _, _ = strings.Cut(head, "\r\n\r\n")
+		var names []string
+		for _, line := range strings.Split(head, "\r\n") {
+			name, _, _ := strings.Cut(line, ":")
+			names = append(names, name)
+		}
+		expected := "Host,x-session-id,Content-Length,User-Agent,Content-Type,Accept-Encoding"
+		if i == 2 {
+			expected = "Host,x-session-id,Transfer-Encoding,User-Agent,Content-Type,Accept-Encoding"
+		}
+		if got := strings.Join(names, ","); got != expected {
+			t.Errorf("request %d: fields %s", i, got)
+		}
+	}
+}
@@ -12,7 +12,10 @@ import (
 	"net/textproto"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
+
+	"../lib/logging"
 )
 
 // The code in this file has to do with communication between meek-client and
@@ -46,6 +49,23 @@ type HelperRoundTripper struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	proxySpec    *ProxySpec
+	// Protects HelperAddr when the helper is run by --helper-exec, which
+	// changes the address when it restarts the helper.
+	lock sync.Mutex
+}
+
+// Change the address of the helper, or set it to nil while there is no
+// helper.
+func (rt *HelperRoundTripper) SetHelperAddr(addr *net.TCPAddr) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.HelperAddr = addr
+}
+
+func (rt *HelperRoundTripper) helperAddr() *net.TCPAddr {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return rt.HelperAddr
 }
 
 func (rt *HelperRoundTripper) SetProxy(u *url.URL) error {
@@ -95,7 +115,11 @@ func makeProxySpec(u *url.URL) (*ProxySpec, error) {
 }
 
 func (rt *HelperRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	s, err := net.DialTCP("tcp", nil, rt.HelperAddr)
+	addr := rt.helperAddr()
+	if addr == nil {
+		return nil, fmt.Errorf("the helper is not running")
+	}
+	s, err := net.DialTCP("tcp", nil, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -140,7 +164,7 @@ func (rt *HelperRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	if err != nil {
 		return nil, err
 	}
-	// log.Printf("encoded %s", encReq)
+	logging.Debugf("encoded %s", scrubPayload(encReq))
 
 	// Send the request.
 	s.SetWriteDeadline(time.Now().Add(rt.WriteTimeout))
@@ -170,7 +194,7 @@ func (rt *HelperRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	if err != nil {
 		return nil, err
 	}
-	// log.Printf("received %s", encResp)
+	logging.Debugf("received %s", scrubPayload(encResp))
 
 	// Decode their JSON.
 	var jsonResp JSONResponse
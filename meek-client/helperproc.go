@@ -0,0 +1,258 @@
+//go:build !js
+// +build !js
+
+package main
+
+// The code in this file runs the helper browser itself (--helper-exec), instead
+// of expecting one to be running already at the --helper address. The browser
+// is started with its own profile (--helper-profile, created if it doesn't
+// exist), which must have the meek-http-helper extension installed, and
+// headless unless --helper-headless=false. When the extension is ready, it
+// writes a line
+//
+//	meek-http-helper: listen 127.0.0.1:PORT
+//
+// to the browser's stdout, and requests go to that address from then on. The
+// browser's other output is logged at debug level. If the browser exits, or
+// doesn't write the line within helperStartTimeout, it is started again after
+// a delay that doubles with each failure in a row (up to
+// maxHelperRestartDelay); requests fail in the meantime. The browser is killed
+// when meek-client exits.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The prefix of the line that gives the helper's address.
+	helperListenPrefix = "meek-http-helper: listen "
+	// How long to wait for the helper's address after starting it.
+	helperStartTimeout = 60 * time.Second
+	// The delay before restarting the helper after its first failure, and
+	// the longest delay.
+	minHelperRestartDelay = time.Second
+	maxHelperRestartDelay = time.Minute
+	// A helper that ran at least this long before exiting is restarted
+	// without delay.
+	helperStableTime = time.Minute
+)
+
+// stringsFlag is a flag.Value that collects the values of a repeated option.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// managedHelper runs a helper browser and keeps it running.
+type managedHelper struct {
+	Path     string
+	Args     []string
+	Profile  string
+	Headless bool
+	// Where to tell the helper's address.
+	rt *HelperRoundTripper
+
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	// Closed when the helper first gives its address.
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// Make a managedHelper that tells rt the helper's address.
+func newManagedHelper(path string, args []string, profile string, headless bool, rt *HelperRoundTripper) *managedHelper {
+	return &managedHelper{
+		Path:     path,
+		Args:     args,
+		Profile:  profile,
+		Headless: headless,
+		rt:       rt,
+		ready:    make(chan struct{}),
+	}
+}
+
+// Return a channel that is closed when the helper is first ready.
+func (h *managedHelper) Ready() <-chan struct{} {
+	return h.ready
+}
+
+// Return the command line arguments of the browser.
+func (h *managedHelper) commandArgs() []string {
+	var args []string
+	if h.Profile != "" {
+		// Firefox options for a profile of our own, apart from any
+		// browser the user is running.
+		args = append(args, "-no-remote", "-profile", h.Profile)
+	}
+	return append(args, h.Args...)
+}
+
+// Parse the address from a line of the helper's output, if it is the line
+// that gives it.
+func parseHelperListen(line string) (*net.TCPAddr, bool, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, helperListenPrefix) {
+		return nil, false, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", strings.TrimPrefix(line, helperListenPrefix))
+	if err != nil {
+		return nil, true, err
+	}
+	if !addr.IP.IsLoopback() {
+		return nil, true, fmt.Errorf("helper address %s is not a loopback address", addr)
+	}
+	return addr, true, nil
+}
+
+// Read the helper's output from r, sending its address on ready, and logging
+// everything else.
+func readHelperOutput(r io.Reader, ready chan<- *net.TCPAddr) {
+	scanner := bufio.NewScanner(r)
+	sent := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		addr, ok, err := parseHelperListen(line)
+		if !ok || sent {
+			logging.Debugf("helper: %s", line)
+			continue
+		}
+		if err != nil {
+			logging.Warnf("helper: %s", err)
+			continue
+		}
+		ready <- addr
+		sent = true
+	}
+	// Keep reading whatever is left, so the browser never blocks on a
+	// full pipe.
+	io.Copy(io.Discard, r)
+}
+
+// Start the browser and wait for it to give its address. Returns a channel
+// that receives the result of Wait.
+func (h *managedHelper) start() (<-chan error, error) {
+	if h.Profile != "" {
+		err := os.MkdirAll(h.Profile, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command(h.Path, h.commandArgs()...)
+	cmd.Env = os.Environ()
+	if h.Headless {
+		cmd.Env = append(cmd.Env, "MOZ_HEADLESS=1")
+	}
+	// A pipe of our own rather than cmd.StdoutPipe, so that Wait doesn't
+	// close it before all the output is read.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	h.lock.Lock()
+	if h.stopped {
+		h.lock.Unlock()
+		pr.Close()
+		pw.Close()
+		return nil, fmt.Errorf("stopped")
+	}
+	err = cmd.Start()
+	if err == nil {
+		h.cmd = cmd
+	}
+	h.lock.Unlock()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	logging.Debugf("started helper %s, pid %d", h.Path, cmd.Process.Pid)
+
+	ready := make(chan *net.TCPAddr, 1)
+	exited := make(chan error, 1)
+	go func() {
+		readHelperOutput(pr, ready)
+		pr.Close()
+	}()
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	timer := time.NewTimer(helperStartTimeout)
+	defer timer.Stop()
+	select {
+	case addr := <-ready:
+		// A helper that printed its address and then exited is not
+		// ready.
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("helper exited before it was ready: %v", err)
+		default:
+		}
+		h.rt.SetHelperAddr(addr)
+		logging.Infof("using helper on %s", addr)
+		h.readyOnce.Do(func() { close(h.ready) })
+		return exited, nil
+	case err := <-exited:
+		return nil, fmt.Errorf("helper exited before it was ready: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-exited
+		return nil, fmt.Errorf("helper gave no address within %s", helperStartTimeout)
+	}
+}
+
+// Run the browser, restarting it whenever it exits, until Stop is called.
+func (h *managedHelper) Run() {
+	delay := minHelperRestartDelay
+	for {
+		started := time.Now()
+		exited, err := h.start()
+		if err == nil {
+			err = <-exited
+			h.rt.SetHelperAddr(nil)
+			if err == nil {
+				err = fmt.Errorf("exited")
+			}
+		}
+		h.lock.Lock()
+		stopped := h.stopped
+		h.lock.Unlock()
+		if stopped {
+			return
+		}
+		if time.Since(started) >= helperStableTime {
+			delay = minHelperRestartDelay
+		}
+		logging.Warnf("helper: %s; restarting in %s", err, delay)
+		time.Sleep(delay)
+		delay = min(2*delay, maxHelperRestartDelay)
+	}
+}
+
+// Kill the browser and don't restart it.
+func (h *managedHelper) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stopped = true
+	if h.cmd != nil && h.cmd.Process != nil {
+		h.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,118 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Run as the fake helper browser when started by newFakeHelper.
+func TestMain(m *testing.M) {
+	switch os.Getenv("MEEK_FAKE_HELPER") {
+	case "":
+		os.Exit(m.Run())
+	case "serve":
+		fmt.Println("starting up")
+		fmt.Println(helperListenPrefix + "127.0.0.1:7000")
+		time.Sleep(time.Hour)
+	case "exit":
+		fmt.Println(helperListenPrefix + "127.0.0.1:7001")
+		// Long enough for the address to be taken before the exit.
+		time.Sleep(500 * time.Millisecond)
+		os.Exit(1)
+	}
+}
+
+// Make a managedHelper that runs this test binary as a fake browser in mode.
+func newFakeHelper(t *testing.T, mode string, rt *HelperRoundTripper) *managedHelper {
+	t.Setenv("MEEK_FAKE_HELPER", mode)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newManagedHelper(exe, nil, "", false, rt)
+}
+
+func TestParseHelperListen(t *testing.T) {
+	addr, ok, err := parseHelperListen("meek-http-helper: listen 127.0.0.1:7000\r\n")
+	if err != nil || !ok || addr.String() != "127.0.0.1:7000" {
+		t.Errorf("got (%v, %v, %v)", addr, ok, err)
+	}
+	if _, ok, _ := parseHelperListen("some other output"); ok {
+		t.Errorf("other output taken for the address")
+	}
+	for _, line := range []string{
+		"meek-http-helper: listen 192.0.2.1:7000",
+		"meek-http-helper: listen 127.0.0.1",
+	} {
+		if _, ok, err := parseHelperListen(line); !ok || err == nil {
+			t.Errorf("%q → (%v, %v), expected an error", line, ok, err)
+		}
+	}
+}
+
+func TestManagedHelperArgs(t *testing.T) {
+	h := newManagedHelper("firefox", []string{"-foreground"}, "/tmp/profile", true, nil)
+	expected := []string{"-no-remote", "-profile", "/tmp/profile", "-foreground"}
+	if args := h.commandArgs(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("got %q, expected %q", args, expected)
+	}
+	h = newManagedHelper("firefox", nil, "", true, nil)
+	if args := h.commandArgs(); len(args) != 0 {
+		t.Errorf("no profile: got %q", args)
+	}
+}
+
+func TestManagedHelper(t *testing.T) {
+	rt := &HelperRoundTripper{}
+	h := newFakeHelper(t, "serve", rt)
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	select {
+	case <-h.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("helper not ready")
+	}
+	if addr := rt.helperAddr(); addr == nil || addr.String() != "127.0.0.1:7000" {
+		t.Errorf("helper address %v", addr)
+	}
+
+	h.Stop()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after Stop")
+	}
+	if addr := rt.helperAddr(); addr != nil {
+		t.Errorf("helper address %v after Stop", addr)
+	}
+}
+
+func TestManagedHelperExit(t *testing.T) {
+	rt := &HelperRoundTripper{}
+	h := newFakeHelper(t, "exit", rt)
+	go h.Run()
+	defer h.Stop()
+	select {
+	case <-h.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("helper not ready")
+	}
+	// The exit is noticed, and the address is forgotten until the helper
+	// is restarted.
+	deadline := time.Now().Add(10 * time.Second)
+	for rt.helperAddr() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := rt.helperAddr(); addr != nil {
+		t.Errorf("helper address %v after exit", addr)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// The code in this file gets Kerberos tokens for Negotiate (SPNEGO)
+// authentication to a proxy, from the credential cache of a user who has
+// already logged in (with kinit, or at login), like browsers do. The Kerberos
+// configuration is read from $KRB5_CONFIG (default /etc/krb5.conf) and the
+// credential cache from $KRB5CCNAME (default /tmp/krb5cc_UID). Only credential
+// caches in files are supported; in particular, not the Windows logon session.
+//
+// Kerberos is used only with --proxy-kerberos. Getting a token means talking
+// to the KDC, and that traffic goes directly from this host, not through the
+// proxy or the tunnel, and is not checked by --strict.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Are there Kerberos credentials to try? A variable so that tests can
+// substitute another.
+var haveKerberos = func() bool {
+	return kerberosCCachePath() != ""
+}
+
+// Return the path of the Kerberos credential cache, or "" if it doesn't exist.
+func kerberosCCachePath() string {
+	path := os.Getenv("KRB5CCNAME")
+	if path == "" {
+		path = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+	}
+	path = strings.TrimPrefix(path, "FILE:")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// Return a SPNEGO token for the service principal name spn (such as
+// "HTTP/proxy.example.com"), or ctx.Err() if ctx is done first. The error is
+// errNoKerberos if there are no Kerberos credentials to use.
+func kerberosToken(ctx context.Context, spn string) ([]byte, error) {
+	type result struct {
+		token []byte
+		err   error
+	}
+	// The Kerberos library can't be interrupted; if ctx is done first, it
+	// is left to finish within its own timeouts.
+	c := make(chan result, 1)
+	go func() {
+		token, err := getKerberosToken(spn)
+		c <- result{token, err}
+	}()
+	select {
+	case r := <-c:
+		return r.token, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Like kerberosToken, but without a context.
+func getKerberosToken(spn string) ([]byte, error) {
+	ccachePath := kerberosCCachePath()
+	if ccachePath == "" {
+		return nil, errNoKerberos
+	}
+	configPath := os.Getenv("KRB5_CONFIG")
+	if configPath == "" {
+		configPath = "/etc/krb5.conf"
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	ccache, err := credentials.LoadCCache(ccachePath)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Destroy()
+	s := spnego.SPNEGOClient(cl, spn)
+	err = s.AcquireCred()
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.InitSecContext()
+	if err != nil {
+		return nil, err
+	}
+	return token.Marshal()
+}
@@ -0,0 +1,15 @@
+package main
+
+// The code in this file has to do with writing TLS session secrets to a key
+// log file (--keylog, or else SSLKEYLOGFILE), which ../lib/keylog opens. It
+// covers connections made with crypto/tls and with uTLS, polling and WebSocket
+// alike, but not those made by the --helper browser extension. The file is
+// for test setups only: anyone with it can decrypt every connection made while
+// it was written.
+
+import (
+	"io"
+)
+
+// Where to write TLS key log lines, or nil not to.
+var keyLogWriter io.Writer
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+
+	"../lib/keylog"
+)
+
+// uTLS connections write their secrets to the key log, which is readable only
+// by its owner.
+func TestKeyLogUTLS(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys")
+	kl, err := keylog.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kl.Close()
+	saved := keyLogWriter
+	defer func() { keyLogWriter = saved }()
+	keyLogWriter = kl
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	// A name rather than an IP address, so that there is an SNI.
+	addr := strings.Replace(strings.TrimPrefix(server.URL, "https://"), "127.0.0.1", "localhost", 1)
+	// The handshake fails, because the test server's certificate is not
+	// trusted, but not before the handshake secrets are known.
+	uconn, err := dialUTLS("tcp", addr, nil, &utls.HelloChrome_Auto, proxy.Direct, false)
+	if err == nil {
+		uconn.Close()
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ") {
+		t.Errorf("no handshake secret in key log %q", data)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); runtime.GOOS != "windows" && perm&0077 != 0 {
+		t.Errorf("key log has permissions %o", perm)
+	}
+}
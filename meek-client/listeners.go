@@ -0,0 +1,229 @@
+package main
+
+// The code in this file keeps the local SOCKS listeners apart from one
+// another. Each listener has default SOCKS args (the arguments of its
+// transport method, see transports.go, or of its --listen option), and
+// connection pools and statistics of its own: its sessions never share a
+// connection, or a multiplexed session, with those of another listener, and
+// the number of sessions and bytes of each listener are logged separately,
+// every listenerStatsInterval and at exit. So one process can serve several
+// bridges, each with its own url, front, and utls, as if each had a
+// meek-client of its own.
+//
+// With --listen, meek-client runs on its own, without tor, like with --tunnel,
+// and the local application speaks SOCKS to each listener.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../lib/goptlib"
+)
+
+// How often to log the statistics of listeners that have had sessions.
+const listenerStatsInterval = time.Hour
+
+// listenSpec is one --listen address and its default SOCKS args.
+type listenSpec struct {
+	Addr string
+	Args pt.Args
+}
+
+// Parse a --listen value of the form "ADDR" or "ADDR;ARGS", where ARGS are
+// semicolon-separated key=value bridge line arguments, like
+// "127.0.0.1:7001;url=https://meek.example.com/;front=cdn.example.net". ADDR
+// may be a bare port number, meaning that port on 127.0.0.1.
+func parseListenSpec(s string) (listenSpec, error) {
+	addr, rest, _ := strings.Cut(s, ";")
+	if !strings.Contains(addr, ":") {
+		addr = net.JoinHostPort("127.0.0.1", addr)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return listenSpec{}, fmt.Errorf("listen %q: %s", s, err)
+	}
+	args, err := parseDefaultArgs(rest)
+	if err != nil {
+		return listenSpec{}, fmt.Errorf("listen %q: %s", s, err)
+	}
+	return listenSpec{Addr: addr, Args: args}, nil
+}
+
+type listenFlag []listenSpec
+
+func (f *listenFlag) String() string {
+	addrs := make([]string, len(*f))
+	for i, spec := range *f {
+		addrs[i] = spec.Addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (f *listenFlag) Set(s string) error {
+	spec, err := parseListenSpec(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// listenerStats are the counts logged for a listener.
+type listenerStats struct {
+	// SOCKS requests, and those that were rejected.
+	Sessions atomic.Int64
+	Rejected atomic.Int64
+	// Bytes read from and written to local connections.
+	BytesSent     atomic.Int64
+	BytesReceived atomic.Int64
+}
+
+// clientListener is a local SOCKS listener's configuration, connection pools,
+// and statistics.
+type clientListener struct {
+	// The transport method name or --listen address, for the log.
+	Name string
+	// Default SOCKS args.
+	Args pt.Args
+
+	mux *muxPool
+	// Connection pools for requests that would otherwise use
+	// httpRoundTripper or the HTTP/1.1-only round tripper, made from
+	// httpRoundTripper on first use.
+	poolsOnce         sync.Once
+	http2Pool, h1Pool *http.Transport
+	// The h2c connection pool, in place of the shared one of
+	// getH2CTransport, made on first use.
+	h2cOnce sync.Once
+	h2cPool http.RoundTripper
+	stats   listenerStats
+}
+
+func newClientListener(name string, args pt.Args) *clientListener {
+	l := &clientListener{Name: name, Args: args}
+	l.mux = newMuxPool(l.carryMux)
+	return l
+}
+
+// Return the round tripper to use in place of rt, which makeRequestInfo
+// chose: the listener's own pool instead of a shared one. Other round
+// trippers, like uTLS and helper ones, are not shared, or can't be copied, and
+// are returned as they are.
+func (l *clientListener) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	l.poolsOnce.Do(func() {
+		l.http2Pool = httpRoundTripper.Clone()
+		l.h1Pool = httpRoundTripper.Clone()
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		l.h1Pool.ForceAttemptHTTP2 = false
+		l.h1Pool.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	})
+	switch rt := rt.(type) {
+	case *http.Transport:
+		if rt == httpRoundTripper {
+			return l.http2Pool
+		}
+		if rt == getHTTP1RoundTripper() {
+			return l.h1Pool
+		}
+	case *h2cRoundTripper:
+		return &h2cRoundTripper{h2c: l.h2cTransport(rt.h2c), fallback: l.roundTripper(rt.fallback)}
+	case *harRoundTripper:
+		return &harRoundTripper{rec: rt.rec, rt: l.roundTripper(rt.rt)}
+	case *agingRoundTripper:
+		return &agingRoundTripper{ager: rt.ager, rt: l.roundTripper(rt.rt)}
+	}
+	return rt
+}
+
+// Return the listener's own h2c transport, to use in place of shared. An
+// http2.Transport can't be cloned, so this is a new one, made the way the
+// shared one was; if that fails, shared is used after all.
+func (l *clientListener) h2cTransport(shared http.RoundTripper) http.RoundTripper {
+	l.h2cOnce.Do(func() {
+		tr, err := makeH2CTransport()
+		if err != nil {
+			l.h2cPool = shared
+			return
+		}
+		l.h2cPool = tr
+	})
+	return l.h2cPool
+}
+
+// Make the RequestInfo for a session of this listener, with args.
+func (l *clientListener) makeRequestInfo(args pt.Args) (*RequestInfo, error) {
+	info, err := makeRequestInfo(args)
+	if err != nil {
+		return nil, err
+	}
+	info.RoundTripper = l.roundTripper(info.RoundTripper)
+	return info, nil
+}
+
+// Carry one end of a pipe, whose other end is a multiplexer session, over a
+// new meek session of this listener.
+func (l *clientListener) carryMux(conn net.Conn, args pt.Args) error {
+	info, err := l.makeRequestInfo(args)
+	if err != nil {
+		return err
+	}
+	return copyLoop(conn, info)
+}
+
+// Count a rejected SOCKS request.
+func (l *clientListener) reject(conn *pt.SocksConn, info *RequestInfo, err error) error {
+	l.stats.Rejected.Add(1)
+	return rejectSOCKS(conn, info, err)
+}
+
+// Return conn wrapped so that its bytes are counted in the listener's
+// statistics.
+func (l *clientListener) count(conn net.Conn) net.Conn {
+	return &countedConn{Conn: conn, stats: &l.stats}
+}
+
+// Format the statistics.
+func (l *clientListener) String() string {
+	return fmt.Sprintf("listener %s: %d sessions, %d rejected, %d bytes sent, %d bytes received",
+		l.Name, l.stats.Sessions.Load(), l.stats.Rejected.Load(), l.stats.BytesSent.Load(), l.stats.BytesReceived.Load())
+}
+
+// Every listenerStatsInterval, log the statistics of each of listeners that
+// has had sessions since the last time. Does not return.
+func logListenerStats(listeners []*clientListener) {
+	lastSessions := make([]int64, len(listeners))
+	for range time.Tick(listenerStatsInterval) {
+		for i, l := range listeners {
+			sessions := l.stats.Sessions.Load()
+			if sessions != lastSessions[i] {
+				log.Print(l)
+				lastSessions[i] = sessions
+			}
+		}
+	}
+}
+
+// countedConn is a net.Conn that counts the bytes read from it as sent, and
+// those written to it as received.
+type countedConn struct {
+	net.Conn
+	stats *listenerStats
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.BytesSent.Add(int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.BytesReceived.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestParseListenSpec(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected listenSpec
+	}{
+		{"7001", listenSpec{"127.0.0.1:7001", pt.Args{}}},
+		{"[::1]:7001", listenSpec{"[::1]:7001", pt.Args{}}},
+		{"127.0.0.1:7001;url=https://meek.example.com/;front=cdn.example.net", listenSpec{"127.0.0.1:7001", pt.Args{
+			"url":   []string{"https://meek.example.com/"},
+			"front": []string{"cdn.example.net"},
+		}}},
+	} {
+		spec, err := parseListenSpec(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec, test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.input, spec, test.expected)
+		}
+	}
+	for _, input := range []string{
+		"::1",
+		"127.0.0.1:7001;https://meek.example.com/",
+		"127.0.0.1:7001;bogus=1",
+	} {
+		if _, err := parseListenSpec(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+// Each listener has its own pools, in place of the shared ones.
+func TestClientListenerRoundTripper(t *testing.T) {
+	a := newClientListener("a", nil)
+	b := newClientListener("b", nil)
+	for _, shared := range []http.RoundTripper{httpRoundTripper, getHTTP1RoundTripper()} {
+		rtA, rtB := a.roundTripper(shared), b.roundTripper(shared)
+		if rtA == shared || rtB == shared || rtA == rtB {
+			t.Errorf("pools are shared")
+		}
+		if a.roundTripper(shared) != rtA {
+			t.Errorf("a listener's pool changed")
+		}
+	}
+	if a.roundTripper(httpRoundTripper) == a.roundTripper(getHTTP1RoundTripper()) {
+		t.Errorf("HTTP/1.1 and HTTP/2 pools are the same")
+	}
+	if tr := a.roundTripper(getHTTP1RoundTripper()).(*http.Transport); tr.TLSNextProto == nil {
+		t.Errorf("HTTP/1.1 pool may use HTTP/2")
+	}
+	// Round trippers that aren't shared are used as they are.
+	other := &http.Transport{}
+	if a.roundTripper(other) != other {
+		t.Errorf("unshared round tripper replaced")
+	}
+	shared, err := getH2CTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2c := &h2cRoundTripper{h2c: shared, fallback: httpRoundTripper}
+	rtA := a.roundTripper(h2c).(*h2cRoundTripper)
+	if rtA.fallback != a.roundTripper(httpRoundTripper) {
+		t.Errorf("h2c fallback is not the listener's pool")
+	}
+	rtB := b.roundTripper(h2c).(*h2cRoundTripper)
+	if rtA.h2c == shared || rtB.h2c == shared || rtA.h2c == rtB.h2c {
+		t.Errorf("h2c pools are shared")
+	}
+	if a.roundTripper(h2c).(*h2cRoundTripper).h2c != rtA.h2c {
+		t.Errorf("a listener's h2c pool changed")
+	}
+}
+
+func TestClientListenerStats(t *testing.T) {
+	l := newClientListener("test", nil)
+	local, remote := net.Pipe()
+	defer local.Close()
+	conn := l.count(remote)
+	go func() {
+		local.Write([]byte("hello"))
+		io.ReadFull(local, make([]byte, 3))
+	}()
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Write([]byte("abc"))
+	l.stats.Sessions.Add(1)
+	expected := "listener test: 1 sessions, 0 rejected, 5 bytes sent, 3 bytes received"
+	if l.String() != expected {
+		t.Errorf("got %q, expected %q", l.String(), expected)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// The code in this file has to do with keeping sensitive information, like
+// payload data and proxy credentials, out of the log. The log level is kept by
+// ../lib/logging.
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// If true, allow payload contents and proxy credentials in the log. Set by
+// --unsafe-logging.
+var unsafeLogging = false
+
+// Return a URL in a form suitable for logging: with any password replaced by
+// "xxxxx", unless --unsafe-logging is in effect.
+func scrubURL(u *url.URL) string {
+	if unsafeLogging {
+		return u.String()
+	}
+	return u.Redacted()
+}
+
+// Return payload data in a form suitable for logging: quoted if
+// --unsafe-logging is in effect, otherwise only its length.
+func scrubPayload(b []byte) string {
+	if unsafeLogging {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("[%d bytes]", len(b))
+}
@@ -0,0 +1,655 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"../lib/faultreport"
+	"../lib/goptlib"
+	"../lib/keylog"
+	"../lib/logging"
+	"../lib/parent"
+)
+
+func main() {
+	var helperAddr string
+	var helperExec, helperProfile string
+	var helperArgs stringsFlag
+	var helperHeadless bool
+	var strict bool
+	var logFilename string
+	var keyLogFile string
+	var idleConnTimeout, connMaxAge time.Duration
+	var maxIdleConnsPerHost int
+	var harFilename string
+	var caCertFile string
+	var insecure bool
+	var headerOrderSpec string
+	var proxy string
+	var socksPort string
+	var logLevelName string
+	var bindAddr string
+	var fwmark int
+	var dnsMinTTL, dnsMaxTTL, dnsNegativeTTL time.Duration
+	var tunnels tunnelFlag
+	var transports transportFlag
+	var listens listenFlag
+	var echoSecretFile string
+	var endpointsFile string
+	var bridgesURL, bridgesKey string
+	var frontProbeInterval time.Duration
+	var frontStatePath string
+	var coverPaths string
+	var coverInterval time.Duration
+	var coverBurst int
+	var coverToServer bool
+	var timing string
+	var timingDiurnal bool
+	var exitWithParent bool
+	var maxSessions int
+	var sessionQueueWait time.Duration
+	var version bool
+	var err error
+
+	os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	os.Setenv("TOR_PT_CLIENT_TRANSPORTS", "meek")
+
+	flag.StringVar(&caCertFile, "cacert", "", "PEM file of CA certificates to trust instead of the system's")
+	flag.StringVar(&bridgesKey, "bridges-key", "", "base64 Ed25519 public key that signs the --bridges-url list")
+	flag.StringVar(&bridgesURL, "bridges-url", "", "URL of a signed list of url/front combinations to fetch at startup")
+	flag.StringVar(&bindAddr, "bind-addr", "", "local IP address or interface name to make outgoing connections from")
+	flag.IntVar(&coverBurst, "cover-burst", 4, "maximum cover requests in one burst")
+	flag.DurationVar(&coverInterval, "cover-interval", 30*time.Second, "mean time between bursts of cover requests")
+	flag.BoolVar(&coverToServer, "cover-to-server", false, "send cover requests to meek-server instead of the front domain")
+	flag.StringVar(&coverPaths, "cover-paths", "", "comma-separated paths of assets on the front domain to fetch as cover traffic")
+	flag.DurationVar(&dnsMaxTTL, "dns-max-ttl", defaultDNSMaxTTL, "how long to keep reusing a DNS answer when new lookups fail")
+	flag.DurationVar(&dnsMinTTL, "dns-min-ttl", defaultDNSMinTTL, "how long to cache DNS answers (0 disables the cache)")
+	flag.DurationVar(&dnsNegativeTTL, "dns-negative-ttl", defaultDNSNegativeTTL, "how long to cache failed DNS lookups")
+	flag.StringVar(&options.Credential, "credential", "", "credential to present to the server for a QoS class, if no credential= SOCKS arg")
+	flag.StringVar(&options.Connect, "connect", "", "host name or address to connect to instead of the front, for domain shadowing, if no connect= SOCKS arg")
+	flag.DurationVar(&connMaxAge, "conn-max-age", 0, "close connections this long after their first request, once no request is using them, for CDNs that stall old connections (0 means no limit)")
+	flag.StringVar(&options.DNSDomain, "dns-domain", "", "domain under which to encode queries for mode=dns, if no dns-domain= SOCKS arg")
+	flag.StringVar(&options.DoHURL, "doh-url", defaultDoHURL, "URL of the DNS-over-HTTPS resolver for mode=dns, if no doh= SOCKS arg")
+	flag.StringVar(&echoSecretFile, "echo-secret-file", "", "file containing the secret of the server's --echo-secret-file, for meek-client test")
+	flag.StringVar(&endpointsFile, "endpoints-file", "", "file of url=, front=, and utls= arguments that override --url, --front, and --utls, reloaded on SIGHUP instead of toggling debug logging")
+	flag.BoolVar(&exitWithParent, "exit-with-parent", false, "exit when the parent process exits, for launchers that don't close stdin")
+	flag.StringVar(&options.Front, "front", "", "front domain name, or comma-separated list of them, if no front= SOCKS arg")
+	flag.DurationVar(&frontProbeInterval, "front-probe-interval", defaultFrontProbeInterval, "how often to probe the latency of multiple --front domains")
+	flag.StringVar(&frontStatePath, "front-state", "", "file to save front probe results in (default: in the pluggable transport state directory)")
+	flag.IntVar(&fwmark, "fwmark", 0, "firewall mark (SO_MARK) to set on outgoing connections (Linux only)")
+	flag.BoolVar(&options.H2C, "h2c", false, "use HTTP/2 with prior knowledge for http:// URLs, if no http= SOCKS arg")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", httpRoundTripper.IdleConnTimeout, "how long to keep an unused connection for later requests (0 means no limit)")
+	flag.BoolVar(&insecure, "insecure", false, "don't check server certificates at all (dangerous; for test setups only)")
+	flag.StringVar(&harFilename, "har", "", "file to record the metadata of HTTP transactions in, in HAR format, for debugging (secrets are scrubbed; bodies are not recorded)")
+	flag.StringVar(&headerOrderSpec, "header-order", "", "order of header fields in HTTP/1.1 requests made with uTLS: chrome, firefox, safari, or a comma-separated list of names (default that of the uTLS browser)")
+	flag.StringVar(&helperAddr, "helper", "", "address of HTTP helper (browser extension)")
+	flag.Var(&helperArgs, "helper-arg", "command line argument for the --helper-exec browser (may be repeated)")
+	flag.StringVar(&helperExec, "helper-exec", "", "browser with the HTTP helper extension to run, and restart if it exits, instead of using --helper")
+	flag.BoolVar(&helperHeadless, "helper-headless", true, "run the --helper-exec browser without a window")
+	flag.StringVar(&helperProfile, "helper-profile", "", "profile directory for the --helper-exec browser")
+	flag.BoolVar(&options.HTTP1, "http1", false, "use HTTP/1.1 only, never HTTP/2, if no http= SOCKS arg")
+	flag.StringVar(&keyLogFile, "keylog", "", "file to append TLS session secrets to, for decrypting test captures (default $SSLKEYLOGFILE; never use in production)")
+	flag.Var(&listens, "listen", "ADDR[;ARGS]: accept SOCKS connections on ADDR, with semicolon-separated key=value ARGS as default SOCKS args, instead of running as a tor transport (may be repeated)")
+	flag.StringVar(&logFilename, "log", "", "name of log file")
+	flag.StringVar(&logLevelName, "log-level", "info", "log verbosity: debug, info, or warn")
+	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "allow payload data and proxy credentials in the log")
+	flag.IntVar(&maxIdleConnsPerHost, "max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "most unused HTTP/1.1 connections to keep for later requests, per host")
+	flag.IntVar(&maxSessions, "max-sessions", 0, "maximum sessions at once; further SOCKS connections are refused (0 means unlimited)")
+	flag.StringVar(&options.Method, "method", "POST", "HTTP method of transport requests if no method= SOCKS arg: "+strings.Join(transportMethodNames, ", "))
+	flag.StringVar(&options.Mode, "mode", modePoll, "carrier mode if no mode= SOCKS arg: poll, ws, auto, or dns")
+	flag.StringVar(&proxy, "proxy", "", "proxy URL")
+	flag.BoolVar(&options.ProxyKerberos, "proxy-kerberos", false, "answer a proxy's Negotiate challenge with Kerberos credentials from the ticket cache (the KDC is contacted directly, not through the proxy)")
+	flag.StringVar(&socksPort, "port", "4455", "listening socks port")
+	flag.DurationVar(&sessionQueueWait, "session-queue-wait", 0, "how long a connection over --max-sessions waits for a session to end before it is refused")
+	flag.BoolVar(&strict, "strict", false, "refuse any connection that isn't to a front or the proxy, failing the SOCKS request, and log each attempt")
+	flag.StringVar(&timing, "timing", timingBackoff, "timing of polls in idle sessions: backoff, or browser for bursts and think times like a browser's")
+	flag.BoolVar(&timingDiurnal, "timing-diurnal", false, "with --timing=browser, make think times longer at night by the local clock")
+	flag.Var(&transports, "transport", "NAME[:ARGS]: also serve transport method NAME, with semicolon-separated key=value ARGS as default SOCKS args (may be repeated)")
+	flag.Var(&tunnels, "tunnel", "LOCAL=REMOTE: forward local port LOCAL to REMOTE through the server, instead of running as a tor transport (may be repeated)")
+	flag.StringVar(&options.URL, "url", "", "URL to request if no url= SOCKS arg")
+	flag.StringVar(&options.UTLSName, "utls", "", "uTLS Client Hello ID")
+	flag.BoolVar(&version, "version", false, "print the version and build information and exit")
+	flag.BoolVar(&options.Mux, "mux", false, "carry SOCKS connections with the same SOCKS args over one shared session if no mux= SOCKS arg")
+	flag.IntVar(&options.Pipeline, "pipeline", 1, "maximum requests in flight per session if no pipeline= SOCKS arg")
+	flag.Parse()
+	options.Clock = systemClock{}
+
+	if version {
+		fmt.Printf("meek-client %s\n", getBuildInfo())
+		os.Exit(0)
+	}
+
+	// "meek-client test" runs a self-test and exits. Options may come
+	// before or after "test".
+	selfTest := flag.Arg(0) == "test"
+	if selfTest {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	// "meek-client validate ARGS" checks the arguments of a bridge line
+	// and exits. ARGS may be one word or several, and options may come
+	// before or after.
+	validate := flag.Arg(0) == "validate"
+	var bridgeLine []string
+	if validate {
+		rest := flag.Args()[1:]
+		for {
+			flag.CommandLine.Parse(rest)
+			if flag.NArg() == 0 {
+				break
+			}
+			bridgeLine = append(bridgeLine, flag.Arg(0))
+			rest = flag.Args()[1:]
+		}
+	}
+
+	// Set up the log and fault reports before checking the other
+	// options, so that a bad option leaves a report.
+	log.SetFlags(log.LstdFlags | log.LUTC)
+	if logFilename != "" {
+		f, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			// If we fail to open the log, emit a message that will
+			// appear in tor's log.
+			pt.CmethodError(ptMethodName, fmt.Sprintf("error opening log file: %s", err))
+			faultreport.Fatalf("error opening log file: %s", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+	if !selfTest && !validate && os.Getenv("TOR_PT_STATE_LOCATION") != "" {
+		dir, err := pt.MakeStateDir()
+		if err != nil {
+			log.Printf("can't make state directory for fault reports: %s", err)
+		} else {
+			faultreport.Default = faultreport.New(dir, "meek-client", hashConfig(flag.CommandLine), getBuildInfo())
+			log.SetOutput(io.MultiWriter(log.Writer(), faultreport.Default))
+		}
+	}
+	if !selfTest && !validate {
+		log.Printf("starting version %s", getBuildInfo())
+	}
+	if filename, err := faultreport.Default.WatchCrashes(); err != nil {
+		log.Printf("error setting up crash output: %s", err)
+	} else if filename != "" {
+		log.Printf("the last run crashed; fault report in %s", filename)
+	}
+
+	level, err := logging.ParseLevel(logLevelName)
+	if err != nil {
+		faultreport.Fatal(err)
+	}
+	logging.SetLevel(level)
+
+	err = checkMode(options.Mode)
+	if err != nil {
+		faultreport.Fatalf("--mode: %s", err)
+	}
+	options.Method, err = checkMethod(options.Method)
+	if err != nil {
+		faultreport.Fatalf("--method: %s", err)
+	}
+
+	if coverPaths != "" {
+		paths, err := parseCoverPaths(coverPaths)
+		if err != nil {
+			faultreport.Fatalf("--cover-paths: %s", err)
+		}
+		if coverInterval <= 0 || coverBurst < 1 {
+			faultreport.Fatalf("--cover-interval and --cover-burst must be positive")
+		}
+		options.Cover = &coverModel{Paths: paths, Interval: coverInterval, Burst: coverBurst, ToServer: coverToServer}
+	}
+
+	options.Timing, err = parseTiming(timing, timingDiurnal)
+	if err != nil {
+		faultreport.Fatalf("--timing: %s", err)
+	}
+
+	if options.HTTP1 && options.H2C {
+		faultreport.Fatalf("--http1 and --h2c are mutually exclusive")
+	}
+	if fwmark != 0 && !fwmarkSupported {
+		faultreport.Fatalf("--fwmark is not supported on this platform")
+	}
+	sessionSlots = newSessionLimiter(maxSessions, sessionQueueWait)
+
+	var bridgesU *url.URL
+	var bridgesPubKey ed25519.PublicKey
+	if bridgesURL != "" {
+		if bridgesKey == "" {
+			faultreport.Fatalf("--bridges-url requires --bridges-key")
+		}
+		bridgesPubKey, err = parseBridgesKey(bridgesKey)
+		if err != nil {
+			faultreport.Fatal(err)
+		}
+		bridgesU, err = url.Parse(bridgesURL)
+		if err != nil {
+			faultreport.Fatalf("can't parse --bridges-url: %s", err)
+		}
+	}
+
+	// The self-test, validation, and the tunnel and listen modes don't
+	// talk to tor.
+	var ptInfo pt.ClientInfo
+	if !selfTest && !validate && len(tunnels) == 0 && len(listens) == 0 {
+		ptInfo, err = pt.ClientSetup(nil)
+		if err != nil {
+			faultreport.Fatalf("error in ClientSetup: %s", err)
+		}
+	}
+
+	kl, err := keylog.Open(keyLogFile)
+	if err != nil {
+		faultreport.Fatalf("--keylog: %s", err)
+	}
+	if kl != nil {
+		defer kl.Close()
+		keyLogWriter = kl
+	}
+	if harFilename != "" {
+		harCapture, err = newHARRecorder(harFilename)
+		if err != nil {
+			faultreport.Fatalf("--har: %s", err)
+		}
+		defer harCapture.Save()
+		go harCapture.Run(harSaveInterval)
+		log.Printf("recording HTTP transactions to %s", harFilename)
+	}
+	if caCertFile != "" && insecure {
+		faultreport.Fatalf("--cacert and --insecure are mutually exclusive")
+	}
+	if helperAddr != "" && helperExec != "" {
+		faultreport.Fatalf("--helper and --helper-exec are mutually exclusive")
+	}
+	useHelper := helperAddr != "" || helperExec != ""
+	if strict && useHelper {
+		faultreport.Fatalf("--strict is not compatible with --helper")
+	}
+	if (caCertFile != "" || insecure) && useHelper {
+		faultreport.Fatalf("--cacert and --insecure are not compatible with --helper")
+	}
+	if caCertFile != "" {
+		rootCAs, err = loadCACerts(caCertFile)
+		if err != nil {
+			faultreport.Fatalf("--cacert: %s", err)
+		}
+	}
+	if insecure {
+		insecureSkipVerify = true
+		log.Printf("WARNING: --insecure: not checking server certificates; anyone on the path can intercept the traffic")
+	}
+	httpRoundTripper.TLSClientConfig = newTLSConfig()
+	if idleConnTimeout < 0 || maxIdleConnsPerHost < 0 || connMaxAge < 0 {
+		faultreport.Fatalf("--idle-conn-timeout, --max-idle-conns-per-host, and --conn-max-age may not be negative")
+	}
+	httpRoundTripper.IdleConnTimeout = idleConnTimeout
+	httpRoundTripper.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if connMaxAge > 0 {
+		if useHelper {
+			faultreport.Fatalf("--conn-max-age is not compatible with --helper")
+		}
+		if connMaxAge < time.Second {
+			faultreport.Fatalf("--conn-max-age must be at least 1s")
+		}
+		connAging = newConnAger(connMaxAge)
+		go connAging.Run(connAgeSweepInterval(connMaxAge))
+	}
+	if headerOrderSpec != "" {
+		if useHelper {
+			faultreport.Fatalf("--header-order is not compatible with --helper")
+		}
+		options.HeaderOrder, err = parseHeaderOrder(headerOrderSpec)
+		if err != nil {
+			faultreport.Fatalf("--header-order: %s", err)
+		}
+	}
+
+	if helperAddr != "" {
+		options.UseHelper = true
+		helperRoundTripper.HelperAddr, err = net.ResolveTCPAddr("tcp", helperAddr)
+		if err != nil {
+			faultreport.Fatalf("can't resolve helper address: %s", err)
+		}
+		log.Printf("using helper on %s", helperRoundTripper.HelperAddr)
+	} else if helperExec != "" {
+		options.UseHelper = true
+	}
+
+	if proxy != "" {
+		options.ProxyURL, err = url.Parse(proxy)
+		if err != nil {
+			faultreport.Fatalf("can't parse proxy URL: %s", err)
+		}
+	}
+
+	err = configureOutboundDialer(bindAddr, fwmark)
+	if err != nil {
+		faultreport.Fatal(err)
+	}
+	if dnsMinTTL > 0 {
+		outbound.cache = newDNSCache(dnsMinTTL, dnsMaxTTL, dnsNegativeTTL)
+	}
+	httpRoundTripper.DialContext = outbound.DialContext
+
+	// Disable the default ProxyFromEnvironment setting.
+	// httpRoundTripper.Proxy is overridden below if options.ProxyURL is
+	// set.
+	httpRoundTripper.Proxy = nil
+
+	// Command-line proxy overrides managed configuration.
+	if options.ProxyURL == nil {
+		options.ProxyURL = ptInfo.ProxyURL
+	}
+	// Check whether we support this kind of proxy.
+	if options.ProxyURL != nil {
+		err = checkProxyURL(options.ProxyURL)
+		if err != nil {
+			pt.ProxyError(err.Error())
+			faultreport.Fatalf("proxy error: %s", err)
+		}
+		log.Printf("using proxy %s", scrubURL(options.ProxyURL))
+		switch options.ProxyURL.Scheme {
+		case "http", "https":
+			// net/http's own proxy support knows only Basic
+			// authentication, and gives up on a 407; do the
+			// CONNECT for https URLs ourselves (see
+			// makeProxyDialer). http URLs still go through
+			// Proxy, as plain requests.
+			d, err := makeProxyDialer(options.ProxyURL, nil, nil)
+			if err == nil {
+				httpRoundTripper.DialContext, err = proxyConnectDialContext(options.ProxyURL, d)
+			}
+			if err != nil {
+				pt.ProxyError(err.Error())
+				faultreport.Fatalf("proxy error: %s", err)
+			}
+			httpRoundTripper.Proxy = proxyForHTTPURLs(options.ProxyURL)
+		default:
+			httpRoundTripper.Proxy = http.ProxyURL(options.ProxyURL)
+		}
+		if options.UseHelper {
+			err = helperRoundTripper.SetProxy(options.ProxyURL)
+			if err != nil {
+				pt.ProxyError(err.Error())
+				faultreport.Fatalf("proxy error: %s", err)
+			}
+		}
+		if ptInfo.ProxyURL != nil {
+			pt.ProxyDone()
+		}
+	}
+
+	if strict {
+		strictGuard, err = newLeakGuard(options.ProxyURL)
+		if err != nil {
+			faultreport.Fatalf("--strict: %s", err)
+		}
+		log.Printf("strict mode: connections go only to the fronts or the proxy")
+	}
+
+	// The helper browser is needed for anything but validation.
+	var managed *managedHelper
+	if helperExec != "" && !validate {
+		managed = newManagedHelper(helperExec, helperArgs, helperProfile, helperHeadless, helperRoundTripper)
+		go managed.Run()
+		defer managed.Stop()
+		// faultreport.Fatalf and os.Exit don't run deferred calls.
+		faultreport.BeforeExit = managed.Stop
+		select {
+		case <-managed.Ready():
+		case <-time.After(helperStartTimeout):
+			log.Printf("helper is not ready; carrying on without it")
+		}
+	}
+
+	// The command-line values of the options that --endpoints-file can
+	// change.
+	baseEndpoints := endpoints{URL: options.URL, Front: options.Front, UTLSName: options.UTLSName}
+	startEndpoints := baseEndpoints
+	if endpointsFile != "" {
+		startEndpoints, err = readEndpointsFile(endpointsFile, baseEndpoints)
+		if err != nil {
+			faultreport.Fatalf("--endpoints-file: %s", err)
+		}
+	}
+	startSelector := func(e endpoints, fronts []string) (*frontSelector, error) {
+		return startFrontSelector(e, fronts, frontStatePath, frontProbeInterval)
+	}
+	// Anything that needs a single front, like fetching the bridge list,
+	// uses the first of several.
+	err = applyEndpoints(startEndpoints, startSelector)
+	if err != nil {
+		faultreport.Fatal(err)
+	}
+
+	if bridgesURL != "" {
+		err = loadBridges(bridgesU, bridgesPubKey)
+		if err != nil {
+			// Carry on with --url and --front, if any.
+			log.Printf("error fetching bridge list: %s", err)
+		}
+	}
+
+	if selfTest {
+		status := selfTestMain(echoSecretFile)
+		if managed != nil {
+			// os.Exit doesn't run deferred calls.
+			managed.Stop()
+		}
+		harCapture.Save()
+		os.Exit(status)
+	}
+	if validate {
+		os.Exit(validateMain(strings.Join(bridgeLine, " ")))
+	}
+
+	listeners := make([]net.Listener, 0)
+	var clientListeners []*clientListener
+	if len(tunnels) > 0 || len(listens) > 0 {
+		// Tunnel and listen modes: there is nothing to report to tor.
+		for _, spec := range listens {
+			ln, err := pt.ListenSocks("tcp", spec.Addr)
+			if err != nil {
+				faultreport.Fatalf("error opening SOCKS listener: %s", err)
+			}
+			l := newClientListener(ln.Addr().String(), spec.Args)
+			go acceptSOCKS(ln, l)
+			log.Printf("listening on %s", ln.Addr())
+			clientListeners = append(clientListeners, l)
+			listeners = append(listeners, ln)
+		}
+		for _, spec := range tunnels {
+			ln, err := net.Listen("tcp", spec.Local)
+			if err != nil {
+				faultreport.Fatalf("error opening tunnel listener: %s", err)
+			}
+			go acceptTunnel(ln, spec.Remote)
+			log.Printf("tunneling %s to %s", ln.Addr(), spec.Remote)
+			listeners = append(listeners, ln)
+		}
+	} else {
+		methods := transportMethods(transports)
+		// Only the first listener gets --port; the others get any
+		// free port, which tor learns from the CMETHOD line.
+		port := socksPort
+		for _, methodName := range ptInfo.MethodNames {
+			args, ok := methods[methodName]
+			if !ok {
+				pt.CmethodError(methodName, "no such method")
+				continue
+			}
+			ln, err := pt.ListenSocks("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				pt.CmethodError(methodName, err.Error())
+				continue
+			}
+			port = "0"
+			l := newClientListener(methodName, args)
+			go acceptSOCKS(ln, l)
+			pt.Cmethod(methodName, ln.Version(), ln.Addr())
+			log.Printf("listening for %s on %s", methodName, ln.Addr())
+			clientListeners = append(clientListeners, l)
+			listeners = append(listeners, ln)
+		}
+		pt.CmethodsDone()
+	}
+	go logListenerStats(clientListeners)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	// SIGHUP reloads --endpoints-file, if there is one, or else turns
+	// debug logging on for a while, and off again.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			if endpointsFile != "" {
+				reloadEndpoints(endpointsFile, baseEndpoints, startSelector)
+			} else {
+				logging.ToggleDebug()
+			}
+		}
+	}()
+
+	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+		// This environment variable means we should treat EOF on stdin
+		// just like SIGTERM: https://bugs.torproject.org/15435.
+		go func() {
+			io.Copy(ioutil.Discard, os.Stdin)
+			log.Printf("synthesizing SIGTERM because of stdin close")
+			sigChan <- syscall.SIGTERM
+		}()
+	}
+
+	if exitWithParent {
+		go func() {
+			err := parent.WaitExit()
+			if err != nil {
+				log.Printf("not watching parent process: %s", err)
+				return
+			}
+			log.Printf("synthesizing SIGTERM because the parent process exited")
+			sigChan <- syscall.SIGTERM
+		}()
+	}
+
+	// Wait for a signal.
+	sig := <-sigChan
+	log.Printf("got signal %s", sig)
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	// Let open sessions finish their requests and close.
+	n, idle := openSessions.Drain()
+	if n > 0 {
+		log.Printf("closing %d sessions", n)
+		select {
+		case <-idle:
+		case <-time.After(drainTimeout):
+			log.Printf("timed out closing sessions")
+		case sig := <-sigChan:
+			log.Printf("got signal %s, not waiting for sessions", sig)
+		}
+	}
+	for _, l := range clientListeners {
+		log.Print(l)
+	}
+	if strictGuard != nil {
+		log.Printf("strict mode blocked %d connections", strictGuard.Blocked())
+	}
+
+	log.Printf("done")
+}
+
+// Run the self-test, with the echo secret in echoSecretFile, and print a
+// report. Returns the exit status.
+func selfTestMain(echoSecretFile string) int {
+	if echoSecretFile == "" {
+		fmt.Fprintf(os.Stderr, "the self-test needs --echo-secret-file\n")
+		return 1
+	}
+	echoSecret, err := readEchoSecret(echoSecretFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	result, err := runSelfTest(info, echoSecret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "self-test failed: %s\n", err)
+		return 1
+	}
+	reportSelfTest(os.Stdout, info, result)
+	return 0
+}
+
+// Fetch the bridge list for --bridges-url into options.Bridges.
+func loadBridges(u *url.URL, key ed25519.PublicKey) error {
+	rt, err := chooseRoundTripper(options.UTLSName, options.UTLSName != "", options.HTTP1, options.H2C)
+	if err != nil {
+		return err
+	}
+	if strictGuard != nil {
+		strictGuard.AllowURL(u, options.Front)
+	}
+	bridges, err := fetchBridges(u, options.Front, rt, key)
+	if err != nil {
+		return err
+	}
+	options.Bridges = bridges
+	log.Printf("fetched %d bridges", len(bridges))
+	return nil
+}
+
+// Make a front selector to choose among fronts for the endpoints e, and start
+// probing them in the background.
+func startFrontSelector(e endpoints, fronts []string, statePath string, interval time.Duration) (*frontSelector, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("--front-probe-interval must be positive")
+	}
+	var err error
+	if statePath == "" {
+		statePath, err = defaultFrontStatePath()
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt, err := chooseRoundTripper(e.UTLSName, e.UTLSName != "", options.HTTP1, options.H2C)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	if u, err := url.Parse(e.URL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	sel := newFrontSelector(fronts, statePath, scheme, rt)
+	err = sel.load()
+	if err != nil {
+		// Start from scratch.
+		log.Printf("error loading front probe results: %s", err)
+	}
+	go sel.Run(interval)
+	return sel, nil
+}
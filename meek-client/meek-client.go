@@ -34,26 +34,30 @@ package main
 
 import (
 	"../lib/goptlib"
+	"../lib/logging"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
-	"flag"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
-	"os/signal"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
 const (
+	programVersion = "0.38.0"
+
 	ptMethodName = "meek"
 	// A session ID is a randomly generated string that identifies a
 	// long-lived session. We split a TCP stream across multiple HTTP
@@ -62,7 +66,8 @@ const (
 	sessionIDLength = 8
 	// The size of the largest chunk of data we will read from the SOCKS
 	// port before forwarding it in a request, and the maximum size of a
-	// body we are willing to handle in a reply.
+	// body we are willing to handle in a reply, unless we negotiate another
+	// size with the server; see payloadsize.go.
 	maxPayloadLength = 0x10000
 	// We must poll the server to see if it has anything to send; there is
 	// no way for the server to push data back to us until we send an HTTP
@@ -78,6 +83,10 @@ const (
 	maxTries = 10
 	// Wait this long between retries.
 	retryDelay = 30 * time.Second
+	// The most requests per session we will have in flight at once.
+	maxPipeline = 32
+	// How long to wait for the server to acknowledge closing a session.
+	closeTimeout = 10 * time.Second
 	// Safety limits on interaction with the HTTP helper.
 	maxHelperResponseLength = 10000000
 	helperReadTimeout       = 60 * time.Second
@@ -89,6 +98,25 @@ const (
 // setting (notably, disabling the default ProxyFromEnvironment).
 var httpRoundTripper *http.Transport = http.DefaultTransport.(*http.Transport).Clone()
 
+// We use this RoundTripper in place of httpRoundTripper when HTTP/2 is
+// disabled. It is made from httpRoundTripper on first use, after main has
+// finished configuring that.
+var (
+	http1RoundTripper     *http.Transport
+	http1RoundTripperOnce sync.Once
+)
+
+func getHTTP1RoundTripper() *http.Transport {
+	http1RoundTripperOnce.Do(func() {
+		tr := httpRoundTripper.Clone()
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		http1RoundTripper = tr
+	})
+	return http1RoundTripper
+}
+
 // We use this RoundTripper when --helper is in effect.
 var helperRoundTripper = &HelperRoundTripper{
 	ReadTimeout:  helperReadTimeout,
@@ -102,6 +130,43 @@ var options struct {
 	ProxyURL  *url.URL
 	UseHelper bool
 	UTLSName  string
+	Pipeline  int
+	// Answer a proxy's Negotiate challenge with Kerberos; see
+	// kerberos.go.
+	ProxyKerberos bool
+	// Carry SOCKS connections over shared sessions; see muxpool.go.
+	Mux bool
+	// Disable HTTP/2.
+	HTTP1 bool
+	// Use HTTP/2 with prior knowledge for http:// URLs.
+	H2C bool
+	// The order of header fields in HTTP/1.1 requests made with uTLS, or
+	// nil for that of the uTLS browser; see headerorder.go.
+	HeaderOrder headerOrder
+	// url/front combinations fetched with --bridges-url.
+	Bridges []bridgeSpec
+	// Carrier mode: modePoll, modeWebSocket, modeAuto, or modeDNS.
+	Mode string
+	// The method of transport requests; see methods.go.
+	Method string
+	// The domain and DoH resolver for modeDNS; see dnstunnel.go.
+	DNSDomain string
+	DoHURL    string
+	// The name or address to connect to instead of the front, for
+	// domain shadowing; see shadow.go.
+	Connect string
+	// The credential to present to the server for a QoS class, or "" for
+	// none.
+	Credential string
+	// Chooses among several --front domains; nil if there is only one.
+	FrontSelector *frontSelector
+	// Cover traffic for each polling session; nil if disabled.
+	Cover *coverModel
+	// Browser-like timing of polls; nil for the polling backoff. See
+	// timing.go.
+	Timing *timingModel
+	// Times poll intervals and retry delays; see deps.go.
+	Clock Clock
 }
 
 // RequestInfo encapsulates all the configuration used for a request–response
@@ -110,6 +175,19 @@ var options struct {
 type RequestInfo struct {
 	// What to put in the X-Session-ID header.
 	SessionID string
+	// The session token issued by the server, if any. Shared by all
+	// copies of the RequestInfo for a session.
+	Token *sessionToken
+	// The negotiated payload size, or nil not to negotiate. Shared by all
+	// copies of the RequestInfo for a session.
+	PayloadSize *payloadSize
+	// Measurements for sizing requests to the path, or nil for fixed
+	// sizes; see bdp.go. Shared by all copies of the RequestInfo for a
+	// session.
+	BDP *bdpEstimator
+	// The latest poll hint from the server. Shared by all copies of the
+	// RequestInfo for a session.
+	PollHint *pollHint
 	// The URL to request.
 	URL *url.URL
 	// The Host header to put in the HTTP request (optional and may be
@@ -118,11 +196,49 @@ type RequestInfo struct {
 	// The RoundTripper to use to send requests. This may vary depending on
 	// the value of global options like --helper.
 	RoundTripper http.RoundTripper
+	// Times poll intervals and retry delays. nil means the system clock.
+	Clock Clock
+	// The maximum number of requests to have in flight at once. Values
+	// greater than 1 enable sequence-numbered pipelining.
+	Pipeline int
+	// The carrier mode: modePoll, modeWebSocket, modeAuto, or modeDNS.
+	// The empty string means modePoll.
+	Mode string
+	// The largest request body the carrier can take, or 0 for no limit
+	// but the payload size.
+	MaxPayload int
+	// The HTTP method of requests. The empty string means POST.
+	Method string
+	// The uTLS Client Hello ID name for WebSocket connections, or "" for
+	// crypto/tls. (RoundTripper already takes it into account for
+	// polling.)
+	UTLSName string
+	// Whether the session carries multiplexed streams; see muxpool.go.
+	Mux bool
+	// The address connections are made to instead of the host of URL, or
+	// "" for none; see shadow.go.
+	Connect string
+	// The timing of polls, or nil for the polling backoff; see
+	// timing.go. Shared by all copies of the RequestInfo for a session.
+	Timing *timingShaper
+	// The credential proved in the X-Credential header (see
+	// credentialProof), or "" for none. The server puts a session with a
+	// credential it knows in a QoS class.
+	Credential string
+}
+
+// Return the X-Credential value for a session: the hex HMAC-SHA256 of the
+// session id under the credential. The credential itself never crosses the
+// network, and the value is good for that one session only.
+func credentialProof(credential, sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(credential))
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 // Make an http.Request from the payload data in buf and the request metadata in
-// info.
-func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
+// info. The request is aborted if ctx is canceled.
+func makeRequest(ctx context.Context, buf []byte, info *RequestInfo) (*http.Request, error) {
 	var body io.Reader
 	if len(buf) > 0 {
 		// Leave body == nil when buf is empty. A nil body is an
@@ -136,7 +252,11 @@ func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
 		// https://bugs.torproject.org/22865.
 		body = bytes.NewReader(buf)
 	}
-	req, err := http.NewRequest("POST", info.URL.String(), body)
+	method := info.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, info.URL.String(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -146,9 +266,27 @@ func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
 		req.Host = info.Host
 	}
 	req.Header.Set("X-Session-Id", info.SessionID)
+	if token := info.Token.Get(); token != "" {
+		req.Header.Set("X-Session-Token", token)
+	}
+	if info.Credential != "" {
+		req.Header.Set("X-Credential", credentialProof(info.Credential, info.SessionID))
+	}
+	info.PayloadSize.SetHeader(req)
+	if info.Mux {
+		req.Header.Set(muxHeader, "1")
+	}
 	return req, nil
 }
 
+// httpStatusError is the error of a request answered with a status other than
+// 200.
+type httpStatusError int
+
+func (code httpStatusError) Error() string {
+	return fmt.Sprintf("status code was %d, not %d", int(code), http.StatusOK)
+}
+
 // Do a roundtrip, trying at most limit times if there is an HTTP status other
 // than 200. In case all tries result in error, returns the last error seen.
 //
@@ -157,67 +295,187 @@ func makeRequest(buf []byte, info *RequestInfo) (*http.Request, error) {
 // which will cause the connection to die. The alternative, though, is to just
 // kill the connection immediately. A better solution would be a system of
 // acknowledgements so we know what to resend after an error.
-func roundTripRetries(rt http.RoundTripper, req *http.Request, limit int) (*http.Response, error) {
+//
+// A status of 429 or 503 puts the front in backoff (see backoff.go), and every
+// try first waits for the front's backoff to be over.
+//
+// The delay between tries, timed by clock, ends early, with an error, if the
+// request's context is canceled.
+func roundTripRetries(rt http.RoundTripper, clock Clock, req *http.Request, limit int) (*http.Response, error) {
 	var resp *http.Response
 	var err error
 again:
 	limit--
+	err = frontBackoffs.Wait(req.Context(), req.URL.Host, clock)
+	if err != nil {
+		return nil, err
+	}
 	resp, err = rt.RoundTrip(req)
+	var backoff time.Duration
+	if err == nil {
+		backoff = frontBackoffs.Update(req.URL.Host, resp, clock.Now())
+	}
 	// Retry only if the HTTP roundtrip completed without error, but
 	// returned a status other than 200. Other kinds of errors and success
 	// with 200 always return immediately.
 	if err == nil && resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("status code was %d, not %d", resp.StatusCode, http.StatusOK)
+		err = httpStatusError(resp.StatusCode)
 		if limit > 0 {
-			log.Printf("%s; trying again after %.f seconds (%d)", err, retryDelay.Seconds(), limit)
-			time.Sleep(retryDelay)
+			resp.Body.Close()
+			if backoff > 0 {
+				logging.Warnf("%s; backing off for %.f seconds (%d)", err, backoff.Seconds(), limit)
+				goto again
+			}
+			logging.Warnf("%s; trying again after %.f seconds (%d)", err, retryDelay.Seconds(), limit)
+			select {
+			case <-clock.After(retryDelay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
 			goto again
 		}
 	}
 	return resp, err
 }
 
-// Send the data in buf to the remote URL, wait for a reply, and feed the reply
-// body back into conn.
-func sendRecv(buf []byte, conn net.Conn, info *RequestInfo) (int64, error) {
-	req, err := makeRequest(buf, info)
+// Return the most to read from the local connection for one request.
+func (info *RequestInfo) chunkSize() int {
+	n := info.BDP.ChunkSize(info.PayloadSize.Get(), info.Pipeline)
+	if info.MaxPayload > 0 {
+		n = min(n, info.MaxPayload)
+	}
+	return n
+}
+
+// Send the data in buf to the remote URL, trying at most tries times, wait for a
+// reply, and feed the reply body back into w.
+func sendRecv(ctx context.Context, buf []byte, w io.Writer, info *RequestInfo, tries int) (int64, error) {
+	req, err := makeRequest(ctx, buf, info)
 	if err != nil {
 		return 0, err
 	}
-	resp, err := roundTripRetries(info.RoundTripper, req, maxTries)
+	start := info.clock().Now()
+	resp, err := roundTripRetries(info.RoundTripper, info.clock(), req, tries)
 	if err != nil {
 		return 0, err
 	}
 	defer resp.Body.Close()
-	return io.Copy(conn, io.LimitReader(resp.Body, maxPayloadLength))
+	info.Token.Update(resp)
+	info.PayloadSize.Update(resp)
+	info.PollHint.Update(resp)
+	n, err := io.Copy(w, io.LimitReader(resp.Body, info.PayloadSize.ResponseLimit()))
+	if err == nil {
+		info.BDP.Record(start, int64(len(buf))+n)
+	}
+	return n, err
 }
 
-// Repeatedly read from conn, issue HTTP requests, and write the responses back
-// to conn.
-func copyLoop(conn net.Conn, info *RequestInfo) error {
-	var interval time.Duration
+// Tell the server that the session is over, so it can release the session's
+// resources at once instead of waiting for the session to expire. This is only
+// a courtesy, so it is tried once, and not at all if the front is rate-limiting
+// us, and errors are only logged.
+func sendClose(info *RequestInfo) {
+	if frontBackoffs.Remaining(info.URL.Host, info.clock().Now()) > 0 {
+		logging.Debugf("not closing session: %s is rate-limiting", info.URL.Host)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	req, err := makeRequest(ctx, nil, info)
+	if err != nil {
+		logging.Debugf("error closing session: %s", err)
+		return
+	}
+	req.Header.Set("X-Session-Close", "1")
+	resp, err := roundTripRetries(info.RoundTripper, info.clock(), req, 1)
+	if err != nil {
+		logging.Debugf("error closing session: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
 
+// Read from conn, at most chunkSize() bytes at a time, and send byte slices on
+// the returned channel. The channel is closed when conn reaches EOF or an
+// error. After an error, cancel is called at once; after EOF, only once
+// closeTimeout has passed, so that requests in flight, carrying what was read
+// last, may finish. The reading goroutine also exits if ctx is canceled.
+func readLocal(ctx context.Context, cancel context.CancelFunc, conn net.Conn, chunkSize func() int) <-chan []byte {
 	ch := make(chan []byte)
-
-	// Read from the Conn and send byte slices on the channel.
 	go func() {
-		var buf [maxPayloadLength]byte
+		defer close(ch)
+		var buf []byte
 		r := bufio.NewReader(conn)
 		for {
-			n, err := r.Read(buf[:])
-			b := make([]byte, n)
-			copy(b, buf[:n])
-			// log.Printf("read from local: %q", b)
-			ch <- b
+			if n := chunkSize(); len(buf) != n {
+				buf = make([]byte, n)
+			}
+			n, err := r.Read(buf)
+			if n > 0 {
+				b := make([]byte, n)
+				copy(b, buf[:n])
+				logging.Debugf("read from local: %s", scrubPayload(b))
+				select {
+				case ch <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("error reading from local: %s", err)
+					logging.Warnf("error reading from local: %s", err)
+					cancel()
+				} else {
+					time.AfterFunc(closeTimeout, cancel)
 				}
 				break
 			}
 		}
-		close(ch)
 	}()
+	return ch
+}
+
+// Repeatedly read from conn, issue HTTP requests, and write the responses back
+// to conn. When reading conn fails, any request or retry delay in progress is
+// canceled immediately; at EOF, the requests in flight are given closeTimeout
+// to finish. When openSessions starts draining, requests in
+// progress are finished, and the session is closed.
+func copyLoop(conn net.Conn, info *RequestInfo) error {
+	err := openSessions.Enter()
+	if err != nil {
+		return err
+	}
+	defer openSessions.Leave()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if info.Mode == modeWebSocket || info.Mode == modeAuto {
+		ws, err := dialWebSocket(ctx, info)
+		if err == nil {
+			return copyWebSocket(conn, ws)
+		}
+		if info.Mode == modeWebSocket {
+			return err
+		}
+		logging.Infof("WebSocket failed, falling back to polling: %s", err)
+	}
+
+	ch := readLocal(ctx, cancel, conn, info.chunkSize)
+
+	if options.Cover != nil && info.Mode != modeDNS {
+		go options.Cover.Run(ctx, info)
+	}
+
+	if info.Pipeline > 1 {
+		err := copyLoopPipelined(ctx, ch, conn, info)
+		if err == nil {
+			sendClose(info)
+		}
+		return err
+	}
+
+	var interval time.Duration
 
 	interval = initPollInterval
 loop:
@@ -225,32 +483,38 @@ loop:
 		var buf []byte
 		var ok bool
 
-		// log.Printf("waiting up to %.2f s", interval.Seconds())
-		// start := time.Now()
+		logging.Debugf("waiting up to %.2f s", interval.Seconds())
+		start := info.clock().Now()
 		select {
 		case buf, ok = <-ch:
 			if !ok {
 				break loop
 			}
-			// log.Printf("read %d bytes from local after %.2f s", len(buf), time.Since(start).Seconds())
-		case <-time.After(interval):
-			// log.Printf("read nothing from local after %.2f s", time.Since(start).Seconds())
+			logging.Debugf("read %d bytes from local after %.2f s", len(buf), info.clock().Now().Sub(start).Seconds())
+		case <-info.clock().After(interval):
+			logging.Debugf("read nothing from local after %.2f s", info.clock().Now().Sub(start).Seconds())
 			buf = nil
+		case <-openSessions.Draining():
+			break loop
 		}
 
-		nw, err := sendRecv(buf, conn, info)
+		nw, err := sendRecv(ctx, buf, conn, info, maxTries)
+		if ctx.Err() != nil {
+			// Reading the local connection failed.
+			break loop
+		}
 		if err != nil {
 			return err
 		}
-		/*
-			if nw > 0 {
-				log.Printf("got %d bytes from remote", nw)
-			} else {
-				log.Printf("got nothing from remote")
-			}
-		*/
+		if nw > 0 {
+			logging.Debugf("got %d bytes from remote", nw)
+		} else {
+			logging.Debugf("got nothing from remote")
+		}
 
-		if nw > 0 || len(buf) > 0 {
+		if info.Timing != nil {
+			interval = info.Timing.Next(nw > 0 || len(buf) > 0)
+		} else if nw > 0 || len(buf) > 0 {
 			// If we sent or received anything, poll again
 			// immediately.
 			interval = 0
@@ -259,14 +523,19 @@ loop:
 			// wait a while.
 			interval = initPollInterval
 		} else {
-			// After that, wait a little longer.
-			interval = time.Duration(float64(interval) * pollIntervalMultiplier)
+			// After that, wait a little longer, up to
+			// maxPollInterval.
+			interval = min(time.Duration(float64(interval)*pollIntervalMultiplier), maxPollInterval)
+		}
+		if hint, ok := info.PollHint.Take(); ok {
+			interval = hint
 		}
-		if interval > maxPollInterval {
-			interval = maxPollInterval
+		if info.PollHint.TakeMoreData() {
+			interval = 0
 		}
 	}
 
+	sendClose(info)
 	return nil
 }
 
@@ -279,89 +548,290 @@ func genSessionID() string {
 	return strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "=")
 }
 
-// Callback for new SOCKS requests.
-func handleSOCKS(conn *pt.SocksConn) error {
-	defer conn.Close()
-	err := conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
-	if err != nil {
-		return err
-	}
-
+// Build the RequestInfo for a new session from SOCKS args, falling back to
+// command-line options for anything not given in args.
+func makeRequestInfo(args pt.Args) (*RequestInfo, error) {
+	var err error
 	var info RequestInfo
 	info.SessionID = genSessionID()
+	info.Token = new(sessionToken)
+	info.PollHint = new(pollHint)
+	info.Timing = newTimingShaper(options.Timing)
+	if !options.UseHelper {
+		info.PayloadSize = new(payloadSize)
+	}
+
+	// The --url, --front, and --utls options, as last reloaded (see
+	// reload.go).
+	endpoints, frontSelector := currentEndpoints()
 
-	// First check url= SOCKS arg, then --url option.
-	urlArg, ok := conn.Req.Args.Get("url")
+	// First check url= SOCKS arg, then the list from --bridges-url, then
+	// --url option.
+	var bridge *bridgeSpec
+	urlArg, ok := args.Get("url")
 	if ok {
-	} else if options.URL != "" {
-		urlArg = options.URL
+	} else if bridge = pickBridge(options.Bridges); bridge != nil {
+		urlArg = bridge.URL
+	} else if endpoints.URL != "" {
+		urlArg = endpoints.URL
 	} else {
-		return fmt.Errorf("no URL for SOCKS request")
+		return nil, fmt.Errorf("no URL for SOCKS request")
 	}
 	info.URL, err = url.Parse(urlArg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// First check front= SOCKS arg, then --front option.
-	front, ok := conn.Req.Args.Get("front")
+	// First check front= SOCKS arg, then the bridge's front if the URL
+	// came from a bridge, then --front option.
+	front, ok := args.Get("front")
 	if ok {
-	} else if options.Front != "" {
-		front = options.Front
+	} else if bridge != nil {
+		front = bridge.Front
+		ok = front != ""
+	} else if frontSelector != nil {
+		front = frontSelector.Best()
+		ok = true
+	} else if endpoints.Front != "" {
+		front = endpoints.Front
 		ok = true
 	}
+	if strictGuard != nil {
+		strictGuard.AllowURL(info.URL, front)
+	}
 	if ok {
 		info.Host = info.URL.Host
 		info.URL.Host = front
 	}
 
 	// First check utls= SOCKS arg, then --utls option.
-	utlsName, utlsOK := conn.Req.Args.Get("utls")
+	utlsName, utlsOK := args.Get("utls")
 	if utlsOK {
-	} else if options.UTLSName != "" {
-		utlsName = options.UTLSName
+	} else if endpoints.UTLSName != "" {
+		utlsName = endpoints.UTLSName
 		utlsOK = true
 	}
 
+	// First check pipeline= SOCKS arg, then --pipeline option.
+	info.Pipeline = options.Pipeline
+	if pipelineArg, ok := args.Get("pipeline"); ok {
+		info.Pipeline, err = strconv.Atoi(pipelineArg)
+		if err != nil {
+			return nil, fmt.Errorf("bad pipeline= value %q", pipelineArg)
+		}
+	}
+	if info.Pipeline < 1 || info.Pipeline > maxPipeline {
+		return nil, fmt.Errorf("pipeline depth %d is not between 1 and %d", info.Pipeline, maxPipeline)
+	}
+	// Start with the fixed sizes, and adapt from there.
+	info.Clock = options.Clock
+	info.BDP = newBDPEstimator(maxPayloadLength * info.Pipeline)
+	info.BDP.now = info.clock().Now
+
+	// First check http= SOCKS arg, then --http1 and --h2c options.
+	http1, h2c := options.HTTP1, options.H2C
+	if httpArg, ok := args.Get("http"); ok {
+		switch httpArg {
+		case "1":
+			http1, h2c = true, false
+		case "2":
+			http1, h2c = false, false
+		case "h2c":
+			http1, h2c = false, true
+		default:
+			return nil, fmt.Errorf("bad http= value %q", httpArg)
+		}
+	}
+
+	info.RoundTripper, err = chooseRoundTripper(utlsName, utlsOK, http1, h2c)
+	if err != nil {
+		return nil, err
+	}
+	if utlsOK {
+		info.UTLSName = utlsName
+	}
+
+	// First check mode= SOCKS arg, then --mode option.
+	info.Mode = options.Mode
+	if modeArg, ok := args.Get("mode"); ok {
+		info.Mode = modeArg
+	}
+	if info.Mode == "" {
+		info.Mode = modePoll
+	}
+	if err := checkMode(info.Mode); err != nil {
+		return nil, err
+	}
+	if options.UseHelper {
+		// The helper can only make ordinary requests.
+		switch info.Mode {
+		case modeWebSocket, modeDNS:
+			return nil, fmt.Errorf("cannot use mode=%s with --helper", info.Mode)
+		case modeAuto:
+			info.Mode = modePoll
+		}
+	}
+	if info.Mode == modeDNS {
+		err = setupDNSMode(&info, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// First check connect= SOCKS arg, then --connect option.
+	connect, ok := args.Get("connect")
+	if !ok {
+		connect, ok = options.Connect, options.Connect != ""
+	}
+	if ok {
+		err = setupConnect(&info, connect)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// First check credential= SOCKS arg, then --credential option.
+	info.Credential = options.Credential
+	if credential, ok := args.Get("credential"); ok {
+		info.Credential = credential
+	}
+
+	// First check method= SOCKS arg, then --method option.
+	info.Method = options.Method
+	if methodArg, ok := args.Get("method"); ok {
+		info.Method, err = checkMethod(methodArg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info.Mux, err = wantMux(args)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mux {
+		// The server multiplexes only polling sessions.
+		switch info.Mode {
+		case modeWebSocket:
+			return nil, fmt.Errorf("cannot use mode=%s with mux", info.Mode)
+		case modeAuto:
+			info.Mode = modePoll
+		}
+	}
+
+	return &info, nil
+}
+
+// Return the RoundTripper to use, given the uTLS Client Hello ID name (if
+// utlsOK), whether to disable HTTP/2, and whether to use h2c for http:// URLs.
+func chooseRoundTripper(utlsName string, utlsOK bool, http1, h2c bool) (http.RoundTripper, error) {
 	// First we check --helper: if it was specified, then we always use the
 	// helper, and utls is disallowed. Otherwise, we use utls if requested;
 	// or else fall back to native net/http.
 	if options.UseHelper {
 		if utlsOK {
-			return fmt.Errorf("cannot use utls with --helper")
+			return nil, fmt.Errorf("cannot use utls with --helper")
+		}
+		if http1 || h2c {
+			// The browser chooses the HTTP version.
+			return nil, fmt.Errorf("cannot choose the HTTP version with --helper")
+		}
+		return helperRoundTripper, nil
+	}
+
+	var rt http.RoundTripper
+	var err error
+	if utlsOK {
+		rt, err = newUTLSRoundTripper(utlsName, nil, options.ProxyURL, http1)
+		if err != nil {
+			return nil, err
+		}
+	} else if http1 {
+		rt = getHTTP1RoundTripper()
+	} else {
+		rt = httpRoundTripper
+	}
+	if h2c {
+		tr, err := getH2CTransport()
+		if err != nil {
+			return nil, err
 		}
-		info.RoundTripper = helperRoundTripper
-	} else if utlsOK {
-		info.RoundTripper, err = NewUTLSRoundTripper(utlsName, nil, options.ProxyURL)
+		rt = &h2cRoundTripper{h2c: tr, fallback: rt}
+	}
+	return harCapture.Wrap(connAging.Wrap(rt)), nil
+}
+
+// Callback for new SOCKS requests on the listener l. The SOCKS request is
+// granted once the session is established (see establishSession), and
+// otherwise rejected with a reply code for the kind of failure (see
+// socksreply.go).
+func handleSOCKS(conn *pt.SocksConn, l *clientListener) error {
+	defer conn.Close()
+	l.stats.Sessions.Add(1)
+	err := sessionSlots.Acquire()
+	if err != nil {
+		l.stats.Rejected.Add(1)
+		conn.RejectReason(pt.SocksRepConnectionNotAllowed)
+		return err
+	}
+	defer sessionSlots.Release()
+
+	mux, err := wantMux(conn.Req.Args)
+	if err != nil {
+		return l.reject(conn, nil, err)
+	}
+	if mux {
+		err = conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
 		if err != nil {
 			return err
 		}
-	} else {
-		info.RoundTripper = httpRoundTripper
+		return l.mux.Handle(l.count(conn), conn.Req.Args)
 	}
 
-	return copyLoop(conn, &info)
+	info, err := l.makeRequestInfo(conn.Req.Args)
+	if err != nil {
+		return l.reject(conn, nil, err)
+	}
+	first, err := establishSession(info)
+	if err != nil {
+		return l.reject(conn, info, err)
+	}
+	err = conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return err
+	}
+	local := l.count(conn)
+	if len(first) > 0 {
+		_, err = local.Write(first)
+		if err != nil {
+			return err
+		}
+	}
+
+	return copyLoop(local, info)
 }
 
-func acceptSOCKS(ln *pt.SocksListener) error {
+// Accept SOCKS requests on ln, adding the default SOCKS args of l (see
+// listeners.go) to their own.
+func acceptSOCKS(ln *pt.SocksListener, l *clientListener) error {
 	defer ln.Close()
 	for {
 		conn, err := ln.AcceptSocks()
 		if err != nil {
-			log.Printf("error in AcceptSocks: %s", err)
+			logging.Warnf("error in AcceptSocks: %s", err)
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				continue
 			}
 			return err
 		}
+		conn.Req.Args = mergeTransportArgs(conn.Req.Args, l.Args)
 		go func() {
-			err := handleSOCKS(conn)
+			err := handleSOCKS(conn, l)
 			if err != nil {
-				log.Printf("error in handling request: %s", err)
+				logging.Warnf("error in handling request: %s", err)
 			}
 		}()
 	}
-	return nil
 }
 
 // Return an error if this proxy URL doesn't work with the rest of the
@@ -398,134 +868,8 @@ func checkProxyURL(u *url.URL) error {
 			return fmt.Errorf("don't understand proxy URL scheme %q", u.Scheme)
 		}
 		if u.User != nil {
-			return fmt.Errorf("a proxy URL with a username or password can't be used with --helper")
+			return fmt.Errorf("a proxy URL with a username or password can't be used with --helper (it can with --utls, or without either)")
 		}
 	}
 	return nil
 }
-
-func main() {
-	var helperAddr string
-	var logFilename string
-	var proxy string
-	var socksPort string
-	var err error
-
-	os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
-	os.Setenv("TOR_PT_CLIENT_TRANSPORTS", "meek")
-
-	flag.StringVar(&options.Front, "front", "", "front domain name if no front= SOCKS arg")
-	flag.StringVar(&helperAddr, "helper", "", "address of HTTP helper (browser extension)")
-	flag.StringVar(&logFilename, "log", "", "name of log file")
-	flag.StringVar(&proxy, "proxy", "", "proxy URL")
-	flag.StringVar(&socksPort, "port", "4455", "listening socks port")
-	flag.StringVar(&options.URL, "url", "", "URL to request if no url= SOCKS arg")
-	flag.StringVar(&options.UTLSName, "utls", "", "uTLS Client Hello ID")
-	flag.Parse()
-
-	ptInfo, err := pt.ClientSetup(nil)
-	if err != nil {
-		log.Fatalf("error in ClientSetup: %s", err)
-	}
-
-	log.SetFlags(log.LstdFlags | log.LUTC)
-	if logFilename != "" {
-		f, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			// If we fail to open the log, emit a message that will
-			// appear in tor's log.
-			pt.CmethodError(ptMethodName, fmt.Sprintf("error opening log file: %s", err))
-			log.Fatalf("error opening log file: %s", err)
-		}
-		defer f.Close()
-		log.SetOutput(f)
-	}
-
-	if helperAddr != "" {
-		options.UseHelper = true
-		helperRoundTripper.HelperAddr, err = net.ResolveTCPAddr("tcp", helperAddr)
-		if err != nil {
-			log.Fatalf("can't resolve helper address: %s", err)
-		}
-		log.Printf("using helper on %s", helperRoundTripper.HelperAddr)
-	}
-
-	if proxy != "" {
-		options.ProxyURL, err = url.Parse(proxy)
-		if err != nil {
-			log.Fatalf("can't parse proxy URL: %s", err)
-		}
-	}
-
-	// Disable the default ProxyFromEnvironment setting.
-	// httpRoundTripper.Proxy is overridden below if options.ProxyURL is
-	// set.
-	httpRoundTripper.Proxy = nil
-
-	// Command-line proxy overrides managed configuration.
-	if options.ProxyURL == nil {
-		options.ProxyURL = ptInfo.ProxyURL
-	}
-	// Check whether we support this kind of proxy.
-	if options.ProxyURL != nil {
-		err = checkProxyURL(options.ProxyURL)
-		if err != nil {
-			pt.ProxyError(err.Error())
-			log.Fatal(fmt.Sprintf("proxy error: %s", err))
-		}
-		log.Printf("using proxy %s", options.ProxyURL.String())
-		httpRoundTripper.Proxy = http.ProxyURL(options.ProxyURL)
-		if options.UseHelper {
-			err = helperRoundTripper.SetProxy(options.ProxyURL)
-			if err != nil {
-				pt.ProxyError(err.Error())
-				log.Fatal(fmt.Sprintf("proxy error: %s", err))
-			}
-		}
-		if ptInfo.ProxyURL != nil {
-			pt.ProxyDone()
-		}
-	}
-
-	listeners := make([]net.Listener, 0)
-	for _, methodName := range ptInfo.MethodNames {
-		switch methodName {
-		case ptMethodName:
-			ln, err := pt.ListenSocks("tcp", "127.0.0.1:"+socksPort)
-			if err != nil {
-				pt.CmethodError(methodName, err.Error())
-				break
-			}
-			go acceptSOCKS(ln)
-			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-			log.Printf("listening on %s", ln.Addr())
-			listeners = append(listeners, ln)
-		default:
-			pt.CmethodError(methodName, "no such method")
-		}
-	}
-	pt.CmethodsDone()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
-
-	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
-		// This environment variable means we should treat EOF on stdin
-		// just like SIGTERM: https://bugs.torproject.org/15435.
-		go func() {
-			io.Copy(ioutil.Discard, os.Stdin)
-			log.Printf("synthesizing SIGTERM because of stdin close")
-			sigChan <- syscall.SIGTERM
-		}()
-	}
-
-	// Wait for a signal.
-	sig := <-sigChan
-	log.Printf("got signal %s", sig)
-
-	for _, ln := range listeners {
-		ln.Close()
-	}
-
-	log.Printf("done")
-}
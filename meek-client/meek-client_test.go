@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A RoundTripper that always returns the given status code.
+type statusRoundTripper int
+
+func (rt statusRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: int(rt),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+// Test that roundTripRetries stops waiting between tries as soon as the
+// request's context is canceled.
+func TestRoundTripRetriesCanceled(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = roundTripRetries(statusRoundTripper(http.StatusServiceUnavailable), systemClock{}, req, maxTries)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > retryDelay/2 {
+		t.Errorf("roundTripRetries took %v to notice cancellation", elapsed)
+	}
+}
+
+// Test that copyLoop returns promptly when reading the local connection fails
+// while a retry delay is in progress.
+func TestCopyLoopLocalClose(t *testing.T) {
+	defer func(b *frontBackoff) { frontBackoffs = b }(frontBackoffs)
+	frontBackoffs = newFrontBackoff()
+	local, remote := net.Pipe()
+	u, _ := url.Parse("http://example.com/")
+	info := &RequestInfo{
+		SessionID:    "session",
+		URL:          u,
+		RoundTripper: statusRoundTripper(http.StatusServiceUnavailable),
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- copyLoop(remote, info)
+	}()
+	local.Write([]byte("data"))
+	time.Sleep(50 * time.Millisecond)
+	remote.Close()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("copyLoop returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("copyLoop did not return after the local connection closed")
+	}
+}
+
+// A RoundTripper that takes a while to answer, and records whether the
+// request was canceled meanwhile.
+type slowRoundTripper struct {
+	delay    time.Duration
+	canceled chan bool
+}
+
+func (rt *slowRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Session-Close") == "" {
+		select {
+		case <-time.After(rt.delay):
+			rt.canceled <- false
+		case <-req.Context().Done():
+			rt.canceled <- true
+			return nil, req.Context().Err()
+		}
+	}
+	return statusRoundTripper(http.StatusOK).RoundTrip(req)
+}
+
+// Test that the request in flight when the local connection reaches EOF is
+// not canceled.
+func TestCopyLoopLocalEOF(t *testing.T) {
+	for _, pipeline := range []int{1, 4} {
+		local, remote := net.Pipe()
+		u, _ := url.Parse("http://example.com/")
+		rt := &slowRoundTripper{delay: 200 * time.Millisecond, canceled: make(chan bool, 100)}
+		info := &RequestInfo{
+			SessionID:    "session",
+			URL:          u,
+			RoundTripper: rt,
+			Pipeline:     pipeline,
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- copyLoop(remote, info)
+		}()
+		local.Write([]byte("data"))
+		local.Close()
+		if err := <-errChan; err != nil {
+			t.Errorf("pipeline %d: copyLoop returned %v", pipeline, err)
+		}
+		close(rt.canceled)
+		for canceled := range rt.canceled {
+			if canceled {
+				t.Errorf("pipeline %d: request canceled at EOF", pipeline)
+			}
+		}
+	}
+}
+
+// A RoundTripper that sends each request on a channel and returns an empty
+// 200 response.
+type recordingRoundTripper chan *http.Request
+
+func (rt recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt <- req
+	return statusRoundTripper(http.StatusOK).RoundTrip(req)
+}
+
+// Test that copyLoop sends a close request when the local connection is
+// closed.
+func TestCopyLoopSendsClose(t *testing.T) {
+	for _, pipeline := range []int{1, 4} {
+		local, remote := net.Pipe()
+		u, _ := url.Parse("http://example.com/")
+		requests := make(recordingRoundTripper, 100)
+		info := &RequestInfo{
+			SessionID:    "session",
+			URL:          u,
+			RoundTripper: requests,
+			Pipeline:     pipeline,
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- copyLoop(remote, info)
+		}()
+		local.Write([]byte("data"))
+		local.Close()
+		if err := <-errChan; err != nil {
+			t.Errorf("pipeline %d: copyLoop returned %v", pipeline, err)
+		}
+		close(requests)
+		var last *http.Request
+		for req := range requests {
+			last = req
+		}
+		if last == nil || last.Header.Get("X-Session-Close") != "1" || last.Header.Get("X-Session-Id") != "session" {
+			t.Errorf("pipeline %d: last request was not a close request", pipeline)
+		}
+	}
+}
+
+func TestMakeRequestInfoHTTP(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 1
+
+	for _, test := range []struct {
+		http1    bool
+		arg      string
+		expected http.RoundTripper
+	}{
+		{false, "", httpRoundTripper},
+		{true, "", getHTTP1RoundTripper()},
+		{false, "1", getHTTP1RoundTripper()},
+		{true, "2", httpRoundTripper},
+	} {
+		options.HTTP1 = test.http1
+		args := make(map[string][]string)
+		if test.arg != "" {
+			args["http"] = []string{test.arg}
+		}
+		info, err := makeRequestInfo(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.RoundTripper != test.expected {
+			t.Errorf("--http1=%v http=%q: got %p, expected %p", test.http1, test.arg, info.RoundTripper, test.expected)
+		}
+	}
+
+	_, err := makeRequestInfo(map[string][]string{"http": {"3"}})
+	if err == nil {
+		t.Errorf("http=3 unexpectedly succeeded")
+	}
+}
+
+func TestCredentialProof(t *testing.T) {
+	// RFC 4231 test case 2.
+	if proof := credentialProof("Jefe", "what do ya want for nothing?"); proof != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("got %s", proof)
+	}
+}
+
+func TestMakeRequestCredential(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 1
+	options.Credential = "from-option"
+
+	for _, test := range []struct {
+		args     map[string][]string
+		expected string
+	}{
+		{nil, "from-option"},
+		{map[string][]string{"credential": {"from-arg"}}, "from-arg"},
+	} {
+		info, err := makeRequestInfo(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := makeRequest(context.Background(), nil, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("X-Credential"); got != credentialProof(test.expected, info.SessionID) {
+			t.Errorf("%v: got %q, expected proof of %q", test.args, got, test.expected)
+		}
+	}
+
+	options.Credential = ""
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := makeRequest(context.Background(), nil, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := req.Header["X-Credential"]; ok {
+		t.Errorf("X-Credential without a credential")
+	}
+}
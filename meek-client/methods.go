@@ -0,0 +1,27 @@
+package main
+
+// The code in this file has to do with the HTTP method of transport requests,
+// chosen by --method or the method= SOCKS arg. POST is the default; PUT and
+// PATCH are for fronting paths that treat methods differently, and to make
+// the traffic less uniform. The server must accept the method (meek-server's
+// --methods option).
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The methods that transport requests may use.
+var transportMethodNames = []string{"PATCH", "POST", "PUT"}
+
+// Check a --method or method= value, and return it in canonical (uppercase)
+// form.
+func checkMethod(method string) (string, error) {
+	method = strings.ToUpper(method)
+	i := sort.SearchStrings(transportMethodNames, method)
+	if i == len(transportMethodNames) || transportMethodNames[i] != method {
+		return "", fmt.Errorf("unknown method %q (known methods are %s)", method, strings.Join(transportMethodNames, ", "))
+	}
+	return method, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestCheckMethod(t *testing.T) {
+	for _, test := range []struct {
+		method, expected string
+		ok               bool
+	}{
+		{"POST", "POST", true},
+		{"put", "PUT", true},
+		{"Patch", "PATCH", true},
+		{"GET", "", false},
+		{"", "", false},
+	} {
+		method, err := checkMethod(test.method)
+		if (err == nil) != test.ok || method != test.expected {
+			t.Errorf("%q: got %q, %v", test.method, method, err)
+		}
+	}
+}
+
+func TestMakeRequestInfoMethod(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 1
+	options.Method = "PUT"
+
+	for _, test := range []struct {
+		args     pt.Args
+		expected string
+	}{
+		{pt.Args{}, "PUT"},
+		{pt.Args{"method": {"patch"}}, "PATCH"},
+	} {
+		info, err := makeRequestInfo(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := makeRequest(context.Background(), nil, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Method != test.expected {
+			t.Errorf("%v: method %q, expected %q", test.args, req.Method, test.expected)
+		}
+	}
+	if _, err := makeRequestInfo(pt.Args{"method": {"DELETE"}}); err == nil {
+		t.Errorf("method=DELETE unexpectedly succeeded")
+	}
+
+	// Without a method, requests are POST.
+	u, _ := url.Parse("https://meek.example/")
+	req, err := makeRequest(context.Background(), nil, &RequestInfo{URL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" {
+		t.Errorf("no method: got %q", req.Method)
+	}
+}
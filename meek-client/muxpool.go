@@ -0,0 +1,164 @@
+package main
+
+// The code in this file carries many SOCKS connections over one meek session
+// (--mux or the mux=1 SOCKS arg). Without it, every SOCKS connection starts a
+// session of its own, with its own session id visible to the CDN and its own
+// round trips to set up. With it, SOCKS connections to the same listener (see
+// listeners.go) that have the same SOCKS args share a session, and each is a
+// stream of a multiplexer session (see lib/mux) that runs over it; the server
+// connects each stream to a backend of its own. The session is closed once it
+// has had no streams for muxIdleTimeout. The server must be run with --mux.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/goptlib"
+	"../lib/logging"
+	"../lib/mux"
+)
+
+// How long a multiplexed session with no streams is kept open for new ones.
+const muxIdleTimeout = time.Minute
+
+// The request header that marks a multiplexed session.
+const muxHeader = "X-Mux"
+
+// muxPool keeps one multiplexed meek session for each set of SOCKS args.
+type muxPool struct {
+	// How to start the meek session that carries conn, given the SOCKS
+	// args. Stubbed out in tests.
+	carry func(conn net.Conn, args pt.Args) error
+
+	lock     sync.Mutex
+	sessions map[string]*mux.Session
+}
+
+func newMuxPool(carry func(net.Conn, pt.Args) error) *muxPool {
+	return &muxPool{carry: carry, sessions: make(map[string]*mux.Session)}
+}
+
+// Should connections with args be multiplexed? First check the mux= SOCKS arg,
+// then the --mux option.
+func wantMux(args pt.Args) (bool, error) {
+	muxArg, ok := args.Get("mux")
+	if !ok {
+		return options.Mux, nil
+	}
+	switch muxArg {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, fmt.Errorf("bad mux= value %q", muxArg)
+	}
+}
+
+// Return a string that is the same for equal args.
+func muxPoolKey(args pt.Args) string {
+	var keys []string
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		for _, value := range args[key] {
+			fmt.Fprintf(&b, "%q=%q;", key, value)
+		}
+	}
+	return b.String()
+}
+
+// Open a stream on the session for args, starting a session if there is none.
+func (pool *muxPool) Open(args pt.Args) (*mux.Stream, error) {
+	key := muxPoolKey(args)
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	sess := pool.sessions[key]
+	if sess != nil {
+		stream, err := sess.Open()
+		if err == nil {
+			return stream, nil
+		}
+		// The meek session has ended; start another.
+	}
+
+	local, meekEnd := net.Pipe()
+	sess = mux.NewSession(local, true)
+	pool.sessions[key] = sess
+	go func() {
+		err := pool.carry(meekEnd, args)
+		if err != nil {
+			logging.Warnf("mux session: %s", err)
+		}
+		meekEnd.Close()
+		sess.Close()
+		pool.lock.Lock()
+		if pool.sessions[key] == sess {
+			delete(pool.sessions, key)
+		}
+		pool.lock.Unlock()
+	}()
+	return sess.Open()
+}
+
+// Close the session for args, if it has no streams left, after muxIdleTimeout.
+func (pool *muxPool) release(args pt.Args, sess *mux.Session) {
+	time.AfterFunc(muxIdleTimeout, func() {
+		key := muxPoolKey(args)
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		// Checked under the pool lock, so that Open can't add a stream
+		// in between.
+		if sess.NumStreams() > 0 {
+			return
+		}
+		if pool.sessions[key] == sess {
+			delete(pool.sessions, key)
+		}
+		sess.Close()
+	})
+}
+
+// Carry conn over a stream of the session for args.
+func (pool *muxPool) Handle(conn net.Conn, args pt.Args) error {
+	stream, err := pool.Open(args)
+	if err != nil {
+		return err
+	}
+	defer pool.release(args, stream.Session())
+	defer stream.Close()
+
+	var wg sync.WaitGroup
+	var upErr, downErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, upErr = io.Copy(stream, conn)
+		if upErr != nil {
+			// Unblock the other direction.
+			stream.Close()
+			return
+		}
+		// Let the server finish sending what it has.
+		stream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, downErr = io.Copy(conn, stream)
+		conn.Close()
+	}()
+	wg.Wait()
+	// One direction's error is only the result of the other closing.
+	if upErr != nil && downErr != nil {
+		return fmt.Errorf("mux stream: %s", downErr)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"../lib/goptlib"
+	"../lib/mux"
+)
+
+// Return a muxPool whose sessions are carried to an echoing multiplexer server
+// in memory, and a function that returns the number of sessions started.
+func newTestMuxPool() (*muxPool, func() int) {
+	var lock sync.Mutex
+	started := 0
+	pool := newMuxPool(func(conn net.Conn, args pt.Args) error {
+		lock.Lock()
+		started++
+		lock.Unlock()
+		server := mux.NewSession(conn, false)
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return nil
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	})
+	return pool, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return started
+	}
+}
+
+// Carry a message over the pool and check that it comes back.
+func echoOverMuxPool(pool *muxPool, args pt.Args, msg string) error {
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- pool.Handle(remote, args) }()
+	defer func() { <-errc }()
+	defer local.Close()
+	go local.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(local, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("got %q, expected %q", buf, msg)
+	}
+	return nil
+}
+
+// Connections with the same args share a session; others get their own.
+func TestMuxPoolShares(t *testing.T) {
+	pool, started := newTestMuxPool()
+	a := pt.Args{"url": {"https://a.example/"}, "front": {"front.example"}}
+	b := pt.Args{"url": {"https://b.example/"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := echoOverMuxPool(pool, a, fmt.Sprintf("connection %d", i))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if started() != 1 {
+		t.Errorf("%d sessions for the same args", started())
+	}
+	if err := echoOverMuxPool(pool, b, "other"); err != nil {
+		t.Error(err)
+	}
+	if started() != 2 {
+		t.Errorf("%d sessions for two sets of args", started())
+	}
+}
+
+// A session that has ended is replaced.
+func TestMuxPoolRestart(t *testing.T) {
+	pool, started := newTestMuxPool()
+	args := pt.Args{"url": {"https://a.example/"}}
+	if err := echoOverMuxPool(pool, args, "first"); err != nil {
+		t.Fatal(err)
+	}
+	pool.lock.Lock()
+	pool.sessions[muxPoolKey(args)].Close()
+	pool.lock.Unlock()
+	if err := echoOverMuxPool(pool, args, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if started() != 2 {
+		t.Errorf("%d sessions", started())
+	}
+}
+
+func TestMuxPoolKey(t *testing.T) {
+	a := pt.Args{"url": {"https://a.example/"}, "front": {"front.example"}}
+	b := pt.Args{"front": {"front.example"}, "url": {"https://a.example/"}}
+	c := pt.Args{"url": {"https://a.example/;front=front.example"}}
+	if muxPoolKey(a) != muxPoolKey(b) {
+		t.Errorf("equal args have keys %q and %q", muxPoolKey(a), muxPoolKey(b))
+	}
+	if muxPoolKey(a) == muxPoolKey(c) {
+		t.Errorf("different args have the same key %q", muxPoolKey(a))
+	}
+}
+
+func TestWantMux(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	for _, test := range []struct {
+		option   bool
+		arg      string
+		expected bool
+		ok       bool
+	}{
+		{false, "", false, true},
+		{true, "", true, true},
+		{false, "1", true, true},
+		{true, "0", false, true},
+		{false, "yes", false, false},
+	} {
+		options.Mux = test.option
+		args := make(pt.Args)
+		if test.arg != "" {
+			args.Add("mux", test.arg)
+		}
+		mux, err := wantMux(args)
+		if (err == nil) != test.ok || mux != test.expected {
+			t.Errorf("--mux=%v mux=%q: got %v, %v", test.option, test.arg, mux, err)
+		}
+	}
+}
+
+func TestMakeRequestInfoMux(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 1
+
+	info, err := makeRequestInfo(pt.Args{"mux": {"1"}, "mode": {modeAuto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mux || info.Mode != modePoll {
+		t.Errorf("mux=1 mode=auto: got mux %v, mode %q", info.Mux, info.Mode)
+	}
+	req, err := makeRequest(context.Background(), nil, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get(muxHeader) != "1" {
+		t.Errorf("no %s header", muxHeader)
+	}
+
+	if _, err := makeRequestInfo(pt.Args{"mux": {"1"}, "mode": {modeWebSocket}}); err == nil {
+		t.Errorf("mux=1 mode=websocket unexpectedly succeeded")
+	}
+}
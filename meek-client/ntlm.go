@@ -0,0 +1,214 @@
+package main
+
+// The code in this file makes the messages of the client side of NTLM
+// authentication (MS-NLMP), for proxies that ask for NTLM, or for Negotiate
+// when Kerberos is not available. Only NTLMv2 responses are made; the older
+// NTLM and LM responses are too weak to offer. The connection to the proxy is
+// not signed or sealed afterward, so no session key is exchanged.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// NTLM negotiate flags.
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	ntlmClientFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity |
+		ntlmNegotiate128 | ntlmNegotiate56
+)
+
+// The AV_PAIR id of the server's time in the target info of a challenge.
+const ntlmAvTimestamp = 7
+
+// Return the NEGOTIATE_MESSAGE that starts NTLM authentication.
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmClientFlags)
+	// Empty domain and workstation fields, pointing at the end.
+	binary.LittleEndian.PutUint32(msg[20:], 32)
+	binary.LittleEndian.PutUint32(msg[28:], 32)
+	return msg
+}
+
+// The parts of a CHALLENGE_MESSAGE that the answer depends on.
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge [8]byte
+	targetInfo      []byte
+}
+
+var errNTLMChallenge = errors.New("malformed NTLM challenge")
+
+// Return the bytes of the field of msg that the security buffer at offset
+// points to.
+func ntlmField(msg []byte, offset int) ([]byte, error) {
+	if len(msg) < offset+8 {
+		return nil, errNTLMChallenge
+	}
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if length == 0 {
+		return nil, nil
+	}
+	if start < 0 || start > len(msg) || length > len(msg)-start {
+		return nil, errNTLMChallenge
+	}
+	return msg[start : start+length], nil
+}
+
+// Parse a CHALLENGE_MESSAGE.
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+	c := &ntlmChallenge{flags: binary.LittleEndian.Uint32(msg[20:])}
+	copy(c.serverChallenge[:], msg[24:32])
+	if c.flags&ntlmNegotiateTargetInfo != 0 {
+		var err error
+		c.targetInfo, err = ntlmField(msg, 40)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Return the server's time from target info, if it has one.
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == 0 || len(targetInfo) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil, false
+}
+
+// Encode s as UTF-16LE.
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// NTOWFv2 of MS-NLMP section 3.3.2.
+func ntowfv2(username, password, domain string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(username)+domain))
+}
+
+// Return the NTLMv2 response to c, and the LMv2 response, made with the given
+// client challenge and time (a FILETIME, which is used if the server didn't
+// send one).
+func ntlmv2Responses(c *ntlmChallenge, username, password, domain string, clientChallenge, now []byte) (nt, lm []byte) {
+	key := ntowfv2(username, password, domain)
+	timestamp, serverTime := ntlmTimestamp(c.targetInfo)
+	if !serverTime {
+		timestamp = now
+	}
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(c.targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+	proof := hmacMD5(key, c.serverChallenge[:], temp.Bytes())
+	nt = append(proof, temp.Bytes()...)
+	if serverTime {
+		// With a server time, the LMv2 response must be zeros.
+		lm = make([]byte, 24)
+	} else {
+		lm = append(hmacMD5(key, c.serverChallenge[:], clientChallenge), clientChallenge...)
+	}
+	return nt, lm
+}
+
+// Return the current time as a Windows FILETIME: 100 ns units since 1601.
+func ntlmFiletime(t time.Time) []byte {
+	const epochOffset = 116444736000000000
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+epochOffset))
+	return b
+}
+
+// Return the AUTHENTICATE_MESSAGE answering the CHALLENGE_MESSAGE msg.
+// username may be in the form "DOMAIN\user".
+func ntlmAuthenticateMessage(msg []byte, username, password string) ([]byte, error) {
+	c, err := parseNTLMChallenge(msg)
+	if err != nil {
+		return nil, err
+	}
+	var domain string
+	if i := strings.IndexByte(username, '\\'); i >= 0 {
+		domain, username = username[:i], username[i+1:]
+	}
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+	nt, lm := ntlmv2Responses(c, username, password, domain, clientChallenge, ntlmFiletime(time.Now()))
+
+	flags := c.flags & ntlmClientFlags
+	encode := func(s string) []byte {
+		if flags&ntlmNegotiateUnicode != 0 {
+			return utf16le(s)
+		}
+		return []byte(s)
+	}
+	// The fields, in the order of their security buffers: LM, NT, domain,
+	// user, workstation, and session key.
+	fields := [][]byte{lm, nt, encode(domain), encode(username), nil, nil}
+	const headerLength = 64
+	msg = make([]byte, headerLength)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		offset := 12 + 8*i
+		binary.LittleEndian.PutUint16(msg[offset:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[offset+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[offset+4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, nil
+}
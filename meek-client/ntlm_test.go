@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The target info of the examples of MS-NLMP section 4.2.4: domain "Domain",
+// server "Server".
+var ntlmTestTargetInfo = mustDecodeHex("02000c0044006f006d00610069006e00" + "01000c005300650072007600650072000000" + "0000")
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// A CHALLENGE_MESSAGE with the server challenge and target info of the
+// examples of MS-NLMP section 4.2.4.
+var ntlmTestChallenge = func() []byte {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[12:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo|ntlmNegotiateExtendedSessionSecurity)
+	copy(msg[24:], mustDecodeHex("0123456789abcdef"))
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(ntlmTestTargetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(ntlmTestTargetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, ntlmTestTargetInfo...)
+}()
+
+// The examples of MS-NLMP section 4.2.4.
+func TestNTLMv2Responses(t *testing.T) {
+	if key := hex.EncodeToString(ntowfv2("User", "Password", "Domain")); key != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("NTOWFv2 %s", key)
+	}
+	c, err := parseNTLMChallenge(ntlmTestChallenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.targetInfo, ntlmTestTargetInfo) {
+		t.Fatalf("target info %x", c.targetInfo)
+	}
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	nt, lm := ntlmv2Responses(c, "User", "Password", "Domain", clientChallenge, make([]byte, 8))
+	if proof := hex.EncodeToString(nt[:16]); proof != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr %s", proof)
+	}
+	if !bytes.HasSuffix(nt, append(ntlmTestTargetInfo, 0, 0, 0, 0)) {
+		t.Errorf("NT response doesn't end with the target info")
+	}
+	if lm := hex.EncodeToString(lm); lm != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("LMv2 response %s", lm)
+	}
+}
+
+func TestNTLMAuthenticateMessage(t *testing.T) {
+	msg, err := ntlmAuthenticateMessage(ntlmTestChallenge, `Domain\User`, "Password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("not an AUTHENTICATE_MESSAGE: %x", msg[:12])
+	}
+	field := func(i int) []byte {
+		b, err := ntlmField(msg, 12+8*i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if domain := field(2); !bytes.Equal(domain, utf16le("Domain")) {
+		t.Errorf("domain %x", domain)
+	}
+	if user := field(3); !bytes.Equal(user, utf16le("User")) {
+		t.Errorf("user %x", user)
+	}
+	// Check the NTProofStr against the rest of the NT response.
+	nt := field(1)
+	key := ntowfv2("User", "Password", "Domain")
+	if !bytes.Equal(nt[:16], hmacMD5(key, mustDecodeHex("0123456789abcdef"), nt[16:])) {
+		t.Errorf("wrong NTProofStr")
+	}
+	if flags := binary.LittleEndian.Uint32(msg[60:]); flags&ntlmNegotiateUnicode == 0 || flags&ntlmNegotiateTargetInfo != 0 {
+		t.Errorf("flags %#x", flags)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		ntlmNegotiateMessage(),
+		ntlmTestChallenge[:40],
+		// Target info out of bounds.
+		append(append([]byte{}, ntlmTestChallenge[:44]...), 0xff, 0xff, 0, 0),
+	} {
+		if _, err := ntlmAuthenticateMessage(bad, "User", "Password"); err == nil {
+			t.Errorf("no error for %x", bad)
+		}
+	}
+}
+
+func FuzzNTLMAuthenticateMessage(f *testing.F) {
+	f.Add(ntlmTestChallenge)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		ntlmAuthenticateMessage(msg, `Domain\User`, "Password")
+	})
+}
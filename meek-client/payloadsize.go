@@ -0,0 +1,78 @@
+package main
+
+// The code in this file has to do with negotiating the payload size with the
+// server. Every request carries, in the X-Payload-Size header, the largest
+// response body we can take (maxNegotiatedPayloadLength). A server that
+// understands the header answers with the size to use in both directions,
+// which we then use as the most to read from the local connection for one
+// request. Until then, and with a server that doesn't answer, we send at most
+// maxPayloadLength, which every server accepts.
+//
+// The browser helper does not pass response headers back to us, so we don't
+// offer to negotiate through it.
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	payloadSizeHeader = "X-Payload-Size"
+	// The largest response body we offer to take, and the range of sizes
+	// we accept from the server.
+	maxNegotiatedPayloadLength = 1 << 20
+	minNegotiatedPayloadLength = 1024
+)
+
+// payloadSize holds the negotiated payload size for one session. It is safe
+// for concurrent use. A nil *payloadSize does not negotiate, and always has
+// the size maxPayloadLength.
+type payloadSize struct {
+	lock sync.Mutex
+	// 0 until the server has told us a size.
+	size int
+}
+
+// Return the most to send in one request.
+func (ps *payloadSize) Get() int {
+	if ps == nil {
+		return maxPayloadLength
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.size == 0 {
+		return maxPayloadLength
+	}
+	return ps.size
+}
+
+// Return the most to read from one response body.
+func (ps *payloadSize) ResponseLimit() int64 {
+	if ps == nil {
+		return maxPayloadLength
+	}
+	return maxNegotiatedPayloadLength
+}
+
+// Offer to negotiate in req.
+func (ps *payloadSize) SetHeader(req *http.Request) {
+	if ps == nil {
+		return
+	}
+	req.Header.Set(payloadSizeHeader, strconv.Itoa(maxNegotiatedPayloadLength))
+}
+
+// Remember the size from resp, if it has a usable one.
+func (ps *payloadSize) Update(resp *http.Response) {
+	if ps == nil {
+		return
+	}
+	size, err := strconv.Atoi(resp.Header.Get(payloadSizeHeader))
+	if err != nil || size < minNegotiatedPayloadLength || size > maxNegotiatedPayloadLength {
+		return
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.size = size
+}
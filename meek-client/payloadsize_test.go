@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestPayloadSize(t *testing.T) {
+	var nilSize *payloadSize
+	req, _ := http.NewRequest("POST", "https://meek.example/", nil)
+	nilSize.SetHeader(req)
+	if _, ok := req.Header[payloadSizeHeader]; ok {
+		t.Errorf("nil payloadSize set the header")
+	}
+	if nilSize.Get() != maxPayloadLength || nilSize.ResponseLimit() != maxPayloadLength {
+		t.Errorf("nil payloadSize: %d, %d", nilSize.Get(), nilSize.ResponseLimit())
+	}
+
+	ps := new(payloadSize)
+	ps.SetHeader(req)
+	if v := req.Header.Get(payloadSizeHeader); v != strconv.Itoa(maxNegotiatedPayloadLength) {
+		t.Errorf("header %q", v)
+	}
+	if ps.Get() != maxPayloadLength || ps.ResponseLimit() != maxNegotiatedPayloadLength {
+		t.Errorf("before negotiation: %d, %d", ps.Get(), ps.ResponseLimit())
+	}
+	for _, test := range []struct {
+		header   string
+		expected int
+	}{
+		// No header, or an unusable one, changes nothing.
+		{"", maxPayloadLength},
+		{"abc", maxPayloadLength},
+		{"10", maxPayloadLength},
+		{strconv.Itoa(2 * maxNegotiatedPayloadLength), maxPayloadLength},
+		{"262144", 262144},
+		{"4096", 4096},
+		{"", 4096},
+	} {
+		resp := &http.Response{Header: make(http.Header)}
+		if test.header != "" {
+			resp.Header.Set(payloadSizeHeader, test.header)
+		}
+		ps.Update(resp)
+		if size := ps.Get(); size != test.expected {
+			t.Errorf("%q: got %d, expected %d", test.header, size, test.expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+// The code in this file implements pipelining: keeping several requests for
+// one session in flight at once, in order to hide round-trip latency on long
+// fronted paths. Each request carries a sequence number in an X-Seq header.
+// The server processes a session's requests strictly in sequence order,
+// whatever order they arrive in, and we write the response bodies back to the
+// local connection in the same order.
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The outcome of one pipelined request.
+type pipelineResult struct {
+	body []byte
+	err  error
+}
+
+// Send the data in buf with the given sequence number and return the body of
+// the response.
+func sendRecvSeq(ctx context.Context, buf []byte, seq uint64, info *RequestInfo) ([]byte, error) {
+	req, err := makeRequest(ctx, buf, info)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Seq", strconv.FormatUint(seq, 10))
+	start := info.clock().Now()
+	resp, err := roundTripRetries(info.RoundTripper, info.clock(), req, maxTries)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	info.Token.Update(resp)
+	info.PayloadSize.Update(resp)
+	info.PollHint.Update(resp)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, info.PayloadSize.ResponseLimit()))
+	if err == nil {
+		info.BDP.Record(start, int64(len(buf)+len(body)))
+	}
+	return body, err
+}
+
+// Like copyLoop, but with up to info.Pipeline requests in flight, or fewer if
+// info.BDP says so. ch is the output of readLocal, and ctx is canceled when
+// reading conn fails.
+func copyLoopPipelined(ctx context.Context, ch <-chan []byte, conn net.Conn, info *RequestInfo) error {
+	// Pending results, in sequence order. The capacity of the channel
+	// bounds the number of requests in flight.
+	results := make(chan chan pipelineResult, info.Pipeline-1)
+	done := make(chan error, 1)
+	// Set to 1 by the writer whenever it receives data, so the dispatcher
+	// knows to poll again immediately.
+	var received int32
+	// The number of requests in flight, and a signal each time one
+	// finishes, for keeping to the limit of info.BDP.
+	var inFlight int32
+	finished := make(chan struct{}, 1)
+	// A signal that a response said the server has more data, to poll
+	// again without waiting out the interval.
+	moreData := make(chan struct{}, 1)
+
+	// Write response bodies to conn in sequence order.
+	go func() {
+		var err error
+		for r := range results {
+			if err != nil {
+				// After an error, just drain the remaining
+				// results so the dispatcher doesn't block.
+				continue
+			}
+			res := <-r
+			if ctx.Err() != nil {
+				// Reading the local connection failed; errors from
+				// canceled requests are expected.
+				continue
+			}
+			err = res.err
+			if err == nil && len(res.body) > 0 {
+				atomic.StoreInt32(&received, 1)
+				_, err = conn.Write(res.body)
+			}
+			if err != nil {
+				done <- err
+			}
+		}
+		if err == nil {
+			done <- nil
+		}
+	}()
+
+	var seq uint64
+	interval := initPollInterval
+loop:
+	for {
+		var buf []byte
+		var ok bool
+
+		select {
+		case buf, ok = <-ch:
+			if !ok {
+				break loop
+			}
+		case <-info.clock().After(interval):
+			buf = nil
+		case <-moreData:
+			buf = nil
+		case <-openSessions.Draining():
+			// Let the requests in flight finish.
+			break loop
+		case err := <-done:
+			close(results)
+			return err
+		}
+
+		for int(atomic.LoadInt32(&inFlight)) >= info.BDP.InFlight(info.PayloadSize.Get(), info.Pipeline) {
+			select {
+			case <-finished:
+			case err := <-done:
+				close(results)
+				return err
+			}
+		}
+
+		r := make(chan pipelineResult, 1)
+		results <- r
+		atomic.AddInt32(&inFlight, 1)
+		first := make(chan struct{})
+		go func(buf []byte, seq uint64) {
+			body, err := sendRecvSeq(ctx, buf, seq, info)
+			close(first)
+			atomic.AddInt32(&inFlight, -1)
+			select {
+			case finished <- struct{}{}:
+			default:
+			}
+			if info.PollHint.TakeMoreData() {
+				select {
+				case moreData <- struct{}{}:
+				default:
+				}
+			}
+			r <- pipelineResult{body, err}
+		}(buf, seq)
+		if seq == 0 {
+			// The first response may carry the session token (see
+			// sessiontoken.go), which every later request needs.
+			select {
+			case <-first:
+			case err := <-done:
+				close(results)
+				return err
+			}
+		}
+		seq++
+
+		active := len(buf) > 0 || atomic.SwapInt32(&received, 0) != 0
+		if info.Timing != nil {
+			interval = info.Timing.Next(active)
+		} else if active {
+			interval = 0
+		} else if interval == 0 {
+			interval = initPollInterval
+		} else {
+			interval = min(time.Duration(float64(interval)*pollIntervalMultiplier), maxPollInterval)
+		}
+		if hint, ok := info.PollHint.Take(); ok {
+			interval = hint
+		}
+	}
+
+	close(results)
+	return <-done
+}
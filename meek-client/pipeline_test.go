@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A RoundTripper that answers each request after a random delay, with a body
+// that is the request's X-Seq header value.
+type seqEchoRoundTripper struct{}
+
+func (rt seqEchoRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+	body := req.Header.Get("X-Seq") + ","
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+// Test that pipelined copyLoop writes responses in sequence order even when
+// they complete out of order.
+func TestCopyLoopPipelinedOrder(t *testing.T) {
+	local, remote := net.Pipe()
+	u, _ := url.Parse("http://example.com/")
+	info := &RequestInfo{
+		SessionID:    "session",
+		URL:          u,
+		RoundTripper: seqEchoRoundTripper{},
+		Pipeline:     8,
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- copyLoop(remote, info)
+	}()
+
+	// Keep sending data so that requests are issued back to back.
+	go func() {
+		for i := 0; i < 50; i++ {
+			local.Write([]byte("x"))
+		}
+	}()
+
+	var received []byte
+	buf := make([]byte, 1024)
+	expected := []byte("0,1,2,3,4,5,6,7,8,9,10,")
+	for len(received) < len(expected) {
+		local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := local.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	if !bytes.Equal(received[:len(expected)], expected) {
+		t.Errorf("expected %q, got %q", expected, received)
+	}
+	local.Close()
+	select {
+	case err := <-errChan:
+		if err != nil && err != io.ErrClosedPipe {
+			t.Logf("copyLoop returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("copyLoop did not return after the local connection closed")
+	}
+}
+
+// A RoundTripper that gives a session token in its first response, and
+// records the tokens of the requests after that.
+type tokenRoundTripper struct {
+	lock   sync.Mutex
+	n      int
+	tokens []string
+}
+
+func (rt *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.lock.Lock()
+	first := rt.n == 0
+	rt.n++
+	if !first && req.Header.Get("X-Session-Close") == "" {
+		rt.tokens = append(rt.tokens, req.Header.Get("X-Session-Token"))
+	}
+	rt.lock.Unlock()
+	resp := statusResponse(http.StatusOK, "")
+	resp.Body = io.NopCloser(bytes.NewReader(nil))
+	if first {
+		// Slow, so that other requests would be sent meanwhile if they
+		// could be.
+		time.Sleep(50 * time.Millisecond)
+		resp.Header.Set("X-Session-Token", "secret")
+	}
+	return resp, nil
+}
+
+// Pipelined requests after the first wait for its response, and carry the
+// session token from it.
+func TestCopyLoopPipelinedToken(t *testing.T) {
+	local, remote := net.Pipe()
+	u, _ := url.Parse("http://example.com/")
+	rt := &tokenRoundTripper{}
+	info := &RequestInfo{
+		SessionID:    "session",
+		URL:          u,
+		RoundTripper: rt,
+		Pipeline:     8,
+		Token:        new(sessionToken),
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- copyLoop(remote, info)
+	}()
+	for i := 0; i < 10; i++ {
+		local.Write([]byte("x"))
+	}
+	local.Close()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if len(rt.tokens) == 0 {
+		t.Fatal("no requests after the first")
+	}
+	for i, token := range rt.tokens {
+		if token != "secret" {
+			t.Errorf("request %d had token %q", i+1, token)
+		}
+	}
+}
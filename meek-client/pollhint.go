@@ -0,0 +1,82 @@
+package main
+
+// The code in this file has to do with poll hints from the server. A server
+// run with --poll-hints says in the X-Poll-Hint header of each response how
+// many milliseconds to wait before the next empty poll, based on what it knows
+// of the session's backend and of its own load. When there is a hint, it takes
+// the place of our own guess from the polling backoff. Data to send is still
+// sent at once, whatever the hint.
+//
+// A response with an X-More-Data header was as full as it could be, and the
+// server has more data waiting. We then poll again at once, whatever the hint
+// or backoff; with pipelining, without waiting for the current wait between
+// polls to end.
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pollHintHeader = "X-Poll-Hint"
+	moreDataHeader = "X-More-Data"
+	// The longest hint we follow.
+	maxPollHint = time.Minute
+)
+
+// pollHint holds the latest poll hint for one session, and whether the server
+// said it has more data. It is safe for concurrent use, and a nil *pollHint
+// never has a hint.
+type pollHint struct {
+	lock     sync.Mutex
+	hint     time.Duration
+	ok       bool
+	moreData bool
+}
+
+// Remember the hint from resp, if it has one.
+func (ph *pollHint) Update(resp *http.Response) {
+	if ph == nil {
+		return
+	}
+	if resp.Header.Get(moreDataHeader) != "" {
+		ph.lock.Lock()
+		ph.moreData = true
+		ph.lock.Unlock()
+	}
+	ms, err := strconv.ParseInt(resp.Header.Get(pollHintHeader), 10, 64)
+	if err != nil || ms < 0 {
+		return
+	}
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	ph.hint = min(time.Duration(ms)*time.Millisecond, maxPollHint)
+	ph.ok = true
+}
+
+// Return the latest hint, if there is one that has not already been taken.
+func (ph *pollHint) Take() (time.Duration, bool) {
+	if ph == nil {
+		return 0, false
+	}
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	hint, ok := ph.hint, ph.ok
+	ph.ok = false
+	return hint, ok
+}
+
+// Return whether a response since the last call said the server has more
+// data.
+func (ph *pollHint) TakeMoreData() bool {
+	if ph == nil {
+		return false
+	}
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+	more := ph.moreData
+	ph.moreData = false
+	return more
+}
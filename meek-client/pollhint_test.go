@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPollHint(t *testing.T) {
+	var nilHint *pollHint
+	nilHint.Update(&http.Response{Header: http.Header{pollHintHeader: {"100"}}})
+	if _, ok := nilHint.Take(); ok {
+		t.Errorf("nil pollHint has a hint")
+	}
+
+	ph := new(pollHint)
+	for _, test := range []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"x", 0, false},
+		{"-5", 0, false},
+		{"0", 0, true},
+		{"2500", 2500 * time.Millisecond, true},
+		{"3600000", maxPollHint, true},
+	} {
+		resp := &http.Response{Header: make(http.Header)}
+		if test.header != "" {
+			resp.Header.Set(pollHintHeader, test.header)
+		}
+		ph.Update(resp)
+		hint, ok := ph.Take()
+		if hint != test.expected || ok != test.ok {
+			t.Errorf("%q: got %v, %v", test.header, hint, ok)
+		}
+		// A hint is taken only once.
+		if _, ok := ph.Take(); ok {
+			t.Errorf("%q: hint taken twice", test.header)
+		}
+	}
+}
+
+func TestPollHintMoreData(t *testing.T) {
+	ph := new(pollHint)
+	ph.Update(&http.Response{Header: make(http.Header)})
+	if ph.TakeMoreData() {
+		t.Errorf("more data without the header")
+	}
+	ph.Update(&http.Response{Header: http.Header{moreDataHeader: {"1"}}})
+	ph.Update(&http.Response{Header: make(http.Header)})
+	if !ph.TakeMoreData() {
+		t.Errorf("more data not remembered")
+	}
+	if ph.TakeMoreData() {
+		t.Errorf("more data taken twice")
+	}
+	if (*pollHint)(nil).TakeMoreData() {
+		t.Errorf("nil pollHint has more data")
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,63 +21,178 @@ import (
 
 type httpProxy struct {
 	network, addr string
-	auth          *proxy.Auth
+	auth          *proxyAuthenticator
 	forward       proxy.Dialer
 }
 
-func (pr *httpProxy) Dial(network, addr string) (net.Conn, error) {
-	connectReq := &http.Request{
-		Method: "CONNECT",
-		URL:    &url.URL{Opaque: addr},
-		Host:   addr,
-		Header: make(http.Header),
-	}
-	// http.Transport has a ProxyConnectHeader field that we are ignoring
-	// here.
-	if pr.auth != nil {
-		connectReq.Header.Set("Proxy-Authorization", "basic "+
-			base64.StdEncoding.EncodeToString([]byte(pr.auth.User+":"+pr.auth.Password)))
+const (
+	// The most bytes of a 407 response body to read past, in order to
+	// send another CONNECT on the same connection.
+	maxProxyAuthBodyLength = 64 * 1024
+	// The most 407 responses to answer in one Dial. Switching from Basic
+	// to NTLM takes two, and from Kerberos to NTLM, three.
+	maxProxyAuthRetries = 3
+)
+
+// proxyAuthError is the error of a CONNECT that the proxy refused with 407
+// Proxy Authentication Required.
+type proxyAuthError struct {
+	status string
+	// Whether there were credentials to send.
+	haveCredentials bool
+}
+
+func (err *proxyAuthError) Error() string {
+	if !err.haveCredentials {
+		return fmt.Sprintf("proxy server returned %q; the proxy URL needs a username and password (or, for Negotiate, --proxy-kerberos and Kerberos credentials)", err.status)
 	}
+	return fmt.Sprintf("proxy server returned %q; check the username and password in the proxy URL", err.status)
+}
 
-	conn, err := pr.forward.Dial(pr.network, pr.addr)
+func (pr *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+func (pr *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := contextDialer{pr.forward}.DialContext(ctx, pr.network, pr.addr)
 	if err != nil {
 		return nil, err
 	}
+	// Interrupt the CONNECT if ctx expires.
+	watch := func(conn net.Conn) func() bool {
+		return context.AfterFunc(ctx, func() { conn.Close() })
+	}
+	stop := watch(conn)
+	defer func() { stop() }()
 
-	err = connectReq.Write(conn)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	// A 407 gets another try with an answer to its challenge, on the same
+	// connection if the proxy keeps it open.
+	session := pr.auth.Session()
+	for tries := 0; ; tries++ {
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		// http.Transport has a ProxyConnectHeader field that we are
+		// ignoring here.
+		authorization := session.Authorization(ctx, "CONNECT", addr)
+		if authorization != "" {
+			connectReq.Header.Set("Proxy-Authorization", authorization)
+		}
+
+		err = connectReq.Write(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// The Go stdlib says: "Okay to use and discard buffered reader
+		// here, because TLS server will not speak until spoken to."
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			// Read past the body to reuse the connection, or make
+			// a new one.
+			n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, maxProxyAuthBodyLength+1))
+			resp.Body.Close()
+			reusable := !resp.Close && n <= maxProxyAuthBodyLength && br.Buffered() == 0
+			if tries >= maxProxyAuthRetries || !session.Challenge(resp, authorization, reusable) {
+				conn.Close()
+				return nil, &proxyAuthError{status: resp.Status, haveCredentials: pr.auth.haveCredentials}
+			}
+			if !reusable {
+				stop()
+				conn.Close()
+				conn, err = contextDialer{pr.forward}.DialContext(ctx, pr.network, pr.addr)
+				if err != nil {
+					return nil, err
+				}
+				stop = watch(conn)
+			}
+			continue
+		}
+		if br.Buffered() != 0 {
+			panic(br.Buffered())
+		}
+		if resp.StatusCode != 200 {
+			conn.Close()
+			return nil, fmt.Errorf("proxy server returned %q", resp.Status)
+		}
+		if !stop() {
+			return nil, ctx.Err()
+		}
+		return conn, nil
 	}
+}
 
-	// The Go stdlib says: "Okay to use and discard buffered reader here,
-	// because TLS server will not speak until spoken to."
-	br := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(br, connectReq)
-	if br.Buffered() != 0 {
-		panic(br.Buffered())
+// Return the username and password of u, or nil if it has none.
+func proxyAuthFromURL(u *url.URL) *proxy.Auth {
+	userpass := u.User
+	if userpass == nil {
+		return nil
 	}
-	if err != nil {
-		conn.Close()
-		return nil, err
+	auth := &proxy.Auth{
+		User: userpass.Username(),
 	}
-	if resp.StatusCode != 200 {
-		conn.Close()
-		return nil, fmt.Errorf("proxy server returned %q", resp.Status)
+	if password, ok := userpass.Password(); ok {
+		auth.Password = password
 	}
+	return auth
+}
 
-	return conn, nil
+// Return the host part of a proxy address, for the Kerberos service principal
+// name.
+func proxyHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
 }
 
 func ProxyHTTP(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (*httpProxy, error) {
 	return &httpProxy{
 		network: network,
 		addr:    addr,
-		auth:    auth,
+		auth:    newProxyAuthenticator(auth, proxyHost(addr)),
 		forward: forward,
 	}, nil
 }
 
+// Return a Proxy function for http.Transport that sends the requests for http
+// URLs through the proxy at proxyURL, as plain requests, and no others.
+func proxyForHTTPURLs(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if req.URL.Scheme == "http" {
+			return proxyURL, nil
+		}
+		return nil, nil
+	}
+}
+
+// Return a DialContext function for http.Transport that connects through
+// dialer, a CONNECT dialer for the proxy at proxyURL, except that it dials the
+// proxy itself directly, for the requests that proxyForHTTPURLs sends to it.
+func proxyConnectDialContext(proxyURL *url.URL, dialer proxy.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	proxyAddr, err := addrForDial(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	connect := contextDialer{dialer}.DialContext
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == proxyAddr {
+			return outbound.DialContext(ctx, network, addr)
+		}
+		return connect(ctx, network, addr)
+	}, nil
+}
+
 type UTLSDialer struct {
 	config        *utls.Config
 	clientHelloID *utls.ClientHelloID
@@ -83,14 +200,14 @@ type UTLSDialer struct {
 }
 
 func (dialer *UTLSDialer) Dial(network, addr string) (net.Conn, error) {
-	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.forward)
+	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.forward, false)
 }
 
 func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (*httpProxy, error) {
 	return &httpProxy{
 		network: network,
 		addr:    addr,
-		auth:    auth,
+		auth:    newProxyAuthenticator(auth, proxyHost(addr)),
 		forward: &UTLSDialer{
 			config: cfg,
 			// We use the same uTLS ClientHelloID for the TLS
@@ -101,3 +218,49 @@ func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cf
 		},
 	}, nil
 }
+
+// tlsDialer makes TLS connections with crypto/tls, to HTTPS proxies when not
+// using uTLS.
+type tlsDialer struct {
+	config  *tls.Config
+	forward proxy.Dialer
+}
+
+func (dialer *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, addr)
+}
+
+func (dialer *tlsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := contextDialer{dialer.forward}.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := dialer.config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Like ProxyHTTPS, but with crypto/tls and the given config rather than uTLS.
+func ProxyHTTPSNative(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *tls.Config) (*httpProxy, error) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	return &httpProxy{
+		network: network,
+		addr:    addr,
+		auth:    newProxyAuthenticator(auth, proxyHost(addr)),
+		forward: &tlsDialer{config: cfg, forward: forward},
+	}, nil
+}
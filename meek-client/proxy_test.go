@@ -2,17 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -140,17 +147,47 @@ func TestProxyHTTPCONNECT(t *testing.T) {
 	}
 }
 
-// Test that the HTTP proxy client sends authorization credentials.
+// Test that the HTTP proxy client sends authorization credentials, once the
+// proxy asks for them.
 func TestProxyHTTPProxyAuthorization(t *testing.T) {
 	auth := &proxy.Auth{
 		User:     testUsername,
 		Password: testPassword,
 	}
-	req, err := requestResultingFromDialHTTP(t, func(addr net.Addr) (*httpProxy, error) {
-		return ProxyHTTP("tcp", addr.String(), auth, proxy.Direct)
-	}, "tcp", testAddr)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ch := make(chan *http.Request, 2)
+	go func() {
+		defer close(ch)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ch <- req
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n")
+		}
+	}()
+	pr, _ := ProxyHTTP("tcp", ln.Addr().String(), auth, proxy.Direct)
+	pr.Dial("tcp", testAddr)
+
+	if pa := (<-ch).Header.Get("Proxy-Authorization"); pa != "" {
+		t.Errorf("first CONNECT had Proxy-Authorization %q", pa)
+	}
+	req := <-ch
+	if req == nil {
+		t.Fatalf("no second CONNECT")
 	}
 	pa := req.Header.Get("Proxy-Authorization")
 	if pa == "" {
@@ -176,6 +213,58 @@ func TestProxyHTTPProxyAuthorization(t *testing.T) {
 	}
 }
 
+// Requests for http URLs go through the proxy as plain requests, and others
+// through a CONNECT.
+func TestProxyForHTTPURLs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	requests := make(chan *http.Request, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String() + "/")
+	pr, _ := ProxyHTTP("tcp", ln.Addr().String(), nil, proxy.Direct)
+	dial, err := proxyConnectDialContext(proxyURL, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{Proxy: proxyForHTTPURLs(proxyURL), DialContext: dial, DisableKeepAlives: true}
+
+	req, _ := http.NewRequest("GET", "http://"+testAddr+"/path", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req := <-requests; req.Method != "GET" || req.RequestURI != "http://"+testAddr+"/path" {
+		t.Errorf("http URL: proxy got %s %s", req.Method, req.RequestURI)
+	}
+
+	req, _ = http.NewRequest("GET", "https://"+testAddr+"/path", nil)
+	tr.RoundTrip(req)
+	if req := <-requests; req.Method != "CONNECT" || req.Host != testAddr {
+		t.Errorf("https URL: proxy got %s %s", req.Method, req.Host)
+	}
+}
+
 // Create a TLS listener using a temporary self-signed certificate.
 // https://golang.org/src/crypto/tls/generate_cert.go
 func selfSignedTLSListen(network, addr string) (net.Listener, error) {
@@ -241,3 +330,209 @@ func TestProxyHTTPSCONNECT(t *testing.T) {
 		t.Errorf("expected %q, got %q", "Host: "+req.Host, "Host: "+testAddr)
 	}
 }
+
+func TestProxyHTTPSNativeCONNECT(t *testing.T) {
+	req, err := requestResultingFromDialHTTPS(t, func(addr net.Addr) (*httpProxy, error) {
+		return ProxyHTTPSNative("tcp", addr.String(), nil, proxy.Direct, &tls.Config{InsecureSkipVerify: true, ServerName: testHost})
+	}, "tcp", testAddr)
+	if err != nil {
+		panic(err)
+	}
+	if req.Method != "CONNECT" {
+		t.Errorf("expected method %q, got %q", "CONNECT", req.Method)
+	}
+	if req.Host != testAddr {
+		t.Errorf("expected %q, got %q", "Host: "+req.Host, "Host: "+testAddr)
+	}
+}
+
+// Check a Digest Proxy-Authorization (MD5, qop=auth) independently of
+// digestChallenge.
+func checkDigest(req *http.Request, username, password string) bool {
+	challenges := parseChallenges([]string{req.Header.Get("Proxy-Authorization")})
+	if len(challenges) != 1 || challenges[0].scheme != "digest" {
+		return false
+	}
+	p := challenges[0].params
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(username + ":" + p["realm"] + ":" + password)
+	ha2 := h(req.Method + ":" + p["uri"])
+	return p["username"] == username && p["uri"] == req.Host &&
+		p["response"] == h(ha1+":"+p["nonce"]+":"+p["nc"]+":"+p["cnonce"]+":"+p["qop"]+":"+ha2)
+}
+
+// Run an HTTP proxy on ln that requires Digest authentication and, once
+// authenticated, connects to the requested address. If close407 is true, it
+// closes the connection after every 407. Returns a count of connections.
+func runDigestProxy(t *testing.T, ln net.Listener, close407 bool) *int32 {
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					if !checkDigest(req, testUsername, testPassword) {
+						header := "Proxy-Authenticate: Digest realm=\"proxy\", nonce=\"abc\", qop=\"auth\"\r\n"
+						if close407 {
+							header += "Connection: close\r\n"
+						}
+						io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+header+"Content-Length: 6\r\n\r\ndenied")
+						if close407 {
+							return
+						}
+						continue
+					}
+					target, err := net.Dial("tcp", req.Host)
+					if err != nil {
+						io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+						return
+					}
+					defer target.Close()
+					io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+					go io.Copy(target, br)
+					io.Copy(conn, target)
+					return
+				}
+			}()
+		}
+	}()
+	return &conns
+}
+
+// An http.Transport dialing through httpProxy gets through a proxy that asks
+// for Digest authentication, whether or not the proxy keeps the connection of
+// the 407.
+func TestProxyHTTPDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	auth := &proxy.Auth{User: testUsername, Password: testPassword}
+
+	for _, close407 := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		conns := runDigestProxy(t, ln, close407)
+		pr, _ := ProxyHTTP("tcp", ln.Addr().String(), auth, proxy.Direct)
+		tr := &http.Transport{DialContext: contextDialer{pr}.DialContext, DisableKeepAlives: true}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("close407=%v: %v", close407, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "ok" {
+				t.Errorf("close407=%v: body %q", close407, body)
+			}
+		}
+		// The first CONNECT gets a 407 and the challenge is remembered
+		// for the second.
+		expected := int32(2)
+		if close407 {
+			expected = 3
+		}
+		if n := atomic.LoadInt32(conns); n != expected {
+			t.Errorf("close407=%v: %d connections to the proxy, expected %d", close407, n, expected)
+		}
+	}
+}
+
+func TestProxyHTTPAuthRefused(t *testing.T) {
+	for _, auth := range []*proxy.Auth{
+		nil,
+		{User: testUsername, Password: "wrong"},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		runDigestProxy(t, ln, false)
+		pr, _ := ProxyHTTP("tcp", ln.Addr().String(), auth, proxy.Direct)
+		_, err = pr.Dial("tcp", testAddr)
+		authErr, ok := err.(*proxyAuthError)
+		if !ok {
+			t.Errorf("%v: got %v, expected a proxyAuthError", auth, err)
+			continue
+		}
+		if authErr.haveCredentials != (auth != nil) {
+			t.Errorf("%v: %v", auth, err)
+		}
+	}
+}
+
+// The NTLM handshake takes three CONNECTs, the last two of which must be on
+// the same connection.
+func TestProxyHTTPNTLM(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				challenged := false
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					authorization := req.Header.Get("Proxy-Authorization")
+					msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "NTLM "))
+					switch {
+					case bytes.Equal(msg, ntlmNegotiateMessage()):
+						challenged = true
+						io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(ntlmTestChallenge)+"\r\nContent-Length: 0\r\n\r\n")
+					case challenged && len(msg) > 64 && msg[8] == 3:
+						nt, _ := ntlmField(msg, 20)
+						if len(nt) < 16 || !bytes.Equal(nt[:16], hmacMD5(ntowfv2("User", testPassword, "Domain"), mustDecodeHex("0123456789abcdef"), nt[16:])) {
+							io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+							return
+						}
+						io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+						return
+					default:
+						io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	pr, _ := ProxyHTTP("tcp", ln.Addr().String(), &proxy.Auth{User: `Domain\User`, Password: testPassword}, proxy.Direct)
+	conn, err := pr.Dial("tcp", testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections to the proxy, expected 1", n)
+	}
+}
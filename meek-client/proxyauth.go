@@ -0,0 +1,483 @@
+package main
+
+// The code in this file answers the authentication challenges of HTTP proxies
+// (407 Proxy Authentication Required), with the username and password from
+// the proxy URL. It knows the Basic (RFC 7617) and Digest (RFC 7616) schemes.
+// No credentials are sent until the proxy asks for them. The scheme asked for
+// is remembered, so that later CONNECTs to the same proxy can answer it without
+// another 407 (with Digest, until the proxy changes the nonce). Once the proxy
+// has asked for a scheme stronger than Basic, a later request for Basic is
+// refused rather than send the password in the clear.
+//
+// It also knows the connection-based NTLM and Negotiate schemes of enterprise
+// proxies, which take two requests on the same connection (see ntlm.go), or
+// one with Kerberos (see kerberos.go). Negotiate uses Kerberos with
+// --proxy-kerberos if the user has Kerberos credentials, and NTLM otherwise.
+// Once a proxy has asked for one of these schemes, later connections start
+// with it.
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"../lib/logging"
+)
+
+// An authentication challenge from a Proxy-Authenticate header.
+type authChallenge struct {
+	// Lowercase.
+	scheme string
+	// The token68 after the scheme, as in "NTLM TlRMTVNTUAACAAAA...", if
+	// any.
+	token string
+	// Keys are lowercase.
+	params map[string]string
+}
+
+// Parse the challenges in the values of a WWW-Authenticate or
+// Proxy-Authenticate header. Any one value may have more than one challenge,
+// as in `Basic realm="a", Digest realm="b", nonce="c"`. Challenges that can't
+// be parsed are left out.
+func parseChallenges(values []string) []authChallenge {
+	var challenges []authChallenge
+	for _, s := range values {
+		var current *authChallenge
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			token, rest := cutToken(s)
+			if token == "" {
+				// The end, or garbage.
+				break
+			}
+			rest = strings.TrimLeft(rest, " \t")
+			if current != nil && strings.HasPrefix(rest, "=") {
+				// An auth-param of the current challenge.
+				var value string
+				value, s = cutParamValue(strings.TrimLeft(rest[1:], " \t"))
+				current.params[strings.ToLower(token)] = value
+				continue
+			}
+			// The start of a new challenge.
+			challenges = append(challenges, authChallenge{
+				scheme: strings.ToLower(token),
+				params: make(map[string]string),
+			})
+			current = &challenges[len(challenges)-1]
+			s = rest
+			// A token68, rather than an auth-param, may follow the
+			// scheme.
+			next, after := cutToken(rest)
+			after = strings.TrimLeft(after, " \t")
+			if next != "" && (!strings.HasPrefix(after, "=") || isToken68(after)) {
+				padding := len(after) - len(strings.TrimLeft(after, "="))
+				current.token = next + after[:padding]
+				s = after[padding:]
+			}
+		}
+	}
+	return challenges
+}
+
+// Split a leading token off s.
+func cutToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// Return whether rest, which follows a token and begins with "=", is the
+// padding of a token68 rather than the value of an auth-param.
+func isToken68(rest string) bool {
+	rest = strings.TrimLeft(rest, "= \t")
+	return rest == "" || rest[0] == ','
+}
+
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~/", c) >= 0
+}
+
+// Split an auth-param value, a token or a quoted-string, off s.
+func cutParamValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return cutToken(s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	// Unterminated.
+	return b.String(), ""
+}
+
+// A Digest challenge that we know how to answer.
+type digestChallenge struct {
+	realm, nonce, opaque string
+	// "MD5", "SHA-256", or either with "-sess".
+	algorithm string
+	// "auth", or "" for the RFC 2069 form without qop.
+	qop   string
+	stale bool
+}
+
+// Return the Digest challenge in c, or nil if it's not one we can answer.
+func makeDigestChallenge(c authChallenge) *digestChallenge {
+	if c.scheme != "digest" || c.params["nonce"] == "" {
+		return nil
+	}
+	d := &digestChallenge{
+		realm:     c.params["realm"],
+		nonce:     c.params["nonce"],
+		opaque:    c.params["opaque"],
+		algorithm: c.params["algorithm"],
+		stale:     strings.EqualFold(c.params["stale"], "true"),
+	}
+	if d.algorithm == "" {
+		d.algorithm = "MD5"
+	}
+	if digestHash(d.algorithm) == nil {
+		return nil
+	}
+	if qop, ok := c.params["qop"]; ok {
+		for _, option := range strings.Split(qop, ",") {
+			if strings.TrimSpace(option) == "auth" {
+				d.qop = "auth"
+			}
+		}
+		if d.qop == "" {
+			// Only auth-int is offered, which would need the body.
+			return nil
+		}
+	}
+	return d
+}
+
+// Return a function making the hash named by a Digest algorithm, or nil if the
+// algorithm is not supported.
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// Return the value of a Proxy-Authorization header answering d for a request
+// with the given method and request-target, with nonce count nc and client
+// nonce cnonce.
+func (d *digestChallenge) authorization(username, password, method, uri string, nc uint32, cnonce string) string {
+	newHash := digestHash(d.algorithm)
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	ha1 := h(username + ":" + d.realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(d.algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + d.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	ncValue := fmt.Sprintf("%08x", nc)
+	var response string
+	if d.qop == "" {
+		response = h(ha1 + ":" + d.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + d.nonce + ":" + ncValue + ":" + cnonce + ":" + d.qop + ":" + ha2)
+	}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	params := []string{
+		"username=" + quote(username),
+		"realm=" + quote(d.realm),
+		"nonce=" + quote(d.nonce),
+		"uri=" + quote(uri),
+		"algorithm=" + d.algorithm,
+		"response=" + quote(response),
+	}
+	if d.opaque != "" {
+		params = append(params, "opaque="+quote(d.opaque))
+	}
+	if d.qop != "" {
+		params = append(params, "qop="+d.qop, "nc="+ncValue, "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
+
+// errNoKerberos means that there are no Kerberos credentials to try.
+var errNoKerberos = errors.New("no Kerberos credentials")
+
+// Gets a Kerberos token for Negotiate; see kerberos.go. A variable so that
+// tests can substitute another.
+var negotiateToken = kerberosToken
+
+// How strongly to prefer each scheme when a proxy offers more than one.
+var proxyAuthSchemePreference = map[string]int{
+	"basic":     1,
+	"digest":    2,
+	"ntlm":      3,
+	"negotiate": 4,
+}
+
+// proxyAuthenticator makes the Proxy-Authorization headers for one proxy,
+// through a proxyAuthSession for each connection. It remembers the scheme the
+// proxy asked for, to start with on later connections.
+type proxyAuthenticator struct {
+	username, password string
+	// Whether there is a username and password; without them, only
+	// Negotiate with Kerberos can work.
+	haveCredentials bool
+	// Whether to use Kerberos (--proxy-kerberos), and the Kerberos service
+	// principal name of the proxy.
+	kerberos bool
+	spn      string
+
+	lock sync.Mutex
+	// The scheme to start with: "" for none, until the proxy asks for
+	// one; or "basic", "digest", "ntlm", or "negotiate".
+	scheme string
+	// For "negotiate", whether to use NTLM rather than Kerberos.
+	negotiateNTLM bool
+	// The Digest challenge to answer.
+	digest *digestChallenge
+	// The nonce count of the last answer to digest.
+	nc uint32
+}
+
+// Return a proxyAuthenticator for the proxy at host (without a port), with
+// the credentials auth, which may be nil.
+func newProxyAuthenticator(auth *proxy.Auth, host string) *proxyAuthenticator {
+	a := &proxyAuthenticator{kerberos: options.ProxyKerberos, spn: "HTTP/" + host}
+	if auth != nil {
+		a.username, a.password = auth.User, auth.Password
+		a.haveCredentials = true
+	}
+	return a
+}
+
+// proxyAuthSession is the authentication of one connection to a proxy. NTLM
+// and Negotiate take more than one request on the same connection.
+type proxyAuthSession struct {
+	a *proxyAuthenticator
+	// The connection-based scheme in progress ("ntlm" or "negotiate"),
+	// whose first token was sent, or "".
+	scheme string
+	// Whether the last token of scheme was sent.
+	done bool
+	// The Proxy-Authorization to send next, continuing scheme.
+	next string
+}
+
+// Start authenticating a new connection.
+func (a *proxyAuthenticator) Session() *proxyAuthSession {
+	return &proxyAuthSession{a: a}
+}
+
+// Return the value of the Proxy-Authorization header for a request with the
+// given method and request-target, or "" for none. Getting a Kerberos token
+// stops when ctx is done.
+func (s *proxyAuthSession) Authorization(ctx context.Context, method, uri string) string {
+	if s.next != "" {
+		next := s.next
+		s.next = ""
+		s.done = true
+		return next
+	}
+	a := s.a
+	if a.wantKerberos() {
+		s.scheme = "negotiate"
+		// Not with the lock held: this may take a round trip to the
+		// KDC.
+		token, err := negotiateToken(ctx, a.spn)
+		if err == nil {
+			// Kerberos takes one request.
+			s.done = true
+			return "Negotiate " + base64.StdEncoding.EncodeToString(token)
+		}
+		logging.Warnf("Kerberos authentication to the proxy: %s", err)
+		if !a.haveCredentials {
+			return ""
+		}
+		// Fall back to NTLM.
+		a.lock.Lock()
+		a.negotiateNTLM = true
+		a.lock.Unlock()
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch a.scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	case "digest":
+		a.nc++
+		var cnonce [16]byte
+		rand.Read(cnonce[:])
+		return a.digest.authorization(a.username, a.password, method, uri, a.nc, hex.EncodeToString(cnonce[:]))
+	case "ntlm":
+		s.scheme = "ntlm"
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())
+	case "negotiate":
+		s.scheme = "negotiate"
+		if !a.negotiateNTLM {
+			// Another connection has just switched to Kerberos.
+			return ""
+		}
+		return "Negotiate " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())
+	}
+	return ""
+}
+
+// Should the next connection start with Kerberos?
+func (a *proxyAuthenticator) wantKerberos() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.scheme == "negotiate" && !a.negotiateNTLM
+}
+
+// Learn from the challenges of a 407 response to a request that had the
+// Proxy-Authorization header sent (possibly ""). reusable is whether the
+// connection can carry another request. Returns true if trying again might
+// succeed: with the next message of an NTLM or Negotiate exchange, or with a
+// scheme other than the one sent, or with Digest with a new or stale nonce.
+// Returns false if the credentials were sent as asked and refused, or if there
+// is nothing we can answer.
+func (s *proxyAuthSession) Challenge(resp *http.Response, sent string, reusable bool) bool {
+	challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+	a := s.a
+
+	// The next step of an exchange in progress.
+	if s.scheme != "" && !s.done {
+		for _, c := range challenges {
+			if c.scheme != s.scheme || c.token == "" {
+				continue
+			}
+			// Only NTLM takes another step.
+			msg, err := base64.StdEncoding.DecodeString(c.token)
+			if err == nil {
+				msg, err = ntlmAuthenticateMessage(msg, a.username, a.password)
+			}
+			if err != nil {
+				logging.Warnf("NTLM authentication to the proxy: %s", err)
+				return false
+			}
+			if c.scheme == "ntlm" {
+				s.next = "NTLM " + base64.StdEncoding.EncodeToString(msg)
+			} else {
+				s.next = "Negotiate " + base64.StdEncoding.EncodeToString(msg)
+			}
+			// The answer counts only on the same connection.
+			return reusable
+		}
+	}
+	// Otherwise the proxy is starting over.
+	s.scheme, s.done = "", false
+
+	// Choose the scheme to try next.
+	var best string
+	var digest *digestChallenge
+	offered := make(map[string]bool)
+	for _, c := range challenges {
+		switch c.scheme {
+		case "basic", "ntlm":
+			if !a.haveCredentials {
+				continue
+			}
+		case "digest":
+			d := makeDigestChallenge(c)
+			if d == nil || !a.haveCredentials {
+				continue
+			}
+			if digest == nil {
+				digest = d
+			}
+		case "negotiate":
+			// Without credentials, only Kerberos.
+		default:
+			continue
+		}
+		offered[c.scheme] = true
+		if proxyAuthSchemePreference[c.scheme] > proxyAuthSchemePreference[best] {
+			best = c.scheme
+		}
+	}
+	sentScheme, _, _ := strings.Cut(sent, " ")
+	sentScheme = strings.ToLower(sentScheme)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if best == "negotiate" {
+		switch {
+		case sentScheme == "negotiate" && (a.negotiateNTLM || !a.haveCredentials):
+			return false
+		case sentScheme == "negotiate":
+			// Kerberos was refused; try NTLM in its place.
+			a.negotiateNTLM = true
+		default:
+			// Whether Kerberos works is found out when the token
+			// is got, in Authorization.
+			kerberos := a.kerberos && haveKerberos()
+			if !kerberos && !a.haveCredentials {
+				return false
+			}
+			a.negotiateNTLM = !kerberos
+		}
+		if a.negotiateNTLM && offered["ntlm"] {
+			// NTLM by its own name is more widely understood.
+			best = "ntlm"
+		}
+	}
+	switch best {
+	case "basic":
+		if sentScheme == best {
+			return false
+		}
+		// Basic sends the password in the clear; don't fall back to
+		// it from a scheme that doesn't.
+		if proxyAuthSchemePreference[a.scheme] > proxyAuthSchemePreference["basic"] ||
+			proxyAuthSchemePreference[sentScheme] > proxyAuthSchemePreference["basic"] {
+			logging.Warnf("proxy asked for Basic authentication after a stronger scheme; not sending the password in the clear")
+			return false
+		}
+	case "ntlm":
+		if sentScheme == best {
+			return false
+		}
+	case "digest":
+		if sentScheme == "digest" && !digest.stale && a.digest != nil && digest.nonce == a.digest.nonce {
+			return false
+		}
+		a.digest, a.nc = digest, 0
+	case "":
+		return false
+	}
+	a.scheme = best
+	return true
+}
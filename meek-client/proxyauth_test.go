@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestParseChallenges(t *testing.T) {
+	for _, test := range []struct {
+		values   []string
+		expected []authChallenge
+	}{
+		{nil, nil},
+		{[]string{`Basic realm="proxy"`}, []authChallenge{
+			{"basic", "", map[string]string{"realm": "proxy"}},
+		}},
+		{[]string{`Basic realm="a, b", Digest realm="c\"d", nonce=xyz, qop="auth,auth-int"`}, []authChallenge{
+			{"basic", "", map[string]string{"realm": "a, b"}},
+			{"digest", "", map[string]string{"realm": `c"d`, "nonce": "xyz", "qop": "auth,auth-int"}},
+		}},
+		{[]string{`Negotiate`, `NTLM TlRMTVNTUAACAAAA==, Basic realm = x`}, []authChallenge{
+			{"negotiate", "", map[string]string{}},
+			{"ntlm", "TlRMTVNTUAACAAAA==", map[string]string{}},
+			{"basic", "", map[string]string{"realm": "x"}},
+		}},
+		{[]string{`Negotiate oYG3MIG0oAMKAQ`}, []authChallenge{
+			{"negotiate", "oYG3MIG0oAMKAQ", map[string]string{}},
+		}},
+		{[]string{`Digest realm="unterminated`}, []authChallenge{
+			{"digest", "", map[string]string{"realm": "unterminated"}},
+		}},
+		{[]string{`, ,`, `"garbage"`}, nil},
+	} {
+		challenges := parseChallenges(test.values)
+		if !reflect.DeepEqual(challenges, test.expected) {
+			t.Errorf("%q → %v, expected %v", test.values, challenges, test.expected)
+		}
+	}
+}
+
+// The examples of RFC 7616 section 3.9.1.
+func TestDigestAuthorization(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		d := makeDigestChallenge(parseChallenges([]string{`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` + test.algorithm + `, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`})[0])
+		if d == nil {
+			t.Fatalf("%s: challenge not understood", test.algorithm)
+		}
+		authorization := d.authorization("Mufasa", "Circle of Life", "GET", "/dir/index.html", 1, "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		params := parseChallenges([]string{authorization})[0].params
+		if params["response"] != test.response {
+			t.Errorf("%s: response %q, expected %q", test.algorithm, params["response"], test.response)
+		}
+		if params["qop"] != "auth" || params["nc"] != "00000001" || params["opaque"] != d.opaque || params["uri"] != "/dir/index.html" {
+			t.Errorf("%s: %s", test.algorithm, authorization)
+		}
+	}
+
+	// Unsupported algorithms and qop.
+	for _, value := range []string{
+		`Digest realm="r", nonce="n", algorithm=SHA-512-256`,
+		`Digest realm="r", nonce="n", qop="auth-int"`,
+		`Digest realm="r"`,
+		`Basic realm="r", nonce="n"`,
+	} {
+		if d := makeDigestChallenge(parseChallenges([]string{value})[0]); d != nil {
+			t.Errorf("%q → %+v, expected nil", value, d)
+		}
+	}
+}
+
+func proxyAuthResponse(values ...string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		Header:     http.Header{"Proxy-Authenticate": values},
+	}
+}
+
+func TestProxyAuthenticatorBasicDigest(t *testing.T) {
+	none := newProxyAuthenticator(nil, testHost)
+	s := none.Session()
+	if authorization := s.Authorization(context.Background(), "CONNECT", testAddr); authorization != "" {
+		t.Errorf("no credentials made %q", authorization)
+	}
+	if s.Challenge(proxyAuthResponse(`Basic realm="r"`, `Digest realm="r", nonce="1"`, `NTLM`), "", true) {
+		t.Errorf("no credentials would try again")
+	}
+
+	a := newProxyAuthenticator(&proxy.Auth{User: testUsername, Password: testPassword}, testHost)
+	s = a.Session()
+	// Nothing up front.
+	if authorization := s.Authorization(context.Background(), "CONNECT", testAddr); authorization != "" {
+		t.Fatalf("first authorization %q", authorization)
+	}
+	// Basic, when asked for.
+	if !s.Challenge(proxyAuthResponse(`Basic realm="r"`), "", true) {
+		t.Fatalf("wouldn't try Basic")
+	}
+	basic := s.Authorization(context.Background(), "CONNECT", testAddr)
+	if !strings.HasPrefix(basic, "Basic ") {
+		t.Fatalf("authorization %q", basic)
+	}
+	if authorization := a.Session().Authorization(context.Background(), "CONNECT", testAddr); authorization != basic {
+		t.Errorf("next connection's authorization %q", authorization)
+	}
+	// Basic refused.
+	if s.Challenge(proxyAuthResponse(`Basic realm="r"`), basic, true) {
+		t.Errorf("would try Basic again")
+	}
+	// Digest asked for instead.
+	if !s.Challenge(proxyAuthResponse(`Basic realm="r"`, `Digest realm="r", nonce="1", qop=auth`), basic, true) {
+		t.Fatalf("wouldn't try Digest")
+	}
+	first := s.Authorization(context.Background(), "CONNECT", testAddr)
+	second := a.Session().Authorization(context.Background(), "CONNECT", testAddr)
+	if !strings.HasPrefix(first, "Digest ") || !strings.Contains(first, "nc=00000001") || !strings.Contains(second, "nc=00000002") {
+		t.Errorf("authorizations %q, %q", first, second)
+	}
+	// Digest refused with the same nonce.
+	if s.Challenge(proxyAuthResponse(`Digest realm="r", nonce="1", qop=auth`), second, true) {
+		t.Errorf("would try the same nonce again")
+	}
+	// A stale nonce is worth another try, as is a new one.
+	if !s.Challenge(proxyAuthResponse(`Digest realm="r", nonce="1", qop=auth, stale=true`), second, true) {
+		t.Errorf("wouldn't try again after stale=true")
+	}
+	if !s.Challenge(proxyAuthResponse(`Digest realm="r", nonce="2", qop=auth`), s.Authorization(context.Background(), "CONNECT", testAddr), true) {
+		t.Errorf("wouldn't try a new nonce")
+	}
+	if authorization := s.Authorization(context.Background(), "CONNECT", testAddr); !strings.Contains(authorization, `nonce="2"`) || !strings.Contains(authorization, "nc=00000001") {
+		t.Errorf("authorization %q", authorization)
+	}
+	// Nothing we can answer.
+	if s.Challenge(proxyAuthResponse(`Bearer realm="r"`), "", true) {
+		t.Errorf("would try again after Bearer")
+	}
+	// No going back from Digest to Basic.
+	digest := s.Authorization(context.Background(), "CONNECT", testAddr)
+	if s.Challenge(proxyAuthResponse(`Basic realm="r"`), digest, true) {
+		t.Errorf("would try Basic after Digest")
+	}
+	if authorization := a.Session().Authorization(context.Background(), "CONNECT", testAddr); !strings.HasPrefix(authorization, "Digest ") {
+		t.Errorf("authorization %q after Basic was refused", authorization)
+	}
+}
+
+// Substitute for negotiateToken and haveKerberos in tests, with
+// --proxy-kerberos. *calls counts the tokens got.
+func fakeKerberos(token []byte, err error, calls *int) func() {
+	savedToken, savedHave, savedOption := negotiateToken, haveKerberos, options.ProxyKerberos
+	negotiateToken = func(ctx context.Context, spn string) ([]byte, error) {
+		if calls != nil {
+			*calls++
+		}
+		if spn != "HTTP/"+testHost {
+			return nil, errors.New("wrong SPN " + spn)
+		}
+		return token, err
+	}
+	haveKerberos = func() bool {
+		return err != errNoKerberos
+	}
+	options.ProxyKerberos = true
+	return func() {
+		negotiateToken, haveKerberos, options.ProxyKerberos = savedToken, savedHave, savedOption
+	}
+}
+
+func TestProxyAuthenticatorNTLM(t *testing.T) {
+	defer fakeKerberos(nil, errNoKerberos, nil)()
+	a := newProxyAuthenticator(&proxy.Auth{User: `DOMAIN\user`, Password: testPassword}, testHost)
+	s := a.Session()
+	basic := s.Authorization(context.Background(), "CONNECT", testAddr)
+	// NTLM is preferred to Basic, and to Negotiate without Kerberos.
+	if !s.Challenge(proxyAuthResponse(`Basic realm="r"`, `Negotiate`, `NTLM`), basic, false) {
+		t.Fatalf("wouldn't try NTLM")
+	}
+	s = a.Session()
+	negotiate := s.Authorization(context.Background(), "CONNECT", testAddr)
+	if negotiate != "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+		t.Fatalf("authorization %q", negotiate)
+	}
+	challenge := base64.StdEncoding.EncodeToString(ntlmTestChallenge)
+	// The answer to the challenge is only good on the same connection.
+	if s.Challenge(proxyAuthResponse(`NTLM `+challenge), negotiate, false) {
+		t.Errorf("would answer the challenge on a new connection")
+	}
+	s = a.Session()
+	negotiate = s.Authorization(context.Background(), "CONNECT", testAddr)
+	if !s.Challenge(proxyAuthResponse(`NTLM `+challenge), negotiate, true) {
+		t.Fatalf("wouldn't answer the challenge")
+	}
+	authenticate := s.Authorization(context.Background(), "CONNECT", testAddr)
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authenticate, "NTLM "))
+	if err != nil || len(msg) < 64 || msg[8] != 3 {
+		t.Fatalf("authorization %q", authenticate)
+	}
+	// Refused.
+	if s.Challenge(proxyAuthResponse(`NTLM`), authenticate, true) {
+		t.Errorf("would try NTLM again")
+	}
+}
+
+func TestProxyAuthenticatorNegotiate(t *testing.T) {
+	calls := 0
+	restore := fakeKerberos([]byte("ticket"), nil, &calls)
+	defer restore()
+	// Kerberos needs no username or password.
+	a := newProxyAuthenticator(nil, testHost)
+	s := a.Session()
+	if !s.Challenge(proxyAuthResponse(`Negotiate`, `NTLM`), "", true) {
+		t.Fatalf("wouldn't try Negotiate")
+	}
+	if calls != 0 {
+		t.Errorf("got %d tokens before sending one", calls)
+	}
+	kerberos := s.Authorization(context.Background(), "CONNECT", testAddr)
+	if kerberos != "Negotiate "+base64.StdEncoding.EncodeToString([]byte("ticket")) {
+		t.Fatalf("authorization %q", kerberos)
+	}
+	if calls != 1 {
+		t.Errorf("got %d tokens for one handshake", calls)
+	}
+	if s.Challenge(proxyAuthResponse(`Negotiate`), kerberos, true) {
+		t.Errorf("would try again without credentials")
+	}
+
+	// With credentials, NTLM takes over when Kerberos is refused.
+	a = newProxyAuthenticator(&proxy.Auth{User: "user", Password: testPassword}, testHost)
+	s = a.Session()
+	s.Challenge(proxyAuthResponse(`Negotiate`), "", true)
+	kerberos = s.Authorization(context.Background(), "CONNECT", testAddr)
+	if !s.Challenge(proxyAuthResponse(`Negotiate`), kerberos, true) {
+		t.Fatalf("wouldn't try NTLM")
+	}
+	negotiate := s.Authorization(context.Background(), "CONNECT", testAddr)
+	if negotiate != "Negotiate "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+		t.Fatalf("authorization %q", negotiate)
+	}
+	if !s.Challenge(proxyAuthResponse(`Negotiate `+base64.StdEncoding.EncodeToString(ntlmTestChallenge)), negotiate, true) {
+		t.Fatalf("wouldn't answer the challenge")
+	}
+	if authenticate := s.Authorization(context.Background(), "CONNECT", testAddr); !strings.HasPrefix(authenticate, "Negotiate TlRMTVNTUAADAAAA") {
+		t.Errorf("authorization %q", authenticate)
+	}
+
+	// Without Kerberos credentials, NTLM in Negotiate from the start.
+	restore()
+	restore = fakeKerberos(nil, errNoKerberos, nil)
+	a = newProxyAuthenticator(&proxy.Auth{User: "user", Password: testPassword}, testHost)
+	s = a.Session()
+	if !s.Challenge(proxyAuthResponse(`Negotiate`), "", true) {
+		t.Fatalf("wouldn't try Negotiate")
+	}
+	if negotiate := s.Authorization(context.Background(), "CONNECT", testAddr); negotiate != "Negotiate "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+		t.Errorf("authorization %q", negotiate)
+	}
+	if newProxyAuthenticator(nil, testHost).Session().Challenge(proxyAuthResponse(`Negotiate`), "", true) {
+		t.Errorf("would try Negotiate without any credentials")
+	}
+
+	// Without --proxy-kerberos, Kerberos is never tried.
+	restore()
+	calls = 0
+	restore = fakeKerberos([]byte("ticket"), nil, &calls)
+	options.ProxyKerberos = false
+	a = newProxyAuthenticator(&proxy.Auth{User: "user", Password: testPassword}, testHost)
+	s = a.Session()
+	if !s.Challenge(proxyAuthResponse(`Negotiate`), "", true) {
+		t.Fatalf("wouldn't try Negotiate")
+	}
+	if negotiate := s.Authorization(context.Background(), "CONNECT", testAddr); negotiate != "Negotiate "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+		t.Errorf("authorization %q", negotiate)
+	}
+	if newProxyAuthenticator(nil, testHost).Session().Challenge(proxyAuthResponse(`Negotiate`), "", true) {
+		t.Errorf("would try Negotiate without --proxy-kerberos or credentials")
+	}
+	if calls != 0 {
+		t.Errorf("got %d tokens without --proxy-kerberos", calls)
+	}
+}
+
+// When getting a token fails, NTLM takes over on the same connection.
+func TestProxyAuthenticatorKerberosError(t *testing.T) {
+	defer fakeKerberos(nil, errors.New("KDC unreachable"), nil)()
+	a := newProxyAuthenticator(&proxy.Auth{User: "user", Password: testPassword}, testHost)
+	s := a.Session()
+	if !s.Challenge(proxyAuthResponse(`Negotiate`), "", true) {
+		t.Fatalf("wouldn't try Negotiate")
+	}
+	if negotiate := s.Authorization(context.Background(), "CONNECT", testAddr); negotiate != "Negotiate "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()) {
+		t.Errorf("authorization %q", negotiate)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// The code in this file reloads the endpoint options, --url, --front, and
+// --utls, from a file (--endpoints-file) on SIGHUP, so that an operator can
+// push a new front list without restarting meek-client and breaking the
+// sessions in progress. The file has the url=, front=, and utls= arguments of
+// a bridge line, separated by spaces or newlines; lines starting with "#" are
+// comments. A value in the file overrides the command-line option, and an
+// option left out of the file goes back to its command-line value. New values
+// apply to sessions started after the reload; sessions in progress keep the
+// ones they started with. If the file can't be read, or has a bad value, the
+// error is logged and the previous values are kept.
+//
+// Several fronts (front=a,b,c) go to the front selector (see fronts.go), which
+// is started if there wasn't one; once started, it stays, and gets every new
+// front list, even one with a single front.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"../lib/logging"
+)
+
+// The options that an endpoints file can change.
+type endpoints struct {
+	URL      string
+	Front    string
+	UTLSName string
+}
+
+// The arguments an endpoints file may have.
+var endpointsFileArgs = map[string]bool{"front": true, "url": true, "utls": true}
+
+// Protects options.URL, options.Front, options.UTLSName, and
+// options.FrontSelector once sessions may be running.
+var endpointsLock sync.RWMutex
+
+// Return the current endpoint options and front selector.
+func currentEndpoints() (endpoints, *frontSelector) {
+	endpointsLock.RLock()
+	defer endpointsLock.RUnlock()
+	return endpoints{URL: options.URL, Front: options.Front, UTLSName: options.UTLSName}, options.FrontSelector
+}
+
+// Parse the text of an endpoints file, returning base with the values the file
+// has in place of its own.
+func parseEndpoints(text string, base endpoints) (endpoints, error) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines = append(lines, line)
+		}
+	}
+	args, err := parseBridgeArgs(strings.Join(lines, " "))
+	if err != nil {
+		return endpoints{}, err
+	}
+	for key := range args {
+		if !endpointsFileArgs[key] {
+			return endpoints{}, fmt.Errorf("unknown argument %s= (known arguments are front=, url=, utls=)", key)
+		}
+	}
+	e := base
+	if value, ok := args.Get("url"); ok {
+		u, err := url.Parse(value)
+		if err != nil {
+			return endpoints{}, fmt.Errorf("url=: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return endpoints{}, fmt.Errorf("url= scheme %q is not http or https", u.Scheme)
+		}
+		e.URL = value
+	}
+	if value, ok := args.Get("front"); ok {
+		if len(parseFronts(value)) == 0 {
+			return endpoints{}, fmt.Errorf("front= has no fronts")
+		}
+		e.Front = value
+	}
+	if value, ok := args.Get("utls"); ok {
+		if _, ok := clientHelloIDMap[strings.ToLower(value)]; !ok {
+			return endpoints{}, fmt.Errorf("no uTLS Client Hello ID named %q", value)
+		}
+		e.UTLSName = value
+	}
+	return e, nil
+}
+
+// Read the endpoints file at path, with base as the values of options it
+// leaves out.
+func readEndpointsFile(path string, base endpoints) (endpoints, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return endpoints{}, err
+	}
+	e, err := parseEndpoints(string(data), base)
+	if err != nil {
+		return endpoints{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return e, nil
+}
+
+// Make e the current endpoint options. If e has several fronts, the first is
+// options.Front, and all go to the front selector, which startSelector starts
+// if there is none yet.
+func applyEndpoints(e endpoints, startSelector func(e endpoints, fronts []string) (*frontSelector, error)) error {
+	fronts := parseFronts(e.Front)
+	if strictGuard != nil {
+		// The front selector probes the fronts.
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return err
+		}
+		for _, front := range fronts {
+			strictGuard.AllowURL(u, front)
+		}
+	}
+	if len(fronts) > 0 {
+		e.Front = fronts[0]
+	}
+	endpointsLock.Lock()
+	sel := options.FrontSelector
+	if sel != nil && len(fronts) == 0 {
+		endpointsLock.Unlock()
+		return fmt.Errorf("cannot remove the fronts once there are several")
+	}
+	options.URL, options.Front, options.UTLSName = e.URL, e.Front, e.UTLSName
+	if sel != nil {
+		sel.SetFronts(fronts)
+	}
+	endpointsLock.Unlock()
+
+	if sel == nil && len(fronts) > 1 {
+		// Not with the lock held: starting a selector reads its state
+		// file.
+		sel, err := startSelector(e, fronts)
+		if err != nil {
+			return err
+		}
+		endpointsLock.Lock()
+		options.FrontSelector = sel
+		endpointsLock.Unlock()
+	}
+	return nil
+}
+
+// Reload the endpoints file at path, logging the result.
+func reloadEndpoints(path string, base endpoints, startSelector func(e endpoints, fronts []string) (*frontSelector, error)) {
+	e, err := readEndpointsFile(path, base)
+	if err == nil {
+		err = applyEndpoints(e, startSelector)
+	}
+	if err != nil {
+		logging.Warnf("not reloading endpoints: %s", err)
+		return
+	}
+	u, _ := url.Parse(e.URL)
+	logging.Infof("reloaded endpoints: url=%s front=%s utls=%s", scrubURL(u), e.Front, e.UTLSName)
+}
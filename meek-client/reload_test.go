@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	base := endpoints{URL: "https://base.example/", Front: "base-front.example", UTLSName: "none"}
+	for _, test := range []struct {
+		input    string
+		expected endpoints
+	}{
+		{"", base},
+		{"# nothing here\n", base},
+		{"url=https://new.example/", endpoints{URL: "https://new.example/", Front: "base-front.example", UTLSName: "none"}},
+		{"front=a.example,b.example\nutls=HelloChrome_Auto", endpoints{URL: "https://base.example/", Front: "a.example,b.example", UTLSName: "HelloChrome_Auto"}},
+		{"# fronts\nfront=a.example\n# server\nurl=http://new.example/\n", endpoints{URL: "http://new.example/", Front: "a.example", UTLSName: "none"}},
+	} {
+		e, err := parseEndpoints(test.input, base)
+		if err != nil || e != test.expected {
+			t.Errorf("%q → (%+v, %v), expected (%+v, nil)", test.input, e, err, test.expected)
+		}
+	}
+	for _, input := range []string{
+		"mode=ws",
+		"url=ftp://new.example/",
+		"front=,",
+		"utls=HelloNobody",
+		"url=https://a.example/ url=https://b.example/",
+	} {
+		_, err := parseEndpoints(input, base)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestApplyEndpoints(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.FrontSelector = nil
+
+	var started []string
+	startSelector := func(e endpoints, fronts []string) (*frontSelector, error) {
+		if options.URL != e.URL {
+			t.Errorf("selector started with URL %q, not %q", options.URL, e.URL)
+		}
+		started = fronts
+		return newFakeFrontSelector(fronts, "", nil), nil
+	}
+
+	err := applyEndpoints(endpoints{URL: "https://meek.example/", Front: "a.example"}, startSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started != nil || options.FrontSelector != nil || options.Front != "a.example" {
+		t.Errorf("one front: started %q, front %q", started, options.Front)
+	}
+
+	err = applyEndpoints(endpoints{URL: "https://meek.example/", Front: "b.example,c.example"}, startSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(started, []string{"b.example", "c.example"}) || options.Front != "b.example" {
+		t.Errorf("several fronts: started %q, front %q", started, options.Front)
+	}
+
+	// Once there is a selector, it gets every new list.
+	started = nil
+	err = applyEndpoints(endpoints{URL: "https://other.example/", Front: "d.example"}, startSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started != nil || options.FrontSelector.Best() != "d.example" || options.URL != "https://other.example/" {
+		t.Errorf("after selector: started %q, best %q, URL %q", started, options.FrontSelector.Best(), options.URL)
+	}
+
+	// A selector can't be left with no fronts.
+	err = applyEndpoints(endpoints{URL: "https://other.example/"}, startSelector)
+	if err == nil {
+		t.Errorf("no error for no fronts")
+	}
+	if options.FrontSelector.Best() != "d.example" {
+		t.Errorf("after no fronts: best %q", options.FrontSelector.Best())
+	}
+}
+
+func TestReloadEndpoints(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.FrontSelector = nil
+	options.Pipeline = 1
+	base := endpoints{URL: "https://meek.example/", Front: "a.example"}
+	noSelector := func(e endpoints, fronts []string) (*frontSelector, error) {
+		t.Fatalf("started a front selector for %q", fronts)
+		return nil, nil
+	}
+
+	path := filepath.Join(t.TempDir(), "endpoints")
+	err := os.WriteFile(path, []byte("front=b.example\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadEndpoints(path, base, noSelector)
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL.Host != "b.example" || info.Host != "meek.example" {
+		t.Errorf("got URL host %q, Host %q", info.URL.Host, info.Host)
+	}
+
+	// A bad file leaves the previous values.
+	err = os.WriteFile(path, []byte("front=c.example utls=HelloNobody\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadEndpoints(path, base, noSelector)
+	if options.Front != "b.example" {
+		t.Errorf("after bad file: front %q", options.Front)
+	}
+
+	// An option left out of the file goes back to its base value.
+	err = os.WriteFile(path, []byte("# empty\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadEndpoints(path, base, noSelector)
+	if options.Front != "a.example" || options.URL != "https://meek.example/" {
+		t.Errorf("after empty file: front %q, URL %q", options.Front, options.URL)
+	}
+}
+
+func TestFrontSelectorSetFronts(t *testing.T) {
+	sel := newFakeFrontSelector([]string{"a.example", "b.example"}, "", map[string]time.Duration{
+		"a.example": 80 * time.Millisecond,
+		"b.example": 40 * time.Millisecond,
+		"c.example": 20 * time.Millisecond,
+	})
+	sel.ProbeAll(context.Background())
+	sel.SetFronts([]string{"a.example", "c.example"})
+	// c.example has not been probed yet, so the best probed front wins.
+	if best := sel.Best(); best != "a.example" {
+		t.Errorf("before probing: got %q", best)
+	}
+	sel.ProbeAll(context.Background())
+	if best := sel.Best(); best != "c.example" {
+		t.Errorf("after probing: got %q", best)
+	}
+}
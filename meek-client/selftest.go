@@ -0,0 +1,163 @@
+package main
+
+// The code in this file implements "meek-client test", a self-test that runs
+// without tor or a SOCKS client. It uses the configuration from the command
+// line to send requests to the diagnostic echo endpoint of meek-server (the
+// path element "echo" appended to the URL), through the front and any proxy,
+// authenticated with the secret of --echo-secret-file, and reports:
+//	handshake	time for the first request, including connection setup
+//	round trip	median time for a small request on an open connection
+//	throughput	bytes carried per second, counting both directions
+// The server does not connect echo requests to its backend.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The path element appended to the URL for echo requests.
+	echoPath = "echo"
+	// The request header that authenticates an echo request.
+	echoAuthHeader = "X-Echo-Auth"
+	// The number of small requests used to measure round-trip time.
+	selfTestRTTRounds = 5
+	// The number of maximum-size requests used to measure throughput.
+	selfTestThroughputRounds = 8
+	// How long to allow for any one request.
+	selfTestRequestTimeout = 30 * time.Second
+)
+
+type selfTestResult struct {
+	Handshake  time.Duration
+	RTT        time.Duration
+	Throughput float64 // bytes per second
+}
+
+// Return the URL of the echo endpoint corresponding to the polling URL u.
+func echoURL(u *url.URL) *url.URL {
+	e := *u
+	e.Path = path.Join("/", u.Path, echoPath)
+	e.RawPath = ""
+	return &e
+}
+
+// Read the secret shared with the server's --echo-secret-file from filename.
+func readEchoSecret(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("no echo secret in %s", filename)
+	}
+	return secret, nil
+}
+
+// Return the X-Echo-Auth value for sessionID: the hex HMAC-SHA256 of the
+// session id under secret.
+func echoAuth(secret, sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send payload to the echo endpoint and check that it comes back. Returns the
+// time taken.
+func echoRoundTrip(info *RequestInfo, payload []byte, echoSecret string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestRequestTimeout)
+	defer cancel()
+	req, err := makeRequest(ctx, payload, info)
+	if err != nil {
+		return 0, err
+	}
+	// The echo endpoint takes POST, whatever --method is.
+	req.Method = "POST"
+	req.Header.Set(echoAuthHeader, echoAuth(echoSecret, info.SessionID))
+	start := time.Now()
+	resp, err := info.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status code was %d, not %d", resp.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPayloadLength+1))
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if !bytes.Equal(body, payload) {
+		return 0, fmt.Errorf("echo mismatch: sent %d bytes, got back %d different bytes", len(payload), len(body))
+	}
+	return elapsed, nil
+}
+
+// Run the self-test against the server described by info, whose echo endpoint
+// has the secret echoSecret.
+func runSelfTest(info *RequestInfo, echoSecret string) (*selfTestResult, error) {
+	echoInfo := *info
+	echoInfo.URL = echoURL(info.URL)
+
+	var result selfTestResult
+	small := []byte("meek")
+	var err error
+	result.Handshake, err = echoRoundTrip(&echoInfo, small, echoSecret)
+	if err != nil {
+		return nil, fmt.Errorf("first request: %s", err)
+	}
+
+	rtts := make([]time.Duration, selfTestRTTRounds)
+	for i := range rtts {
+		rtts[i], err = echoRoundTrip(&echoInfo, small, echoSecret)
+		if err != nil {
+			return nil, fmt.Errorf("round-trip test: %s", err)
+		}
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	result.RTT = rtts[len(rtts)/2]
+
+	big := make([]byte, maxPayloadLength)
+	var total time.Duration
+	for i := 0; i < selfTestThroughputRounds; i++ {
+		// Random data, so that compression along the way can't help.
+		_, err = rand.Read(big)
+		if err != nil {
+			return nil, err
+		}
+		elapsed, err := echoRoundTrip(&echoInfo, big, echoSecret)
+		if err != nil {
+			return nil, fmt.Errorf("throughput test: %s", err)
+		}
+		total += elapsed
+	}
+	result.Throughput = float64(2*len(big)*selfTestThroughputRounds) / total.Seconds()
+
+	return &result, nil
+}
+
+// Write a self-test report to w.
+func reportSelfTest(w io.Writer, info *RequestInfo, result *selfTestResult) {
+	fmt.Fprintf(w, "url:        %s\n", scrubURL(info.URL))
+	if info.Host != "" {
+		fmt.Fprintf(w, "host:       %s\n", info.Host)
+	}
+	fmt.Fprintf(w, "handshake:  %.0f ms\n", result.Handshake.Seconds()*1000)
+	fmt.Fprintf(w, "round trip: %.0f ms\n", result.RTT.Seconds()*1000)
+	fmt.Fprintf(w, "throughput: %.1f KB/s\n", result.Throughput/1000)
+}
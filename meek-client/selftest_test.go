@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEchoURL(t *testing.T) {
+	for _, test := range []struct {
+		input, expected string
+	}{
+		{"https://meek.example/", "https://meek.example/echo"},
+		{"https://meek.example", "https://meek.example/echo"},
+		{"http://meek.example:8080/meek/", "http://meek.example:8080/meek/echo"},
+	} {
+		u, err := url.Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output := echoURL(u).String(); output != test.expected {
+			t.Errorf("%q → %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/meek/echo" || req.Header.Get("X-Session-Id") == "" ||
+			req.Header.Get(echoAuthHeader) != echoAuth("secret", req.Header.Get("X-Session-Id")) {
+			http.NotFound(w, req)
+			return
+		}
+		hosts = append(hosts, req.Host)
+		// Read all of the body before writing the response; the
+		// HTTP/1.1 server doesn't allow interleaving them.
+		body, _ := io.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/meek/")
+	info := &RequestInfo{
+		SessionID:    "abcdefgh",
+		URL:          u,
+		Host:         "meek.example",
+		RoundTripper: httpRoundTripper,
+	}
+	result, err := runSelfTest(info, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Handshake <= 0 || result.RTT <= 0 || result.Throughput <= 0 {
+		t.Errorf("implausible result %+v", result)
+	}
+	for _, host := range hosts {
+		if host != "meek.example" {
+			t.Errorf("request had Host %q", host)
+		}
+	}
+	if info.URL.Path != "/meek/" {
+		t.Errorf("runSelfTest modified info.URL")
+	}
+
+	var report bytes.Buffer
+	reportSelfTest(&report, info, result)
+	for _, label := range []string{"handshake:", "round trip:", "throughput:"} {
+		if !strings.Contains(report.String(), label) {
+			t.Errorf("report lacks %q:\n%s", label, report.String())
+		}
+	}
+}
+
+func TestRunSelfTestFailure(t *testing.T) {
+	// A server that doesn't have the echo endpoint, or doesn't accept the
+	// secret.
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	_, err := runSelfTest(&RequestInfo{SessionID: "abcdefgh", URL: u, RoundTripper: httpRoundTripper}, "secret")
+	if err == nil {
+		t.Errorf("self-test against a server without echo succeeded")
+	}
+
+	// A server that doesn't echo faithfully.
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "something else")
+	}))
+	defer server.Close()
+	u, _ = url.Parse(server.URL)
+	_, err = runSelfTest(&RequestInfo{SessionID: "abcdefgh", URL: u, RoundTripper: httpRoundTripper}, "secret")
+	if err == nil {
+		t.Errorf("self-test with a bad echo succeeded")
+	}
+}
+
+// The known HMAC-SHA256 of RFC 4231 test case 2.
+func TestEchoAuth(t *testing.T) {
+	if auth := echoAuth("Jefe", "what do ya want for nothing?"); auth != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("got %s", auth)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+// The code in this file limits how many sessions the client runs at once
+// (--max-sessions). Each session has its own polling loop and buffers, so on a
+// low-memory device, or with a front that rate-limits requests, a tor that
+// opens many circuits at once can do more harm than good. A SOCKS connection
+// beyond the limit waits up to --session-queue-wait for another session to
+// end, and is then refused with a SOCKS error, which tor treats like any other
+// failed connection attempt.
+
+import (
+	"fmt"
+	"time"
+)
+
+// sessionLimiter hands out a fixed number of session slots. A nil
+// *sessionLimiter allows any number of sessions.
+type sessionLimiter struct {
+	slots chan struct{}
+	// How long to wait for a slot before giving up.
+	wait time.Duration
+}
+
+// The session limiter, or nil if there is no limit. Set up in main.
+var sessionSlots *sessionLimiter
+
+// Make a sessionLimiter allowing max sessions at once. Returns nil if max is 0
+// or less.
+func newSessionLimiter(max int, wait time.Duration) *sessionLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &sessionLimiter{slots: make(chan struct{}, max), wait: wait}
+}
+
+// Take a slot, waiting up to the queue wait for one to be released. Returns an
+// error if there is none. A successful Acquire must be matched by a Release.
+func (limiter *sessionLimiter) Acquire() error {
+	if limiter == nil {
+		return nil
+	}
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if limiter.wait > 0 {
+		timer := time.NewTimer(limiter.wait)
+		defer timer.Stop()
+		select {
+		case limiter.slots <- struct{}{}:
+			return nil
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("too many sessions (limit %d)", cap(limiter.slots))
+}
+
+// Give back a slot taken by Acquire.
+func (limiter *sessionLimiter) Release() {
+	if limiter == nil {
+		return
+	}
+	<-limiter.slots
+}
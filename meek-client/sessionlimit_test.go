@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	limiter := newSessionLimiter(2, 0)
+	for i := 0; i < 2; i++ {
+		if err := limiter.Acquire(); err != nil {
+			t.Fatalf("refused within the limit: %v", err)
+		}
+	}
+	if err := limiter.Acquire(); err == nil {
+		t.Errorf("allowed beyond the limit")
+	}
+	limiter.Release()
+	if err := limiter.Acquire(); err != nil {
+		t.Errorf("refused after a release: %v", err)
+	}
+}
+
+func TestSessionLimiterQueue(t *testing.T) {
+	limiter := newSessionLimiter(1, 5*time.Second)
+	if err := limiter.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.Release()
+	}()
+	if err := limiter.Acquire(); err != nil {
+		t.Errorf("queued session refused: %v", err)
+	}
+
+	limiter = newSessionLimiter(1, 50*time.Millisecond)
+	limiter.Acquire()
+	if err := limiter.Acquire(); err == nil {
+		t.Errorf("allowed after waiting with no release")
+	}
+}
+
+func TestSessionLimiterNil(t *testing.T) {
+	limiter := newSessionLimiter(0, 0)
+	if limiter != nil {
+		t.Fatalf("limiter without a limit is not nil")
+	}
+	for i := 0; i < 10; i++ {
+		if err := limiter.Acquire(); err != nil {
+			t.Errorf("nil limiter refused: %v", err)
+		}
+	}
+	limiter.Release()
+}
@@ -0,0 +1,50 @@
+package main
+
+// The code in this file has to do with session tokens. A server run with
+// --session-tokens sends a secret token in the X-Session-Token header of its
+// response to the first request of a session, and requires every later
+// request to carry the token in the same header, so that knowing the session
+// id alone is not enough to inject data into the session. So that every later
+// request can have it, pipelining waits for the first response before sending
+// more. A server without --session-tokens never sends a token, and nothing
+// changes.
+//
+// The token can't be learned through the browser helper, whose protocol does
+// not pass on response headers, so the browser helper can't be used with a
+// server that has --session-tokens.
+
+import (
+	"net/http"
+	"sync"
+)
+
+// sessionToken holds the token for one session. It is safe for concurrent use,
+// and a nil *sessionToken never has a token.
+type sessionToken struct {
+	lock  sync.Mutex
+	token string
+}
+
+// Return the token, or "" if there is none yet.
+func (st *sessionToken) Get() string {
+	if st == nil {
+		return ""
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.token
+}
+
+// Remember the token from resp, if it has one.
+func (st *sessionToken) Update(resp *http.Response) {
+	if st == nil {
+		return
+	}
+	token := resp.Header.Get("X-Session-Token")
+	if token == "" {
+		return
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.token = token
+}
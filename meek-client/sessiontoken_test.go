@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSessionToken(t *testing.T) {
+	var nilToken *sessionToken
+	if nilToken.Get() != "" {
+		t.Errorf("nil token has a value")
+	}
+	nilToken.Update(&http.Response{Header: http.Header{"X-Session-Token": {"abc"}}})
+
+	st := new(sessionToken)
+	st.Update(&http.Response{})
+	if token := st.Get(); token != "" {
+		t.Errorf("token %q from a response without one", token)
+	}
+	st.Update(&http.Response{Header: http.Header{"X-Session-Token": {"abc"}}})
+	if token := st.Get(); token != "abc" {
+		t.Errorf("got %q, expected %q", token, "abc")
+	}
+	// A later response without the header doesn't erase it.
+	st.Update(&http.Response{Header: http.Header{}})
+	if token := st.Get(); token != "abc" {
+		t.Errorf("got %q after an empty response", token)
+	}
+}
+
+func TestMakeRequestSessionToken(t *testing.T) {
+	u, _ := url.Parse("https://meek.example/")
+	info := &RequestInfo{SessionID: "Y2FyZ28gdHJ1Y2s", URL: u, Token: new(sessionToken)}
+	req, err := makeRequest(context.Background(), nil, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := req.Header["X-Session-Token"]; ok {
+		t.Errorf("X-Session-Token sent before one was issued")
+	}
+
+	info.Token.Update(&http.Response{Header: http.Header{"X-Session-Token": {"abc"}}})
+	req, err = makeRequest(context.Background(), nil, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := req.Header.Get("X-Session-Token"); token != "abc" {
+		t.Errorf("got X-Session-Token %q", token)
+	}
+}
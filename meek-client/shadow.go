@@ -0,0 +1,133 @@
+package main
+
+// The code in this file implements domain shadowing (connect= and --connect).
+// With front= alone, two names are in play: the front, which is looked up in
+// DNS, connected to, and sent as the TLS SNI, and the host of url=, which goes
+// in the Host header. Some CDNs route on a third name, so that the address
+// connected to comes from yet another name. With connect=, the connection is
+// made to that name (or address) instead, while the SNI is still the front (or
+// the host of url=, if there is no front) and the Host header is still the
+// host of url=. For example, with
+//
+//	url=https://meek.example/ front=allowed.example connect=edge.cdn.example
+//
+// the client looks up and connects to edge.cdn.example, sends SNI
+// allowed.example, and sends Host meek.example.
+//
+// Connections are pooled by the SNI name, so the override is made when
+// dialing: all connections for one SNI name and port go to the same connect=
+// address, and it is an error for two sessions to want different ones.
+// connect= can't be used with --helper or a proxy, which make connections
+// themselves, or with mode=dns.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../lib/logging"
+)
+
+// connectTable maps the addresses that connections are made for (SNI name and
+// port) to the addresses to connect to instead.
+type connectTable struct {
+	lock    sync.Mutex
+	targets map[string]string
+}
+
+// The connect= overrides of all sessions so far.
+var connectOverrides = &connectTable{targets: make(map[string]string)}
+
+// Make connections for addr go to target. It is an error if they already go
+// somewhere else.
+func (t *connectTable) Set(addr, target string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if prev, ok := t.targets[addr]; ok && prev != target {
+		return fmt.Errorf("connections for %s already go to %s, not %s", addr, prev, target)
+	}
+	t.targets[addr] = target
+	return nil
+}
+
+// Return the address to connect to for addr, which is addr itself if there is
+// no override.
+func (t *connectTable) Lookup(addr string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if target, ok := t.targets[addr]; ok {
+		return target
+	}
+	return addr
+}
+
+// Parse a connect= value, a host name or IP address with an optional port,
+// into a host:port address. The port defaults to that of sniAddr.
+func parseConnectAddr(value, sniAddr string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("empty connect=")
+	}
+	host, port := value, ""
+	if h, p, err := net.SplitHostPort(value); err == nil {
+		host, port = h, p
+	} else if strings.Count(value, ":") == 1 {
+		return "", fmt.Errorf("bad connect= value %q: %s", value, err)
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" || strings.ContainsAny(host, "/@ ") {
+		return "", fmt.Errorf("bad connect= host %q", host)
+	}
+	if port == "" {
+		_, p, err := net.SplitHostPort(sniAddr)
+		if err != nil {
+			return "", err
+		}
+		port = p
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("bad connect= port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Set up connections for info to go to the connect= value, and log the three
+// names in play.
+func setupConnect(info *RequestInfo, value string) error {
+	if options.UseHelper {
+		return fmt.Errorf("cannot use connect= with --helper")
+	}
+	if options.ProxyURL != nil {
+		return fmt.Errorf("cannot use connect= with a proxy")
+	}
+	if info.Mode == modeDNS {
+		return fmt.Errorf("cannot use connect= with mode=%s", modeDNS)
+	}
+	sniAddr, err := addrForDial(info.URL)
+	if err != nil {
+		return err
+	}
+	target, err := parseConnectAddr(value, sniAddr)
+	if err != nil {
+		return err
+	}
+	if target == sniAddr {
+		return nil
+	}
+	err = connectOverrides.Set(sniAddr, target)
+	if err != nil {
+		return err
+	}
+	if strictGuard != nil {
+		// Still never a covert domain.
+		host, _, _ := net.SplitHostPort(target)
+		strictGuard.Allow(host)
+	}
+	info.Connect = target
+	host := info.Host
+	if host == "" {
+		host = info.URL.Host
+	}
+	logging.Debugf("domain shadowing: connect %s, SNI %s, Host %s", target, info.URL.Hostname(), host)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestParseConnectAddr(t *testing.T) {
+	for _, test := range []struct {
+		value, sniAddr, expected string
+	}{
+		{"edge.example", "front.example:443", "edge.example:443"},
+		{"edge.example:8443", "front.example:443", "edge.example:8443"},
+		{"edge.example:", "front.example:80", "edge.example:80"},
+		{"192.0.2.1", "front.example:443", "192.0.2.1:443"},
+		{"2001:db8::1", "front.example:443", "[2001:db8::1]:443"},
+		{"[2001:db8::1]", "front.example:443", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:8443", "front.example:443", "[2001:db8::1]:8443"},
+	} {
+		addr, err := parseConnectAddr(test.value, test.sniAddr)
+		if err != nil || addr != test.expected {
+			t.Errorf("%q → (%q, %v), expected (%q, nil)", test.value, addr, err, test.expected)
+		}
+	}
+	for _, value := range []string{"", ":443", "edge.example:http", "edge.example:0", "edge.example:70000", "user@edge.example", "edge.example/path"} {
+		if _, err := parseConnectAddr(value, "front.example:443"); err == nil {
+			t.Errorf("%q unexpectedly succeeded", value)
+		}
+	}
+}
+
+func TestConnectTable(t *testing.T) {
+	table := &connectTable{targets: make(map[string]string)}
+	if addr := table.Lookup("front.example:443"); addr != "front.example:443" {
+		t.Errorf("no override: got %q", addr)
+	}
+	if err := table.Set("front.example:443", "edge.example:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Set("front.example:443", "edge.example:443"); err != nil {
+		t.Errorf("same override again: %v", err)
+	}
+	if err := table.Set("front.example:443", "other.example:443"); err == nil {
+		t.Errorf("conflicting override accepted")
+	}
+	if addr := table.Lookup("front.example:443"); addr != "edge.example:443" {
+		t.Errorf("got %q", addr)
+	}
+}
+
+func TestMakeRequestInfoConnect(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	defer func(saved *connectTable) { connectOverrides = saved }(connectOverrides)
+	connectOverrides = &connectTable{targets: make(map[string]string)}
+	options.Pipeline = 1
+
+	info, err := makeRequestInfo(pt.Args{
+		"url":     {"https://meek.example/"},
+		"front":   {"front.example"},
+		"connect": {"edge.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Connect != "edge.example:443" || info.URL.Host != "front.example" || info.Host != "meek.example" {
+		t.Errorf("got connect %q, SNI %q, Host %q", info.Connect, info.URL.Host, info.Host)
+	}
+	if addr := connectOverrides.Lookup("front.example:443"); addr != "edge.example:443" {
+		t.Errorf("override %q", addr)
+	}
+
+	// Another session may not send the same front elsewhere.
+	_, err = makeRequestInfo(pt.Args{
+		"url":     {"https://meek.example/"},
+		"front":   {"front.example"},
+		"connect": {"other.example"},
+	})
+	if err == nil {
+		t.Errorf("conflicting connect= accepted")
+	}
+}
+
+func TestCachingDialerConnect(t *testing.T) {
+	defer func(saved *connectTable) { connectOverrides = saved }(connectOverrides)
+	connectOverrides = &connectTable{targets: make(map[string]string)}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	err = connectOverrides.Set("front.invalid:443", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &cachingDialer{dialer: &net.Dialer{}}
+	conn, err := d.DialContext(context.Background(), "tcp", "front.invalid:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(conn)
+	if buf.String() != "hello" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+// With --strict, the connect= target is checked as well as the front.
+func TestCachingDialerConnectStrict(t *testing.T) {
+	defer func(saved *connectTable) { connectOverrides = saved }(connectOverrides)
+	connectOverrides = &connectTable{targets: make(map[string]string)}
+	defer func(saved *leakGuard) { strictGuard = saved }(strictGuard)
+	var err error
+	strictGuard, err = newLeakGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strictGuard.AllowURL(&url.URL{Scheme: "https", Host: "meek.invalid"}, "front.invalid")
+
+	// The covert domain as a connect= target.
+	err = connectOverrides.Set("front.invalid:443", "meek.invalid:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &cachingDialer{dialer: &net.Dialer{}}
+	conn, err := d.DialContext(context.Background(), "tcp", "front.invalid:443")
+	if err == nil {
+		conn.Close()
+	}
+	if !errors.Is(err, errLeakBlocked) {
+		t.Errorf("connect= to the covert domain: got %v, expected %v", err, errLeakBlocked)
+	}
+}
+
+func TestValidateBridgeLineConnect(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	defer func(saved *connectTable) { connectOverrides = saved }(connectOverrides)
+	connectOverrides = &connectTable{targets: make(map[string]string)}
+	options.Pipeline = 1
+	var looked string
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		looked = host
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+
+	var buf bytes.Buffer
+	err := validateBridgeLine(&buf, "url=https://meek.example/ front=front.example connect=edge.example", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "connect:  edge.example:443") {
+		t.Errorf("report lacks connect:\n%s", buf.String())
+	}
+	if looked != "edge.example" {
+		t.Errorf("looked up %q, expected %q", looked, "edge.example")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+// The code in this file tells the local application why a SOCKS request
+// failed. A session is established with its first request before the SOCKS
+// request is granted, so that a failure can be reported with a SOCKS reply
+// code for its class, and logged with the class, instead of a granted
+// connection that then just closes. The classes and their reply codes:
+//	config   general failure (0x01): no URL, or bad SOCKS args or options
+//	blocked  not allowed (0x02): status 403, or the connection reset or
+//	         closed, as a censor would
+//	leak     not allowed (0x02): --strict refused the connection (see
+//	         strict.go)
+//	tls      network unreachable (0x03): a TLS handshake or certificate
+//	         failure
+//	dns      host unreachable (0x04): the front's name didn't resolve
+//	server   connection refused (0x05): the connection was refused, or the
+//	         server answered with another status
+//	timeout  TTL expired (0x06)
+//	error    general failure (0x01): anything else
+// The error, which is logged, has the form
+//	SOCKS request failed: class=CLASS reply=0xNN front=FRONT: ERROR
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"../lib/goptlib"
+)
+
+// How long to wait for the first request of a session before rejecting the
+// SOCKS request.
+const establishTimeout = time.Minute
+
+// Failure classes.
+const (
+	failureConfig  = "config"
+	failureBlocked = "blocked"
+	failureLeak    = "leak"
+	failureTLS     = "tls"
+	failureDNS     = "dns"
+	failureServer  = "server"
+	failureTimeout = "timeout"
+	failureError   = "error"
+)
+
+// The SOCKS reply code of each failure class.
+var failureReplies = map[string]byte{
+	failureConfig:  pt.SocksRepGeneralFailure,
+	failureBlocked: pt.SocksRepConnectionNotAllowed,
+	failureLeak:    pt.SocksRepConnectionNotAllowed,
+	failureTLS:     pt.SocksRepNetworkUnreachable,
+	failureDNS:     pt.SocksRepHostUnreachable,
+	failureServer:  pt.SocksRepConnectionRefused,
+	failureTimeout: pt.SocksRepTTLExpired,
+	failureError:   pt.SocksRepGeneralFailure,
+}
+
+// Return the failure class of err, an error from the first request of a
+// session.
+func classifyFailure(err error) string {
+	if errors.Is(err, errLeakBlocked) {
+		return failureLeak
+	}
+	var status httpStatusError
+	if errors.As(err, &status) {
+		if status == http.StatusForbidden {
+			return failureBlocked
+		}
+		return failureServer
+	}
+	switch blockSignature(err) {
+	case "reset", "eof":
+		return failureBlocked
+	case "certificate", "tls":
+		return failureTLS
+	case "dns":
+		return failureDNS
+	case "refused":
+		return failureServer
+	case "timeout":
+		return failureTimeout
+	default:
+		return failureError
+	}
+}
+
+// Send the first request of a session, an empty poll, and return the body of
+// the response, to be written to the local connection once the SOCKS request
+// is granted. Only sessions in poll mode without pipelining are established
+// this way; for others, it returns nil at once, and failures show up only
+// after the grant.
+func establishSession(info *RequestInfo) ([]byte, error) {
+	if info.Mode != modePoll || info.Pipeline > 1 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), establishTimeout)
+	defer cancel()
+	var buf bytes.Buffer
+	_, err := sendRecv(ctx, nil, &buf, info, 1)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reject conn with the reply code for err, and return an error that describes
+// the failure. info is nil if the failure came before there was one, which
+// makes it a configuration failure.
+func rejectSOCKS(conn *pt.SocksConn, info *RequestInfo, err error) error {
+	class := failureConfig
+	front := ""
+	if info != nil {
+		class = classifyFailure(err)
+		front = info.URL.Host
+	}
+	reply := failureReplies[class]
+	conn.RejectReason(reply)
+	return fmt.Errorf("SOCKS request failed: class=%s reply=0x%02x front=%s: %w", class, reply, front, err)
+}
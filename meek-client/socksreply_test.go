@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class string
+	}{
+		{httpStatusError(http.StatusForbidden), failureBlocked},
+		{fmt.Errorf("wrapped: %w", httpStatusError(http.StatusBadGateway)), failureServer},
+		{&net.DNSError{Err: "no such host", Name: "front.example"}, failureDNS},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, failureBlocked},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, failureServer},
+		{context.DeadlineExceeded, failureTimeout},
+		{io.ErrUnexpectedEOF, failureBlocked},
+		{errors.New("remote error: tls: handshake failure"), failureTLS},
+		{fmt.Errorf("wrapped: %w", errLeakBlocked), failureLeak},
+		{errors.New("something else"), failureError},
+	} {
+		if class := classifyFailure(test.err); class != test.class {
+			t.Errorf("%v: got %s, expected %s", test.err, class, test.class)
+		}
+	}
+}
+
+// Run handleSOCKS for a request with args, and return the SOCKS reply code,
+// and what the connection gets after the reply.
+func runHandleSOCKS(t *testing.T, args pt.Args) (byte, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- handleSOCKS(&pt.SocksConn{Conn: remote, Req: pt.SocksRequest{Args: args}}, newClientListener("test", nil))
+	}()
+
+	// A SOCKS5 reply with an IPv4 address is 10 bytes long.
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(local, reply); err != nil {
+		t.Fatal(err)
+	}
+	var after []byte
+	if reply[1] == 0 {
+		after = make([]byte, 5)
+		io.ReadFull(local, after)
+		local.Close()
+	}
+	return reply[1], string(after), <-errChan
+}
+
+// handleSOCKS grants a request once the session's first request succeeds, and
+// rejects it with a reply code for the failure otherwise.
+func TestHandleSOCKSReply(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.Pipeline = 1
+
+	status := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusOK && req.Header.Get("X-Session-Close") == "" {
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	reply, _, err := runHandleSOCKS(t, pt.Args{"url": {server.URL}})
+	if reply != pt.SocksRepConnectionNotAllowed || err == nil {
+		t.Errorf("403: reply %#x, %v", reply, err)
+	}
+
+	reply, _, err = runHandleSOCKS(t, pt.Args{"mode": {"carrier pigeon"}, "url": {server.URL}})
+	if reply != pt.SocksRepGeneralFailure || err == nil {
+		t.Errorf("bad mode: reply %#x, %v", reply, err)
+	}
+
+	status = http.StatusOK
+	reply, after, err := runHandleSOCKS(t, pt.Args{"url": {server.URL}})
+	if reply != 0 || after != "hello" || err != nil {
+		t.Errorf("200: reply %#x, %q, %v", reply, after, err)
+	}
+
+	server.Close()
+	httpRoundTripper.CloseIdleConnections()
+	reply, _, err = runHandleSOCKS(t, pt.Args{"url": {"http://" + u.Host + "/"}})
+	if reply != pt.SocksRepConnectionRefused || err == nil {
+		t.Errorf("closed server: reply %#x, %v", reply, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+// The code in this file implements fail-closed leak protection (--strict).
+// Normally, a mistake in configuration, or a bug, could make the client
+// connect somewhere it shouldn't: to the covert domain (the host of url= when
+// there is a front), which also means a system DNS lookup of that name, or
+// directly to a front when there is a proxy that everything should go through.
+// In strict mode, every outgoing connection is checked before it is made, and
+// before its name is resolved. Only these are allowed:
+//	- with a proxy, the proxy, and nothing else
+//	- otherwise, the fronts (front= SOCKS args, --front, the bridge list, and
+//	  --endpoints-file), the host of url= when there is no front, the
+//	  connect= targets of domain shadowing (see shadow.go), and the DoH
+//	  resolver of mode=dns
+// With domain shadowing, both the front and the connect= target that the
+// connection actually goes to are checked.
+// A connection to anything else fails, which fails the SOCKS request that
+// wanted it with failure class "leak" (see socksreply.go), and is logged at
+// warn level as
+//	leak blocked: connection to ADDR: REASON
+// so that the log is an audit of attempted leaks. The number blocked is logged
+// again at exit. A host that is the covert domain of any session is never
+// allowed, even if it is a front elsewhere. Strict mode can't be used with
+// --helper, because the browser makes its own connections.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"../lib/logging"
+)
+
+// The error of a connection that --strict refused.
+var errLeakBlocked = errors.New("connection refused by --strict")
+
+// leakGuard decides which outgoing connections are allowed in strict mode.
+type leakGuard struct {
+	// The address of the proxy, if there is one.
+	proxyAddr string
+
+	lock sync.Mutex
+	// Hosts that may be connected to directly.
+	allowed map[string]bool
+	// Covert domains, never connected to.
+	covert  map[string]bool
+	blocked int
+}
+
+// The leakGuard for --strict, or nil if it was not given. Set up in main.
+var strictGuard *leakGuard
+
+// Make a leakGuard that allows only connections to proxyURL, if it is not nil.
+func newLeakGuard(proxyURL *url.URL) (*leakGuard, error) {
+	g := &leakGuard{
+		allowed: make(map[string]bool),
+		covert:  make(map[string]bool),
+	}
+	if proxyURL != nil {
+		addr, err := addrForDial(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		g.proxyAddr = strings.ToLower(addr)
+	}
+	return g, nil
+}
+
+// Allow direct connections to host, a host name or IP address.
+func (g *leakGuard) Allow(host string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.allowed[strings.ToLower(host)] = true
+}
+
+// Never allow connections to host, a covert domain.
+func (g *leakGuard) AddCovert(host string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.covert[strings.ToLower(host)] = true
+}
+
+// Allow connections for a URL that is sent to front (or to its own host, if
+// front is empty).
+func (g *leakGuard) AllowURL(u *url.URL, front string) {
+	if front == "" {
+		g.Allow(u.Hostname())
+		return
+	}
+	g.AddCovert(u.Hostname())
+	// front may have a port.
+	if host, _, err := net.SplitHostPort(front); err == nil {
+		front = host
+	}
+	g.Allow(front)
+}
+
+// Return the reason a connection to addr, a host:port address, is not
+// allowed, or "" if it is.
+func (g *leakGuard) reason(addr string) string {
+	addr = strings.ToLower(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "not a host:port address"
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	switch {
+	case g.covert[host]:
+		return "covert domain"
+	case g.proxyAddr != "" && addr != g.proxyAddr:
+		return "not the proxy " + g.proxyAddr
+	case g.proxyAddr != "":
+		return ""
+	case !g.allowed[host]:
+		return "not a configured front"
+	}
+	return ""
+}
+
+// Return an error wrapping errLeakBlocked if a connection to addr is not
+// allowed, and log the attempt.
+func (g *leakGuard) Check(addr string) error {
+	reason := g.reason(addr)
+	if reason == "" {
+		return nil
+	}
+	g.lock.Lock()
+	g.blocked++
+	g.lock.Unlock()
+	logging.Warnf("leak blocked: connection to %s: %s", addr, reason)
+	return fmt.Errorf("%w: %s: %s", errLeakBlocked, addr, reason)
+}
+
+// Return how many connections have been blocked.
+func (g *leakGuard) Blocked() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.blocked
+}
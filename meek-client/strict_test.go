@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestLeakGuard(t *testing.T) {
+	g, err := newLeakGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.AllowURL(&url.URL{Scheme: "https", Host: "meek.example"}, "Front.example")
+	g.AllowURL(&url.URL{Scheme: "https", Host: "direct.example:8443"}, "")
+	g.AllowURL(&url.URL{Scheme: "https", Host: "other.example"}, "192.0.2.1:443")
+	for _, test := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"front.example:443", true},
+		{"FRONT.example:80", true},
+		{"direct.example:8443", true},
+		{"192.0.2.1:443", true},
+		{"meek.example:443", false},
+		{"other.example:443", false},
+		{"unknown.example:443", false},
+		{"front.example", false},
+	} {
+		err := g.Check(test.addr)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+		} else if !test.ok && !errors.Is(err, errLeakBlocked) {
+			t.Errorf("%s: got %v, expected %v", test.addr, err, errLeakBlocked)
+		}
+	}
+	if n := g.Blocked(); n != 4 {
+		t.Errorf("blocked %d, expected 4", n)
+	}
+
+	// A covert domain stays blocked even if it is a front elsewhere.
+	g.AllowURL(&url.URL{Scheme: "https", Host: "front2.example"}, "meek.example")
+	if err := g.Check("meek.example:443"); err == nil {
+		t.Errorf("covert domain allowed as a front")
+	}
+}
+
+func TestLeakGuardProxy(t *testing.T) {
+	proxyURL, _ := url.Parse("socks5://proxy.example:1080")
+	g, err := newLeakGuard(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.AllowURL(&url.URL{Scheme: "https", Host: "meek.example"}, "front.example")
+	if err := g.Check("proxy.example:1080"); err != nil {
+		t.Errorf("proxy: %v", err)
+	}
+	for _, addr := range []string{"front.example:443", "proxy.example:1081", "meek.example:443"} {
+		if err := g.Check(addr); !errors.Is(err, errLeakBlocked) {
+			t.Errorf("%s: got %v, expected %v", addr, err, errLeakBlocked)
+		}
+	}
+}
+
+// A SOCKS request whose connection --strict refuses is rejected with class
+// leak.
+func TestHandleSOCKSStrict(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.Pipeline = 1
+	defer func(saved *leakGuard) { strictGuard = saved }(strictGuard)
+	defer func(saved func(ctx context.Context, network, addr string) (net.Conn, error)) {
+		httpRoundTripper.DialContext = saved
+	}(httpRoundTripper.DialContext)
+	httpRoundTripper.DialContext = outbound.DialContext
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Session-Close") == "" {
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer server.Close()
+
+	strictGuard, _ = newLeakGuard(nil)
+	reply, _, err := runHandleSOCKS(t, pt.Args{"url": {server.URL}})
+	if reply != 0 || err != nil {
+		t.Errorf("allowed: reply %#x, %v", reply, err)
+	}
+
+	// Everything must go through a proxy, which this doesn't.
+	proxyURL, _ := url.Parse("http://127.0.0.1:1/")
+	strictGuard, _ = newLeakGuard(proxyURL)
+	httpRoundTripper.CloseIdleConnections()
+	reply, _, err = runHandleSOCKS(t, pt.Args{"url": {server.URL}})
+	if reply != pt.SocksRepConnectionNotAllowed || !errors.Is(err, errLeakBlocked) {
+		t.Errorf("blocked: reply %#x, %v", reply, err)
+	}
+	if strictGuard.Blocked() != 1 {
+		t.Errorf("blocked %d, expected 1", strictGuard.Blocked())
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// The code in this file implements browser-like timing of polls
+// (--timing=browser). With the default polling backoff, an idle session polls
+// on a smooth, mechanical curve: 100 ms, 150 ms, 225 ms, and so on up to 5 s,
+// forever. A browser on a page that polls for updates looks different: a burst
+// of requests close together, then a pause while the user reads (a "think
+// time"), then another burst. The timing model imitates that. Think times have
+// a log-normal distribution, as measured in recorded browsing sessions, and the
+// number of requests in a burst is geometric. A burst starts over whenever
+// data is sent or received, as with a page load.
+//
+// Only empty polls are timed by the model; data to send is still sent at once,
+// and a poll hint or X-More-Data from the server (see pollhint.go) takes the
+// place of the model's guess just as it does that of the backoff.
+//
+// A diurnal hook can stretch or shrink think times by the time of day, as
+// browsing is slower at night. With --timing-diurnal, defaultDiurnal is used.
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	timingBackoff = "backoff"
+	timingBrowser = "browser"
+)
+
+// timingModel describes the timing of polls in an idle session.
+type timingModel struct {
+	// The mean number of polls in a burst.
+	BurstMean float64
+	// Polls in a burst are a random time up to this long apart.
+	BurstGap time.Duration
+	// The median and shape of the log-normal think time.
+	ThinkMedian time.Duration
+	ThinkSigma  float64
+	// The longest think time, which must be well within the server's
+	// session timeout.
+	MaxThink time.Duration
+	// Returns a factor to multiply think times by at the given time, or
+	// nil for none.
+	Diurnal func(t time.Time) float64
+}
+
+// The model for --timing=browser.
+var browserTimingModel = timingModel{
+	BurstMean:   4,
+	BurstGap:    400 * time.Millisecond,
+	ThinkMedian: 3 * time.Second,
+	ThinkSigma:  0.9,
+	MaxThink:    30 * time.Second,
+}
+
+// Factors for think times by hour of the local day, slowest in the early
+// morning.
+var diurnalFactors = [24]float64{
+	1.6, 1.8, 2.0, 2.0, 1.9, 1.7, 1.4, 1.2, 1.0, 0.9, 0.9, 0.9,
+	1.0, 0.9, 0.9, 0.9, 0.9, 1.0, 1.0, 0.9, 0.9, 1.0, 1.2, 1.4,
+}
+
+// The diurnal hook for --timing-diurnal, interpolating diurnalFactors by the
+// minute.
+func defaultDiurnal(t time.Time) float64 {
+	h := t.Hour()
+	frac := float64(t.Minute()) / 60
+	return diurnalFactors[h]*(1-frac) + diurnalFactors[(h+1)%24]*frac
+}
+
+// Check a --timing value and return the model for it, or nil for the backoff.
+func parseTiming(s string, diurnal bool) (*timingModel, error) {
+	switch s {
+	case timingBackoff:
+		if diurnal {
+			return nil, fmt.Errorf("--timing-diurnal requires --timing=%s", timingBrowser)
+		}
+		return nil, nil
+	case timingBrowser:
+		model := browserTimingModel
+		if diurnal {
+			model.Diurnal = defaultDiurnal
+		}
+		return &model, nil
+	default:
+		return nil, fmt.Errorf("unknown timing %q (known timings are %s, %s)", s, timingBackoff, timingBrowser)
+	}
+}
+
+// Return a random number of polls in a burst, at least 1.
+func (model *timingModel) burstLength(r *rand.Rand) int {
+	if model.BurstMean <= 1 {
+		return 1
+	}
+	// Geometric with mean BurstMean.
+	p := 1 / model.BurstMean
+	return 1 + int(math.Log(1-r.Float64())/math.Log(1-p))
+}
+
+// Return a random think time at now.
+func (model *timingModel) thinkTime(r *rand.Rand, now time.Time) time.Duration {
+	d := float64(model.ThinkMedian) * math.Exp(model.ThinkSigma*r.NormFloat64())
+	if model.Diurnal != nil {
+		d *= model.Diurnal(now)
+	}
+	if d > float64(model.MaxThink) {
+		return model.MaxThink
+	}
+	return time.Duration(d)
+}
+
+// timingShaper is the timing state of one session. It is safe for concurrent
+// use.
+type timingShaper struct {
+	model *timingModel
+	lock  sync.Mutex
+	r     *rand.Rand
+	// Polls left in the current burst.
+	left int
+}
+
+// Make a timingShaper for a new session, or nil if model is nil.
+func newTimingShaper(model *timingModel) *timingShaper {
+	if model == nil {
+		return nil
+	}
+	return &timingShaper{
+		model: model,
+		r:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Return how long to wait before the next poll. active says whether the last
+// request sent or received any data, which starts a new burst.
+func (ts *timingShaper) Next(active bool) time.Duration {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if active {
+		ts.left = ts.model.burstLength(ts.r)
+		return 0
+	}
+	if ts.left > 0 {
+		ts.left--
+		return time.Duration(ts.r.Int63n(int64(ts.model.BurstGap) + 1))
+	}
+	// This poll is the first of a new burst.
+	ts.left = ts.model.burstLength(ts.r) - 1
+	return ts.model.thinkTime(ts.r, time.Now())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseTiming(t *testing.T) {
+	model, err := parseTiming(timingBackoff, false)
+	if err != nil || model != nil {
+		t.Errorf("backoff → (%v, %v), expected (nil, nil)", model, err)
+	}
+	model, err = parseTiming(timingBrowser, false)
+	if err != nil || model == nil || model.Diurnal != nil {
+		t.Errorf("browser → (%+v, %v)", model, err)
+	}
+	model, err = parseTiming(timingBrowser, true)
+	if err != nil || model == nil || model.Diurnal == nil {
+		t.Errorf("browser with diurnal → (%+v, %v)", model, err)
+	}
+	// The returned model is a copy.
+	if browserTimingModel.Diurnal != nil {
+		t.Errorf("browserTimingModel was changed")
+	}
+	for _, test := range []struct {
+		s       string
+		diurnal bool
+	}{
+		{"", false},
+		{"Browser", false},
+		{timingBackoff, true},
+	} {
+		_, err := parseTiming(test.s, test.diurnal)
+		if err == nil {
+			t.Errorf("%q, %v unexpectedly succeeded", test.s, test.diurnal)
+		}
+	}
+}
+
+func TestTimingModelBurstLength(t *testing.T) {
+	model := &timingModel{BurstMean: 4}
+	r := rand.New(rand.NewSource(1))
+	total := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		length := model.burstLength(r)
+		if length < 1 {
+			t.Fatalf("burst of %d", length)
+		}
+		total += length
+	}
+	if mean := float64(total) / n; mean < 3.5 || mean > 4.5 {
+		t.Errorf("mean burst length %.2f, expected about 4", mean)
+	}
+	if length := (&timingModel{BurstMean: 0}).burstLength(r); length != 1 {
+		t.Errorf("BurstMean 0: burst of %d", length)
+	}
+}
+
+func TestTimingModelThinkTime(t *testing.T) {
+	model := browserTimingModel
+	r := rand.New(rand.NewSource(1))
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	var below int
+	const n = 10000
+	for i := 0; i < n; i++ {
+		d := model.thinkTime(r, now)
+		if d <= 0 || d > model.MaxThink {
+			t.Fatalf("think time %v", d)
+		}
+		if d < model.ThinkMedian {
+			below++
+		}
+	}
+	if frac := float64(below) / n; frac < 0.45 || frac > 0.55 {
+		t.Errorf("%.2f of think times below the median", frac)
+	}
+
+	model.Diurnal = func(time.Time) float64 { return 100 }
+	if d := model.thinkTime(r, now); d != model.MaxThink {
+		t.Errorf("stretched think time %v, expected %v", d, model.MaxThink)
+	}
+}
+
+func TestDefaultDiurnal(t *testing.T) {
+	for h := 0; h < 24; h++ {
+		for _, m := range []int{0, 30, 59} {
+			f := defaultDiurnal(time.Date(2020, 1, 1, h, m, 0, 0, time.Local))
+			if f < 0.5 || f > 2.5 {
+				t.Errorf("%02d:%02d: factor %.2f", h, m, f)
+			}
+		}
+	}
+	night := defaultDiurnal(time.Date(2020, 1, 1, 3, 0, 0, 0, time.Local))
+	day := defaultDiurnal(time.Date(2020, 1, 1, 15, 0, 0, 0, time.Local))
+	if night <= day {
+		t.Errorf("night factor %.2f, day factor %.2f", night, day)
+	}
+}
+
+func TestTimingShaper(t *testing.T) {
+	if ts := newTimingShaper(nil); ts != nil {
+		t.Errorf("nil model gave %v", ts)
+	}
+	model := &timingModel{
+		BurstMean:   3,
+		BurstGap:    100 * time.Millisecond,
+		ThinkMedian: 5 * time.Second,
+		MaxThink:    5 * time.Second,
+	}
+	ts := newTimingShaper(model)
+	ts.r = rand.New(rand.NewSource(1))
+	if d := ts.Next(true); d != 0 {
+		t.Errorf("after data: %v", d)
+	}
+	// The polls left in the burst are close together, and then comes a
+	// think time.
+	for i := 0; ; i++ {
+		d := ts.Next(false)
+		if d == model.ThinkMedian {
+			if i == 0 {
+				t.Errorf("no polls in burst")
+			}
+			break
+		}
+		if d > model.BurstGap {
+			t.Fatalf("poll %d of burst after %v", i, d)
+		}
+	}
+	// Data starts a new burst at once.
+	if d := ts.Next(true); d != 0 {
+		t.Errorf("after data: %v", d)
+	}
+}
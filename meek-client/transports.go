@@ -0,0 +1,111 @@
+package main
+
+// The code in this file lets one meek-client process serve several transport
+// method names (--transport), such as meek and meek_lite, or one per CDN, each
+// with arguments of its own. tor asks for methods by name, and every name
+// registered here gets its own SOCKS listener. A method's arguments are
+// default SOCKS args: they are used for the keys that a connection's own SOCKS
+// args (those of its bridge line) don't set. ptMethodName is always served,
+// without arguments unless a --transport gives it some.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"../lib/goptlib"
+)
+
+// A transport method name, as the pluggable transport spec allows them.
+var methodNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// transportSpec is one --transport method name and its default SOCKS args.
+type transportSpec struct {
+	Name string
+	Args pt.Args
+}
+
+// Parse a --transport value of the form "NAME" or "NAME:ARGS", where ARGS are
+// semicolon-separated key=value bridge line arguments, like
+// "meek_lite:url=https://meek.example.com/;front=cdn.example.net".
+func parseTransportSpec(s string) (transportSpec, error) {
+	name, rest, _ := strings.Cut(s, ":")
+	if !methodNameRegexp.MatchString(name) {
+		return transportSpec{}, fmt.Errorf("%q is not a valid method name", name)
+	}
+	args, err := parseDefaultArgs(rest)
+	if err != nil {
+		return transportSpec{}, fmt.Errorf("%s: %s", name, err)
+	}
+	return transportSpec{Name: name, Args: args}, nil
+}
+
+// Parse semicolon-separated key=value bridge line arguments, which may be "".
+func parseDefaultArgs(s string) (pt.Args, error) {
+	words := strings.Split(s, ";")
+	for _, word := range words {
+		if strings.ContainsAny(word, " \t") {
+			return nil, fmt.Errorf("%q contains a space", word)
+		}
+	}
+	if s != "" && !strings.Contains(words[0], "=") {
+		return nil, fmt.Errorf("%q is not a key=value argument", words[0])
+	}
+	args, err := parseBridgeArgs(strings.Join(words, " "))
+	if err != nil {
+		return nil, err
+	}
+	return args, checkKnownBridgeArgs(args)
+}
+
+type transportFlag []transportSpec
+
+func (f *transportFlag) String() string {
+	names := make([]string, len(*f))
+	for i, spec := range *f {
+		names[i] = spec.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *transportFlag) Set(s string) error {
+	spec, err := parseTransportSpec(s)
+	if err != nil {
+		return err
+	}
+	for _, other := range *f {
+		if other.Name == spec.Name {
+			return fmt.Errorf("method name %q appears more than once", spec.Name)
+		}
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// Return the default SOCKS args of each method name to serve: those of specs,
+// and ptMethodName.
+func transportMethods(specs []transportSpec) map[string]pt.Args {
+	methods := map[string]pt.Args{ptMethodName: {}}
+	for _, spec := range specs {
+		methods[spec.Name] = spec.Args
+	}
+	return methods
+}
+
+// Return args with the values of defaults added for the keys that args
+// doesn't have.
+func mergeTransportArgs(args, defaults pt.Args) pt.Args {
+	if len(defaults) == 0 {
+		return args
+	}
+	merged := make(pt.Args)
+	for key, values := range args {
+		merged[key] = values
+	}
+	for key, values := range defaults {
+		if _, ok := merged[key]; !ok {
+			merged[key] = values
+		}
+	}
+	return merged
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"../lib/goptlib"
+)
+
+func TestParseTransportSpec(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected transportSpec
+	}{
+		{"meek_lite", transportSpec{"meek_lite", pt.Args{}}},
+		{"meek_lite:", transportSpec{"meek_lite", pt.Args{}}},
+		{"meek_cdn2:url=https://meek.example.com/;front=cdn.example.net", transportSpec{"meek_cdn2", pt.Args{
+			"url":   []string{"https://meek.example.com/"},
+			"front": []string{"cdn.example.net"},
+		}}},
+		{"meek:mode=ws;", transportSpec{"meek", pt.Args{"mode": []string{"ws"}}}},
+	} {
+		spec, err := parseTransportSpec(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec, test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.input, spec, test.expected)
+		}
+	}
+	for _, input := range []string{
+		"",
+		":url=https://meek.example.com/",
+		"meek-lite",
+		"1meek",
+		"meek_lite:https://meek.example.com/",
+		"meek_lite:url=https://meek.example.com/;https://other.example.com/",
+		"meek_lite:url=https://meek.example.com/;url=https://other.example.com/",
+		"meek_lite:url=https://meek.example.com/ front=cdn.example.net",
+		"meek_lite:bogus=1",
+	} {
+		if _, err := parseTransportSpec(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestTransportFlag(t *testing.T) {
+	var f transportFlag
+	if err := f.Set("meek_lite:front=cdn.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("meek_cdn2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("meek_lite"); err == nil {
+		t.Errorf("repeated method name: no error")
+	}
+	if f.String() != "meek_lite,meek_cdn2" {
+		t.Errorf("String() = %q", f.String())
+	}
+
+	methods := transportMethods(f)
+	if len(methods) != 3 {
+		t.Errorf("methods %v", methods)
+	}
+	if args, ok := methods[ptMethodName]; !ok || len(args) != 0 {
+		t.Errorf("%s: %v, %v", ptMethodName, args, ok)
+	}
+	if value, _ := methods["meek_lite"].Get("front"); value != "cdn.example.net" {
+		t.Errorf("meek_lite front=%q", value)
+	}
+}
+
+func TestMergeTransportArgs(t *testing.T) {
+	defaults := pt.Args{
+		"url":   []string{"https://meek.example.com/"},
+		"front": []string{"cdn.example.net"},
+	}
+	args := pt.Args{"front": []string{"other.example.net"}}
+	merged := mergeTransportArgs(args, defaults)
+	expected := pt.Args{
+		"url":   []string{"https://meek.example.com/"},
+		"front": []string{"other.example.net"},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("got %v, expected %v", merged, expected)
+	}
+	// The connection's own args are not changed.
+	if len(args) != 1 {
+		t.Errorf("args changed: %v", args)
+	}
+	if merged := mergeTransportArgs(args, pt.Args{}); !reflect.DeepEqual(merged, args) {
+		t.Errorf("no defaults: got %v", merged)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+// The code in this file implements tunnel mode (--tunnel), in which
+// meek-client is used on its own, without tor, to expose remote TCP services
+// as local ports. Each connection to a local port gets its own meek session.
+// At the start of the session we ask the server to connect to the configured
+// remote address with a SOCKS5 CONNECT, which is answered by meek-server's
+// built-in SOCKS service (i.e., when it is run without --external-service).
+// After that, the session carries the connection's data.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"../lib/logging"
+)
+
+// tunnelSpec is one --tunnel mapping of a local listening address to a
+// remote address.
+type tunnelSpec struct {
+	Local  string
+	Remote string
+}
+
+// Parse a --tunnel value of the form "LOCAL=REMOTE". LOCAL may be a bare port
+// number, meaning that port on 127.0.0.1.
+func parseTunnelSpec(s string) (tunnelSpec, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return tunnelSpec{}, fmt.Errorf("tunnel %q is not of the form LOCAL=REMOTE", s)
+	}
+	local := parts[0]
+	if !strings.Contains(local, ":") {
+		_, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return tunnelSpec{}, fmt.Errorf("tunnel %q: bad local port %q", s, local)
+		}
+		local = net.JoinHostPort("127.0.0.1", local)
+	}
+	for _, addr := range []string{local, parts[1]} {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return tunnelSpec{}, fmt.Errorf("tunnel %q: %s", s, err)
+		}
+	}
+	return tunnelSpec{Local: local, Remote: parts[1]}, nil
+}
+
+// tunnelFlag is a flag.Value that collects repeated --tunnel options.
+type tunnelFlag []tunnelSpec
+
+func (f *tunnelFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, spec := range *f {
+		specs[i] = spec.Local + "=" + spec.Remote
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *tunnelFlag) Set(s string) error {
+	spec, err := parseTunnelSpec(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// connDialer is a proxy.Dialer that "dials" by returning a connection that
+// already exists.
+type connDialer struct {
+	conn net.Conn
+}
+
+func (d connDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// Carry conn to remote over a new meek session.
+func handleTunnel(conn net.Conn, remote string) error {
+	defer conn.Close()
+
+	err := sessionSlots.Acquire()
+	if err != nil {
+		return err
+	}
+	defer sessionSlots.Release()
+
+	info, err := makeRequestInfo(nil)
+	if err != nil {
+		return err
+	}
+
+	// copyLoop carries whatever is written to one end of the pipe over the
+	// meek session. We speak SOCKS on the other end.
+	local, meekEnd := net.Pipe()
+	loopErr := make(chan error, 1)
+	go func() {
+		err := copyLoop(meekEnd, info)
+		meekEnd.Close()
+		loopErr <- err
+	}()
+	defer func() {
+		local.Close()
+		err := <-loopErr
+		if err != nil {
+			logging.Warnf("tunnel to %s: %s", remote, err)
+		}
+	}()
+
+	dialer, err := proxy.SOCKS5("tcp", "meek", nil, connDialer{local})
+	if err != nil {
+		return err
+	}
+	stream, err := dialer.Dial("tcp", remote)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	// A meek session has no way to pass on a half-close: stream is one end
+	// of a net.Pipe, and closing it ends the session. So when the local
+	// client is done sending, the remote side isn't told, and the session
+	// stays open for the rest of the response until the remote side closes
+	// it. A remote service that waits for EOF before answering will wait
+	// until the local client closes the connection entirely. When the
+	// remote side is done, the local client gets a half-close, and may go
+	// on sending until it closes too.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stream, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, stream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+	return nil
+}
+
+// Close conn for writing, or close it entirely if it can't be half-closed.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// Accept connections on ln and tunnel each one to remote.
+func acceptTunnel(ln net.Listener, remote string) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				logging.Warnf("error in Accept: %s", err)
+				continue
+			}
+			return err
+		}
+		go func() {
+			err := handleTunnel(conn, remote)
+			if err != nil {
+				logging.Warnf("error in tunnel to %s: %s", remote, err)
+			}
+		}()
+	}
+}
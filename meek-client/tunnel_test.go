@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTunnelSpec(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected tunnelSpec
+	}{
+		{"8080=10.0.0.5:80", tunnelSpec{"127.0.0.1:8080", "10.0.0.5:80"}},
+		{"0.0.0.0:2222=internal.example:22", tunnelSpec{"0.0.0.0:2222", "internal.example:22"}},
+		{"[::1]:53=[2001:db8::1]:53", tunnelSpec{"[::1]:53", "[2001:db8::1]:53"}},
+	} {
+		spec, err := parseTunnelSpec(test.input)
+		if err != nil || spec != test.expected {
+			t.Errorf("%q → (%+v, %v), expected %+v", test.input, spec, err, test.expected)
+		}
+	}
+	for _, input := range []string{
+		"",
+		"8080",
+		"8080=",
+		"=10.0.0.5:80",
+		"8080=10.0.0.5",
+		"localhost=10.0.0.5:80",
+	} {
+		_, err := parseTunnelSpec(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+// Answer one SOCKS5 CONNECT on conn, report the requested destination on
+// dest, and then echo.
+func serveFakeSOCKS(conn net.Conn, dest chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, hdr[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	var req [5]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil || req[3] != 3 {
+		return
+	}
+	name := make([]byte, req[4]+2)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(name[len(name)-2:])
+	dest <- net.JoinHostPort(string(name[:len(name)-2]), strconv.Itoa(int(port)))
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	io.Copy(conn, r)
+}
+
+// A minimal imitation of meek-server whose backend is serveFakeSOCKS.
+func newFakeMeekServer(dest chan<- string) *httptest.Server {
+	var lock sync.Mutex
+	sessions := make(map[string]net.Conn)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Session-Id")
+		lock.Lock()
+		conn := sessions[id]
+		if conn == nil {
+			var backend net.Conn
+			conn, backend = net.Pipe()
+			go serveFakeSOCKS(backend, dest)
+			sessions[id] = conn
+		}
+		lock.Unlock()
+		if _, err := io.Copy(conn, req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf := make([]byte, maxPayloadLength)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, _ := conn.Read(buf)
+		w.Write(buf[:n])
+	}))
+}
+
+func TestHandleTunnel(t *testing.T) {
+	dest := make(chan string, 1)
+	server := newFakeMeekServer(dest)
+	defer server.Close()
+
+	savedURL, savedPipeline := options.URL, options.Pipeline
+	defer func() { options.URL, options.Pipeline = savedURL, savedPipeline }()
+	options.URL = server.URL
+	options.Pipeline = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptTunnel(ln, "service.example:7000")
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got (%q, %v)", buf, err)
+	}
+	if d := <-dest; d != "service.example:7000" {
+		t.Errorf("server was asked to connect to %q", d)
+	}
+}
+
+// A client that half-closes its connection after sending its request still
+// gets the whole response.
+func TestHandleTunnelHalfClose(t *testing.T) {
+	dest := make(chan string, 1)
+	server := newFakeMeekServer(dest)
+	defer server.Close()
+
+	savedURL, savedPipeline := options.URL, options.Pipeline
+	defer func() { options.URL, options.Pipeline = savedURL, savedPipeline }()
+	options.URL = server.URL
+	options.Pipeline = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptTunnel(ln, "service.example:7000")
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	request := []byte("hello, and goodbye")
+	_, err = conn.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(request))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != string(request) {
+		t.Fatalf("got (%q, %v)", buf, err)
+	}
+	<-dest
+}
+
+// closeWrite half-closes a TCP connection, and closes one that can't be
+// half-closed.
+func TestCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	closeWrite(conn)
+	if n, err := peer.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("after half-close, peer read (%d, %v)", n, err)
+	}
+	peer.Write([]byte("x"))
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Errorf("reading after half-close: %v", err)
+	}
+
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	closeWrite(p1)
+	if _, err := p1.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("pipe not closed: %v", err)
+	}
+}
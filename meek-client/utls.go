@@ -69,11 +69,16 @@ func addrForDial(url *url.URL) (string, error) {
 
 // Analogous to tls.Dial. Connect to the given address and initiate a TLS
 // handshake using the given ClientHelloID, returning the resulting connection.
-func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer) (*utls.UConn, error) {
+// If http1 is true, the ALPN extension offers only "http/1.1", whatever the
+// ClientHelloID would otherwise offer.
+func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer, http1 bool) (*utls.UConn, error) {
 	conn, err := forward.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
+	if cfg == nil {
+		cfg = newUTLSConfig()
+	}
 	uconn := utls.UClient(conn, cfg, *clientHelloID)
 	if cfg == nil || cfg.ServerName == "" {
 		serverName, _, err := net.SplitHostPort(addr)
@@ -82,6 +87,13 @@ func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.Client
 		}
 		uconn.SetSNI(serverName)
 	}
+	if http1 {
+		err = forceHTTP1ALPN(uconn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	err = uconn.Handshake()
 	if err != nil {
 		return nil, err
@@ -89,6 +101,21 @@ func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.Client
 	return uconn, nil
 }
 
+// Rewrite the ALPN extension of uconn's Client Hello to offer only "http/1.1".
+// The rest of the fingerprint is unchanged.
+func forceHTTP1ALPN(uconn *utls.UConn) error {
+	err := uconn.BuildHandshakeState()
+	if err != nil {
+		return err
+	}
+	for _, ext := range uconn.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+	return uconn.MarshalClientHello()
+}
+
 // A http.RoundTripper that uses uTLS (with a specified Client Hello ID) to make
 // TLS connections.
 //
@@ -100,6 +127,9 @@ type UTLSRoundTripper struct {
 	rtLock        sync.Mutex
 	rt            http.RoundTripper
 
+	// Offer only HTTP/1.1 in ALPN, never HTTP/2.
+	http1 bool
+
 	// Transport for HTTP requests, which don't use uTLS.
 	httpRT *http.Transport
 }
@@ -119,7 +149,7 @@ func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	if rt.rt == nil {
 		// On the first call, make an http.Transport or http2.Transport
 		// as appropriate.
-		rt.rt, err = makeRoundTripper(req.URL, rt.clientHelloID, rt.config, rt.proxyDialer)
+		rt.rt, err = makeRoundTripper(req.URL, rt.clientHelloID, rt.config, rt.proxyDialer, rt.http1)
 	}
 	rt.rtLock.Unlock()
 	if err != nil {
@@ -130,12 +160,14 @@ func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	return rt.rt.RoundTrip(req)
 }
 
-// Unlike when using the native Go net/http (whose built-in proxy support we can
-// use by setting Proxy on an http.Transport), and unlike when using the browser
-// helper (the browser has its own proxy support), when using uTLS we have to
-// craft our own proxy connections.
+// Unlike when using the browser helper (the browser has its own proxy
+// support), when using uTLS we have to craft our own proxy connections. We do
+// the same for HTTP and HTTPS proxies with the native Go net/http, whose
+// built-in proxy support knows only Basic authentication and gives up on a
+// 407. If clientHelloID is nil, TLS to an HTTPS proxy uses crypto/tls with the
+// TLSClientConfig of httpRoundTripper, as net/http would.
 func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
-	var proxyDialer proxy.Dialer = proxy.Direct
+	var proxyDialer proxy.Dialer = outbound
 	if proxyURL == nil {
 		return proxyDialer, nil
 	}
@@ -145,15 +177,7 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 		return nil, err
 	}
 
-	var auth *proxy.Auth
-	if userpass := proxyURL.User; userpass != nil {
-		auth = &proxy.Auth{
-			User: userpass.Username(),
-		}
-		if password, ok := userpass.Password(); ok {
-			auth.Password = password
-		}
-	}
+	auth := proxyAuthFromURL(proxyURL)
 
 	switch proxyURL.Scheme {
 	case "socks5":
@@ -161,6 +185,10 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 	case "http":
 		proxyDialer, err = ProxyHTTP("tcp", proxyAddr, auth, proxyDialer)
 	case "https":
+		if clientHelloID == nil {
+			proxyDialer, err = ProxyHTTPSNative("tcp", proxyAddr, auth, proxyDialer, httpRoundTripper.TLSClientConfig)
+			break
+		}
 		// We use the same uTLS Config for TLS to the HTTPS proxy, as we
 		// use for HTTPS connections through the tunnel. We make a clone
 		// of the Config to avoid concurrent modification as the two
@@ -177,7 +205,7 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 	return proxyDialer, err
 }
 
-func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer) (http.RoundTripper, error) {
+func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer, http1 bool) (http.RoundTripper, error) {
 	addr, err := addrForDial(url)
 	if err != nil {
 		return nil, err
@@ -187,7 +215,7 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 	// initiate a TLS handshake using the given ClientHelloID. Return the
 	// resulting connection.
 	dial := func(network, addr string) (*utls.UConn, error) {
-		return dialUTLS(network, addr, cfg, clientHelloID, proxyDialer)
+		return dialUTLS(network, addr, cfg, clientHelloID, proxyDialer, http1)
 	}
 
 	bootstrapConn, err := dial("tcp", addr)
@@ -233,19 +261,42 @@ func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls
 		// configuration options as http.Transport with regard to
 		// timeouts, etc., so we are at the mercy of the defaults.
 		// https://github.com/golang/go/issues/16581
-		return &http2.Transport{
+		// Make the HTTP/2 frames match the browser too; see
+		// h2fingerprint.go.
+		profile := h2ProfileFor(clientHelloID)
+		tr := &http2.Transport{
+			// The one setting we can share with httpRoundTripper.
+			IdleConnTimeout: httpRoundTripper.IdleConnTimeout,
 			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
 				// Ignore the *tls.Config parameter; use our
 				// static cfg instead.
-				return dialTLS(network, addr)
+				conn, err := dialTLS(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return profile.wrapConn(conn), nil
 			},
-		}, nil
+		}
+		profile.configureTransport(tr)
+		return tr, nil
 	default:
 		// With http.Transport, copy important default fields from
 		// http.DefaultTransport, such as TLSHandshakeTimeout and
 		// IdleConnTimeout, before overriding DialTLS.
 		tr := httpRoundTripper.Clone()
-		tr.DialTLS = dialTLS
+		// Order the header fields like the browser too; see
+		// headerorder.go.
+		order := options.HeaderOrder
+		if order == nil {
+			order = headerOrderFor(clientHelloID)
+		}
+		tr.DialTLS = func(network, addr string) (net.Conn, error) {
+			conn, err := dialTLS(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return order.wrapConn(conn), nil
+		}
 		return tr, nil
 	}
 }
@@ -277,6 +328,8 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"hellochrome_96":        &utls.HelloChrome_96,
 	"hellochrome_100":       &utls.HelloChrome_100,
 	"hellochrome_102":       &utls.HelloChrome_102,
+	"hellochrome_131":       &utls.HelloChrome_131, // offers X25519MLKEM768 (post-quantum)
+	"hellochrome_133":       &utls.HelloChrome_133, // offers X25519MLKEM768 (post-quantum)
 	"helloios_auto":         &utls.HelloIOS_Auto,
 	"helloios_11_1":         &utls.HelloIOS_11_1,
 	"helloios_12_1":         &utls.HelloIOS_12_1,
@@ -291,9 +344,17 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	//   https://github.com/refraction-networking/utls/pull/122#issue-1401840671
 	//   "the specs based on Edge 106 and 360 11.0 seem to be incompatible with this library"
 	// omitting utls.HelloAndroid_11_OkHttp
+	// omitting utls.HelloChrome_115_PQ and utls.HelloChrome_120_PQ
+	//   They offer X25519Kyber768Draft00, a draft post-quantum key exchange
+	//   that browsers and servers have since dropped for X25519MLKEM768.
 }
 
 func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http.RoundTripper, error) {
+	return newUTLSRoundTripper(name, cfg, proxyURL, false)
+}
+
+// Like NewUTLSRoundTripper, but if http1 is true, never use HTTP/2.
+func newUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL, http1 bool) (http.RoundTripper, error) {
 	// Lookup is case-insensitive.
 	clientHelloID, ok := clientHelloIDMap[strings.ToLower(name)]
 	if !ok {
@@ -301,6 +362,9 @@ func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http
 	}
 	if clientHelloID == nil {
 		// Special case for "none" and HelloGolang.
+		if http1 {
+			return getHTTP1RoundTripper(), nil
+		}
 		return httpRoundTripper, nil
 	}
 
@@ -312,12 +376,14 @@ func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http
 	// This special-case RoundTripper is used for HTTP requests, which don't
 	// use uTLS but should use the specified proxy.
 	httpRT := httpRoundTripper.Clone()
-	httpRT.Proxy = http.ProxyURL(proxyURL)
+	httpRT.Proxy = nil
+	httpRT.DialContext = contextDialer{proxyDialer}.DialContext
 
 	return &UTLSRoundTripper{
 		clientHelloID: clientHelloID,
 		config:        cfg,
 		proxyDialer:   proxyDialer,
+		http1:         http1,
 		// rt will be set in the first call to RoundTrip.
 		httpRT: httpRT,
 	}, nil
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -246,3 +247,74 @@ func TestUTLSHTTPWithProxy(t *testing.T) {
 		}
 	}
 }
+
+// Test that with http1, a uTLS RoundTripper uses HTTP/1.1 even with a server
+// that prefers HTTP/2, and that it uses HTTP/2 otherwise.
+func TestUTLSHTTP1(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, test := range []struct {
+		http1    bool
+		expected string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	} {
+		rt, err := newUTLSRoundTripper("HelloChrome_Auto", &utls.Config{InsecureSkipVerify: true}, nil, test.http1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("http1=%v: %v", test.http1, err)
+		}
+		resp.Body.Close()
+		if resp.Proto != test.expected {
+			t.Errorf("http1=%v: got %s, expected %s", test.http1, resp.Proto, test.expected)
+		}
+	}
+}
+
+func TestHTTP1RoundTripper(t *testing.T) {
+	tr := getHTTP1RoundTripper()
+	if tr == httpRoundTripper {
+		t.Fatal("getHTTP1RoundTripper returned httpRoundTripper")
+	}
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Errorf("HTTP/2 not disabled: ForceAttemptHTTP2 %v, TLSNextProto %v", tr.ForceAttemptHTTP2, tr.TLSNextProto)
+	}
+	rt, err := newUTLSRoundTripper("none", nil, nil, true)
+	if err != nil || rt != tr {
+		t.Errorf("\"none\" with http1: got (%p, %v)", rt, err)
+	}
+}
+
+// Test that the fingerprints documented as post-quantum offer X25519MLKEM768.
+func TestUTLSPostQuantum(t *testing.T) {
+	for _, name := range []string{"hellochrome_auto", "hellochrome_131", "hellochrome_133"} {
+		spec, err := utls.UTLSIdToSpec(*clientHelloIDMap[name])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		found := false
+		for _, ext := range spec.Extensions {
+			if groups, ok := ext.(*utls.SupportedCurvesExtension); ok {
+				for _, curve := range groups.Curves {
+					if curve == utls.X25519MLKEM768 {
+						found = true
+					}
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s doesn't offer X25519MLKEM768", name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+// The code in this file implements "meek-client validate", which checks the
+// arguments of a bridge line without connecting to anything but DNS:
+//	meek-client [OPTIONS] validate "url=https://meek.example.com/ front=cdn.example.com utls=HelloChrome_Auto"
+// The arguments may also be given as separate words, and may be preceded by
+// the transport name, address, and fingerprint of a full bridge line. They are
+// interpreted exactly as SOCKS args from tor would be, together with the
+// command-line options, and the first problem found is reported.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"../lib/goptlib"
+)
+
+// How long to allow for resolving the front.
+const validateLookupTimeout = 10 * time.Second
+
+// The SOCKS args that makeRequestInfo understands.
+var knownBridgeArgs = []string{"connect", "credential", "dns-domain", "doh", "front", "http", "method", "mode", "mux", "pipeline", "url", "utls"}
+
+// Parse the key=value arguments of a bridge line. Words before the first
+// key=value (such as "Bridge meek 192.0.2.3:80 FINGERPRINT") are skipped.
+func parseBridgeArgs(line string) (pt.Args, error) {
+	args := make(pt.Args)
+	words := strings.Fields(line)
+	for len(words) > 0 && !strings.Contains(words[0], "=") {
+		words = words[1:]
+	}
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value argument", word)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", word)
+		}
+		if _, ok := args[key]; ok {
+			return nil, fmt.Errorf("%s= appears more than once; only the first would be used", key)
+		}
+		args.Add(key, value)
+	}
+	return args, nil
+}
+
+// Check that every argument is one that makeRequestInfo uses, because others
+// are silently ignored.
+func checkKnownBridgeArgs(args pt.Args) error {
+	var keys []string
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		i := sort.SearchStrings(knownBridgeArgs, key)
+		if i == len(knownBridgeArgs) || knownBridgeArgs[i] != key {
+			return fmt.Errorf("unknown argument %s= (known arguments are %s)", key, strings.Join(knownBridgeArgs, "=, ")+"=")
+		}
+	}
+	return nil
+}
+
+// Check a bridge line, writing what was found to w. lookup resolves the host
+// name that connections would be made to. Returns the first problem.
+func validateBridgeLine(w io.Writer, line string, lookup func(context.Context, string) ([]net.IP, error)) error {
+	args, err := parseBridgeArgs(line)
+	if err != nil {
+		return err
+	}
+	err = checkKnownBridgeArgs(args)
+	if err != nil {
+		return err
+	}
+	info, err := makeRequestInfo(args)
+	if err != nil {
+		return err
+	}
+	if info.URL.Scheme != "http" && info.URL.Scheme != "https" {
+		return fmt.Errorf("url= scheme %q is not http or https", info.URL.Scheme)
+	}
+	if info.URL.Hostname() == "" {
+		return fmt.Errorf("url= has no host")
+	}
+	fmt.Fprintf(w, "url:      %s\n", scrubURL(info.URL))
+	if info.Host != "" {
+		fmt.Fprintf(w, "host:     %s\n", info.Host)
+	}
+	if info.Connect != "" {
+		fmt.Fprintf(w, "connect:  %s\n", info.Connect)
+	}
+	if info.UTLSName != "" {
+		fmt.Fprintf(w, "utls:     %s\n", info.UTLSName)
+	}
+	fmt.Fprintf(w, "mode:     %s\n", info.Mode)
+	fmt.Fprintf(w, "pipeline: %d\n", info.Pipeline)
+
+	// makeRequestInfo has already checked that the proxy works with the
+	// chosen round tripper.
+	if options.ProxyURL != nil {
+		fmt.Fprintf(w, "proxy:    %s\n", scrubURL(options.ProxyURL))
+	}
+
+	// With a proxy or the helper, names are resolved elsewhere.
+	host := info.URL.Hostname()
+	if info.Connect != "" {
+		host, _, _ = net.SplitHostPort(info.Connect)
+	}
+	if options.ProxyURL != nil || options.UseHelper || net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), validateLookupTimeout)
+	defer cancel()
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("can't resolve %s: %s", host, err)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	fmt.Fprintf(w, "resolves: %s\n", strings.Join(addrs, " "))
+	return nil
+}
+
+// Check a bridge line and print a report. Returns the exit status.
+func validateMain(line string) int {
+	lookup := lookupIP
+	if outbound.cache != nil {
+		lookup = outbound.cache.Lookup
+	}
+	err := validateBridgeLine(os.Stdout, line, lookup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "ok\n")
+	return 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBridgeArgs(t *testing.T) {
+	args, err := parseBridgeArgs("Bridge meek 192.0.2.3:80 0123456789ABCDEF0123456789ABCDEF01234567 url=https://meek.example.com/ front=cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := args.Get("url"); u != "https://meek.example.com/" {
+		t.Errorf("url=%q", u)
+	}
+	if f, _ := args.Get("front"); f != "cdn.example.com" {
+		t.Errorf("front=%q", f)
+	}
+
+	for _, line := range []string{
+		"url=https://meek.example.com/ cdn.example.com",
+		"url=https://meek.example.com/ =x",
+		"url=https://meek.example.com/ url=https://other.example.com/",
+	} {
+		if _, err := parseBridgeArgs(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestValidateBridgeLine(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.Pipeline = 1
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		if host == "cdn.example.com" {
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	var buf bytes.Buffer
+	err := validateBridgeLine(&buf, "url=https://meek.example.com/ front=cdn.example.com pipeline=4", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"host:     meek.example.com", "pipeline: 4", "resolves: 192.0.2.1"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("report lacks %q:\n%s", expected, buf.String())
+		}
+	}
+
+	for _, test := range []struct {
+		line, expected string
+	}{
+		{"url=https://meek.example.com/ fronts=cdn.example.com", "unknown argument fronts="},
+		{"url=https://meek.example.com/ front=cdn.example.com pipeline=0", "pipeline depth"},
+		{"url=https://meek.example.com/ front=cdn.example.com mode=carrier-pigeon", "carrier-pigeon"},
+		{"url=ftp://meek.example.com/ front=cdn.example.com", "not http or https"},
+		{"url=https://meek.example.com/ front=missing.example.com", "can't resolve missing.example.com"},
+		{"front=cdn.example.com", "no URL"},
+	} {
+		err := validateBridgeLine(new(bytes.Buffer), test.line, lookup)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: expected error containing %q, got %v", test.line, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+//go:build js && wasm
+// +build js,wasm
+
+// The js/wasm build of meek-client runs inside a web page, without a native
+// helper extension. There is no SOCKS listener and no tor process. Instead,
+// the page calls the global function
+//
+//	meekConnect(url, port)
+//
+// where port is a MessagePort (or a WebSocket to a local relay). Every message
+// posted to the port is a chunk of the stream to be sent; every chunk received
+// from the server is posted back as a Uint8Array. Posting null, or closing the
+// port, ends the stream. HTTP requests are made through net/http, which on
+// js/wasm is implemented with the browser's Fetch API, so the meek-server must
+// be run with --cors-origins allowing the page's origin.
+//
+// Domain fronting is not possible from inside a browser, because the Fetch API
+// does not allow setting the Host header; the url argument must be the URL
+// that is actually requested.
+//
+// Build with:
+//
+//	GOOS=js GOARCH=wasm go build -o meek-client.wasm
+//
+// and load it using the wasm_exec.js shim from $(go env GOROOT)/misc/wasm.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// portAddr is the net.Addr of both ends of a portConn.
+type portAddr struct{}
+
+func (a portAddr) Network() string { return "js" }
+func (a portAddr) String() string  { return "messageport" }
+
+// The most bytes received from a port and not yet read. A page that posts more
+// than this without waiting has its connection closed.
+const maxPortQueue = 16 << 20
+
+// portConn adapts a JavaScript MessagePort or WebSocket to a net.Conn, so that
+// it can be passed to copyLoop in place of a SOCKS connection.
+type portConn struct {
+	port js.Value
+	// Chunks received and not yet read, and their total length. onMsg
+	// runs on the JavaScript event loop, and so must never block; it
+	// only adds to the queue, and signals ready.
+	lock    sync.Mutex
+	queue   [][]byte
+	queued  int
+	ready   chan struct{}
+	pending []byte
+
+	closed   chan struct{}
+	once     sync.Once
+	onMsg    js.Func
+	onClose  js.Func
+	isSocket bool
+}
+
+func newPortConn(port js.Value) *portConn {
+	c := &portConn{
+		port:   port,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	// A WebSocket has send; a MessagePort has postMessage.
+	c.isSocket = port.Get("send").Type() == js.TypeFunction
+	if c.isSocket {
+		port.Set("binaryType", "arraybuffer")
+	}
+	c.onMsg = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		data := args[0].Get("data")
+		if data.IsNull() || data.IsUndefined() {
+			c.Close()
+			return nil
+		}
+		array := js.Global().Get("Uint8Array").New(data)
+		b := make([]byte, array.Get("length").Int())
+		if len(b) == 0 {
+			return nil
+		}
+		js.CopyBytesToGo(b, array)
+		c.lock.Lock()
+		c.queue = append(c.queue, b)
+		c.queued += len(b)
+		over := c.queued > maxPortQueue
+		c.lock.Unlock()
+		if over {
+			log.Printf("more than %d bytes queued from the port; closing", maxPortQueue)
+			c.Close()
+			return nil
+		}
+		select {
+		case c.ready <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	c.onClose = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		c.Close()
+		return nil
+	})
+	port.Call("addEventListener", "message", c.onMsg)
+	port.Call("addEventListener", "close", c.onClose)
+	if !c.isSocket {
+		// A MessagePort doesn't deliver messages until started.
+		port.Call("start")
+	}
+	return c
+}
+
+// Take the oldest queued chunk, or nil if there is none.
+func (c *portConn) dequeue() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.queue) == 0 {
+		return nil
+	}
+	b := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	c.queued -= len(b)
+	return b
+}
+
+// Read what was posted to the port. Chunks posted before the port was closed
+// are still read, before io.EOF.
+func (c *portConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		c.pending = c.dequeue()
+		if c.pending != nil {
+			break
+		}
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			if c.pending = c.dequeue(); c.pending == nil {
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *portConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	array := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(array, b)
+	if c.isSocket {
+		c.port.Call("send", array)
+	} else {
+		c.port.Call("postMessage", array)
+	}
+	return len(b), nil
+}
+
+func (c *portConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.port.Call("removeEventListener", "message", c.onMsg)
+		c.port.Call("removeEventListener", "close", c.onClose)
+		c.port.Call("close")
+		// Releasing the functions here is safe even when Close is
+		// called from inside one of them: the call in progress keeps
+		// running, only future calls from JavaScript fail.
+		c.onMsg.Release()
+		c.onClose.Release()
+	})
+	return nil
+}
+
+func (c *portConn) LocalAddr() net.Addr                { return portAddr{} }
+func (c *portConn) RemoteAddr() net.Addr               { return portAddr{} }
+func (c *portConn) SetDeadline(t time.Time) error      { return nil }
+func (c *portConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *portConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// The JavaScript meekConnect(url, port) function.
+func meekConnect(this js.Value, args []js.Value) interface{} {
+	if len(args) != 2 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeObject {
+		return js.Global().Get("Error").New("usage: meekConnect(url, port)")
+	}
+	u, err := url.Parse(args[0].String())
+	if err != nil {
+		return js.Global().Get("Error").New(err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return js.Global().Get("Error").New(fmt.Sprintf("unsupported URL scheme %q", u.Scheme))
+	}
+
+	info := &RequestInfo{
+		SessionID: genSessionID(),
+		URL:       u,
+		// On js/wasm, http.Transport makes requests using fetch.
+		RoundTripper: httpRoundTripper,
+	}
+	conn := newPortConn(args[1])
+	go func() {
+		defer conn.Close()
+		err := copyLoop(conn, info)
+		if err != nil {
+			log.Printf("error in copyLoop: %s", err)
+		}
+	}()
+	return nil
+}
+
+func main() {
+	js.Global().Set("meekConnect", js.FuncOf(meekConnect))
+	log.Printf("meekConnect ready")
+	// Keep the Go runtime alive to service callbacks.
+	select {}
+}
@@ -0,0 +1,204 @@
+package main
+
+// The code in this file implements the WebSocket carrier mode. Instead of
+// polling with a sequence of POST requests, the session is carried in a single
+// WebSocket connection to the same server, at the path element "ws" appended
+// to the URL. The server pushes data as soon as it has it, so there is no
+// polling delay and no empty requests. The WebSocket connection goes through
+// the front and proxy the same way as polling requests do, and with --utls it
+// has the same TLS fingerprint (except that ALPN offers only "http/1.1", as
+// WebSocket requires).
+//
+// The carrier mode is chosen by --mode or the mode= SOCKS arg:
+//	poll	classic polling (the default)
+//	ws	WebSocket only
+//	auto	try WebSocket, and fall back to polling if the upgrade fails
+//	dns	queries through a DNS-over-HTTPS resolver (see dnstunnel.go)
+// Server-sent events are not implemented.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/websocket"
+)
+
+// Carrier modes.
+const (
+	modePoll      = "poll"
+	modeWebSocket = "ws"
+	modeAuto      = "auto"
+)
+
+const (
+	// The path element appended to the URL for a WebSocket upgrade.
+	webSocketPath = "ws"
+	// How long to allow for connecting and upgrading to WebSocket.
+	webSocketHandshakeTimeout = 30 * time.Second
+)
+
+// Check that a --mode or mode= value is one we know.
+func checkMode(mode string) error {
+	switch mode {
+	case modePoll, modeWebSocket, modeAuto, modeDNS:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// Return the URL of the WebSocket endpoint corresponding to the polling URL u.
+func webSocketURL(u *url.URL) *url.URL {
+	w := *u
+	w.Path = path.Join("/", u.Path, webSocketPath)
+	w.RawPath = ""
+	w.RawQuery = ""
+	w.Fragment = ""
+	switch u.Scheme {
+	case "http":
+		w.Scheme = "ws"
+	case "https":
+		w.Scheme = "wss"
+	}
+	return &w
+}
+
+// Connect to the server described by info and upgrade to WebSocket. The
+// connection is made to the URL's host (the front), with the Host header set to
+// info.Host, if any.
+func dialWebSocket(ctx context.Context, info *RequestInfo) (*websocket.Conn, error) {
+	if options.UseHelper {
+		return nil, fmt.Errorf("WebSocket mode is not available with --helper")
+	}
+	addr, err := addrForDial(info.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientHelloID *utls.ClientHelloID
+	if info.UTLSName != "" {
+		var ok bool
+		clientHelloID, ok = clientHelloIDMap[strings.ToLower(info.UTLSName)]
+		if !ok {
+			return nil, fmt.Errorf("no uTLS Client Hello ID named %q", info.UTLSName)
+		}
+	}
+	dialer, err := makeProxyDialer(options.ProxyURL, nil, clientHelloID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webSocketHandshakeTimeout)
+	defer cancel()
+	conn, err := contextDialer{dialer}.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Interrupt the handshake if ctx expires.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	ws, err := upgradeWebSocket(conn, addr, clientHelloID, info)
+	if !stop() {
+		return nil, fmt.Errorf("WebSocket handshake: %s", ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// Do the TLS handshake (for https URLs) and WebSocket upgrade on conn.
+func upgradeWebSocket(conn net.Conn, addr string, clientHelloID *utls.ClientHelloID, info *RequestInfo) (*websocket.Conn, error) {
+	if info.URL.Scheme == "https" {
+		serverName, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if clientHelloID != nil {
+			uconn := utls.UClient(conn, newUTLSConfig(), *clientHelloID)
+			uconn.SetSNI(serverName)
+			err = forceHTTP1ALPN(uconn)
+			if err == nil {
+				err = uconn.Handshake()
+			}
+			conn = uconn
+		} else {
+			cfg := newTLSConfig()
+			cfg.ServerName = serverName
+			cfg.NextProtos = []string{"http/1.1"}
+			tlsConn := tls.Client(conn, cfg)
+			err = tlsConn.Handshake()
+			conn = tlsConn
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	location := webSocketURL(info.URL)
+	if info.Host != "" {
+		location.Host = info.Host
+	}
+	// The x/net/websocket client insists on an Origin. Use the server's
+	// own, which meek-server accepts as same-origin.
+	origin := &url.URL{Scheme: info.URL.Scheme, Host: location.Host}
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("X-Session-Id", info.SessionID)
+	if info.Credential != "" {
+		config.Header.Set("X-Credential", credentialProof(info.Credential, info.SessionID))
+	}
+	return websocket.NewClient(config, conn)
+}
+
+// Copy data between conn and ws until either side closes, or openSessions
+// starts draining.
+func copyWebSocket(conn net.Conn, ws *websocket.Conn) error {
+	var wg sync.WaitGroup
+	var upErr, downErr error
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-openSessions.Draining():
+			// Closing the WebSocket ends the session on the server.
+			ws.Close()
+		case <-finished:
+		}
+	}()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, upErr = io.Copy(ws, conn)
+		// Unblock the other direction.
+		ws.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, downErr = io.Copy(conn, ws)
+		conn.Close()
+	}()
+	wg.Wait()
+	select {
+	case <-openSessions.Draining():
+		// The errors are only the result of closing ws.
+		return nil
+	default:
+	}
+	// One direction's error is only the result of the other closing.
+	if upErr != nil && downErr != nil {
+		return fmt.Errorf("WebSocket session: %s", downErr)
+	}
+	return nil
+}
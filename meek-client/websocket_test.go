@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketURL(t *testing.T) {
+	for _, test := range []struct {
+		input, expected string
+	}{
+		{"https://meek.example/", "wss://meek.example/ws"},
+		{"https://meek.example", "wss://meek.example/ws"},
+		{"http://meek.example:8080/meek/?a=b", "ws://meek.example:8080/meek/ws"},
+	} {
+		u, err := url.Parse(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output := webSocketURL(u).String(); output != test.expected {
+			t.Errorf("%q → %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestMakeRequestInfoMode(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.URL = "https://meek.example/"
+	options.Pipeline = 1
+
+	for _, test := range []struct {
+		option, arg, expected string
+	}{
+		{"", "", modePoll},
+		{modeAuto, "", modeAuto},
+		{modeAuto, modeWebSocket, modeWebSocket},
+		{modePoll, modeAuto, modeAuto},
+	} {
+		options.Mode = test.option
+		args := make(map[string][]string)
+		if test.arg != "" {
+			args["mode"] = []string{test.arg}
+		}
+		info, err := makeRequestInfo(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode != test.expected {
+			t.Errorf("--mode=%q mode=%q: got %q, expected %q", test.option, test.arg, info.Mode, test.expected)
+		}
+	}
+
+	_, err := makeRequestInfo(map[string][]string{"mode": {"sse"}})
+	if err == nil {
+		t.Errorf("mode=sse unexpectedly succeeded")
+	}
+}
+
+// Run copyLoop on one end of a pipe and check that data written to the other
+// end is echoed.
+func checkCopyLoopEcho(t *testing.T, info *RequestInfo) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- copyLoop(remote, info) }()
+
+	local.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := local.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(local, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got (%q, %v)", buf, err)
+	}
+	local.Close()
+	if err := <-errCh; err != nil {
+		t.Errorf("copyLoop: %v", err)
+	}
+}
+
+func TestCopyLoopWebSocket(t *testing.T) {
+	sessionIDs := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/meek/ws", websocket.Handler(func(ws *websocket.Conn) {
+		sessionIDs <- ws.Request().Header.Get("X-Session-Id")
+		io.Copy(ws, ws)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/meek/")
+	checkCopyLoopEcho(t, &RequestInfo{
+		SessionID: "abcdefgh",
+		URL:       u,
+		Mode:      modeWebSocket,
+	})
+	if id := <-sessionIDs; id != "abcdefgh" {
+		t.Errorf("server got session id %q", id)
+	}
+}
+
+func TestCopyLoopAutoFallback(t *testing.T) {
+	// A server that knows only polling.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.NotFound(w, req)
+			return
+		}
+		io.Copy(w, req.Body)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	checkCopyLoopEcho(t, &RequestInfo{
+		SessionID:    "abcdefgh",
+		URL:          u,
+		RoundTripper: httpRoundTripper,
+		Pipeline:     1,
+		Mode:         modeAuto,
+	})
+
+	// In ws mode, there is no fallback.
+	info := &RequestInfo{
+		SessionID:    "abcdefgh",
+		URL:          u,
+		RoundTripper: httpRoundTripper,
+		Pipeline:     1,
+		Mode:         modeWebSocket,
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	if err := copyLoop(remote, info); err == nil {
+		t.Errorf("ws mode against a polling-only server unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+// The code in this file implements the client address allow and deny lists,
+// which are set through the admin API. They apply only when a session is
+// created; changing them does not affect existing sessions.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Returned by GetSession when the client address is not allowed.
+var errClientDenied = errors.New("client address not allowed")
+
+// ipACL is a pair of allow and deny lists of address ranges. An address is
+// allowed if it matches no deny entry and, when the allow list is not empty, at
+// least one allow entry.
+type ipACL struct {
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// The ACL for new sessions.
+var clientACL ipACL
+
+// Parse a list of CIDR ranges. A bare IP address means just that address.
+func parseIPNets(specs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("bad IP address %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func formatIPNets(nets []*net.IPNet) []string {
+	specs := make([]string, 0, len(nets))
+	for _, ipNet := range nets {
+		specs = append(specs, ipNet.String())
+	}
+	return specs
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace both lists. If either fails to parse, neither is changed.
+func (acl *ipACL) Set(allow, deny []string) error {
+	allowNets, err := parseIPNets(allow)
+	if err != nil {
+		return fmt.Errorf("allow: %s", err)
+	}
+	denyNets, err := parseIPNets(deny)
+	if err != nil {
+		return fmt.Errorf("deny: %s", err)
+	}
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	acl.allow, acl.deny = allowNets, denyNets
+	return nil
+}
+
+// Return both lists as CIDR strings.
+func (acl *ipACL) Get() (allow, deny []string) {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	return formatIPNets(acl.allow), formatIPNets(acl.deny)
+}
+
+// Is ip allowed? A nil ip (client address unknown) is allowed only if there is
+// no allow list.
+func (acl *ipACL) Allowed(ip net.IP) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	if ip == nil {
+		return len(acl.allow) == 0
+	}
+	if containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestIPACL(t *testing.T) {
+	var acl ipACL
+	if !acl.Allowed(net.ParseIP("192.0.2.1")) || !acl.Allowed(nil) {
+		t.Errorf("empty ACL denied something")
+	}
+
+	err := acl.Set([]string{"192.0.2.0/24", "2001:db8::/32"}, []string{"192.0.2.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip       string
+		expected bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.66", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if acl.Allowed(net.ParseIP(test.ip)) != test.expected {
+			t.Errorf("%s: expected %v", test.ip, test.expected)
+		}
+	}
+	if acl.Allowed(nil) {
+		t.Errorf("unknown address allowed despite allow list")
+	}
+
+	allow, deny := acl.Get()
+	if !reflect.DeepEqual(allow, []string{"192.0.2.0/24", "2001:db8::/32"}) || !reflect.DeepEqual(deny, []string{"192.0.2.66/32"}) {
+		t.Errorf("Get returned %q %q", allow, deny)
+	}
+
+	// A bad entry changes nothing.
+	err = acl.Set(nil, []string{"192.0.2.0/24", "bogus"})
+	if err == nil {
+		t.Errorf("bad entry accepted")
+	}
+	if !acl.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Errorf("ACL changed by failed Set")
+	}
+}
+
+func TestGetSessionDenied(t *testing.T) {
+	defer clientACL.Set(nil, nil)
+	err := clientACL.Set(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewState()
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.5:1234"
+	_, err = state.GetSession("Y2FyZ28gdHJ1Y2s", req)
+	if err != errClientDenied {
+		t.Errorf("got %v, expected %v", err, errClientDenied)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+// The code in this file implements the admin API (--admin-addr), an HTTP
+// interface for changing the configuration of a running server without
+// dropping existing sessions. It is meant to listen on localhost or a private
+// network only. Every request must have the header
+//	Authorization: Bearer TOKEN
+// where TOKEN is the contents of --admin-token-file. The token can be rotated
+// through the API, which also writes the new token to the file.
+//
+// Requests and responses are JSON:
+//	GET    /backends         {"backends": [ADDR, ...]}
+//	POST   /backends         {"addr": ADDR}            add a backend
+//	DELETE /backends/{addr}                            remove a backend
+//	GET    /acl              {"allow": [CIDR, ...], "deny": [CIDR, ...]}
+//	PUT    /acl              {"allow": [...], "deny": [...]}
+//	GET    /limits           {"max_conns_per_ip": N, "max_requests_per_conn": N}
+//	PUT    /limits           {"max_conns_per_ip": N, "max_requests_per_conn": N}
+//	GET    /qos              {"classes": [...], "credentials": {...}, "default": CLASS}
+//	PUT    /qos              {"classes": [...], "credentials": {...}, "default": CLASS}
+//	PUT    /token            {"token": TOKEN}
+//	DELETE /sessions/{id}                              close a session
+//	GET    /sessions/{id}/trace {"session": ID, "created": TIME, "events": [...]}
+//	GET    /countries        [{"country": CC, "sessions": N, "bytes": N}, ...]
+//	POST   /dump             {"sessions": N, "goroutines": N, ...}  log a state dump
+//	GET    /log-level        {"level": LEVEL, "until": TIME}
+//	PUT    /log-level        {"level": LEVEL, "duration_seconds": N}
+//	GET    /version          {"version": VERSION, "commit": COMMIT, "date": DATE, "go_version": GOVERSION}
+// Changes affect new sessions and connections only, and are not saved (except
+// for the token): a restart returns to the command-line configuration. A log
+// level set with a duration goes back to the previous level after that many
+// seconds; "until" is omitted if the level is not temporary.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// The shortest admin token accepted.
+const minAdminTokenLength = 16
+
+type adminServer struct {
+	state     *State
+	tokenFile string
+
+	lock  sync.Mutex
+	token string
+}
+
+// Make an admin server for state, with the token read from tokenFile.
+func newAdminServer(state *State, tokenFile string) (*adminServer, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) < minAdminTokenLength {
+		return nil, fmt.Errorf("admin token in %s is shorter than %d characters", tokenFile, minAdminTokenLength)
+	}
+	return &adminServer{state: state, tokenFile: tokenFile, token: token}, nil
+}
+
+// Return the token of an "Authorization: Bearer TOKEN" header value. ok is
+// false if it is not that.
+func parseBearerToken(value string) (token string, ok bool) {
+	scheme, token, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return token, true
+}
+
+func (admin *adminServer) authorized(req *http.Request) bool {
+	provided, ok := parseBearerToken(req.Header.Get("Authorization"))
+	if !ok {
+		return false
+	}
+	admin.lock.Lock()
+	token := admin.token
+	admin.lock.Unlock()
+	return tokenMatches(provided, token)
+}
+
+// An admin API route. An element "*" of pattern matches any one non-empty
+// path element, which is passed to the handler as arg.
+type adminRoute struct {
+	method  string
+	pattern string
+	handler func(w http.ResponseWriter, req *http.Request, arg string)
+}
+
+// Adapt a handler that takes no path element.
+func adminHandlerFunc(h http.HandlerFunc) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, req *http.Request, _ string) {
+		h(w, req)
+	}
+}
+
+func (admin *adminServer) routes() []adminRoute {
+	return []adminRoute{
+		{"GET", "/backends", adminHandlerFunc(admin.getBackends)},
+		{"POST", "/backends", adminHandlerFunc(admin.addBackend)},
+		{"DELETE", "/backends/*", admin.removeBackend},
+		{"GET", "/acl", adminHandlerFunc(admin.getACL)},
+		{"PUT", "/acl", adminHandlerFunc(admin.setACL)},
+		{"GET", "/limits", adminHandlerFunc(admin.getLimits)},
+		{"PUT", "/limits", adminHandlerFunc(admin.setLimits)},
+		{"GET", "/qos", adminHandlerFunc(admin.getQoS)},
+		{"PUT", "/qos", adminHandlerFunc(admin.setQoS)},
+		{"PUT", "/token", adminHandlerFunc(admin.setToken)},
+		{"DELETE", "/sessions/*", admin.closeSession},
+		{"GET", "/sessions/*/trace", admin.getSessionTrace},
+		{"GET", "/countries", adminHandlerFunc(admin.getCountries)},
+		{"POST", "/dump", adminHandlerFunc(admin.dumpState)},
+		{"GET", "/log-level", adminHandlerFunc(admin.getLogLevel)},
+		{"PUT", "/log-level", adminHandlerFunc(admin.setLogLevel)},
+		{"GET", "/version", adminHandlerFunc(admin.getVersion)},
+	}
+}
+
+// Match urlPath against the pattern of an adminRoute, returning the path
+// element that matched "*", if any.
+func matchAdminPath(pattern, urlPath string) (arg string, ok bool) {
+	patternElems := strings.Split(pattern, "/")
+	pathElems := strings.Split(urlPath, "/")
+	if len(patternElems) != len(pathElems) {
+		return "", false
+	}
+	for i, elem := range patternElems {
+		if elem == "*" && pathElems[i] != "" {
+			arg = pathElems[i]
+		} else if elem != pathElems[i] {
+			return "", false
+		}
+	}
+	return arg, true
+}
+
+// Return the http.Handler for the admin API. Requests are routed by hand,
+// not with the method and wildcard patterns of http.ServeMux, which without
+// a go.mod (in GOPATH mode) are turned off by the default GODEBUG
+// httpmuxgo121=1. As with those patterns, GET also matches HEAD, and a path
+// that has routes, but none for the method, gets 405 with an Allow header.
+func (admin *adminServer) Handler() http.Handler {
+	routes := admin.routes()
+	return withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if options.RequestIDHeader {
+			w.Header().Set(requestIDHeader, requestID(req))
+		}
+		if !admin.authorized(req) {
+			logging.Debugf("[%s] admin: unauthorized %s %s", requestID(req), req.Method, req.URL.Path)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		var allowed []string
+		for _, route := range routes {
+			arg, ok := matchAdminPath(route.pattern, req.URL.Path)
+			if !ok {
+				continue
+			}
+			if route.method == req.Method || (route.method == "GET" && req.Method == "HEAD") {
+				route.handler(w, req, arg)
+				return
+			}
+			allowed = append(allowed, route.method)
+		}
+		if len(allowed) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Decode a JSON request body into v, answering with an error and returning
+// false if it can't be done.
+func readJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (admin *adminServer) getBackends(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string][]string{"backends": backends.List()})
+}
+
+func (admin *adminServer) addBackend(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Addr string `json:"addr"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	if err := backends.Add(body.Addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Infof("admin: added backend %s", body.Addr)
+	admin.getBackends(w, req)
+}
+
+func (admin *adminServer) removeBackend(w http.ResponseWriter, req *http.Request, addr string) {
+	if !backends.Remove(addr) {
+		http.NotFound(w, req)
+		return
+	}
+	removeBackendBreaker(addr)
+	logging.Infof("admin: removed backend %s", addr)
+	admin.getBackends(w, req)
+}
+
+type aclBody struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (admin *adminServer) getACL(w http.ResponseWriter, req *http.Request) {
+	var body aclBody
+	body.Allow, body.Deny = clientACL.Get()
+	writeJSON(w, body)
+}
+
+func (admin *adminServer) setACL(w http.ResponseWriter, req *http.Request) {
+	var body aclBody
+	if !readJSON(w, req, &body) {
+		return
+	}
+	if err := clientACL.Set(body.Allow, body.Deny); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Infof("admin: set ACL with %d allow and %d deny entries", len(body.Allow), len(body.Deny))
+	admin.getACL(w, req)
+}
+
+type limitsBody struct {
+	MaxConnsPerIP      *int `json:"max_conns_per_ip"`
+	MaxRequestsPerConn *int `json:"max_requests_per_conn"`
+}
+
+func (admin *adminServer) getLimits(w http.ResponseWriter, req *http.Request) {
+	conns, requests := maxConnsPerIP.Get(), maxRequestsPerConn.Get()
+	writeJSON(w, limitsBody{&conns, &requests})
+}
+
+// Set either or both limits; one that is omitted is unchanged.
+func (admin *adminServer) setLimits(w http.ResponseWriter, req *http.Request) {
+	var body limitsBody
+	if !readJSON(w, req, &body) {
+		return
+	}
+	// 0 means no limit; a negative limit means nothing.
+	if (body.MaxConnsPerIP != nil && *body.MaxConnsPerIP < 0) ||
+		(body.MaxRequestsPerConn != nil && *body.MaxRequestsPerConn < 0) {
+		http.Error(w, "limits must not be negative", http.StatusBadRequest)
+		return
+	}
+	if body.MaxConnsPerIP != nil {
+		maxConnsPerIP.Set(*body.MaxConnsPerIP)
+		logging.Infof("admin: set max-conns-per-ip to %d", *body.MaxConnsPerIP)
+	}
+	if body.MaxRequestsPerConn != nil {
+		maxRequestsPerConn.Set(*body.MaxRequestsPerConn)
+		logging.Infof("admin: set max-requests-per-conn to %d", *body.MaxRequestsPerConn)
+	}
+	admin.getLimits(w, req)
+}
+
+func (admin *adminServer) getQoS(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, qosTable.Get())
+}
+
+// Replace the QoS classes and credentials; see qos.go.
+func (admin *adminServer) setQoS(w http.ResponseWriter, req *http.Request) {
+	if fairSched == nil {
+		http.Error(w, "QoS classes need --fair-rate", http.StatusBadRequest)
+		return
+	}
+	var body qosConfig
+	if !readJSON(w, req, &body) {
+		return
+	}
+	if err := qosTable.Set(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logging.Infof("admin: set %d QoS classes with %d credentials", len(body.Classes), len(body.Credentials))
+	admin.getQoS(w, req)
+}
+
+// Replace the token and write it to the token file, so that it survives a
+// restart. The old token stops working at once.
+func (admin *adminServer) setToken(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	if len(body.Token) < minAdminTokenLength || strings.TrimSpace(body.Token) != body.Token {
+		http.Error(w, fmt.Sprintf("token must be at least %d characters, without surrounding space", minAdminTokenLength), http.StatusBadRequest)
+		return
+	}
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+	tmp := admin.tokenFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(body.Token+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, admin.tokenFile)
+	}
+	if err != nil {
+		logging.Warnf("admin: error writing token file: %s", err)
+		httpInternalServerError(w)
+		return
+	}
+	admin.token = body.Token
+	logging.Infof("admin: rotated admin token")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *adminServer) closeSession(w http.ResponseWriter, req *http.Request, sessionID string) {
+	if !admin.state.CloseSession(sessionID, closeReasonExplicit) {
+		http.NotFound(w, req)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Return the recent events of a session, named by its id or by the hash of its
+// id in the log. 404 if there is no such session, or tracing is disabled.
+func (admin *adminServer) getSessionTrace(w http.ResponseWriter, req *http.Request, id string) {
+	sessionID, session := admin.state.findSession(id)
+	if session == nil || session.trace == nil {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, struct {
+		Session string       `json:"session"`
+		Created time.Time    `json:"created"`
+		Events  []traceEvent `json:"events"`
+	}{scrubSessionID(sessionID), session.Created, session.trace.Events()})
+}
+
+// Return per-country usage since the last heartbeat, rounded as in the
+// heartbeat. 404 if GeoIP is not enabled.
+func (admin *adminServer) getCountries(w http.ResponseWriter, req *http.Request) {
+	if usageByCountry == nil {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, usageByCountry.Current())
+}
+
+// Write a state dump to the log, and return it.
+func (admin *adminServer) dumpState(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, admin.state.LogDump())
+}
+
+type logLevelBody struct {
+	Level string     `json:"level"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func (admin *adminServer) getLogLevel(w http.ResponseWriter, req *http.Request) {
+	level, until := logging.Current()
+	body := logLevelBody{Level: logging.LevelName(level)}
+	if !until.IsZero() {
+		body.Until = &until
+	}
+	writeJSON(w, body)
+}
+
+// Set the log level, for a number of seconds if duration_seconds is given.
+func (admin *adminServer) setLogLevel(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Level           string `json:"level"`
+		DurationSeconds int    `json:"duration_seconds"`
+	}
+	if !readJSON(w, req, &body) {
+		return
+	}
+	level, err := logging.ParseLevel(body.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.DurationSeconds < 0 {
+		http.Error(w, "duration_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	logging.Change(level, time.Duration(body.DurationSeconds)*time.Second)
+	admin.getLogLevel(w, req)
+}
+
+func (admin *adminServer) getVersion(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, getBuildInfo())
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../lib/buildinfo"
+	"../lib/logging"
+)
+
+const testAdminToken = "0123456789abcdef0123"
+
+func newTestAdmin(t *testing.T) (*adminServer, string) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte(testAdminToken+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := newAdminServer(NewState(), tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admin, tokenFile
+}
+
+// Make an admin request and return the response.
+func adminRequest(handler http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewAdminServerShortToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("short\n"), 0600)
+	if _, err := newAdminServer(NewState(), tokenFile); err == nil {
+		t.Errorf("short token accepted")
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+	for _, token := range []string{"", "wrong-token-wrong-token"} {
+		if rec := adminRequest(handler, token, "GET", "/limits", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d", token, rec.Code)
+		}
+	}
+	if rec := adminRequest(handler, testAdminToken, "GET", "/limits", ""); rec.Code != http.StatusOK {
+		t.Errorf("good token: status %d", rec.Code)
+	}
+}
+
+func TestMatchAdminPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		arg           string
+		ok            bool
+	}{
+		{"/backends", "/backends", "", true},
+		{"/backends", "/backends/", "", false},
+		{"/backends/*", "/backends/127.0.0.1:9001", "127.0.0.1:9001", true},
+		{"/backends/*", "/backends/", "", false},
+		{"/backends/*", "/backends", "", false},
+		{"/sessions/*/trace", "/sessions/Y2FyZ28gdHJ1Y2s/trace", "Y2FyZ28gdHJ1Y2s", true},
+		{"/sessions/*/trace", "/sessions/Y2FyZ28gdHJ1Y2s", "", false},
+		{"/sessions/*", "/sessions/Y2FyZ28gdHJ1Y2s/trace", "", false},
+	} {
+		arg, ok := matchAdminPath(test.pattern, test.path)
+		if arg != test.arg || ok != test.ok {
+			t.Errorf("%q %q: got %q, %v", test.pattern, test.path, arg, ok)
+		}
+	}
+}
+
+// Unknown paths are 404, and known paths with the wrong method are 405.
+func TestAdminRouting(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+	if rec := adminRequest(handler, testAdminToken, "GET", "/nonexistent", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown path: status %d", rec.Code)
+	}
+	rec := adminRequest(handler, testAdminToken, "DELETE", "/limits", "")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("wrong method: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if rec := adminRequest(handler, testAdminToken, "HEAD", "/limits", ""); rec.Code != http.StatusOK {
+		t.Errorf("HEAD: status %d", rec.Code)
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	defer func() {
+		for _, addr := range backends.List() {
+			backends.Remove(addr)
+		}
+	}()
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+
+	rec := adminRequest(handler, testAdminToken, "POST", "/backends", `{"addr": "127.0.0.1:9001"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("add: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(handler, testAdminToken, "POST", "/backends", `{"addr": "127.0.0.1:9001"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("duplicate add: status %d", rec.Code)
+	}
+	if rec := adminRequest(handler, testAdminToken, "POST", "/backends", `{"addr": "no-port"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad add: status %d", rec.Code)
+	}
+
+	rec = adminRequest(handler, testAdminToken, "GET", "/backends", "")
+	var body struct{ Backends []string }
+	json.NewDecoder(rec.Body).Decode(&body)
+	if len(body.Backends) != 1 || body.Backends[0] != "127.0.0.1:9001" {
+		t.Errorf("list: got %q", body.Backends)
+	}
+
+	if rec := adminRequest(handler, testAdminToken, "DELETE", "/backends/127.0.0.1:9001", ""); rec.Code != http.StatusOK {
+		t.Errorf("remove: status %d", rec.Code)
+	}
+	if rec := adminRequest(handler, testAdminToken, "DELETE", "/backends/127.0.0.1:9001", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second remove: status %d", rec.Code)
+	}
+}
+
+func TestAdminACL(t *testing.T) {
+	defer clientACL.Set(nil, nil)
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+
+	rec := adminRequest(handler, testAdminToken, "PUT", "/acl", `{"deny": ["192.0.2.0/24"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body aclBody
+	json.NewDecoder(rec.Body).Decode(&body)
+	if len(body.Deny) != 1 || body.Deny[0] != "192.0.2.0/24" {
+		t.Errorf("got %+v", body)
+	}
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/acl", `{"deny": ["bogus"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad ACL: status %d", rec.Code)
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	defer maxConnsPerIP.Set(maxConnsPerIP.Get())
+	defer maxRequestsPerConn.Set(maxRequestsPerConn.Get())
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+
+	maxRequestsPerConn.Set(7)
+	rec := adminRequest(handler, testAdminToken, "PUT", "/limits", `{"max_conns_per_ip": 3}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if maxConnsPerIP.Get() != 3 || maxRequestsPerConn.Get() != 7 {
+		t.Errorf("limits are %d and %d", maxConnsPerIP.Get(), maxRequestsPerConn.Get())
+	}
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/limits", `{"max_conns": 3}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status %d", rec.Code)
+	}
+	for _, body := range []string{
+		`{"max_conns_per_ip": -1}`,
+		`{"max_conns_per_ip": 5, "max_requests_per_conn": -1}`,
+	} {
+		if rec := adminRequest(handler, testAdminToken, "PUT", "/limits", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, rec.Code)
+		}
+	}
+	if maxConnsPerIP.Get() != 3 || maxRequestsPerConn.Get() != 7 {
+		t.Errorf("after negative limits, limits are %d and %d", maxConnsPerIP.Get(), maxRequestsPerConn.Get())
+	}
+}
+
+func TestAdminQoS(t *testing.T) {
+	defer qosTable.Set(qosConfig{})
+	defer func(saved *fairScheduler) { fairSched = saved }(fairSched)
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+
+	const config = `{"classes": [{"name": "paid", "weight": 4}], "credentials": {"secret": "paid"}}`
+	fairSched = nil
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/qos", config); rec.Code != http.StatusBadRequest {
+		t.Errorf("without --fair-rate: status %d", rec.Code)
+	}
+	fairSched = newFairScheduler(1 << 20)
+	rec := adminRequest(handler, testAdminToken, "PUT", "/qos", config)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if class := qosTable.Class(credentialProof("secret", "session"), "session"); class == nil || class.Weight != 4 {
+		t.Errorf("got class %+v", class)
+	}
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/qos", `{"classes": [], "default": "none"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad config: status %d", rec.Code)
+	}
+	rec = adminRequest(handler, testAdminToken, "GET", "/qos", "")
+	var body qosConfig
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", rec.Code, err)
+	}
+	if len(body.Classes) != 1 || body.Credentials["secret"] != "paid" {
+		t.Errorf("got %+v", body)
+	}
+	rec = adminRequest(handler, testAdminToken, "POST", "/qos", config)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("POST: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	admin, tokenFile := newTestAdmin(t)
+	handler := admin.Handler()
+	newToken := "fedcba9876543210fedcba"
+
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/token", `{"token": "short"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("short token: status %d", rec.Code)
+	}
+	if rec := adminRequest(handler, testAdminToken, "PUT", "/token", `{"token": "`+newToken+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(handler, testAdminToken, "GET", "/limits", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old token still works")
+	}
+	if rec := adminRequest(handler, newToken, "GET", "/limits", ""); rec.Code != http.StatusOK {
+		t.Errorf("new token doesn't work")
+	}
+	data, _ := os.ReadFile(tokenFile)
+	if !bytes.Equal(bytes.TrimSpace(data), []byte(newToken)) {
+		t.Errorf("token file contains %q", data)
+	}
+}
+
+func TestAdminCloseSession(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+	if rec := adminRequest(handler, testAdminToken, "DELETE", "/sessions/Y2FyZ28gdHJ1Y2s", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", rec.Code)
+	}
+}
+
+func TestAdminSessionTrace(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	if rec := adminRequest(handler, testAdminToken, "GET", "/sessions/"+sessionID+"/trace", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", rec.Code)
+	}
+
+	session := &Session{trace: newSessionTrace(4)}
+	session.trace.Add(traceEvent{Event: traceEventCreate})
+	admin.state.shard(sessionID).sessions.Store(sessionID, session)
+	// The session can be named by its id or its hash in the log.
+	for _, id := range []string{sessionID, logSessionIDHasher.Hash(sessionID)} {
+		rec := adminRequest(handler, testAdminToken, "GET", "/sessions/"+id+"/trace", "")
+		var body struct {
+			Events []traceEvent `json:"events"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if len(body.Events) != 1 || body.Events[0].Event != traceEventCreate {
+			t.Errorf("%s: events %+v", id, body.Events)
+		}
+	}
+}
+
+// The session id is taken from the path by the admin handler's own routing, as
+// served over HTTP the way meek-server serves it.
+func TestAdminSessionTraceHTTP(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session := &Session{trace: newSessionTrace(4)}
+	session.trace.Add(traceEvent{Event: traceEventCreate})
+	admin.state.shard(sessionID).sessions.Store(sessionID, session)
+	server := httptest.NewServer(admin.Handler())
+	defer server.Close()
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/sessions/" + sessionID + "/trace", http.StatusOK},
+		{"GET", "/sessions/" + logSessionIDHasher.Hash(sessionID) + "/trace", http.StatusOK},
+		{"HEAD", "/sessions/" + sessionID + "/trace", http.StatusOK},
+		{"GET", "/sessions/AAAAAAAAAAAAAAA/trace", http.StatusNotFound},
+		{"GET", "/sessions/" + sessionID + "/trace/", http.StatusNotFound},
+		{"GET", "/sessions//trace", http.StatusNotFound},
+		{"POST", "/sessions/" + sessionID + "/trace", http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.path, err)
+		}
+		var body struct {
+			Events []traceEvent `json:"events"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, expected %d", test.method, test.path, resp.StatusCode, test.status)
+			continue
+		}
+		if test.method == "GET" && test.status == http.StatusOK {
+			if err != nil || len(body.Events) != 1 || body.Events[0].Event != traceEventCreate {
+				t.Errorf("%s %s: events %+v, %v", test.method, test.path, body.Events, err)
+			}
+		}
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	saved, _ := logging.Current()
+	defer logging.Change(saved, 0)
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+
+	rec := adminRequest(handler, testAdminToken, "PUT", "/log-level", `{"level": "debug", "duration_seconds": 60}`)
+	var body logLevelBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", rec.Code, err)
+	}
+	if body.Level != "debug" || body.Until == nil || time.Until(*body.Until) > time.Minute {
+		t.Errorf("got %+v", body)
+	}
+	rec = adminRequest(handler, testAdminToken, "PUT", "/log-level", `{"level": "warn"}`)
+	body = logLevelBody{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Level != "warn" || body.Until != nil {
+		t.Errorf("got %+v, %v", body, err)
+	}
+	for _, s := range []string{`{"level": "verbose"}`, `{"level": "info", "duration_seconds": -1}`} {
+		if rec := adminRequest(handler, testAdminToken, "PUT", "/log-level", s); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", s, rec.Code)
+		}
+	}
+}
+
+func TestAdminVersion(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	rec := adminRequest(admin.Handler(), testAdminToken, "GET", "/version", "")
+	var body buildinfo.Info
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", rec.Code, err)
+	}
+	if body != getBuildInfo() {
+		t.Errorf("got %+v", body)
+	}
+	if rec := adminRequest(admin.Handler(), testAdminToken, "HEAD", "/version", ""); rec.Code != http.StatusOK {
+		t.Errorf("HEAD: status %d", rec.Code)
+	}
+	rec = adminRequest(admin.Handler(), testAdminToken, "PUT", "/version", "{}")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("PUT: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if rec := adminRequest(admin.Handler(), "", "GET", "/version", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d", rec.Code)
+	}
+}
+
+func FuzzParseBearerToken(f *testing.F) {
+	for _, value := range []string{"Bearer " + testAdminToken, "bearer x", "BEARER  x", "Bearer", "Bearer ", "Basic dXNlcjpwYXNz", ""} {
+		f.Add(value)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		token, ok := parseBearerToken(value)
+		if !ok {
+			if token != "" {
+				t.Fatalf("%q: not a bearer token, but got %q", value, token)
+			}
+			return
+		}
+		if !strings.HasSuffix(value, " "+token) || !strings.EqualFold(strings.TrimSuffix(value, " "+token), "Bearer") {
+			t.Fatalf("%q: got %q", value, token)
+		}
+	})
+}
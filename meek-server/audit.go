@@ -0,0 +1,106 @@
+package main
+
+// The code in this file implements the session audit log (--audit-log). It
+// gets one JSON line when a session is created and one when it is closed,
+// recording how long the session lasted, how much data it carried, and why it
+// ended. It is separate from the ordinary log so that it can be kept and
+// analyzed on its own.
+//
+// Session ids are not logged as they are. They are replaced by a keyed hash,
+// whose key is chosen randomly at startup, so that the open and close entries
+// of a session can be matched up, but the entries can't be matched with
+// session ids observed elsewhere.
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// Reasons for closing a session.
+const (
+	// No requests for maxSessionStaleness.
+	closeReasonExpired = "expired"
+	// Open for longer than --max-session-age.
+	closeReasonMaxAge = "max-age"
+	// A transaction failed, leaving the session unusable.
+	closeReasonError = "error"
+	// Closed on purpose, for example by an operator, or by either end of
+	// a WebSocket session.
+	closeReasonExplicit = "explicit"
+)
+
+type auditEntry struct {
+	Time    string `json:"time"`
+	Event   string `json:"event"`
+	Session string `json:"session"`
+	// The remaining fields are only for "close" events.
+	Reason    string  `json:"reason,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+	BytesUp   int64   `json:"bytes_up,omitempty"`
+	BytesDown int64   `json:"bytes_down,omitempty"`
+}
+
+// auditLogger writes audit entries. A nil *auditLogger discards them.
+type auditLogger struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	seed maphash.Seed
+}
+
+// The audit log, or nil if there is none. Set up in main.
+var auditLog *auditLogger
+
+func newAuditLogger(w io.Writer) *auditLogger {
+	return &auditLogger{
+		enc:  json.NewEncoder(w),
+		seed: maphash.MakeSeed(),
+	}
+}
+
+func (a *auditLogger) hashID(sessionID string) string {
+	return fmt.Sprintf("%016x", maphash.String(a.seed, sessionID))
+}
+
+func (a *auditLogger) write(entry *auditEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.enc.Encode(entry)
+	if err != nil {
+		logging.Warnf("error writing audit log: %s", err)
+	}
+}
+
+// Record the creation of a session.
+func (a *auditLogger) Open(sessionID string, session *Session) {
+	if a == nil {
+		return
+	}
+	a.write(&auditEntry{
+		Time:    session.Created.UTC().Format(time.RFC3339),
+		Event:   "open",
+		Session: a.hashID(sessionID),
+	})
+}
+
+// Record the closing of a session.
+func (a *auditLogger) Close(sessionID string, session *Session, reason string) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.write(&auditEntry{
+		Time:      now.UTC().Format(time.RFC3339),
+		Event:     "close",
+		Session:   a.hashID(sessionID),
+		Reason:    reason,
+		Duration:  now.Sub(session.Created).Round(time.Millisecond).Seconds(),
+		BytesUp:   session.BytesUp.Load(),
+		BytesDown: session.BytesDown.Load(),
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := newAuditLogger(&buf)
+
+	session := NewSession(nil)
+	a.Open("session-id-1", session)
+	session.BytesUp.Add(100)
+	session.BytesDown.Add(2000)
+	a.Close("session-id-1", session, closeReasonExpired)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, expected 2: %q", len(lines), buf.String())
+	}
+	if strings.Contains(buf.String(), "session-id-1") {
+		t.Errorf("raw session id appears in audit log")
+	}
+	var open, close auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &open); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &close); err != nil {
+		t.Fatal(err)
+	}
+	if open.Event != "open" || close.Event != "close" {
+		t.Errorf("got events %q, %q", open.Event, close.Event)
+	}
+	if open.Session != close.Session || open.Session == "" {
+		t.Errorf("session hashes %q and %q don't match", open.Session, close.Session)
+	}
+	if close.Reason != closeReasonExpired || close.BytesUp != 100 || close.BytesDown != 2000 {
+		t.Errorf("got close entry %+v", close)
+	}
+	if open.Reason != "" || open.BytesUp != 0 {
+		t.Errorf("open entry has close fields: %+v", open)
+	}
+
+	// Different ids hash differently.
+	if a.hashID("session-id-1") == a.hashID("session-id-2") {
+		t.Errorf("different session ids have the same hash")
+	}
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var a *auditLogger
+	session := NewSession(nil)
+	// Must not panic.
+	a.Open("session-id-1", session)
+	a.Close("session-id-1", session, closeReasonError)
+}
@@ -0,0 +1,289 @@
+package main
+
+// The code in this file has to do with dialing the backend: the OR port or
+// external service that session data is forwarded to. Normally the backend is
+// dialed directly, but it may also be reached through an upstream SOCKS5 or
+// HTTP proxy (--backend-proxy). The local address (--out-bind-addr) and TCP
+// options (--backend-nodelay and others) of backend connections are
+// configurable. Additional backends can be added at runtime through the admin
+// API; new sessions are spread among them.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"../lib/goptlib"
+	"golang.org/x/net/proxy"
+)
+
+// How long a CONNECT through the backend proxy may take, including the
+// connection to the proxy, when the caller has no deadline of its own.
+const backendProxyConnectTimeout = 30 * time.Second
+
+// httpConnectDialer dials through an HTTP proxy using the CONNECT method.
+// https://tools.ietf.org/html/rfc7231#section-4.3.6
+type httpConnectDialer struct {
+	addr    string
+	auth    *proxy.Auth
+	forward proxy.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendProxyConnectTimeout)
+	defer cancel()
+	return d.DialContext(ctx, network, addr)
+}
+
+// Dial addr through the proxy. The CONNECT is abandoned, and the connection to
+// the proxy closed, if ctx is done before the proxy answers.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		connectReq.Header.Set("Proxy-Authorization", "basic "+
+			base64.StdEncoding.EncodeToString([]byte(d.auth.User+":"+d.auth.Password)))
+	}
+
+	var conn net.Conn
+	var err error
+	if forward, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = forward.DialContext(ctx, network, d.addr)
+	} else {
+		conn, err = d.forward.Dial(network, d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fail := func(err error) (net.Conn, error) {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	err = connectReq.Write(conn)
+	if err != nil {
+		return fail(err)
+	}
+	// Reading the response through a bufio.Reader is okay because the
+	// backend does not speak until spoken to, so nothing past the end of
+	// the response will have been buffered.
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		return fail(err)
+	}
+	if resp.StatusCode != 200 || br.Buffered() != 0 {
+		return fail(fmt.Errorf("backend proxy returned %q", resp.Status))
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Make a dialer that goes through the proxy at u, which must have a "socks5"
+// or "http" scheme. Connections to the proxy itself are made with forward.
+func makeBackendProxyDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{User: u.User.Username()}
+		auth.Password, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5":
+		return proxy.SOCKS5("tcp", u.Host, auth, forward)
+	case "http":
+		return &httpConnectDialer{addr: u.Host, auth: auth, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("don't understand backend proxy URL scheme %q", u.Scheme)
+	}
+}
+
+// tunedDialer is a net.Dialer that additionally sets TCP options on each
+// connection it makes. The keep-alive period is controlled by the embedded
+// Dialer's KeepAlive field.
+type tunedDialer struct {
+	net.Dialer
+	// Disable Nagle's algorithm. Backend writes are small and bursty, and
+	// delaying them only adds latency.
+	NoDelay bool
+	// Socket buffer sizes; 0 means the operating system default.
+	SendBuffer    int
+	ReceiveBuffer int
+}
+
+func (d *tunedDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		err = d.tune(tc)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (d *tunedDialer) tune(conn *net.TCPConn) error {
+	err := conn.SetNoDelay(d.NoDelay)
+	if err != nil {
+		return err
+	}
+	if d.SendBuffer > 0 {
+		err = conn.SetWriteBuffer(d.SendBuffer)
+		if err != nil {
+			return err
+		}
+	}
+	if d.ReceiveBuffer > 0 {
+		err = conn.SetReadBuffer(d.ReceiveBuffer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The dialer that makes the TCP connections to the backend (or to the
+// backend proxy). Configured in main.
+var backendTCPDialer = &tunedDialer{NoDelay: true}
+
+// The dialer used for backend connections: backendTCPDialer, possibly wrapped
+// in a proxy dialer. Set up in main.
+var backendDialer proxy.Dialer = backendTCPDialer
+
+// backendPool is a list of backend addresses that can be changed at runtime.
+// New sessions are assigned to the addresses in turn; existing sessions keep
+// the backend connection they have. When the list is empty, new sessions go to
+// the OR port or extended OR port that tor configured.
+type backendPool struct {
+	lock  sync.Mutex
+	addrs []string
+	next  int
+}
+
+// The backends added through the admin API.
+var backends backendPool
+
+// Add a backend address. It is an error to add one twice.
+func (pool *backendPool) Add(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for _, a := range pool.addrs {
+		if a == addr {
+			return fmt.Errorf("backend %s already present", addr)
+		}
+	}
+	pool.addrs = append(pool.addrs, addr)
+	return nil
+}
+
+// Remove a backend address. Returns false if it was not present.
+func (pool *backendPool) Remove(addr string) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for i, a := range pool.addrs {
+		if a == addr {
+			pool.addrs = append(pool.addrs[:i], pool.addrs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Return a copy of the list of backend addresses.
+func (pool *backendPool) List() []string {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return append([]string{}, pool.addrs...)
+}
+
+// Return the number of backend addresses.
+func (pool *backendPool) Len() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.addrs)
+}
+
+// Return the next backend address, or "" if there are none.
+func (pool *backendPool) pick() string {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if len(pool.addrs) == 0 {
+		return ""
+	}
+	pool.next %= len(pool.addrs)
+	addr := pool.addrs[pool.next]
+	pool.next++
+	return addr
+}
+
+// Return the address of the OR port or extended OR port that tor configured.
+func orBackendAddr() string {
+	if ptInfo.ExtendedOrAddr != nil && ptInfo.AuthCookiePath != "" {
+		return ptInfo.ExtendedOrAddr.String()
+	}
+	return ptInfo.OrAddr.String()
+}
+
+// Dial the backend for a new session, passing useraddr and the transport method
+// name on to the extended OR port if there is one. A method with a backend of
+// its own (see transports.go) always uses it. Backends added at runtime, and
+// those of methods, are plain TCP services and don't get either. Backends
+// whose circuit is open (see breaker.go) are skipped.
+func dialBackend(useraddr, methodName string) (net.Conn, error) {
+	var conn net.Conn
+	err := errBackendUnavailable
+	if t := transportConfig(methodName); t != nil && t.Backend != "" {
+		if cb := backendBreaker(t.Backend); cb.Allow() {
+			conn, err = backendDialer.Dial("tcp", t.Backend)
+			cb.Record(err)
+		}
+	} else if n := backends.Len(); n > 0 {
+		for i := 0; i < n; i++ {
+			addr := backends.pick()
+			cb := backendBreaker(addr)
+			if !cb.Allow() {
+				continue
+			}
+			conn, err = backendDialer.Dial("tcp", addr)
+			cb.Record(err)
+			break
+		}
+	} else if cb := backendBreaker(orBackendAddr()); cb.Allow() {
+		conn, err = pt.DialOrWithDialer(backendDialer, &ptInfo, useraddr, methodName)
+		cb.Record(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.SpillDir != "" {
+		return newSpillConn(newCountedConn(conn), options.SpillDir, options.SpillMax, options.SpillTotalMax), nil
+	}
+	return newCountedConn(conn), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+// The code in this file implements bandwidth accounting. The bytes carried
+// between clients and the backend, in both directions, are totaled per UTC
+// day and per UTC calendar month. When run by tor, the totals are saved in
+// the pluggable transport state directory (meek-bandwidth.json), so they
+// survive restarts. The heartbeat logs them.
+//
+// With --bandwidth-budget, once the month's total reaches the budget, the
+// server stops accepting new sessions until the next month, giving requests
+// that would create one a decoy response. Existing sessions continue, so the
+// budget may be overshot by what they carry.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The name of the file in the state directory.
+	bandwidthStateFilename = "meek-bandwidth.json"
+	// How often to save the totals.
+	bandwidthSaveInterval = time.Minute
+)
+
+// Returned by GetSession when the monthly budget is used up.
+var errBandwidthBudget = errors.New("monthly bandwidth budget used up; refusing new session")
+
+// The saved form of the totals.
+type bandwidthTotals struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// bandwidthAccount keeps the totals. A nil *bandwidthAccount ignores
+// everything.
+type bandwidthAccount struct {
+	// The file to save totals in, or "" to keep them only in memory.
+	path string
+	// The monthly budget in bytes; 0 means no budget.
+	budget int64
+	now    func() time.Time
+
+	lock   sync.Mutex
+	totals bandwidthTotals
+	// Whether the budget was used up when last checked, to log changes.
+	exhausted bool
+}
+
+// The bandwidth account, or nil if there is none. Set up in main.
+var bandwidthAcct *bandwidthAccount
+
+// Make a bandwidthAccount, loading any totals saved in path.
+func newBandwidthAccount(path string, budget int64) (*bandwidthAccount, error) {
+	acct := &bandwidthAccount{path: path, budget: budget, now: time.Now}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &acct.totals)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return acct, nil
+}
+
+// Start new totals if the day or month has changed. Must be called with the
+// lock held.
+func (acct *bandwidthAccount) roll() {
+	now := acct.now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if acct.totals.Day != day {
+		if acct.totals.Day != "" {
+			logging.Infof("bandwidth on %s: %d bytes", acct.totals.Day, acct.totals.DayBytes)
+		}
+		acct.totals.Day, acct.totals.DayBytes = day, 0
+	}
+	if acct.totals.Month != month {
+		if acct.totals.Month != "" {
+			logging.Infof("bandwidth in %s: %d bytes", acct.totals.Month, acct.totals.MonthBytes)
+		}
+		acct.totals.Month, acct.totals.MonthBytes = month, 0
+	}
+}
+
+// Count n bytes carried.
+func (acct *bandwidthAccount) Add(n int64) {
+	if acct == nil || n == 0 {
+		return
+	}
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.roll()
+	acct.totals.DayBytes += n
+	acct.totals.MonthBytes += n
+}
+
+// Return the current totals.
+func (acct *bandwidthAccount) Totals() bandwidthTotals {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.roll()
+	return acct.totals
+}
+
+// Return true if the monthly budget is used up.
+func (acct *bandwidthAccount) Exhausted() bool {
+	if acct == nil || acct.budget <= 0 {
+		return false
+	}
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.roll()
+	exhausted := acct.totals.MonthBytes >= acct.budget
+	if exhausted != acct.exhausted {
+		acct.exhausted = exhausted
+		if exhausted {
+			logging.Warnf("bandwidth budget of %d bytes for %s used up; refusing new sessions", acct.budget, acct.totals.Month)
+		} else {
+			logging.Infof("bandwidth budget available for %s; accepting new sessions", acct.totals.Month)
+		}
+	}
+	return exhausted
+}
+
+// Write the totals to the state file.
+func (acct *bandwidthAccount) Save() error {
+	if acct == nil || acct.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(acct.Totals())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(acct.path, data, 0600)
+}
+
+// Save the totals every interval, forever.
+func (acct *bandwidthAccount) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := acct.Save()
+		if err != nil {
+			logging.Warnf("error saving bandwidth totals: %s", err)
+		}
+	}
+}
+
+// Parse a byte count with an optional K, M, G, or T suffix (powers of 1024),
+// like "500G".
+func parseByteSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	multiplier := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad byte size %q", size)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected int64
+	}{
+		{"12345", 12345},
+		{"4K", 4 << 10},
+		{"100m", 100 << 20},
+		{"1.5G", 3 << 29},
+		{"2T", 2 << 40},
+	} {
+		n, err := parseByteSize(test.input)
+		if err != nil || n != test.expected {
+			t.Errorf("%q: got %d, %v; expected %d", test.input, n, err, test.expected)
+		}
+	}
+	for _, input := range []string{"", "G", "-1G", "10X"} {
+		if _, err := parseByteSize(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestBandwidthAccount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), bandwidthStateFilename)
+	now := time.Date(2017, 3, 31, 23, 0, 0, 0, time.UTC)
+	acct, err := newBandwidthAccount(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct.now = func() time.Time { return now }
+
+	acct.Add(600)
+	if acct.Exhausted() {
+		t.Errorf("exhausted at 600 of 1000")
+	}
+	acct.Add(400)
+	if !acct.Exhausted() {
+		t.Errorf("not exhausted at 1000 of 1000")
+	}
+
+	// The totals survive a restart.
+	if err := acct.Save(); err != nil {
+		t.Fatal(err)
+	}
+	acct, err = newBandwidthAccount(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct.now = func() time.Time { return now }
+	if totals := acct.Totals(); totals.Day != "2017-03-31" || totals.DayBytes != 1000 || totals.MonthBytes != 1000 {
+		t.Errorf("after reload: %+v", totals)
+	}
+	if !acct.Exhausted() {
+		t.Errorf("not exhausted after reload")
+	}
+
+	// A new month starts over.
+	now = now.Add(2 * time.Hour)
+	if acct.Exhausted() {
+		t.Errorf("exhausted in a new month")
+	}
+	if totals := acct.Totals(); totals.Month != "2017-04" || totals.MonthBytes != 0 || totals.DayBytes != 0 {
+		t.Errorf("new month: %+v", totals)
+	}
+
+	// A nil account ignores everything.
+	var none *bandwidthAccount
+	none.Add(1)
+	if none.Exhausted() {
+		t.Errorf("nil account exhausted")
+	}
+	if err := none.Save(); err != nil {
+		t.Errorf("nil account Save: %v", err)
+	}
+}
+
+func TestGetSessionBandwidthBudget(t *testing.T) {
+	defer func() { bandwidthAcct = nil }()
+	var err error
+	bandwidthAcct, err = newBandwidthAccount("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bandwidthAcct.Add(100)
+
+	state := NewState()
+	_, err = state.GetSession("Y2FyZ28gdHJ1Y2s", newBindingRequest("192.0.2.1:1234"))
+	if err != errBandwidthBudget {
+		t.Errorf("got %v, expected %v", err, errBandwidthBudget)
+	}
+}
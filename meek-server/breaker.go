@@ -0,0 +1,147 @@
+package main
+
+// The code in this file implements circuit breaking for backend connections.
+// When a backend (the OR port, or a backend added through the admin API) is
+// down, for example while the external service restarts, every new session
+// would otherwise wait for a failing dial, over and over under load. Instead,
+// after breakerThreshold dials in a row have failed, the backend's circuit
+// "opens": further dials fail at once with errBackendUnavailable, and sessions
+// go to another backend if there is one. Meanwhile the backend is probed in
+// the background, with exponential backoff between breakerMinBackoff and
+// breakerMaxBackoff, and the circuit closes again as soon as a probe connects.
+// Removing a backend through the admin API discards its breaker and stops the
+// probing.
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// Consecutive dial failures that open a circuit.
+	breakerThreshold = 3
+	// The first and longest delays between recovery probes.
+	breakerMinBackoff = 1 * time.Second
+	breakerMaxBackoff = 1 * time.Minute
+)
+
+// Returned by dialBackend when every backend's circuit is open.
+var errBackendUnavailable = errors.New("backend unavailable; waiting for it to recover")
+
+// circuitBreaker tracks the health of one backend.
+type circuitBreaker struct {
+	addr string
+	// Try to connect to the backend, for recovery probes.
+	probe func(addr string) error
+
+	// Closed when the backend is removed, to stop recovery probes. May be
+	// nil, in which case probing never stops early.
+	stop chan struct{}
+
+	lock     sync.Mutex
+	failures int
+	open     bool
+	removed  bool
+}
+
+// Return true if the backend may be dialed.
+func (cb *circuitBreaker) Allow() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return !cb.open
+}
+
+// Record the outcome of a dial.
+func (cb *circuitBreaker) Record(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if err == nil {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= breakerThreshold && !cb.open && !cb.removed {
+		cb.open = true
+		logging.Warnf("backend %s failed %d times in a row; not dialing it until it recovers: %s", cb.addr, cb.failures, scrubError(err))
+		go cb.recover()
+	}
+}
+
+// Probe the backend, with exponential backoff, until it can be reached, then
+// close the circuit.
+func (cb *circuitBreaker) recover() {
+	backoff := breakerMinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-cb.stop:
+			timer.Stop()
+			logging.Debugf("backend %s removed; no longer probing it", cb.addr)
+			return
+		}
+		err := cb.probe(cb.addr)
+		if err == nil {
+			break
+		}
+		logging.Debugf("backend %s still unavailable: %s", cb.addr, scrubError(err))
+		backoff *= 2
+		if backoff > breakerMaxBackoff {
+			backoff = breakerMaxBackoff
+		}
+	}
+	cb.lock.Lock()
+	cb.open = false
+	cb.failures = 0
+	cb.lock.Unlock()
+	logging.Infof("backend %s recovered", cb.addr)
+}
+
+// Connect to addr through backendDialer and hang up.
+func probeBackend(addr string) error {
+	conn, err := backendDialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+var (
+	breakersLock sync.Mutex
+	breakers     = make(map[string]*circuitBreaker)
+)
+
+// Return the circuit breaker for addr, creating it if necessary.
+func backendBreaker(addr string) *circuitBreaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	cb := breakers[addr]
+	if cb == nil {
+		cb = &circuitBreaker{addr: addr, probe: probeBackend, stop: make(chan struct{})}
+		breakers[addr] = cb
+	}
+	return cb
+}
+
+// Discard the circuit breaker for addr, if there is one, stopping any
+// recovery probes.
+func removeBackendBreaker(addr string) {
+	breakersLock.Lock()
+	cb := breakers[addr]
+	delete(breakers, addr)
+	breakersLock.Unlock()
+	if cb == nil {
+		return
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if !cb.removed {
+		cb.removed = true
+		if cb.stop != nil {
+			close(cb.stop)
+		}
+	}
+}
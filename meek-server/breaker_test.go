@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	probed := make(chan struct{}, 1)
+	cb := &circuitBreaker{addr: "192.0.2.1:9001", probe: func(addr string) error {
+		probed <- struct{}{}
+		return nil
+	}}
+	dialErr := errors.New("connection refused")
+
+	// Failures below the threshold, and a success that resets the count,
+	// leave the circuit closed.
+	for i := 0; i < breakerThreshold-1; i++ {
+		cb.Record(dialErr)
+	}
+	cb.Record(nil)
+	for i := 0; i < breakerThreshold-1; i++ {
+		cb.Record(dialErr)
+	}
+	if !cb.Allow() {
+		t.Fatalf("open after %d failures", breakerThreshold-1)
+	}
+
+	cb.Record(dialErr)
+	if cb.Allow() {
+		t.Fatalf("closed after %d failures", breakerThreshold)
+	}
+
+	// The background probe succeeds, closing the circuit again.
+	select {
+	case <-probed:
+	case <-time.After(breakerMinBackoff + 5*time.Second):
+		t.Fatal("no recovery probe")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !cb.Allow() {
+		if time.Now().After(deadline) {
+			t.Fatal("still open after a successful probe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendBreakerRegistry(t *testing.T) {
+	a := backendBreaker("192.0.2.1:9001")
+	if backendBreaker("192.0.2.1:9001") != a {
+		t.Errorf("different breakers for the same address")
+	}
+	if backendBreaker("192.0.2.2:9001") == a {
+		t.Errorf("same breaker for different addresses")
+	}
+}
+
+// Test that removing a backend discards its breaker and stops the recovery
+// probes of an open circuit.
+func TestRemoveBackendBreaker(t *testing.T) {
+	const addr = "192.0.2.3:9001"
+	probed := make(chan struct{}, 10)
+	cb := backendBreaker(addr)
+	cb.probe = func(addr string) error {
+		probed <- struct{}{}
+		return errors.New("connection refused")
+	}
+	for i := 0; i < breakerThreshold; i++ {
+		cb.Record(errors.New("connection refused"))
+	}
+	if cb.Allow() {
+		t.Fatalf("closed after %d failures", breakerThreshold)
+	}
+
+	removeBackendBreaker(addr)
+	breakersLock.Lock()
+	_, ok := breakers[addr]
+	breakersLock.Unlock()
+	if ok {
+		t.Errorf("breaker still registered after removal")
+	}
+	if backendBreaker(addr) == cb {
+		t.Errorf("same breaker after removal")
+	}
+	select {
+	case <-probed:
+		t.Errorf("probed after removal")
+	case <-time.After(breakerMinBackoff + 500*time.Millisecond):
+	}
+
+	// Failures recorded by dials that were under way don't start probing
+	// again.
+	for i := 0; i < breakerThreshold; i++ {
+		cb.Record(errors.New("connection refused"))
+	}
+	removeBackendBreaker(addr)
+}
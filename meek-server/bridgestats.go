@@ -0,0 +1,147 @@
+package main
+
+// The code in this file implements the bridge statistics file
+// (--bridge-stats). At the end of each UTC day, it appends the number of unique
+// client IP addresses seen during the day, in the format of the bridge
+// statistics lines of tor's extra-info descriptors (see dir-spec.txt), which
+// is what CollecTor and Tor Metrics consume:
+//	bridge-stats-end 2017-03-22 00:00:00 (86400 s)
+//	bridge-ips us=16,de=8
+//	bridge-ip-versions v4=24,v6=8
+//	bridge-ip-transports meek=32
+// With --transports, bridge-ip-transports has a count for each method name.
+// As in tor, counts are rounded up to a multiple of 8. Countries come from
+// --geoip and --geoip6, and are "??" without them. Unique addresses are
+// counted with the same kind of keyed HyperLogLog sketch as the heartbeat's
+// unique client estimate, so no address is stored.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// The length of a statistics interval.
+const bridgeStatsInterval = 24 * time.Hour
+
+// bridgeStats counts unique client addresses for the bridge statistics file.
+// A nil *bridgeStats ignores everything.
+type bridgeStats struct {
+	db *geoIPDB
+	w  io.Writer
+
+	lock      sync.Mutex
+	countries map[string]*uniqueCounter
+	v4, v6    *uniqueCounter
+	// Counters by transport method name.
+	transports map[string]*uniqueCounter
+}
+
+// The bridge statistics, or nil if there is no --bridge-stats. Set up in
+// main.
+var bridgeStatsLog *bridgeStats
+
+// Make a bridgeStats that writes to w. db may be nil.
+func newBridgeStats(db *geoIPDB, w io.Writer) *bridgeStats {
+	bs := &bridgeStats{db: db, w: w}
+	bs.reset()
+	return bs
+}
+
+func (bs *bridgeStats) reset() {
+	bs.countries = make(map[string]*uniqueCounter)
+	bs.v4 = newUniqueCounter()
+	bs.v6 = newUniqueCounter()
+	bs.transports = make(map[string]*uniqueCounter)
+}
+
+// Record a client address that came to the listener of a transport method.
+func (bs *bridgeStats) Add(ip net.IP, methodName string) {
+	if bs == nil {
+		return
+	}
+	country := unknownCountry
+	if bs.db != nil {
+		country = bs.db.Country(ip)
+	}
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	c := bs.countries[country]
+	if c == nil {
+		c = newUniqueCounter()
+		bs.countries[country] = c
+	}
+	c.Add(ip)
+	if ip.To4() != nil {
+		bs.v4.Add(ip)
+	} else {
+		bs.v6.Add(ip)
+	}
+	t := bs.transports[methodName]
+	if t == nil {
+		t = newUniqueCounter()
+		bs.transports[methodName] = t
+	}
+	t.Add(ip)
+}
+
+// Format the statistics for the interval ending at end, and reset the counts.
+func (bs *bridgeStats) format(end time.Time) string {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	type entry struct {
+		country string
+		n       uint64
+	}
+	entries := make([]entry, 0, len(bs.countries))
+	for country, c := range bs.countries {
+		entries = append(entries, entry{country, uint64(binCount(int64(c.Estimate())))})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].n != entries[j].n {
+			return entries[i].n > entries[j].n
+		}
+		return entries[i].country < entries[j].country
+	})
+	ips := make([]string, len(entries))
+	for i, e := range entries {
+		ips[i] = fmt.Sprintf("%s=%d", e.country, e.n)
+	}
+
+	// There is always a count for ptMethodName, even if it is 0.
+	if bs.transports[ptMethodName] == nil {
+		bs.transports[ptMethodName] = newUniqueCounter()
+	}
+	var transports []string
+	for name, t := range bs.transports {
+		transports = append(transports, fmt.Sprintf("%s=%d", name, binCount(int64(t.Estimate()))))
+	}
+	sort.Strings(transports)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "bridge-stats-end %s (%d s)\n", end.UTC().Format("2006-01-02 15:04:05"), int(bridgeStatsInterval.Seconds()))
+	fmt.Fprintf(&b, "bridge-ips %s\n", strings.Join(ips, ","))
+	fmt.Fprintf(&b, "bridge-ip-versions v4=%d,v6=%d\n",
+		binCount(int64(bs.v4.Estimate())), binCount(int64(bs.v6.Estimate())))
+	fmt.Fprintf(&b, "bridge-ip-transports %s\n", strings.Join(transports, ","))
+	bs.reset()
+	return b.String()
+}
+
+// Write the statistics for the interval ending at end, and reset the counts.
+func (bs *bridgeStats) Flush(end time.Time) {
+	if bs == nil {
+		return
+	}
+	_, err := io.WriteString(bs.w, bs.format(end))
+	if err != nil {
+		logging.Warnf("error writing bridge statistics: %s", err)
+	}
+}
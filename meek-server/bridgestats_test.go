@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBridgeStats(t *testing.T) {
+	var db geoIPDB
+	if err := db.load4(strings.NewReader(testGeoIP4)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	bs := newBridgeStats(&db, &out)
+	// 10 addresses in us, 1 in de (seen twice), and 1 IPv6 of unknown
+	// country that came to another transport.
+	for i := 0; i < 10; i++ {
+		bs.Add(net.ParseIP(fmt.Sprintf("192.0.2.%d", i)), ptMethodName)
+	}
+	bs.Add(net.ParseIP("198.51.100.1"), ptMethodName)
+	bs.Add(net.ParseIP("198.51.100.1"), ptMethodName)
+	bs.Add(net.ParseIP("2001:db8::1"), "meek_lite")
+
+	bs.Flush(time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC))
+	expected := "bridge-stats-end 2017-03-22 00:00:00 (86400 s)\n" +
+		"bridge-ips us=16,??=8,de=8\n" +
+		"bridge-ip-versions v4=16,v6=8\n" +
+		"bridge-ip-transports meek=16,meek_lite=8\n"
+	if out.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", out.String(), expected)
+	}
+
+	// Counts start over for the next interval.
+	out.Reset()
+	bs.Flush(time.Date(2017, 3, 23, 0, 0, 0, 0, time.UTC))
+	if !strings.Contains(out.String(), "bridge-ip-transports meek=0\n") {
+		t.Errorf("after reset:\n%s", out.String())
+	}
+
+	// A nil *bridgeStats ignores everything.
+	var none *bridgeStats
+	none.Add(net.ParseIP("192.0.2.1"), ptMethodName)
+	none.Flush(time.Now())
+}
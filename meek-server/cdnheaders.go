@@ -0,0 +1,186 @@
+package main
+
+// The code in this file adds response headers like those of a CDN edge or a
+// caching proxy (--cdn-headers). Behind a CDN, every response a client sees
+// has gone through the edge, which adds headers such as Via, X-Cache, Age, and
+// request ids. A prober that finds the origin and connects to it directly
+// would see responses without any of them, unlike the same site fetched
+// through the CDN. With --cdn-headers, the origin adds plausible headers of
+// the chosen kind itself. (The CDN, for responses that do go through it,
+// replaces or adds to them as it normally would.)
+//
+// A GET or HEAD that succeeds is reported as a cache hit, with an Age that
+// grows and starts over every hour, as if the edge refetched the path once an
+// hour; everything else is reported as a miss or as uncacheable.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The time for which a cache entry seems to live, for computing Age.
+const cdnCacheLifetime = time.Hour
+
+// Points of presence, by IATA airport code, to choose from when --cdn-pop is
+// not given.
+var cdnPOPs = []string{"AMS", "ARN", "CDG", "FRA", "IAD", "LAX", "LHR", "NRT", "ORD", "SIN"}
+
+// A --cdn-pop value.
+var cdnPOPRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// The headers of one kind of edge for a response: whether it was a cache hit,
+// the Age for a hit, the point of presence, and the current time.
+type cdnProfile func(h http.Header, hit bool, age int, pop string, now time.Time)
+
+// The kinds of edge that --cdn-headers can imitate.
+var cdnProfiles = map[string]cdnProfile{
+	"cloudflare": func(h http.Header, hit bool, age int, pop string, now time.Time) {
+		h.Set("Server", "cloudflare")
+		h.Set("CF-Ray", fmt.Sprintf("%016x-%s", rand.Uint64(), pop))
+		if hit {
+			h.Set("CF-Cache-Status", "HIT")
+			h.Set("Age", strconv.Itoa(age))
+		} else {
+			h.Set("CF-Cache-Status", "DYNAMIC")
+		}
+	},
+	"cloudfront": func(h http.Header, hit bool, age int, pop string, now time.Time) {
+		h.Set("Via", fmt.Sprintf("1.1 %016x%016x.cloudfront.net (CloudFront)", rand.Uint64(), rand.Uint64()))
+		h.Set("X-Amz-Cf-Pop", fmt.Sprintf("%s%d-C%d", pop, 50+rand.Intn(10), 1+rand.Intn(2)))
+		h.Set("X-Amz-Cf-Id", cdnRandomID(56))
+		if hit {
+			h.Set("X-Cache", "Hit from cloudfront")
+			h.Set("Age", strconv.Itoa(age))
+		} else {
+			h.Set("X-Cache", "Miss from cloudfront")
+		}
+	},
+	"fastly": func(h http.Header, hit bool, age int, pop string, now time.Time) {
+		h.Set("Via", "1.1 varnish")
+		h.Set("X-Served-By", fmt.Sprintf("cache-%s%d-%s", strings.ToLower(pop), 1000000+rand.Intn(9000000), pop))
+		h.Set("X-Timer", fmt.Sprintf("S%d.%06d,VS0,VE%d", now.Unix(), now.Nanosecond()/1000, rand.Intn(3)))
+		if hit {
+			h.Set("X-Cache", "HIT")
+			h.Set("X-Cache-Hits", strconv.Itoa(1+age/30))
+			h.Set("Age", strconv.Itoa(age))
+		} else {
+			h.Set("X-Cache", "MISS")
+			h.Set("X-Cache-Hits", "0")
+			h.Set("Age", "0")
+		}
+	},
+	"varnish": func(h http.Header, hit bool, age int, pop string, now time.Time) {
+		h.Set("Via", "1.1 varnish (Varnish/7.1)")
+		id := 100000000 + rand.Intn(900000000)
+		if hit {
+			h.Set("X-Varnish", fmt.Sprintf("%d %d", id, id-1-rand.Intn(1000000)))
+			h.Set("X-Cache", "HIT")
+			h.Set("Age", strconv.Itoa(age))
+		} else {
+			h.Set("X-Varnish", strconv.Itoa(id))
+			h.Set("X-Cache", "MISS")
+			h.Set("Age", "0")
+		}
+	},
+}
+
+// Return the names of the kinds of edge, sorted.
+func cdnProfileNames() []string {
+	var names []string
+	for name := range cdnProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check --cdn-headers and --cdn-pop values.
+func checkCDNHeaders(profile, pop string) error {
+	if _, ok := cdnProfiles[profile]; profile != "" && !ok {
+		return fmt.Errorf("unknown kind %q; must be one of %s", profile, strings.Join(cdnProfileNames(), ", "))
+	}
+	if pop != "" && !cdnPOPRegexp.MatchString(pop) {
+		return fmt.Errorf("point of presence %q is not a three-letter code like FRA", pop)
+	}
+	return nil
+}
+
+// Return a random string of n letters and digits, like a CloudFront request id.
+func cdnRandomID(n int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// Return the Age of a cached copy of path at now: the time since the start of
+// the current cache lifetime, which begins at a different offset for each
+// path.
+func cdnAge(path string, now time.Time) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	lifetime := int64(cdnCacheLifetime / time.Second)
+	return int((now.Unix() + int64(h.Sum32())) % lifetime)
+}
+
+// cdnResponseWriter adds the headers of a profile just before the response
+// header is written, when the status is known.
+type cdnResponseWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	profile     cdnProfile
+	pop         string
+	wroteHeader bool
+}
+
+func (w *cdnResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		now := time.Now()
+		hit := (w.req.Method == "GET" || w.req.Method == "HEAD") && code < 400
+		w.profile(w.Header(), hit, cdnAge(w.req.URL.Path, now), w.pop, now)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cdnResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Return the underlying ResponseWriter, for http.ResponseController.
+func (w *cdnResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Wrap handler so that its responses have the headers of the named profile,
+// with pop as the point of presence (or a random one if pop is ""). Returns
+// handler itself if profile is "". WebSocket requests, which need the
+// connection hijacked, are passed through.
+func cdnHeaders(handler http.Handler, profile, pop string) http.Handler {
+	if profile == "" {
+		return handler
+	}
+	if pop == "" {
+		pop = cdnPOPs[rand.Intn(len(cdnPOPs))]
+	}
+	p := cdnProfiles[profile]
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isWebSocketRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		handler.ServeHTTP(&cdnResponseWriter{ResponseWriter: w, req: req, profile: p, pop: pop}, req)
+	})
+}
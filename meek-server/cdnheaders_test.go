@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCheckCDNHeaders(t *testing.T) {
+	for _, test := range []struct {
+		Profile, Pop string
+		OK           bool
+	}{
+		{"", "", true},
+		{"cloudflare", "", true},
+		{"fastly", "FRA", true},
+		{"akamai", "", false},
+		{"varnish", "fra", false},
+		{"varnish", "FRAN", false},
+	} {
+		err := checkCDNHeaders(test.Profile, test.Pop)
+		if (err == nil) != test.OK {
+			t.Errorf("%q %q: got %v", test.Profile, test.Pop, err)
+		}
+	}
+}
+
+func TestCDNHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	for _, test := range []struct {
+		Profile string
+		Method  string
+		Path    string
+		// Headers whose values must match.
+		Headers map[string]string
+	}{
+		{"cloudflare", "GET", "/", map[string]string{
+			"Server":          `^cloudflare$`,
+			"CF-Ray":          `^[0-9a-f]{16}-AMS$`,
+			"CF-Cache-Status": `^HIT$`,
+			"Age":             `^[0-9]+$`,
+		}},
+		{"cloudflare", "POST", "/", map[string]string{
+			"CF-Cache-Status": `^DYNAMIC$`,
+			"Age":             `^$`,
+		}},
+		{"cloudfront", "GET", "/missing", map[string]string{
+			"Via":          `^1\.1 [0-9a-f]{32}\.cloudfront\.net \(CloudFront\)$`,
+			"X-Cache":      `^Miss from cloudfront$`,
+			"X-Amz-Cf-Pop": `^AMS[0-9]{2}-C[12]$`,
+			"X-Amz-Cf-Id":  `^[A-Za-z0-9]{56}$`,
+		}},
+		{"fastly", "HEAD", "/", map[string]string{
+			"X-Served-By": `^cache-ams[0-9]{7}-AMS$`,
+			"X-Cache":     `^HIT$`,
+			"X-Timer":     `^S[0-9]+\.[0-9]{6},VS0,VE[0-9]$`,
+		}},
+		{"varnish", "GET", "/", map[string]string{
+			"X-Varnish": `^[0-9]{9} [0-9]+$`,
+			"X-Cache":   `^HIT$`,
+		}},
+		{"varnish", "POST", "/", map[string]string{
+			"X-Varnish": `^[0-9]{9}$`,
+			"Age":       `^0$`,
+		}},
+	} {
+		rec := httptest.NewRecorder()
+		cdnHeaders(handler, test.Profile, "AMS").ServeHTTP(rec, httptest.NewRequest(test.Method, test.Path, nil))
+		for name, pattern := range test.Headers {
+			if value := rec.Header().Get(name); !regexp.MustCompile(pattern).MatchString(value) {
+				t.Errorf("%s %s %s: %s: %q does not match %q", test.Profile, test.Method, test.Path, name, value, pattern)
+			}
+		}
+	}
+
+	// No profile means no change.
+	rec := httptest.NewRecorder()
+	cdnHeaders(handler, "", "").ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if len(rec.Header()) != 1 {
+		t.Errorf("headers added without a profile: %v", rec.Header())
+	}
+}
+
+// Age grows with time and starts over after the cache lifetime.
+func TestCDNAge(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	age := cdnAge("/", now)
+	if age < 0 || age >= int(cdnCacheLifetime/time.Second) {
+		t.Fatalf("age %d out of range", age)
+	}
+	later := cdnAge("/", now.Add(10*time.Second))
+	if later != age+10 && later != age+10-int(cdnCacheLifetime/time.Second) {
+		t.Errorf("age %d, 10 s later %d", age, later)
+	}
+	if next := cdnAge("/", now.Add(cdnCacheLifetime)); next != age {
+		t.Errorf("age %d, one lifetime later %d", age, next)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+// The code in this file implements "meek-server check", which checks a
+// configuration without starting the server, for use in deployment scripts.
+// It takes the same options as a normal run and checks, offline, that the
+// options are consistent, that the certificate is valid and not about to
+// expire, and that mask content exists; and, online, that the listening ports
+// can be bound and that the backend can be dialed. Each check prints one line.
+// The exit status is nonzero if any check failed.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// Warn about a certificate that expires sooner than this.
+	certExpiryWarning = 14 * 24 * time.Hour
+	// How long to wait when dialing the backend.
+	checkDialTimeout = 10 * time.Second
+)
+
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkOK:
+		return "ok"
+	case checkWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// The outcome of one check. Message says what was found and, if something is
+// wrong, what to do about it.
+type checkResult struct {
+	Status  checkStatus
+	Name    string
+	Message string
+}
+
+func checkOKf(name, format string, v ...interface{}) checkResult {
+	return checkResult{checkOK, name, fmt.Sprintf(format, v...)}
+}
+
+func checkWarnf(name, format string, v ...interface{}) checkResult {
+	return checkResult{checkWarn, name, fmt.Sprintf(format, v...)}
+}
+
+func checkFailf(name, format string, v ...interface{}) checkResult {
+	return checkResult{checkFail, name, fmt.Sprintf(format, v...)}
+}
+
+// The parts of the configuration that live in local variables of main rather
+// than in options.
+type checkConfig struct {
+	DisableTLS       bool
+	CertFilename     string
+	KeyFilename      string
+	ACMEHostnames    []string
+	ACMEEmail        string
+	ACMECacheDir     string
+	ECHPublicName    string
+	Port             int
+	Transports       []serverTransport
+	ListenUnix       string
+	SocksPort        string
+	ExternalService  string
+	LogFilename      string
+	AuditLogFilename string
+}
+
+// Ways of setting up TLS, as returned by tlsMode.
+const (
+	tlsModeDisabled = "disabled"
+	tlsModeFiles    = "files"
+	tlsModeACME     = "acme"
+)
+
+// Work out which way of setting up TLS the options ask for, or return an error
+// saying what to fix if they conflict. Doesn't look at any files.
+func tlsMode(cfg *checkConfig) (string, error) {
+	haveACME := len(cfg.ACMEHostnames) > 0 || cfg.ACMEEmail != ""
+	haveFiles := cfg.CertFilename != "" || cfg.KeyFilename != ""
+	switch {
+	case cfg.DisableTLS:
+		if haveACME || haveFiles {
+			return "", fmt.Errorf("--acme-email, --acme-hostnames, --cert, and --key are not allowed with --disable-tls; remove them")
+		}
+		if cfg.ECHPublicName != "" {
+			return "", fmt.Errorf("--ech-public-name is not allowed with --disable-tls")
+		}
+		return tlsModeDisabled, nil
+	case haveFiles:
+		if haveACME {
+			return "", fmt.Errorf("--cert and --key are not allowed with --acme-email or --acme-hostnames; use one or the other")
+		}
+		if cfg.CertFilename == "" || cfg.KeyFilename == "" {
+			return "", fmt.Errorf("--cert and --key must be used together")
+		}
+		return tlsModeFiles, nil
+	case len(cfg.ACMEHostnames) > 0:
+		return tlsModeACME, nil
+	default:
+		return "", fmt.Errorf("no TLS configuration; use --acme-hostnames, --cert and --key, or --disable-tls")
+	}
+}
+
+// Check the TLS configuration: which mode is in use, and the validity of the
+// certificate.
+func checkTLS(cfg *checkConfig, now time.Time) []checkResult {
+	const name = "tls"
+	mode, err := tlsMode(cfg)
+	switch {
+	case err != nil:
+		return []checkResult{checkFailf(name, "%s", err)}
+	case mode == tlsModeDisabled:
+		return []checkResult{checkOKf(name, "TLS disabled; a CDN or reverse proxy must terminate TLS")}
+	case mode == tlsModeFiles:
+		return []checkResult{checkCertificateFiles(cfg.CertFilename, cfg.KeyFilename, now)}
+	default:
+		return checkACME(cfg.ACMEHostnames, cfg.ACMECacheDir, now)
+	}
+}
+
+// Check that a certificate and key can be loaded and that the certificate is
+// currently valid.
+func checkCertificateFiles(certFilename, keyFilename string, now time.Time) checkResult {
+	const name = "certificate"
+	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	if err != nil {
+		return checkFailf(name, "can't load %s and %s: %s", certFilename, keyFilename, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return checkFailf(name, "can't parse %s: %s", certFilename, err)
+	}
+	return checkCertificateExpiry(name, certFilename, leaf, now)
+}
+
+// Check the validity period of a certificate. what says where it came from.
+func checkCertificateExpiry(name, what string, leaf *x509.Certificate, now time.Time) checkResult {
+	expiry := leaf.NotAfter.UTC().Format("2006-01-02")
+	switch {
+	case now.Before(leaf.NotBefore):
+		return checkFailf(name, "%s is not valid until %s; check the system clock", what, leaf.NotBefore.UTC().Format("2006-01-02"))
+	case now.After(leaf.NotAfter):
+		return checkFailf(name, "%s expired on %s; renew it", what, expiry)
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		return checkWarnf(name, "%s expires soon, on %s; renew it (new --cert and --key files are loaded automatically)", what, expiry)
+	default:
+		return checkOKf(name, "%s for %v valid until %s", what, leaf.DNSNames, expiry)
+	}
+}
+
+// Check the ACME configuration: that port 80 is available for the HTTP-01
+// challenge, and the state of any cached certificates.
+func checkACME(hostnames []string, cacheDir string, now time.Time) []checkResult {
+	results := []checkResult{checkBindable("acme", &net.TCPAddr{Port: 80}, "the HTTP-01 challenge needs port 80")}
+	if cacheDir == "" {
+		results = append(results, checkWarnf("acme", "no certificate cache; certificates will be requested again at every restart, which may hit rate limits"))
+		return results
+	}
+	cache := autocert.DirCache(cacheDir)
+	for _, hostname := range hostnames {
+		leaf, err := cachedACMECertificate(cache, hostname)
+		if err != nil {
+			results = append(results, checkWarnf("acme", "no cached certificate for %s (%s); one will be requested on the first connection, so %s must resolve to this server", hostname, err, hostname))
+			continue
+		}
+		results = append(results, checkCertificateExpiry("acme", "cached certificate for "+hostname, leaf, now))
+	}
+	return results
+}
+
+// Find the certificate for hostname in an autocert cache. autocert stores the
+// private key and then the certificate chain, PEM-encoded, under the hostname
+// (with a "+rsa" suffix for RSA certificates).
+func cachedACMECertificate(cache autocert.Cache, hostname string) (*x509.Certificate, error) {
+	var data []byte
+	var err error
+	for _, key := range []string{hostname, hostname + "+rsa"} {
+		data, err = cache.Get(context.Background(), key)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in cache entry")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Check that a TCP address can be listened on. why says what it is for.
+func checkBindable(name string, addr *net.TCPAddr, why string) checkResult {
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		msg := fmt.Sprintf("can't listen on %s (%s): %s", addr, why, err)
+		if addr.Port < 1024 {
+			msg += "; ports below 1024 need root or CAP_NET_BIND_SERVICE"
+		} else {
+			msg += "; is another process using it?"
+		}
+		return checkFailf(name, "%s", msg)
+	}
+	ln.Close()
+	return checkOKf(name, "can listen on %s", addr)
+}
+
+// Check that a unix socket can be listened on at path, for --listen-unix,
+// without disturbing a socket that is in use.
+func checkUnixListenable(name, path string) checkResult {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return checkFailf(name, "%s (--listen-unix) exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, unixSocketProbeTimeout)
+		if err == nil {
+			conn.Close()
+			return checkFailf(name, "another process is listening on %s (--listen-unix)", path)
+		}
+		return checkOKf(name, "will replace stale socket %s", path)
+	}
+	ln, err := listenUnix(path, options.ListenUnixMode)
+	if err != nil {
+		return checkFailf(name, "can't listen on %s (--listen-unix): %s", path, err)
+	}
+	ln.Close()
+	// With --reuse-port, Close leaves the socket file.
+	os.Remove(path)
+	return checkOKf(name, "can listen on %s", path)
+}
+
+// Check that the external service can be dialed through backendDialer.
+func checkBackend(externalService string) checkResult {
+	const name = "backend"
+	if externalService == "" {
+		return checkOKf(name, "using the built-in SOCKS service")
+	}
+	conn, err := backendDialer.Dial("tcp", externalService)
+	if err != nil {
+		return checkFailf(name, "can't connect to --external-service %s: %s; is it running, and is --backend-proxy right?", externalService, err)
+	}
+	conn.Close()
+	return checkOKf(name, "can connect to %s", externalService)
+}
+
+// Check that the mask content exists.
+func checkMask() checkResult {
+	const name = "mask"
+	switch {
+	case options.MaskRedirect != "":
+		u, err := url.Parse(options.MaskRedirect)
+		if err != nil || !u.IsAbs() {
+			return checkFailf(name, "--redirect %q is not an absolute URL", options.MaskRedirect)
+		}
+		return checkOKf(name, "redirecting to %s", options.MaskRedirect)
+	case options.MaskDir != "":
+		fi, err := os.Stat(options.MaskDir)
+		if err != nil {
+			return checkFailf(name, "--mask-dir: %s", err)
+		}
+		if !fi.IsDir() {
+			return checkFailf(name, "--mask-dir %s is not a directory", options.MaskDir)
+		}
+		index := filepath.Join(options.MaskDir, "index.html")
+		if _, err := os.Stat(index); err != nil {
+			return checkWarnf(name, "--mask-dir has no index.html; \"/\" will show a directory listing or 404")
+		}
+		return checkOKf(name, "serving %s", options.MaskDir)
+	case options.MaskMirror != "":
+		if _, err := parseMaskMirrorURL(options.MaskMirror); err != nil {
+			return checkFailf(name, "--mask-mirror: %s", err)
+		}
+		return checkOKf(name, "serving a copy of %s", options.MaskMirror)
+	case options.MaskTemplate != "":
+		if _, err := maskTemplate(options.MaskTemplate); err != nil {
+			return checkFailf(name, "--mask-template: %s", err)
+		}
+		return checkOKf(name, "serving the built-in %q site", options.MaskTemplate)
+	case options.MaskDoc != "":
+		f, err := os.Open(options.MaskDoc)
+		if err != nil {
+			return checkFailf(name, "--mask: %s", err)
+		}
+		f.Close()
+		return checkOKf(name, "serving %s", options.MaskDoc)
+	default:
+		return checkWarnf(name, "no mask content; consider --mask, --mask-dir, --mask-mirror, --mask-template, or --redirect so the server looks like an ordinary web site")
+	}
+}
+
+// Check that a log file can be opened for appending.
+func checkLogFile(name, filename string) checkResult {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return checkFailf(name, "%s", err)
+	}
+	f.Close()
+	return checkOKf(name, "can write %s", filename)
+}
+
+// Split a comma-separated list, as for --acme-hostnames, returning nil for "".
+func splitNonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Check the configuration, print the results on stdout, and return the exit
+// status.
+func checkMain(cfg *checkConfig) int {
+	// The ACME certificate cache is in the state directory, which is only
+	// known when run by tor.
+	if len(cfg.ACMEHostnames) > 0 && os.Getenv("TOR_PT_STATE_LOCATION") != "" {
+		dir, err := getCertificateCacheDir()
+		if err == nil {
+			cfg.ACMECacheDir = dir
+		}
+	}
+	if !runChecks(cfg, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// Run all checks and write the results to w. Returns false if any check
+// failed.
+func runChecks(cfg *checkConfig, w io.Writer) bool {
+	if backendTCPDialer.Timeout == 0 {
+		backendTCPDialer.Timeout = checkDialTimeout
+	}
+
+	var results []checkResult
+	results = append(results, checkTLS(cfg, time.Now())...)
+	if cfg.ListenUnix != "" {
+		results = append(results, checkUnixListenable("listen", cfg.ListenUnix))
+	} else {
+		results = append(results, checkBindable("listen", &net.TCPAddr{Port: cfg.Port}, "--port"))
+	}
+	for _, t := range cfg.Transports {
+		results = append(results, checkBindable("listen "+t.Name, &net.TCPAddr{Port: t.Port}, "--transports"))
+	}
+	if cfg.ExternalService == "" {
+		addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:"+cfg.SocksPort)
+		if err != nil {
+			results = append(results, checkFailf("socks", "bad --socks port %q", cfg.SocksPort))
+		} else {
+			results = append(results, checkBindable("socks", addr, "--socks"))
+		}
+	}
+	results = append(results, checkBackend(cfg.ExternalService))
+	results = append(results, checkMask())
+	if cfg.LogFilename != "" {
+		results = append(results, checkLogFile("log", cfg.LogFilename))
+	}
+	if cfg.AuditLogFilename != "" {
+		results = append(results, checkLogFile("audit-log", cfg.AuditLogFilename))
+	}
+
+	ok := true
+	for _, result := range results {
+		fmt.Fprintf(w, "%-4s %-12s %s\n", result.Status, result.Name, result.Message)
+		if result.Status == checkFail {
+			ok = false
+		}
+	}
+	return ok
+}
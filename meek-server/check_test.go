@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCertificateFiles(t *testing.T) {
+	files := loadTestFiles()
+	defer files.Cleanup()
+
+	// cert1 is valid from 2017-03-21 22:53:47 to 2017-03-22 22:53:47.
+	for _, test := range []struct {
+		now      time.Time
+		expected checkStatus
+	}{
+		{time.Date(2017, 3, 20, 0, 0, 0, 0, time.UTC), checkFail},
+		{time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC), checkWarn},
+		{time.Date(2017, 3, 23, 0, 0, 0, 0, time.UTC), checkFail},
+	} {
+		result := checkCertificateFiles(files.cert1Filename, files.key1Filename, test.now)
+		if result.Status != test.expected {
+			t.Errorf("%s: got %s (%s), expected %s", test.now, result.Status, result.Message, test.expected)
+		}
+	}
+
+	for _, filenames := range [][2]string{
+		{files.cert1Filename, files.key2Filename},
+		{files.badSyntaxFilename, files.key1Filename},
+		{files.nonexistentFilename, files.key1Filename},
+	} {
+		now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+		if result := checkCertificateFiles(filenames[0], filenames[1], now); result.Status != checkFail {
+			t.Errorf("%q: got %s", filenames, result.Status)
+		}
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	for _, test := range []struct {
+		cfg      checkConfig
+		expected checkStatus
+	}{
+		{checkConfig{DisableTLS: true}, checkOK},
+		{checkConfig{DisableTLS: true, CertFilename: "cert.pem"}, checkFail},
+		{checkConfig{CertFilename: "cert.pem"}, checkFail},
+		{checkConfig{CertFilename: "cert.pem", KeyFilename: "key.pem", ACMEHostnames: []string{"meek.example"}}, checkFail},
+		{checkConfig{ACMEEmail: "admin@meek.example"}, checkFail},
+		{checkConfig{}, checkFail},
+	} {
+		results := checkTLS(&test.cfg, time.Now())
+		if len(results) != 1 || results[0].Status != test.expected {
+			t.Errorf("%+v: got %+v, expected %s", test.cfg, results, test.expected)
+		}
+	}
+}
+
+func TestCheckBindable(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	if result := checkBindable("listen", addr, "test"); result.Status != checkFail {
+		t.Errorf("port in use: got %s", result.Status)
+	}
+	if result := checkBindable("listen", &net.TCPAddr{IP: addr.IP}, "test"); result.Status != checkOK {
+		t.Errorf("free port: got %s (%s)", result.Status, result.Message)
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	if result := checkBackend(addr); result.Status != checkOK {
+		t.Errorf("listening backend: got %s (%s)", result.Status, result.Message)
+	}
+	ln.Close()
+	if result := checkBackend(addr); result.Status != checkFail {
+		t.Errorf("closed backend: got %s", result.Status)
+	}
+	if result := checkBackend(""); result.Status != checkOK {
+		t.Errorf("built-in service: got %s", result.Status)
+	}
+}
+
+func TestCheckMask(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	dir := t.TempDir()
+	doc := filepath.Join(dir, "mask.html")
+	if err := os.WriteFile(doc, []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		doc, dir, redirect string
+		expected           checkStatus
+	}{
+		{"", "", "", checkWarn},
+		{doc, "", "", checkOK},
+		{filepath.Join(dir, "missing.html"), "", "", checkFail},
+		{"", dir, "", checkWarn}, // no index.html
+		{"", doc, "", checkFail}, // not a directory
+		{"", "", "https://www.example.com/", checkOK},
+		{"", "", "/relative", checkFail},
+	} {
+		options.MaskDoc, options.MaskDir, options.MaskRedirect = test.doc, test.dir, test.redirect
+		if result := checkMask(); result.Status != test.expected {
+			t.Errorf("%+v: got %s (%s)", test, result.Status, result.Message)
+		}
+	}
+}
+
+func TestRunChecks(t *testing.T) {
+	var out bytes.Buffer
+	ok := runChecks(&checkConfig{SocksPort: "0"}, &out)
+	if ok {
+		t.Errorf("config without TLS passed")
+	}
+	if !strings.Contains(out.String(), "FAIL tls") {
+		t.Errorf("output lacks the TLS failure:\n%s", out.String())
+	}
+}
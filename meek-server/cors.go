@@ -0,0 +1,93 @@
+package main
+
+// The code in this file has to do with Cross-Origin Resource Sharing, which
+// lets a client running inside a web page (e.g. a WASM build of meek-client,
+// or a helper implemented as page script) make transport requests from an
+// ordinary origin.
+// https://fetch.spec.whatwg.org/#http-cors-protocol
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a browser may cache the result of a preflight request.
+	corsMaxAge = 10 * time.Minute
+	// Request headers allowed in cross-origin requests. The allowed
+	// methods are those of --methods.
+	corsAllowHeaders = "Content-Type, X-Session-Id, X-Seq, X-Session-Token, X-Session-Close, X-Payload-Size, X-Mux, X-Credential"
+	// Response headers readable by cross-origin clients.
+	corsExposeHeaders = "X-Session-Token, X-Payload-Size, X-Poll-Hint, X-More-Data, X-Request-Id"
+)
+
+// corsPolicy decides which origins may make cross-origin transport requests.
+// The zero value (and a nil pointer) allows none.
+type corsPolicy struct {
+	allowAll bool
+	origins  map[string]bool
+}
+
+// Parse a comma-separated list of allowed origins. The special value "*"
+// allows any origin.
+func parseCORSOrigins(s string) *corsPolicy {
+	policy := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			policy.allowAll = true
+		} else {
+			policy.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return policy
+}
+
+// Is the given Origin header value allowed?
+func (policy *corsPolicy) Allowed(origin string) bool {
+	if policy == nil || origin == "" {
+		return false
+	}
+	return policy.allowAll || policy.origins[strings.ToLower(origin)]
+}
+
+// Set the response headers for a cross-origin request, if the request has an
+// allowed Origin. Returns true if the headers were set.
+func (policy *corsPolicy) SetHeaders(w http.ResponseWriter, req *http.Request) bool {
+	if policy == nil {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	// Caches must not reuse a response for a different Origin.
+	w.Header().Add("Vary", "Origin")
+	if !policy.Allowed(origin) {
+		return false
+	}
+	// Echo the specific origin rather than "*", even when allowing all
+	// origins, so the response works the same with or without
+	// credentials.
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	return true
+}
+
+// Answer a preflight OPTIONS request. Returns false, having written nothing,
+// if the request is not a preflight from an allowed origin.
+func (policy *corsPolicy) Preflight(w http.ResponseWriter, req *http.Request) bool {
+	if req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if !policy.SetHeaders(w, req) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", options.TransportMethods.String())
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicyAllowed(t *testing.T) {
+	tests := []struct {
+		Origins  string
+		Origin   string
+		Expected bool
+	}{
+		{"https://a.example", "https://a.example", true},
+		{"https://a.example", "https://A.example", true},
+		{"https://a.example", "https://b.example", false},
+		{"https://a.example", "", false},
+		{"https://a.example, https://b.example", "https://b.example", true},
+		{"*", "https://c.example", true},
+		{"*", "", false},
+		{"", "https://a.example", false},
+	}
+	for _, test := range tests {
+		policy := parseCORSOrigins(test.Origins)
+		if got := policy.Allowed(test.Origin); got != test.Expected {
+			t.Errorf("%q allowed %q: expected %v, got %v", test.Origins, test.Origin, test.Expected, got)
+		}
+	}
+
+	var policy *corsPolicy
+	if policy.Allowed("https://a.example") {
+		t.Errorf("nil policy allowed an origin")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	policy := parseCORSOrigins("https://a.example")
+
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://a.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	if !policy.Preflight(rec, req) {
+		t.Fatalf("preflight from allowed origin was refused")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Errorf("bad Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != corsAllowHeaders {
+		t.Errorf("bad Access-Control-Allow-Headers %q", got)
+	}
+
+	// Disallowed origin.
+	req.Header.Set("Origin", "https://b.example")
+	rec = httptest.NewRecorder()
+	if policy.Preflight(rec, req) {
+		t.Errorf("preflight from disallowed origin was accepted")
+	}
+
+	// Not a preflight.
+	req = httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://a.example")
+	rec = httptest.NewRecorder()
+	if policy.Preflight(rec, req) {
+		t.Errorf("OPTIONS without Access-Control-Request-Method was accepted")
+	}
+}
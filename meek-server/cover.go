@@ -0,0 +1,139 @@
+package main
+
+// The code in this file implements cover paths (--cover-paths): paths that are
+// answered with static content of a plausible type and size, to give meek-client
+// cover traffic (its --cover-to-server option) somewhere to terminate at the
+// origin. The content is generated at startup from each path's extension:
+// tiny valid images for image types, and filler code or markup, of a size
+// derived from the path, for text types. A request for a cover path gets its
+// content whatever the method; any request body is read and discarded. Cover
+// requests are counted in the heartbeat.
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// The size range of generated text content.
+	minCoverTextLength = 2 << 10
+	maxCoverTextLength = 24 << 10
+	// The most request body read from a cover request.
+	maxCoverBodyLength = 1 << 20
+)
+
+// A 1×1 transparent GIF.
+var coverGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// A 1×1 transparent PNG.
+var coverPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\b\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\x0eIDATx\xdabb```\x00\f\x00\x00\x0f\x00\x03\xb1\x88\xf4\x0f\x00\x00\x00\x00IEND\xaeB`\x82")
+
+// coverAsset is the generated content for one cover path.
+type coverAsset struct {
+	contentType string
+	body        []byte
+}
+
+// Generate the content for each of paths.
+func makeCoverAssets(paths []string) (map[string]*coverAsset, error) {
+	assets := make(map[string]*coverAsset)
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("cover path %q does not start with \"/\"", p)
+		}
+		assets[p] = makeCoverAsset(p)
+	}
+	return assets, nil
+}
+
+// Generate content for p according to its extension. The same path always
+// gets the same content.
+func makeCoverAsset(p string) *coverAsset {
+	ext := strings.ToLower(path.Ext(p))
+	contentType := mime.TypeByExtension(ext)
+	switch ext {
+	case ".gif":
+		return &coverAsset{contentType, coverGIF}
+	case ".png":
+		return &coverAsset{contentType, coverPNG}
+	case ".ico":
+		return &coverAsset{"image/x-icon", makeICO(coverPNG)}
+	}
+
+	h := fnv.New64a()
+	io.WriteString(h, p)
+	r := rand.New(rand.NewSource(int64(h.Sum64())))
+	size := minCoverTextLength + r.Intn(maxCoverTextLength-minCoverTextLength)
+	var buf bytes.Buffer
+	switch ext {
+	case ".js":
+		contentType = "text/javascript; charset=utf-8"
+		buf.WriteString("\"use strict\";\n")
+		for buf.Len() < size {
+			fmt.Fprintf(&buf, "function f%x(a,b){var c=a*%d+b;return c>%d?c-%d:c}\n", r.Uint32(), r.Intn(100), r.Intn(10000), r.Intn(100))
+		}
+	case ".css":
+		contentType = "text/css; charset=utf-8"
+		for buf.Len() < size {
+			fmt.Fprintf(&buf, ".c%x{margin:%dpx %dpx;color:#%06x}\n", r.Uint32(), r.Intn(40), r.Intn(40), r.Intn(1<<24))
+		}
+	case ".json":
+		contentType = "application/json"
+		buf.WriteString("{")
+		for buf.Len() < size {
+			if buf.Len() > 1 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, "\"k%x\":%d", r.Uint32(), r.Intn(100000))
+		}
+		buf.WriteString("}\n")
+	default:
+		contentType = "text/html; charset=utf-8"
+		buf.WriteString("<!DOCTYPE html>\n<html><head><title></title></head><body>\n")
+		for buf.Len() < size {
+			fmt.Fprintf(&buf, "<div class=\"c%x\"><p>%x</p></div>\n", r.Uint32(), r.Uint64())
+		}
+		buf.WriteString("</body></html>\n")
+	}
+	return &coverAsset{contentType, buf.Bytes()}
+}
+
+// Wrap a PNG image in an ICO container with one entry.
+func makeICO(png []byte) []byte {
+	var buf bytes.Buffer
+	// ICONDIR: reserved, type 1 (icon), 1 image.
+	buf.Write([]byte{0, 0, 1, 0, 1, 0})
+	// ICONDIRENTRY: 1×1, no palette, reserved, 1 plane, 32 bits per
+	// pixel, size, offset.
+	n, off := uint32(len(png)), uint32(6+16)
+	buf.Write([]byte{1, 1, 0, 0, 1, 0, 32, 0,
+		byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24),
+		byte(off), byte(off >> 8), byte(off >> 16), byte(off >> 24)})
+	buf.Write(png)
+	return buf.Bytes()
+}
+
+// Return the cover asset for req, or nil if req is not for a cover path.
+func coverAssetFor(req *http.Request) *coverAsset {
+	return options.CoverAssets[req.URL.Path]
+}
+
+// The time cover content claims to have been last modified.
+var coverModTime = time.Now().UTC().Truncate(time.Hour)
+
+// Answer a request for a cover path.
+func (state *State) ServeCover(w http.ResponseWriter, req *http.Request, asset *coverAsset) {
+	state.coverRequests.Add(1)
+	io.Copy(io.Discard, io.LimitReader(req.Body, maxCoverBodyLength))
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	serveMaskContent(w, req, path.Base(req.URL.Path), coverModTime, int64(len(asset.body)), bytes.NewReader(asset.body))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCoverImages(t *testing.T) {
+	if _, err := gif.Decode(bytes.NewReader(coverGIF)); err != nil {
+		t.Errorf("GIF: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(coverPNG)); err != nil {
+		t.Errorf("PNG: %v", err)
+	}
+}
+
+func TestMakeCoverAsset(t *testing.T) {
+	for _, test := range []struct {
+		path, contentType string
+	}{
+		{"/favicon.ico", "image/x-icon"},
+		{"/img/logo.png", "image/png"},
+		{"/static/app.js", "text/javascript; charset=utf-8"},
+		{"/static/site.css", "text/css; charset=utf-8"},
+		{"/api/config.json", "application/json"},
+		{"/about", "text/html; charset=utf-8"},
+	} {
+		asset := makeCoverAsset(test.path)
+		if asset.contentType != test.contentType {
+			t.Errorf("%s: Content-Type %q, expected %q", test.path, asset.contentType, test.contentType)
+		}
+		if !bytes.Equal(asset.body, makeCoverAsset(test.path).body) {
+			t.Errorf("%s: content differs between calls", test.path)
+		}
+	}
+	js := makeCoverAsset("/static/app.js")
+	if len(js.body) < minCoverTextLength || len(js.body) > maxCoverTextLength+200 {
+		t.Errorf("JavaScript of %d bytes", len(js.body))
+	}
+	if _, err := makeCoverAssets([]string{"favicon.ico"}); err == nil {
+		t.Errorf("relative path accepted")
+	}
+}
+
+func TestServeCover(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	var err error
+	options.CoverAssets, err = makeCoverAssets([]string{"/static/app.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Strict = true
+
+	state := NewState()
+	for _, method := range []string{"GET", "POST"} {
+		rr := httptest.NewRecorder()
+		state.ServeHTTP(rr, httptest.NewRequest(method, "/static/app.js", strings.NewReader("payload")))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: status %d", method, rr.Code)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), options.CoverAssets["/static/app.js"].body) {
+			t.Errorf("%s: wrong content", method)
+		}
+	}
+	if n := state.coverRequests.Load(); n != 2 {
+		t.Errorf("counted %d cover requests, expected 2", n)
+	}
+
+	// Other paths are unaffected.
+	rr := httptest.NewRecorder()
+	state.ServeHTTP(rr, httptest.NewRequest("GET", "/static/other.js", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("other path: status %d", rr.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+// The code in this file implements recovery from panics in the HTTP handler.
+// net/http would recover them anyway, but only by abruptly closing the
+// connection, which looks unlike an ordinary web server, and with the stack
+// trace mixed into the log. Instead the client gets a plain 500 response, and
+// the panic becomes a fault report (../lib/faultreport) of kind "panic", in the
+// same format as the report of a fatal error: it is written to the pluggable
+// transport state directory and, with --crash-report-url, is POSTed to an
+// operator-configured endpoint. Reports never contain client addresses.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"../lib/faultreport"
+	"../lib/logging"
+)
+
+const (
+	// The most panics reported in one run, so that a request that always
+	// panics can't keep writing reports.
+	maxCrashRecords = 100
+	// How long to allow for POSTing a crash report.
+	crashReportTimeout = 30 * time.Second
+)
+
+// crashReporter reports panics in the HTTP handler.
+type crashReporter struct {
+	// Makes and writes the reports. If nil, reports have only the panic.
+	Faults *faultreport.Reporter
+	// Where to POST reports, or "" not to.
+	URL string
+
+	count atomic.Int64
+}
+
+// Record a panic. Returns the name of the report file, or "" if none was
+// written.
+func (c *crashReporter) Record(value interface{}, req *http.Request, stack []byte) string {
+	if c.count.Add(1) > maxCrashRecords {
+		return ""
+	}
+	message := fmt.Sprintf("panic serving %s %s %s: %v", req.Method, req.URL.Path, req.Proto, value)
+	report := c.Faults.Make("panic", message, stack)
+	filename, err := c.Faults.Save(report)
+	if err != nil {
+		logging.Warnf("error writing fault report: %s", err)
+	}
+	if c.URL != "" {
+		go c.post(report)
+	}
+	return filename
+}
+
+func (c *crashReporter) post(report *faultreport.Report) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		logging.Warnf("error encoding crash report: %s", err)
+		return
+	}
+	client := http.Client{Timeout: crashReportTimeout}
+	resp, err := client.Post(c.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logging.Warnf("error sending crash report: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logging.Warnf("crash report endpoint returned status %d", resp.StatusCode)
+	}
+}
+
+// Wrap handler so that a panic is recorded with reporter and answered with a
+// 500 response, instead of taking down the connection.
+func recoverPanics(handler http.Handler, reporter *crashReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			// http.ErrAbortHandler is the sanctioned way to abort a
+			// response; let net/http handle it as usual.
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			if err, ok := value.(error); ok {
+				value = scrubError(err)
+			}
+			filename := reporter.Record(value, req, debug.Stack())
+			if filename != "" {
+				logging.Warnf("[%s] panic serving %s %s: %v; fault report in %s", requestID(req), req.Method, req.URL.Path, value, filename)
+			} else {
+				logging.Warnf("[%s] panic serving %s %s: %v", requestID(req), req.Method, req.URL.Path, value)
+			}
+			httpInternalServerError(w)
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../lib/buildinfo"
+	"../lib/faultreport"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	reports := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		reports <- body
+	}))
+	defer collector.Close()
+
+	dir := t.TempDir()
+	faults := faultreport.New(dir, "meek-server", "0123456789abcdef", buildinfo.Info{Version: "1.0"})
+	reporter := &crashReporter{Faults: faults, URL: collector.URL}
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic(&net.OpError{
+			Op:   "dial",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9001},
+			Err:  errors.New("connection refused"),
+		})
+	}), reporter)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, expected %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "meek-server-fault-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("%d fault reports, expected 1", len(names))
+	}
+	data, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The report written and the report sent are the same fault report.
+	for _, data := range [][]byte{data, <-reports} {
+		var report faultreport.Report
+		if err := json.Unmarshal(data, &report); err != nil {
+			t.Fatalf("%v: %s", err, data)
+		}
+		if report.Kind != "panic" || report.Program != "meek-server" || report.Build.Version != "1.0" ||
+			!strings.Contains(report.Message, "POST /") || !strings.Contains(report.Stack, "TestRecoverPanics") {
+			t.Errorf("report lacks kind, build, request, or stack:\n%s", data)
+		}
+		if strings.Contains(string(data), "192.0.2.1") {
+			t.Errorf("report contains an address:\n%s", data)
+		}
+	}
+}
+
+func TestRecoverPanicsAbort(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	}), &crashReporter{})
+	defer func() {
+		if value := recover(); value != http.ErrAbortHandler {
+			t.Errorf("recovered %v, expected http.ErrAbortHandler", value)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestCrashReporterLimit(t *testing.T) {
+	reporter := &crashReporter{Faults: faultreport.New(t.TempDir(), "meek-server", "", buildinfo.Info{})}
+	req := httptest.NewRequest("GET", "/", nil)
+	written := 0
+	for i := 0; i < maxCrashRecords+5; i++ {
+		if reporter.Record("boom", req, nil) != "" {
+			written++
+		}
+	}
+	if written != maxCrashRecords {
+		t.Errorf("%d reports written, expected %d", written, maxCrashRecords)
+	}
+}
+
+// panicConn is a net.Conn whose writes panic.
+type panicConn struct {
+	net.Conn
+}
+
+func (panicConn) Write(p []byte) (int, error) {
+	panic("write")
+}
+
+// A panic during a transaction doesn't leave the session locked.
+func TestPostPanicUnlocks(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session := NewSession(panicConn{c1})
+	state.shard(sessionID).sessions.Store(sessionID, session)
+
+	handler := recoverPanics(http.HandlerFunc(state.Post), &crashReporter{})
+	for _, seq := range []string{"", "0"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+		req.Header.Set("X-Session-Id", sessionID)
+		if seq != "" {
+			req.Header.Set("X-Seq", seq)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("X-Seq %q: status %d", seq, rr.Code)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := session.Lock(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("X-Seq %q: session left locked: %v", seq, err)
+		}
+		session.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+// The code in this file has to do with the things a State depends on: how it
+// dials backends (BackendDialer), what time it is (Clock), and where it keeps
+// its sessions (SessionStore). main wires in the real ones; anything
+// embedding the server, and tests, can substitute others through
+// NewStateWith, for example an in-memory backend and a clock that only moves
+// when told to, which make session expiry and replay checks deterministic.
+
+import (
+	"net"
+	"time"
+)
+
+// BackendDialer dials the backend connection of a new session (or of a mux
+// stream). useraddr and methodName are passed on to the extended OR port, if
+// there is one.
+type BackendDialer interface {
+	DialBackend(useraddr, methodName string) (net.Conn, error)
+}
+
+// backendDialerFunc is a function that is a BackendDialer.
+type backendDialerFunc func(useraddr, methodName string) (net.Conn, error)
+
+func (f backendDialerFunc) DialBackend(useraddr, methodName string) (net.Conn, error) {
+	return f(useraddr, methodName)
+}
+
+// The BackendDialer that dials the configured backends; see backend.go.
+var defaultBackendDialer BackendDialer = backendDialerFunc(dialBackend)
+
+// Clock tells the time of session events: creation, last use, expiry, and
+// closing.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the operating system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SessionStore holds the sessions of one shard of a State, by session id. It
+// need not be safe for concurrent use: the shard's lock is held around every
+// call.
+type SessionStore interface {
+	// Return the session with sessionID, or nil if there is none.
+	Load(sessionID string) *Session
+	Store(sessionID string, session *Session)
+	Delete(sessionID string)
+	Len() int
+	// Call f for each session, in no particular order, until f returns
+	// false. f may Delete the session it is called with.
+	Range(f func(sessionID string, session *Session) bool)
+}
+
+// mapSessionStore is a SessionStore in a map.
+type mapSessionStore map[string]*Session
+
+func newMapSessionStore() SessionStore {
+	return make(mapSessionStore)
+}
+
+func (m mapSessionStore) Load(sessionID string) *Session {
+	return m[sessionID]
+}
+
+func (m mapSessionStore) Store(sessionID string, session *Session) {
+	m[sessionID] = session
+}
+
+func (m mapSessionStore) Delete(sessionID string) {
+	delete(m, sessionID)
+}
+
+func (m mapSessionStore) Len() int {
+	return len(m)
+}
+
+func (m mapSessionStore) Range(f func(sessionID string, session *Session) bool) {
+	for sessionID, session := range m {
+		if !f(sessionID, session) {
+			return
+		}
+	}
+}
+
+// StateConfig is what NewStateWith makes a State with. Nil fields get the
+// defaults of NewState.
+type StateConfig struct {
+	// Dials the backend of new sessions (default: the configured
+	// backends).
+	Backend BackendDialer
+	// Default: the system clock.
+	Clock Clock
+	// Makes the SessionStore of each shard (default: a map).
+	NewSessionStore func() SessionStore
+}
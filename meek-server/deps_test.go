@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// pipeBackend is a BackendDialer whose backends are the far ends of pipes.
+type pipeBackend struct {
+	lock  sync.Mutex
+	conns []net.Conn
+	err   error
+}
+
+func (b *pipeBackend) DialBackend(useraddr, methodName string) (net.Conn, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	c1, c2 := net.Pipe()
+	b.conns = append(b.conns, c2)
+	return c1, nil
+}
+
+// countingStore is a SessionStore that counts its calls.
+type countingStore struct {
+	mapSessionStore
+	stores, deletes int
+}
+
+func (s *countingStore) Store(sessionID string, session *Session) {
+	s.stores++
+	s.mapSessionStore.Store(sessionID, session)
+}
+
+func (s *countingStore) Delete(sessionID string) {
+	s.deletes++
+	s.mapSessionStore.Delete(sessionID)
+}
+
+func TestStateDeps(t *testing.T) {
+	defer func(saved *replayCache) { closedSessions = saved }(closedSessions)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	closedSessions = newReplayCache(time.Hour, 100, clock.Now())
+	backend := &pipeBackend{}
+	var stores []*countingStore
+	state := NewStateWith(StateConfig{
+		Backend: backend,
+		Clock:   clock,
+		NewSessionStore: func() SessionStore {
+			s := &countingStore{mapSessionStore: make(mapSessionStore)}
+			stores = append(stores, s)
+			return s
+		},
+	})
+	if len(stores) != numSessionShards {
+		t.Fatalf("%d stores for %d shards", len(stores), numSessionShards)
+	}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session, err := state.GetSession(sessionID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.conns) != 1 {
+		t.Fatalf("%d backends dialed", len(backend.conns))
+	}
+	if !session.Created.Equal(clock.Now()) || !session.LastSeen.Equal(clock.Now()) {
+		t.Errorf("created %s, last seen %s, expected %s", session.Created, session.LastSeen, clock.Now())
+	}
+	store := state.shard(sessionID).sessions.(*countingStore)
+	if store.stores != 1 || state.NumSessions() != 1 {
+		t.Errorf("%d stores, %d sessions", store.stores, state.NumSessions())
+	}
+
+	// Used again just before expiry, so it lasts another maxSessionStaleness.
+	clock.Advance(maxSessionStaleness)
+	if again, err := state.GetSession(sessionID, req); err != nil || again != session {
+		t.Fatalf("got %p, %v, expected %p", again, err, session)
+	}
+	clock.Advance(maxSessionStaleness)
+	state.expireSessions()
+	if state.NumSessions() != 1 {
+		t.Fatalf("session expired early")
+	}
+	clock.Advance(time.Second)
+	state.expireSessions()
+	if state.NumSessions() != 0 || store.deletes != 1 {
+		t.Fatalf("%d sessions, %d deletes after expiry", state.NumSessions(), store.deletes)
+	}
+	// The backend was closed with the session.
+	if _, err := backend.conns[0].Write([]byte("x")); err == nil {
+		t.Errorf("backend still open")
+	}
+
+	// The id can't be reused while the replay cache remembers it.
+	if _, err := state.GetSession(sessionID, req); err != errSessionReplayed {
+		t.Errorf("got %v, expected %v", err, errSessionReplayed)
+	}
+
+	errDial := errors.New("dial failed")
+	backend.err = errDial
+	if _, err := state.GetSession("ZGlmZmVyZW50", req); err != errDial {
+		t.Errorf("got %v, expected %v", err, errDial)
+	}
+	if state.NumSessions() != 0 {
+		t.Errorf("session left after a failed dial")
+	}
+}
+
+// Sessions over options.MaxSessionAge are removed however recently they were
+// used.
+func TestStateExpireMaxAge(t *testing.T) {
+	defer func() { options.MaxSessionAge = 0 }()
+	options.MaxSessionAge = time.Hour
+	clock := &fakeClock{now: time.Now()}
+	state := NewStateWith(StateConfig{Backend: &pipeBackend{}, Clock: clock})
+	req := httptest.NewRequest("POST", "/", nil)
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	for elapsed := time.Duration(0); elapsed <= time.Hour; elapsed += maxSessionStaleness / 2 {
+		if _, err := state.GetSession(sessionID, req); err != nil {
+			t.Fatalf("after %s: %v", elapsed, err)
+		}
+		state.expireSessions()
+		clock.Advance(maxSessionStaleness / 2)
+	}
+	state.expireSessions()
+	if state.NumSessions() != 0 {
+		t.Errorf("session outlived its max age")
+	}
+}
+
+// gatedBackend is a pipeBackend whose dials wait until gate is closed.
+type gatedBackend struct {
+	pipeBackend
+	gate    chan struct{}
+	dialing chan struct{}
+}
+
+func (b *gatedBackend) DialBackend(useraddr, methodName string) (net.Conn, error) {
+	b.dialing <- struct{}{}
+	<-b.gate
+	return b.pipeBackend.DialBackend(useraddr, methodName)
+}
+
+// A slow dial doesn't hold up other sessions in the shard, and requests that
+// create the same session at once get the same one.
+func TestGetSessionDialUnlocked(t *testing.T) {
+	backend := &gatedBackend{gate: make(chan struct{}), dialing: make(chan struct{}, 2)}
+	state := NewStateWith(StateConfig{Backend: backend})
+	req := httptest.NewRequest("POST", "/", nil)
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	// Another session in the same shard.
+	other := "b3RoZXI"
+	for i := 0; state.shard(other) != state.shard(sessionID); i++ {
+		other = fmt.Sprintf("b3RoZXI%d", i)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state.shard(other).sessions.Store(other, NewSession(c1))
+
+	results := make(chan *Session, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			session, err := state.GetSession(sessionID, req)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- session
+		}()
+	}
+	<-backend.dialing
+	<-backend.dialing
+	done := make(chan error, 1)
+	go func() {
+		_, err := state.GetSession(other, req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("other session held up by a dial")
+	}
+
+	close(backend.gate)
+	s1, s2 := <-results, <-results
+	if s1 == nil || s1 != s2 {
+		t.Fatalf("got sessions %p and %p", s1, s2)
+	}
+	// One of the two backends was closed.
+	closed := 0
+	for _, conn := range backend.conns {
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Write([]byte("x")); err == io.ErrClosedPipe {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("%d of %d backends closed", closed, len(backend.conns))
+	}
+}
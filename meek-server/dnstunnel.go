@@ -0,0 +1,453 @@
+package main
+
+// The code in this file is a last-resort carrier for sessions, for when every
+// HTTP front is blocked: small payloads encoded in DNS queries and answers
+// (--dns-addr, --dns-domain). The client sends its queries through a public
+// DNS-over-HTTPS resolver (meek-client's mode=dns), which forwards them to
+// this server as the authoritative name server for the domain. It is slow—a
+// hundred or so bytes up and a kilobyte down per round trip—but enough to
+// fetch new bridge lines or keep a trickle of traffic going.
+//
+// A query is a TXT question for a name made of base32 labels under the domain.
+// The decoded labels are:
+//
+//	seq (4 bytes, big-endian) | flags (1 byte) | id length (1 byte) | session id | token (8 bytes) | payload
+//
+// The answer is a single TXT record, whose strings, joined together, are:
+//
+//	flags (1 byte) | payload
+//
+// The client numbers the queries of a session from 0 and sends them one at a
+// time, repeating a query that got no answer. Resolvers also repeat queries on
+// their own, so the server remembers the last answer for each session: a
+// repeated query gets the same answer again, not another turn on the session.
+//
+// The token is a random value chosen by the client for the session. The server
+// remembers the token of a session's first query, and ignores later queries,
+// including ones that close the session, that don't carry the same token, so
+// that knowing a session id is not enough to reach or close the session.
+//
+// The server answers no more than dnsMaxInFlight queries at a time, and drops
+// queries that arrive while it is busy; the resolver sends them again.
+//
+// Only UDP is supported. The resolver's address is not the client's, so
+// sessions carried over DNS have no client address: --session-ip-binding and
+// --session-tokens don't apply to them, --new-session-rate-per-ip counts them
+// all as one client, and a client address allow list (see acl.go) refuses
+// them. They are kept apart from HTTP sessions, so that a session id seen over
+// HTTP can't be used to reach the session over DNS.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"../lib/logging"
+)
+
+const (
+	// Flags in queries.
+	dnsFlagClose = 1 << 0
+	dnsFlagMux   = 1 << 1
+	// Flags in answers.
+	dnsFlagMoreData = 1 << 0
+	// The largest answer to send, whatever the resolver says it can take:
+	// the size that avoids IP fragmentation on nearly every path.
+	dnsMaxResponseSize = 1232
+	// The answer size to assume for resolvers that don't use EDNS.
+	dnsClassicResponseSize = 512
+	// The longest domain name, in presentation format without the final
+	// dot, and the longest label.
+	dnsMaxNameLength  = 253
+	dnsMaxLabelLength = 63
+	// The longest string in a TXT record.
+	dnsMaxTXTString = 255
+	// Prefix of the session map keys of sessions carried over DNS.
+	dnsSessionKeyPrefix = "dns:"
+	// The length of a session's token.
+	dnsTokenLength = 8
+	// The most queries to answer at once.
+	dnsMaxInFlight = 256
+)
+
+// Base32 without padding, for names; decoding is case-insensitive (see
+// dnsDecodeName), since resolvers may change the case of names.
+var dnsBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// The decoded labels of a tunnel query.
+type dnsQuery struct {
+	Seq       uint32
+	Flags     byte
+	SessionID string
+	Token     []byte
+	Payload   []byte
+}
+
+// Parse the decoded labels of a tunnel query.
+func parseDNSQuery(data []byte) (*dnsQuery, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("query too short")
+	}
+	idLen := int(data[5])
+	if len(data) < 6+idLen+dnsTokenLength {
+		return nil, fmt.Errorf("session id length %d too long", idLen)
+	}
+	return &dnsQuery{
+		Seq:       binary.BigEndian.Uint32(data[0:4]),
+		Flags:     data[4],
+		SessionID: string(data[6 : 6+idLen]),
+		Token:     data[6+idLen : 6+idLen+dnsTokenLength],
+		Payload:   data[6+idLen+dnsTokenLength:],
+	}, nil
+}
+
+// Return the data encoded in the labels of name before domain, which must
+// both be lowercase and end in a dot. ok is false if name is not under domain.
+func dnsDecodeName(name, domain string) (data []byte, ok bool, err error) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, "."+domain) {
+		return nil, name == domain, nil
+	}
+	labels := strings.TrimSuffix(name, "."+domain)
+	data, err = dnsBase32.DecodeString(strings.ToUpper(strings.ReplaceAll(labels, ".", "")))
+	return data, true, err
+}
+
+// The state of one session's queries, for answering repeated queries.
+type dnsSession struct {
+	lock    sync.Mutex
+	started bool
+	token   []byte
+	seq     uint32
+	answer  []byte
+	// When a query was last seen; guarded by the dnsTunnel's lock.
+	lastSeen time.Time
+}
+
+// dnsTunnel answers tunnel queries for a domain, carrying sessions on a State.
+type dnsTunnel struct {
+	state *State
+	// The domain, lowercase, ending in a dot.
+	domain string
+
+	lock      sync.Mutex
+	sessions  map[string]*dnsSession
+	lastPrune time.Time
+}
+
+// Make a dnsTunnel for domain, which must leave room in names for data.
+func newDNSTunnel(state *State, domain string) (*dnsTunnel, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return nil, fmt.Errorf("empty domain")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > dnsMaxLabelLength {
+			return nil, fmt.Errorf("bad domain %q", domain)
+		}
+	}
+	if len(domain) > dnsMaxNameLength/2 {
+		return nil, fmt.Errorf("domain %q is too long to leave room for data", domain)
+	}
+	return &dnsTunnel{
+		state:     state,
+		domain:    domain + ".",
+		sessions:  make(map[string]*dnsSession),
+		lastPrune: time.Now(),
+	}, nil
+}
+
+// Return the dnsSession for key, creating it if it doesn't exist, and remove
+// any that haven't been used for a while.
+func (t *dnsTunnel) getSession(key string) *dnsSession {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastPrune) > maxSessionStaleness/2 {
+		for k, s := range t.sessions {
+			if now.Sub(s.lastSeen) > maxSessionStaleness {
+				delete(t.sessions, k)
+			}
+		}
+		t.lastPrune = now
+	}
+	s := t.sessions[key]
+	if s == nil {
+		s = &dnsSession{}
+		t.sessions[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// Read queries from conn and answer them, until reading fails. Queries that
+// arrive while dnsMaxInFlight others are being answered are dropped.
+func (t *dnsTunnel) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 4096)
+	inFlight := make(chan struct{}, dnsMaxInFlight)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			logging.Debugf("dropping DNS query: %d queries in flight", dnsMaxInFlight)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-inFlight }()
+			resp := t.Answer(query)
+			if resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// Return the response to the DNS message query, or nil if there should be
+// none.
+func (t *dnsTunnel) Answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	// The size the resolver says it can take, or 0 if it doesn't use EDNS.
+	edns := 0
+	if err := p.SkipAllAnswers(); err == nil {
+		if err := p.SkipAllAuthorities(); err == nil {
+			for {
+				rh, err := p.AdditionalHeader()
+				if err != nil {
+					break
+				}
+				if rh.Type == dnsmessage.TypeOPT {
+					edns = min(max(int(rh.Class), dnsClassicResponseSize), dnsMaxResponseSize)
+				}
+				p.SkipAdditional()
+			}
+		}
+	}
+	limit := max(edns, dnsClassicResponseSize)
+
+	resp := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+		RCode:            dnsmessage.RCodeSuccess,
+	}
+	if header.OpCode != 0 || len(questions) != 1 {
+		resp.RCode = dnsmessage.RCodeFormatError
+		return buildDNSResponse(resp, questions, nil, edns)
+	}
+	q := questions[0]
+	data, ok, err := dnsDecodeName(q.Name.String(), t.domain)
+	if !ok {
+		resp.RCode = dnsmessage.RCodeRefused
+		return buildDNSResponse(resp, questions, nil, edns)
+	}
+	if err != nil || data == nil || q.Type != dnsmessage.TypeTXT || q.Class != dnsmessage.ClassINET {
+		// Not a tunnel query: no data.
+		return buildDNSResponse(resp, questions, nil, edns)
+	}
+	tq, err := parseDNSQuery(data)
+	if err == nil {
+		err = checkSessionID(tq.SessionID)
+	}
+	if err != nil {
+		logging.Debugf("rejecting DNS query: %s", err)
+		return buildDNSResponse(resp, questions, nil, edns)
+	}
+
+	answer, err := t.answerQuery(tq, limit-dnsResponseOverhead(resp, q, edns))
+	if err != nil {
+		resp.RCode = dnsmessage.RCodeServerFailure
+		return buildDNSResponse(resp, questions, nil, edns)
+	}
+	return buildDNSResponse(resp, questions, answer, edns)
+}
+
+// Return the flags and payload to answer tq with, no more than size bytes in
+// all (including TXT string lengths), doing a transaction on its session
+// unless tq repeats the previous query.
+func (t *dnsTunnel) answerQuery(tq *dnsQuery, size int) ([]byte, error) {
+	// The largest flags and payload that fit in size, with a length byte
+	// for each TXT string.
+	size -= (size + dnsMaxTXTString) / (dnsMaxTXTString + 1)
+	if size < 1 {
+		return nil, fmt.Errorf("no room for an answer")
+	}
+	key := dnsSessionKeyPrefix + tq.SessionID
+	s := t.getSession(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started && subtle.ConstantTimeCompare(tq.Token, s.token) != 1 {
+		logging.Debugf("DNS session %s: bad token", scrubSessionID(key))
+		return nil, fmt.Errorf("bad token")
+	}
+	if s.started && tq.Seq == s.seq {
+		if len(s.answer) > size {
+			return nil, fmt.Errorf("repeated answer does not fit")
+		}
+		return s.answer, nil
+	}
+	if !(!s.started && tq.Seq == 0) && !(s.started && tq.Seq == s.seq+1) {
+		logging.Debugf("DNS session %s: unexpected sequence number %d", scrubSessionID(key), tq.Seq)
+		return nil, fmt.Errorf("unexpected sequence number")
+	}
+
+	answer, err := t.transact(key, tq, size)
+	if err != nil {
+		return nil, err
+	}
+	if !s.started {
+		s.token = append([]byte(nil), tq.Token...)
+	}
+	s.started = true
+	s.seq = tq.Seq
+	s.answer = answer
+	return answer, nil
+}
+
+// Do a transaction for tq on the session key, returning the flags and payload
+// of the answer, no more than size bytes.
+func (t *dnsTunnel) transact(key string, tq *dnsQuery, size int) ([]byte, error) {
+	id := newRequestID()
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), requestIDContextKey{}, id), readWriteTimeout)
+	defer cancel()
+	if tq.Flags&dnsFlagClose != 0 {
+		t.state.CloseSession(key, closeReasonExplicit)
+		return []byte{0}, nil
+	}
+
+	// A stand-in for an HTTP request, with no client address, for
+	// GetSession.
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/", nil)
+	if tq.Flags&dnsFlagMux != 0 {
+		req.Header.Set(muxHeader, "1")
+	}
+	session, err := t.state.GetSession(key, req)
+	if err != nil {
+		logging.Debugf("[%s] DNS: %s", id, err)
+		return nil, err
+	}
+	arrived := time.Now()
+	err = session.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	up, down := session.BytesUp.Load(), session.BytesDown.Load()
+	answer, err := dnsTransact(session, tq.Payload, size)
+	session.Unlock()
+	ev := traceEvent{
+		Time:       arrived,
+		Event:      traceEventRequest,
+		RequestID:  id,
+		Up:         session.BytesUp.Load() - up,
+		Down:       session.BytesDown.Load() - down,
+		DurationMS: traceMS(time.Since(arrived)),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	session.trace.Add(ev)
+	if err != nil {
+		logging.Warnf("[%s] DNS: %s", id, err)
+		t.state.CloseSession(key, closeReasonError)
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Write payload to the OR port of session, and read back no more than size-1
+// bytes. Returns the flags and the data read.
+func dnsTransact(session *Session, payload []byte, size int) ([]byte, error) {
+	session.Or.SetWriteDeadline(time.Now().Add(readWriteTimeout))
+	nw, err := session.Or.Write(payload)
+	session.Or.SetWriteDeadline(time.Time{})
+	session.BytesUp.Add(int64(nw))
+	bandwidthAcct.Add(int64(nw))
+	if err != nil {
+		return nil, fmt.Errorf("error copying payload to ORPort: %s", scrubError(err))
+	}
+
+	buf := make([]byte, size)
+	session.Or.SetReadDeadline(time.Now().Add(turnaroundTimeout))
+	n, err := session.Or.Read(buf[1:])
+	if err != nil {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return nil, fmt.Errorf("reading from ORPort: %s", err)
+		}
+	}
+	session.BytesDown.Add(int64(n))
+	bandwidthAcct.Add(int64(n))
+	if nw > 0 || n > 0 {
+		session.lastData.Store(time.Now().UnixNano())
+	}
+	transportRequestRate.Add()
+	if n == len(buf)-1 {
+		buf[0] |= dnsFlagMoreData
+	}
+	return buf[:1+n], nil
+}
+
+// Return the size of a response with header and question q, and an empty TXT
+// answer.
+func dnsResponseOverhead(header dnsmessage.Header, q dnsmessage.Question, edns int) int {
+	return len(buildDNSResponse(header, []dnsmessage.Question{q}, []byte{}, edns))
+}
+
+// Build a response with header and questions. If answer is not nil, it is put
+// in a TXT record for the first question, split into strings. edns, if not 0,
+// is the size to advertise in an EDNS OPT record.
+func buildDNSResponse(header dnsmessage.Header, questions []dnsmessage.Question, answer []byte, edns int) []byte {
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	b.StartQuestions()
+	for _, q := range questions {
+		b.Question(q)
+	}
+	b.StartAnswers()
+	if answer != nil && len(questions) > 0 {
+		var txt []string
+		for len(answer) > dnsMaxTXTString {
+			txt = append(txt, string(answer[:dnsMaxTXTString]))
+			answer = answer[dnsMaxTXTString:]
+		}
+		txt = append(txt, string(answer))
+		b.TXTResource(dnsmessage.ResourceHeader{
+			Name:  questions[0].Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   0,
+		}, dnsmessage.TXTResource{TXT: txt})
+	}
+	if edns != 0 {
+		b.StartAdditionals()
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(edns, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
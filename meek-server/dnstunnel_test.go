@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testDNSDomain = "t.example.com"
+
+// The session token of test queries.
+const testDNSToken = "tokentok"
+
+// Build a query for name of type qtype, with EDNS if edns is not 0.
+func makeTestDNSQuery(t *testing.T, name string, qtype dnsmessage.Type, edns int) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	if edns != 0 {
+		b.StartAdditionals()
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(edns, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// Build a tunnel query, with the labels in mixed case, as some resolvers send
+// them.
+func makeTestTunnelQuery(t *testing.T, seq uint32, flags byte, sessionID, token string, payload []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, seq)
+	data = append(data, flags, byte(len(sessionID)))
+	data = append(data, sessionID...)
+	data = append(data, token...)
+	data = append(data, payload...)
+	encoded := dnsBase32.EncodeToString(data)
+	var labels []string
+	for len(encoded) > 63 {
+		labels = append(labels, encoded[:63])
+		encoded = encoded[63:]
+	}
+	labels = append(labels, strings.ToLower(encoded))
+	return makeTestDNSQuery(t, strings.Join(labels, ".")+"."+testDNSDomain+".", dnsmessage.TypeTXT, 1232)
+}
+
+// Parse a response, returning its RCode and the joined strings of its TXT
+// answer, or nil if there is none.
+func parseTestDNSResponse(t *testing.T, msg []byte) (dnsmessage.RCode, []byte) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1234 || !m.Response {
+		t.Fatalf("bad response header %+v", m.Header)
+	}
+	var answer []byte
+	for _, rr := range m.Answers {
+		txt, ok := rr.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			t.Fatalf("answer %v is not TXT", rr)
+		}
+		answer = []byte(strings.Join(txt.TXT, ""))
+	}
+	return m.RCode, answer
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	q, err := parseDNSQuery([]byte("\x00\x00\x01\x02\x01\x03abc" + testDNSToken + "payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Seq != 258 || q.Flags != dnsFlagClose || q.SessionID != "abc" || string(q.Token) != testDNSToken || string(q.Payload) != "payload" {
+		t.Errorf("got %+v", q)
+	}
+	for _, data := range []string{"", "\x00\x00\x00\x00\x00", "\x00\x00\x00\x00\x00\x05abc", "\x00\x00\x00\x00\x00\x03abctoken"} {
+		if _, err := parseDNSQuery([]byte(data)); err == nil {
+			t.Errorf("%q: unexpected success", data)
+		}
+	}
+}
+
+func TestNewDNSTunnel(t *testing.T) {
+	tunnel, err := newDNSTunnel(NewState(), "T.Example.COM.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.domain != "t.example.com." {
+		t.Errorf("domain %q", tunnel.domain)
+	}
+	for _, domain := range []string{"", ".", strings.Repeat("a.", 70) + "com", "bad..example"} {
+		if _, err := newDNSTunnel(NewState(), domain); err == nil {
+			t.Errorf("%q: unexpected success", domain)
+		}
+	}
+}
+
+// Queries that aren't for the tunnel are answered as a name server would.
+func TestDNSTunnelNonTunnelQueries(t *testing.T) {
+	tunnel, err := newDNSTunnel(NewState(), testDNSDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+	}{
+		{"www.example.org.", dnsmessage.TypeTXT, dnsmessage.RCodeRefused},
+		{testDNSDomain + ".", dnsmessage.TypeA, dnsmessage.RCodeSuccess},
+		{testDNSDomain + ".", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess},
+		{"not-base32!." + testDNSDomain + ".", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess},
+		{"aaaaaaaa." + testDNSDomain + ".", dnsmessage.TypeA, dnsmessage.RCodeSuccess},
+	} {
+		resp := tunnel.Answer(makeTestDNSQuery(t, test.name, test.qtype, 0))
+		if resp == nil {
+			t.Errorf("%s %v: no response", test.name, test.qtype)
+			continue
+		}
+		rcode, answer := parseTestDNSResponse(t, resp)
+		if rcode != test.rcode || answer != nil {
+			t.Errorf("%s %v: got %v, %q", test.name, test.qtype, rcode, answer)
+		}
+	}
+}
+
+// Data goes to the backend and comes back in answers; repeated queries get
+// the same answer; out-of-order queries fail; and a close query closes the
+// session.
+func TestDNSTunnelSession(t *testing.T) {
+	useEchoBackend(t)
+	state := NewState()
+	tunnel, err := newDNSTunnel(state, testDNSDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	msg := []byte("hello over dns")
+
+	var seq uint32
+	var received []byte
+	var last []byte
+	payload := msg
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(received, msg) && time.Now().Before(deadline) {
+		rcode, answer := parseTestDNSResponse(t, tunnel.Answer(makeTestTunnelQuery(t, seq, 0, sessionID, testDNSToken, payload)))
+		if rcode != dnsmessage.RCodeSuccess || len(answer) < 1 {
+			t.Fatalf("seq %d: got %v, %q", seq, rcode, answer)
+		}
+		received = append(received, answer[1:]...)
+		last = answer
+		payload = nil
+		seq++
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Equal(received, msg) {
+		t.Fatalf("received %q", received)
+	}
+
+	_, answer := parseTestDNSResponse(t, tunnel.Answer(makeTestTunnelQuery(t, seq-1, 0, sessionID, testDNSToken, nil)))
+	if !bytes.Equal(answer, last) {
+		t.Errorf("repeated query: got %q, expected %q", answer, last)
+	}
+	rcode, _ := parseTestDNSResponse(t, tunnel.Answer(makeTestTunnelQuery(t, seq+1, 0, sessionID, testDNSToken, nil)))
+	if rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("skipped sequence number: got %v", rcode)
+	}
+	// Queries with another token, whether repeated, next, or closing, are
+	// refused.
+	for _, q := range []struct {
+		seq   uint32
+		flags byte
+	}{{seq - 1, 0}, {seq, 0}, {seq, dnsFlagClose}} {
+		rcode, _ := parseTestDNSResponse(t, tunnel.Answer(makeTestTunnelQuery(t, q.seq, q.flags, sessionID, "badtoken", nil)))
+		if rcode != dnsmessage.RCodeServerFailure {
+			t.Errorf("seq %d flags %d with bad token: got %v", q.seq, q.flags, rcode)
+		}
+	}
+
+	// The session is not reachable over HTTP.
+	if state.shard(sessionID).sessions.Load(sessionID) != nil {
+		t.Errorf("DNS session stored under its HTTP session id")
+	}
+	key := dnsSessionKeyPrefix + sessionID
+	rcode, _ = parseTestDNSResponse(t, tunnel.Answer(makeTestTunnelQuery(t, seq, dnsFlagClose, sessionID, testDNSToken, nil)))
+	if rcode != dnsmessage.RCodeSuccess {
+		t.Errorf("close: got %v", rcode)
+	}
+	if state.shard(key).sessions.Load(key) != nil {
+		t.Errorf("session not closed")
+	}
+}
+
+// Answers fit in the size the resolver can take.
+func TestDNSTunnelAnswerSize(t *testing.T) {
+	state := NewState()
+	tunnel, err := newDNSTunnel(state, testDNSDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	// A backend with more to send than fits in one answer.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+	go c2.Write(bytes.Repeat([]byte("x"), 5000))
+	key := dnsSessionKeyPrefix + sessionID
+	state.shard(key).sessions.Store(key, NewSession(c1))
+
+	for _, edns := range []int{0, 1232, 4096} {
+		seq := uint32(0)
+		if edns != 0 {
+			seq = tunnel.sessions[key].seq + 1
+		}
+		query := makeTestTunnelQuery(t, seq, 0, sessionID, testDNSToken, nil)
+		if edns != 1232 {
+			// Rebuild the query with a different EDNS size.
+			var m dnsmessage.Message
+			m.Unpack(query)
+			query = makeTestDNSQuery(t, m.Questions[0].Name.String(), dnsmessage.TypeTXT, edns)
+		}
+		resp := tunnel.Answer(query)
+		limit := max(min(edns, dnsMaxResponseSize), dnsClassicResponseSize)
+		if len(resp) > limit {
+			t.Errorf("EDNS %d: response of %d bytes", edns, len(resp))
+		}
+		_, answer := parseTestDNSResponse(t, resp)
+		if len(answer) < limit/2 || answer[0]&dnsFlagMoreData == 0 {
+			t.Errorf("EDNS %d: full answer of %d bytes not flagged", edns, len(answer))
+		}
+	}
+}
+
+func FuzzDNSQuery(f *testing.F) {
+	domain := testDNSDomain + "."
+	var query []byte
+	query = binary.BigEndian.AppendUint32(query, 1)
+	query = append(query, 0, byte(len("Y2FyZ28gdHJ1Y2s")))
+	query = append(query, "Y2FyZ28gdHJ1Y2s"+testDNSToken+"hello"...)
+	encoded := strings.ToLower(dnsBase32.EncodeToString(query))
+	f.Add(encoded + "." + domain)
+	f.Add(encoded[:20] + "." + encoded[20:] + "." + strings.ToUpper(domain))
+	f.Add(domain)
+	f.Add("x." + domain)
+	f.Add("aaaaaaaaaa." + domain)
+	f.Add("other.example.")
+	f.Fuzz(func(t *testing.T, name string) {
+		data, ok, err := dnsDecodeName(name, domain)
+		if !ok || err != nil {
+			return
+		}
+		q, err := parseDNSQuery(data)
+		if err != nil {
+			return
+		}
+		if 6+len(q.SessionID)+len(q.Token)+len(q.Payload) != len(data) || len(q.Token) != dnsTokenLength {
+			t.Fatalf("%q: %d bytes of session id and %d of payload in %d bytes", name, len(q.SessionID), len(q.Payload), len(data))
+		}
+		checkSessionID(q.SessionID)
+	})
+}
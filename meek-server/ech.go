@@ -0,0 +1,316 @@
+package main
+
+// The code in this file implements Encrypted Client Hello on the TLS listener
+// (--ech-public-name). With ECH, a client encrypts the real SNI (and the rest
+// of its Client Hello) under a public key it got from the server, typically
+// from a DNS HTTPS record, and the only name visible on the wire is the public
+// name. That helps direct-connect deployments, which have no CDN to hide
+// behind.
+//
+// The server generates its own X25519 ECH keys. A new key is made every
+// --ech-key-rotation, and the one before it is still accepted until the next
+// rotation, so clients with a cached config keep working. The keys are kept in
+// the pluggable transport state directory (meek-ech-keys.json), when there is
+// one, so they survive restarts. The ECHConfigList of the current key is
+// written, base64-encoded, to --ech-config-file, and as a DNS HTTPS record to
+// --ech-dns-record-file, for the operator to publish. A client whose config is
+// out of date gets the current one as a retry config in the handshake.
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The name of the key file in the state directory.
+	echStateFilename = "meek-ech-keys.json"
+	// How many keys to accept: the current one and the one before it.
+	echMaxKeys = 2
+	// The TTL to put in the DNS record.
+	echDNSTTL = 300
+
+	// Protocol constants; see draft-ietf-tls-esni and RFC 9180.
+	echConfigVersion     = 0xfe0d
+	hpkeKEMX25519        = 0x0020
+	hpkeKDFHKDFSHA256    = 0x0001
+	hpkeAEADAES128GCM    = 0x0001
+	hpkeAEADChaCha20Poly = 0x0003
+)
+
+// One ECH key, in the form saved in the state file.
+type echKey struct {
+	ConfigID   uint8     `json:"config_id"`
+	PrivateKey []byte    `json:"private_key"`
+	Created    time.Time `json:"created"`
+}
+
+// Make the ECHConfig for a key.
+func (key *echKey) config(publicName string) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(publicName) == 0 || len(publicName) > 255 {
+		return nil, fmt.Errorf("bad ECH public name length %d", len(publicName))
+	}
+	pub := priv.PublicKey().Bytes()
+
+	var contents []byte
+	contents = append(contents, key.ConfigID)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	suites := []uint16{
+		hpkeKDFHKDFSHA256, hpkeAEADAES128GCM,
+		hpkeKDFHKDFSHA256, hpkeAEADChaCha20Poly,
+	}
+	contents = binary.BigEndian.AppendUint16(contents, uint16(2*len(suites)))
+	for _, id := range suites {
+		contents = binary.BigEndian.AppendUint16(contents, id)
+	}
+	// maximum_name_length: 0, meaning let the client decide padding.
+	contents = append(contents, 0)
+	contents = append(contents, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	// No extensions.
+	contents = binary.BigEndian.AppendUint16(contents, 0)
+
+	var config []byte
+	config = binary.BigEndian.AppendUint16(config, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	return append(config, contents...), nil
+}
+
+// Make a new random key whose config id differs from avoid.
+func newECHKey(avoid int, now time.Time) (echKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return echKey{}, err
+	}
+	var id [1]byte
+	for {
+		_, err = rand.Read(id[:])
+		if err != nil {
+			return echKey{}, err
+		}
+		if int(id[0]) != avoid {
+			break
+		}
+	}
+	return echKey{ConfigID: id[0], PrivateKey: priv.Bytes(), Created: now}, nil
+}
+
+// Options for the ECH keys.
+type echOptions struct {
+	// The name clients put in the outer Client Hello.
+	PublicName string
+	// How often to make a new key.
+	Rotation time.Duration
+	// Where to save the keys, or "" to keep them only in memory.
+	StatePath string
+	// Where to write the current ECHConfigList (base64) and a DNS HTTPS
+	// record, or "" for neither.
+	ConfigFile    string
+	DNSRecordFile string
+}
+
+// echKeySet holds the current ECH keys. A nil *echKeySet means ECH is off.
+type echKeySet struct {
+	echOptions
+	now func() time.Time
+
+	lock sync.Mutex
+	// Newest first.
+	keys    []echKey
+	tlsKeys []tls.EncryptedClientHelloKey
+}
+
+// The ECH keys, or nil if ECH is off. Set up in main.
+var echKeys *echKeySet
+
+// Make an echKeySet, loading any keys saved in opts.StatePath, and making a
+// new one if they are missing or due for rotation.
+func newECHKeySet(opts echOptions) (*echKeySet, error) {
+	if opts.Rotation <= 0 {
+		return nil, fmt.Errorf("ECH key rotation interval must be positive")
+	}
+	ks := &echKeySet{echOptions: opts, now: time.Now}
+	if opts.StatePath != "" {
+		data, err := ioutil.ReadFile(opts.StatePath)
+		if err == nil {
+			err = json.Unmarshal(data, &ks.keys)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", opts.StatePath, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	err := ks.setKeys(ks.keys)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ks.rotateIfDue()
+	return ks, err
+}
+
+// Install keys as the current ones. Must be called with the lock held, or
+// before ks is shared.
+func (ks *echKeySet) setKeys(keys []echKey) error {
+	if len(keys) > echMaxKeys {
+		keys = keys[:echMaxKeys]
+	}
+	tlsKeys := make([]tls.EncryptedClientHelloKey, len(keys))
+	for i := range keys {
+		config, err := keys[i].config(ks.PublicName)
+		if err != nil {
+			return err
+		}
+		tlsKeys[i] = tls.EncryptedClientHelloKey{
+			Config:     config,
+			PrivateKey: keys[i].PrivateKey,
+			// Only offer the current config as a retry config.
+			SendAsRetry: i == 0,
+		}
+	}
+	ks.keys = keys
+	ks.tlsKeys = tlsKeys
+	return nil
+}
+
+// Return the time the current key is due to be replaced.
+func (ks *echKeySet) nextRotation() time.Time {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if len(ks.keys) == 0 {
+		return ks.now()
+	}
+	return ks.keys[0].Created.Add(ks.Rotation)
+}
+
+// Make a new key if there is none or the current one is old enough, then save
+// and publish. Returns whether there was a new key.
+func (ks *echKeySet) rotateIfDue() (bool, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	now := ks.now()
+	avoid := -1
+	if len(ks.keys) > 0 {
+		if now.Before(ks.keys[0].Created.Add(ks.Rotation)) {
+			return false, ks.publish()
+		}
+		avoid = int(ks.keys[0].ConfigID)
+	}
+	key, err := newECHKey(avoid, now)
+	if err != nil {
+		return false, err
+	}
+	err = ks.setKeys(append([]echKey{key}, ks.keys...))
+	if err != nil {
+		return false, err
+	}
+	err = ks.save()
+	if err != nil {
+		return true, err
+	}
+	return true, ks.publish()
+}
+
+// Return the ECHConfigList with the current config. Must be called with the
+// lock held.
+func (ks *echKeySet) configList() []byte {
+	config := ks.tlsKeys[0].Config
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	return append(list, config...)
+}
+
+// Return the ECHConfigList with the current config.
+func (ks *echKeySet) ConfigList() []byte {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.configList()
+}
+
+// Format a DNS HTTPS record (RFC 9460) advertising the ECHConfigList.
+func formatECHDNSRecord(publicName string, configList []byte) string {
+	return fmt.Sprintf("%s. %d IN HTTPS 1 . alpn=\"h2,http/1.1\" ech=\"%s\"\n",
+		publicName, echDNSTTL, base64.StdEncoding.EncodeToString(configList))
+}
+
+// Write a file by way of a temporary file, so readers never see it partly
+// written.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Write the keys to the state file. Must be called with the lock held.
+func (ks *echKeySet) save() error {
+	if ks.StatePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(ks.keys)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ks.StatePath, data, 0600)
+}
+
+// Write the current config to --ech-config-file and --ech-dns-record-file.
+// Must be called with the lock held.
+func (ks *echKeySet) publish() error {
+	list := ks.configList()
+	if ks.ConfigFile != "" {
+		err := writeFileAtomic(ks.ConfigFile, []byte(base64.StdEncoding.EncodeToString(list)+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if ks.DNSRecordFile != "" {
+		err := writeFileAtomic(ks.DNSRecordFile, []byte(formatECHDNSRecord(ks.PublicName, list)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the keys to accept, for tls.Config.GetEncryptedClientHelloKeys.
+func (ks *echKeySet) GetKeys(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.tlsKeys, nil
+}
+
+// Rotate keys when they are due, forever.
+func (ks *echKeySet) Run() {
+	for {
+		time.Sleep(time.Until(ks.nextRotation()))
+		rotated, err := ks.rotateIfDue()
+		if err != nil {
+			logging.Warnf("error rotating ECH keys: %s", err)
+			// Don't spin if the error keeps happening.
+			time.Sleep(time.Minute)
+			continue
+		}
+		if rotated {
+			logging.Infof("rotated ECH key; publish the new config: %s",
+				base64.StdEncoding.EncodeToString(ks.ConfigList()))
+		}
+	}
+}
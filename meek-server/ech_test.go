@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestECHKeySet(t *testing.T, dir string, now *time.Time) *echKeySet {
+	ks, err := newECHKeySet(echOptions{
+		PublicName:    "public.example.com",
+		Rotation:      24 * time.Hour,
+		StatePath:     filepath.Join(dir, echStateFilename),
+		ConfigFile:    filepath.Join(dir, "ech.txt"),
+		DNSRecordFile: filepath.Join(dir, "ech.zone"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.now = func() time.Time { return *now }
+	return ks
+}
+
+func TestECHKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ks := newTestECHKeySet(t, dir, &now)
+	first := ks.ConfigList()
+
+	// The config list is published.
+	data, err := os.ReadFile(filepath.Join(dir, "ech.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != base64.StdEncoding.EncodeToString(first) {
+		t.Errorf("config file %q", data)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "ech.zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != formatECHDNSRecord("public.example.com", first) {
+		t.Errorf("DNS record file %q", data)
+	}
+
+	// Not due yet.
+	if rotated, err := ks.rotateIfDue(); rotated || err != nil {
+		t.Errorf("early rotation: %v, %v", rotated, err)
+	}
+
+	// The keys survive a restart.
+	ks = newTestECHKeySet(t, dir, &now)
+	if string(ks.ConfigList()) != string(first) {
+		t.Errorf("different config after reload")
+	}
+
+	// After rotation, the old key is still accepted, but only the new one
+	// is offered for retry.
+	now = now.Add(25 * time.Hour)
+	if rotated, err := ks.rotateIfDue(); !rotated || err != nil {
+		t.Fatalf("no rotation: %v, %v", rotated, err)
+	}
+	if string(ks.ConfigList()) == string(first) {
+		t.Errorf("same config after rotation")
+	}
+	if len(ks.tlsKeys) != 2 || !ks.tlsKeys[0].SendAsRetry || ks.tlsKeys[1].SendAsRetry {
+		t.Errorf("keys after rotation: %+v", ks.tlsKeys)
+	}
+	if ks.keys[0].ConfigID == ks.keys[1].ConfigID {
+		t.Errorf("config id reused")
+	}
+
+	// A third key pushes out the first.
+	now = now.Add(25 * time.Hour)
+	ks.rotateIfDue()
+	if len(ks.keys) != echMaxKeys {
+		t.Errorf("%d keys, expected %d", len(ks.keys), echMaxKeys)
+	}
+}
+
+// Test that a client using the published config gets ECH accepted.
+func TestECHHandshake(t *testing.T) {
+	now := time.Now()
+	ks := newTestECHKeySet(t, t.TempDir(), &now)
+	serverConfig := &tls.Config{
+		Certificates:                []tls.Certificate{*mustLoadCertificate([]byte(cert1PEM), []byte(key1PEM))},
+		GetEncryptedClientHelloKeys: ks.GetKeys,
+	}
+	clientConfig := &tls.Config{
+		ServerName:                     "meek-server.example.com",
+		InsecureSkipVerify:             true,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: ks.ConfigList(),
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	client, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.ConnectionState().ECHAccepted {
+		t.Errorf("ECH not accepted")
+	}
+}
+
+func TestECHBadRotation(t *testing.T) {
+	_, err := newECHKeySet(echOptions{PublicName: "public.example.com"})
+	if err == nil {
+		t.Errorf("no error with a zero rotation interval")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// The code in this file implements the diagnostic echo endpoint used by
+// "meek-client test". It is off unless --echo-secret-file is given. A POST to
+// the path element "echo", with a session id like any other polling request
+// and an X-Echo-Auth header proving knowledge of the secret, gets its body back
+// unchanged. Nothing is connected to the backend, so a client can measure
+// round-trip time and throughput through the front and CDN without tor.
+//
+// The X-Echo-Auth header is the hex HMAC-SHA256 of the session id under the
+// secret, so the secret itself never crosses the CDN, and the header differs
+// from one session to the next. An echo request that is not authenticated is
+// answered like any other invalid transport request (see probe.go), and an
+// authenticated one is subject to the same client ACL, load, bandwidth
+// budget, and rate checks as the first request of a new session.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"../lib/logging"
+)
+
+const (
+	// The last path element of a diagnostic echo request.
+	echoPath = "echo"
+	// The request header that authenticates a diagnostic echo request.
+	echoAuthHeader = "X-Echo-Auth"
+	// The shortest echo secret accepted.
+	minEchoSecretLength = 16
+)
+
+// Read the echo secret from filename.
+func readEchoSecret(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if len(secret) < minEchoSecretLength {
+		return "", fmt.Errorf("echo secret in %s is shorter than %d characters", filename, minEchoSecretLength)
+	}
+	return secret, nil
+}
+
+// Return the X-Echo-Auth value for sessionID under secret.
+func echoAuth(secret, sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Is the diagnostic echo endpoint enabled?
+func echoEnabled() bool {
+	return options.EchoSecret != ""
+}
+
+// Is req a diagnostic echo request?
+func isEchoRequest(req *http.Request) bool {
+	return req.Method == "POST" && path.Base(req.URL.Path) == echoPath
+}
+
+// Handle a diagnostic echo request.
+func (state *State) Echo(w http.ResponseWriter, req *http.Request) {
+	sessionID := req.Header.Get("X-Session-Id")
+	if checkSessionID(sessionID) != nil ||
+		!tokenMatches(req.Header.Get(echoAuthHeader), echoAuth(options.EchoSecret, sessionID)) {
+		logging.Debugf("[%s] unauthenticated echo request", requestID(req))
+		serveProbeResponse(w, req)
+		return
+	}
+	ip, _ := originalClientIP(req)
+	if err := admitNewSession(ip); err != nil {
+		logging.Debugf("[%s] echo: %s", requestID(req), err)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+
+	options.CORS.SetHeaders(w, req)
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadLength))
+	bandwidthAcct.Add(int64(len(body)))
+	if err != nil {
+		httpBadRequest(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	n, _ := w.Write(body)
+	bandwidthAcct.Add(int64(n))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testEchoSecret = "0123456789abcdef"
+
+func echoRequest(sessionID, auth string, body []byte) *http.Request {
+	req := httptest.NewRequest("POST", "/echo", bytes.NewReader(body))
+	req.Header.Set("X-Session-Id", sessionID)
+	if auth != "" {
+		req.Header.Set(echoAuthHeader, auth)
+	}
+	return req
+}
+
+func TestEcho(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.EchoSecret = testEchoSecret
+	state := NewState()
+	payload := bytes.Repeat([]byte("echo"), 1000)
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	auth := echoAuth(testEchoSecret, sessionID)
+
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, echoRequest(sessionID, auth, payload))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !bytes.Equal(body, payload) {
+		t.Errorf("body not echoed")
+	}
+	if state.NumSessions() != 0 {
+		t.Errorf("echo created a session")
+	}
+
+	// Without the right authentication, or with a bad session id, the
+	// answer is the probe response.
+	for _, req := range []*http.Request{
+		echoRequest(sessionID, "", payload),
+		echoRequest(sessionID, echoAuth("wrong secret", sessionID), payload),
+		echoRequest(sessionID, echoAuth(testEchoSecret, "another session"), payload),
+		echoRequest("short", echoAuth(testEchoSecret, "short"), payload),
+	} {
+		rec = httptest.NewRecorder()
+		state.ServeHTTP(rec, req)
+		if body, _ := io.ReadAll(rec.Body); bytes.Equal(body, payload) {
+			t.Errorf("%q: echoed", req.Header.Get(echoAuthHeader))
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d", req.Header.Get(echoAuthHeader), rec.Code)
+		}
+	}
+
+	// Too big.
+	rec = httptest.NewRecorder()
+	state.ServeHTTP(rec, echoRequest(sessionID, auth, make([]byte, maxPayloadLength+1)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("oversized body: status %d", rec.Code)
+	}
+}
+
+// Echo requests get the same admission checks as new sessions.
+func TestEchoAdmission(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.EchoSecret = testEchoSecret
+	defer clientACL.Set(nil, nil)
+	if err := clientACL.Set(nil, []string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	req := echoRequest("Y2FyZ28gdHJ1Y2s", echoAuth(testEchoSecret, "Y2FyZ28gdHJ1Y2s"), []byte("hello"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	NewState().ServeHTTP(rec, req)
+	if body, _ := io.ReadAll(rec.Body); string(body) == "hello" {
+		t.Errorf("denied client got an echo")
+	}
+}
+
+// With the echo endpoint off, an echo request is not special.
+func TestEchoDisabled(t *testing.T) {
+	req := echoRequest("Y2FyZ28gdHJ1Y2s", echoAuth("", "Y2FyZ28gdHJ1Y2s"), []byte("hello"))
+	req.Header.Del("X-Session-Id")
+	rec := httptest.NewRecorder()
+	NewState().ServeHTTP(rec, req)
+	if body, _ := io.ReadAll(rec.Body); string(body) == "hello" {
+		t.Errorf("disabled echo endpoint echoed")
+	}
+}
+
+func TestReadEchoSecret(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "secret")
+	os.WriteFile(filename, []byte(testEchoSecret+"\n"), 0600)
+	if secret, err := readEchoSecret(filename); err != nil || secret != testEchoSecret {
+		t.Errorf("got %q, %v", secret, err)
+	}
+	os.WriteFile(filename, []byte("short"), 0600)
+	if _, err := readEchoSecret(filename); err == nil {
+		t.Errorf("short secret accepted")
+	}
+}
+
+// The known HMAC-SHA256 of RFC 4231 test case 2, the same as meek-client's.
+func TestEchoAuth(t *testing.T) {
+	if auth := echoAuth("Jefe", "what do ya want for nothing?"); auth != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("got %s", auth)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+// The code in this file shares the server's downstream bandwidth fairly among
+// sessions when it is saturated (--fair-rate). Without it, responses go out
+// in whatever order their requests happen to be served, so one client doing a
+// bulk download, whose every response is full, can crowd out interactive
+// sessions that only need a few hundred bytes at a time.
+//
+// --fair-rate is the downstream capacity to schedule, in bytes per second.
+// Each request waits for an allocation for its response payload before it
+// takes its session's turn on the backend, so that nothing read from the
+// backend is held while waiting. As the size of the payload is not known
+// until it has been read, the allocation is for the size of the session's
+// last one; the difference is taken or given back afterwards. While the rate
+// is not used up, allocations are granted at once. Beyond that, responses wait in a queue
+// per session, and the queues are served by deficit round robin: on each turn
+// a session's deficit grows by fairQuantum, and it may send responses as long
+// as the deficit covers them. A session with small responses is served on its
+// first turn; one with a full 64 KB response waits a few turns, while the
+// others get theirs. WebSocket sessions, which have no turns, wait after
+// each read from the backend instead.
+//
+// A session in a QoS class (see qos.go) gets the class's weight times
+// fairQuantum on each turn. A class with a min share has a token bucket
+// filling at that fraction of the rate; while it is not empty, the class's
+// sessions are served first. A class with a max share has a bucket filling at
+// that fraction, and its sessions wait while it is empty, saturated or not.
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// How much a session's deficit grows on each turn.
+	fairQuantum = 16 << 10
+	// How much of the rate may be used at once after an idle spell.
+	fairBurstTime = 100 * time.Millisecond
+)
+
+// A response payload waiting for its allocation.
+type fairRequest struct {
+	n       int
+	granted chan struct{}
+}
+
+// The token buckets of a QoS class for its min and max shares, nil if it
+// doesn't have one.
+type fairClass struct {
+	min, max *tokenBucket
+}
+
+// Is the class under its max share? A nil *fairClass always is.
+func (c *fairClass) underMax() bool {
+	return c == nil || c.max == nil || c.max.tokens >= 0
+}
+
+// Is the class under its min share, and not over its max?
+func (c *fairClass) underMin() bool {
+	return c != nil && c.min != nil && c.min.tokens >= 0 && c.underMax()
+}
+
+// The queue of one session.
+type fairFlow struct {
+	session *Session
+	class   *fairClass
+	weight  int
+	queue   []*fairRequest
+	deficit int
+	// Whether the flow has had its quantum for its current turn.
+	turn bool
+}
+
+// fairScheduler allocates downstream bandwidth among sessions. A nil
+// *fairScheduler grants everything at once.
+type fairScheduler struct {
+	rate float64
+	now  func() time.Time
+	// Signaled when a request is queued.
+	wake chan struct{}
+
+	lock    sync.Mutex
+	bucket  *tokenBucket
+	flows   map[*Session]*fairFlow
+	classes map[*qosClass]*fairClass
+	// The flows with requests, in round robin order. The first is the one
+	// whose turn it is.
+	active []*fairFlow
+}
+
+// The fair scheduler, or nil if there is no --fair-rate. Set up in main.
+var fairSched *fairScheduler
+
+// The context key of the *fairReservation for a request's response payload.
+type fairReservationContextKey struct{}
+
+// The bytes reserved by Reserve for a response payload, which must be settled
+// once whatever happens to the request.
+type fairReservation struct {
+	sched    *fairScheduler
+	session  *Session
+	reserved int
+	settled  bool
+}
+
+// Settle the reservation for a payload of n bytes, unless it has been settled
+// already. A nil reservation does nothing.
+func (r *fairReservation) Settle(n int) {
+	if r == nil || r.settled {
+		return
+	}
+	r.settled = true
+	r.sched.Settle(r.session, r.reserved, n)
+}
+
+// Make a fairScheduler for rate bytes per second. Returns nil if rate is 0.
+func newFairScheduler(rate int64) *fairScheduler {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) * fairBurstTime.Seconds()
+	if burst < fairQuantum {
+		burst = fairQuantum
+	}
+	return &fairScheduler{
+		rate:    float64(rate),
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		bucket:  newTokenBucket(float64(rate), burst, time.Now()),
+		flows:   make(map[*Session]*fairFlow),
+		classes: make(map[*qosClass]*fairClass),
+	}
+}
+
+// Make a token bucket for a fraction of the rate.
+func (s *fairScheduler) shareBucket(share float64, now time.Time) *tokenBucket {
+	if share <= 0 {
+		return nil
+	}
+	rate := s.rate * share
+	return newTokenBucket(rate, math.Max(rate*fairBurstTime.Seconds(), fairQuantum), now)
+}
+
+// Return the buckets of class, which may be nil, refilled. Call with s.lock
+// held.
+func (s *fairScheduler) class(class *qosClass, now time.Time) *fairClass {
+	if class == nil || (class.Min <= 0 && class.Max <= 0) {
+		return nil
+	}
+	c := s.classes[class]
+	if c == nil {
+		c = &fairClass{min: s.shareBucket(class.Min, now), max: s.shareBucket(class.Max, now)}
+		s.classes[class] = c
+	}
+	for _, b := range []*tokenBucket{c.min, c.max} {
+		if b != nil {
+			b.refill(now)
+		}
+	}
+	return c
+}
+
+// Take n bytes from the buckets of the rate and of class. Call with s.lock
+// held.
+func (s *fairScheduler) charge(class *fairClass, n int) {
+	s.bucket.tokens -= float64(n)
+	if class == nil {
+		return
+	}
+	for _, b := range []*tokenBucket{class.min, class.max} {
+		if b != nil {
+			b.tokens -= float64(n)
+		}
+	}
+}
+
+// Wait until n bytes of session's response may be sent, or ctx is done.
+func (s *fairScheduler) Wait(ctx context.Context, session *Session, n int) error {
+	if s == nil || n <= 0 {
+		return nil
+	}
+	r := s.request(session, n)
+	if r == nil {
+		return nil
+	}
+	select {
+	case <-r.granted:
+		return nil
+	case <-ctx.Done():
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-r.granted:
+		// Granted just now; the bandwidth is spent anyway.
+		return nil
+	default:
+	}
+	flow := s.flows[session]
+	for i, q := range flow.queue {
+		if q == r {
+			flow.queue = append(flow.queue[:i], flow.queue[i+1:]...)
+			break
+		}
+	}
+	if len(flow.queue) == 0 {
+		s.remove(flow)
+	}
+	return ctx.Err()
+}
+
+// Wait for an allocation for the next response payload of session, or until
+// ctx is done, and return the number of bytes reserved: the size of the
+// session's last payload, the best guess of the next. Call Settle once the
+// payload has been read.
+func (s *fairScheduler) Reserve(ctx context.Context, session *Session) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	n := int(session.fairLast.Load())
+	return n, s.Wait(ctx, session, n)
+}
+
+// Account for a response payload of n bytes for which reserved bytes were
+// reserved: take the excess from the buckets, which may go into debt like any
+// other grant, or give back what was not used.
+func (s *fairScheduler) Settle(session *Session, reserved, n int) {
+	if s == nil {
+		return
+	}
+	session.fairLast.Store(int64(n))
+	if n == reserved {
+		return
+	}
+	s.lock.Lock()
+	now := s.now()
+	s.bucket.refill(now)
+	class := s.class(session.QoS, now)
+	s.charge(class, n-reserved)
+	buckets := []*tokenBucket{s.bucket}
+	if class != nil {
+		buckets = append(buckets, class.min, class.max)
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens = math.Min(b.tokens, b.burst)
+		}
+	}
+	s.lock.Unlock()
+	if n < reserved {
+		// What was given back may be granted to those waiting.
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Grant n bytes to session at once and return nil if the rate is not used
+// up, or else queue a request for them.
+func (s *fairScheduler) request(session *Session, n int) *fairRequest {
+	s.lock.Lock()
+	now := s.now()
+	s.bucket.refill(now)
+	class := s.class(session.QoS, now)
+	if len(s.active) == 0 && s.bucket.tokens >= 0 && class.underMax() {
+		// The buckets may go into debt, which the next ones pay off by
+		// waiting.
+		s.charge(class, n)
+		s.lock.Unlock()
+		return nil
+	}
+	r := &fairRequest{n: n, granted: make(chan struct{})}
+	flow := s.flows[session]
+	if flow == nil {
+		flow = &fairFlow{session: session, class: class, weight: 1}
+		if session.QoS != nil {
+			flow.weight = session.QoS.Weight
+		}
+		s.flows[session] = flow
+		s.active = append(s.active, flow)
+	}
+	flow.queue = append(flow.queue, r)
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return r
+}
+
+// Remove flow, which has no requests left. Call with s.lock held.
+func (s *fairScheduler) remove(flow *fairFlow) {
+	delete(s.flows, flow.session)
+	for i, f := range s.active {
+		if f == flow {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+}
+
+// Move the first active flow to the end. Call with s.lock held.
+func (s *fairScheduler) rotate() {
+	s.active = append(s.active[1:], s.active[0])
+}
+
+// Serve the active flows whose class is eligible, by deficit round robin,
+// until none is left or the rate is used up. Call with s.lock held.
+func (s *fairScheduler) serve(eligible func(*fairClass) bool) {
+	skipped := 0
+	for len(s.active) > 0 && skipped < len(s.active) && s.bucket.tokens >= 0 {
+		flow := s.active[0]
+		if !eligible(flow.class) {
+			s.rotate()
+			skipped++
+			continue
+		}
+		skipped = 0
+		if !flow.turn {
+			flow.deficit += fairQuantum * flow.weight
+			flow.turn = true
+		}
+		r := flow.queue[0]
+		if flow.deficit < r.n {
+			// End of its turn.
+			flow.turn = false
+			s.rotate()
+			continue
+		}
+		s.charge(flow.class, r.n)
+		flow.deficit -= r.n
+		close(r.granted)
+		flow.queue = flow.queue[1:]
+		if len(flow.queue) == 0 {
+			// An idle flow keeps no deficit.
+			s.remove(flow)
+		}
+	}
+}
+
+// Return how long until the bucket b is out of debt.
+func debtTime(b *tokenBucket) time.Duration {
+	return time.Duration(-b.tokens/b.rate*float64(time.Second)) + time.Millisecond
+}
+
+// Grant what can be granted now, and return how long to wait until more can
+// be, or 0 if nothing is waiting.
+func (s *fairScheduler) dispatch() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	s.bucket.refill(now)
+	for class, c := range s.classes {
+		for _, b := range []*tokenBucket{c.min, c.max} {
+			if b != nil {
+				b.refill(now)
+			}
+		}
+		// Forget classes that are owed nothing; they start again with
+		// full buckets.
+		if c.underMax() && (c.min == nil || c.min.tokens >= c.min.burst) {
+			delete(s.classes, class)
+		}
+	}
+	// Flows keep the buckets they started with.
+	for _, flow := range s.active {
+		if flow.class != nil && flow.session.QoS != nil {
+			s.classes[flow.session.QoS] = flow.class
+		}
+	}
+
+	// First the classes that haven't had their min share, then everyone
+	// under their max.
+	s.serve((*fairClass).underMin)
+	s.serve((*fairClass).underMax)
+	if len(s.active) == 0 {
+		return 0
+	}
+	if s.bucket.tokens < 0 {
+		return debtTime(s.bucket)
+	}
+	// Everything waiting is over its max.
+	var wait time.Duration
+	for _, flow := range s.active {
+		if d := debtTime(flow.class.max); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// Grant allocations as bandwidth becomes available. Never returns.
+func (s *fairScheduler) Run() {
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		d := s.dispatch()
+		if d == 0 {
+			<-s.wake
+			continue
+		}
+		timer.Reset(d)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+	}
+}
+
+// fairReader is an io.Reader whose reads each wait for an allocation from a
+// fairScheduler before returning.
+type fairReader struct {
+	io.Reader
+	sched   *fairScheduler
+	session *Session
+}
+
+func (r *fairReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.sched.Wait(context.Background(), r.session, n)
+	return n, err
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFairSchedulerNil(t *testing.T) {
+	var s *fairScheduler
+	if err := s.Wait(context.Background(), &Session{}, 1000); err != nil {
+		t.Error(err)
+	}
+	if n, err := s.Reserve(context.Background(), &Session{}); n != 0 || err != nil {
+		t.Errorf("reserved %d, %v", n, err)
+	}
+	s.Settle(&Session{}, 0, 1000)
+	if newFairScheduler(0) != nil {
+		t.Errorf("scheduler with no rate")
+	}
+}
+
+// Small responses of interactive sessions go ahead of a bulk session's full
+// ones when the rate is used up.
+func TestFairSchedulerOrder(t *testing.T) {
+	s := newFairScheduler(1 << 20)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.bucket.last = now
+
+	bulk, small1, small2 := &Session{}, &Session{}, &Session{}
+	if r := s.request(bulk, maxPayloadLength); r != nil {
+		t.Fatalf("first request queued with the rate unused")
+	}
+	// Saturated.
+	s.bucket.tokens = -1
+	queued := []struct {
+		name string
+		r    *fairRequest
+	}{
+		{"bulk 1", s.request(bulk, maxPayloadLength)},
+		{"bulk 2", s.request(bulk, maxPayloadLength)},
+		{"small 1", s.request(small1, 500)},
+		{"small 2", s.request(small2, 500)},
+	}
+	// Grant one at a time: with no tokens left, each grant puts the bucket
+	// into debt.
+	var order []string
+	granted := make(map[string]bool)
+	for len(order) < len(queued) {
+		s.bucket.tokens = 0
+		s.dispatch()
+		n := len(order)
+		for _, q := range queued {
+			select {
+			case <-q.r.granted:
+				if !granted[q.name] {
+					granted[q.name] = true
+					order = append(order, q.name)
+				}
+			default:
+			}
+		}
+		if len(order) != n+1 {
+			t.Fatalf("granted %q after %q, expected one more", order[n:], order[:n])
+		}
+	}
+	expected := []string{"small 1", "small 2", "bulk 1", "bulk 2"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("granted in order %q, expected %q", order, expected)
+		}
+	}
+	if len(s.flows) != 0 || len(s.active) != 0 {
+		t.Errorf("flows left: %d, %d", len(s.flows), len(s.active))
+	}
+}
+
+func TestFairSchedulerCancel(t *testing.T) {
+	s := newFairScheduler(1 << 20)
+	s.bucket.tokens = -1e12
+	session := &Session{}
+	s.request(&Session{}, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := s.Wait(ctx, session, 1000)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if s.flows[session] != nil {
+		t.Errorf("canceled session still queued")
+	}
+}
+
+// Everything gets through, at about the rate.
+func TestFairSchedulerRun(t *testing.T) {
+	const rate = 4 << 20
+	s := newFairScheduler(rate)
+	go s.Run()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		session := &Session{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 8; j++ {
+				err := s.Wait(context.Background(), session, maxPayloadLength)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// 32 full payloads is 2 MiB, half a second at the rate, less the burst.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+}
+
+// A reservation is the size of the session's last payload, and the difference
+// from the payload read is taken or given back.
+func TestFairSchedulerReserve(t *testing.T) {
+	s := newStoppedFairScheduler(1 << 20)
+	session := &Session{}
+	full := s.bucket.tokens
+	n, err := s.Reserve(context.Background(), session)
+	if n != 0 || err != nil {
+		t.Fatalf("first reservation %d, %v", n, err)
+	}
+	s.Settle(session, n, 3000)
+	if s.bucket.tokens != full-3000 {
+		t.Errorf("after taking the excess: %f tokens", s.bucket.tokens)
+	}
+	n, err = s.Reserve(context.Background(), session)
+	if n != 3000 || err != nil {
+		t.Fatalf("second reservation %d, %v", n, err)
+	}
+	s.Settle(session, n, 1000)
+	if s.bucket.tokens != full-4000 {
+		t.Errorf("after giving back: %f tokens", s.bucket.tokens)
+	}
+	// What is given back never fills the bucket beyond its burst.
+	s.Settle(session, 1<<20, 0)
+	if s.bucket.tokens != full {
+		t.Errorf("after giving back too much: %f tokens", s.bucket.tokens)
+	}
+}
+
+// A reservation is given back when a request ends before a payload is read
+// from the OR port: when it is turned away by LockSeq, and when writing its
+// body to the OR port fails.
+func TestFairReservationSettled(t *testing.T) {
+	defer func(saved *fairScheduler) { fairSched = saved }(fairSched)
+	fairSched = newStoppedFairScheduler(1 << 20)
+	full := fairSched.bucket.tokens
+	state := NewStateWith(StateConfig{Backend: &pipeBackend{}})
+
+	for _, test := range []struct {
+		name, sessionID string
+		prepare         func(session *Session, req *http.Request)
+	}{
+		{"LockSeq", "Y2FyZ28gdHJ1Y2s", func(session *Session, req *http.Request) {
+			req.Header.Set("X-Seq", "1000000")
+		}},
+		{"body", "ZGlmZmVyZW50", func(session *Session, req *http.Request) {
+			session.Or.Close()
+		}},
+	} {
+		newReq := func() *http.Request {
+			req := httptest.NewRequest("POST", "/", strings.NewReader("payload"))
+			req.Header.Set("X-Session-Id", test.sessionID)
+			return req
+		}
+		session, err := state.GetSession(test.sessionID, newReq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.fairLast.Store(3000)
+		req := newReq()
+		test.prepare(session, req)
+		state.Post(httptest.NewRecorder(), req)
+		if fairSched.bucket.tokens != full {
+			t.Errorf("%s: %f tokens, expected %f", test.name, fairSched.bucket.tokens, full)
+		}
+	}
+}
+
+// A reservation is settled only once.
+func TestFairReservationOnce(t *testing.T) {
+	s := newStoppedFairScheduler(1 << 20)
+	full := s.bucket.tokens
+	session := &Session{}
+	session.fairLast.Store(3000)
+	n, err := s.Reserve(context.Background(), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fairReservation{sched: s, session: session, reserved: n}
+	r.Settle(1000)
+	r.Settle(0)
+	if s.bucket.tokens != full-1000 || session.fairLast.Load() != 1000 {
+		t.Errorf("%f tokens, last %d", s.bucket.tokens, session.fairLast.Load())
+	}
+	var nilReservation *fairReservation
+	nilReservation.Settle(1000)
+}
+
+// Make a fairScheduler whose clock stands still, so that its buckets only
+// change as the test says.
+func newStoppedFairScheduler(rate int64) *fairScheduler {
+	s := newFairScheduler(rate)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.bucket.last = now
+	return s
+}
+
+// Dispatch with a bucket that allows one more grant, and return the index in
+// queued of the request granted, or -1 if there is none.
+func dispatchOne(s *fairScheduler, queued []*fairRequest, done map[int]bool) int {
+	s.bucket.tokens = 0
+	s.dispatch()
+	for i, r := range queued {
+		select {
+		case <-r.granted:
+			if !done[i] {
+				done[i] = true
+				return i
+			}
+		default:
+		}
+	}
+	return -1
+}
+
+// A session in a class of weight 4 gets four times the turns of one in no
+// class.
+func TestFairSchedulerWeight(t *testing.T) {
+	s := newStoppedFairScheduler(1 << 20)
+	s.bucket.tokens = -1
+	heavy := &Session{QoS: &qosClass{Name: "paid", Weight: 4}}
+	light := &Session{}
+	var queued []*fairRequest
+	for i := 0; i < 20; i++ {
+		queued = append(queued, s.request(heavy, fairQuantum), s.request(light, fairQuantum))
+	}
+	done := make(map[int]bool)
+	counts := make(map[bool]int)
+	for i := 0; i < 20; i++ {
+		j := dispatchOne(s, queued, done)
+		if j < 0 {
+			t.Fatalf("nothing granted after %d", i)
+		}
+		counts[j%2 == 0]++
+	}
+	if counts[true] != 16 || counts[false] != 4 {
+		t.Errorf("heavy got %d, light %d, expected 16 and 4", counts[true], counts[false])
+	}
+}
+
+// A class under its min share goes ahead of earlier requests.
+func TestFairSchedulerMin(t *testing.T) {
+	s := newStoppedFairScheduler(1 << 20)
+	s.bucket.tokens = -1
+	plain := &Session{}
+	guaranteed := &Session{QoS: &qosClass{Name: "paid", Weight: 1, Min: 0.5}}
+	queued := []*fairRequest{
+		s.request(plain, 1000),
+		s.request(guaranteed, 1000),
+	}
+	done := make(map[int]bool)
+	if j := dispatchOne(s, queued, done); j != 1 {
+		t.Errorf("granted %d first, expected the min class's", j)
+	}
+	if j := dispatchOne(s, queued, done); j != 0 {
+		t.Errorf("granted %d second", j)
+	}
+}
+
+// A class over its max share waits, even when the rate isn't used up.
+func TestFairSchedulerMax(t *testing.T) {
+	s := newStoppedFairScheduler(1 << 20)
+	capped := &Session{QoS: &qosClass{Name: "free", Weight: 1, Max: 0.1}}
+	other := &Session{}
+	if r := s.request(capped, maxPayloadLength); r != nil {
+		t.Fatalf("first request of the class queued")
+	}
+	r := s.request(capped, 1000)
+	if r == nil {
+		t.Fatalf("request over the max granted at once")
+	}
+	d := s.dispatch()
+	select {
+	case <-r.granted:
+		t.Fatalf("request over the max granted")
+	default:
+	}
+	// The debt is a full payload less the burst, at a tenth of the rate.
+	if d < 300*time.Millisecond || d > time.Second {
+		t.Errorf("wait %s", d)
+	}
+	// Others are not held up.
+	o := s.request(other, 1000)
+	s.dispatch()
+	select {
+	case <-o.granted:
+	default:
+		t.Errorf("other session held up by the capped class")
+	}
+
+	later := s.now().Add(d)
+	s.now = func() time.Time { return later }
+	s.dispatch()
+	select {
+	case <-r.granted:
+	default:
+		t.Errorf("not granted after the wait")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+// The code in this file has to do with per-country usage statistics, enabled by
+// --geoip and --geoip6. Those name GeoIP databases in the format tor uses
+// (the "geoip" and "geoip6" files that come with tor): lines of
+//	LOW,HIGH,CC
+// giving an inclusive address range and a two-letter country code, where the
+// addresses are decimal integers in the IPv4 file and IPv6 addresses in the
+// IPv6 file. Lines beginning with "#" are comments.
+//
+// Each session is assigned a country when it is created. Only the country is
+// kept, never the address. The number of sessions and the bytes they carried
+// are summed per country and reported, then reset, at each heartbeat. As in
+// tor's bridge statistics, counts are rounded up to a multiple of 8, so that a
+// report doesn't reveal whether any one client used the bridge.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The country code of addresses not in the database.
+const unknownCountry = "??"
+
+// Session counts are rounded up to a multiple of this.
+const countryCountBin = 8
+
+type geoIPRange4 struct {
+	low, high uint32
+	country   string
+}
+
+type geoIPRange6 struct {
+	low, high [16]byte
+	country   string
+}
+
+// geoIPDB maps addresses to countries. Ranges are sorted and don't overlap.
+type geoIPDB struct {
+	v4 []geoIPRange4
+	v6 []geoIPRange6
+}
+
+// Split a database line into its three fields, or return ok == false for a
+// blank line or comment.
+func splitGeoIPLine(line string) (low, high, country string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", "", false, nil
+	}
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return "", "", "", false, fmt.Errorf("expected 3 fields, found %d", len(fields))
+	}
+	return fields[0], fields[1], strings.ToLower(fields[2]), true, nil
+}
+
+// Read an IPv4 database.
+func (db *geoIPDB) load4(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		lowStr, highStr, country, ok, err := splitGeoIPLine(s.Text())
+		if err == nil && ok {
+			var low, high uint64
+			low, err = strconv.ParseUint(lowStr, 10, 32)
+			if err == nil {
+				high, err = strconv.ParseUint(highStr, 10, 32)
+			}
+			if err == nil && low > high {
+				err = fmt.Errorf("range %d–%d is backwards", low, high)
+			}
+			if err == nil {
+				db.v4 = append(db.v4, geoIPRange4{uint32(low), uint32(high), country})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	sort.Slice(db.v4, func(i, j int) bool { return db.v4[i].low < db.v4[j].low })
+	return nil
+}
+
+// Read an IPv6 database.
+func (db *geoIPDB) load6(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		lowStr, highStr, country, ok, err := splitGeoIPLine(s.Text())
+		if err == nil && ok {
+			low, high := net.ParseIP(lowStr).To16(), net.ParseIP(highStr).To16()
+			switch {
+			case low == nil || high == nil:
+				err = fmt.Errorf("bad address range %s–%s", lowStr, highStr)
+			case bytes.Compare(low, high) > 0:
+				err = fmt.Errorf("range %s–%s is backwards", lowStr, highStr)
+			default:
+				var rng geoIPRange6
+				copy(rng.low[:], low)
+				copy(rng.high[:], high)
+				rng.country = country
+				db.v6 = append(db.v6, rng)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	sort.Slice(db.v6, func(i, j int) bool { return bytes.Compare(db.v6[i].low[:], db.v6[j].low[:]) < 0 })
+	return nil
+}
+
+// Load the IPv4 and IPv6 databases from the named files. Either name may be
+// empty.
+func loadGeoIP(filename4, filename6 string) (*geoIPDB, error) {
+	db := new(geoIPDB)
+	for _, f := range []struct {
+		filename string
+		load     func(io.Reader) error
+	}{
+		{filename4, db.load4},
+		{filename6, db.load6},
+	} {
+		if f.filename == "" {
+			continue
+		}
+		file, err := os.Open(f.filename)
+		if err != nil {
+			return nil, err
+		}
+		err = f.load(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.filename, err)
+		}
+	}
+	return db, nil
+}
+
+// Return the country code of ip, or unknownCountry.
+func (db *geoIPDB) Country(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		x := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(db.v4), func(i int) bool { return db.v4[i].high >= x })
+		if i < len(db.v4) && db.v4[i].low <= x {
+			return db.v4[i].country
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		i := sort.Search(len(db.v6), func(i int) bool { return bytes.Compare(db.v6[i].high[:], ip16) >= 0 })
+		if i < len(db.v6) && bytes.Compare(db.v6[i].low[:], ip16) <= 0 {
+			return db.v6[i].country
+		}
+	}
+	return unknownCountry
+}
+
+// Usage for one country.
+type countryUsage struct {
+	Country  string `json:"country"`
+	Sessions int64  `json:"sessions"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// countryStats sums usage per country. A nil *countryStats, as when GeoIP is
+// not enabled, ignores everything.
+type countryStats struct {
+	db *geoIPDB
+
+	lock  sync.Mutex
+	usage map[string]*countryUsage
+}
+
+// The per-country statistics, or nil if GeoIP is not enabled. Set up in main.
+var usageByCountry *countryStats
+
+func newCountryStats(db *geoIPDB) *countryStats {
+	return &countryStats{db: db, usage: make(map[string]*countryUsage)}
+}
+
+func (cs *countryStats) get(country string) *countryUsage {
+	u := cs.usage[country]
+	if u == nil {
+		u = &countryUsage{Country: country}
+		cs.usage[country] = u
+	}
+	return u
+}
+
+// Count a new session from ip, and return its country (or "" if cs is nil).
+func (cs *countryStats) Open(ip net.IP) string {
+	if cs == nil {
+		return ""
+	}
+	country := unknownCountry
+	if ip != nil {
+		country = cs.db.Country(ip)
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.get(country).Sessions++
+	return country
+}
+
+// Count the bytes carried by a session that has ended.
+func (cs *countryStats) Close(session *Session) {
+	if cs == nil || session.Country == "" {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.get(session.Country).Bytes += session.BytesUp.Load() + session.BytesDown.Load()
+}
+
+// Round n up to a multiple of countryCountBin.
+func binCount(n int64) int64 {
+	return (n + countryCountBin - 1) / countryCountBin * countryCountBin
+}
+
+// Return the usage since the last reset, rounded, with the busiest countries
+// first.
+func (cs *countryStats) Current() []countryUsage {
+	if cs == nil {
+		return nil
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return roundCountryUsage(cs.usage)
+}
+
+// Like Current, but also reset the counts.
+func (cs *countryStats) Reset() []countryUsage {
+	if cs == nil {
+		return nil
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	usage := cs.usage
+	cs.usage = make(map[string]*countryUsage)
+	return roundCountryUsage(usage)
+}
+
+func roundCountryUsage(usage map[string]*countryUsage) []countryUsage {
+	result := make([]countryUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, countryUsage{u.Country, binCount(u.Sessions), u.Bytes})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Sessions != result[j].Sessions {
+			return result[i].Sessions > result[j].Sessions
+		}
+		return result[i].Country < result[j].Country
+	})
+	return result
+}
+
+// Format usage for the log, as "cc=SESSIONS/KB ...".
+func formatCountryUsage(usage []countryUsage) string {
+	parts := make([]string, len(usage))
+	for i, u := range usage {
+		parts[i] = fmt.Sprintf("%s=%d/%dKB", u.Country, u.Sessions, (u.Bytes+1023)/1024)
+	}
+	return strings.Join(parts, " ")
+}
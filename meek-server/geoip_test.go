@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testGeoIP4 = `# Comment
+3221225984,3221226239,US
+3325256704,3325256959,DE
+`
+
+const testGeoIP6 = `2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,NL
+`
+
+func TestGeoIPCountry(t *testing.T) {
+	var db geoIPDB
+	if err := db.load4(strings.NewReader(testGeoIP4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.load6(strings.NewReader(testGeoIP6)); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip, expected string
+	}{
+		{"192.0.2.0", "us"},   // 3221225984
+		{"192.0.2.255", "us"}, // 3221226239
+		{"198.51.100.7", "de"},
+		{"203.0.113.1", unknownCountry},
+		{"2001:db8::1", "nl"},
+		{"2001:db9::1", unknownCountry},
+	} {
+		if country := db.Country(net.ParseIP(test.ip)); country != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.ip, country, test.expected)
+		}
+	}
+}
+
+func TestGeoIPBadInput(t *testing.T) {
+	for _, input := range []string{
+		"1,2\n",
+		"x,2,US\n",
+		"5,4,US\n",
+	} {
+		var db geoIPDB
+		if err := db.load4(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+	var db geoIPDB
+	if err := db.load6(strings.NewReader("2001:db8::ff,2001:db8::1,NL\n")); err == nil {
+		t.Errorf("backwards IPv6 range: no error")
+	}
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "geoip")
+	if err := os.WriteFile(filename, []byte(testGeoIP4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadGeoIP(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country := db.Country(net.ParseIP("192.0.2.1")); country != "us" {
+		t.Errorf("got %q", country)
+	}
+	if _, err := loadGeoIP("", filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("missing file: no error")
+	}
+}
+
+func TestCountryStats(t *testing.T) {
+	var db geoIPDB
+	if err := db.load4(strings.NewReader(testGeoIP4)); err != nil {
+		t.Fatal(err)
+	}
+	cs := newCountryStats(&db)
+	for i := 0; i < 9; i++ {
+		session := &Session{Country: cs.Open(net.ParseIP("192.0.2.1"))}
+		session.BytesUp.Store(1000)
+		session.BytesDown.Store(24)
+		cs.Close(session)
+	}
+	cs.Open(net.ParseIP("198.51.100.1"))
+	cs.Open(nil)
+
+	expected := []countryUsage{
+		{"us", 16, 9 * 1024},
+		{"??", 8, 0},
+		{"de", 8, 0},
+	}
+	if usage := cs.Current(); !reflect.DeepEqual(usage, expected) {
+		t.Errorf("got %+v, expected %+v", usage, expected)
+	}
+	if usage := cs.Reset(); !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Reset: got %+v, expected %+v", usage, expected)
+	}
+	if usage := cs.Current(); len(usage) != 0 {
+		t.Errorf("after Reset: got %+v", usage)
+	}
+	if s := formatCountryUsage(expected); s != "us=16/9KB ??=8/0KB de=8/0KB" {
+		t.Errorf("formatted as %q", s)
+	}
+
+	// A nil *countryStats ignores everything.
+	var none *countryStats
+	if country := none.Open(net.ParseIP("192.0.2.1")); country != "" {
+		t.Errorf("nil stats returned country %q", country)
+	}
+	none.Close(&Session{})
+	if none.Reset() != nil {
+		t.Errorf("nil stats returned usage")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+// The code in this file protects the HTTP/2 side of the public listener
+// against abusive clients. The HTTP/2 server already bounds header sizes,
+// but a direct-connect endpoint is exposed to anyone, and there are cheap
+// attacks that work within those bounds:
+//
+//   - Rapid reset: opening streams and immediately cancelling them with
+//     RST_STREAM, which costs the client nothing but makes the server start
+//     (and tear down) a handler each time. --max-stream-resets caps the rate
+//     of RST_STREAM frames on a connection.
+//   - CONTINUATION flood: a header block split into an unending series of
+//     tiny CONTINUATION frames. --max-continuation-frames caps the number of
+//     CONTINUATION frames in one header block.
+//   - Stream exhaustion: a client opening many connections, each with the
+//     maximum number of streams. --max-streams-per-conn sets the HTTP/2
+//     SETTINGS_MAX_CONCURRENT_STREAMS, and --max-streams-per-ip caps the
+//     streams in progress from one address over all its connections.
+//
+// The first two are enforced by h2GuardConn, which watches the frames a
+// client sends as they are read, without otherwise interfering, and closes
+// the connection on a violation.
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"../lib/logging"
+)
+
+// The length of an HTTP/2 frame header.
+const h2FrameHeaderLen = 9
+
+// h2Guard follows the frames in a client's byte stream and enforces limits on
+// them. A connection that doesn't begin with the HTTP/2 client preface is not
+// HTTP/2, and is passed through unexamined.
+type h2Guard struct {
+	// Maximum CONTINUATION frames per header block; 0 means unlimited.
+	maxContinuations int
+	// Limits RST_STREAM frames; nil means unlimited.
+	resets *tokenBucket
+	now    func() time.Time
+
+	// How many bytes of the client preface have matched so far.
+	prefaceLen int
+	// The stream is not HTTP/2, or has violated a limit.
+	passthrough bool
+	err         error
+	// The frame header being read, and how many bytes of it are in.
+	header    [h2FrameHeaderLen]byte
+	headerLen int
+	// Payload bytes left in the current frame.
+	payloadLeft int
+	// CONTINUATION frames since the last HEADERS.
+	continuations int
+}
+
+// Make an h2Guard allowing maxResets RST_STREAM frames per second (0 means
+// unlimited) and maxContinuations CONTINUATION frames per header block.
+func newH2Guard(maxResets, maxContinuations int, now func() time.Time) *h2Guard {
+	guard := &h2Guard{maxContinuations: maxContinuations, now: now}
+	if maxResets > 0 {
+		guard.resets = newTokenBucket(float64(maxResets), float64(maxResets), now())
+	}
+	return guard
+}
+
+// Examine bytes read from the client. Returns an error once a limit has been
+// violated, and on every call after.
+func (guard *h2Guard) scan(p []byte) error {
+	if guard.err != nil {
+		return guard.err
+	}
+	for len(p) > 0 && !guard.passthrough {
+		switch {
+		case guard.prefaceLen < len(http2.ClientPreface):
+			n := len(http2.ClientPreface) - guard.prefaceLen
+			if n > len(p) {
+				n = len(p)
+			}
+			if string(p[:n]) != http2.ClientPreface[guard.prefaceLen:guard.prefaceLen+n] {
+				guard.passthrough = true
+				return nil
+			}
+			guard.prefaceLen += n
+			p = p[n:]
+		case guard.payloadLeft > 0:
+			n := guard.payloadLeft
+			if n > len(p) {
+				n = len(p)
+			}
+			guard.payloadLeft -= n
+			p = p[n:]
+		default:
+			n := copy(guard.header[guard.headerLen:], p)
+			guard.headerLen += n
+			p = p[n:]
+			if guard.headerLen == h2FrameHeaderLen {
+				guard.headerLen = 0
+				err := guard.frame()
+				if err != nil {
+					guard.err = err
+					guard.passthrough = true
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Account for the frame whose header is in guard.header.
+func (guard *h2Guard) frame() error {
+	guard.payloadLeft = int(binary.BigEndian.Uint32(guard.header[:4]) >> 8)
+	switch http2.FrameType(guard.header[3]) {
+	case http2.FrameRSTStream:
+		if guard.resets != nil && !guard.resets.take(guard.now()) {
+			return fmt.Errorf("more than %g RST_STREAM frames per second", guard.resets.rate)
+		}
+	case http2.FrameHeaders:
+		guard.continuations = 0
+	case http2.FrameContinuation:
+		guard.continuations++
+		if guard.maxContinuations > 0 && guard.continuations > guard.maxContinuations {
+			return fmt.Errorf("more than %d CONTINUATION frames in a header block", guard.maxContinuations)
+		}
+	}
+	return nil
+}
+
+// h2GuardConn is a net.Conn whose incoming bytes are checked by an h2Guard. It
+// closes itself when the guard reports a violation.
+type h2GuardConn struct {
+	net.Conn
+	guard *h2Guard
+}
+
+// Wrap conn in an h2GuardConn with the limits in options. If conn is a
+// *tls.Conn, the result still reports its TLS connection state, which the
+// HTTP/2 server needs.
+func newH2GuardConn(conn net.Conn) net.Conn {
+	c := &h2GuardConn{
+		Conn:  conn,
+		guard: newH2Guard(options.MaxStreamResets, options.MaxContinuationFrames, time.Now),
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		return &h2GuardTLSConn{h2GuardConn: c, tls: tc}
+	}
+	return c
+}
+
+func (c *h2GuardConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if scanErr := c.guard.scan(p[:n]); scanErr != nil {
+		logging.Debugf("closing HTTP/2 connection from %s: %s", scrubAddr(c.RemoteAddr().String()), scanErr)
+		c.Conn.Close()
+		return 0, scanErr
+	}
+	return n, err
+}
+
+// h2GuardTLSConn is an h2GuardConn over a TLS connection.
+type h2GuardTLSConn struct {
+	*h2GuardConn
+	tls *tls.Conn
+}
+
+func (c *h2GuardTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+// h2GuardListener wraps the connections from a net.Listener in h2GuardConns,
+// for HTTP/2 with prior knowledge (h2c).
+type h2GuardListener struct {
+	net.Listener
+}
+
+func (ln h2GuardListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newH2GuardConn(conn), nil
+}
+
+// Make the HTTP/2 server settings from options.
+func newH2Server() *http2.Server {
+	return &http2.Server{MaxConcurrentStreams: uint32(options.MaxStreamsPerConn)}
+}
+
+// Set up HTTP/2 over TLS on server, using h2srv and guarding every connection
+// with an h2GuardConn. This replaces the TLSNextProto entry that
+// http2.ConfigureServer installs, which has no hook for wrapping the
+// connection.
+func configureH2Guard(server *http.Server, h2srv *http2.Server) error {
+	err := http2.ConfigureServer(server, h2srv)
+	if err != nil {
+		return err
+	}
+	server.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		// Like the TLSNextProto of http2.ConfigureServer, pass on the
+		// connection's context, if the handler net/http gives us has
+		// one.
+		var ctx context.Context
+		if bc, ok := h.(interface{ BaseContext() context.Context }); ok {
+			ctx = bc.BaseContext()
+		}
+		h2srv.ServeConn(newH2GuardConn(c), &http2.ServeConnOpts{
+			Context:    ctx,
+			Handler:    h,
+			BaseConfig: hs,
+		})
+	}
+	return nil
+}
+
+// limitStreamsPerIP wraps an http.Handler, resetting HTTP/2 streams from an
+// address that already has max streams in progress. max 0 or less means
+// unlimited. HTTP/1.1 requests are bounded by --max-conns-per-ip instead.
+//
+// The address is the client address passed on by a CDN (see
+// originalClientIP), not that of the connection, which behind a CDN is one
+// of a few edge servers shared by many clients. Only when there is no
+// usable client address is the connection's address used.
+func limitStreamsPerIP(handler http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return handler
+	}
+	var lock sync.Mutex
+	streams := make(map[string]int)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		host := bindingIP(req)
+		if host == "" {
+			var err error
+			host, _, err = net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				handler.ServeHTTP(w, req)
+				return
+			}
+		}
+		lock.Lock()
+		if streams[host] >= max {
+			lock.Unlock()
+			logging.Debugf("too many HTTP/2 streams from %s; resetting stream", scrubAddr(host))
+			// Aborting the handler resets the stream.
+			panic(http.ErrAbortHandler)
+		}
+		streams[host]++
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			streams[host]--
+			if streams[host] <= 0 {
+				delete(streams, host)
+			}
+			lock.Unlock()
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Return the client preface followed by frames written by write.
+func h2Stream(t *testing.T, write func(*http2.Framer)) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	write(http2.NewFramer(&buf, nil))
+	return buf.Bytes()
+}
+
+// Feed data to guard a few bytes at a time, to exercise frames split across
+// reads.
+func scanInPieces(guard *h2Guard, data []byte) error {
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := guard.scan(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestH2GuardResets(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	guard := newH2Guard(10, 0, func() time.Time { return now })
+	resets := func(n int) []byte {
+		return h2Stream(t, func(fr *http2.Framer) {
+			for i := 0; i < n; i++ {
+				fr.WriteData(uint32(2*i+1), false, []byte("data"))
+				fr.WriteRSTStream(uint32(2*i+1), http2.ErrCodeCancel)
+			}
+		})
+	}
+	data := resets(10)
+	if err := scanInPieces(guard, data); err != nil {
+		t.Fatalf("error within the limit: %v", err)
+	}
+	// One more, without waiting, is too many.
+	extra := resets(1)[len(http2.ClientPreface):]
+	if err := guard.scan(extra); err == nil {
+		t.Fatalf("no error over the limit")
+	}
+	// Once violated, the guard stays in error.
+	if err := guard.scan([]byte{0}); err == nil {
+		t.Errorf("no error after a violation")
+	}
+
+	// A second later, there's room again.
+	guard = newH2Guard(10, 0, func() time.Time { return now })
+	scanInPieces(guard, data)
+	now = now.Add(time.Second)
+	if err := guard.scan(extra); err != nil {
+		t.Errorf("error after refill: %v", err)
+	}
+}
+
+func TestH2GuardContinuations(t *testing.T) {
+	block := func(n int) []byte {
+		return h2Stream(t, func(fr *http2.Framer) {
+			fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: []byte{0x82}})
+			for i := 0; i < n; i++ {
+				fr.WriteContinuation(1, i == n-1, []byte{0x84})
+			}
+		})
+	}
+	guard := newH2Guard(0, 3, time.Now)
+	if err := scanInPieces(guard, block(3)); err != nil {
+		t.Errorf("error within the limit: %v", err)
+	}
+	guard = newH2Guard(0, 3, time.Now)
+	if err := scanInPieces(guard, block(4)); err == nil {
+		t.Errorf("no error over the limit")
+	}
+	// The count starts over with each HEADERS.
+	guard = newH2Guard(0, 3, time.Now)
+	data := block(3)
+	data = append(data, block(3)[len(http2.ClientPreface):]...)
+	if err := scanInPieces(guard, data); err != nil {
+		t.Errorf("error over two header blocks: %v", err)
+	}
+}
+
+// Anything that doesn't start with the client preface is passed through.
+func TestH2GuardNotHTTP2(t *testing.T) {
+	guard := newH2Guard(1, 1, time.Now)
+	data := []byte("POST / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	data = append(data, bytes.Repeat([]byte{0, 0, 0, 3, 0, 0, 0, 0, 1}, 100)...)
+	if err := scanInPieces(guard, data); err != nil {
+		t.Errorf("error on a non-HTTP/2 stream: %v", err)
+	}
+}
+
+func TestLimitStreamsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	handler := limitStreamsPerIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started.Done()
+		<-release
+	}), 2)
+	serve := func(remoteAddr string, proto int) (aborted bool) {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.ProtoMajor = proto
+		defer func() {
+			aborted = recover() == http.ErrAbortHandler
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return false
+	}
+
+	var done sync.WaitGroup
+	started.Add(2)
+	done.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer done.Done()
+			serve("192.0.2.1:1234", 2)
+		}()
+	}
+	started.Wait()
+	if !serve("192.0.2.1:5678", 2) {
+		t.Errorf("stream over the limit not reset")
+	}
+	// Other addresses and HTTP/1.1 requests are not affected.
+	started.Add(2)
+	go func() { serve("192.0.2.2:1234", 2) }()
+	go func() { serve("192.0.2.1:1234", 1) }()
+	started.Wait()
+	close(release)
+	done.Wait()
+	// The slots are given back.
+	if serve("192.0.2.1:1234", 2) {
+		t.Errorf("stream reset after others finished")
+	}
+}
+
+// Behind a CDN, streams are counted by the client address the CDN passes
+// on, not by the address of the CDN edge.
+func TestLimitStreamsPerIPForwarded(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	handler := limitStreamsPerIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started.Done()
+		<-release
+	}), 1)
+	serve := func(remoteAddr, forwardedFor string) (aborted bool) {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.ProtoMajor = 2
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		defer func() {
+			aborted = recover() == http.ErrAbortHandler
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return false
+	}
+
+	var done sync.WaitGroup
+	started.Add(2)
+	done.Add(2)
+	for _, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		go func(client string) {
+			defer done.Done()
+			serve("192.0.2.1:1234", client)
+		}(client)
+	}
+	started.Wait()
+	if !serve("192.0.2.2:1234", "198.51.100.1") {
+		t.Errorf("stream over the limit through another edge not reset")
+	}
+	close(release)
+	done.Wait()
+}
@@ -0,0 +1,46 @@
+package main
+
+// The code in this file answers the requests that come to the port-80 listener
+// opened for ACME HTTP-01 challenges, other than the challenges themselves.
+// autocert's own fallback redirects every GET to HTTPS with a bare 302 and
+// answers everything else with 400, which looks nothing like a real web
+// server. Instead, the listener serves the same decoy site as the HTTPS
+// listener, answering other methods as probes (see --probe-response); or, with
+// --acme-redirect, it redirects to the same URL over HTTPS, the way a web
+// server that only serves HTTPS would.
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Return the handler for non-challenge requests on the HTTP-01 listener. If
+// redirect is true, it redirects to HTTPS on tlsPort; otherwise it serves the
+// decoy site of state.
+func http01Fallback(state *State, redirect bool, tlsPort int) http.Handler {
+	if redirect {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			} else {
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+			if tlsPort != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" || req.Method == "HEAD" {
+			state.Get(w, req)
+		} else {
+			serveProbeResponse(w, req)
+		}
+	})
+}
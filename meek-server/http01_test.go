@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP01FallbackRedirect(t *testing.T) {
+	for _, test := range []struct {
+		port     int
+		host     string
+		target   string
+		location string
+	}{
+		{443, "meek.example", "/a?b=c", "https://meek.example/a?b=c"},
+		{443, "meek.example:80", "/", "https://meek.example/"},
+		{8443, "meek.example", "/x", "https://meek.example:8443/x"},
+		{443, "[2001:db8::1]", "/", "https://[2001:db8::1]/"},
+		{8443, "[2001:db8::1]:80", "/", "https://[2001:db8::1]:8443/"},
+	} {
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		http01Fallback(NewState(), true, test.port).ServeHTTP(rec, req)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != test.location {
+			t.Errorf("%d %s%s: %d %q", test.port, test.host, test.target, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+// Without the redirect, the listener serves the decoy site, and answers other
+// methods as probes.
+func TestHTTP01FallbackDecoy(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.MaskRedirect = "https://www.example.com/"
+	options.ProbeResponse = probeResponseNotFound
+
+	handler := http01Fallback(NewState(), false, 443)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != options.MaskRedirect {
+		t.Errorf("GET: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST: %d", rec.Code)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+// The code in this file has to do with writing TLS session secrets to a key
+// log file (--keylog, or else SSLKEYLOGFILE), which ../lib/keylog opens. The
+// file lets developers decrypt captures of their own test traffic when
+// debugging what a CDN or middlebox does to it. Anyone with the file can
+// decrypt every connection made while it was written, so it must never be
+// used on a production server.
+
+import (
+	"io"
+)
+
+// Where to write TLS key log lines, or nil not to.
+var keyLogWriter io.Writer
@@ -0,0 +1,260 @@
+package main
+
+// The code in this file has to do with protecting the public listener against
+// clients that try to exhaust it: slowloris-style slow requests, floods of
+// connections from one address, file descriptor exhaustion, and too many
+// requests in flight at once.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"../lib/logging"
+)
+
+// Default bounds on the delay between retries of a failed Accept. These are
+// the same values net/http uses internally.
+const (
+	defaultAcceptBackoffMin = 5 * time.Millisecond
+	defaultAcceptBackoffMax = 1 * time.Second
+)
+
+// A limit that can be changed while the server is running (through the admin
+// API), shared by everything that enforces it. 0 or less means unlimited.
+type adjustableLimit struct {
+	value atomic.Int64
+}
+
+func newAdjustableLimit(n int) *adjustableLimit {
+	limit := new(adjustableLimit)
+	limit.Set(n)
+	return limit
+}
+
+func (limit *adjustableLimit) Get() int {
+	return int(limit.value.Load())
+}
+
+func (limit *adjustableLimit) Set(n int) {
+	limit.value.Store(int64(n))
+}
+
+// The limits on connections per IP address and requests per connection for the
+// public listeners. Set from options in main.
+var (
+	maxConnsPerIP      adjustableLimit
+	maxRequestsPerConn adjustableLimit
+)
+
+// limitListener wraps a net.Listener, capping the number of simultaneous
+// connections from any one IP address and backing off on Accept errors.
+type limitListener struct {
+	net.Listener
+	// Maximum number of concurrent connections per IP address.
+	maxConnsPerIP *adjustableLimit
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+
+	lock  sync.Mutex
+	conns map[string]int
+}
+
+func newLimitListener(ln net.Listener, maxConnsPerIP *adjustableLimit, backoffMin, backoffMax time.Duration) *limitListener {
+	if backoffMin <= 0 {
+		backoffMin = defaultAcceptBackoffMin
+	}
+	if backoffMax < backoffMin {
+		backoffMax = backoffMin
+	}
+	return &limitListener{
+		Listener:      ln,
+		maxConnsPerIP: maxConnsPerIP,
+		backoffMin:    backoffMin,
+		backoffMax:    backoffMax,
+		conns:         make(map[string]int),
+	}
+}
+
+// Is this an Accept error that may go away if we wait (e.g. running out of file
+// descriptors)?
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	if e, ok := err.(net.Error); ok && e.Temporary() {
+		return true
+	}
+	return false
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			if !isTemporaryAcceptError(err) {
+				return nil, err
+			}
+			if delay == 0 {
+				delay = ln.backoffMin
+			} else {
+				delay *= 2
+			}
+			if delay > ln.backoffMax {
+				delay = ln.backoffMax
+			}
+			logging.Warnf("accept error: %s; retrying in %s", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		// Count connections even when there is no limit, so that the
+		// count is right if a limit is set later.
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		if !ln.acquire(host) {
+			// Over the limit: drop the connection without a word.
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { ln.release(host) }}, nil
+	}
+}
+
+func (ln *limitListener) acquire(host string) bool {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	if max := ln.maxConnsPerIP.Get(); max > 0 && ln.conns[host] >= max {
+		return false
+	}
+	ln.conns[host]++
+	return true
+}
+
+func (ln *limitListener) release(host string) {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	ln.conns[host]--
+	if ln.conns[host] <= 0 {
+		delete(ln.conns, host)
+	}
+}
+
+// limitConn is a net.Conn that gives back its slot in a limitListener when
+// closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// The context key under which connRequestCount stores a per-connection request
+// counter.
+type connRequestCountKey struct{}
+
+// Attach a fresh request counter to a connection's context. For use as
+// http.Server.ConnContext.
+func connRequestCountContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connRequestCountKey{}, new(int64))
+}
+
+// limitRequestsPerConn wraps an http.Handler, asking the client to close an
+// HTTP/1.1 connection once it has carried max requests. HTTP/2 connections are
+// unaffected; their streams are bounded by the HTTP/2 server settings instead.
+func limitRequestsPerConn(handler http.Handler, max *adjustableLimit) http.Handler {
+	var lock sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if count, ok := req.Context().Value(connRequestCountKey{}).(*int64); ok {
+			lock.Lock()
+			*count++
+			n := *count
+			lock.Unlock()
+			if limit := max.Get(); limit > 0 && n >= int64(limit) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// limitInFlight wraps an http.Handler, allowing at most max requests to be
+// handled at once over the whole server, so that a burst of requests stuck on
+// slow backend reads can't pile up goroutines and buffers without bound. Up to
+// queue more requests wait as long as wait for a slot; the rest, and those
+// that wait too long, are refused (see serveInFlightRefusal). max 0 or less
+// means unlimited. WebSocket requests are not counted, because they last as
+// long as their session.
+func limitInFlight(handler http.Handler, max, queue int, wait time.Duration) http.Handler {
+	if max <= 0 {
+		return handler
+	}
+	slots := make(chan struct{}, max)
+	waiting := make(chan struct{}, queue)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isWebSocketRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			if !waitForSlot(req.Context(), slots, waiting, wait) {
+				logging.Debugf("too many requests in flight; refusing request")
+				serveInFlightRefusal(w, req)
+				return
+			}
+		}
+		defer func() { <-slots }()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Answer a request refused by limitInFlight. A transport request, one with a
+// session id, gets a 503, which clients retry. Any other request gets the same
+// answer as other requests the server won't serve, according to
+// --probe-response, so that load doesn't reveal a response particular to this
+// server.
+func serveInFlightRefusal(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Session-Id") == "" {
+		serveProbeResponse(w, req)
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Service unavailable.", http.StatusServiceUnavailable)
+}
+
+// Wait up to wait for a place in slots, if there's room in the waiting queue.
+// Returns whether a slot was taken.
+func waitForSlot(ctx context.Context, slots, waiting chan struct{}, wait time.Duration) bool {
+	select {
+	case waiting <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-waiting }()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
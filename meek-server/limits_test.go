@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that limitListener drops connections from an IP address that already
+// has the maximum number open, and admits new ones after a slot is freed.
+func TestLimitListenerMaxConnsPerIP(t *testing.T) {
+	rawLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(rawLn, newAdjustableLimit(2), 0, 0)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", rawLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	expectAccepted := func(expected bool) net.Conn {
+		select {
+		case conn := <-accepted:
+			if !expected {
+				t.Fatalf("connection accepted over the limit")
+			}
+			return conn
+		case <-time.After(200 * time.Millisecond):
+			if expected {
+				t.Fatalf("connection not accepted under the limit")
+			}
+			return nil
+		}
+	}
+
+	c1, c2, c3 := dial(), dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	defer c3.Close()
+	s1 := expectAccepted(true)
+	expectAccepted(true)
+	expectAccepted(false)
+
+	// The third client should have been disconnected.
+	c3.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c3.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection over the limit was not closed")
+	}
+
+	s1.Close()
+	c4 := dial()
+	defer c4.Close()
+	expectAccepted(true)
+}
+
+func TestLimitRequestsPerConn(t *testing.T) {
+	handler := limitRequestsPerConn(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), newAdjustableLimit(2))
+	ctx := connRequestCountContext(context.Background(), nil)
+	for i, expected := range []string{"", "close", "close"} {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Connection"); got != expected {
+			t.Errorf("request %d: expected Connection %q, got %q", i+1, expected, got)
+		}
+	}
+}
+
+func TestLimitRequestsPerConnAdjusted(t *testing.T) {
+	limit := newAdjustableLimit(0)
+	handler := limitRequestsPerConn(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), limit)
+	ctx := connRequestCountContext(context.Background(), nil)
+	for i, expected := range []string{"", "", "close"} {
+		if i == 2 {
+			// Lowering the limit affects existing connections.
+			limit.Set(2)
+		}
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Connection"); got != expected {
+			t.Errorf("request %d: expected Connection %q, got %q", i+1, expected, got)
+		}
+	}
+}
+
+// Test that limitInFlight queues requests beyond the limit, and refuses those
+// beyond the queue or that wait too long.
+func TestLimitInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	handler := limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 1, 1, 5*time.Second)
+	serve := func(result chan<- int) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-Session-Id", "session")
+		handler.ServeHTTP(rec, req)
+		result <- rec.Code
+	}
+
+	results := make(chan int, 10)
+	go serve(results)
+	<-started
+	// This one waits in the queue.
+	go serve(results)
+	time.Sleep(100 * time.Millisecond)
+	// The queue is full, so this one is refused.
+	go serve(results)
+	if code := <-results; code != http.StatusServiceUnavailable {
+		t.Errorf("over the queue: status %d", code)
+	}
+	// A request that isn't a transport request gets the probe response.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("over the queue without a session id: status %d", rec.Code)
+	}
+	// Releasing the first lets the queued one run.
+	release <- struct{}{}
+	<-started
+	if code := <-results; code != http.StatusOK {
+		t.Errorf("first request: status %d", code)
+	}
+	release <- struct{}{}
+	if code := <-results; code != http.StatusOK {
+		t.Errorf("queued request: status %d", code)
+	}
+
+	// A request that waits too long is refused.
+	handler = limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 1, 1, 50*time.Millisecond)
+	go serve(results)
+	<-started
+	go serve(results)
+	if code := <-results; code != http.StatusServiceUnavailable {
+		t.Errorf("after waiting: status %d", code)
+	}
+	release <- struct{}{}
+	<-results
+}
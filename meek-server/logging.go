@@ -0,0 +1,122 @@
+package main
+
+// The code in this file has to do with keeping sensitive information, like
+// client IP addresses, out of the log. The log level is kept by
+// ../lib/logging.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// If true, don't scrub client addresses or session ids from log messages. Set
+// by --unsafe-logging.
+var unsafeLogging = false
+
+// scrubbedAddr is a phony net.Addr that returns "[scrubbed]" for all calls.
+type scrubbedAddr struct{}
+
+func (a scrubbedAddr) Network() string { return "[scrubbed]" }
+func (a scrubbedAddr) String() string  { return "[scrubbed]" }
+
+// Replace the Addr in a net.OpError with "[scrubbed]" for logging, unless
+// --unsafe-logging is in effect.
+func scrubError(err error) error {
+	if unsafeLogging {
+		return err
+	}
+	if err, ok := err.(*net.OpError); ok {
+		// net.OpError contains Op, Net, Addr, and a subsidiary Err. The
+		// (Op, Net, Addr) part is responsible for error text prefixes
+		// like "read tcp X.X.X.X:YYYY:". We want that information but
+		// don't want to log the literal address.
+		err.Addr = scrubbedAddr{}
+	}
+	return err
+}
+
+// Return a client address (or IP address) in a form suitable for logging:
+// "[scrubbed]" unless --unsafe-logging is in effect.
+func scrubAddr(addr string) string {
+	if unsafeLogging {
+		return addr
+	}
+	return scrubbedAddr{}.String()
+}
+
+// The start of the HTTP server's log lines about failed TLS handshakes, which
+// go on with the client's address.
+const tlsHandshakeErrorPrefix = "http: TLS handshake error from "
+
+// serverErrorLogWriter is the output of the HTTP server's ErrorLog. It scrubs
+// the client address from the lines about failed TLS handshakes.
+type serverErrorLogWriter struct{}
+
+func (serverErrorLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	if rest, ok := strings.CutPrefix(line, tlsHandshakeErrorPrefix); ok {
+		if addr, msg, ok := strings.Cut(rest, ": "); ok {
+			line = tlsHandshakeErrorPrefix + scrubAddr(addr) + ": " + msg
+		}
+	}
+	logging.Warnf("%s", line)
+	return len(p), nil
+}
+
+// Return a logger for http.Server.ErrorLog that scrubs client addresses.
+func newServerErrorLog() *log.Logger {
+	return log.New(serverErrorLogWriter{}, "", 0)
+}
+
+// Session ids are logged as a short keyed hash, so that the lines about one
+// session can be matched up, but the log doesn't contain the ids themselves.
+// The key changes every day (UTC), so hashes can't be linked across days.
+const sessionIDHashLen = 8
+
+// sessionIDHasher makes the keyed hashes of session ids for logging.
+type sessionIDHasher struct {
+	now func() time.Time
+
+	lock sync.Mutex
+	key  []byte
+	// The day the key is for, in the form "2006-01-02".
+	day string
+}
+
+var logSessionIDHasher = &sessionIDHasher{now: time.Now}
+
+// Return the hash of sessionID under today's key.
+func (hasher *sessionIDHasher) Hash(sessionID string) string {
+	hasher.lock.Lock()
+	day := hasher.now().UTC().Format("2006-01-02")
+	if day != hasher.day || hasher.key == nil {
+		key := make([]byte, sha256.Size)
+		_, err := rand.Read(key)
+		if err != nil {
+			panic(err)
+		}
+		hasher.key, hasher.day = key, day
+	}
+	mac := hmac.New(sha256.New, hasher.key)
+	hasher.lock.Unlock()
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))[:sessionIDHashLen]
+}
+
+// Return a session id in a form suitable for logging: a short hash that
+// changes daily, unless --unsafe-logging is in effect.
+func scrubSessionID(sessionID string) string {
+	if unsafeLogging {
+		return sessionID
+	}
+	return logSessionIDHasher.Hash(sessionID)
+}
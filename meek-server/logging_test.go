@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubError(t *testing.T) {
+	defer func(saved bool) { unsafeLogging = saved }(unsafeLogging)
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	newErr := func() error {
+		return &net.OpError{Op: "read", Net: "tcp", Addr: addr, Err: errors.New("reset")}
+	}
+
+	unsafeLogging = false
+	if s := scrubError(newErr()).Error(); s != "read tcp [scrubbed]: reset" {
+		t.Errorf("safe: got %q", s)
+	}
+	if s := scrubAddr(addr.String()); s != "[scrubbed]" {
+		t.Errorf("safe: got %q", s)
+	}
+	unsafeLogging = true
+	if s := scrubError(newErr()).Error(); s != "read tcp 192.0.2.1:1234: reset" {
+		t.Errorf("unsafe: got %q", s)
+	}
+	if s := scrubAddr(addr.String()); s != addr.String() {
+		t.Errorf("unsafe: got %q", s)
+	}
+}
+
+// The HTTP server's lines about failed TLS handshakes don't contain the
+// client's address.
+func TestServerErrorLog(t *testing.T) {
+	defer func(saved bool) { unsafeLogging = saved }(unsafeLogging)
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+
+	logger := newServerErrorLog()
+	for _, test := range []struct {
+		unsafe         bool
+		line, expected string
+	}{
+		{false, "http: TLS handshake error from 192.0.2.1:1234: EOF", "http: TLS handshake error from [scrubbed]: EOF\n"},
+		{false, "http: TLS handshake error from [2001:db8::1]:1234: remote error: tls: bad certificate", "http: TLS handshake error from [scrubbed]: remote error: tls: bad certificate\n"},
+		{true, "http: TLS handshake error from 192.0.2.1:1234: EOF", "http: TLS handshake error from 192.0.2.1:1234: EOF\n"},
+		{false, "http: Accept error: too many open files", "http: Accept error: too many open files\n"},
+	} {
+		unsafeLogging = test.unsafe
+		buf.Reset()
+		logger.Print(test.line)
+		if buf.String() != test.expected {
+			t.Errorf("%q: got %q", test.line, buf.String())
+		}
+	}
+}
+
+func TestSessionIDHasher(t *testing.T) {
+	now := time.Date(2017, 3, 22, 12, 0, 0, 0, time.UTC)
+	hasher := &sessionIDHasher{now: func() time.Time { return now }}
+	const id = "0123456789abcdef"
+
+	h := hasher.Hash(id)
+	if len(h) != sessionIDHashLen || strings.Contains(id, h) {
+		t.Errorf("bad hash %q", h)
+	}
+	if hasher.Hash(id) != h {
+		t.Errorf("different hash on the same day")
+	}
+	if hasher.Hash("fedcba9876543210") == h {
+		t.Errorf("same hash for different ids")
+	}
+	// Still the same day in UTC.
+	now = now.Add(11 * time.Hour)
+	if hasher.Hash(id) != h {
+		t.Errorf("different hash on the same day")
+	}
+	now = now.Add(time.Hour)
+	if hasher.Hash(id) == h {
+		t.Errorf("same hash on the next day")
+	}
+}
+
+func TestScrubSessionID(t *testing.T) {
+	const id = "0123456789abcdef"
+	if scrubSessionID(id) == id {
+		t.Errorf("session id not scrubbed")
+	}
+	unsafeLogging = true
+	defer func() { unsafeLogging = false }()
+	if scrubSessionID(id) != id {
+		t.Errorf("session id scrubbed with --unsafe-logging")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+// The code in this file has to do with serving decoy ("mask") content to
+// requests that are not meek transport requests. Under active probing, the
+// responses should be indistinguishable from those of an ordinary static file
+// server: conditional requests, byte ranges, HEAD, and directory index pages
+// all behave the way they would with a stock web server.
+//
+// Operators without content of their own can choose one of the decoy sites
+// built into the program (--mask-template), which live in the masktemplates
+// directory of the source, or have a copy of a real site kept up to date
+// (--mask-mirror; see maskmirror.go). A built-in site is served from a copy in
+// the state directory, made the first time it is used, so that its
+// Last-Modified times and entity tags are those of the deployment and not the
+// same on every server.
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The body served when no mask document or directory is configured.
+const defaultMaskBody = "I’m just a happy little web server.\n"
+
+// The name of the file served for a directory.
+const maskIndexName = "index.html"
+
+// Process start time, used as the Last-Modified time of content that doesn't
+// come from a file.
+var maskStartTime = time.Now()
+
+// The built-in decoy sites, one per subdirectory of masktemplates.
+//
+//go:embed masktemplates
+var maskTemplates embed.FS
+
+// The name of the directory, in the state directory, of the copy of the
+// --mask-template site.
+const maskTemplateDirname = "meek-mask-template"
+
+// Replaced, in the files of a built-in decoy site, with the modification time
+// of the copy, formatted as in an nginx directory listing.
+const maskTemplateDatePlaceholder = "{{date}}"
+
+// The directory of the copy of the --mask-template site, or "" if there is
+// none.
+var maskTemplateDir string
+
+// Return the names of the built-in decoy sites.
+func maskTemplateNames() []string {
+	entries, _ := maskTemplates.ReadDir("masktemplates")
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return the files of the built-in decoy site name, or an error if there is
+// no such site.
+func maskTemplate(name string) (fs.FS, error) {
+	for _, n := range maskTemplateNames() {
+		if n == name {
+			return fs.Sub(maskTemplates, path.Join("masktemplates", name))
+		}
+	}
+	return nil, fmt.Errorf("unknown mask template %q; must be one of %s", name, strings.Join(maskTemplateNames(), ", "))
+}
+
+// Copy the built-in decoy site name to a subdirectory of dir, unless it is
+// there already, and return the subdirectory. Every file of a new copy has
+// the current time, to the minute, as its modification time. An existing
+// copy is kept as it is, so that the times don't change at each restart;
+// removing it makes a new one.
+func installMaskTemplate(name, dir string) (string, error) {
+	fsys, err := maskTemplate(name)
+	if err != nil {
+		return "", err
+	}
+	siteDir := filepath.Join(dir, name)
+	if _, err := os.Stat(siteDir); err == nil {
+		return siteDir, nil
+	}
+	// Copy to a temporary directory first, so that a copy cut short by
+	// an error isn't mistaken for a complete one the next time.
+	tmpDir, err := os.MkdirTemp(dir, name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	modtime := time.Now().UTC().Truncate(time.Minute)
+	date := []byte(modtime.Format("02-Jan-2006 15:04"))
+	err = fs.WalkDir(fsys, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmpDir, filepath.FromSlash(file))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		contents = bytes.ReplaceAll(contents, []byte(maskTemplateDatePlaceholder), date)
+		err = os.WriteFile(target, contents, 0600)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, modtime, modtime)
+	})
+	if err == nil {
+		err = os.Rename(tmpDir, siteDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return siteDir, nil
+}
+
+// Return the files to serve as decoy content from --mask-dir, --mask-mirror,
+// or --mask-template, or nil if there are none.
+func maskFileSystem() http.FileSystem {
+	if options.MaskDir != "" {
+		return http.Dir(options.MaskDir)
+	}
+	if fsys := maskMirrorSite.FileSystem(); fsys != nil {
+		return fsys
+	}
+	if maskTemplateDir != "" {
+		return http.Dir(maskTemplateDir)
+	}
+	return nil
+}
+
+// Compute an entity tag from a file's modification time and size, the same way
+// nginx does.
+func maskETag(modtime time.Time, size int64) string {
+	return fmt.Sprintf("\"%x-%x\"", modtime.Unix(), size)
+}
+
+// Serve content with full conditional-request and Range support.
+// http.ServeContent takes care of If-Modified-Since, If-None-Match, If-Range,
+// Range, Content-Length, and HEAD.
+func serveMaskContent(w http.ResponseWriter, req *http.Request, name string, modtime time.Time, size int64, content io.ReadSeeker) {
+	w.Header().Set("ETag", maskETag(modtime, size))
+	http.ServeContent(w, req, name, modtime, content)
+}
+
+// Serve a single file as the decoy for "/", and 404 for every other path.
+func serveMaskDoc(w http.ResponseWriter, req *http.Request, doc string) {
+	if path.Clean(req.URL.Path) != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := os.Open(doc)
+	if err == nil {
+		defer f.Close()
+		fi, err := f.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			// The mask document is HTML regardless of its file
+			// name, so don't let ServeContent guess from the
+			// extension.
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			serveMaskContent(w, req, "index.html", fi.ModTime(), fi.Size(), f)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	body := []byte(defaultMaskBody)
+	serveMaskContent(w, req, "", maskStartTime, int64(len(body)), bytes.NewReader(body))
+}
+
+// Serve files out of a directory tree.
+func serveMaskDir(w http.ResponseWriter, req *http.Request, dir string) {
+	serveMaskFS(w, req, http.Dir(dir))
+}
+
+// Serve files out of a file system. A request for a directory without a
+// trailing slash is redirected to the slash form; a request for a directory
+// serves its index.html if there is one, and 404 otherwise (no listings). Dot
+// files are never served.
+func serveMaskFS(w http.ResponseWriter, req *http.Request, fsys http.FileSystem) {
+	upath := req.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := path.Clean(upath)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			http.NotFound(w, req)
+			return
+		}
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if fi.IsDir() {
+		if !strings.HasSuffix(upath, "/") {
+			localRedirect(w, req, path.Base(upath)+"/")
+			return
+		}
+		index, err := fsys.Open(path.Join(name, maskIndexName))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		defer index.Close()
+		ifi, err := index.Stat()
+		if err != nil || ifi.IsDir() {
+			http.NotFound(w, req)
+			return
+		}
+		serveMaskContent(w, req, maskIndexName, ifi.ModTime(), ifi.Size(), index)
+		return
+	}
+
+	// Like net/http's FileServer, redirect ".../index.html" to ".../".
+	if strings.HasSuffix(upath, "/"+maskIndexName) {
+		localRedirect(w, req, "./")
+		return
+	}
+	serveMaskContent(w, req, fi.Name(), fi.ModTime(), fi.Size(), f)
+}
+
+// Redirect to a path relative to the request path, preserving the query
+// string.
+func localRedirect(w http.ResponseWriter, req *http.Request, newPath string) {
+	if q := req.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// Respond to a request with a method that a static file server doesn't
+// support, such as a POST that is not a valid transport request.
+func serveMaskMethodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+}
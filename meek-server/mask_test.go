@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeMaskDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "meek-server-mask-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "sub", "empty"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"index.html":     "<html>index</html>",
+		"sub/index.html": "<html>sub</html>",
+		"style.css":      "body { color: black; }",
+		".secret":        "secret",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func maskDirRequest(dir string, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	serveMaskDir(rec, req, dir)
+	return rec
+}
+
+func TestServeMaskDir(t *testing.T) {
+	dir := makeMaskDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Path     string
+		Status   int
+		Body     string
+		Location string
+	}{
+		{"/", http.StatusOK, "<html>index</html>", ""},
+		{"/style.css", http.StatusOK, "body { color: black; }", ""},
+		{"/sub/", http.StatusOK, "<html>sub</html>", ""},
+		{"/sub", http.StatusMovedPermanently, "", "sub/"},
+		{"/sub/index.html", http.StatusMovedPermanently, "", "./"},
+		{"/sub/empty/", http.StatusNotFound, "", ""},
+		{"/.secret", http.StatusNotFound, "", ""},
+		{"/../etc/passwd", http.StatusNotFound, "", ""},
+		{"/nonexistent", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		rec := maskDirRequest(dir, httptest.NewRequest("GET", test.Path, nil))
+		if rec.Code != test.Status {
+			t.Errorf("%q: expected status %d, got %d", test.Path, test.Status, rec.Code)
+			continue
+		}
+		if test.Body != "" && rec.Body.String() != test.Body {
+			t.Errorf("%q: expected body %q, got %q", test.Path, test.Body, rec.Body.String())
+		}
+		if loc := rec.Header().Get("Location"); loc != test.Location {
+			t.Errorf("%q: expected Location %q, got %q", test.Path, test.Location, loc)
+		}
+	}
+}
+
+// Test conditional requests and Range requests against a mask directory.
+func TestServeMaskDirConditional(t *testing.T) {
+	dir := makeMaskDir(t)
+	defer os.RemoveAll(dir)
+
+	rec := maskDirRequest(dir, httptest.NewRequest("GET", "/style.css", nil))
+	etag := rec.Header().Get("ETag")
+	lastModified := rec.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("missing ETag %q or Last-Modified %q", etag, lastModified)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "22" {
+		t.Errorf("expected Content-Length 22, got %q", cl)
+	}
+
+	req := httptest.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = maskDirRequest(dir, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: expected status %d, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rec = maskDirRequest(dir, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: expected status %d, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rec = maskDirRequest(dir, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "body" {
+		t.Errorf("Range: got status %d body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = maskDirRequest(dir, httptest.NewRequest("HEAD", "/style.css", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: got status %d body %q", rec.Code, rec.Body.String())
+	}
+}
+
+// Test that serveMaskDoc serves only "/", and falls back to the built-in body
+// when the document doesn't exist.
+func TestServeMaskDoc(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveMaskDoc(rec, httptest.NewRequest("GET", "/", nil), "/nonexistent/index.html")
+	if rec.Code != http.StatusOK || rec.Body.String() != defaultMaskBody {
+		t.Errorf("got status %d body %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Errorf("missing ETag")
+	}
+
+	rec = httptest.NewRecorder()
+	serveMaskDoc(rec, httptest.NewRequest("GET", "/other", nil), "/nonexistent/index.html")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// Install the built-in decoy site name as the --mask-template site, in a
+// temporary directory that the caller must remove.
+func useMaskTemplate(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "meek-server-mask-template-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maskTemplateDir, err = installMaskTemplate(name, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Test that every built-in decoy site has an index and a 404 page, and that
+// the files of the sites are served with the modification time of the copy.
+func TestMaskTemplates(t *testing.T) {
+	defer func() { maskTemplateDir = "" }()
+	names := maskTemplateNames()
+	if len(names) < 3 {
+		t.Errorf("only %d mask templates: %v", len(names), names)
+	}
+	for _, name := range names {
+		dir := useMaskTemplate(t, name)
+		defer os.RemoveAll(dir)
+		for _, file := range []string{"index.html", "404.html"} {
+			_, err := os.Stat(filepath.Join(maskTemplateDir, file))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		serveMaskFS(rec, httptest.NewRequest("GET", "/", nil), http.Dir(maskTemplateDir))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<html") {
+			t.Errorf("%s: status %d, body %q", name, rec.Code, rec.Body.String())
+		}
+		if strings.Contains(rec.Body.String(), maskTemplateDatePlaceholder) {
+			t.Errorf("%s: placeholder not replaced: %q", name, rec.Body.String())
+		}
+		lm, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+		if err != nil || time.Since(lm) > time.Hour || lm.Second() != 0 {
+			t.Errorf("%s: Last-Modified %q", name, rec.Header().Get("Last-Modified"))
+		}
+	}
+	if _, err := maskTemplate("nonexistent"); err == nil {
+		t.Errorf("no error for an unknown template")
+	}
+}
+
+// Test that an existing copy of a built-in decoy site is kept, modification
+// times and all.
+func TestInstallMaskTemplateExisting(t *testing.T) {
+	defer func() { maskTemplateDir = "" }()
+	dir := useMaskTemplate(t, "files")
+	defer os.RemoveAll(dir)
+	modtime := time.Date(2021, time.March, 4, 5, 6, 0, 0, time.UTC)
+	index := filepath.Join(maskTemplateDir, "index.html")
+	err := os.Chtimes(index, modtime, modtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteDir, err := installMaskTemplate("files", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if siteDir != maskTemplateDir {
+		t.Errorf("got %q, expected %q", siteDir, maskTemplateDir)
+	}
+	fi, err := os.Stat(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(modtime) {
+		t.Errorf("modification time %v, expected %v", fi.ModTime(), modtime)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d entries in %s, expected 1", len(entries), dir)
+	}
+}
+
+// Test that --mask-template is served by Get, and that --mask-dir overrides it.
+func TestGetMaskTemplate(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.MaskTemplate = "blog"
+	defer func() { maskTemplateDir = "" }()
+	defer os.RemoveAll(useMaskTemplate(t, "blog"))
+
+	rec := httptest.NewRecorder()
+	NewState().Get(rec, httptest.NewRequest("GET", "/style.css", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Errorf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	dir := makeMaskDir(t)
+	defer os.RemoveAll(dir)
+	options.MaskDir = dir
+	rec = httptest.NewRecorder()
+	NewState().Get(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "<html>index</html>" {
+		t.Errorf("--mask-dir doesn't override --mask-template: body %q", rec.Body.String())
+	}
+}
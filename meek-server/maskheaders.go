@@ -0,0 +1,69 @@
+package main
+
+// The code in this file adds security and caching headers to decoy responses
+// (--mask-hsts, --mask-nosniff, --mask-csp, and --mask-cache-control). A
+// professionally hosted site sends Strict-Transport-Security,
+// X-Content-Type-Options, Content-Security-Policy, and Cache-Control with its
+// pages; a bare Go file server sends none of them, which sets the origin apart
+// when a prober compares it with ordinary sites. All of them are off by
+// default.
+//
+// Browsers ignore Strict-Transport-Security received over plain HTTP, and
+// sites don't send it there, so it is only added to responses to HTTPS
+// requests: those that came over TLS, or, with --disable-tls behind a CDN,
+// those with an X-Forwarded-Proto of https.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// maskHeaders are the headers to add to decoy responses. Zero values mean the
+// header is not sent.
+type maskHeaders struct {
+	HSTS         time.Duration
+	NoSniff      bool
+	CSP          string
+	CacheControl string
+}
+
+// Return an error if the headers can't be sent.
+func checkMaskHeaders(h maskHeaders) error {
+	if h.HSTS < 0 {
+		return fmt.Errorf("--mask-hsts: must not be negative")
+	}
+	if !httpguts.ValidHeaderFieldValue(h.CSP) {
+		return fmt.Errorf("--mask-csp: not a valid header value")
+	}
+	if !httpguts.ValidHeaderFieldValue(h.CacheControl) {
+		return fmt.Errorf("--mask-cache-control: not a valid header value")
+	}
+	return nil
+}
+
+// Add the headers to a response to req.
+func (h *maskHeaders) Set(w http.ResponseWriter, req *http.Request) {
+	header := w.Header()
+	if h.HSTS > 0 && isHTTPSRequest(req) {
+		header.Set("Strict-Transport-Security", "max-age="+strconv.FormatInt(int64(h.HSTS/time.Second), 10))
+	}
+	if h.NoSniff {
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+	if h.CSP != "" {
+		header.Set("Content-Security-Policy", h.CSP)
+	}
+	if h.CacheControl != "" {
+		header.Set("Cache-Control", h.CacheControl)
+	}
+}
+
+// Did req come over HTTPS, to this server or to a CDN in front of it?
+func isHTTPSRequest(req *http.Request) bool {
+	return req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
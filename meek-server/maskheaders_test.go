@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckMaskHeaders(t *testing.T) {
+	if err := checkMaskHeaders(maskHeaders{HSTS: 365 * 24 * time.Hour, CSP: "default-src 'self'", CacheControl: "max-age=600"}); err != nil {
+		t.Error(err)
+	}
+	for _, h := range []maskHeaders{
+		{HSTS: -time.Second},
+		{CSP: "default-src\n'self'"},
+		{CacheControl: "no-cache\r\nX-Injected: 1"},
+	} {
+		if err := checkMaskHeaders(h); err == nil {
+			t.Errorf("%+v: unexpected success", h)
+		}
+	}
+}
+
+func TestMaskHeadersSet(t *testing.T) {
+	h := maskHeaders{HSTS: 2 * time.Hour, NoSniff: true, CSP: "default-src 'self'", CacheControl: "max-age=600"}
+	for _, test := range []struct {
+		tls       bool
+		forwarded string
+		hsts      string
+	}{
+		{false, "", ""},
+		{true, "", "max-age=7200"},
+		{false, "https", "max-age=7200"},
+		{false, "http", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-Proto", test.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.Set(rec, req)
+		got := rec.Header()
+		if got.Get("Strict-Transport-Security") != test.hsts {
+			t.Errorf("%+v: Strict-Transport-Security %q", test, got.Get("Strict-Transport-Security"))
+		}
+		if got.Get("X-Content-Type-Options") != "nosniff" || got.Get("Content-Security-Policy") != h.CSP || got.Get("Cache-Control") != h.CacheControl {
+			t.Errorf("%+v: headers %v", test, got)
+		}
+	}
+
+	// The zero value adds nothing.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	(&maskHeaders{}).Set(rec, req)
+	if len(rec.Header()) != 0 {
+		t.Errorf("zero value: headers %v", rec.Header())
+	}
+}
+
+// The headers are on decoy responses from State.Get.
+func TestGetMaskHeaders(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.MaskHeaders = maskHeaders{NoSniff: true, CacheControl: "max-age=600"}
+	rec := httptest.NewRecorder()
+	NewState().Get(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" || rec.Header().Get("Cache-Control") != "max-age=600" {
+		t.Errorf("headers %v", rec.Header())
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+// The code in this file implements --mask-mirror, which serves a copy of a real
+// web site as decoy content. The server fetches the page at the given URL and,
+// following links, up to maskMirrorMaxFiles pages and other files from the
+// same host, and saves them under the pluggable transport state directory (or
+// a temporary directory if there is none). The copy is fetched again every
+// --mask-refresh, so the decoy doesn't go stale; a failed fetch keeps the
+// previous copy. A copy saved by an earlier run is served until the first
+// fetch finishes, so that a restart doesn't leave the server without its decoy
+// while the site is being crawled.
+//
+// Files are saved as they were served. Links in them are not rewritten, so
+// absolute links still point to the real site.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"../lib/logging"
+)
+
+const (
+	// The name of the directory in the state directory that holds the
+	// copies of the site.
+	maskMirrorDirname = "meek-mask-mirror"
+	// How many files to fetch from the site.
+	maskMirrorMaxFiles = 50
+	// The largest file to keep.
+	maskMirrorMaxFileSize = 4 * 1024 * 1024
+	// The time allowed for fetching the whole site.
+	maskMirrorTimeout = 2 * time.Minute
+	// How long to wait before trying again after a failed fetch.
+	maskMirrorRetry = 5 * time.Minute
+	// The names of copies of the site, from the time they were fetched.
+	// They sort in time order.
+	maskMirrorCopyLayout = "20060102T150405.000000000Z"
+	// The User-Agent to fetch with. Some sites refuse Go's default.
+	maskMirrorUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+)
+
+// maskMirror keeps a local copy of a web site. A nil *maskMirror has no copy.
+type maskMirror struct {
+	origin *url.URL
+	// The directory that holds copies of the site, each in a subdirectory
+	// named by the time it was fetched.
+	dir string
+	// How often to fetch the site again, or 0 to fetch it only once.
+	refresh time.Duration
+	client  *http.Client
+
+	lock sync.Mutex
+	// The subdirectory of dir being served, or "" if there is no copy yet.
+	current string
+}
+
+// The mirrored site, or nil if --mask-mirror is not set. Set up in main.
+var maskMirrorSite *maskMirror
+
+// Parse a --mask-mirror URL, which must be an absolute http or https URL.
+func parseMaskMirrorURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q is not an http or https URL", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", s)
+	}
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// Make a maskMirror of the site at origin, keeping its copies in dir. A copy
+// left in dir by an earlier run is served until the first fetch finishes;
+// anything else in dir is removed.
+func newMaskMirror(origin, dir string, refresh time.Duration) (*maskMirror, error) {
+	u, err := parseMaskMirrorURL(origin)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &maskMirror{
+		origin:  u,
+		dir:     dir,
+		refresh: refresh,
+		client:  &http.Client{},
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		_, err := time.Parse(maskMirrorCopyLayout, name)
+		if m.current == "" && err == nil {
+			m.current = name
+			continue
+		}
+		// An older copy, or an unfinished fetch.
+		os.RemoveAll(filepath.Join(dir, name))
+	}
+	return m, nil
+}
+
+// Return the files of the current copy of the site, or nil if there is none.
+func (m *maskMirror) FileSystem() http.FileSystem {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.current == "" {
+		return nil
+	}
+	return http.Dir(filepath.Join(m.dir, m.current))
+}
+
+// Fetch the site into a new copy, and serve it in place of the old one.
+// Returns the number of files fetched. If fetching the first page fails, the
+// old copy stays.
+func (m *maskMirror) Fetch(ctx context.Context) (int, error) {
+	tmp, err := os.MkdirTemp(m.dir, ".fetch-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.crawl(ctx, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return 0, err
+	}
+	name := time.Now().UTC().Format(maskMirrorCopyLayout)
+	err = os.Rename(tmp, filepath.Join(m.dir, name))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return 0, err
+	}
+	m.lock.Lock()
+	old := m.current
+	m.current = name
+	m.lock.Unlock()
+	if old != "" {
+		// Requests still reading files of the old copy keep them open.
+		os.RemoveAll(filepath.Join(m.dir, old))
+	}
+	return n, nil
+}
+
+// Fetch pages and the files they link to, starting at the origin and staying
+// on its host, and save them under dir. Only the first page is required;
+// other files that can't be fetched or saved are skipped.
+func (m *maskMirror) crawl(ctx context.Context, dir string) (int, error) {
+	queue := []*url.URL{m.origin}
+	seen := map[string]bool{m.origin.Path: true}
+	n := 0
+	for len(queue) > 0 && n < maskMirrorMaxFiles {
+		u := queue[0]
+		queue = queue[1:]
+		links, err := m.fetchFile(ctx, u, dir)
+		if err != nil {
+			if n == 0 {
+				return 0, err
+			}
+			logging.Debugf("mask mirror: skipping %s: %s", u, err)
+			continue
+		}
+		n++
+		for _, link := range links {
+			if link.Path == "" {
+				link.Path = "/"
+			}
+			if link.Scheme != m.origin.Scheme || link.Host != m.origin.Host || link.RawQuery != "" || seen[link.Path] {
+				continue
+			}
+			seen[link.Path] = true
+			queue = append(queue, link)
+		}
+	}
+	return n, nil
+}
+
+// Fetch one file and save it under dir. Returns the links in it, if it is an
+// HTML page.
+func (m *maskMirror) fetchFile(ctx context.Context, u *url.URL, dir string) ([]*url.URL, error) {
+	name, err := maskMirrorFilename(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", maskMirrorUserAgent)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maskMirrorMaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maskMirrorMaxFileSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", u, maskMirrorMaxFileSize)
+	}
+
+	filename := filepath.Join(dir, filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filename, body, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the site's own modification time, for Last-Modified.
+	if modtime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(filename, modtime, modtime)
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil, nil
+	}
+	// Resolve links against where the page ended up after redirects.
+	var links []*url.URL
+	for _, ref := range extractLinks(body) {
+		link, err := resp.Request.URL.Parse(ref)
+		if err != nil {
+			continue
+		}
+		link.Fragment = ""
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Return the name under which to save the file at a URL path: the path itself,
+// or its index.html if it names a directory. Paths with dot files, which
+// serveMaskFS would not serve, are an error.
+func maskMirrorFilename(urlPath string) (string, error) {
+	name := path.Clean("/" + urlPath)
+	if name == "/" || strings.HasSuffix(urlPath, "/") {
+		name = path.Join(name, maskIndexName)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("%q has a dot file", urlPath)
+		}
+	}
+	return name[1:], nil
+}
+
+// Return the values of the href and src attributes in an HTML document.
+func extractLinks(body []byte) []string {
+	var links []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			_, hasAttr := z.TagName()
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				if string(key) == "href" || string(key) == "src" {
+					links = append(links, string(value))
+				}
+			}
+		}
+	}
+}
+
+// Fetch the site now, and again every refresh, forever. After a failure, try
+// again sooner.
+func (m *maskMirror) Run() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), maskMirrorTimeout)
+		n, err := m.Fetch(ctx)
+		cancel()
+		if err != nil {
+			logging.Warnf("error fetching --mask-mirror site: %s", err)
+			time.Sleep(maskMirrorRetry)
+			continue
+		}
+		logging.Infof("fetched %d files from %s for the mask", n, m.origin)
+		if m.refresh <= 0 {
+			return
+		}
+		time.Sleep(m.refresh)
+	}
+}
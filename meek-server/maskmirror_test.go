@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaskMirrorFilename(t *testing.T) {
+	for _, test := range []struct {
+		Path string
+		Name string
+	}{
+		{"", "index.html"},
+		{"/", "index.html"},
+		{"/about", "about"},
+		{"/about/", "about/index.html"},
+		{"/a/../b.css", "b.css"},
+		{"/../../etc/passwd", "etc/passwd"},
+		{"/.git/config", ""},
+		{"/.htaccess", ""},
+	} {
+		name, err := maskMirrorFilename(test.Path)
+		if test.Name == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", test.Path, name)
+			}
+			continue
+		}
+		if err != nil || name != test.Name {
+			t.Errorf("%q: expected %q, got %q, %v", test.Path, test.Name, name, err)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	links := extractLinks([]byte(`<html><head><link rel="stylesheet" href="style.css"><script src="/app.js"></script></head>
+<body><a href="https://example.com/">x</a><img src="img/a.png" alt="a"/><p class="x">text</p></body></html>`))
+	expected := []string{"style.css", "/app.js", "https://example.com/", "img/a.png"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected %q, got %q", expected, links)
+	}
+}
+
+// Make a test site, and return it with a count of requests by path.
+func makeMirrorSite(t *testing.T) (*httptest.Server, map[string]int) {
+	requests := make(map[string]int)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Last-Modified", "Mon, 03 Feb 2020 11:42:00 GMT")
+			fmt.Fprint(w, `<html><link href="/style.css" rel="stylesheet">
+<a href="about/">About</a> <a href="about/#team">Team</a>
+<a href="/search?q=x">Search</a> <a href="https://elsewhere.example/">Elsewhere</a>
+<a href="/missing">Missing</a> <a href="/.env">Dot</a></html>`)
+		case "/about/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><a href="../">Home</a></html>`)
+		case "/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			fmt.Fprint(w, `body { color: black; }`)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+	return httptest.NewServer(mux), requests
+}
+
+func TestMaskMirrorFetch(t *testing.T) {
+	site, requests := makeMirrorSite(t)
+	defer site.Close()
+	dir, err := ioutil.TempDir("", "meek-mask-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := newMaskMirror(site.URL, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FileSystem() != nil {
+		t.Fatalf("file system before the first fetch")
+	}
+	n, err := m.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("fetched %d files, expected 3", n)
+	}
+	expected := map[string]int{"/": 1, "/about/": 1, "/style.css": 1, "/missing": 1}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+
+	fsys := m.FileSystem()
+	for _, test := range []struct {
+		Path string
+		Body string
+	}{
+		{"/", "<html><link"},
+		{"/about/", `<html><a href="../">`},
+		{"/style.css", "body {"},
+	} {
+		rec := httptest.NewRecorder()
+		serveMaskFS(rec, httptest.NewRequest("GET", test.Path, nil), fsys)
+		if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), test.Body) {
+			t.Errorf("%s: status %d, body %q", test.Path, rec.Code, rec.Body.String())
+		}
+	}
+	rec := httptest.NewRecorder()
+	serveMaskFS(rec, httptest.NewRequest("GET", "/", nil), fsys)
+	if lm := rec.Header().Get("Last-Modified"); lm != "Mon, 03 Feb 2020 11:42:00 GMT" {
+		t.Errorf("Last-Modified %q", lm)
+	}
+
+	// A new maskMirror on the same directory serves the saved copy.
+	m2, err := newMaskMirror(site.URL, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.FileSystem() == nil {
+		t.Errorf("saved copy not used")
+	}
+
+	// A failed fetch keeps the old copy.
+	site.Close()
+	if _, err := m.Fetch(context.Background()); err == nil {
+		t.Fatalf("no error fetching from a closed server")
+	}
+	rec = httptest.NewRecorder()
+	serveMaskFS(rec, httptest.NewRequest("GET", "/style.css", nil), m.FileSystem())
+	if rec.Code != http.StatusOK {
+		t.Errorf("old copy not kept: status %d", rec.Code)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected 1 copy in %s, found %d", dir, len(entries))
+	}
+}
+
+// Only the newest copy in the directory is kept.
+func TestNewMaskMirrorCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-mask-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t1 := time.Date(2020, 2, 3, 11, 42, 0, 0, time.UTC)
+	for _, name := range []string{
+		t1.Format(maskMirrorCopyLayout),
+		t1.Add(time.Hour).Format(maskMirrorCopyLayout),
+		".fetch-123",
+	} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := newMaskMirror("https://example.com", dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.current != t1.Add(time.Hour).Format(maskMirrorCopyLayout) {
+		t.Errorf("current copy %q", m.current)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected 1 entry, found %d", len(entries))
+	}
+}
+
+func TestParseMaskMirrorURL(t *testing.T) {
+	for _, s := range []string{"example.com", "ftp://example.com/", "https://", "https://example.com/%zz"} {
+		if _, err := parseMaskMirrorURL(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+	u, err := parseMaskMirrorURL("https://example.com#top")
+	if err != nil || u.String() != "https://example.com/" {
+		t.Errorf("got %v, %v", u, err)
+	}
+}
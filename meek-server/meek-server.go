@@ -25,29 +25,39 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"hash/maphash"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"../lib/bindaddr"
+	"../lib/faultreport"
 	"../lib/go-socks5"
 	"../lib/goptlib"
+	"../lib/keylog"
+	"../lib/logging"
+	"../lib/parent"
 	"golang.org/x/crypto/acme/autocert"
-	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -59,7 +69,8 @@ const (
 	// likely to collide.
 	minSessionIDLength = 8
 	// The largest request body we are willing to process, and the largest
-	// chunk of data we'll send back in a response.
+	// chunk of data we'll send back in a response, unless the client
+	// negotiates another size; see payloadsize.go.
 	maxPayloadLength = 0x10000
 	// How long we try to read something back from the OR port before
 	// returning the response.
@@ -67,6 +78,11 @@ const (
 	// Passed as ReadTimeout and WriteTimeout when constructing the
 	// http.Server.
 	readWriteTimeout = 20 * time.Second
+	// The furthest ahead of the next expected sequence number that a
+	// pipelined request may be.
+	maxPipelineDepth = 64
+	// The number of independently locked shards in the session map.
+	numSessionShards = 64
 	// Cull unused session ids (with their corresponding OR port connection)
 	// if we haven't seen any activity for this long.
 	maxSessionStaleness = 120 * time.Second
@@ -75,8 +91,117 @@ const (
 	listenAndServeErrorTimeout = 100 * time.Millisecond
 )
 
+// TLS key exchange groups. X25519MLKEM768 is a hybrid of X25519 and the
+// post-quantum ML-KEM, and is what current browsers offer first; the others
+// are for older clients.
+var serverCurvePreferences = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+
 var ptInfo pt.ServerInfo
 
+// Store for command line options.
+var options struct {
+	// A file served as the decoy page for "/".
+	MaskDoc string
+	// A directory tree served as decoy content. Overrides MaskDoc.
+	MaskDir string
+	// The name of a built-in decoy site; see mask.go. Overrides MaskDoc;
+	// MaskDir overrides it.
+	MaskTemplate string
+	// The URL of a site to serve a copy of as decoy content, and how often
+	// to fetch it again; see maskmirror.go. Overrides MaskDoc and
+	// MaskTemplate; MaskDir overrides it.
+	MaskMirror  string
+	MaskRefresh time.Duration
+	// A location to redirect non-transport requests to. Overrides MaskDoc
+	// and MaskDir.
+	MaskRedirect string
+	// Headers to add to decoy responses; see maskheaders.go.
+	MaskHeaders maskHeaders
+	// The profile of responses for commonly probed paths, or "" for none;
+	// see wellknown.go.
+	MaskWellKnown string
+	// Whether to send poll hints, and the rate of transport requests to
+	// aim for with them; see pollhint.go.
+	PollHints    bool
+	PollHintRate float64
+	// The largest payload to use with clients that negotiate the size.
+	PayloadSize int
+	// Whether to accept multiplexed sessions; see muxbackend.go.
+	Mux bool
+	// Methods accepted for transport requests; see methods.go.
+	TransportMethods transportMethods
+	// Paths accepted for transport requests; see paths.go.
+	TransportPaths *transportPaths
+	// The method names served besides ptMethodName, with their own
+	// settings; see transports.go.
+	Transports []serverTransport
+	// The kind of CDN edge or cache whose response headers to imitate, or
+	// "" for none, and its point of presence; see cdnheaders.go.
+	CDNHeaders string
+	CDNPop     string
+	// Origins allowed to make cross-origin transport requests. nil means
+	// CORS is disabled.
+	CORS *corsPolicy
+	// Limits on what a single client can tie up; see limits.go. Zero
+	// values mean the net/http defaults or no limit.
+	ReadHeaderTimeout  time.Duration
+	MaxHeaderBytes     int
+	MaxRequestsPerConn int
+	MaxConnsPerIP      int
+	AcceptBackoffMin   time.Duration
+	AcceptBackoffMax   time.Duration
+	// HTTP/2 limits; see h2limits.go. Zero values mean the http2 package
+	// defaults or no limit.
+	MaxStreamsPerConn     int
+	MaxStreamsPerIP       int
+	MaxStreamResets       int
+	MaxContinuationFrames int
+	// Server-wide cap on requests being handled at once, and the queue of
+	// requests waiting for one to finish; see limitInFlight.
+	MaxInFlight       int
+	InFlightQueue     int
+	InFlightQueueWait time.Duration
+	// Reject requests that don't have exactly the expected shape; see
+	// strict.go.
+	Strict bool
+	// How often to log a heartbeat with usage counts; 0 disables it.
+	HeartbeatInterval time.Duration
+	// Listen with SO_REUSEPORT, and how long to wait for sessions to end
+	// when draining; see upgrade.go.
+	ReusePort    bool
+	DrainTimeout time.Duration
+	// A unix socket to listen on instead of TCP, and its permissions; see
+	// unixlisten.go.
+	ListenUnix     string
+	ListenUnixMode os.FileMode
+	// Whether and how sessions are bound to client addresses; see
+	// sessionbind.go.
+	SessionIPBinding string
+	// Whether to issue session tokens; see sessiontoken.go.
+	SessionTokens bool
+	// How to answer invalid transport requests; see probe.go.
+	ProbeResponse string
+	// Content for cover paths, by path; see cover.go.
+	CoverAssets map[string]*coverAsset
+	// Close sessions this long after they were created, however active
+	// they are; 0 means no limit.
+	MaxSessionAge time.Duration
+	// How many recent events to keep for each session; see sessiontrace.go.
+	SessionTraceEvents int
+	// The shared secret that enables the diagnostic echo endpoint, or ""
+	// to disable it; see echo.go.
+	EchoSecret string
+	// Whether to send request correlation ids on admin API responses; see
+	// requestid.go.
+	RequestIDHeader bool
+	// The directory to spill data for slow backends into, or "" not to
+	// spill, the most to spill per session, and the most to spill in all
+	// (0 for no limit); see spill.go.
+	SpillDir      string
+	SpillMax      int64
+	SpillTotalMax int64
+}
+
 func httpBadRequest(w http.ResponseWriter) {
 	http.Error(w, "Bad request.", http.StatusBadRequest)
 }
@@ -89,73 +214,273 @@ func httpInternalServerError(w http.ResponseWriter) {
 // between received requests. The first time we see a new session id, we create
 // a new OR port connection.
 type Session struct {
-	Or       *net.TCPConn
+	Or       net.Conn
+	Created  time.Time
 	LastSeen time.Time
+	// The client address that created the session, for
+	// --session-ip-binding.
+	ClientIP string
+	// The session token, for --session-tokens.
+	token sessionToken
+	// The QoS class, or nil for none; see qos.go.
+	QoS *qosClass
+	// The client's country, for statistics; "" if GeoIP is not enabled.
+	Country string
+	// Bytes carried from the client to the OR port, and back.
+	BytesUp   atomic.Int64
+	BytesDown atomic.Int64
+	// When the session last carried data, in Unix nanoseconds, for poll
+	// hints.
+	lastData atomic.Int64
+	// Recent events, for the admin API; see sessiontrace.go.
+	trace *sessionTrace
+	// The size of the last response payload, for the reservations of the
+	// fair scheduler; see fair.go.
+	fairLast atomic.Int64
+	// A one-slot semaphore that serializes transactions on Or. Goroutines
+	// blocked sending on a channel are woken in FIFO order, so requests
+	// for the session are processed in the order they arrive.
+	turn chan struct{}
+
+	// For pipelined requests (those with an X-Seq header), the sequence
+	// number of the next request to process, whether a request with that
+	// number is already being processed, and a channel that is closed
+	// whenever nextSeq advances.
+	seqLock     sync.Mutex
+	nextSeq     uint64
+	seqClaimed  bool
+	seqAdvanced chan struct{}
+}
+
+func NewSession(or net.Conn) *Session {
+	return newSessionAt(or, time.Now())
+}
+
+// Make a session created at now.
+func newSessionAt(or net.Conn, now time.Time) *Session {
+	session := &Session{
+		Or:          or,
+		Created:     now,
+		trace:       newSessionTrace(options.SessionTraceEvents),
+		turn:        make(chan struct{}, 1),
+		seqAdvanced: make(chan struct{}),
+	}
+	session.lastData.Store(session.Created.UnixNano())
+	return session
+}
+
+// Wait for this request's turn to use the session, or until ctx is done. Must
+// be followed by a call to Unlock if successful.
+func (session *Session) Lock(ctx context.Context) error {
+	select {
+	case session.turn <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Let the next waiting request use the session.
+func (session *Session) Unlock() {
+	<-session.turn
+}
+
+// Wait until it is the turn of the request with sequence number seq, then
+// Lock the session. Fails if seq has already been processed, is too far ahead,
+// if the requests before it don't arrive within timeout, or if ctx is done.
+// Must be followed by a call to UnlockSeq if successful.
+func (session *Session) LockSeq(ctx context.Context, seq uint64, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		session.seqLock.Lock()
+		next, claimed, advanced := session.nextSeq, session.seqClaimed, session.seqAdvanced
+		if seq == next && !claimed {
+			session.seqClaimed = true
+		}
+		session.seqLock.Unlock()
+
+		if seq < next || (seq == next && claimed) {
+			return fmt.Errorf("duplicate sequence number %d", seq)
+		}
+		if seq-next > maxPipelineDepth {
+			return fmt.Errorf("sequence number %d too far ahead of %d", seq, next)
+		}
+		if seq == next {
+			break
+		}
+		select {
+		case <-advanced:
+		case <-deadline.C:
+			return fmt.Errorf("timed out waiting for sequence number %d", next)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := session.Lock(ctx)
+	if err != nil {
+		session.seqLock.Lock()
+		session.seqClaimed = false
+		session.seqLock.Unlock()
+	}
+	return err
+}
+
+// Advance to the next sequence number and Unlock the session.
+func (session *Session) UnlockSeq() {
+	session.seqLock.Lock()
+	session.nextSeq++
+	session.seqClaimed = false
+	close(session.seqAdvanced)
+	session.seqAdvanced = make(chan struct{})
+	session.seqLock.Unlock()
+	session.Unlock()
+}
+
+// Mark a session as having been seen at now.
+func (session *Session) Touch(now time.Time) {
+	session.LastSeen = now
+}
+
+// Is this session old enough at now to be culled?
+func (session *Session) IsExpired(now time.Time) bool {
+	return now.Sub(session.LastSeen) > maxSessionStaleness
 }
 
-// Mark a session as having been seen just now.
-func (session *Session) Touch() {
-	session.LastSeen = time.Now()
+// Has this session outlived options.MaxSessionAge at now?
+func (session *Session) IsTooOld(now time.Time) bool {
+	return options.MaxSessionAge > 0 && now.Sub(session.Created) > options.MaxSessionAge
 }
 
-// Is this session old enough to be culled?
-func (session *Session) IsExpired() bool {
-	return time.Since(session.LastSeen) > maxSessionStaleness
+// One shard of the session map. Each shard has its own lock, so requests for
+// sessions in different shards don't contend with each other.
+type sessionShard struct {
+	sessions SessionStore
+	lock     sync.Mutex
 }
 
 // There is one state per HTTP listener. In the usual case there is just one
 // listener, so there is just one global state. State also serves as the http
 // Handler.
 type State struct {
-	sessionMap map[string]*Session
-	lock       sync.Mutex
+	shards [numSessionShards]sessionShard
+	// Random seed for the hash that assigns session ids to shards, so
+	// that clients can't aim all their sessions at one shard.
+	seed maphash.Seed
+	// Estimated number of distinct client IP addresses; see stats.go.
+	clients *uniqueCounter
+	// Number of WebSocket sessions, which are not in the session map.
+	webSockets atomic.Int64
+	// Number of requests for cover paths since the last heartbeat.
+	coverRequests atomic.Int64
+	// Dials the backend of new sessions.
+	backend BackendDialer
+	// Tells the time of session events.
+	clock Clock
 }
 
 func NewState() *State {
+	return NewStateWith(StateConfig{})
+}
+
+// Make a State with the dependencies in config; see deps.go.
+func NewStateWith(config StateConfig) *State {
+	if config.Backend == nil {
+		config.Backend = defaultBackendDialer
+	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	if config.NewSessionStore == nil {
+		config.NewSessionStore = newMapSessionStore
+	}
 	state := new(State)
-	state.sessionMap = make(map[string]*Session)
+	for i := range state.shards {
+		state.shards[i].sessions = config.NewSessionStore()
+	}
+	state.seed = maphash.MakeSeed()
+	state.clients = newUniqueCounter()
+	state.backend = config.Backend
+	state.clock = config.Clock
 	return state
 }
 
+// Return the shard responsible for a session id.
+func (state *State) shard(sessionID string) *sessionShard {
+	return &state.shards[maphash.String(state.seed, sessionID)%numSessionShards]
+}
+
 func (state *State) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logging.Debugf("[%s] %s %s %q from %s", requestID(req), req.Proto, req.Method, req.URL.Path, scrubAddr(req.RemoteAddr))
+	// Cover paths are answered the same way whatever the request looks
+	// like, so they are exempt from strict mode.
+	if asset := coverAssetFor(req); asset != nil {
+		state.ServeCover(w, req, asset)
+		return
+	}
+	if options.Strict {
+		err := validateStrict(req)
+		if err != nil {
+			logging.Debugf("strict mode rejected request: %s", err)
+			serveProbeResponse(w, req)
+			return
+		}
+	}
+	if !originVerify.Verified(req) {
+		logging.Debugf("[%s] request did not come through the CDN", requestID(req))
+		if req.Method == "GET" || req.Method == "HEAD" {
+			state.Get(w, req)
+		} else {
+			serveProbeResponse(w, req)
+		}
+		return
+	}
 	switch req.Method {
-	case "GET":
+	case "GET", "HEAD":
+		if isWebSocketRequest(req) {
+			state.ServeWebSocket(w, req)
+			return
+		}
 		state.Get(w, req)
-	case "POST":
-		state.Post(w, req)
+	case "OPTIONS":
+		if !options.CORS.Preflight(w, req) {
+			serveProbeResponse(w, req)
+		}
 	default:
-		httpBadRequest(w)
+		if echoEnabled() && isEchoRequest(req) && options.TransportPaths.AllowedParent(req.URL.Path) {
+			state.Echo(w, req)
+		} else if options.TransportMethods.Allowed(req.Method) && options.TransportPaths.Allowed(req.URL.Path) {
+			state.Post(w, req)
+		} else {
+			serveProbeResponse(w, req)
+		}
 	}
 }
 
-// Handle a GET request. This doesn't have any purpose apart from diagnostics.
+// Handle a GET or HEAD request. This doesn't have any purpose apart from
+// diagnostics and serving decoy content.
 func (state *State) Get(w http.ResponseWriter, req *http.Request) {
-	if path.Clean(req.URL.Path) != "/" {
-		http.NotFound(w, req)
+	options.MaskHeaders.Set(w, req)
+	if options.MaskWellKnown != "" && serveWellKnown(w, req, options.MaskWellKnown, maskFileSystem()) {
 		return
 	}
-	maskRedirect := os.Getenv("MASK_REDIRECT")
-	if maskRedirect != "" {
+	if options.MaskRedirect != "" {
+		if path.Clean(req.URL.Path) != "/" {
+			http.NotFound(w, req)
+			return
+		}
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Header().Set("Location", maskRedirect)
+		w.Header().Set("Location", options.MaskRedirect)
 		w.WriteHeader(http.StatusMovedPermanently)
 		w.Write([]byte("Moved permanently.\n"))
+	} else if fsys := maskFileSystem(); fsys != nil {
+		serveMaskFS(w, req, fsys)
 	} else {
-		doc := os.Getenv("MASK_DOC")
+		doc := options.MaskDoc
 		if doc == "" {
-			doc = "index.html"
-		}
-		file, err := ioutil.ReadFile(doc)
-		if err != nil {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			//w.Write([]byte("I’m just a happy little web server.\n"))
-			w.Write([]byte("I’m just a happy little web server.\n"))
-		} else {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			w.Write(file)
+			doc = maskIndexName
 		}
+		serveMaskDoc(w, req, doc)
 	}
 }
 
@@ -171,56 +496,153 @@ func getUseraddr(req *http.Request) string {
 	return net.JoinHostPort(ip.String(), "1")
 }
 
+// Check whether a client at ip (nil if unknown) may start a new session, under
+// the client ACL, the load watchdog, the bandwidth budget, and the new session
+// rate limit.
+func admitNewSession(ip net.IP) error {
+	if !clientACL.Allowed(ip) {
+		return errClientDenied
+	}
+	if loadWatchdog.Overloaded() {
+		return errOverloaded
+	}
+	if bandwidthAcct.Exhausted() {
+		return errBandwidthBudget
+	}
+	if !newSessionLimiter.Allow(ip) {
+		return errSessionRate
+	}
+	return nil
+}
+
 // Look up a session by id, or create a new one (with its OR port connection) if
-// it doesn't already exist.
+// it doesn't already exist. The OR port connection is dialed without holding
+// the shard's lock, so that a slow dial doesn't hold up the shard's other
+// sessions.
 func (state *State) GetSession(sessionID string, req *http.Request) (*Session, error) {
-	state.lock.Lock()
-	defer state.lock.Unlock()
+	shard := state.shard(sessionID)
+	now := state.clock.Now()
+	shard.lock.Lock()
+	session := shard.sessions.Load(sessionID)
+	if session != nil {
+		defer shard.lock.Unlock()
+		if err := state.touchSession(session, req, now); err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+	logging.Debugf("unknown session id %s; creating new session", scrubSessionID(sessionID))
+	if closedSessions.Seen(sessionID, now) {
+		shard.lock.Unlock()
+		return nil, errSessionReplayed
+	}
+	ip, _ := originalClientIP(req)
+	err := admitNewSession(ip)
+	shard.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	session := state.sessionMap[sessionID]
-	if session == nil {
-		// log.Printf("unknown session id %q; creating new session", sessionID)
+	or, err := state.dialSession(req, ip)
+	if err != nil {
+		return nil, err
+	}
 
-		or, err := pt.DialOr(&ptInfo, getUseraddr(req), ptMethodName)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	// Another request may have created the session, or closed it, while
+	// we were dialing.
+	if existing := shard.sessions.Load(sessionID); existing != nil {
+		or.Close()
+		if err := state.touchSession(existing, req, now); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+	if closedSessions.Seen(sessionID, now) {
+		or.Close()
+		return nil, errSessionReplayed
+	}
+	session = newSessionAt(or, now)
+	session.ClientIP = bindingIP(req)
+	session.QoS = qosTable.Class(req.Header.Get(credentialHeader), sessionID)
+	session.Country = usageByCountry.Open(ip)
+	if options.SessionTokens {
+		session.token.token, err = newSessionToken()
 		if err != nil {
+			or.Close()
 			return nil, err
 		}
-		session = &Session{Or: or}
-		state.sessionMap[sessionID] = session
 	}
-	session.Touch()
-
+	// A new session's first request carries no token, but still has to
+	// be marked as the one that gets it.
+	if err := session.token.checkToken(req, false); err != nil {
+		or.Close()
+		return nil, err
+	}
+	shard.sessions.Store(sessionID, session)
+	auditLog.Open(sessionID, session)
+	session.trace.Add(traceEvent{Time: session.Created, Event: traceEventCreate})
+	session.Touch(now)
 	return session, nil
 }
 
-// scrubbedAddr is a phony net.Addr that returns "[scrubbed]" for all calls.
-type scrubbedAddr struct{}
-
-func (a scrubbedAddr) Network() string { return "[scrubbed]" }
-func (a scrubbedAddr) String() string  { return "[scrubbed]" }
+// Check that req may use the existing session (its client binding and its
+// token), and only then mark the session as used at now, so that a rejected
+// request doesn't keep the session alive. Call with the shard's lock held.
+func (state *State) touchSession(session *Session, req *http.Request, now time.Time) error {
+	if err := checkSessionBinding(session, req); err != nil {
+		return err
+	}
+	if err := session.token.checkToken(req, false); err != nil {
+		session.trace.Add(traceEvent{Time: now, Event: traceEventRejected, RequestID: requestID(req), Error: err.Error()})
+		return err
+	}
+	session.Touch(now)
+	return nil
+}
 
-// Replace the Addr in a net.OpError with "[scrubbed]" for logging.
-func scrubError(err error) error {
-	if err, ok := err.(*net.OpError); ok {
-		// net.OpError contains Op, Net, Addr, and a subsidiary Err. The
-		// (Op, Net, Addr) part is responsible for error text prefixes
-		// like "read tcp X.X.X.X:YYYY:". We want that information but
-		// don't want to log the literal address.
-		err.Addr = scrubbedAddr{}
+// Dial the OR port connection for a new session for req, from the client
+// address ip.
+func (state *State) dialSession(req *http.Request, ip net.IP) (net.Conn, error) {
+	if isMuxRequest(req) {
+		if !options.Mux {
+			return nil, errMuxDisabled
+		}
+		return newMuxBackend(state.backend, ip, getUseraddr(req), methodName(req)), nil
 	}
-	return err
+	return state.backend.DialBackend(getUseraddr(req), methodName(req))
 }
 
 // Feed the body of req into the OR port, and write any data read from the OR
-// port back to w.
+// port back to w. If the request's context is canceled (i.e., the client or CDN
+// aborts the request), any OR port read or write in progress is interrupted,
+// and transact returns an error. The session is not usable after that, as
+// some of the body may or may not have been written to the OR port.
 func transact(session *Session, w http.ResponseWriter, req *http.Request) error {
-	body := http.MaxBytesReader(w, req.Body, maxPayloadLength+1)
-	_, err := io.Copy(session.Or, body)
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() {
+		// Unblock any Read or Write in progress.
+		session.Or.SetDeadline(time.Now())
+	})
+	err := transactInner(session, w, req)
+	if !stop() {
+		return fmt.Errorf("request canceled: %s", ctx.Err())
+	}
+	return err
+}
+
+func transactInner(session *Session, w http.ResponseWriter, req *http.Request) error {
+	size, advertise := negotiatePayloadSize(req, options.PayloadSize)
+	body := http.MaxBytesReader(w, req.Body, requestBodyLimit(size)+1)
+	nr, err := io.Copy(session.Or, body)
+	session.BytesUp.Add(nr)
+	bandwidthAcct.Add(nr)
 	if err != nil {
 		return fmt.Errorf("error copying body to ORPort: %s", scrubError(err))
 	}
 
-	buf := make([]byte, maxPayloadLength)
+	buf := make([]byte, size)
 	session.Or.SetReadDeadline(time.Now().Add(turnaroundTimeout))
 	n, err := session.Or.Read(buf)
 	if err != nil {
@@ -230,70 +652,205 @@ func transact(session *Session, w http.ResponseWriter, req *http.Request) error
 			return fmt.Errorf("reading from ORPort: %s", err)
 		}
 	}
-	// log.Printf("read %d bytes from ORPort: %q", n, buf[:n])
+	logging.Debugf("read %d bytes from ORPort", n)
+	reservation, _ := req.Context().Value(fairReservationContextKey{}).(*fairReservation)
+	reservation.Settle(n)
 	// Set a Content-Type to prevent Go and the CDN from trying to guess.
 	w.Header().Set("Content-Type", "application/octet-stream")
+	now := time.Now()
+	idle := now.Sub(time.Unix(0, session.lastData.Load()))
+	if nr > 0 || n > 0 {
+		session.lastData.Store(now.UnixNano())
+	}
+	transportRequestRate.Add()
+	if options.PollHints {
+		hint := pollHint(nr > 0 || n > 0, idle, transportRequestRate.Rate(), options.PollHintRate)
+		w.Header().Set(pollHintHeader, strconv.FormatInt(hint.Milliseconds(), 10))
+	}
+	if n == len(buf) {
+		w.Header().Set(moreDataHeader, "1")
+	}
+	if advertise {
+		w.Header().Set(payloadSizeHeader, strconv.Itoa(size))
+	}
 	n, err = w.Write(buf[:n])
+	session.BytesDown.Add(int64(n))
+	bandwidthAcct.Add(int64(n))
 	if err != nil {
 		return fmt.Errorf("error writing to response: %s", scrubError(err))
 	}
-	// log.Printf("wrote %d bytes to response", n)
+	logging.Debugf("wrote %d bytes to response", n)
 	return nil
 }
 
+// Get the value of the X-Seq header used by pipelining clients. hasSeq is false
+// if there is no such header.
+func getSeq(req *http.Request) (seq uint64, hasSeq bool, err error) {
+	return parseSeq(req.Header["X-Seq"])
+}
+
+// Parse the values of X-Seq headers, for getSeq.
+func parseSeq(values []string) (seq uint64, hasSeq bool, err error) {
+	if len(values) == 0 {
+		return 0, false, nil
+	}
+	if len(values) > 1 {
+		return 0, false, fmt.Errorf("multiple X-Seq headers")
+	}
+	seq, err = strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return seq, true, nil
+}
+
 // Handle a POST request. Look up the session id and then do a transaction.
 func (state *State) Post(w http.ResponseWriter, req *http.Request) {
 	sessionID := req.Header.Get("X-Session-Id")
-	if len(sessionID) < minSessionIDLength {
-		httpBadRequest(w)
+	if err := checkSessionID(sessionID); err == errNoSessionID {
+		serveProbeResponse(w, req)
 		return
+	} else if err != nil {
+		logging.Debugf("[%s] rejecting session id: %s", requestID(req), err)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+	seq, hasSeq, err := getSeq(req)
+	if err != nil {
+		serveProbeResponse(w, req)
+		return
+	}
+
+	options.CORS.SetHeaders(w, req)
+
+	if ip, err := originalClientIP(req); err == nil {
+		state.clients.Add(ip)
+		bridgeStatsLog.Add(ip, methodName(req))
 	}
 
+	sessionID = state.sessionKey(sessionID, req)
+	if isCloseRequest(req) {
+		state.PostClose(w, req, sessionID)
+		return
+	}
 	session, err := state.GetSession(sessionID, req)
-	if err != nil {
-		log.Print(err)
+	switch err {
+	case nil:
+	case errClientDenied, errOverloaded, errBandwidthBudget, errSessionRate, errSessionIPMismatch, errMuxDisabled, errSessionReplayed, errSessionToken:
+		logging.Debugf("[%s] %s", requestID(req), err)
+		serveMaskMethodNotAllowed(w)
+		return
+	case errBackendUnavailable:
+		// Already logged when the circuit opened.
+		logging.Debugf("[%s] %s", requestID(req), err)
 		httpInternalServerError(w)
 		return
+	default:
+		logging.Warnf("[%s] %s", requestID(req), err)
+		httpInternalServerError(w)
+		return
+	}
+	arrived := time.Now()
+	session.token.setHeader(w)
+
+	// Wait for a share of downstream bandwidth before taking the session's
+	// turn, not while holding the turn and data read from the OR port.
+	reserved, err := fairSched.Reserve(req.Context(), session)
+	if err != nil {
+		// The client gave up while waiting.
+		return
 	}
+	reservation := &fairReservation{sched: fairSched, session: session, reserved: reserved}
+	// Give the reservation back if no payload is read from the OR port,
+	// however the request ends.
+	defer reservation.Settle(0)
+	req = req.WithContext(context.WithValue(req.Context(), fairReservationContextKey{}, reservation))
 
-	err = transact(session, w, req)
+	// Concurrent requests for the same session would interleave their
+	// reads and writes on the OR connection and corrupt the stream.
+	if hasSeq {
+		err = session.LockSeq(req.Context(), seq, readWriteTimeout)
+		if err != nil {
+			logging.Warnf("[%s] %s", requestID(req), err)
+			session.trace.Add(traceEvent{Time: arrived, Event: traceEventRejected, RequestID: requestID(req), Error: err.Error()})
+			httpBadRequest(w)
+			state.CloseSession(sessionID, closeReasonError)
+			return
+		}
+		// Deferred, so that the session is not left locked if the
+		// transaction panics (see crash.go).
+		defer session.UnlockSeq()
+	} else {
+		err = session.Lock(req.Context())
+		if err != nil {
+			// The client gave up while waiting its turn.
+			return
+		}
+		defer session.Unlock()
+	}
+	err = session.tracedTransact(w, req, arrived)
 	if err != nil {
-		log.Print(err)
-		state.CloseSession(sessionID)
+		logging.Warnf("[%s] %s", requestID(req), err)
+		state.CloseSession(sessionID, closeReasonError)
 		return
 	}
 }
 
 // Remove a session from the map and closes its corresponding OR port
-// connection. Does nothing if the session id is not known.
-func (state *State) CloseSession(sessionID string) {
-	state.lock.Lock()
-	defer state.lock.Unlock()
-	// log.Printf("closing session %q", sessionID)
-	session, ok := state.sessionMap[sessionID]
-	if ok {
+// connection. Does nothing if the session id is not known. reason is recorded
+// in the audit log. Returns whether the session existed.
+func (state *State) CloseSession(sessionID string, reason string) bool {
+	shard := state.shard(sessionID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	logging.Debugf("closing session %s", scrubSessionID(sessionID))
+	session := shard.sessions.Load(sessionID)
+	if session != nil {
 		session.Or.Close()
-		delete(state.sessionMap, sessionID)
+		shard.sessions.Delete(sessionID)
+		closedSessions.Add(sessionID, state.clock.Now())
+		auditLog.Close(sessionID, session, reason)
+		usageByCountry.Close(session)
 	}
+	return session != nil
 }
 
 // Loop forever, checking for expired sessions and removing them.
 func (state *State) ExpireSessions() {
 	for {
 		time.Sleep(maxSessionStaleness / 2)
-		state.lock.Lock()
-		for sessionID, session := range state.sessionMap {
-			if session.IsExpired() {
-				// log.Printf("deleting expired session %q", sessionID)
-				session.Or.Close()
-				delete(state.sessionMap, sessionID)
+		state.expireSessions()
+	}
+}
+
+// Remove the sessions that are expired or too old now.
+func (state *State) expireSessions() {
+	now := state.clock.Now()
+	for i := range state.shards {
+		shard := &state.shards[i]
+		shard.lock.Lock()
+		shard.sessions.Range(func(sessionID string, session *Session) bool {
+			var reason string
+			if session.IsExpired(now) {
+				reason = closeReasonExpired
+			} else if session.IsTooOld(now) {
+				reason = closeReasonMaxAge
+			} else {
+				return true
 			}
-		}
-		state.lock.Unlock()
+			logging.Debugf("deleting session %s: %s", scrubSessionID(sessionID), reason)
+			session.Or.Close()
+			shard.sessions.Delete(sessionID)
+			closedSessions.Add(sessionID, now)
+			auditLog.Close(sessionID, session, reason)
+			usageByCountry.Close(session)
+			return true
+		})
+		shard.lock.Unlock()
 	}
 }
 
-func initServer(addr *net.TCPAddr,
+func initServer(addr *net.TCPAddr, handler http.Handler,
 	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
 	listenAndServe func(*http.Server, chan<- error)) (*http.Server, error) {
 	// We're not capable of listening on port 0 (i.e., an ephemeral port
@@ -302,18 +859,19 @@ func initServer(addr *net.TCPAddr,
 	// return, so there's no opportunity to find out what the port number
 	// is, in between the Listen and Serve steps.
 	// https://groups.google.com/d/msg/Golang-nuts/3F1VRCCENp8/3hcayZiwYM8J
-	if addr.Port == 0 {
+	if addr.Port == 0 && options.ListenUnix == "" {
 		return nil, fmt.Errorf("cannot listen on port %d; configure a port using ServerTransportListenAddr", addr.Port)
 	}
 
-	state := NewState()
-	go state.ExpireSessions()
-
 	server := &http.Server{
-		Addr:         addr.String(),
-		Handler:      state,
-		ReadTimeout:  readWriteTimeout,
-		WriteTimeout: readWriteTimeout,
+		Addr:              addr.String(),
+		Handler:           handler,
+		ReadTimeout:       readWriteTimeout,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		WriteTimeout:      readWriteTimeout,
+		MaxHeaderBytes:    options.MaxHeaderBytes,
+		ConnContext:       connRequestCountContext,
+		ErrorLog:          newServerErrorLog(),
 	}
 	// We need to override server.TLSConfig.GetCertificate--but first
 	// server.TLSConfig needs to be non-nil. If we just create our own new
@@ -323,11 +881,23 @@ func initServer(addr *net.TCPAddr,
 	// server.TLSConfig properly. An alternative would be to make a dummy
 	// net.Listener, call Serve on it, and let it return.
 	// https://github.com/golang/go/issues/16588#issuecomment-237386446
-	err := http2.ConfigureServer(server, nil)
+	err := configureH2Guard(server, newH2Server())
 	if err != nil {
 		return server, err
 	}
 	server.TLSConfig.GetCertificate = getCertificate
+	server.TLSConfig.CurvePreferences = serverCurvePreferences
+	if clientCAs := originVerify.ClientCAs(); clientCAs != nil {
+		server.TLSConfig.ClientCAs = clientCAs
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if echKeys != nil {
+		server.TLSConfig.GetEncryptedClientHelloKeys = echKeys.GetKeys
+	}
+	server.TLSConfig.KeyLogWriter = keyLogWriter
+	if strictSNI != nil {
+		server.TLSConfig.GetConfigForClient = strictSNI.GetConfigForClient
+	}
 
 	// Another unfortunate effect of the inseparable net/http ListenAndServe
 	// is that we can't check for Listen errors like "permission denied" and
@@ -348,10 +918,32 @@ func initServer(addr *net.TCPAddr,
 	return server, err
 }
 
-func startServer(addr *net.TCPAddr) (*http.Server, error) {
-	return initServer(addr, nil, func(server *http.Server, errChan chan<- error) {
-		log.Printf("listening with plain HTTP on %s", addr)
-		err := server.ListenAndServe()
+// Open a listener on server.Addr, or the --listen-unix socket, wrapped to
+// enforce the per-IP connection cap and Accept backoff.
+func listen(server *http.Server) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if options.ListenUnix != "" {
+		ln, err = listenUnix(options.ListenUnix, options.ListenUnixMode)
+	} else {
+		ln, err = listenTCP(server.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newLimitListener(trackListener(ln), &maxConnsPerIP, options.AcceptBackoffMin, options.AcceptBackoffMax), nil
+}
+
+func startServer(addr *net.TCPAddr, handler http.Handler) (*http.Server, error) {
+	return initServer(addr, handler, nil, func(server *http.Server, errChan chan<- error) {
+		log.Printf("listening with plain HTTP on %s", listenAddrName(addr))
+		// Accept HTTP/2 with prior knowledge (h2c) as well as HTTP/1.1,
+		// for clients behind a TLS-terminating hop.
+		server.Handler = h2c.NewHandler(server.Handler, newH2Server())
+		ln, err := listen(server)
+		if err == nil {
+			err = server.Serve(h2GuardListener{ln})
+		}
 		if err != nil {
 			log.Printf("Error in ListenAndServe: %s", err)
 		}
@@ -359,10 +951,13 @@ func startServer(addr *net.TCPAddr) (*http.Server, error) {
 	})
 }
 
-func startServerTLS(addr *net.TCPAddr, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*http.Server, error) {
-	return initServer(addr, getCertificate, func(server *http.Server, errChan chan<- error) {
-		log.Printf("listening with HTTPS on %s", addr)
-		err := server.ListenAndServeTLS("", "")
+func startServerTLS(addr *net.TCPAddr, handler http.Handler, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*http.Server, error) {
+	return initServer(addr, handler, getCertificate, func(server *http.Server, errChan chan<- error) {
+		log.Printf("listening with HTTPS on %s", listenAddrName(addr))
+		ln, err := listen(server)
+		if err == nil {
+			err = server.ServeTLS(ln, "", "")
+		}
 		if err != nil {
 			log.Printf("Error in ListenAndServeTLS: %s", err)
 		}
@@ -370,6 +965,49 @@ func startServerTLS(addr *net.TCPAddr, getCertificate func(*tls.ClientHelloInfo)
 	})
 }
 
+// Start the admin API for state on addr.
+func startAdmin(addr, tokenFile string, state *State) error {
+	if tokenFile == "" {
+		return fmt.Errorf("--admin-addr requires --admin-token-file")
+	}
+	admin, err := newAdminServer(state, tokenFile)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("admin API listening on %s", ln.Addr())
+	go func() {
+		err := http.Serve(ln, admin.Handler())
+		log.Printf("admin API stopped: %s", err)
+	}()
+	return nil
+}
+
+// Start answering DNS tunnel queries for domain, carried on state, on the UDP
+// address addr.
+func startDNSTunnel(addr, domain string, state *State) error {
+	if domain == "" {
+		return fmt.Errorf("--dns-addr requires --dns-domain")
+	}
+	tunnel, err := newDNSTunnel(state, domain)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("DNS tunnel for %s listening on %s", tunnel.domain, conn.LocalAddr())
+	go func() {
+		err := tunnel.Serve(conn)
+		log.Printf("DNS tunnel stopped: %s", err)
+	}()
+	return nil
+}
+
 func getCertificateCacheDir() (string, error) {
 	stateDir, err := pt.MakeStateDir()
 	if err != nil {
@@ -385,7 +1023,11 @@ func runProxy(port string) {
 	)
 
 	// Create SOCKS5 proxy on localhost port
-	if err := server.ListenAndServe("tcp", "127.0.0.1:"+port); err != nil {
+	ln, err := listenTCP("127.0.0.1:" + port)
+	if err != nil {
+		panic(err)
+	}
+	if err := server.Serve(trackListener(ln)); err != nil && !listenersClosed() {
 		panic(err)
 	}
 }
@@ -394,53 +1036,339 @@ func main() {
 	var acmeEmail string
 	var acmeHostnamesCommas string
 	var disableTLS bool
+	var printConfigFlag bool
+	var acmeRedirect bool
+	var version bool
 	var certFilename, keyFilename string
 	var logFilename string
 	var port int
 
 	var socksPort string
 	var externalService string
-	var maskHtmlDoc string
-	var maskRedirect string
+	var corsOrigins string
+	var logLevelName string
+	var backendProxy string
+	var outBindAddr string
+	var auditLogFilename string
+	var adminAddr, adminTokenFile string
+	var dnsAddr, dnsDomain string
+	var maxHeapMB uint64
+	var crashReportURL string
+	var coverPaths string
+	var geoIPFilename, geoIP6Filename string
+	var geoDB *geoIPDB
+	var bridgeStatsFilename string
+	var bandwidthBudget string
+	var newSessionRate, newSessionRatePerIP float64
+	var sessionReplayWindow time.Duration
+	var sessionReplayMax int
+	var fairRate string
+	var qosFile string
+	var exitWithParent bool
+	var echOpts echOptions
+	var listenUnixMode string
+	var keyLogFile string
+	var methods string
+	var strictSNIMode string
+	var paths string
+	var transportsSpec string
+	var transports []serverTransport
+	var originSecretHeader, originSecretFile, originClientCAFile string
+	var echoSecretFile string
 
 	os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
-	os.Setenv("TOR_PT_SERVER_TRANSPORTS", "meek")
 
+	flag.StringVar(&adminAddr, "admin-addr", "", "address (e.g. 127.0.0.1:9090) for the admin API, which changes configuration at runtime")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "file containing the bearer token for the admin API")
+	flag.StringVar(&auditLogFilename, "audit-log", "", "name of a file to write session audit records to")
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
 	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for automatic TLS certificate")
+	flag.BoolVar(&acmeRedirect, "acme-redirect", false, "on the port 80 ACME listener, redirect requests to HTTPS instead of serving the decoy site")
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
+	flag.StringVar(&dnsAddr, "dns-addr", "", "UDP address (e.g. :53) on which to answer DNS tunnel queries, as the name server for --dns-domain")
+	flag.StringVar(&dnsDomain, "dns-domain", "", "domain under which clients encode DNS tunnel queries")
+	flag.BoolVar(&printConfigFlag, "print-config", false, "print the effective configuration as JSON and exit")
+	flag.BoolVar(&version, "version", false, "print the version and build information and exit")
+	flag.DurationVar(&backendTCPDialer.KeepAlive, "backend-keepalive", 0, "TCP keep-alive period for backend connections (0 means the default of 15s; negative disables)")
+	flag.BoolVar(&backendTCPDialer.NoDelay, "backend-nodelay", true, "disable Nagle's algorithm on backend connections")
+	flag.IntVar(&backendTCPDialer.ReceiveBuffer, "backend-rcvbuf", 0, "receive buffer size for backend connections (0 means the system default)")
+	flag.IntVar(&backendTCPDialer.SendBuffer, "backend-sndbuf", 0, "send buffer size for backend connections (0 means the system default)")
+	flag.StringVar(&backendProxy, "backend-proxy", "", "URL of a socks5 or http proxy through which to dial the OR port or external service")
+	flag.StringVar(&bandwidthBudget, "bandwidth-budget", "", "monthly bandwidth cap, like 500G, after which new sessions are refused")
+	flag.StringVar(&fairRate, "fair-rate", "", "downstream bytes per second, like 10M, beyond which response payloads are shared fairly among sessions")
+	flag.StringVar(&bridgeStatsFilename, "bridge-stats", "", "name of a file to append daily bridge statistics to, in tor's extra-info format")
 	flag.StringVar(&certFilename, "cert", "", "TLS certificate file")
 	flag.StringVar(&keyFilename, "key", "", "TLS private key file")
+	flag.StringVar(&keyLogFile, "keylog", "", "file to append TLS session secrets to, for decrypting test captures (default $SSLKEYLOGFILE; never use in production)")
+	flag.StringVar(&geoIPFilename, "geoip", "", "tor-format IPv4 GeoIP database, for per-country statistics")
+	flag.StringVar(&geoIP6Filename, "geoip6", "", "tor-format IPv6 GeoIP database, for per-country statistics")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
-	flag.StringVar(&maskHtmlDoc, "mask", "", "mask html doc file. (served when invalid request received)")
-	flag.StringVar(&maskRedirect, "redirect", "", "mask redirect location. (overrides mask option)")
+	flag.StringVar(&logLevelName, "log-level", "info", "log verbosity: debug, info, or warn")
+	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "don't scrub client IP addresses or session ids from the log")
+	flag.DurationVar(&options.HeartbeatInterval, "heartbeat-interval", time.Hour, "how often to log session and unique client counts (0 to disable)")
+	flag.StringVar(&outBindAddr, "out-bind-addr", "", "local IP address or interface name to dial the backend from")
+	flag.StringVar(&options.MaskDoc, "mask", "", "mask html doc file. (served when invalid request received)")
+	flag.StringVar(&options.MaskDir, "mask-dir", "", "directory of static files to serve as mask content. (overrides mask, mask-mirror, and mask-template options)")
+	flag.StringVar(&options.MaskMirror, "mask-mirror", "", "URL of a web site to copy and serve as mask content. (overrides mask and mask-template options)")
+	flag.StringVar(&options.MaskHeaders.CacheControl, "mask-cache-control", "", "Cache-Control header to send with decoy responses")
+	flag.StringVar(&options.MaskHeaders.CSP, "mask-csp", "", "Content-Security-Policy header to send with decoy responses")
+	flag.DurationVar(&options.MaskHeaders.HSTS, "mask-hsts", 0, "max-age of a Strict-Transport-Security header to send with decoy responses over HTTPS (0 for none)")
+	flag.BoolVar(&options.MaskHeaders.NoSniff, "mask-nosniff", false, "send X-Content-Type-Options: nosniff with decoy responses")
+	flag.StringVar(&options.MaskWellKnown, "mask-well-known", "", "answer commonly probed paths like /robots.txt and /wp-login.php as a kind of site would: "+strings.Join(wellKnownProfileNames(), ", "))
+	flag.DurationVar(&options.MaskRefresh, "mask-refresh", 24*time.Hour, "how often to fetch the mask-mirror site again (0 for only at startup)")
+	flag.StringVar(&options.MaskTemplate, "mask-template", "", "name of a built-in decoy site to serve as mask content: "+strings.Join(maskTemplateNames(), ", ")+" (overrides mask option; mask-dir and mask-mirror override it)")
+	flag.StringVar(&options.MaskRedirect, "redirect", "", "mask redirect location. (overrides mask and mask-dir options)")
+	flag.StringVar(&qosFile, "qos-file", "", "JSON file of QoS classes and the credentials in them, for --fair-rate")
+	flag.StringVar(&options.ProbeResponse, "probe-response", probeResponseBadRequest, "how to answer invalid transport requests: bad-request, not-found, close, or redirect")
+	flag.BoolVar(&options.PollHints, "poll-hints", false, "suggest to clients how long to wait before polling again")
+	flag.Float64Var(&options.PollHintRate, "poll-hint-rate", 0, "rate of transport requests per second to aim for with poll hints (0 for none)")
+	flag.StringVar(&methods, "methods", "POST", "comma-separated HTTP methods to accept for transport requests: "+strings.Join(transportMethodNames, ", "))
+	flag.StringVar(&paths, "paths", "", "comma-separated URL paths on which to accept transport requests, each exact or ending in \"/*\" (default any path)")
+	flag.BoolVar(&options.Mux, "mux", false, "accept sessions that multiplex many client connections, each with its own backend connection")
+	flag.IntVar(&options.PayloadSize, "payload-size", maxPayloadLength, "largest request and response body to use with clients that negotiate the payload size")
+	flag.StringVar(&options.CDNHeaders, "cdn-headers", "", "add response headers like those of a CDN edge or cache: "+strings.Join(cdnProfileNames(), ", "))
+	flag.StringVar(&options.CDNPop, "cdn-pop", "", "three-letter point of presence code for cdn-headers (default random)")
+	flag.StringVar(&coverPaths, "cover-paths", "", "comma-separated paths to answer with generated static content, for client cover traffic")
+	flag.StringVar(&crashReportURL, "crash-report-url", "", "URL to POST a report to when the HTTP handler panics")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "comma-separated origins allowed to make cross-origin requests, or \"*\" for any")
+	flag.StringVar(&echoSecretFile, "echo-secret-file", "", "file containing a shared secret that enables the diagnostic echo endpoint for meek-client test")
+	flag.StringVar(&echOpts.ConfigFile, "ech-config-file", "", "file to write the current base64 ECHConfigList to, for publishing")
+	flag.StringVar(&echOpts.DNSRecordFile, "ech-dns-record-file", "", "file to write a DNS HTTPS record with the current ECH config to")
+	flag.DurationVar(&echOpts.Rotation, "ech-key-rotation", 24*time.Hour, "how often to make a new ECH key")
+	flag.StringVar(&echOpts.PublicName, "ech-public-name", "", "enable Encrypted Client Hello, with this as the public name visible to observers")
+	flag.BoolVar(&exitWithParent, "exit-with-parent", false, "exit when the parent process exits, for launchers that don't close stdin")
 	flag.StringVar(&externalService, "external-service", "", "External service needed to be obfuscated on meek service port. if missing internal socks service replaced. [1.2.3.4:4455]")
+	flag.StringVar(&originClientCAFile, "origin-client-ca", "", "PEM file of CAs for the TLS client certificates a CDN presents to the origin; requests without one get the decoy site")
+	flag.StringVar(&originSecretFile, "origin-secret-file", "", "file containing a secret that the CDN adds in a header to every request; requests without it get the decoy site")
+	flag.StringVar(&originSecretHeader, "origin-secret-header", defaultOriginSecretHeader, "name of the header carrying the origin-secret-file secret")
 	flag.StringVar(&socksPort, "socks", "1080", "port to listen on")
 	flag.IntVar(&port, "port", 4455, "port to listen on")
+	flag.StringVar(&transportsSpec, "transports", "", "comma-separated NAME=PORT: serve each further transport method NAME on its own PORT, besides meek on --port")
+	flag.StringVar(&options.ListenUnix, "listen-unix", "", "path of a unix socket to listen on instead of the TCP port, for a local frontend")
+	flag.StringVar(&listenUnixMode, "listen-unix-mode", "660", "octal permissions of the listen-unix socket")
+	flag.BoolVar(&options.ReusePort, "reuse-port", false, "listen with SO_REUSEPORT, so that a new meek-server can take over the port (Linux only)")
+	flag.DurationVar(&options.DrainTimeout, "drain-timeout", 5*time.Minute, "on SIGUSR2, how long to keep serving existing sessions before exiting")
+	flag.IntVar(&loadWatchdog.MaxGoroutines, "max-goroutines", 0, "refuse new sessions while there are more than this many goroutines (0 means unlimited)")
+	flag.Int64Var(&loadWatchdog.MaxBackendConns, "max-backend-conns", 0, "refuse new sessions while this many backend connections are open (0 means unlimited)")
+	flag.Uint64Var(&maxHeapMB, "max-heap-mb", 0, "refuse new sessions while the heap is larger than this many megabytes (0 means unlimited)")
+	flag.Float64Var(&newSessionRate, "new-session-rate", 0, "maximum new sessions per second, over all clients (0 means unlimited)")
+	flag.Float64Var(&newSessionRatePerIP, "new-session-rate-per-ip", 0, "maximum new sessions per second from one client address or IPv6 /64 (0 means unlimited)")
+	flag.StringVar(&options.SessionIPBinding, "session-ip-binding", sessionIPBindingOff, "bind sessions to the client address that created them: off, reject, or new")
+	flag.BoolVar(&options.RequestIDHeader, "request-id-header", false, "send each request's log correlation id in an X-Request-Id header on admin API responses")
+	flag.IntVar(&sessionReplayMax, "session-replay-max", defaultReplayCacheMax, "most closed session ids to remember for session-replay-window")
+	flag.DurationVar(&sessionReplayWindow, "session-replay-window", 24*time.Hour, "refuse to reopen the ids of sessions closed within this long (0 disables)")
+	flag.StringVar(&options.SpillDir, "spill-dir", "", "directory in which to queue data for backends that read slowly, instead of blocking requests")
+	flag.Int64Var(&options.SpillMax, "spill-max", 16<<20, "most bytes per session to queue in --spill-dir")
+	flag.Int64Var(&options.SpillTotalMax, "spill-total-max", 1<<30, "most bytes of all sessions to queue in --spill-dir (0 means unlimited)")
+	flag.IntVar(&options.SessionTraceEvents, "session-trace-events", 32, "how many recent events to keep per session for the admin API (0 disables tracing)")
+	flag.BoolVar(&options.SessionTokens, "session-tokens", false, "issue each session a secret token that later requests must present")
+	flag.DurationVar(&options.MaxSessionAge, "max-session-age", 0, "close sessions this long after they were created, even if active (0 means no limit)")
+	flag.BoolVar(&options.Strict, "strict", false, "reject requests that don't have exactly the expected method, path, headers, and body length")
+	flag.StringVar(&strictSNIMode, "strict-sni", "", "refuse TLS handshakes whose SNI isn't one of the server's host names: close (drop the connection) or cert (answer with a generic self-signed certificate)")
+	flag.DurationVar(&options.ReadHeaderTimeout, "read-header-timeout", 0, "time allowed to read request headers (0 means the same as the read timeout)")
+	flag.IntVar(&options.MaxHeaderBytes, "max-header-bytes", 0, "maximum size of request headers (0 means the net/http default)")
+	flag.IntVar(&options.MaxRequestsPerConn, "max-requests-per-conn", 0, "close HTTP/1.1 connections after this many requests (0 means unlimited)")
+	flag.IntVar(&options.MaxConnsPerIP, "max-conns-per-ip", 0, "maximum concurrent connections from one IP address (0 means unlimited)")
+	flag.IntVar(&options.MaxStreamsPerConn, "max-streams-per-conn", 0, "maximum concurrent HTTP/2 streams on one connection (0 means the http2 default)")
+	flag.IntVar(&options.MaxStreamsPerIP, "max-streams-per-ip", 0, "maximum HTTP/2 streams in progress from one client address (0 means unlimited)")
+	flag.IntVar(&options.MaxStreamResets, "max-stream-resets", 0, "close HTTP/2 connections that reset more than this many streams per second (0 means unlimited)")
+	flag.IntVar(&options.MaxContinuationFrames, "max-continuation-frames", 0, "close HTTP/2 connections that send more than this many CONTINUATION frames in one header block (0 means unlimited)")
+	flag.IntVar(&options.MaxInFlight, "max-in-flight", 0, "maximum requests handled at once, over all clients (0 means unlimited)")
+	flag.IntVar(&options.InFlightQueue, "in-flight-queue", 64, "how many requests may wait when --max-in-flight is reached")
+	flag.DurationVar(&options.InFlightQueueWait, "in-flight-queue-wait", time.Second, "how long a request may wait when --max-in-flight is reached")
+	flag.DurationVar(&options.AcceptBackoffMin, "accept-backoff-min", defaultAcceptBackoffMin, "initial delay before retrying a failed accept")
+	flag.DurationVar(&options.AcceptBackoffMax, "accept-backoff-max", defaultAcceptBackoffMax, "maximum delay before retrying a failed accept")
 	flag.Parse()
 
-	os.Setenv("MASK_DOC", maskHtmlDoc)
-	os.Setenv("MASK_REDIRECT", maskRedirect)
+	if version {
+		fmt.Printf("meek-server %s\n", getBuildInfo())
+		os.Exit(0)
+	}
+
+	// "meek-server check" checks the configuration and exits. Options may
+	// come before or after "check".
+	check := flag.Arg(0) == "check"
+	if check {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if corsOrigins != "" {
+		options.CORS = parseCORSOrigins(corsOrigins)
+	}
+	level, err := logging.ParseLevel(logLevelName)
+	if err != nil {
+		faultreport.Fatal(err)
+	}
+	logging.SetLevel(level)
+	if geoIPFilename != "" || geoIP6Filename != "" {
+		geoDB, err = loadGeoIP(geoIPFilename, geoIP6Filename)
+		if err != nil {
+			faultreport.Fatalf("GeoIP: %s", err)
+		}
+		usageByCountry = newCountryStats(geoDB)
+	}
+	if bridgeStatsFilename != "" && externalService == "" {
+		faultreport.Fatalf("--bridge-stats requires --external-service to be a tor OR port")
+	}
+	options.TransportMethods, err = parseTransportMethods(methods)
+	if err != nil {
+		faultreport.Fatalf("--methods: %s", err)
+	}
+	if paths != "" {
+		options.TransportPaths, err = parseTransportPaths(paths)
+		if err != nil {
+			faultreport.Fatalf("--paths: %s", err)
+		}
+	}
+	transports, err = parseServerTransports(transportsSpec)
+	if err != nil {
+		faultreport.Fatalf("--transports: %s", err)
+	}
+	for _, t := range transports {
+		if t.ProbeResponse == "" {
+			continue
+		}
+		if err := checkProbeResponse(t.ProbeResponse, options.MaskRedirect); err != nil {
+			faultreport.Fatalf("--transports: %s: probe-response: %s", t.Name, err)
+		}
+	}
+	options.Transports = transports
+	if len(transports) > 0 && options.ListenUnix != "" {
+		faultreport.Fatalf("--transports: can't be used with --listen-unix")
+	}
+	options.CoverAssets, err = makeCoverAssets(splitNonEmpty(coverPaths))
+	if err != nil {
+		faultreport.Fatalf("--cover-paths: %s", err)
+	}
+	if err := checkSessionIPBinding(options.SessionIPBinding); err != nil {
+		faultreport.Fatalf("--session-ip-binding: %s", err)
+	}
+	if options.SpillDir != "" {
+		if err := checkSpillDir(options.SpillDir); err != nil {
+			faultreport.Fatalf("--spill-dir: %s", err)
+		}
+	}
+	if options.MaxConnsPerIP < 0 {
+		faultreport.Fatalf("--max-conns-per-ip must not be negative")
+	}
+	if options.MaxRequestsPerConn < 0 {
+		faultreport.Fatalf("--max-requests-per-conn must not be negative")
+	}
+	if options.SpillMax < 0 {
+		faultreport.Fatalf("--spill-max must not be negative")
+	}
+	if options.SpillTotalMax < 0 {
+		faultreport.Fatalf("--spill-total-max must not be negative")
+	}
+	if options.MaskTemplate != "" {
+		if _, err := maskTemplate(options.MaskTemplate); err != nil {
+			faultreport.Fatalf("--mask-template: %s", err)
+		}
+	}
+	if options.MaskMirror != "" {
+		if _, err := parseMaskMirrorURL(options.MaskMirror); err != nil {
+			faultreport.Fatalf("--mask-mirror: %s", err)
+		}
+	}
+	if options.MaskRefresh < 0 {
+		faultreport.Fatalf("--mask-refresh: must not be negative")
+	}
+	if err := checkMaskHeaders(options.MaskHeaders); err != nil {
+		faultreport.Fatal(err)
+	}
+	if err := checkWellKnownProfile(options.MaskWellKnown); err != nil {
+		faultreport.Fatalf("--mask-well-known: %s", err)
+	}
+	if options.PollHintRate < 0 {
+		faultreport.Fatalf("--poll-hint-rate: must not be negative")
+	}
+	if options.PollHintRate > 0 && !options.PollHints {
+		faultreport.Fatalf("--poll-hint-rate requires --poll-hints")
+	}
+	if err := checkPayloadSize(options.PayloadSize); err != nil {
+		faultreport.Fatalf("--payload-size: %s", err)
+	}
+	if err := checkCDNHeaders(options.CDNHeaders, options.CDNPop); err != nil {
+		faultreport.Fatalf("--cdn-headers: %s", err)
+	}
+	if err := checkProbeResponse(options.ProbeResponse, options.MaskRedirect); err != nil {
+		faultreport.Fatalf("--probe-response: %s", err)
+	}
+	if options.MaxStreamsPerConn < 0 || options.MaxStreamsPerConn > math.MaxUint32 {
+		faultreport.Fatalf("--max-streams-per-conn: %d is out of range", options.MaxStreamsPerConn)
+	}
+	if options.InFlightQueue < 0 {
+		faultreport.Fatalf("--in-flight-queue: %d is negative", options.InFlightQueue)
+	}
+	if sessionReplayMax <= 0 {
+		faultreport.Fatalf("--session-replay-max: %d is not positive", sessionReplayMax)
+	}
+	if options.ReusePort && !reusePortSupported {
+		faultreport.Fatalf("--reuse-port is not supported on this platform")
+	}
+	options.ListenUnixMode, err = parseUnixSocketMode(listenUnixMode)
+	if err != nil {
+		faultreport.Fatalf("--listen-unix-mode: %s", err)
+	}
+	if outBindAddr != "" {
+		ip, err := bindaddr.Resolve(outBindAddr)
+		if err != nil {
+			faultreport.Fatalf("--out-bind-addr: %s", err)
+		}
+		backendTCPDialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if backendProxy != "" {
+		u, err := url.Parse(backendProxy)
+		if err != nil {
+			faultreport.Fatalf("can't parse --backend-proxy: %s", err)
+		}
+		backendDialer, err = makeBackendProxyDialer(u, backendDialer)
+		if err != nil {
+			faultreport.Fatal(err)
+		}
+	}
 
-	//service port
-	os.Setenv("TOR_PT_SERVER_BINDADDR", "meek-0.0.0.0:"+strconv.Itoa(port))
+	cfg := &checkConfig{
+		DisableTLS:       disableTLS,
+		CertFilename:     certFilename,
+		KeyFilename:      keyFilename,
+		ACMEHostnames:    splitNonEmpty(acmeHostnamesCommas),
+		ACMEEmail:        acmeEmail,
+		ECHPublicName:    echOpts.PublicName,
+		Port:             port,
+		Transports:       transports,
+		ListenUnix:       options.ListenUnix,
+		SocksPort:        socksPort,
+		ExternalService:  externalService,
+		LogFilename:      logFilename,
+		AuditLogFilename: auditLogFilename,
+	}
+	if printConfigFlag {
+		os.Exit(printConfigMain(cfg))
+	}
+	if check {
+		os.Exit(checkMain(cfg))
+	}
+	if config, err := makeEffectiveConfig(flag.CommandLine, os.Environ(), cfg); err == nil {
+		configHash = hashConfig(config)
+	}
 
-	//external service needed to be obfuscated
+	//service port and external service needed to be obfuscated
+	for name, value := range serverPTEnv(port, transports, socksPort, externalService) {
+		os.Setenv(name, value)
+	}
 	if externalService == "" {
 		//implement socks service
 		fmt.Println("Starting socks service on port: " + socksPort)
-		os.Setenv("TOR_PT_ORPORT", "127.0.0.1:"+socksPort)
 		go runProxy(socksPort)
 	} else {
 		//external service entered
 		fmt.Println("Serving external service on port: " + strconv.Itoa(port))
-		os.Setenv("TOR_PT_ORPORT", externalService)
 	}
 
-	var err error
 	ptInfo, err = pt.ServerSetup(nil)
 	if err != nil {
-		log.Fatalf("error in ServerSetup: %s", err)
+		faultreport.Fatalf("error in ServerSetup: %s", err)
 	}
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -450,11 +1378,145 @@ func main() {
 			// If we fail to open the log, emit a message that will
 			// appear in tor's log.
 			pt.SmethodError(ptMethodName, fmt.Sprintf("error opening log file: %s", err))
-			log.Fatalf("error opening log file: %s", err)
+			faultreport.Fatalf("error opening log file: %s", err)
 		}
 		defer f.Close()
 		log.SetOutput(f)
 	}
+	if os.Getenv("TOR_PT_STATE_LOCATION") != "" {
+		dir, err := pt.MakeStateDir()
+		if err != nil {
+			log.Printf("can't make state directory for fault reports: %s", err)
+		} else {
+			faultreport.Default = faultreport.New(dir, "meek-server", configHash, getBuildInfo())
+			log.SetOutput(io.MultiWriter(log.Writer(), faultreport.Default))
+		}
+	}
+	if filename, err := faultreport.Default.WatchCrashes(); err != nil {
+		log.Printf("error setting up crash output: %s", err)
+	} else if filename != "" {
+		log.Printf("the last run crashed; fault report in %s", filename)
+	}
+	if auditLogFilename != "" {
+		f, err := os.OpenFile(auditLogFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			pt.SmethodError(ptMethodName, fmt.Sprintf("error opening audit log file: %s", err))
+			faultreport.Fatalf("error opening audit log file: %s", err)
+		}
+		defer f.Close()
+		auditLog = newAuditLogger(f)
+	}
+
+	var budget int64
+	if bandwidthBudget != "" {
+		budget, err = parseByteSize(bandwidthBudget)
+		if err != nil {
+			faultreport.Fatalf("--bandwidth-budget: %s", err)
+		}
+	}
+	var fairBytesPerSecond int64
+	if fairRate != "" {
+		fairBytesPerSecond, err = parseByteSize(fairRate)
+		if err != nil {
+			faultreport.Fatalf("--fair-rate: %s", err)
+		}
+	}
+	if qosFile != "" {
+		if fairBytesPerSecond <= 0 {
+			faultreport.Fatalf("--qos-file requires --fair-rate")
+		}
+		config, err := readQoSFile(qosFile)
+		if err == nil {
+			err = qosTable.Set(config)
+		}
+		if err != nil {
+			faultreport.Fatalf("--qos-file: %s", err)
+		}
+	}
+	var stateDir string
+	if os.Getenv("TOR_PT_STATE_LOCATION") != "" {
+		stateDir, err = pt.MakeStateDir()
+		if err != nil {
+			faultreport.Fatalf("can't make state directory: %s", err)
+		}
+	}
+	var bandwidthPath string
+	if stateDir != "" {
+		bandwidthPath = filepath.Join(stateDir, bandwidthStateFilename)
+	} else if budget > 0 {
+		log.Printf("no state directory; bandwidth totals will start over at each restart")
+	}
+	bandwidthAcct, err = newBandwidthAccount(bandwidthPath, budget)
+	if err != nil {
+		faultreport.Fatalf("bandwidth accounting: %s", err)
+	}
+	go bandwidthAcct.Run(bandwidthSaveInterval)
+	defer bandwidthAcct.Save()
+
+	if echOpts.PublicName != "" {
+		if disableTLS {
+			faultreport.Fatalf("--ech-public-name is not allowed with --disable-tls")
+		}
+		if stateDir != "" {
+			echOpts.StatePath = filepath.Join(stateDir, echStateFilename)
+		} else {
+			log.Printf("no state directory; ECH keys will change at each restart")
+		}
+		echKeys, err = newECHKeySet(echOpts)
+		if err != nil {
+			faultreport.Fatalf("ECH: %s", err)
+		}
+		log.Printf("ECH config for %s: %s", echOpts.PublicName, base64.StdEncoding.EncodeToString(echKeys.ConfigList()))
+		go echKeys.Run()
+	}
+
+	if options.MaskMirror != "" {
+		var dir string
+		if stateDir != "" {
+			dir = filepath.Join(stateDir, maskMirrorDirname)
+		} else {
+			log.Printf("no state directory; the --mask-mirror site will be fetched again at each restart")
+			dir, err = os.MkdirTemp("", maskMirrorDirname)
+			if err != nil {
+				faultreport.Fatalf("--mask-mirror: %s", err)
+			}
+			defer os.RemoveAll(dir)
+		}
+		maskMirrorSite, err = newMaskMirror(options.MaskMirror, dir, options.MaskRefresh)
+		if err != nil {
+			faultreport.Fatalf("--mask-mirror: %s", err)
+		}
+		go maskMirrorSite.Run()
+	}
+	if options.MaskTemplate != "" {
+		var dir string
+		if stateDir != "" {
+			dir = filepath.Join(stateDir, maskTemplateDirname)
+			err = os.MkdirAll(dir, 0700)
+		} else {
+			log.Printf("no state directory; the --mask-template site will have new modification times at each restart")
+			dir, err = os.MkdirTemp("", maskTemplateDirname)
+			if err == nil {
+				defer os.RemoveAll(dir)
+			}
+		}
+		if err == nil {
+			maskTemplateDir, err = installMaskTemplate(options.MaskTemplate, dir)
+		}
+		if err != nil {
+			faultreport.Fatalf("--mask-template: %s", err)
+		}
+	}
+
+	if bridgeStatsFilename != "" {
+		f, err := os.OpenFile(bridgeStatsFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			pt.SmethodError(ptMethodName, fmt.Sprintf("error opening bridge statistics file: %s", err))
+			faultreport.Fatalf("error opening bridge statistics file: %s", err)
+		}
+		defer f.Close()
+		bridgeStatsLog = newBridgeStats(geoDB, f)
+	}
 
 	// Handle the various ways of setting up TLS. The legal configurations
 	// are:
@@ -468,15 +1530,15 @@ func main() {
 	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 	if disableTLS {
 		if acmeEmail != "" || acmeHostnamesCommas != "" || certFilename != "" || keyFilename != "" {
-			log.Fatalf("The --acme-email, --acme-hostnames, --cert, and --key options are not allowed with --disable-tls.")
+			faultreport.Fatalf("The --acme-email, --acme-hostnames, --cert, and --key options are not allowed with --disable-tls.")
 		}
 	} else if certFilename != "" && keyFilename != "" {
 		if acmeEmail != "" || acmeHostnamesCommas != "" {
-			log.Fatalf("The --cert and --key options are not allowed with --acme-email or --acme-hostnames.")
+			faultreport.Fatalf("The --cert and --key options are not allowed with --acme-email or --acme-hostnames.")
 		}
 		ctx, err := newCertContext(certFilename, keyFilename)
 		if err != nil {
-			log.Fatal(err)
+			faultreport.Fatal(err)
 		}
 		getCertificate = ctx.GetCertificate
 	} else if acmeHostnamesCommas != "" {
@@ -505,53 +1567,172 @@ func main() {
 		}
 		getCertificate = certManager.GetCertificate
 	} else {
-		log.Fatalf("You must use either --acme-hostnames, or --cert and --key.")
+		faultreport.Fatalf("You must use either --acme-hostnames, or --cert and --key.")
+	}
+	if acmeRedirect && !needHTTP01Listener {
+		faultreport.Fatalf("--acme-redirect: only allowed with --acme-hostnames")
+	}
+
+	if disableTLS && originClientCAFile != "" {
+		faultreport.Fatalf("The --origin-client-ca option is not allowed with --disable-tls.")
+	}
+	originVerify, err = newOriginVerifier(originSecretHeader, originSecretFile, originClientCAFile)
+	if err != nil {
+		faultreport.Fatalf("origin verification: %s", err)
+	}
+	if echoSecretFile != "" {
+		options.EchoSecret, err = readEchoSecret(echoSecretFile)
+		if err != nil {
+			faultreport.Fatalf("--echo-secret-file: %s", err)
+		}
+	}
+	if !disableTLS {
+		kl, err := keylog.Open(keyLogFile)
+		if err != nil {
+			faultreport.Fatalf("--keylog: %s", err)
+		}
+		if kl != nil {
+			defer kl.Close()
+			keyLogWriter = kl
+		}
+	}
+	if strictSNIMode != "" {
+		if disableTLS {
+			faultreport.Fatalf("--strict-sni is not allowed with --disable-tls")
+		}
+		hostnames := splitNonEmpty(acmeHostnamesCommas)
+		if echOpts.PublicName != "" {
+			hostnames = append(hostnames, echOpts.PublicName)
+		}
+		// With --cert, the names are those of the certificate.
+		var certNames func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		if certManager == nil {
+			certNames = getCertificate
+		}
+		strictSNI, err = newSNIFilter(strictSNIMode, hostnames, certNames)
+		if err != nil {
+			faultreport.Fatalf("--strict-sni: %s", err)
+		}
+	}
+
+	log.Printf("starting version %s", getBuildInfo())
+
+	// All listeners share one set of sessions.
+	state := NewStateWith(StateConfig{
+		Backend:         defaultBackendDialer,
+		Clock:           systemClock{},
+		NewSessionStore: newMapSessionStore,
+	})
+	go state.ExpireSessions()
+	go state.ReportStats(options.HeartbeatInterval)
+	loadWatchdog.MaxHeapBytes = maxHeapMB << 20
+	newSessionLimiter = newSessionRateLimiter(newSessionRate, newSessionRatePerIP)
+	closedSessions = newReplayCache(sessionReplayWindow, sessionReplayMax, time.Now())
+	fairSched = newFairScheduler(fairBytesPerSecond)
+	if fairSched != nil {
+		go fairSched.Run()
+	}
+	if loadWatchdog.Enabled() {
+		go loadWatchdog.Run(state, watchdogInterval)
+	}
+	maxConnsPerIP.Set(options.MaxConnsPerIP)
+	maxRequestsPerConn.Set(options.MaxRequestsPerConn)
+	// Panics in the HTTP handler are reported like fatal errors. Without a
+	// state directory, reports are only POSTed.
+	crashes := &crashReporter{Faults: faultreport.Default, URL: crashReportURL}
+	if crashes.Faults == nil {
+		crashes.Faults = faultreport.New("", "meek-server", configHash, getBuildInfo())
+	}
+	handler := limitRequestsPerConn(state, &maxRequestsPerConn)
+	handler = limitInFlight(handler, options.MaxInFlight, options.InFlightQueue, options.InFlightQueueWait)
+	handler = cdnHeaders(handler, options.CDNHeaders, options.CDNPop)
+	handler = recoverPanics(limitStreamsPerIP(handler, options.MaxStreamsPerIP), crashes)
+	handler = withRequestID(handler)
+	handler = strictSNI.Handler(handler)
+
+	if adminAddr != "" {
+		err = startAdmin(adminAddr, adminTokenFile, state)
+		if err != nil {
+			faultreport.Fatalf("admin API: %s", err)
+		}
+	}
+	if dnsAddr != "" {
+		err = startDNSTunnel(dnsAddr, dnsDomain, state)
+		if err != nil {
+			faultreport.Fatalf("DNS tunnel: %s", err)
+		}
 	}
 
-	log.Printf("starting version %s (%s)", programVersion, runtime.Version())
 	servers := make([]*http.Server, 0)
 	for _, bindaddr := range ptInfo.Bindaddrs {
-		if port != 0 {
+		if port != 0 && bindaddr.MethodName == ptMethodName {
 			bindaddr.Addr.Port = port
 		}
-		switch bindaddr.MethodName {
-		case ptMethodName:
-			if needHTTP01Listener {
-				needHTTP01Listener = false
-				addr := *bindaddr.Addr
-				addr.Port = 80
-				log.Printf("starting HTTP-01 ACME listener on %s", addr.String())
-				lnHTTP01, err := net.ListenTCP("tcp", &addr)
-				if err != nil {
-					log.Printf("error opening HTTP-01 ACME listener: %s", err)
-					pt.SmethodError(bindaddr.MethodName, "HTTP-01 ACME listener: "+err.Error())
-					continue
-				}
-				go func() {
-					log.Fatal(http.Serve(lnHTTP01, certManager.HTTPHandler(nil)))
-				}()
-			}
-
-			var server *http.Server
-			if disableTLS {
-				server, err = startServer(bindaddr.Addr)
-			} else {
-				server, err = startServerTLS(bindaddr.Addr, getCertificate)
-			}
+		if !isServerMethod(bindaddr.MethodName, transports) {
+			pt.SmethodError(bindaddr.MethodName, "no such method")
+			continue
+		}
+		if needHTTP01Listener {
+			needHTTP01Listener = false
+			addr := *bindaddr.Addr
+			addr.Port = 80
+			log.Printf("starting HTTP-01 ACME listener on %s", addr.String())
+			lnHTTP01, err := listenTCP(addr.String())
 			if err != nil {
-				pt.SmethodError(bindaddr.MethodName, err.Error())
-				break
+				log.Printf("error opening HTTP-01 ACME listener: %s", err)
+				pt.SmethodError(bindaddr.MethodName, "HTTP-01 ACME listener: "+err.Error())
+				continue
 			}
-			pt.Smethod(bindaddr.MethodName, bindaddr.Addr)
-			servers = append(servers, server)
-		default:
-			pt.SmethodError(bindaddr.MethodName, "no such method")
+			go func() {
+				fallback := http01Fallback(state, acmeRedirect, bindaddr.Addr.Port)
+				err := http.Serve(trackListener(lnHTTP01), certManager.HTTPHandler(fallback))
+				if !listenersClosed() {
+					faultreport.Fatal(err)
+				}
+			}()
+		}
+
+		if options.ListenUnix != "" && len(servers) > 0 {
+			pt.SmethodError(bindaddr.MethodName, "only one listener can use --listen-unix")
+			continue
 		}
+		var server *http.Server
+		if disableTLS {
+			server, err = startServer(bindaddr.Addr, withMethodName(handler, bindaddr.MethodName))
+		} else {
+			server, err = startServerTLS(bindaddr.Addr, withMethodName(handler, bindaddr.MethodName), getCertificate)
+		}
+		if err != nil {
+			pt.SmethodError(bindaddr.MethodName, err.Error())
+			continue
+		}
+		pt.Smethod(bindaddr.MethodName, bindaddr.Addr)
+		servers = append(servers, server)
 	}
 	pt.SmethodsDone()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	if drainSignal != nil {
+		signal.Notify(sigChan, drainSignal)
+	}
+	if dumpSignal != nil {
+		dumpChan := make(chan os.Signal, 1)
+		signal.Notify(dumpChan, dumpSignal)
+		go func() {
+			for range dumpChan {
+				state.LogDump()
+			}
+		}()
+	}
+	// SIGHUP turns debug logging on for a while, and off again.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			logging.ToggleDebug()
+		}
+	}()
 
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
 		// This environment variable means we should treat EOF on stdin
@@ -563,9 +1744,24 @@ func main() {
 		}()
 	}
 
+	if exitWithParent {
+		go func() {
+			err := parent.WaitExit()
+			if err != nil {
+				log.Printf("not watching parent process: %s", err)
+				return
+			}
+			log.Printf("synthesizing SIGTERM because the parent process exited")
+			sigChan <- syscall.SIGTERM
+		}()
+	}
+
 	// Keep track of handlers and wait for a signal.
 	sig := <-sigChan
 	log.Printf("got signal %s", sig)
+	if sig == drainSignal {
+		state.Drain(options.DrainTimeout)
+	}
 
 	for _, server := range servers {
 		server.Close()
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that Session.Lock admits waiting goroutines in the order in which they
+// started waiting.
+func TestSessionLockOrder(t *testing.T) {
+	session := NewSession(nil)
+	session.Lock(context.Background())
+
+	const n = 10
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session.Lock(context.Background())
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			session.Unlock()
+		}(i)
+		// Give goroutine i time to block before starting i+1.
+		time.Sleep(10 * time.Millisecond)
+	}
+	session.Unlock()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if order[i] != i {
+			t.Fatalf("goroutines ran in order %v", order)
+		}
+	}
+}
+
+// Test that LockSeq admits requests in sequence order regardless of the order
+// in which they arrive.
+func TestSessionLockSeq(t *testing.T) {
+	session := NewSession(nil)
+
+	arrival := []uint64{3, 1, 4, 0, 2}
+	var lock sync.Mutex
+	var order []uint64
+	var wg sync.WaitGroup
+	for _, seq := range arrival {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			err := session.LockSeq(context.Background(), seq, time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			order = append(order, seq)
+			lock.Unlock()
+			session.UnlockSeq()
+		}(seq)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	for i := range arrival {
+		if order[i] != uint64(i) {
+			t.Fatalf("requests processed in order %v", order)
+		}
+	}
+
+	// A sequence number that has already been processed is a duplicate.
+	if err := session.LockSeq(context.Background(), 2, time.Second); err == nil {
+		t.Errorf("duplicate sequence number accepted")
+	}
+	// Too far ahead.
+	if err := session.LockSeq(context.Background(), 5+maxPipelineDepth+1, time.Second); err == nil {
+		t.Errorf("sequence number too far ahead accepted")
+	}
+	// A gap that is never filled times out.
+	if err := session.LockSeq(context.Background(), 6, 50*time.Millisecond); err == nil {
+		t.Errorf("LockSeq did not time out")
+	}
+}
+
+// Test that a session id always maps to the same shard, and that session ids
+// are spread across shards.
+func TestStateShard(t *testing.T) {
+	state := NewState()
+	used := make(map[*sessionShard]bool)
+	for i := 0; i < 10*numSessionShards; i++ {
+		id := strconv.Itoa(i)
+		shard := state.shard(id)
+		if state.shard(id) != shard {
+			t.Fatalf("%q mapped to different shards", id)
+		}
+		used[shard] = true
+	}
+	if len(used) < numSessionShards/2 {
+		t.Errorf("only %d of %d shards used", len(used), numSessionShards)
+	}
+}
+
+// Test that waiting for a session's turn stops when the request's context is
+// canceled.
+func TestSessionLockCanceled(t *testing.T) {
+	session := NewSession(nil)
+	session.Lock(context.Background())
+	defer session.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := session.Lock(ctx); err == nil {
+		t.Errorf("Lock succeeded while the session was locked")
+	}
+	if err := session.LockSeq(ctx, 1, time.Second); err == nil {
+		t.Errorf("LockSeq succeeded with a canceled context")
+	}
+}
+
+// Test that transact returns promptly when the request is canceled while the
+// OR port is not accepting writes.
+func TestTransactCanceled(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept but never read, so writes eventually block.
+		conn, err := ln.Accept()
+		if err == nil {
+			time.Sleep(5 * time.Second)
+			conn.Close()
+		}
+	}()
+	or, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer or.Close()
+	or.SetWriteBuffer(1024)
+	session := NewSession(or)
+
+	// A body that never ends, as if the client were slowly uploading.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := pw.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/", pr).WithContext(ctx)
+
+	start := time.Now()
+	err = transact(session, httptest.NewRecorder(), req)
+	if err == nil {
+		t.Errorf("transact succeeded despite cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("transact took %v to notice cancellation", elapsed)
+	}
+}
+
+func TestSessionIsTooOld(t *testing.T) {
+	defer func() { options.MaxSessionAge = 0 }()
+	now := time.Now()
+	session := &Session{Created: now.Add(-time.Hour), LastSeen: now}
+
+	options.MaxSessionAge = 0
+	if session.IsTooOld(now) {
+		t.Errorf("too old with no limit")
+	}
+	options.MaxSessionAge = 2 * time.Hour
+	if session.IsTooOld(now) {
+		t.Errorf("too old at 1h with a limit of 2h")
+	}
+	options.MaxSessionAge = 30 * time.Minute
+	if !session.IsTooOld(now) {
+		t.Errorf("not too old at 1h with a limit of 30m")
+	}
+}
+
+// Test that a client offering only the post-quantum hybrid key exchange can
+// connect.
+func TestServerPostQuantumKeyExchange(t *testing.T) {
+	serverConfig := &tls.Config{
+		Certificates:     []tls.Certificate{*mustLoadCertificate([]byte(cert1PEM), []byte(key1PEM))},
+		CurvePreferences: serverCurvePreferences,
+	}
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		CurvePreferences:   []tls.CurveID{tls.X25519MLKEM768},
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	client, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if curve := client.ConnectionState().CurveID; curve != tls.X25519MLKEM768 {
+		t.Errorf("negotiated %v, expected %v", curve, tls.X25519MLKEM768)
+	}
+}
+
+func FuzzParseSeq(f *testing.F) {
+	for _, value := range []string{"0", "1", "007", "18446744073709551615", "18446744073709551616", "-1", "+1", " 1", "0x10", "1_000", ""} {
+		f.Add(value, false)
+	}
+	f.Add("1", true)
+	f.Fuzz(func(t *testing.T, value string, twice bool) {
+		values := []string{value}
+		if twice {
+			values = append(values, value)
+		}
+		seq, hasSeq, err := parseSeq(values)
+		if err != nil {
+			return
+		}
+		if twice || !hasSeq {
+			t.Fatalf("%q: accepted %d values, hasSeq %v", value, len(values), hasSeq)
+		}
+		// Only decimal digits are accepted, with leading zeros.
+		if digits := strings.TrimLeft(value, "0"); strconv.FormatUint(seq, 10) != digits && !(seq == 0 && digits == "") {
+			t.Fatalf("%q parsed as %d", value, seq)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+// The code in this file has to do with the HTTP methods accepted for transport
+// requests (--methods). Clients send POST by default, but some fronting paths
+// apply different caching or filtering rules to different methods, and
+// traffic that is only ever POST is a recognizable pattern, so a client may
+// be configured to use PUT or PATCH instead (meek-client's method= bridge
+// arg). The server accepts transport requests with any of the configured
+// methods, and answers others as it answers any other unknown request. The
+// diagnostic echo endpoint (see echo.go) always takes POST.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The methods that --methods may list.
+var transportMethodNames = []string{"PATCH", "POST", "PUT"}
+
+// transportMethods is a set of methods accepted for transport requests. A nil
+// transportMethods accepts only POST.
+type transportMethods map[string]bool
+
+// Parse a comma-separated list of methods for --methods.
+func parseTransportMethods(s string) (transportMethods, error) {
+	methods := make(transportMethods)
+	for _, method := range strings.Split(s, ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			continue
+		}
+		i := sort.SearchStrings(transportMethodNames, method)
+		if i == len(transportMethodNames) || transportMethodNames[i] != method {
+			return nil, fmt.Errorf("unknown method %q (known methods are %s)", method, strings.Join(transportMethodNames, ", "))
+		}
+		methods[method] = true
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no methods")
+	}
+	return methods, nil
+}
+
+// Is method accepted for transport requests?
+func (methods transportMethods) Allowed(method string) bool {
+	if methods == nil {
+		return method == "POST"
+	}
+	return methods[method]
+}
+
+// Return the accepted methods as a sorted, comma-separated list, as for an
+// Access-Control-Allow-Methods header.
+func (methods transportMethods) String() string {
+	if methods == nil {
+		return "POST"
+	}
+	names := make([]string, 0, len(methods))
+	for method := range methods {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
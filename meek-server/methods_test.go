@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTransportMethods(t *testing.T) {
+	methods, err := parseTransportMethods("put, patch,POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := methods.String(); got != "PATCH, POST, PUT" {
+		t.Errorf("got %q", got)
+	}
+	for _, s := range []string{"", " , ", "GET", "POST,DELETE"} {
+		if _, err := parseTransportMethods(s); err == nil {
+			t.Errorf("%q: unexpected success", s)
+		}
+	}
+}
+
+func TestTransportMethodsAllowed(t *testing.T) {
+	var methods transportMethods
+	if !methods.Allowed("POST") || methods.Allowed("PUT") || methods.String() != "POST" {
+		t.Errorf("nil set: POST %v, PUT %v, %q", methods.Allowed("POST"), methods.Allowed("PUT"), methods.String())
+	}
+	methods, _ = parseTransportMethods("PUT")
+	if methods.Allowed("POST") || !methods.Allowed("PUT") {
+		t.Errorf("PUT only: POST %v, PUT %v", methods.Allowed("POST"), methods.Allowed("PUT"))
+	}
+}
+
+// Transport requests with a method not in --methods are answered as probes.
+func TestServeHTTPTransportMethods(t *testing.T) {
+	saved := options.TransportMethods
+	defer func() { options.TransportMethods = saved }()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	state.shard(sessionID).sessions.Store(sessionID, NewSession(c1))
+
+	options.TransportMethods = nil
+	req := newCloseRequest(sessionID)
+	req.Method = "PUT"
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK || state.lookupSession(sessionID) == nil {
+		t.Errorf("PUT not in --methods: status %d", rec.Code)
+	}
+
+	options.TransportMethods, _ = parseTransportMethods("PUT")
+	rec = httptest.NewRecorder()
+	state.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || state.lookupSession(sessionID) != nil {
+		t.Errorf("PUT in --methods: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// The code in this file carries multiplexed sessions (--mux). A client that
+// sends many connections over one session marks its requests with an "X-Mux:
+// 1" header. The session's stream is then not a single backend connection,
+// but a multiplexer session (see lib/mux), each of whose streams is copied to a
+// backend connection of its own. To the rest of the server, a multiplexed
+// session looks like any other: its Or is one end of an in-memory pipe, whose
+// other end the multiplexer reads and writes.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"../lib/logging"
+	"../lib/mux"
+)
+
+const (
+	// The request header that marks a multiplexed session.
+	muxHeader = "X-Mux"
+	// The most streams a multiplexed session may have open at once. Each
+	// is a backend connection.
+	muxMaxStreams = 64
+)
+
+// Returned by GetSession for a multiplexed session when --mux is not set.
+var errMuxDisabled = errors.New("multiplexed session requested but --mux is not set")
+
+// Does req ask for a multiplexed session?
+func isMuxRequest(req *http.Request) bool {
+	return req.Header.Get(muxHeader) == "1"
+}
+
+// Return a connection to use as the Or of a new multiplexed session. Streams
+// that the client opens are connected to backends as they arrive, passing
+// useraddr and methodName to backend. Each is admitted like a new session from
+// ip (see admitNewSession), and a session may have no more than muxMaxStreams;
+// other streams are closed at once. All of them are closed when the returned
+// connection is closed.
+func newMuxBackend(backend BackendDialer, ip net.IP, useraddr, methodName string) net.Conn {
+	or, conn := net.Pipe()
+	sess := mux.NewSession(conn, false)
+	go func() {
+		for {
+			stream, err := sess.Accept()
+			if err != nil {
+				if err := sess.Err(); err != nil {
+					logging.Debugf("mux: %s", err)
+				}
+				return
+			}
+			if sess.NumStreams() > muxMaxStreams {
+				logging.Debugf("mux: refusing stream: more than %d streams", muxMaxStreams)
+				stream.Close()
+				continue
+			}
+			if err := admitNewSession(ip); err != nil {
+				logging.Debugf("mux: refusing stream: %s", err)
+				stream.Close()
+				continue
+			}
+			go carryMuxStream(stream, backend, useraddr, methodName)
+		}
+	}()
+	return or
+}
+
+// Close conn for writing if it can be, or else entirely.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// Copy data between stream and a new backend connection. When one side stops
+// sending, the other is closed for writing; both are closed once both
+// directions are done.
+func carryMuxStream(stream *mux.Stream, dialer BackendDialer, useraddr, methodName string) {
+	defer stream.Close()
+	backend, err := dialer.DialBackend(useraddr, methodName)
+	if err != nil {
+		logging.Warnf("mux: %s", err)
+		return
+	}
+	defer backend.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(backend, stream)
+		if err != nil {
+			// Unblock the other direction.
+			backend.Close()
+			return
+		}
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(stream, backend)
+		if err != nil {
+			stream.Close()
+			return
+		}
+		stream.CloseWrite()
+	}()
+	wg.Wait()
+}
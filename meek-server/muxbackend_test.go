@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"../lib/mux"
+)
+
+// Open a stream on client and check that a message comes back through the
+// echo backend.
+func echoOverMuxStream(client *mux.Session, msg string) (*mux.Stream, error) {
+	stream, err := client.Open()
+	if err != nil {
+		return nil, err
+	}
+	stream.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(stream, buf)
+	if err != nil || string(buf) != msg {
+		stream.Close()
+		return nil, fmt.Errorf("got %q, %v", buf, err)
+	}
+	return stream, nil
+}
+
+// A multiplexed session connects each stream to a backend of its own.
+func TestMuxBackend(t *testing.T) {
+	useEchoBackend(t)
+	or := newMuxBackend(defaultBackendDialer, nil, "", ptMethodName)
+	defer or.Close()
+	client := mux.NewSession(or, true)
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		stream, err := echoOverMuxStream(client, fmt.Sprintf("stream %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+	}
+}
+
+// Closing a stream for writing closes its backend connection for writing,
+// and the backend's answer still comes back.
+func TestMuxBackendCloseWrite(t *testing.T) {
+	useEchoBackend(t)
+	or := newMuxBackend(defaultBackendDialer, nil, "", ptMethodName)
+	defer or.Close()
+	client := mux.NewSession(or, true)
+	defer client.Close()
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.Write([]byte("hello"))
+	stream.CloseWrite()
+	got, err := io.ReadAll(stream)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// A session may have only muxMaxStreams streams, and each is admitted like a
+// new session.
+func TestMuxBackendLimits(t *testing.T) {
+	useEchoBackend(t)
+	or := newMuxBackend(defaultBackendDialer, nil, "", ptMethodName)
+	defer or.Close()
+	client := mux.NewSession(or, true)
+	defer client.Close()
+	for i := 0; i < muxMaxStreams; i++ {
+		stream, err := echoOverMuxStream(client, fmt.Sprintf("stream %d", i))
+		if err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+		defer stream.Close()
+	}
+	if _, err := echoOverMuxStream(client, "one too many"); err == nil {
+		t.Errorf("stream over the limit was carried")
+	}
+
+	saved := newSessionLimiter
+	defer func() { newSessionLimiter = saved }()
+	newSessionLimiter = newSessionRateLimiter(0, 0.001)
+	ip := net.ParseIP("192.0.2.1")
+	or = newMuxBackend(defaultBackendDialer, ip, "", ptMethodName)
+	defer or.Close()
+	client = mux.NewSession(or, true)
+	defer client.Close()
+	for i := 0; i < sessionRateMinBurst; i++ {
+		stream, err := echoOverMuxStream(client, fmt.Sprintf("stream %d", i))
+		if err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+		defer stream.Close()
+	}
+	if _, err := echoOverMuxStream(client, "one too many"); err == nil {
+		t.Errorf("stream over the new-session rate was carried")
+	}
+}
+
+func TestGetSessionMuxDisabled(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(muxHeader, "1")
+	_, err := NewState().GetSession("Y2FyZ28gdHJ1Y2s", req)
+	if err != errMuxDisabled {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+// The code in this file checks that requests came through the CDN, so that
+// only they are treated as transport traffic. A prober that finds the origin
+// and connects to it directly, bypassing the CDN, then sees only the decoy
+// site, whatever it sends. There are two ways, which may be used together:
+//
+// --origin-secret-file: the CDN is configured to add a header with a secret
+// value to every request it forwards to the origin (CloudFront calls this a
+// custom origin header; other CDNs have equivalents). The header name is
+// --origin-secret-header. This works with --disable-tls, when TLS is
+// terminated by the CDN or a local frontend.
+//
+// --origin-client-ca: the CDN presents a TLS client certificate issued by the
+// given CA when it connects to the origin (Cloudflare's Authenticated Origin
+// Pulls). This needs TLS at the origin. A connection without a certificate is
+// still accepted, so that a direct prober gets the decoy site like anyone
+// else rather than a failed handshake.
+//
+// Requests that fail verification are answered as if they were not transport
+// requests: GET and HEAD requests with the decoy site, others with the
+// --probe-response.
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The default name of the header carrying the origin secret.
+const defaultOriginSecretHeader = "X-Origin-Verify"
+
+// The shortest origin secret accepted.
+const minOriginSecretLength = 16
+
+// originVerifier checks that requests came through the CDN. A nil
+// *originVerifier accepts every request.
+type originVerifier struct {
+	// The header that must carry secret, if secret is not "".
+	header string
+	secret string
+	// CAs one of which must have issued a verified client certificate, or
+	// nil not to require one.
+	clientCAs *x509.CertPool
+}
+
+// The verifier used by ServeHTTP; nil if not configured.
+var originVerify *originVerifier
+
+// Make an originVerifier from the --origin-secret-header,
+// --origin-secret-file, and --origin-client-ca options. Returns nil if
+// neither secretFile nor clientCAFile is given.
+func newOriginVerifier(header, secretFile, clientCAFile string) (*originVerifier, error) {
+	if secretFile == "" && clientCAFile == "" {
+		return nil, nil
+	}
+	v := &originVerifier{header: http.CanonicalHeaderKey(header)}
+	if secretFile != "" {
+		data, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		v.secret = strings.TrimSpace(string(data))
+		if len(v.secret) < minOriginSecretLength {
+			return nil, fmt.Errorf("origin secret in %s is shorter than %d characters", secretFile, minOriginSecretLength)
+		}
+		if v.header == "" {
+			return nil, fmt.Errorf("empty origin secret header name")
+		}
+	}
+	if clientCAFile != "" {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		v.clientCAs = x509.NewCertPool()
+		if !v.clientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates in %s", clientCAFile)
+		}
+	}
+	return v, nil
+}
+
+// Return the pool of CAs for client certificates, or nil if client
+// certificates are not checked.
+func (v *originVerifier) ClientCAs() *x509.CertPool {
+	if v == nil {
+		return nil
+	}
+	return v.clientCAs
+}
+
+// Did req come through the CDN?
+func (v *originVerifier) Verified(req *http.Request) bool {
+	if v == nil {
+		return true
+	}
+	if v.secret != "" {
+		values := req.Header[v.header]
+		if len(values) != 1 || !tokenMatches(values[0], v.secret) {
+			return false
+		}
+	}
+	if v.clientCAs != nil {
+		// The TLS stack has already verified any certificate against
+		// clientCAs.
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testOriginSecret = "0123456789abcdef0123"
+
+func TestNewOriginVerifier(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte(testOriginSecret+"\n"), 0600)
+	shortFile := filepath.Join(dir, "short")
+	os.WriteFile(shortFile, []byte("short\n"), 0600)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, []byte(cert1PEM), 0600)
+	notPEMFile := filepath.Join(dir, "bad.pem")
+	os.WriteFile(notPEMFile, []byte(badSyntax), 0600)
+
+	if v, err := newOriginVerifier(defaultOriginSecretHeader, "", ""); v != nil || err != nil {
+		t.Errorf("no options: got %v, %v", v, err)
+	}
+	for _, test := range []struct {
+		header, secretFile, caFile string
+		ok                         bool
+	}{
+		{defaultOriginSecretHeader, secretFile, "", true},
+		{defaultOriginSecretHeader, "", caFile, true},
+		{"x-cdn-secret", secretFile, caFile, true},
+		{defaultOriginSecretHeader, shortFile, "", false},
+		{"", secretFile, "", false},
+		{defaultOriginSecretHeader, filepath.Join(dir, "missing"), "", false},
+		{defaultOriginSecretHeader, "", notPEMFile, false},
+	} {
+		_, err := newOriginVerifier(test.header, test.secretFile, test.caFile)
+		if (err == nil) != test.ok {
+			t.Errorf("%q %q %q: got %v", test.header, test.secretFile, test.caFile, err)
+		}
+	}
+}
+
+func TestOriginVerifierVerified(t *testing.T) {
+	cert := mustLoadCertificate([]byte(cert1PEM), []byte(key1PEM))
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	verifiedTLS := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+
+	secretOnly := &originVerifier{header: "X-Origin-Verify", secret: testOriginSecret}
+	certOnly := &originVerifier{clientCAs: pool}
+	both := &originVerifier{header: "X-Origin-Verify", secret: testOriginSecret, clientCAs: pool}
+	for _, test := range []struct {
+		v       *originVerifier
+		secrets []string
+		tls     *tls.ConnectionState
+		ok      bool
+	}{
+		{nil, nil, nil, true},
+		{secretOnly, []string{testOriginSecret}, nil, true},
+		{secretOnly, nil, nil, false},
+		{secretOnly, []string{"wrong"}, nil, false},
+		{secretOnly, []string{testOriginSecret, testOriginSecret}, nil, false},
+		{certOnly, nil, verifiedTLS, true},
+		{certOnly, nil, &tls.ConnectionState{}, false},
+		{certOnly, nil, nil, false},
+		{both, []string{testOriginSecret}, verifiedTLS, true},
+		{both, nil, verifiedTLS, false},
+		{both, []string{testOriginSecret}, nil, false},
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		for _, secret := range test.secrets {
+			req.Header.Add("X-Origin-Verify", secret)
+		}
+		req.TLS = test.tls
+		if got := test.v.Verified(req); got != test.ok {
+			t.Errorf("%+v secrets %q TLS %v: got %v", test.v, test.secrets, test.tls != nil, got)
+		}
+	}
+}
+
+// Transport requests that didn't come through the CDN are answered like any
+// other unexpected request.
+func TestServeHTTPOriginVerify(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.EchoSecret = testEchoSecret
+	defer func() { originVerify = nil }()
+	originVerify = &originVerifier{header: "X-Origin-Verify", secret: testOriginSecret}
+	state := NewState()
+	for _, secret := range []string{"", testOriginSecret} {
+		req := echoRequest("Y2FyZ28gdHJ1Y2s", echoAuth(testEchoSecret, "Y2FyZ28gdHJ1Y2s"), []byte("hello"))
+		if secret != "" {
+			req.Header.Set("X-Origin-Verify", secret)
+		}
+		rec := httptest.NewRecorder()
+		state.ServeHTTP(rec, req)
+		expected := http.StatusBadRequest
+		if secret != "" {
+			expected = http.StatusOK
+		}
+		if rec.Code != expected {
+			t.Errorf("secret %q: status %d, expected %d", secret, rec.Code, expected)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// The code in this file has to do with the URL paths on which transport
+// requests are accepted (--paths). By default a transport request may go to
+// any path, and clients use whatever path is in their url= bridge arg. A
+// server with --paths accepts transport requests only on the listed paths,
+// like /api/v2/sync or anything under /upload/, so that clients can use paths
+// that look like a real web API's, and a transport request to any other path
+// is answered as a probe, like any other unknown request. The echo endpoint
+// and WebSocket upgrades (see echo.go and websocket.go) are accepted under an
+// allowed path, since clients make them by appending to their url= path.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// transportPaths is a set of paths accepted for transport requests. A nil
+// *transportPaths accepts any path.
+type transportPaths struct {
+	// Paths that must match exactly.
+	exact map[string]bool
+	// Prefixes, with a final "/", of patterns ending in "/*".
+	prefixes []string
+}
+
+// Parse a comma-separated list of paths for --paths. Each is an absolute path,
+// matched exactly, or a path followed by "/*", which matches that path and
+// every path under it.
+func parseTransportPaths(s string) (*transportPaths, error) {
+	paths := &transportPaths{exact: make(map[string]bool)}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path %q does not start with \"/\"", p)
+		}
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if !strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "*") {
+				return nil, fmt.Errorf("path %q has \"*\" other than as a final element", p)
+			}
+			paths.prefixes = append(paths.prefixes, prefix)
+			// "/upload/*" matches "/upload" too; "/*" matches "/".
+			paths.exact[path.Clean(prefix)] = true
+			continue
+		}
+		if strings.Contains(p, "*") {
+			return nil, fmt.Errorf("path %q has \"*\" other than as a final element", p)
+		}
+		paths.exact[p] = true
+	}
+	if len(paths.exact) == 0 {
+		return nil, fmt.Errorf("no paths")
+	}
+	return paths, nil
+}
+
+// Is urlPath accepted for transport requests?
+func (paths *transportPaths) Allowed(urlPath string) bool {
+	if paths == nil {
+		return true
+	}
+	if paths.exact[urlPath] {
+		return true
+	}
+	for _, prefix := range paths.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is urlPath, the path of an echo or WebSocket request, under a path accepted
+// for transport requests? Clients append the last path element to their
+// transport path.
+func (paths *transportPaths) AllowedParent(urlPath string) bool {
+	return paths.Allowed(path.Dir(urlPath)) || paths.Allowed(path.Dir(urlPath)+"/")
+}
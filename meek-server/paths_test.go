@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTransportPaths(t *testing.T) {
+	for _, s := range []string{"", " , ", "api", "/api/*/x", "/api*", "/a,*"} {
+		if _, err := parseTransportPaths(s); err == nil {
+			t.Errorf("%q: unexpected success", s)
+		}
+	}
+}
+
+func TestTransportPathsAllowed(t *testing.T) {
+	var paths *transportPaths
+	if !paths.Allowed("/anything") || !paths.AllowedParent("/anything/echo") {
+		t.Errorf("nil set rejected a path")
+	}
+	paths, err := parseTransportPaths("/api/v2/sync, /upload/*, /slash/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path         string
+		allowed      bool
+		parentAllows bool
+	}{
+		{"/api/v2/sync", true, false},
+		{"/api/v2/sync/", false, true},
+		{"/api/v2/sync/echo", false, true},
+		{"/api/v2/syncx", false, false},
+		{"/upload", true, false},
+		{"/upload/", true, true},
+		{"/upload/x/y", true, true},
+		{"/uploads", false, false},
+		{"/slash/", true, true},
+		{"/slash/ws", false, true},
+		{"/", false, false},
+		{"/echo", false, false},
+	} {
+		if got := paths.Allowed(test.path); got != test.allowed {
+			t.Errorf("%s: Allowed %v", test.path, got)
+		}
+		if got := paths.AllowedParent(test.path); got != test.parentAllows {
+			t.Errorf("%s: AllowedParent %v", test.path, got)
+		}
+	}
+}
+
+// Transport requests to a path not in --paths get the decoy.
+func TestServeHTTPTransportPaths(t *testing.T) {
+	saved := options.TransportPaths
+	defer func() { options.TransportPaths = saved }()
+	options.TransportPaths, _ = parseTransportPaths("/api/v2/sync")
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	state.shard(sessionID).sessions.Store(sessionID, NewSession(c1))
+
+	req := newCloseRequest(sessionID)
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK || state.lookupSession(sessionID) == nil {
+		t.Errorf("path not in --paths: status %d", rec.Code)
+	}
+
+	req = newCloseRequest(sessionID)
+	req.URL.Path = "/api/v2/sync"
+	rec = httptest.NewRecorder()
+	state.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || state.lookupSession(sessionID) != nil {
+		t.Errorf("path in --paths: status %d", rec.Code)
+	}
+}
+
+func FuzzTransportPaths(f *testing.F) {
+	f.Add("/meek", "/meek")
+	f.Add("/api/*,/x", "/api/v1")
+	f.Add("/*", "/")
+	f.Add("/a/*", "/a")
+	f.Add("/a/*", "/a/../b")
+	f.Add("api", "/api")
+	f.Add("/a*b", "/ab")
+	f.Fuzz(func(t *testing.T, spec, urlPath string) {
+		paths, err := parseTransportPaths(spec)
+		if err != nil {
+			return
+		}
+		for _, p := range strings.Split(spec, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" && !strings.HasSuffix(p, "*") && !paths.Allowed(p) {
+				t.Fatalf("%q: listed path %q not allowed", spec, p)
+			}
+		}
+		// Every pattern is absolute.
+		if paths.Allowed(urlPath) && !strings.HasPrefix(urlPath, "/") {
+			t.Fatalf("%q: relative path %q allowed", spec, urlPath)
+		}
+		paths.AllowedParent(urlPath)
+	})
+}
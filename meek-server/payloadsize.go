@@ -0,0 +1,56 @@
+package main
+
+// The code in this file has to do with negotiating the payload size: the
+// largest request body a client sends and the largest response body the
+// server sends. A client that can adapt says so by sending, in the
+// X-Payload-Size header, the largest response body it can take. The server
+// answers, in the same header of its response, with the size to use in both
+// directions: the smaller of the client's figure and --payload-size. A client
+// that doesn't send the header gets responses no larger than the historical
+// 64 KiB (maxPayloadLength), and request bodies of that size are always
+// accepted, whatever --payload-size is.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	payloadSizeHeader = "X-Payload-Size"
+	// The range of --payload-size.
+	minPayloadSize = 1024
+	maxPayloadSize = 1 << 20
+)
+
+// Check a --payload-size value.
+func checkPayloadSize(size int) error {
+	if size < minPayloadSize || size > maxPayloadSize {
+		return fmt.Errorf("%d is not between %d and %d", size, minPayloadSize, maxPayloadSize)
+	}
+	return nil
+}
+
+// Return the payload size for a request, given the server's preferred size (0
+// meaning maxPayloadLength), and whether the client asked for a size (and so
+// should be told the result).
+func negotiatePayloadSize(req *http.Request, preferred int) (int, bool) {
+	if preferred <= 0 {
+		preferred = maxPayloadLength
+	}
+	values := req.Header[payloadSizeHeader]
+	if len(values) != 1 {
+		return min(preferred, maxPayloadLength), false
+	}
+	clientSize, err := strconv.Atoi(values[0])
+	if err != nil || clientSize < minPayloadSize {
+		return min(preferred, maxPayloadLength), false
+	}
+	return min(preferred, clientSize), true
+}
+
+// Return the largest request body to accept from a client using the given
+// payload size.
+func requestBodyLimit(size int) int64 {
+	return int64(max(size, maxPayloadLength))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiatePayloadSize(t *testing.T) {
+	for _, test := range []struct {
+		header    string
+		preferred int
+		size      int
+		advertise bool
+	}{
+		// Clients that don't negotiate get at most maxPayloadLength.
+		{"", 0, maxPayloadLength, false},
+		{"", 1 << 20, maxPayloadLength, false},
+		{"", 4096, 4096, false},
+		{"junk", 1 << 20, maxPayloadLength, false},
+		{"100", 1 << 20, maxPayloadLength, false},
+		// Otherwise the smaller of the two.
+		{"1048576", 0, maxPayloadLength, true},
+		{"1048576", 262144, 262144, true},
+		{"8192", 262144, 8192, true},
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		if test.header != "" {
+			req.Header.Set(payloadSizeHeader, test.header)
+		}
+		size, advertise := negotiatePayloadSize(req, test.preferred)
+		if size != test.size || advertise != test.advertise {
+			t.Errorf("%q, %d: got %d, %v, expected %d, %v", test.header, test.preferred, size, advertise, test.size, test.advertise)
+		}
+	}
+	// Bodies of maxPayloadLength are always accepted.
+	if requestBodyLimit(4096) != maxPayloadLength || requestBodyLimit(1<<20) != 1<<20 {
+		t.Errorf("request body limits %d, %d", requestBodyLimit(4096), requestBodyLimit(1<<20))
+	}
+}
+
+func TestCheckPayloadSize(t *testing.T) {
+	for _, size := range []int{minPayloadSize, maxPayloadLength, maxPayloadSize} {
+		if err := checkPayloadSize(size); err != nil {
+			t.Errorf("%d: %v", size, err)
+		}
+	}
+	for _, size := range []int{0, minPayloadSize - 1, maxPayloadSize + 1} {
+		if err := checkPayloadSize(size); err == nil {
+			t.Errorf("%d: no error", size)
+		}
+	}
+}
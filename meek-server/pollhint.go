@@ -0,0 +1,100 @@
+package main
+
+// The code in this file implements poll hints (--poll-hints). A client has to
+// poll for data from the server, and without help it can only guess how long
+// to wait between polls from whether its own recent polls were empty. With
+// poll hints, every transport response carries an X-Poll-Hint header saying,
+// in milliseconds, how long the client should wait before its next empty
+// poll. A response that carried data in either direction says 0, to poll
+// again at once. Otherwise the hint grows with the time since the session last
+// carried data, the way a client's own backoff would. With
+// --poll-hint-rate, the server also stretches the hints of idle sessions in
+// proportion to how far the rate of transport requests from all clients is
+// above that target, so that the aggregate load it sees stays near what it
+// can handle. Sessions with data to move are never slowed down.
+//
+// Separately, and whether or not --poll-hints is set, a response that is as
+// full as the payload size allows carries an X-More-Data header, because the
+// OR port most likely has more data waiting. The client then polls again at
+// once, even if it would otherwise have waited.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	pollHintHeader = "X-Poll-Hint"
+	moreDataHeader = "X-More-Data"
+	// The range of hints for an idle session, before load is taken into
+	// account.
+	minPollHint = 100 * time.Millisecond
+	maxPollHint = 5 * time.Second
+	// The longest hint under load.
+	maxLoadedPollHint = 30 * time.Second
+)
+
+// rateMeter counts events per second. It is safe for concurrent use.
+type rateMeter struct {
+	now func() time.Time
+
+	lock sync.Mutex
+	// The current second, the count in it, and the count in the second
+	// before.
+	second int64
+	count  int
+	last   int
+}
+
+// The rate of transport requests, for --poll-hint-rate.
+var transportRequestRate = newRateMeter()
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{now: time.Now}
+}
+
+// Move to the current second. Must be called with the lock held.
+func (m *rateMeter) advance() {
+	sec := m.now().Unix()
+	if sec == m.second {
+		return
+	}
+	if sec == m.second+1 {
+		m.last = m.count
+	} else {
+		m.last = 0
+	}
+	m.second = sec
+	m.count = 0
+}
+
+// Count an event.
+func (m *rateMeter) Add() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.advance()
+	m.count++
+}
+
+// Return the number of events in the last complete second.
+func (m *rateMeter) Rate() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.advance()
+	return m.last
+}
+
+// Return the poll hint for a response. active is whether the request or
+// response carried data; idle is how long the session had gone without data
+// before the request; rate is the current rate of transport requests, and
+// target is the --poll-hint-rate (0 for no target).
+func pollHint(active bool, idle time.Duration, rate int, target float64) time.Duration {
+	if active {
+		return 0
+	}
+	hint := min(max(idle/2, minPollHint), maxPollHint)
+	if target > 0 && float64(rate) > target {
+		hint = min(time.Duration(float64(hint)*float64(rate)/target), maxLoadedPollHint)
+	}
+	return hint
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPollHint(t *testing.T) {
+	for _, test := range []struct {
+		active   bool
+		idle     time.Duration
+		rate     int
+		target   float64
+		expected time.Duration
+	}{
+		{true, time.Hour, 1000, 10, 0},
+		{false, 0, 0, 0, minPollHint},
+		{false, 2 * time.Second, 0, 0, time.Second},
+		{false, time.Hour, 0, 0, maxPollHint},
+		// Load at or under the target changes nothing.
+		{false, 2 * time.Second, 100, 100, time.Second},
+		{false, 2 * time.Second, 300, 100, 3 * time.Second},
+		{false, time.Hour, 10000, 100, maxLoadedPollHint},
+		// Without a target, load is ignored.
+		{false, 2 * time.Second, 10000, 0, time.Second},
+	} {
+		hint := pollHint(test.active, test.idle, test.rate, test.target)
+		if hint != test.expected {
+			t.Errorf("%+v: got %v", test, hint)
+		}
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	m := newRateMeter()
+	m.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		m.Add()
+	}
+	if rate := m.Rate(); rate != 0 {
+		t.Errorf("rate %d during the first second", rate)
+	}
+	now = now.Add(time.Second)
+	m.Add()
+	if rate := m.Rate(); rate != 5 {
+		t.Errorf("rate %d, expected 5", rate)
+	}
+	// After a gap, the rate is 0.
+	now = now.Add(3 * time.Second)
+	if rate := m.Rate(); rate != 0 {
+		t.Errorf("rate %d after a gap", rate)
+	}
+}
+
+// Test the X-Poll-Hint and X-More-Data headers of transact.
+func TestTransactHints(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.PollHints = true
+
+	client, or := net.Pipe()
+	defer client.Close()
+	defer or.Close()
+	session := NewSession(client)
+	go func() {
+		// More than fits in one response.
+		or.Write(make([]byte, maxPayloadLength+100))
+	}()
+
+	rec := httptest.NewRecorder()
+	err := transact(session, rec, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.Len() != maxPayloadLength || rec.Header().Get(moreDataHeader) != "1" || rec.Header().Get(pollHintHeader) != "0" {
+		t.Errorf("full response: %d bytes, headers %v", rec.Body.Len(), rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	err = transact(session, rec, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.Len() != 100 || rec.Header().Get(moreDataHeader) != "" {
+		t.Errorf("last response: %d bytes, headers %v", rec.Body.Len(), rec.Header())
+	}
+
+	// An empty poll gets a nonzero hint.
+	rec = httptest.NewRecorder()
+	err = transact(session, rec, httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hint := rec.Header().Get(pollHintHeader); hint == "" || hint == "0" {
+		t.Errorf("empty poll: hint %q", hint)
+	}
+}
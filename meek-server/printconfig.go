@@ -0,0 +1,97 @@
+package main
+
+// The code in this file implements --print-config, which prints the effective
+// configuration as JSON and exits, without opening any sockets. The output
+// has the value of every option (given on the command line or not), the
+// pluggable transport environment variables as the server would see them
+// (including those it sets itself from --port, --transports, and
+// --external-service), and the TLS mode. Options that conflict cause a
+// nonzero exit instead: those checked at startup (which exit before this
+// point), and the combinations of TLS options.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The effective configuration, as printed by --print-config.
+type effectiveConfig struct {
+	// Every option, by name, in its flag.Value string form.
+	Options map[string]string `json:"options"`
+	// The TOR_PT_* environment variables.
+	Environment map[string]string `json:"environment"`
+	// The way TLS is set up: "disabled", "files", or "acme".
+	TLS string `json:"tls"`
+}
+
+// Return the environment variables that main sets for pt.ServerSetup: the
+// method names and listening addresses from --port and --transports, and the
+// OR port from --external-service or the built-in SOCKS service on socksPort.
+func serverPTEnv(port int, transports []serverTransport, socksPort, externalService string) map[string]string {
+	orPort := externalService
+	if orPort == "" {
+		orPort = "127.0.0.1:" + socksPort
+	}
+	names, bindaddrs := serverTransportsEnv(port, transports)
+	return map[string]string{
+		"TOR_PT_SERVER_TRANSPORTS": names,
+		"TOR_PT_SERVER_BINDADDR":   bindaddrs,
+		"TOR_PT_ORPORT":            orPort,
+	}
+}
+
+// Gather the effective configuration from flags, the environment, and cfg.
+// Returns an error if the TLS options conflict.
+func makeEffectiveConfig(flags *flag.FlagSet, environ []string, cfg *checkConfig) (*effectiveConfig, error) {
+	mode, err := tlsMode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	config := &effectiveConfig{
+		Options:     make(map[string]string),
+		Environment: make(map[string]string),
+		TLS:         mode,
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		config.Options[f.Name] = f.Value.String()
+	})
+	// print-config itself is not part of the configuration.
+	delete(config.Options, "print-config")
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(name, "TOR_PT_") {
+			config.Environment[name] = value
+		}
+	}
+	for name, value := range serverPTEnv(cfg.Port, cfg.Transports, cfg.SocksPort, cfg.ExternalService) {
+		config.Environment[name] = value
+	}
+	return config, nil
+}
+
+// Write the effective configuration as JSON to w, or an error to errW. Returns
+// the exit status.
+func printConfig(w, errW io.Writer, flags *flag.FlagSet, environ []string, cfg *checkConfig) int {
+	config, err := makeEffectiveConfig(flags, environ, cfg)
+	if err != nil {
+		fmt.Fprintf(errW, "configuration error: %s\n", err)
+		return 1
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(config)
+	if err != nil {
+		fmt.Fprintf(errW, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Print the effective configuration to stdout. Returns the exit status.
+func printConfigMain(cfg *checkConfig) int {
+	return printConfig(os.Stdout, os.Stderr, flag.CommandLine, os.Environ(), cfg)
+}
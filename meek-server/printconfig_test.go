@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	flags := flag.NewFlagSet("meek-server", flag.ContinueOnError)
+	flags.Bool("disable-tls", false, "")
+	flags.Int("port", 4455, "")
+	flags.Bool("print-config", false, "")
+	if err := flags.Parse([]string{"--disable-tls", "--port=8080", "--print-config"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"HOME=/root", "TOR_PT_STATE_LOCATION=/var/lib/meek", "TOR_PT_ORPORT=192.0.2.1:9001"}
+	cfg := &checkConfig{DisableTLS: true, Port: 8080, SocksPort: "1080"}
+
+	var out, errOut bytes.Buffer
+	if status := printConfig(&out, &errOut, flags, environ, cfg); status != 0 {
+		t.Fatalf("status %d: %s", status, errOut.String())
+	}
+	var config effectiveConfig
+	if err := json.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.TLS != tlsModeDisabled {
+		t.Errorf("TLS mode %q", config.TLS)
+	}
+	if config.Options["disable-tls"] != "true" || config.Options["port"] != "8080" {
+		t.Errorf("options %v", config.Options)
+	}
+	if _, ok := config.Options["print-config"]; ok {
+		t.Errorf("print-config in options")
+	}
+	// Only TOR_PT_ variables, with those that main sets overriding the
+	// environment.
+	expected := map[string]string{
+		"TOR_PT_STATE_LOCATION":    "/var/lib/meek",
+		"TOR_PT_ORPORT":            "127.0.0.1:1080",
+		"TOR_PT_SERVER_TRANSPORTS": "meek",
+		"TOR_PT_SERVER_BINDADDR":   "meek-0.0.0.0:8080",
+	}
+	if len(config.Environment) != len(expected) {
+		t.Errorf("environment %v", config.Environment)
+	}
+	for name, value := range expected {
+		if config.Environment[name] != value {
+			t.Errorf("%s=%q, expected %q", name, config.Environment[name], value)
+		}
+	}
+}
+
+func TestPrintConfigConflict(t *testing.T) {
+	flags := flag.NewFlagSet("meek-server", flag.ContinueOnError)
+	for _, cfg := range []*checkConfig{
+		{DisableTLS: true, CertFilename: "cert.pem", KeyFilename: "key.pem"},
+		{DisableTLS: true, ECHPublicName: "public.example.com"},
+		{CertFilename: "cert.pem", ACMEHostnames: []string{"meek.example.com"}},
+		{CertFilename: "cert.pem"},
+		{},
+	} {
+		var out, errOut bytes.Buffer
+		if status := printConfig(&out, &errOut, flags, nil, cfg); status == 0 {
+			t.Errorf("%+v: status 0", cfg)
+		}
+		if out.Len() != 0 || !strings.Contains(errOut.String(), "configuration error") {
+			t.Errorf("%+v: output %q, error %q", cfg, out.String(), errOut.String())
+		}
+	}
+}
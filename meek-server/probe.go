@@ -0,0 +1,99 @@
+package main
+
+// The code in this file decides how to answer requests that are not valid
+// transport requests, like a POST without a session id or with an unknown
+// method: the kind of request an active prober sends. The default plain-text
+// 400 "Bad request." is particular to this server, so the --probe-response
+// option offers other answers that blend in with an ordinary web server:
+//	bad-request: the plain-text 400 (the default).
+//	not-found:   a 404 with an HTML body, the 404.html of --mask-dir or
+//	             --mask-template if there is one, otherwise a page like
+//	             nginx's.
+//	close:       no response; the connection (or HTTP/2 stream) is reset.
+//	redirect:    a 301 to the --redirect location.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	probeResponseBadRequest = "bad-request"
+	probeResponseNotFound   = "not-found"
+	probeResponseClose      = "close"
+	probeResponseRedirect   = "redirect"
+)
+
+// The name of a custom 404 page in --mask-dir.
+const probeNotFoundName = "404.html"
+
+// The 404 page used when --mask-dir doesn't have one.
+const probeNotFoundBody = "<html>\r\n" +
+	"<head><title>404 Not Found</title></head>\r\n" +
+	"<body>\r\n" +
+	"<center><h1>404 Not Found</h1></center>\r\n" +
+	"<hr><center>nginx</center>\r\n" +
+	"</body>\r\n" +
+	"</html>\r\n"
+
+// Check a --probe-response value. redirect is the --redirect location, which
+// the redirect policy needs.
+func checkProbeResponse(policy, redirect string) error {
+	switch policy {
+	case probeResponseBadRequest, probeResponseNotFound, probeResponseClose:
+	case probeResponseRedirect:
+		if redirect == "" {
+			return fmt.Errorf("%q requires --redirect", policy)
+		}
+	default:
+		return fmt.Errorf("unknown probe response %q; must be %q, %q, %q, or %q", policy,
+			probeResponseBadRequest, probeResponseNotFound, probeResponseClose, probeResponseRedirect)
+	}
+	return nil
+}
+
+// Return the probe response policy for req: that of the transport method of
+// its listener, if the method has one (see transports.go), otherwise
+// options.ProbeResponse.
+func probeResponsePolicy(req *http.Request) string {
+	if t := transportConfig(methodName(req)); t != nil && t.ProbeResponse != "" {
+		return t.ProbeResponse
+	}
+	return options.ProbeResponse
+}
+
+// Answer an invalid transport request according to probeResponsePolicy.
+// A POST to a login page of --mask-well-known gets the site's answer instead.
+func serveProbeResponse(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" && options.MaskWellKnown != "" && serveWellKnown(w, req, options.MaskWellKnown, maskFileSystem()) {
+		return
+	}
+	switch probeResponsePolicy(req) {
+	case probeResponseNotFound:
+		w.Header().Set("Content-Type", "text/html")
+		body := []byte(probeNotFoundBody)
+		if fsys := maskFileSystem(); fsys != nil {
+			f, err := fsys.Open("/" + probeNotFoundName)
+			if err == nil {
+				data, err := io.ReadAll(f)
+				f.Close()
+				if err == nil {
+					body = data
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		if req.Method != "HEAD" {
+			w.Write(body)
+		}
+	case probeResponseClose:
+		// Makes net/http drop the connection, or reset the stream
+		// in HTTP/2, without writing a response.
+		panic(http.ErrAbortHandler)
+	case probeResponseRedirect:
+		http.Redirect(w, req, options.MaskRedirect, http.StatusMovedPermanently)
+	default:
+		httpBadRequest(w)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckProbeResponse(t *testing.T) {
+	for _, policy := range []string{probeResponseBadRequest, probeResponseNotFound, probeResponseClose} {
+		if err := checkProbeResponse(policy, ""); err != nil {
+			t.Errorf("%q: %v", policy, err)
+		}
+	}
+	if err := checkProbeResponse(probeResponseRedirect, "https://example.com/"); err != nil {
+		t.Errorf("redirect: %v", err)
+	}
+	if err := checkProbeResponse(probeResponseRedirect, ""); err == nil {
+		t.Errorf("redirect without a location: no error")
+	}
+	if err := checkProbeResponse("teapot", ""); err == nil {
+		t.Errorf("unknown policy: no error")
+	}
+}
+
+// Send a POST without a session id, which is not a valid transport request.
+func probeRequest() *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	NewState().ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	return rec
+}
+
+func TestServeProbeResponse(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	options.ProbeResponse = probeResponseBadRequest
+	if rec := probeRequest(); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad-request: status %d", rec.Code)
+	}
+
+	options.ProbeResponse = probeResponseNotFound
+	rec := probeRequest()
+	if rec.Code != http.StatusNotFound || rec.Body.String() != probeNotFoundBody {
+		t.Errorf("not-found: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, probeNotFoundName), []byte("custom 404"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options.MaskDir = dir
+	if rec := probeRequest(); rec.Code != http.StatusNotFound || rec.Body.String() != "custom 404" {
+		t.Errorf("not-found with --mask-dir: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	options.ProbeResponse = probeResponseRedirect
+	options.MaskRedirect = "https://example.com/"
+	rec = probeRequest()
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != options.MaskRedirect {
+		t.Errorf("redirect: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	options.ProbeResponse = probeResponseClose
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("close: recovered %v, expected %v", r, http.ErrAbortHandler)
+			}
+		}()
+		probeRequest()
+	}()
+}
+
+// Test that --probe-response=not-found uses the 404 page of --mask-template.
+func TestServeProbeResponseTemplate(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.ProbeResponse = probeResponseNotFound
+	options.MaskTemplate = "company"
+	defer func() { maskTemplateDir = "" }()
+	defer os.RemoveAll(useMaskTemplate(t, "company"))
+	rec := probeRequest()
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "Page not found") {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
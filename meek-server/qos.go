@@ -0,0 +1,180 @@
+package main
+
+// The code in this file implements QoS classes (--qos-file), which let an
+// operator give some clients better service than others on a shared bridge,
+// under the fair scheduler of --fair-rate (see fair.go). A client presents a
+// credential (the credential= SOCKS arg of meek-client), and the credential
+// names a class. The credential itself is not sent: the X-Credential header
+// has the hex HMAC-SHA256 of the session id under the credential, so that it
+// is no use to whoever sees it (a CDN, say) for any other session. The class
+// of a session is decided when the session is created, from the header of its
+// first request; a session without a credential, or with an unknown one, is in
+// the default class, if there is one, or in no class. A class has
+//	weight  the session's share in the round robin, relative to sessions
+//	        in no class, which have weight 1 (default 1)
+//	min     the fraction of --fair-rate that the class's sessions together
+//	        get ahead of everyone else, when they want it (default 0)
+//	max     the largest fraction of --fair-rate that the class's sessions
+//	        together may use, even when the server is not saturated
+//	        (default 0, meaning no limit)
+// The file, and the body of the admin API's /qos, is JSON:
+//	{
+//	  "classes": [{"name": "paid", "weight": 4, "min": 0.5}, {"name": "free", "max": 0.2}],
+//	  "credentials": {"CREDENTIAL": "paid", ...},
+//	  "default": "free"
+//	}
+// Changing the classes affects new sessions only.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// The request header with the client's credential.
+	credentialHeader = "X-Credential"
+	// The largest class weight.
+	maxQoSWeight = 100
+)
+
+// A QoS class.
+type qosClass struct {
+	Name   string  `json:"name"`
+	Weight int     `json:"weight,omitempty"`
+	Min    float64 `json:"min,omitempty"`
+	Max    float64 `json:"max,omitempty"`
+}
+
+// The classes, and the credentials that go with them.
+type qosConfig struct {
+	Classes []qosClass `json:"classes"`
+	// The class name of each credential.
+	Credentials map[string]string `json:"credentials"`
+	// The class of sessions with no known credential, or "" for none.
+	Default string `json:"default,omitempty"`
+}
+
+// qosPolicy maps credentials to classes.
+type qosPolicy struct {
+	lock   sync.RWMutex
+	config qosConfig
+	// The classes by name.
+	classes map[string]*qosClass
+}
+
+// The QoS classes for new sessions.
+var qosTable qosPolicy
+
+// Check config, and fill in default weights.
+func checkQoSConfig(config *qosConfig) error {
+	names := make(map[string]bool)
+	var minSum float64
+	for i := range config.Classes {
+		class := &config.Classes[i]
+		if class.Name == "" {
+			return fmt.Errorf("class %d has no name", i)
+		}
+		if names[class.Name] {
+			return fmt.Errorf("duplicate class %q", class.Name)
+		}
+		names[class.Name] = true
+		if class.Weight == 0 {
+			class.Weight = 1
+		}
+		if class.Weight < 1 || class.Weight > maxQoSWeight {
+			return fmt.Errorf("class %q: weight %d is not between 1 and %d", class.Name, class.Weight, maxQoSWeight)
+		}
+		if class.Min < 0 || class.Min > 1 || class.Max < 0 || class.Max > 1 {
+			return fmt.Errorf("class %q: min and max must be between 0 and 1", class.Name)
+		}
+		if class.Max > 0 && class.Max < class.Min {
+			return fmt.Errorf("class %q: max %g is less than min %g", class.Name, class.Max, class.Min)
+		}
+		minSum += class.Min
+	}
+	if minSum > 1 {
+		return fmt.Errorf("the min shares add up to %g, more than 1", minSum)
+	}
+	for credential, name := range config.Credentials {
+		if credential == "" {
+			return fmt.Errorf("empty credential")
+		}
+		if !names[name] {
+			return fmt.Errorf("credential for unknown class %q", name)
+		}
+	}
+	if config.Default != "" && !names[config.Default] {
+		return fmt.Errorf("unknown default class %q", config.Default)
+	}
+	return nil
+}
+
+// Replace the classes and credentials. If config is bad, nothing is changed.
+func (p *qosPolicy) Set(config qosConfig) error {
+	err := checkQoSConfig(&config)
+	if err != nil {
+		return err
+	}
+	classes := make(map[string]*qosClass, len(config.Classes))
+	for i := range config.Classes {
+		// Sessions keep pointers to these, so they are copies that
+		// don't change when the policy does.
+		class := config.Classes[i]
+		classes[class.Name] = &class
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = config
+	p.classes = classes
+	return nil
+}
+
+func (p *qosPolicy) Get() qosConfig {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.config
+}
+
+// Return the X-Credential value that proves credential for the session
+// sessionID.
+func credentialProof(credential, sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(credential))
+	mac.Write([]byte(sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the class of the session sessionID, whose X-Credential header is proof
+// (which may be ""), or nil if it is in no class.
+func (p *qosPolicy) Class(proof, sessionID string) *qosClass {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	name := p.config.Default
+	if proof != "" {
+		for credential, class := range p.config.Credentials {
+			if tokenMatches(proof, credentialProof(credential, sessionID)) {
+				name = class
+				break
+			}
+		}
+	}
+	return p.classes[name]
+}
+
+// Read a --qos-file.
+func readQoSFile(path string) (qosConfig, error) {
+	var config qosConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+	return config, checkQoSConfig(&config)
+}
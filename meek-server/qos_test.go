@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckQoSConfig(t *testing.T) {
+	good := qosConfig{
+		Classes:     []qosClass{{Name: "paid", Weight: 4, Min: 0.5}, {Name: "free", Max: 0.2}},
+		Credentials: map[string]string{"secret": "paid"},
+		Default:     "free",
+	}
+	if err := checkQoSConfig(&good); err != nil {
+		t.Fatal(err)
+	}
+	if good.Classes[1].Weight != 1 {
+		t.Errorf("default weight %d", good.Classes[1].Weight)
+	}
+
+	for _, config := range []qosConfig{
+		{Classes: []qosClass{{}}},
+		{Classes: []qosClass{{Name: "a"}, {Name: "a"}}},
+		{Classes: []qosClass{{Name: "a", Weight: -1}}},
+		{Classes: []qosClass{{Name: "a", Weight: maxQoSWeight + 1}}},
+		{Classes: []qosClass{{Name: "a", Min: 1.5}}},
+		{Classes: []qosClass{{Name: "a", Min: 0.5, Max: 0.25}}},
+		{Classes: []qosClass{{Name: "a", Min: 0.6}, {Name: "b", Min: 0.6}}},
+		{Classes: []qosClass{{Name: "a"}}, Credentials: map[string]string{"secret": "b"}},
+		{Classes: []qosClass{{Name: "a"}}, Credentials: map[string]string{"": "a"}},
+		{Classes: []qosClass{{Name: "a"}}, Default: "b"},
+	} {
+		if err := checkQoSConfig(&config); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
+
+func TestQoSPolicyClass(t *testing.T) {
+	var p qosPolicy
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	if class := p.Class(credentialProof("secret", sessionID), sessionID); class != nil {
+		t.Errorf("empty policy: got %+v", class)
+	}
+	err := p.Set(qosConfig{
+		Classes:     []qosClass{{Name: "paid", Weight: 4}, {Name: "free"}},
+		Credentials: map[string]string{"secret": "paid"},
+		Default:     "free",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		proof, class string
+	}{
+		{credentialProof("secret", sessionID), "paid"},
+		{credentialProof("wrong", sessionID), "free"},
+		// The proof for another session, and the credential itself.
+		{credentialProof("secret", "other session"), "free"},
+		{"secret", "free"},
+		{"", "free"},
+	} {
+		class := p.Class(test.proof, sessionID)
+		if class == nil || class.Name != test.class {
+			t.Errorf("%q: got %+v, expected %q", test.proof, class, test.class)
+		}
+	}
+
+	// Sessions keep the class they had.
+	paid := p.Class(credentialProof("secret", sessionID), sessionID)
+	if err := p.Set(qosConfig{Classes: []qosClass{{Name: "paid", Weight: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if paid.Weight != 4 {
+		t.Errorf("old class changed to weight %d", paid.Weight)
+	}
+	if class := p.Class(credentialProof("secret", sessionID), sessionID); class != nil {
+		t.Errorf("removed credential: got %+v", class)
+	}
+
+	if err := p.Set(qosConfig{Classes: []qosClass{{Name: "a"}}, Default: "b"}); err == nil {
+		t.Errorf("bad config accepted")
+	}
+	if len(p.Get().Classes) != 1 || p.Get().Classes[0].Name != "paid" {
+		t.Errorf("bad config changed the policy: %+v", p.Get())
+	}
+}
+
+func TestReadQoSFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qos.json")
+	os.WriteFile(path, []byte(`{"classes": [{"name": "paid", "min": 0.5}], "credentials": {"secret": "paid"}}`), 0600)
+	config, err := readQoSFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Classes) != 1 || config.Classes[0].Min != 0.5 || config.Credentials["secret"] != "paid" {
+		t.Errorf("got %+v", config)
+	}
+	os.WriteFile(path, []byte(`{"classes": [{"name": "paid", "min": 2}]}`), 0600)
+	if _, err := readQoSFile(path); err == nil {
+		t.Errorf("bad file accepted")
+	}
+}
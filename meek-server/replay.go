@@ -0,0 +1,123 @@
+package main
+
+// The code in this file keeps a cache of the ids of recently closed sessions
+// (--session-replay-window). Without it, a request with the id of a session
+// that has closed or expired creates a new session, so anyone who captured a
+// client's session id could replay it later to open a fresh backend
+// connection that looks like part of the original client's session. With the
+// cache, such a request gets a decoy response instead. Real clients never
+// reuse a session id: meek-client makes a new random one for every session.
+//
+// The cache has two generations, which change places every window: an id is
+// remembered for at least one window and at most two. Only a hash of each id
+// is kept, with a random seed. So that a flood of short sessions can't use up
+// memory, the cache holds at most --session-replay-max ids, half of them in
+// each generation; a generation that fills up is retired early, and ids are
+// then remembered for less than a window. A remembered id takes about 40
+// bytes, so the default limit comes to about 80 MB.
+
+import (
+	"errors"
+	"hash/maphash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default of --session-replay-max, the most ids in both generations of the
+// cache together.
+const defaultReplayCacheMax = 2 << 20
+
+// Returned by GetSession for the id of a recently closed session.
+var errSessionReplayed = errors.New("session id was recently closed; refusing to reopen it")
+
+// replayCache remembers recently closed session ids. A nil *replayCache
+// remembers nothing.
+type replayCache struct {
+	window time.Duration
+	// The most ids in one generation.
+	max  int
+	seed maphash.Seed
+
+	lock     sync.Mutex
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	// When current became the current generation.
+	started time.Time
+}
+
+// The cache of closed session ids, or nil if it is disabled. Set up in main.
+var closedSessions *replayCache
+
+// Make a replayCache that remembers at most max ids for window. Returns nil if
+// window is 0.
+func newReplayCache(window time.Duration, max int, now time.Time) *replayCache {
+	if window <= 0 {
+		return nil
+	}
+	return &replayCache{
+		window:   window,
+		max:      (max + 1) / 2,
+		seed:     maphash.MakeSeed(),
+		current:  make(map[uint64]struct{}),
+		previous: make(map[uint64]struct{}),
+		started:  now,
+	}
+}
+
+// Return the session id part of a session map key (see sessionKey).
+func replayID(key string) string {
+	id, _, _ := strings.Cut(key, "@")
+	return id
+}
+
+// Retire the current generation if it is a window old or full. Must be called
+// with rc.lock held.
+func (rc *replayCache) rotateLocked(now time.Time) {
+	if now.Sub(rc.started) >= 2*rc.window {
+		// Both generations are too old.
+		rc.previous = make(map[uint64]struct{})
+		rc.current = make(map[uint64]struct{})
+		rc.started = now
+	} else if now.Sub(rc.started) >= rc.window || len(rc.current) >= rc.max {
+		rc.previous = rc.current
+		rc.current = make(map[uint64]struct{})
+		rc.started = now
+	}
+}
+
+// Remember that the session stored under key was closed.
+func (rc *replayCache) Add(key string, now time.Time) {
+	if rc == nil {
+		return
+	}
+	h := maphash.String(rc.seed, replayID(key))
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.rotateLocked(now)
+	rc.current[h] = struct{}{}
+}
+
+// Return whether a session stored under key was closed recently.
+func (rc *replayCache) Seen(key string, now time.Time) bool {
+	if rc == nil {
+		return false
+	}
+	h := maphash.String(rc.seed, replayID(key))
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.rotateLocked(now)
+	_, inCurrent := rc.current[h]
+	_, inPrevious := rc.previous[h]
+	return inCurrent || inPrevious
+}
+
+// Return the number of ids remembered.
+func (rc *replayCache) Len() int {
+	if rc == nil {
+		return 0
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return len(rc.current) + len(rc.previous)
+}
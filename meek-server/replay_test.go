@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	rc := newReplayCache(time.Hour, 100, now)
+	rc.Add("Y2FyZ28gdHJ1Y2s", now)
+	if !rc.Seen("Y2FyZ28gdHJ1Y2s", now.Add(time.Minute)) {
+		t.Errorf("closed id not seen")
+	}
+	if rc.Seen("c2hpcCBvZiBmb29s", now.Add(time.Minute)) {
+		t.Errorf("other id seen")
+	}
+	// The same id under a session key of new binding mode.
+	if !rc.Seen("Y2FyZ28gdHJ1Y2s@0123456789abcdef", now.Add(time.Minute)) {
+		t.Errorf("closed id with address hash not seen")
+	}
+	// Remembered for at least a window...
+	if !rc.Seen("Y2FyZ28gdHJ1Y2s", now.Add(time.Hour+time.Minute)) {
+		t.Errorf("closed id forgotten after one window")
+	}
+	// ...and at most two.
+	if rc.Seen("Y2FyZ28gdHJ1Y2s", now.Add(2*time.Hour+2*time.Minute)) {
+		t.Errorf("closed id remembered after two windows")
+	}
+	if n := rc.Len(); n != 0 {
+		t.Errorf("%d ids remembered after two windows", n)
+	}
+}
+
+func TestReplayCacheFull(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	rc := newReplayCache(time.Hour, 4, now)
+	for _, id := range []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb", "cccccccccccc", "dddddddddddd", "eeeeeeeeeeee"} {
+		rc.Add(id, now)
+	}
+	if n := rc.Len(); n > 4 {
+		t.Errorf("%d ids remembered, expected at most 4", n)
+	}
+	if rc.Seen("aaaaaaaaaaaa", now) {
+		t.Errorf("oldest id remembered in a full cache")
+	}
+	if !rc.Seen("eeeeeeeeeeee", now) {
+		t.Errorf("newest id forgotten")
+	}
+}
+
+func TestReplayCacheNil(t *testing.T) {
+	rc := newReplayCache(0, 100, time.Now())
+	if rc != nil {
+		t.Fatalf("window 0 gave %v", rc)
+	}
+	rc.Add("Y2FyZ28gdHJ1Y2s", time.Now())
+	if rc.Seen("Y2FyZ28gdHJ1Y2s", time.Now()) || rc.Len() != 0 {
+		t.Errorf("nil cache remembered an id")
+	}
+}
+
+func TestGetSessionReplayed(t *testing.T) {
+	defer func(saved *replayCache) { closedSessions = saved }(closedSessions)
+	closedSessions = newReplayCache(time.Hour, 100, time.Now())
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	state.shard(sessionID).sessions.Store(sessionID, NewSession(c1))
+	if !state.CloseSession(sessionID, closeReasonExplicit) {
+		t.Fatalf("session not closed")
+	}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	_, err := state.GetSession(sessionID, req)
+	if err != errSessionReplayed {
+		t.Errorf("got %v, expected %v", err, errSessionReplayed)
+	}
+	if state.lookupSession(sessionID) != nil {
+		t.Errorf("replayed id reopened the session")
+	}
+}
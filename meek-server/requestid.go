@@ -0,0 +1,48 @@
+package main
+
+// The code in this file gives every HTTP request a short random correlation id,
+// so that the log lines about one round trip can be found together, and
+// matched with what was logged elsewhere. The id appears in the debug log line
+// for each request, in warnings about the request, and in session trace events
+// (see sessiontrace.go). With --request-id-header, responses from the admin API
+// (see admin.go), which only operators can reach, also carry the id of their
+// own request in an X-Request-Id header. Responses on the public listeners,
+// transport, echo, or decoy, never carry the header: a response header that
+// the site would not otherwise send would make them easier to tell apart.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// The response header that carries the correlation id.
+const requestIDHeader = "X-Request-Id"
+
+// The context key under which withRequestID stores the id.
+type requestIDContextKey struct{}
+
+// Return a new random correlation id of 8 hex digits.
+func newRequestID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Wrap handler so that every request has a correlation id in its context.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), requestIDContextKey{}, newRequestID())
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Return the correlation id of req, or "-" if it has none.
+func requestID(req *http.Request) string {
+	id, ok := req.Context().Value(requestIDContextKey{}).(string)
+	if !ok {
+		return "-"
+	}
+	return id
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var ids []string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ids = append(ids, requestID(req))
+	}))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	for _, id := range ids {
+		if !regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(id) {
+			t.Errorf("bad id %q", id)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("two requests have id %q", ids[0])
+	}
+	if id := requestID(httptest.NewRequest("GET", "/", nil)); id != "-" {
+		t.Errorf("request without an id has id %q", id)
+	}
+}
+
+// Only admin API responses carry the id, and only with --request-id-header.
+func TestRequestIDHeader(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.EchoSecret = testEchoSecret
+	handler := withRequestID(NewState())
+	admin, _ := newTestAdmin(t)
+	for _, enabled := range []bool{false, true} {
+		options.RequestIDHeader = enabled
+		for _, path := range []string{"/", "/echo"} {
+			req := httptest.NewRequest("POST", path, bytes.NewReader([]byte("hello")))
+			req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+			req.Header.Set(echoAuthHeader, echoAuth(testEchoSecret, "Y2FyZ28gdHJ1Y2s"))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Header().Get(requestIDHeader) != "" {
+				t.Errorf("--request-id-header=%v %s: header present", enabled, path)
+			}
+		}
+
+		rec := adminRequest(admin.Handler(), testAdminToken, "GET", "/version", "")
+		if got := rec.Header().Get(requestIDHeader) != ""; got != enabled {
+			t.Errorf("--request-id-header=%v admin: header present %v", enabled, got)
+		}
+	}
+}
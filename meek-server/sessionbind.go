@@ -0,0 +1,69 @@
+package main
+
+// The code in this file implements binding of sessions to client IP addresses
+// (--session-ip-binding). Without an authentication layer, anyone who learns a
+// session id can send requests in that session. With binding, a session belongs
+// to the client IP address that created it (as found by originalClientIP):
+//	off	no binding (the default)
+//	reject	requests for the session from other addresses get a decoy
+//		response
+//	new	requests from other addresses get a fresh session of their own,
+//		as if they had used a different session id
+// Binding should be used only where client addresses are stable: a client
+// whose address changes mid-session (a mobile client, or a CDN that does not
+// pass on the client address) loses its session.
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net/http"
+)
+
+const (
+	sessionIPBindingOff    = "off"
+	sessionIPBindingReject = "reject"
+	sessionIPBindingNew    = "new"
+)
+
+// Returned by GetSession in reject mode when a session is used from an address
+// other than the one that created it.
+var errSessionIPMismatch = errors.New("session used from a different client address")
+
+// Check that mode is a valid --session-ip-binding value.
+func checkSessionIPBinding(mode string) error {
+	switch mode {
+	case sessionIPBindingOff, sessionIPBindingReject, sessionIPBindingNew:
+		return nil
+	}
+	return fmt.Errorf("unknown session IP binding %q; must be %q, %q, or %q",
+		mode, sessionIPBindingOff, sessionIPBindingReject, sessionIPBindingNew)
+}
+
+// Return the client address a session is bound to, or "" if it is unknown.
+func bindingIP(req *http.Request) string {
+	ip, err := originalClientIP(req)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Return the key under which to store the session with the given id. In new
+// mode, that includes a hash of the client address (a hash, so that the key
+// can be logged).
+func (state *State) sessionKey(sessionID string, req *http.Request) string {
+	if options.SessionIPBinding != sessionIPBindingNew {
+		return sessionID
+	}
+	return fmt.Sprintf("%s@%016x", sessionID, maphash.String(state.seed, bindingIP(req)))
+}
+
+// Check a request for an existing session against the address the session is
+// bound to.
+func checkSessionBinding(session *Session, req *http.Request) error {
+	if options.SessionIPBinding == sessionIPBindingReject && bindingIP(req) != session.ClientIP {
+		return errSessionIPMismatch
+	}
+	return nil
+}
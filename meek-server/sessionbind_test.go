@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckSessionIPBinding(t *testing.T) {
+	for _, mode := range []string{"off", "reject", "new"} {
+		if err := checkSessionIPBinding(mode); err != nil {
+			t.Errorf("%q: %v", mode, err)
+		}
+	}
+	if err := checkSessionIPBinding("on"); err == nil {
+		t.Errorf("\"on\" accepted")
+	}
+}
+
+// Make a request from the address remoteAddr.
+func newBindingRequest(remoteAddr string) *http.Request {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestSessionIPBindingReject(t *testing.T) {
+	saved := options.SessionIPBinding
+	defer func() { options.SessionIPBinding = saved }()
+	options.SessionIPBinding = sessionIPBindingReject
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session := NewSession(c1)
+	session.ClientIP = "192.0.2.1"
+	state.shard(sessionID).sessions.Store(sessionID, session)
+
+	got, err := state.GetSession(sessionID, newBindingRequest("192.0.2.1:1234"))
+	if err != nil || got != session {
+		t.Errorf("same address: got %p, %v", got, err)
+	}
+	_, err = state.GetSession(sessionID, newBindingRequest("198.51.100.1:1234"))
+	if err != errSessionIPMismatch {
+		t.Errorf("other address: got %v, expected %v", err, errSessionIPMismatch)
+	}
+
+	options.SessionIPBinding = sessionIPBindingOff
+	got, err = state.GetSession(sessionID, newBindingRequest("198.51.100.1:1234"))
+	if err != nil || got != session {
+		t.Errorf("binding off: got %p, %v", got, err)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	saved := options.SessionIPBinding
+	defer func() { options.SessionIPBinding = saved }()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	req1 := newBindingRequest("192.0.2.1:1234")
+	req2 := newBindingRequest("192.0.2.1:5678")
+	req3 := newBindingRequest("198.51.100.1:1234")
+
+	options.SessionIPBinding = sessionIPBindingReject
+	if key := state.sessionKey(sessionID, req3); key != sessionID {
+		t.Errorf("reject mode: key %q", key)
+	}
+
+	options.SessionIPBinding = sessionIPBindingNew
+	key1, key2, key3 := state.sessionKey(sessionID, req1), state.sessionKey(sessionID, req2), state.sessionKey(sessionID, req3)
+	if key1 != key2 {
+		t.Errorf("same address, different keys %q %q", key1, key2)
+	}
+	if key1 == key3 {
+		t.Errorf("different addresses, same key %q", key1)
+	}
+}
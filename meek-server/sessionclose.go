@@ -0,0 +1,55 @@
+package main
+
+// The code in this file implements the in-band session close signal. When its
+// local connection ends, a client sends one last POST for the session with an
+// empty body and the header "X-Session-Close: 1". The server then closes the
+// session and its backend connection at once, rather than keeping them until
+// the session has gone unused for maxSessionStaleness. A close request never
+// creates a session, and closing a session that doesn't exist (for example,
+// one that already expired) succeeds quietly. The close is a POST rather than
+// a DELETE because not every CDN passes other methods through.
+
+import (
+	"net/http"
+
+	"../lib/logging"
+)
+
+// The request header that asks for a session to be closed.
+const sessionCloseHeader = "X-Session-Close"
+
+// Return true if req is a session close request.
+func isCloseRequest(req *http.Request) bool {
+	return req.Header.Get(sessionCloseHeader) == "1"
+}
+
+// Return the session with the given id, or nil if there is none. Unlike
+// GetSession, never creates a session.
+func (state *State) lookupSession(sessionID string) *Session {
+	shard := state.shard(sessionID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	return shard.sessions.Load(sessionID)
+}
+
+// Handle a close request for sessionID (already passed through
+// state.sessionKey).
+func (state *State) PostClose(w http.ResponseWriter, req *http.Request, sessionID string) {
+	session := state.lookupSession(sessionID)
+	if session != nil {
+		// Don't let a leaked session id be enough to close the
+		// session, when there is something more to check.
+		if err := checkSessionBinding(session, req); err != nil {
+			logging.Debugf("%s", err)
+			serveMaskMethodNotAllowed(w)
+			return
+		}
+		if err := session.token.checkToken(req, true); err != nil {
+			logging.Debugf("%s", err)
+			serveMaskMethodNotAllowed(w)
+			return
+		}
+		state.CloseSession(sessionID, closeReasonExplicit)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Make a close request for sessionID.
+func newCloseRequest(sessionID string) *http.Request {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Session-Id", sessionID)
+	req.Header.Set(sessionCloseHeader, "1")
+	return req
+}
+
+func TestPostClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	state.shard(sessionID).sessions.Store(sessionID, NewSession(c1))
+
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, newCloseRequest(sessionID))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d", rec.Code)
+	}
+	if state.lookupSession(sessionID) != nil {
+		t.Errorf("session not closed")
+	}
+	// The backend connection was closed.
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("backend read: got %v, expected %v", err, io.EOF)
+	}
+
+	// Closing an unknown session succeeds and doesn't create one.
+	rec = httptest.NewRecorder()
+	state.ServeHTTP(rec, newCloseRequest(sessionID))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unknown session: status %d", rec.Code)
+	}
+	if state.lookupSession(sessionID) != nil {
+		t.Errorf("close request created a session")
+	}
+}
+
+func TestPostCloseToken(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session := NewSession(c1)
+	session.token.token = "secret"
+	session.token.confirmed = true
+	state.shard(sessionID).sessions.Store(sessionID, session)
+
+	// Without the token, the session stays open.
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, newCloseRequest(sessionID))
+	if rec.Code == http.StatusOK || state.lookupSession(sessionID) == nil {
+		t.Errorf("closed without a token: status %d", rec.Code)
+	}
+
+	req := newCloseRequest(sessionID)
+	req.Header.Set("X-Session-Token", "secret")
+	rec = httptest.NewRecorder()
+	state.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || state.lookupSession(sessionID) != nil {
+		t.Errorf("not closed with the token: status %d", rec.Code)
+	}
+}
+
+func TestStrictCloseRequest(t *testing.T) {
+	if err := validateStrict(newCloseRequest("Y2FyZ28gdHJ1Y2s")); err != nil {
+		t.Errorf("close request rejected: %v", err)
+	}
+	req := newCloseRequest("Y2FyZ28gdHJ1Y2s")
+	req.Header.Set(sessionCloseHeader, "yes")
+	if err := validateStrict(req); err == nil {
+		t.Errorf("bad %s accepted", sessionCloseHeader)
+	}
+}
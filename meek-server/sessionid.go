@@ -0,0 +1,79 @@
+package main
+
+// The code in this file has to do with checking that session ids look like
+// the random strings that clients generate. meek-client uses 8 random bytes in
+// unpadded base64; other implementations use hex or URL-safe base64. Ids
+// outside those alphabets, or with too little variety to have been randomly
+// generated (all zeros, counters, keyboard runs), come from broken clients or
+// from scanners, and get a decoy response instead of a session.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned by checkSessionID for an id that is missing or too short, which
+// gets the response to a probe rather than a decoy.
+var errNoSessionID = errors.New("missing or short session id")
+
+// Check the value of an X-Session-Id header (or a session id from elsewhere,
+// like a DNS query). Returns errNoSessionID if it is shorter than
+// minSessionIDLength, or the error of validateSessionID.
+func checkSessionID(id string) error {
+	if len(id) < minSessionIDLength {
+		return errNoSessionID
+	}
+	return validateSessionID(id)
+}
+
+// Is c a character that may appear in a session id?
+func isSessionIDChar(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+		c == '+' || c == '/' || c == '-' || c == '_' || c == '='
+}
+
+// Check that a session id is plausibly random. Returns nil if it is, or an
+// error saying why not. The length is checked separately.
+func validateSessionID(id string) error {
+	distinct := make(map[byte]bool)
+	// Track the longest run of consecutive ascending or descending
+	// characters, like "1234" or "fedc".
+	run, longestRun := 1, 1
+	step := 0
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !isSessionIDChar(c) {
+			return fmt.Errorf("bad character %q", c)
+		}
+		distinct[c] = true
+		if i == 0 {
+			continue
+		}
+		d := int(c) - int(id[i-1])
+		if (d == 1 || d == -1) && d == step {
+			run++
+		} else if d == 1 || d == -1 {
+			run = 2
+		} else {
+			run = 1
+		}
+		step = d
+		if run > longestRun {
+			longestRun = run
+		}
+	}
+	// A random string of n characters has close to n distinct characters
+	// (fewer for hex). Requiring half as many, up to 4, rejects repetitive
+	// ids while rejecting a random id with negligible probability.
+	minDistinct := len(id) / 2
+	if minDistinct > 4 {
+		minDistinct = 4
+	}
+	if len(distinct) < minDistinct {
+		return fmt.Errorf("only %d distinct characters", len(distinct))
+	}
+	if longestRun >= 5 && longestRun*2 >= len(id) {
+		return fmt.Errorf("sequential run of %d characters", longestRun)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestValidateSessionIDRandom(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		for _, id := range []string{
+			// meek-client.
+			strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "="),
+			base64.StdEncoding.EncodeToString(buf),
+			base64.RawURLEncoding.EncodeToString(buf),
+			hex.EncodeToString(buf),
+		} {
+			if err := validateSessionID(id); err != nil {
+				t.Fatalf("%q: %v", id, err)
+			}
+		}
+		sum := sha256.Sum256(buf)
+		id := hex.EncodeToString(sum[:])
+		if err := validateSessionID(id); err != nil {
+			t.Fatalf("%q: %v", id, err)
+		}
+	}
+}
+
+func TestValidateSessionIDBad(t *testing.T) {
+	for _, id := range []string{
+		"00000000",
+		"AAAAAAAAAAA",
+		"aaaabbbb",
+		"00000001",
+		"0000000000000042",
+		"12345678",
+		"abcdefghijk",
+		"zyxwvutsrq",
+		"session id",
+		"abc.def.ghi",
+		"'; DROP TABLE",
+		"%2e%2e%2f%2e",
+	} {
+		if err := validateSessionID(id); err == nil {
+			t.Errorf("%q unexpectedly accepted", id)
+		}
+	}
+}
+
+func FuzzCheckSessionID(f *testing.F) {
+	for _, id := range []string{"", "short", "Y2FyZ28gdHJ1Y2s", "00000000", "abcdefgh", "0123456789abcdef", "Y2Fy\x00Z28gdHJ1", "+/-_=AbC"} {
+		f.Add(id)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		err := checkSessionID(id)
+		if (len(id) < minSessionIDLength) != (err == errNoSessionID) {
+			t.Fatalf("%q of length %d: %v", id, len(id), err)
+		}
+		if err != nil {
+			return
+		}
+		for i := 0; i < len(id); i++ {
+			if !isSessionIDChar(id[i]) {
+				t.Fatalf("%q accepted with %q", id, id[i])
+			}
+		}
+	})
+}
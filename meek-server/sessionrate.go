@@ -0,0 +1,155 @@
+package main
+
+// The code in this file limits the rate at which new sessions are created.
+// Every new session means a backend dial, and any request with an unknown
+// session id creates one, so without a limit a scanner cycling through random
+// session ids can make the server dial the backend thousands of times a
+// second. Requests for existing sessions are not affected.
+//
+// There are two token buckets: one for the whole server
+// (--new-session-rate), and one per client address (--new-session-rate-per-ip).
+// IPv6 addresses are grouped by /64, because a single host usually has a whole
+// /64 to choose from. A request that would create a session when either
+// bucket is empty gets a decoy response.
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// The smallest burst allowed by a bucket, so that a client whose tor
+	// opens several circuits at once isn't refused even under a low rate.
+	sessionRateMinBurst = 5
+	// How often to forget per-address buckets that have refilled.
+	sessionRatePruneInterval = time.Minute
+)
+
+// Returned by GetSession when a new session would exceed a rate limit.
+var errSessionRate = errors.New("new session rate limit exceeded; refusing new session")
+
+// tokenBucket allows events at rate per second on average, with bursts of up
+// to burst.
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Refill the bucket for the time since the last call.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Take a token if there is one, and return whether there was.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sessionRateLimiter applies the global and per-address limits. A nil
+// *sessionRateLimiter allows everything.
+type sessionRateLimiter struct {
+	// Rates in sessions per second; 0 means no limit.
+	rate, ratePerIP float64
+	now             func() time.Time
+
+	lock      sync.Mutex
+	global    *tokenBucket
+	perIP     map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// The new-session rate limiter, or nil if there are no limits. Set up in main.
+var newSessionLimiter *sessionRateLimiter
+
+// Make a sessionRateLimiter. Returns nil if both rates are 0.
+func newSessionRateLimiter(rate, ratePerIP float64) *sessionRateLimiter {
+	if rate <= 0 && ratePerIP <= 0 {
+		return nil
+	}
+	return &sessionRateLimiter{
+		rate:      rate,
+		ratePerIP: ratePerIP,
+		now:       time.Now,
+		perIP:     make(map[string]*tokenBucket),
+	}
+}
+
+// Return the key of the per-address bucket for ip.
+func sessionRateKey(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
+// Return true if a new session may be created for a client at ip (which may
+// be nil if unknown), and count it if so.
+func (limiter *sessionRateLimiter) Allow(ip net.IP) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	limiter.prune(now)
+
+	var bucket *tokenBucket
+	if limiter.ratePerIP > 0 {
+		key := sessionRateKey(ip)
+		bucket = limiter.perIP[key]
+		if bucket == nil {
+			bucket = newTokenBucket(limiter.ratePerIP, math.Max(limiter.ratePerIP, sessionRateMinBurst), now)
+			limiter.perIP[key] = bucket
+		}
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			return false
+		}
+	}
+	if limiter.rate > 0 {
+		if limiter.global == nil {
+			limiter.global = newTokenBucket(limiter.rate, math.Max(limiter.rate, sessionRateMinBurst), now)
+		}
+		if !limiter.global.take(now) {
+			return false
+		}
+	}
+	// Only take from the per-address bucket once the global one has
+	// allowed the session, so refusals don't count against the client.
+	if bucket != nil {
+		bucket.tokens--
+	}
+	return true
+}
+
+// Forget per-address buckets that are full again, and so behave the same as
+// new ones. Must be called with the lock held.
+func (limiter *sessionRateLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < sessionRatePruneInterval {
+		return
+	}
+	limiter.lastPrune = now
+	for key, bucket := range limiter.perIP {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(limiter.perIP, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionRateLimiterPerIP(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	limiter := newSessionRateLimiter(0, 1)
+	limiter.now = func() time.Time { return now }
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	// The burst is used up, then the address has to wait.
+	for i := 0; i < sessionRateMinBurst; i++ {
+		if !limiter.Allow(a) {
+			t.Fatalf("refused within the burst (%d)", i)
+		}
+	}
+	if limiter.Allow(a) {
+		t.Errorf("allowed beyond the burst")
+	}
+	// Another address has its own bucket.
+	if !limiter.Allow(b) {
+		t.Errorf("other address refused")
+	}
+	// After a second, there's room for one more.
+	now = now.Add(time.Second)
+	if !limiter.Allow(a) {
+		t.Errorf("refused after refill")
+	}
+	if limiter.Allow(a) {
+		t.Errorf("allowed two after refilling one")
+	}
+
+	// Full buckets are forgotten.
+	now = now.Add(sessionRatePruneInterval)
+	limiter.Allow(b)
+	if _, ok := limiter.perIP[sessionRateKey(a)]; ok {
+		t.Errorf("full bucket not pruned")
+	}
+}
+
+func TestSessionRateLimiterGlobal(t *testing.T) {
+	now := time.Date(2017, 3, 22, 0, 0, 0, 0, time.UTC)
+	limiter := newSessionRateLimiter(10, 0)
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow(net.IPv4(192, 0, 2, byte(i))) {
+			t.Fatalf("refused within the burst (%d)", i)
+		}
+	}
+	if limiter.Allow(net.ParseIP("198.51.100.1")) {
+		t.Errorf("allowed beyond the global burst")
+	}
+}
+
+func TestSessionRateKey(t *testing.T) {
+	if sessionRateKey(net.ParseIP("2001:db8:1:2:3::1")) != sessionRateKey(net.ParseIP("2001:db8:1:2:ffff::2")) {
+		t.Errorf("same /64, different keys")
+	}
+	if sessionRateKey(net.ParseIP("2001:db8:1:2::1")) == sessionRateKey(net.ParseIP("2001:db8:1:3::1")) {
+		t.Errorf("different /64s, same key")
+	}
+	if sessionRateKey(net.ParseIP("192.0.2.1")) == sessionRateKey(net.ParseIP("192.0.2.2")) {
+		t.Errorf("different IPv4 addresses, same key")
+	}
+}
+
+func TestSessionRateLimiterNil(t *testing.T) {
+	if newSessionRateLimiter(0, 0) != nil {
+		t.Errorf("limiter without limits is not nil")
+	}
+	var none *sessionRateLimiter
+	if !none.Allow(net.ParseIP("192.0.2.1")) {
+		t.Errorf("nil limiter refused")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+// The code in this file implements per-session tokens (--session-tokens). A
+// session id may leak, for example through CDN logs, and without tokens
+// knowing it is enough to inject data into the session. With tokens, the
+// server makes up a random token when it creates a session, and sends it in an
+// X-Session-Token response header to the session's first request. Every later
+// request for the session, including one that closes it, must carry the token
+// in the X-Session-Token request header. A pipelining client must wait for the
+// first response before sending more requests.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// The number of random bytes in a session token.
+const sessionTokenLength = 16
+
+// Returned by checkToken when a request has a missing or wrong token.
+var errSessionToken = errors.New("missing or wrong session token")
+
+// The token state of a session. The zero value means the session has no token.
+type sessionToken struct {
+	token string
+
+	lock sync.Mutex
+	// Whether the session's first request, which needs no token, has been
+	// accepted.
+	issued bool
+	// Whether a request has presented the token yet.
+	confirmed bool
+}
+
+// Make a new random token.
+func newSessionToken() (string, error) {
+	var buf [sessionTokenLength]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// Does provided match secret? An empty secret matches nothing. The time taken
+// doesn't depend on where the first difference is.
+func tokenMatches(provided, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) == 1
+}
+
+// Check the X-Session-Token header of req. Only the session's first request
+// may leave it out, and not if it is closing the session.
+func (st *sessionToken) checkToken(req *http.Request, closing bool) error {
+	return st.check(req.Header.Get("X-Session-Token"), closing)
+}
+
+// Check a provided token ("" for none), for checkToken.
+func (st *sessionToken) check(provided string, closing bool) error {
+	if st.token == "" {
+		return nil
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if provided == "" {
+		if st.issued || closing {
+			return errSessionToken
+		}
+		st.issued = true
+		return nil
+	}
+	if !tokenMatches(provided, st.token) {
+		return errSessionToken
+	}
+	st.issued = true
+	st.confirmed = true
+	return nil
+}
+
+// Send the token in the response, if the client may not have it yet.
+func (st *sessionToken) setHeader(w http.ResponseWriter) {
+	if st.token == "" {
+		return
+	}
+	st.lock.Lock()
+	confirmed := st.confirmed
+	st.lock.Unlock()
+	if !confirmed {
+		w.Header().Set("X-Session-Token", st.token)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Make a request with the given token, or none if token is "".
+func newTokenRequest(token string) *http.Request {
+	req := httptest.NewRequest("POST", "/", nil)
+	if token != "" {
+		req.Header.Set("X-Session-Token", token)
+	}
+	return req
+}
+
+func TestSessionToken(t *testing.T) {
+	st := sessionToken{token: "secret"}
+
+	// The first request needs no token, and gets it in the response.
+	if err := st.checkToken(newTokenRequest(""), false); err != nil {
+		t.Errorf("first request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	st.setHeader(rr)
+	if token := rr.Header().Get("X-Session-Token"); token != "secret" {
+		t.Errorf("got response token %q", token)
+	}
+
+	// Every later request must have it.
+	if err := st.checkToken(newTokenRequest(""), false); err != errSessionToken {
+		t.Errorf("no token on the second request: got %v", err)
+	}
+	if err := st.checkToken(newTokenRequest("wrong"), false); err != errSessionToken {
+		t.Errorf("wrong token: got %v", err)
+	}
+	if err := st.checkToken(newTokenRequest("secret"), false); err != nil {
+		t.Errorf("right token: %v", err)
+	}
+
+	// Once the client has sent it, it is no longer sent.
+	rr = httptest.NewRecorder()
+	st.setHeader(rr)
+	if _, ok := rr.Header()["X-Session-Token"]; ok {
+		t.Errorf("token sent after confirmation")
+	}
+}
+
+// A request to close a session always needs the token, even before the first
+// request.
+func TestSessionTokenClose(t *testing.T) {
+	st := sessionToken{token: "secret"}
+	if err := st.checkToken(newTokenRequest(""), true); err != errSessionToken {
+		t.Errorf("close without token: got %v", err)
+	}
+	if err := st.checkToken(newTokenRequest("secret"), true); err != nil {
+		t.Errorf("close with token: %v", err)
+	}
+}
+
+func TestSessionTokenDisabled(t *testing.T) {
+	var st sessionToken
+	if err := st.checkToken(newTokenRequest("anything"), false); err != nil {
+		t.Errorf("session without token: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	st.setHeader(rr)
+	if _, ok := rr.Header()["X-Session-Token"]; ok {
+		t.Errorf("token header without token")
+	}
+}
+
+func FuzzTokenMatches(f *testing.F) {
+	f.Add("secret", "secret")
+	f.Add("", "")
+	f.Add("secret", "")
+	f.Add("secreT", "secret")
+	f.Add("secret\x00", "secret")
+	f.Fuzz(func(t *testing.T, provided, secret string) {
+		if tokenMatches(provided, secret) != (secret != "" && provided == secret) {
+			t.Fatalf("%q against %q: %v", provided, secret, tokenMatches(provided, secret))
+		}
+	})
+}
+
+func FuzzSessionTokenCheck(f *testing.F) {
+	f.Add("", false)
+	f.Add("", true)
+	f.Add("wrong", false)
+	f.Add("secret", true)
+	f.Fuzz(func(t *testing.T, provided string, closing bool) {
+		st := sessionToken{token: "secret"}
+		err := st.check(provided, closing)
+		switch {
+		case provided == st.token:
+			if err != nil {
+				t.Fatalf("right token: %v", err)
+			}
+		case provided == "" && !closing:
+			// The first request.
+			if err != nil {
+				t.Fatalf("no token on the first request: %v", err)
+			}
+		case err != errSessionToken:
+			t.Fatalf("token %q, closing %v: %v", provided, closing, err)
+		}
+		// After the first request is accepted, a request without the
+		// token is refused.
+		if err == nil {
+			if err := st.check("", false); err != errSessionToken {
+				t.Errorf("no token after the first request: %v", err)
+			}
+		}
+	})
+}
+
+// A request with a missing or wrong token is turned away before it can mark
+// the session as used, so it can't keep a session alive.
+func TestSessionTokenBeforeTouch(t *testing.T) {
+	defer func(saved bool) { options.SessionTokens = saved }(options.SessionTokens)
+	defer func(saved *replayCache) { closedSessions = saved }(closedSessions)
+	options.SessionTokens = true
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	closedSessions = newReplayCache(time.Hour, 100, clock.Now())
+	state := NewStateWith(StateConfig{Backend: &pipeBackend{}, Clock: clock})
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+
+	// A new session's first request can't bring a token of its own.
+	if _, err := state.GetSession("ZGlmZmVyZW50", newTokenRequest("made-up")); err != errSessionToken {
+		t.Errorf("new session with a token: got %v", err)
+	}
+	session, err := state.GetSession(sessionID, newTokenRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := clock.Now()
+
+	clock.Advance(time.Minute)
+	for _, token := range []string{"", "wrong"} {
+		if _, err := state.GetSession(sessionID, newTokenRequest(token)); err != errSessionToken {
+			t.Errorf("token %q: got %v", token, err)
+		}
+		if !session.LastSeen.Equal(created) {
+			t.Errorf("token %q: last seen %s, expected %s", token, session.LastSeen, created)
+		}
+	}
+	if _, err := state.GetSession(sessionID, newTokenRequest(session.token.token)); err != nil {
+		t.Fatal(err)
+	}
+	if !session.LastSeen.Equal(clock.Now()) {
+		t.Errorf("right token: last seen %s, expected %s", session.LastSeen, clock.Now())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+// The code in this file keeps a short trace of recent events for each session:
+// requests with their sizes and timings, and errors. The trace is not logged;
+// an operator can fetch it for one session through the admin API
+// (GET /sessions/{id}/trace), to debug a misbehaving client without turning on
+// debug logging for everyone. The session can be named by its id or by the
+// hash that appears in the log (see scrubSessionID).
+//
+// --session-trace-events sets how many events are kept per session; 0
+// disables tracing.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kinds of trace events.
+const (
+	traceEventCreate   = "create"
+	traceEventRequest  = "request"
+	traceEventRejected = "rejected"
+)
+
+// One event in a session trace.
+type traceEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// The correlation id of the request; see requestid.go.
+	RequestID string `json:"request_id,omitempty"`
+	// Bytes carried in each direction by a request.
+	Up   int64 `json:"up,omitempty"`
+	Down int64 `json:"down,omitempty"`
+	// How long the request waited for its turn on the session, and how
+	// long it then took, in milliseconds.
+	WaitMS     float64 `json:"wait_ms,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// sessionTrace is a ring buffer of the most recent events of a session. A nil
+// *sessionTrace records nothing.
+type sessionTrace struct {
+	lock   sync.Mutex
+	events []traceEvent
+	// Where the next event goes, and whether events has wrapped around.
+	next    int
+	wrapped bool
+}
+
+// Make a sessionTrace keeping n events, or nil if n is 0 or less.
+func newSessionTrace(n int) *sessionTrace {
+	if n <= 0 {
+		return nil
+	}
+	return &sessionTrace{events: make([]traceEvent, n)}
+}
+
+// Record an event, pushing out the oldest one if the buffer is full.
+func (trace *sessionTrace) Add(ev traceEvent) {
+	if trace == nil {
+		return
+	}
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	trace.events[trace.next] = ev
+	trace.next++
+	if trace.next == len(trace.events) {
+		trace.next = 0
+		trace.wrapped = true
+	}
+}
+
+// Return the recorded events, oldest first.
+func (trace *sessionTrace) Events() []traceEvent {
+	if trace == nil {
+		return nil
+	}
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	var events []traceEvent
+	if trace.wrapped {
+		events = append(events, trace.events[trace.next:]...)
+	}
+	return append(events, trace.events[:trace.next]...)
+}
+
+// Convert a duration to milliseconds for a trace event.
+func traceMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Find a session by its key in the session map, or by the hash of its key
+// that appears in the log. Returns the key and the session, or "" and nil.
+func (state *State) findSession(id string) (string, *Session) {
+	if session := state.lookupSession(id); session != nil {
+		return id, session
+	}
+	if len(id) != sessionIDHashLen {
+		return "", nil
+	}
+	for i := range state.shards {
+		shard := &state.shards[i]
+		shard.lock.Lock()
+		var foundID string
+		var found *Session
+		shard.sessions.Range(func(sessionID string, session *Session) bool {
+			if logSessionIDHasher.Hash(sessionID) == id {
+				foundID, found = sessionID, session
+				return false
+			}
+			return true
+		})
+		shard.lock.Unlock()
+		if found != nil {
+			return foundID, found
+		}
+	}
+	return "", nil
+}
+
+// Do a transaction on the session, which the request has waited its turn for
+// since arrived, and record it in the trace.
+func (session *Session) tracedTransact(w http.ResponseWriter, req *http.Request, arrived time.Time) error {
+	begun := time.Now()
+	up, down := session.BytesUp.Load(), session.BytesDown.Load()
+	err := transact(session, w, req)
+	ev := traceEvent{
+		Time:       arrived,
+		Event:      traceEventRequest,
+		RequestID:  requestID(req),
+		Up:         session.BytesUp.Load() - up,
+		Down:       session.BytesDown.Load() - down,
+		WaitMS:     traceMS(begun.Sub(arrived)),
+		DurationMS: traceMS(time.Since(begun)),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	session.trace.Add(ev)
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSessionTraceRing(t *testing.T) {
+	trace := newSessionTrace(3)
+	if events := trace.Events(); len(events) != 0 {
+		t.Errorf("new trace has %d events", len(events))
+	}
+	for i := 1; i <= 5; i++ {
+		trace.Add(traceEvent{Event: traceEventRequest, Up: int64(i)})
+	}
+	events := trace.Events()
+	if len(events) != 3 {
+		t.Fatalf("%d events, expected 3", len(events))
+	}
+	// The oldest two were pushed out, and the rest are oldest first.
+	for i, ev := range events {
+		if ev.Up != int64(i+3) {
+			t.Errorf("event %d: %+v", i, ev)
+		}
+	}
+}
+
+func TestSessionTraceNil(t *testing.T) {
+	trace := newSessionTrace(0)
+	if trace != nil {
+		t.Fatalf("trace with no room is not nil")
+	}
+	trace.Add(traceEvent{Event: traceEventCreate})
+	if events := trace.Events(); events != nil {
+		t.Errorf("nil trace has events %+v", events)
+	}
+}
+
+func TestFindSession(t *testing.T) {
+	state := NewState()
+	const sessionID = "Y2FyZ28gdHJ1Y2s"
+	session := new(Session)
+	state.shard(sessionID).sessions.Store(sessionID, session)
+	for _, id := range []string{sessionID, logSessionIDHasher.Hash(sessionID)} {
+		if key, found := state.findSession(id); key != sessionID || found != session {
+			t.Errorf("%q: found %q, %p", id, key, found)
+		}
+	}
+	if key, found := state.findSession("nosuchid"); key != "" || found != nil {
+		t.Errorf("found %q, %p for an unknown id", key, found)
+	}
+}
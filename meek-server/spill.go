@@ -0,0 +1,330 @@
+package main
+
+// The code in this file implements spilling to disk of data on its way to a
+// slow backend (--spill-dir). Normally a transport request writes its body
+// straight to the backend connection, and when the backend reads slowly, the
+// write blocks, and so does the HTTP handler, holding its request open and the
+// client's data in memory, until the backend catches up. With spilling, a
+// backend connection is a spillConn: writes go into a small buffer in memory,
+// and past that into a temporary file, and a goroutine feeds the backend from
+// them in order. The handler returns as soon as the data is queued. Each
+// session has at most spillMemory bytes in memory and --spill-max bytes on
+// disk, and all sessions together at most --spill-total-max bytes on disk; a
+// write over that blocks as before, until the backend makes room. The file is
+// emptied whenever the backend has caught up. When the session ends, what is
+// still queued is written to the backend, for up to spillCloseTimeout, before
+// the backend connection is closed and the file removed.
+//
+// Only writes are spilled. A backend that writes slowly doesn't tie anything
+// up, because the server reads from the backend only for as long as
+// turnaroundTimeout per request.
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// The most data of a session queued in memory before it is spilled to
+	// disk.
+	spillMemory = 256 << 10
+	// The most read from the file for one write to the backend.
+	spillChunkSize = 64 << 10
+	// How long a closed spillConn keeps writing what is queued to the
+	// backend.
+	spillCloseTimeout = 10 * time.Second
+)
+
+// The number of bytes currently spilled to disk by all sessions.
+var spilledBytes atomic.Int64
+
+// Check that dir is a directory where spill files can be made.
+func checkSpillDir(dir string) error {
+	f, err := os.CreateTemp(dir, "meek-spill-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// spillConn is a backend connection whose writes are queued in memory and then
+// on disk, and written to the backend by a separate goroutine.
+type spillConn struct {
+	net.Conn
+	// The directory for the spill file, the most to spill, and the most
+	// that all spillConns together may spill (0 for no limit).
+	dir      string
+	max      int64
+	totalMax int64
+
+	lock sync.Mutex
+	// Queued data not yet in the file, which is older than any in the
+	// file.
+	mem []byte
+	// The number of bytes being written to the backend.
+	inFlight int
+	// The spill file, created on first use, and the offsets up to which
+	// it has been read and written.
+	file         *os.File
+	fileR, fileW int64
+	// The error from writing to the backend, returned by later writes.
+	err           error
+	writeDeadline time.Time
+	// Signaled when there is data for the writing goroutine, and when a
+	// blocked Write should look again (room was made, the deadline
+	// changed, or there was an error).
+	ready chan struct{}
+	wake  chan struct{}
+	// Closed by Close, after which nothing more is queued.
+	closed    chan struct{}
+	isClosed  bool
+	closeOnce sync.Once
+}
+
+// Wrap a backend connection in a spillConn that spills up to max bytes into a
+// file in dir, as long as all spillConns have spilled less than totalMax (if
+// it is not 0), and start the goroutine that writes to it.
+func newSpillConn(conn net.Conn, dir string, max, totalMax int64) *spillConn {
+	c := &spillConn{
+		Conn:     conn,
+		dir:      dir,
+		max:      max,
+		totalMax: totalMax,
+		ready:    make(chan struct{}, 1),
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go c.drain()
+	return c
+}
+
+// Signal ch without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Return the number of queued bytes. Must be called with c.lock held.
+func (c *spillConn) pendingLocked() int64 {
+	return int64(len(c.mem)+c.inFlight) + c.fileW - c.fileR
+}
+
+// Queue as much of p as there is room for, and return how much that was. Must
+// be called with c.lock held.
+func (c *spillConn) queueLocked(p []byte) (int, error) {
+	room := spillMemory + c.max - c.pendingLocked()
+	if room <= 0 {
+		return 0, nil
+	}
+	if int64(len(p)) > room {
+		p = p[:room]
+	}
+	if c.fileW == c.fileR && len(c.mem)+len(p) <= spillMemory {
+		c.mem = append(c.mem, p...)
+		return len(p), nil
+	}
+	spillRoom := c.max
+	if c.totalMax > 0 {
+		spillRoom = min(spillRoom, c.totalMax-spilledBytes.Load())
+	}
+	if spillRoom <= 0 {
+		// Can't spill; only the memory buffer is left.
+		n := min(len(p), spillMemory-len(c.mem))
+		if c.fileW != c.fileR || n <= 0 {
+			return 0, nil
+		}
+		c.mem = append(c.mem, p[:n]...)
+		return n, nil
+	}
+	// Once anything is in the file, everything goes there, to keep the
+	// data in order.
+	if c.file == nil {
+		f, err := os.CreateTemp(c.dir, "meek-spill-")
+		if err != nil {
+			logging.Warnf("can't spill to disk, blocking instead: %s", err)
+			c.max = 0
+			return c.queueLocked(p)
+		}
+		c.file = f
+	}
+	if int64(len(p)) > spillRoom {
+		p = p[:spillRoom]
+	}
+	n, err := c.file.WriteAt(p, c.fileW)
+	c.fileW += int64(n)
+	spilledBytes.Add(int64(n))
+	return n, err
+}
+
+// Queue p to be written to the backend, blocking while the queue is full.
+func (c *spillConn) Write(p []byte) (int, error) {
+	var total int
+	for {
+		c.lock.Lock()
+		if c.err != nil {
+			c.lock.Unlock()
+			return total, c.err
+		}
+		if c.isClosed {
+			c.lock.Unlock()
+			return total, net.ErrClosed
+		}
+		deadline := c.writeDeadline
+		n, err := c.queueLocked(p[total:])
+		c.lock.Unlock()
+		total += n
+		if n > 0 {
+			notify(c.ready)
+		}
+		if err != nil || total == len(p) {
+			return total, err
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return total, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-timeout:
+		case <-c.closed:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Take the next chunk to write to the backend, or nil if there is none.
+func (c *spillConn) next() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.mem) > 0 {
+		chunk := c.mem
+		c.mem = nil
+		c.inFlight = len(chunk)
+		return chunk, nil
+	}
+	if c.fileR == c.fileW {
+		return nil, nil
+	}
+	chunk := make([]byte, min(spillChunkSize, c.fileW-c.fileR))
+	n, err := c.file.ReadAt(chunk, c.fileR)
+	if n < len(chunk) && err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.fileR += int64(n)
+	c.inFlight = n
+	spilledBytes.Add(-int64(n))
+	if c.fileR == c.fileW {
+		// Start the file over.
+		err = c.file.Truncate(0)
+		c.fileR, c.fileW = 0, 0
+	}
+	return chunk, err
+}
+
+// Write queued data to the backend until c is closed and everything queued has
+// been written, or there is an error; then close the backend connection.
+func (c *spillConn) drain() {
+	defer c.finish()
+	for {
+		chunk, err := c.next()
+		if err == nil && chunk != nil {
+			_, err = c.Conn.Write(chunk)
+		}
+		if err != nil {
+			c.lock.Lock()
+			c.err = err
+			c.inFlight = 0
+			c.lock.Unlock()
+			notify(c.wake)
+			return
+		}
+		if chunk != nil {
+			c.lock.Lock()
+			c.inFlight = 0
+			c.lock.Unlock()
+			notify(c.wake)
+			continue
+		}
+		select {
+		case <-c.ready:
+			continue
+		case <-c.closed:
+		}
+		c.lock.Lock()
+		empty := c.pendingLocked() == 0
+		c.lock.Unlock()
+		if empty {
+			return
+		}
+	}
+}
+
+// Close the backend connection and remove the spill file.
+func (c *spillConn) finish() {
+	c.Conn.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file != nil {
+		spilledBytes.Add(-(c.fileW - c.fileR))
+		c.fileR, c.fileW = 0, 0
+		c.file.Close()
+		os.Remove(c.file.Name())
+		c.file = nil
+	}
+}
+
+// Set the deadline for Write, which doesn't affect writes to the backend
+// already queued.
+func (c *spillConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	notify(c.wake)
+	return nil
+}
+
+func (c *spillConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Stop queueing writes and reading from the backend. What is still queued is
+// written to the backend, for up to spillCloseTimeout, and then the backend
+// connection is closed and the spill file removed.
+func (c *spillConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.isClosed = true
+		c.lock.Unlock()
+		close(c.closed)
+		// Unblock reads now, and writes to the backend later.
+		c.Conn.SetReadDeadline(time.Now())
+		c.Conn.SetWriteDeadline(time.Now().Add(spillCloseTimeout))
+	})
+	return nil
+}
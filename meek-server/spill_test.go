@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return the names of the files in dir.
+func spillFiles(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "meek-spill-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestSpillConnOrder(t *testing.T) {
+	dir := t.TempDir()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := newSpillConn(c1, dir, 4<<20, 0)
+	defer conn.Close()
+
+	data := make([]byte, 3*spillMemory)
+	rand.New(rand.NewSource(1)).Read(data)
+	// Nobody is reading from c2 yet, so the writes would block without
+	// spilling.
+	for i := 0; i < len(data); i += 10000 {
+		_, err := conn.Write(data[i:min(i+10000, len(data))])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(spillFiles(t, dir)) != 1 {
+		t.Errorf("no spill file")
+	}
+
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(c2, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("data changed on the way")
+	}
+
+	conn.Close()
+	waitNoSpillFiles(t, dir)
+}
+
+// Wait for the spill files in dir to be removed.
+func waitNoSpillFiles(t *testing.T, dir string) {
+	for i := 0; len(spillFiles(t, dir)) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("spill files left after close: %q", spillFiles(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// What is queued at Close is still written to the backend.
+func TestSpillConnCloseDrains(t *testing.T) {
+	dir := t.TempDir()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := newSpillConn(c1, dir, 4<<20, 0)
+	data := make([]byte, 2*spillMemory)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, err := conn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("write after close succeeded")
+	}
+	got, err := io.ReadAll(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, expected %d", len(got), len(data))
+	}
+	waitNoSpillFiles(t, dir)
+}
+
+// Past the total limit, nothing more is spilled.
+func TestSpillConnTotalMax(t *testing.T) {
+	// Let the spillConns of other tests finish.
+	for i := 0; spilledBytes.Load() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d bytes spilled before the test", spilledBytes.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := newSpillConn(c1, t.TempDir(), 4<<20, 1000)
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := conn.Write(make([]byte, 2*spillMemory))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, expected %v", err, os.ErrDeadlineExceeded)
+	}
+	if n >= spillMemory+2000 {
+		t.Errorf("queued %d bytes", n)
+	}
+	if spilled := spilledBytes.Load(); spilled > 1000 {
+		t.Errorf("%d bytes spilled", spilled)
+	}
+}
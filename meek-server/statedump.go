@@ -0,0 +1,138 @@
+package main
+
+// The code in this file implements state dumps: a snapshot of the server's
+// internal state, written to the log on SIGUSR1 or through the admin API (POST
+// /dump), for diagnosing a running server where a profiler can't be
+// attached. The snapshot has session counts and ages, the number of
+// goroutines, the heap size, the backends added through the admin API and
+// which of them are unavailable (see breaker.go), and a hash of the startup
+// configuration, to tell whether two servers are configured alike. Like the
+// heartbeat, it has nothing that identifies a client.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When the server started, for the uptime in state dumps.
+var startTime = time.Now()
+
+// A hash of the effective configuration at startup (see printconfig.go), or ""
+// if it couldn't be made.
+var configHash string
+
+// Return a short hash of config.
+func hashConfig(config *effectiveConfig) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// stateDump is a snapshot of the server's internal state.
+type stateDump struct {
+	Time   time.Time `json:"time"`
+	Uptime float64   `json:"uptime_seconds"`
+	// Polling sessions, and WebSocket sessions.
+	Sessions   int `json:"sessions"`
+	WebSockets int `json:"websockets"`
+	// Ids of closed sessions remembered to refuse replays; see replay.go.
+	ClosedSessionIDs int `json:"closed_session_ids"`
+	// Data for slow backends queued on disk; see spill.go.
+	SpilledBytes int64 `json:"spilled_bytes"`
+	// The median and greatest ages of polling sessions.
+	MedianSessionAge float64 `json:"median_session_age_seconds"`
+	OldestSessionAge float64 `json:"oldest_session_age_seconds"`
+	Goroutines       int     `json:"goroutines"`
+	HeapBytes        uint64  `json:"heap_bytes"`
+	// The backends added through the admin API, and the backends that
+	// are not being dialed until they recover.
+	Backends            []string `json:"backends"`
+	UnavailableBackends []string `json:"unavailable_backends"`
+	ConfigHash          string   `json:"config_hash"`
+}
+
+// Take a snapshot of the state.
+func (state *State) Dump() *stateDump {
+	now := time.Now()
+	var ages []time.Duration
+	for i := range state.shards {
+		shard := &state.shards[i]
+		shard.lock.Lock()
+		shard.sessions.Range(func(_ string, session *Session) bool {
+			ages = append(ages, now.Sub(session.Created))
+			return true
+		})
+		shard.lock.Unlock()
+	}
+	sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	dump := &stateDump{
+		Time:                now.UTC(),
+		Uptime:              now.Sub(startTime).Seconds(),
+		Sessions:            len(ages),
+		WebSockets:          int(state.webSockets.Load()),
+		ClosedSessionIDs:    closedSessions.Len(),
+		SpilledBytes:        spilledBytes.Load(),
+		Goroutines:          runtime.NumGoroutine(),
+		HeapBytes:           mem.HeapAlloc,
+		Backends:            backends.List(),
+		UnavailableBackends: unavailableBackends(),
+		ConfigHash:          configHash,
+	}
+	if len(ages) > 0 {
+		dump.MedianSessionAge = ages[len(ages)/2].Seconds()
+		dump.OldestSessionAge = ages[len(ages)-1].Seconds()
+	}
+	return dump
+}
+
+// Return the sorted addresses of backends whose circuit is open.
+func unavailableBackends() []string {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	addrs := []string{}
+	for addr, cb := range breakers {
+		if !cb.Allow() {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Format the snapshot for the log.
+func (dump *stateDump) String() string {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second)).Round(time.Second)
+	}
+	backendsDesc := "tor"
+	if len(dump.Backends) > 0 {
+		backendsDesc = strings.Join(dump.Backends, " ")
+	}
+	unavailable := "none"
+	if len(dump.UnavailableBackends) > 0 {
+		unavailable = strings.Join(dump.UnavailableBackends, " ")
+	}
+	return fmt.Sprintf("up %s; %d sessions (median age %s, oldest %s), %d WebSocket sessions, %d closed session ids; %d goroutines, %d heap bytes, %d spilled bytes; backends %s, unavailable %s; config %s",
+		seconds(dump.Uptime), dump.Sessions, seconds(dump.MedianSessionAge), seconds(dump.OldestSessionAge), dump.WebSockets, dump.ClosedSessionIDs,
+		dump.Goroutines, dump.HeapBytes, dump.SpilledBytes, backendsDesc, unavailable, dump.ConfigHash)
+}
+
+// Take a snapshot of the state and write it to the log.
+func (state *State) LogDump() *stateDump {
+	dump := state.Dump()
+	log.Printf("state dump: %s", dump)
+	return dump
+}
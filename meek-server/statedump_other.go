@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signal that makes the server log a state dump.
+var dumpSignal os.Signal = syscall.SIGUSR1
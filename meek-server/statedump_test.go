@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashConfig(t *testing.T) {
+	a := &effectiveConfig{Options: map[string]string{"port": "443", "strict": "false"}, TLS: "files"}
+	b := &effectiveConfig{Options: map[string]string{"strict": "false", "port": "443"}, TLS: "files"}
+	c := &effectiveConfig{Options: map[string]string{"port": "8443", "strict": "false"}, TLS: "files"}
+	if hashConfig(a) == "" || hashConfig(a) != hashConfig(b) {
+		t.Errorf("equal configurations: %q, %q", hashConfig(a), hashConfig(b))
+	}
+	if hashConfig(a) == hashConfig(c) {
+		t.Errorf("different configurations have the same hash %q", hashConfig(a))
+	}
+}
+
+func TestStateDump(t *testing.T) {
+	state := NewState()
+	for i, id := range []string{"Y2FyZ28gdHJ1Y2s", "c2Vzc2lvbiB0d28", "dGhyZWUgdGhyZWU"} {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		session := NewSession(c1)
+		session.Created = time.Now().Add(-time.Duration(i+1) * time.Minute)
+		state.shard(id).sessions.Store(id, session)
+	}
+	state.webSockets.Add(1)
+
+	dump := state.Dump()
+	if dump.Sessions != 3 || dump.WebSockets != 1 {
+		t.Errorf("%d sessions, %d WebSocket sessions", dump.Sessions, dump.WebSockets)
+	}
+	if dump.MedianSessionAge < 120 || dump.MedianSessionAge > 130 || dump.OldestSessionAge < 180 || dump.OldestSessionAge > 190 {
+		t.Errorf("median age %f, oldest %f", dump.MedianSessionAge, dump.OldestSessionAge)
+	}
+	if dump.Goroutines <= 0 || dump.HeapBytes == 0 {
+		t.Errorf("%d goroutines, %d heap bytes", dump.Goroutines, dump.HeapBytes)
+	}
+	if s := dump.String(); !strings.Contains(s, "3 sessions (median age 2m0s, oldest 3m0s)") {
+		t.Errorf("String: %s", s)
+	}
+}
+
+func TestAdminDump(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+	handler := admin.Handler()
+	// A dump is logged, so it is not something to GET.
+	if rec := adminRequest(handler, testAdminToken, "GET", "/dump", ""); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("GET /dump: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	rec := adminRequest(handler, testAdminToken, "POST", "/dump", "")
+	var dump stateDump
+	if err := json.NewDecoder(rec.Body).Decode(&dump); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", rec.Code, err)
+	}
+	if dump.Goroutines <= 0 || dump.UnavailableBackends == nil {
+		t.Errorf("got %+v", dump)
+	}
+}
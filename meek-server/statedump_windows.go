@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// There is no state dump signal on this platform.
+var dumpSignal os.Signal
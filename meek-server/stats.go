@@ -0,0 +1,140 @@
+package main
+
+// The code in this file has to do with usage statistics that are safe to keep
+// and log: counts and estimates that don't identify any client.
+//
+// The number of unique clients per day is estimated with a HyperLogLog sketch
+// over a keyed hash of client IP addresses. Raw addresses are never stored.
+// The hash key is random and is replaced at the end of each day, so the
+// sketch of one day can't be correlated with that of another, nor can anyone
+// who learns a sketch test whether a given address is in it.
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+const (
+	// Number of hash bits used to select a HyperLogLog register. 2^12
+	// registers give a standard error of about 1.6%.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// uniqueCounter estimates the number of distinct IP addresses added to it.
+type uniqueCounter struct {
+	lock      sync.Mutex
+	seed      maphash.Seed
+	registers [hllRegisters]uint8
+}
+
+func newUniqueCounter() *uniqueCounter {
+	return &uniqueCounter{seed: maphash.MakeSeed()}
+}
+
+// Record an IP address.
+func (c *uniqueCounter) Add(ip net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	x := maphash.Bytes(c.seed, ip.To16())
+	index := x >> (64 - hllPrecision)
+	// Position of the first 1 bit in the remaining bits, counting from 1.
+	// The sentinel bit bounds the result when all of them are 0.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > c.registers[index] {
+		c.registers[index] = rank
+	}
+}
+
+// Return the estimated number of distinct addresses added since the counter
+// was created or last reset.
+func (c *uniqueCounter) Estimate() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.estimate()
+}
+
+func (c *uniqueCounter) estimate() uint64 {
+	const m = float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range c.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Small-range correction (linear counting).
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// Return the current estimate, then clear the counter and choose a new hash
+// key.
+func (c *uniqueCounter) Reset() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.estimate()
+	c.registers = [hllRegisters]uint8{}
+	c.seed = maphash.MakeSeed()
+	return n
+}
+
+// Return the number of sessions currently open.
+func (state *State) NumSessions() int {
+	n := 0
+	for i := range state.shards {
+		shard := &state.shards[i]
+		shard.lock.Lock()
+		n += shard.sessions.Len()
+		shard.lock.Unlock()
+	}
+	return n + int(state.webSockets.Load())
+}
+
+// Loop forever, logging the estimated number of unique clients at the end of
+// each UTC day, and, if interval is positive, a heartbeat with the current
+// counts every interval.
+func (state *State) ReportStats(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		now := time.Now().UTC()
+		day := now.Truncate(24 * time.Hour)
+		timer := time.NewTimer(day.Add(24 * time.Hour).Sub(now))
+		select {
+		case <-tick:
+			timer.Stop()
+			cover := ""
+			if len(options.CoverAssets) > 0 {
+				cover = fmt.Sprintf(", %d cover requests", state.coverRequests.Swap(0))
+			}
+			logging.Infof("heartbeat: %d sessions%s, ~%d unique clients since %s",
+				state.NumSessions(), cover, state.clients.Estimate(), day.Format("2006-01-02 15:04:05"))
+			if bandwidthAcct != nil {
+				totals := bandwidthAcct.Totals()
+				logging.Infof("heartbeat: %d bytes today, %d bytes this month", totals.DayBytes, totals.MonthBytes)
+			}
+			if usageByCountry != nil {
+				logging.Infof("heartbeat: sessions/bytes by country: %s", formatCountryUsage(usageByCountry.Reset()))
+			}
+		case <-timer.C:
+			logging.Infof("unique clients on %s: ~%d", day.Format("2006-01-02"), state.clients.Reset())
+			bridgeStatsLog.Flush(day.Add(24 * time.Hour))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+func makeTestIP(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+func TestUniqueCounterEstimate(t *testing.T) {
+	for _, n := range []uint32{0, 1, 10, 1000, 100000} {
+		c := newUniqueCounter()
+		for i := uint32(0); i < n; i++ {
+			c.Add(makeTestIP(i))
+			// Repeats must not count.
+			c.Add(makeTestIP(i))
+		}
+		est := c.Estimate()
+		// Allow 5%, a little over 3 standard errors.
+		if math.Abs(float64(est)-float64(n)) > 0.05*float64(n)+0.5 {
+			t.Errorf("%d addresses: estimated %d", n, est)
+		}
+	}
+}
+
+func TestUniqueCounterIPv4In6(t *testing.T) {
+	c := newUniqueCounter()
+	c.Add(net.ParseIP("192.0.2.1"))
+	c.Add(net.ParseIP("::ffff:192.0.2.1"))
+	if est := c.Estimate(); est != 1 {
+		t.Errorf("estimated %d, expected 1", est)
+	}
+}
+
+func TestUniqueCounterReset(t *testing.T) {
+	c := newUniqueCounter()
+	for i := uint32(0); i < 100; i++ {
+		c.Add(makeTestIP(i))
+	}
+	seed := c.seed
+	if n := c.Reset(); n < 95 || n > 105 {
+		t.Errorf("Reset returned %d, expected about 100", n)
+	}
+	if est := c.Estimate(); est != 0 {
+		t.Errorf("estimated %d after Reset", est)
+	}
+	if c.seed == seed {
+		t.Errorf("Reset did not change the hash key")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+// The code in this file implements the --strict request validation mode. In
+// strict mode, every request is checked against the narrow shape of what a
+// meek client or a browser fetching the decoy page actually sends, before any
+// other processing and before any session state is touched. Anything else is
+// rejected, shrinking the parsing surface exposed to the public internet.
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+const (
+	// Limits on the request header in strict mode. A meek request has
+	// only a handful of short headers, though CDNs add a few of their own.
+	strictMaxHeaderCount = 40
+	strictMaxHeaderBytes = 8192
+	// The longest session id accepted in strict mode.
+	strictMaxSessionIDLength = 64
+)
+
+// Is urlPath an acceptable path for a transport or echo request in strict mode?
+// With --paths, those are the paths it allows; otherwise only the paths that
+// clients use by default.
+func strictPathAllowed(urlPath string) bool {
+	if options.TransportPaths != nil {
+		return options.TransportPaths.Allowed(urlPath) ||
+			(echoEnabled() && path.Base(urlPath) == echoPath && options.TransportPaths.AllowedParent(urlPath))
+	}
+	switch urlPath {
+	case "/", "/p":
+		return true
+	case "/" + echoPath:
+		return echoEnabled()
+	}
+	return false
+}
+
+// Check a request against the strict-mode rules. Returns nil if the request
+// has an acceptable shape, or an error saying why not.
+func validateStrict(req *http.Request) error {
+	switch req.Method {
+	case "GET", "HEAD":
+		// Decoy requests: no body allowed.
+		if req.ContentLength != 0 || len(req.TransferEncoding) != 0 {
+			return fmt.Errorf("%s with a body", req.Method)
+		}
+	case "OPTIONS":
+		// Only CORS preflights, and only if CORS is enabled.
+		if options.CORS == nil {
+			return fmt.Errorf("OPTIONS without CORS")
+		}
+		if req.ContentLength != 0 || len(req.TransferEncoding) != 0 {
+			return fmt.Errorf("%s with a body", req.Method)
+		}
+	default:
+		// Transport requests, and POST for the echo endpoint.
+		if req.Method != "POST" && !options.TransportMethods.Allowed(req.Method) {
+			return fmt.Errorf("unexpected method")
+		}
+		if !strictPathAllowed(req.URL.Path) {
+			return fmt.Errorf("%s to unexpected path", req.Method)
+		}
+		if req.URL.RawQuery != "" {
+			return fmt.Errorf("%s with a query string", req.Method)
+		}
+		if len(req.TransferEncoding) != 0 {
+			return fmt.Errorf("%s with Transfer-Encoding", req.Method)
+		}
+		size, _ := negotiatePayloadSize(req, options.PayloadSize)
+		if req.ContentLength < 0 || req.ContentLength > requestBodyLimit(size) {
+			return fmt.Errorf("%s with bad Content-Length %d", req.Method, req.ContentLength)
+		}
+		ids := req.Header["X-Session-Id"]
+		if len(ids) != 1 {
+			return fmt.Errorf("%d X-Session-Id headers", len(ids))
+		}
+		if len(ids[0]) < minSessionIDLength || len(ids[0]) > strictMaxSessionIDLength {
+			return fmt.Errorf("X-Session-Id of bad length %d", len(ids[0]))
+		}
+		if _, _, err := getSeq(req); err != nil {
+			return fmt.Errorf("bad X-Seq: %s", err)
+		}
+		if values, ok := req.Header[sessionCloseHeader]; ok {
+			if len(values) != 1 || values[0] != "1" {
+				return fmt.Errorf("bad %s", sessionCloseHeader)
+			}
+			if req.ContentLength != 0 {
+				return fmt.Errorf("close request with a body")
+			}
+		}
+	}
+
+	if req.Header.Get("Expect") != "" {
+		return fmt.Errorf("request with Expect")
+	}
+	count := 0
+	size := 0
+	for key, values := range req.Header {
+		for _, value := range values {
+			count++
+			size += len(key) + len(value)
+		}
+	}
+	if count > strictMaxHeaderCount {
+		return fmt.Errorf("too many header fields (%d)", count)
+	}
+	if size > strictMaxHeaderBytes {
+		return fmt.Errorf("header too large (%d bytes)", size)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateStrict(t *testing.T) {
+	good := func() *http.Request {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("data")))
+		req.Header.Set("X-Session-Id", "abcdefghijk")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req
+	}
+	if err := validateStrict(good()); err != nil {
+		t.Errorf("good request rejected: %s", err)
+	}
+	polling := good()
+	polling.URL.Path = "/p"
+	if err := validateStrict(polling); err != nil {
+		t.Errorf("POST to /p rejected: %s", err)
+	}
+	if err := validateStrict(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Errorf("GET rejected: %s", err)
+	}
+
+	bad := []func(req *http.Request){
+		func(req *http.Request) { req.Method = "PUT" },
+		func(req *http.Request) { req.URL.Path = "/other" },
+		func(req *http.Request) { req.URL.RawQuery = "a=b" },
+		func(req *http.Request) { req.Header.Del("X-Session-Id") },
+		func(req *http.Request) { req.Header.Add("X-Session-Id", "abcdefghijk") },
+		func(req *http.Request) { req.Header.Set("X-Session-Id", "short") },
+		func(req *http.Request) { req.Header.Set("X-Session-Id", strings.Repeat("a", 65)) },
+		func(req *http.Request) { req.ContentLength = maxPayloadLength + 1 },
+		func(req *http.Request) { req.ContentLength = -1 },
+		func(req *http.Request) { req.TransferEncoding = []string{"chunked"} },
+		func(req *http.Request) { req.Header.Set("Expect", "100-continue") },
+		func(req *http.Request) { req.Header.Set("X-Big", strings.Repeat("a", strictMaxHeaderBytes)) },
+		func(req *http.Request) {
+			for i := 0; i < strictMaxHeaderCount; i++ {
+				req.Header.Add("X-Many", "a")
+			}
+		},
+	}
+	for i, f := range bad {
+		req := good()
+		f(req)
+		if err := validateStrict(req); err == nil {
+			t.Errorf("bad request %d accepted", i)
+		}
+	}
+
+	// OPTIONS is allowed only when CORS is enabled.
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	if err := validateStrict(req); err == nil {
+		t.Errorf("OPTIONS accepted without CORS")
+	}
+}
+
+func TestValidateStrictTransportMethods(t *testing.T) {
+	saved := options.TransportMethods
+	defer func() { options.TransportMethods = saved }()
+	req := httptest.NewRequest("PATCH", "/", bytes.NewReader([]byte("data")))
+	req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+	if err := validateStrict(req); err == nil {
+		t.Errorf("PATCH not in --methods accepted")
+	}
+	options.TransportMethods, _ = parseTransportMethods("POST,PATCH")
+	if err := validateStrict(req); err != nil {
+		t.Errorf("PATCH in --methods rejected: %s", err)
+	}
+}
+
+func TestValidateStrictTransportPaths(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.TransportPaths, _ = parseTransportPaths("/api/v2/sync,/upload/*")
+	for _, test := range []struct {
+		path       string
+		echoSecret string
+		ok         bool
+	}{
+		{"/api/v2/sync", "", true},
+		{"/upload/a/b", "", true},
+		{"/api/v2/sync/echo", "", false},
+		{"/api/v2/sync/echo", "0123456789abcdef", true},
+		{"/", "", false},
+		{"/p", "", false},
+		{"/echo", "0123456789abcdef", false},
+		{"/api/v2/other", "", false},
+	} {
+		options.EchoSecret = test.echoSecret
+		req := httptest.NewRequest("POST", test.path, bytes.NewReader([]byte("data")))
+		req.Header.Set("X-Session-Id", "Y2FyZ28gdHJ1Y2s")
+		if err := validateStrict(req); (err == nil) != test.ok {
+			t.Errorf("%s echo secret %q: got %v", test.path, test.echoSecret, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+// The code in this file implements --strict-sni, which refuses TLS handshakes
+// whose SNI is not one of the server's own host names. A prober scanning IP
+// addresses typically connects with no SNI, or with one made up, and would
+// otherwise get the server's real certificate, which names the host, and the
+// decoy site behind it. With --strict-sni=close, such a handshake ends in a
+// plain TCP close right after the Client Hello. With --strict-sni=cert, it
+// completes with a generic self-signed certificate, as the default virtual
+// host of a web server might, and the connection is closed at its first
+// request.
+//
+// The allowed names are --acme-hostnames, or the names in the --cert
+// certificate (looked up at every handshake, so a renewed certificate with
+// different names takes effect), and --ech-public-name. With Encrypted Client
+// Hello, the name checked is the inner SNI if the server could decrypt it.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"../lib/logging"
+)
+
+// Ways of refusing a handshake with --strict-sni.
+const (
+	strictSNIClose = "close"
+	strictSNICert  = "cert"
+)
+
+var errSNIRefused = errors.New("SNI not allowed")
+
+// The global SNI filter, nil if --strict-sni is not in effect.
+var strictSNI *sniFilter
+
+type sniFilter struct {
+	mode      string
+	hostnames []string
+	// If not nil, the certificate whose names are also allowed.
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// The configuration for refused handshakes, with --strict-sni=cert.
+	genericConfig *tls.Config
+}
+
+// Make an SNI filter that refuses handshakes in the given mode. getCertificate,
+// if not nil, is the source of further allowed names.
+func newSNIFilter(mode string, hostnames []string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*sniFilter, error) {
+	f := &sniFilter{
+		mode:           mode,
+		getCertificate: getCertificate,
+	}
+	for _, hostname := range hostnames {
+		f.hostnames = append(f.hostnames, normalizeSNI(hostname))
+	}
+	switch mode {
+	case strictSNIClose:
+	case strictSNICert:
+		cert, err := makeGenericCertificate(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		f.genericConfig = &tls.Config{
+			Certificates:     []tls.Certificate{*cert},
+			CurvePreferences: serverCurvePreferences,
+			// Only HTTP/1.1, so that the first request closes the
+			// connection, not only a stream.
+			NextProtos: []string{"http/1.1"},
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q; must be %q or %q", mode, strictSNIClose, strictSNICert)
+	}
+	return f, nil
+}
+
+// Lowercase a host name and remove any trailing dot.
+func normalizeSNI(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Does the host name pattern, which may start with a "*." wildcard matching
+// one label, match name? Both must be normalized.
+func sniMatches(pattern, name string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, ok := strings.Cut(name, ".")
+		return ok && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+// Return the names that a certificate is good for: its DNS names, or if it has
+// none, its common name.
+func certificateNames(cert *tls.Certificate) []string {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return nil
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+// Is serverName one of the allowed names? Returns false for an empty name.
+func (f *sniFilter) Allowed(serverName string) bool {
+	if f == nil {
+		return true
+	}
+	name := normalizeSNI(serverName)
+	if name == "" {
+		return false
+	}
+	for _, pattern := range f.hostnames {
+		if sniMatches(pattern, name) {
+			return true
+		}
+	}
+	if f.getCertificate != nil {
+		cert, err := f.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil || cert == nil {
+			return false
+		}
+		for _, pattern := range certificateNames(cert) {
+			if sniMatches(normalizeSNI(pattern), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A tls.Config.GetConfigForClient callback that lets allowed handshakes
+// continue as usual, and refuses the others.
+func (f *sniFilter) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if f.Allowed(hello.ServerName) {
+		return nil, nil
+	}
+	logging.Debugf("refusing TLS handshake with SNI %q from %s", hello.ServerName, scrubAddr(hello.Conn.RemoteAddr().String()))
+	if f.mode == strictSNICert {
+		return f.genericConfig, nil
+	}
+	// Closing the connection first means the alert that follows the
+	// error is never sent.
+	hello.Conn.Close()
+	return nil, errSNIRefused
+}
+
+// Wrap handler so that requests on connections that got the generic
+// certificate are aborted, which closes the connection without a response.
+func (f *sniFilter) Handler(handler http.Handler) http.Handler {
+	if f == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && !f.Allowed(req.TLS.ServerName) {
+			panic(http.ErrAbortHandler)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Make a self-signed certificate that names no host, valid from a day before
+// now for a year.
+func makeGenericCertificate(now time.Time) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := now.Add(-24 * time.Hour).Truncate(24 * time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
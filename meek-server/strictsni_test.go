@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSNIFilterAllowed(t *testing.T) {
+	f, err := newSNIFilter(strictSNIClose, []string{"Meek.Example", "*.cdn.example"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		serverName string
+		expected   bool
+	}{
+		{"meek.example", true},
+		{"MEEK.example.", true},
+		{"", false},
+		{"other.example", false},
+		{"sub.meek.example", false},
+		{"a.cdn.example", true},
+		{"a.b.cdn.example", false},
+		{"cdn.example", false},
+		{".cdn.example", false},
+		{"192.0.2.1", false},
+	} {
+		if allowed := f.Allowed(test.serverName); allowed != test.expected {
+			t.Errorf("%q: got %v, expected %v", test.serverName, allowed, test.expected)
+		}
+	}
+
+	var nilFilter *sniFilter
+	if !nilFilter.Allowed("") {
+		t.Errorf("nil filter refused a name")
+	}
+
+	if _, err := newSNIFilter("drop", nil, nil); err == nil {
+		t.Errorf("no error for an unknown mode")
+	}
+}
+
+// With --cert, the names come from the certificate: its DNS names, or its
+// common name if it has none.
+func TestSNIFilterCertificateNames(t *testing.T) {
+	cert1, err := tls.X509KeyPair([]byte(cert1PEM), []byte(key1PEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newSNIFilter(strictSNICert, []string{"public.example"}, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &cert1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		serverName string
+		expected   bool
+	}{
+		{"meek-server.example.com", true},
+		{"public.example", true},
+		{"example.com", false},
+	} {
+		if allowed := f.Allowed(test.serverName); allowed != test.expected {
+			t.Errorf("%q: got %v, expected %v", test.serverName, allowed, test.expected)
+		}
+	}
+
+	generic, err := makeGenericCertificate(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := certificateNames(generic); names != nil {
+		t.Errorf("generic certificate has names %q", names)
+	}
+}
+
+// Start a TLS server whose certificate is for example.com, with an SNI filter
+// in the given mode that allows only that name.
+func startStrictSNIServer(t *testing.T, mode string) *httptest.Server {
+	f, err := newSNIFilter(mode, []string{"example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(f.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	})))
+	server.TLS = &tls.Config{GetConfigForClient: f.GetConfigForClient}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Make a request to server with the given SNI, returning the certificate the
+// server presented (nil if there was no handshake) and the response body.
+func strictSNIRequest(server *httptest.Server, serverName string) (*tls.ConnectionState, string, error) {
+	var state *tls.ConnectionState
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				state = &cs
+				return nil
+			},
+		},
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return state, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return state, string(body), err
+}
+
+func TestStrictSNIClose(t *testing.T) {
+	server := startStrictSNIServer(t, strictSNIClose)
+	if _, body, err := strictSNIRequest(server, "example.com"); err != nil || body != "ok" {
+		t.Errorf("allowed name: %q, %v", body, err)
+	}
+	for _, serverName := range []string{"other.example", ""} {
+		state, _, err := strictSNIRequest(server, serverName)
+		if err == nil {
+			t.Errorf("%q: no error", serverName)
+		}
+		if state != nil {
+			t.Errorf("%q: got a certificate", serverName)
+		}
+	}
+}
+
+func TestStrictSNICert(t *testing.T) {
+	server := startStrictSNIServer(t, strictSNICert)
+	state, body, err := strictSNIRequest(server, "example.com")
+	if err != nil || body != "ok" {
+		t.Errorf("allowed name: %q, %v", body, err)
+	}
+	if state == nil || len(state.PeerCertificates) == 0 || state.PeerCertificates[0].VerifyHostname("example.com") != nil {
+		t.Errorf("allowed name didn't get the real certificate")
+	}
+
+	state, _, err = strictSNIRequest(server, "other.example")
+	if err == nil {
+		t.Errorf("request with a refused name succeeded")
+	}
+	if state == nil || len(state.PeerCertificates) != 1 {
+		t.Fatalf("refused name didn't get a certificate")
+	}
+	if names := state.PeerCertificates[0].DNSNames; len(names) != 0 {
+		t.Errorf("generic certificate has names %q", names)
+	}
+	if state.NegotiatedProtocol == "h2" {
+		t.Errorf("generic handshake negotiated h2")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+// The code in this file lets one meek-server process serve several transport
+// method names (--transports), such as meek and meek_lite, or one per CDN,
+// each on a port of its own. ptMethodName is always served, on --port. tor
+// tells transports apart by name: a connection to the OR port that comes from
+// a method's listener carries that method's name as its ExtORPort transport
+// name, and the clients of each method are counted separately in the
+// bridge-ip-transports line of the bridge statistics (see bridgestats.go).
+//
+// A method may also have settings of its own, which apply to the requests that
+// come to its port:
+//	backend=HOST:PORT  send the method's sessions to this plain TCP service
+//	                   instead of the OR port or the admin API's backends
+//	probe-response=P   answer invalid requests with P instead of
+//	                   --probe-response
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A transport method name, as the pluggable transport spec allows them.
+var methodNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// serverTransport is an extra method name, the port to serve it on, and its
+// own settings. An empty setting means that of the command line.
+type serverTransport struct {
+	Name string
+	Port int
+
+	Backend       string
+	ProbeResponse string
+}
+
+// Parse a comma-separated list of NAME=PORT[;KEY=VALUE...] for --transports.
+func parseServerTransports(s string) ([]serverTransport, error) {
+	var transports []serverTransport
+	seenNames := map[string]bool{ptMethodName: true}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		spec, settings, hasSettings := strings.Cut(spec, ";")
+		name, portString, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not NAME=PORT", spec)
+		}
+		if !methodNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("%q is not a valid method name", name)
+		}
+		if seenNames[name] {
+			return nil, fmt.Errorf("method name %q appears more than once", name)
+		}
+		seenNames[name] = true
+		port, err := strconv.Atoi(portString)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("bad port %q for %s", portString, name)
+		}
+		t := serverTransport{Name: name, Port: port}
+		if hasSettings {
+			err = t.parseSettings(settings)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		transports = append(transports, t)
+	}
+	return transports, nil
+}
+
+// Parse the semicolon-separated KEY=VALUE settings of a method.
+func (t *serverTransport) parseSettings(s string) error {
+	seen := make(map[string]bool)
+	for _, setting := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok || value == "" {
+			return fmt.Errorf("%q is not KEY=VALUE", setting)
+		}
+		if seen[key] {
+			return fmt.Errorf("%q appears more than once", key)
+		}
+		seen[key] = true
+		switch key {
+		case "backend":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return fmt.Errorf("backend: %s", err)
+			}
+			t.Backend = value
+		case "probe-response":
+			t.ProbeResponse = value
+		default:
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return nil
+}
+
+// Return the settings of the method name, or nil if it is ptMethodName or
+// not a method of --transports.
+func transportConfig(name string) *serverTransport {
+	for i := range options.Transports {
+		if options.Transports[i].Name == name {
+			return &options.Transports[i]
+		}
+	}
+	return nil
+}
+
+// Return the TOR_PT_SERVER_TRANSPORTS and TOR_PT_SERVER_BINDADDR values for
+// ptMethodName on port and the extra transports.
+func serverTransportsEnv(port int, transports []serverTransport) (string, string) {
+	names := []string{ptMethodName}
+	bindaddrs := []string{ptMethodName + "-0.0.0.0:" + strconv.Itoa(port)}
+	for _, t := range transports {
+		names = append(names, t.Name)
+		bindaddrs = append(bindaddrs, t.Name+"-0.0.0.0:"+strconv.Itoa(t.Port))
+	}
+	return strings.Join(names, ","), strings.Join(bindaddrs, ",")
+}
+
+// Is name ptMethodName or the name of one of transports?
+func isServerMethod(name string, transports []serverTransport) bool {
+	if name == ptMethodName {
+		return true
+	}
+	for _, t := range transports {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The context key under which withMethodName stores the method name.
+type methodNameContextKey struct{}
+
+// Wrap handler so that every request has name, the method name of the
+// listener it came to, in its context.
+func withMethodName(handler http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), methodNameContextKey{}, name)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Return the method name of the listener req came to, or ptMethodName if it
+// has none.
+func methodName(req *http.Request) string {
+	name, ok := req.Context().Value(methodNameContextKey{}).(string)
+	if !ok {
+		return ptMethodName
+	}
+	return name
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseServerTransports(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []serverTransport
+	}{
+		{"", nil},
+		{"meek_lite=8443", []serverTransport{{Name: "meek_lite", Port: 8443}}},
+		{" meek_lite=8443, meek_cdn2=8444,", []serverTransport{{Name: "meek_lite", Port: 8443}, {Name: "meek_cdn2", Port: 8444}}},
+		{"meek_lite=8443;backend=127.0.0.1:9001;probe-response=close", []serverTransport{
+			{Name: "meek_lite", Port: 8443, Backend: "127.0.0.1:9001", ProbeResponse: "close"},
+		}},
+	} {
+		transports, err := parseServerTransports(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(transports, test.expected) {
+			t.Errorf("%q: got %v, expected %v", test.input, transports, test.expected)
+		}
+	}
+	for _, input := range []string{
+		"meek_lite",
+		"meek_lite=",
+		"meek_lite=0",
+		"meek_lite=65536",
+		"meek_lite=https",
+		"meek-lite=8443",
+		"1meek=8443",
+		"=8443",
+		"meek=8443",
+		"meek_lite=8443,meek_lite=8444",
+		"meek_lite=8443;",
+		"meek_lite=8443;backend",
+		"meek_lite=8443;backend=",
+		"meek_lite=8443;backend=127.0.0.1",
+		"meek_lite=8443;color=blue",
+		"meek_lite=8443;probe-response=close;probe-response=close",
+	} {
+		if _, err := parseServerTransports(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestServerTransportsEnv(t *testing.T) {
+	names, bindaddrs := serverTransportsEnv(443, nil)
+	if names != "meek" || bindaddrs != "meek-0.0.0.0:443" {
+		t.Errorf("got %q %q", names, bindaddrs)
+	}
+	transports := []serverTransport{{Name: "meek_lite", Port: 8443}, {Name: "meek_cdn2", Port: 8444}}
+	names, bindaddrs = serverTransportsEnv(443, transports)
+	if names != "meek,meek_lite,meek_cdn2" || bindaddrs != "meek-0.0.0.0:443,meek_lite-0.0.0.0:8443,meek_cdn2-0.0.0.0:8444" {
+		t.Errorf("got %q %q", names, bindaddrs)
+	}
+	for _, name := range []string{"meek", "meek_lite", "meek_cdn2"} {
+		if !isServerMethod(name, transports) {
+			t.Errorf("%q is not a server method", name)
+		}
+	}
+	if isServerMethod("obfs4", transports) {
+		t.Errorf("obfs4 is a server method")
+	}
+}
+
+func TestWithMethodName(t *testing.T) {
+	var got string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = methodName(req)
+	})
+
+	req := httptest.NewRequest("POST", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != ptMethodName {
+		t.Errorf("without withMethodName, got %q", got)
+	}
+	withMethodName(handler, "meek_lite").ServeHTTP(httptest.NewRecorder(), req)
+	if got != "meek_lite" {
+		t.Errorf("got %q, expected %q", got, "meek_lite")
+	}
+}
+
+// Test that a method's own settings apply to requests that come to its
+// listener, and the command line's to others.
+func TestTransportConfig(t *testing.T) {
+	saved := options.Transports
+	savedProbe := options.ProbeResponse
+	defer func() {
+		options.Transports = saved
+		options.ProbeResponse = savedProbe
+	}()
+	options.Transports = []serverTransport{
+		{Name: "meek_lite", Port: 8443, ProbeResponse: probeResponseNotFound},
+		{Name: "meek_cdn2", Port: 8444, Backend: "127.0.0.1:9001"},
+	}
+	options.ProbeResponse = probeResponseBadRequest
+
+	if transportConfig(ptMethodName) != nil || transportConfig("obfs4") != nil {
+		t.Errorf("settings for a method without any")
+	}
+	if c := transportConfig("meek_cdn2"); c == nil || c.Backend != "127.0.0.1:9001" {
+		t.Errorf("meek_cdn2: got %+v", c)
+	}
+
+	var got string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = probeResponsePolicy(req)
+	})
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{ptMethodName, probeResponseBadRequest},
+		{"meek_lite", probeResponseNotFound},
+		{"meek_cdn2", probeResponseBadRequest},
+	} {
+		withMethodName(handler, test.name).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+		if got != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
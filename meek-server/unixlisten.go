@@ -0,0 +1,109 @@
+package main
+
+// The code in this file lets the public listener be a unix domain socket
+// (--listen-unix) instead of a TCP port, for deployments where a local
+// frontend such as nginx or cloudflared forwards requests to the origin over a
+// socket file. Connections on a unix socket have no client address, so the
+// frontend must send the client's address in an X-Forwarded-For header for
+// anything that uses it (--max-conns-per-ip does not apply). On Windows, this
+// uses AF_UNIX sockets, which are available since Windows 10; named pipes are
+// not supported.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// How long to try connecting to an existing socket file to see whether another
+// process is listening on it.
+const unixSocketProbeTimeout = time.Second
+
+// Parse a --listen-unix-mode value, an octal permission like "660".
+func parseUnixSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission like 660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Return what the public listener for addr listens on, for logging: addr, or
+// the socket path with --listen-unix.
+func listenAddrName(addr *net.TCPAddr) string {
+	if options.ListenUnix != "" {
+		return options.ListenUnix
+	}
+	return addr.String()
+}
+
+// Open a listener on a unix socket at path, with permissions mode. The socket
+// is made in a private directory next to path, given its permissions there,
+// and then renamed to path, so that it never exists at path with the
+// permissions of the umask, even for a moment. If another process is still
+// listening on path, it is an error, unless --reuse-port is set: then the
+// socket file is replaced, so that new connections come to us while the other
+// process drains (see upgrade.go); for the same reason, our listener does not
+// remove the socket file when it is closed. A socket file left behind by a
+// process that is no longer listening is replaced too.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if !options.ReusePort {
+			conn, err := net.DialTimeout("unix", path, unixSocketProbeTimeout)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("another process is listening on %s", path)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// os.MkdirTemp makes the directory with permissions 0700.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".meek-server-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed by unixSocketListener.Close under its
+	// new name, if at all.
+	ln.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, mode)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixSocketListener{UnixListener: ln, path: path, unlink: !options.ReusePort}, nil
+}
+
+// unixSocketListener is a listener on a unix socket that was made under
+// another name and renamed to path (see listenUnix). If unlink is true, Close
+// removes the socket file at path.
+type unixSocketListener struct {
+	*net.UnixListener
+	path   string
+	unlink bool
+}
+
+func (ln *unixSocketListener) Close() error {
+	err := ln.UnixListener.Close()
+	if ln.unlink {
+		os.Remove(ln.path)
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUnixSocketMode(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected os.FileMode
+		ok       bool
+	}{
+		{"660", 0660, true},
+		{"0600", 0600, true},
+		{"777", 0777, true},
+		{"1777", 0, false},
+		{"689", 0, false},
+		{"", 0, false},
+	} {
+		mode, err := parseUnixSocketMode(test.input)
+		if (err == nil) != test.ok || mode != test.expected {
+			t.Errorf("%q: got %o, %v", test.input, mode, err)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	path := filepath.Join(t.TempDir(), "meek.sock")
+
+	ln, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %o", fi.Mode().Perm())
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Read(make([]byte, 1))
+	conn.Close()
+	// Nothing is left next to the socket.
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d entries next to the socket", len(entries))
+	}
+
+	// The socket is in use.
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Errorf("listened on a socket in use")
+	}
+	if result := checkUnixListenable("listen", path); result.Status != checkFail {
+		t.Errorf("check of a socket in use: %+v", result)
+	}
+	// With --reuse-port, the socket is taken over, and not removed when
+	// closed. (The old listener would have had --reuse-port too.)
+	ln.(*unixSocketListener).unlink = false
+	options.ReusePort = true
+	ln2, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	ln2.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("socket removed: %s", err)
+	}
+	// Left behind, the socket is replaced.
+	options.ReusePort = false
+	if result := checkUnixListenable("listen", path); result.Status != checkOK {
+		t.Errorf("check of a stale socket: %+v", result)
+	}
+	ln, err = listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("stale socket: %s", err)
+	}
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v", err)
+	}
+
+	// Not a socket.
+	os.WriteFile(path, []byte("file"), 0600)
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Errorf("listened in place of a file")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// The code in this file has to do with replacing a running meek-server with a
+// new binary without an outage. With --reuse-port, the public listener and the
+// built-in SOCKS service's listener are opened with SO_REUSEPORT, so that a
+// second meek-server can listen on the same ports while the first is still
+// running. Sending SIGUSR2 to the old process then makes it drain: it closes
+// its listeners, so that all new connections go to the new process, goes on
+// serving the connections it already has until its sessions are gone or
+// --drain-timeout passes, and exits. An upgrade is:
+//	meek-server --reuse-port ... &	# the new binary, same options
+//	kill -USR2 $OLDPID
+// Sessions stay with the process that created them. A session whose client
+// makes its next request on a new connection reaches the new process and is
+// broken; clients and CDNs that keep their connections open are unaffected.
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"../lib/logging"
+)
+
+// How often to check whether draining is done.
+const drainPollInterval = 1 * time.Second
+
+// The listeners to close when draining.
+var drainListeners struct {
+	lock   sync.Mutex
+	lns    []net.Listener
+	closed bool
+}
+
+// Open a TCP listener on addr, with SO_REUSEPORT if --reuse-port is set.
+func listenTCP(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if options.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// Remember ln so that it is closed when draining starts. If draining has
+// already started, ln is closed right away.
+func trackListener(ln net.Listener) net.Listener {
+	drainListeners.lock.Lock()
+	defer drainListeners.lock.Unlock()
+	if drainListeners.closed {
+		ln.Close()
+	}
+	drainListeners.lns = append(drainListeners.lns, ln)
+	return ln
+}
+
+// Have the tracked listeners been closed for draining?
+func listenersClosed() bool {
+	drainListeners.lock.Lock()
+	defer drainListeners.lock.Unlock()
+	return drainListeners.closed
+}
+
+func closeListeners() {
+	drainListeners.lock.Lock()
+	defer drainListeners.lock.Unlock()
+	for _, ln := range drainListeners.lns {
+		ln.Close()
+	}
+	drainListeners.lns = nil
+	drainListeners.closed = true
+}
+
+// Stop accepting connections and wait until there are no sessions left, or
+// until timeout has passed.
+func (state *State) Drain(timeout time.Duration) {
+	closeListeners()
+	deadline := time.Now().Add(timeout)
+	for {
+		n := state.NumSessions()
+		if n == 0 {
+			logging.Infof("drained all sessions")
+			return
+		}
+		if !time.Now().Before(deadline) {
+			logging.Infof("drain timeout with %d sessions remaining", n)
+			return
+		}
+		logging.Debugf("draining: %d sessions remaining", n)
+		wait := time.Until(deadline)
+		if wait > drainPollInterval {
+			wait = drainPollInterval
+		}
+		time.Sleep(wait)
+	}
+}
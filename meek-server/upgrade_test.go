@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Undo closeListeners, for tests.
+func resetDrainListeners() {
+	drainListeners.lock.Lock()
+	defer drainListeners.lock.Unlock()
+	drainListeners.lns = nil
+	drainListeners.closed = false
+}
+
+func TestListenTCPReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	saved := options.ReusePort
+	defer func() { options.ReusePort = saved }()
+
+	options.ReusePort = true
+	ln1, err := listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	ln2, err := listenTCP(ln1.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener with --reuse-port: %s", err)
+	}
+	ln2.Close()
+
+	options.ReusePort = false
+	ln3, err := listenTCP(ln1.Addr().String())
+	if err == nil {
+		ln3.Close()
+		t.Errorf("second listener without --reuse-port succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	defer resetDrainListeners()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trackListener(ln)
+
+	state := NewState()
+	a, b := net.Pipe()
+	defer b.Close()
+	state.shard("Y2FyZ28gdHJ1Y2s").sessions.Store("Y2FyZ28gdHJ1Y2s", NewSession(a))
+
+	// The session never ends, so Drain waits for the timeout.
+	start := time.Now()
+	state.Drain(100 * time.Millisecond)
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Drain returned before the timeout with a session open")
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Errorf("listener still open after Drain")
+	}
+	if !listenersClosed() {
+		t.Errorf("listenersClosed is false after Drain")
+	}
+
+	// A listener tracked after draining started is closed at once.
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trackListener(ln2)
+	if _, err := ln2.Accept(); err == nil {
+		t.Errorf("late listener not closed")
+	}
+
+	// With no sessions, Drain returns at once.
+	start = time.Now()
+	NewState().Drain(time.Hour)
+	if time.Since(start) > time.Second {
+		t.Errorf("Drain with no sessions took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+// The code in this file implements the resource watchdog, which protects the
+// process from exhausting memory under load. It compares the number of
+// goroutines, open backend connections, and heap size against ceilings
+// (--max-goroutines, --max-backend-conns, --max-heap-mb). While any ceiling is
+// exceeded, the server is overloaded: existing sessions continue, but requests
+// that would create a new session get the same decoy response as any other
+// unexpected request. The watchdog logs diagnostics when the server becomes
+// overloaded and again when it recovers.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../lib/logging"
+)
+
+// How often the watchdog samples goroutines and heap size.
+const watchdogInterval = time.Second
+
+// Returned by GetSession when the server is overloaded.
+var errOverloaded = errors.New("overloaded; refusing new session")
+
+// The number of backend connections currently open.
+var openBackendConns atomic.Int64
+
+// countedConn is a net.Conn that is counted in openBackendConns until it is
+// closed.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func newCountedConn(conn net.Conn) *countedConn {
+	openBackendConns.Add(1)
+	return &countedConn{Conn: conn}
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { openBackendConns.Add(-1) })
+	return err
+}
+
+// Close the connection for writing, or close it entirely if it can't be
+// half-closed.
+func (c *countedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Close()
+}
+
+// A snapshot of the resources the watchdog watches.
+type resourceUsage struct {
+	Goroutines   int
+	BackendConns int64
+	HeapBytes    uint64
+}
+
+func (u resourceUsage) String() string {
+	return fmt.Sprintf("%d goroutines, %d backend connections, %d MB heap",
+		u.Goroutines, u.BackendConns, u.HeapBytes>>20)
+}
+
+// The heap metric sampled by the watchdog. Unlike runtime.ReadMemStats,
+// reading it does not stop the world.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+func readResourceUsage() resourceUsage {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	var heap uint64
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		heap = sample[0].Value.Uint64()
+	}
+	return resourceUsage{
+		Goroutines:   runtime.NumGoroutine(),
+		BackendConns: openBackendConns.Load(),
+		HeapBytes:    heap,
+	}
+}
+
+// watchdog holds the resource ceilings. A zero ceiling is not enforced.
+type watchdog struct {
+	MaxGoroutines   int
+	MaxBackendConns int64
+	MaxHeapBytes    uint64
+
+	overloaded atomic.Bool
+}
+
+// The watchdog consulted by GetSession. Configured in main.
+var loadWatchdog watchdog
+
+// Return a description of each ceiling that usage exceeds, or "" if none is.
+func (wd *watchdog) exceeded(usage resourceUsage) string {
+	var reasons []string
+	if wd.MaxGoroutines > 0 && usage.Goroutines > wd.MaxGoroutines {
+		reasons = append(reasons, fmt.Sprintf("goroutines %d > %d", usage.Goroutines, wd.MaxGoroutines))
+	}
+	if wd.MaxBackendConns > 0 && usage.BackendConns >= wd.MaxBackendConns {
+		reasons = append(reasons, fmt.Sprintf("backend connections %d >= %d", usage.BackendConns, wd.MaxBackendConns))
+	}
+	if wd.MaxHeapBytes > 0 && usage.HeapBytes > wd.MaxHeapBytes {
+		reasons = append(reasons, fmt.Sprintf("heap %d MB > %d MB", usage.HeapBytes>>20, wd.MaxHeapBytes>>20))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Return whether any ceiling is enforced.
+func (wd *watchdog) Enabled() bool {
+	return wd.MaxGoroutines > 0 || wd.MaxBackendConns > 0 || wd.MaxHeapBytes > 0
+}
+
+// Return true if new sessions should be refused. The backend connection count
+// is checked at once, because it can jump between samples; the others are
+// checked by Run.
+func (wd *watchdog) Overloaded() bool {
+	if wd.MaxBackendConns > 0 && openBackendConns.Load() >= wd.MaxBackendConns {
+		return true
+	}
+	return wd.overloaded.Load()
+}
+
+// Take one sample and update the overloaded state, logging on a change.
+func (wd *watchdog) check(state *State, usage resourceUsage) {
+	reasons := wd.exceeded(usage)
+	was := wd.overloaded.Load()
+	switch {
+	case reasons != "" && !was:
+		wd.overloaded.Store(true)
+		logging.Warnf("watchdog: overloaded (%s); refusing new sessions; %s, %d sessions",
+			reasons, usage, state.NumSessions())
+	case reasons == "" && was:
+		wd.overloaded.Store(false)
+		logging.Infof("watchdog: recovered; accepting new sessions; %s, %d sessions",
+			usage, state.NumSessions())
+	}
+}
+
+// Sample resource usage every interval, forever.
+func (wd *watchdog) Run(state *State, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		wd.check(state, readResourceUsage())
+	}
+}
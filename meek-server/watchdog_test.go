@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatchdogExceeded(t *testing.T) {
+	wd := watchdog{MaxGoroutines: 100, MaxBackendConns: 10, MaxHeapBytes: 64 << 20}
+	for _, test := range []struct {
+		usage    resourceUsage
+		expected []string
+	}{
+		{resourceUsage{50, 5, 32 << 20}, nil},
+		{resourceUsage{101, 5, 32 << 20}, []string{"goroutines 101 > 100"}},
+		{resourceUsage{50, 10, 32 << 20}, []string{"backend connections 10 >= 10"}},
+		{resourceUsage{200, 5, 128 << 20}, []string{"goroutines", "heap 128 MB > 64 MB"}},
+	} {
+		reasons := wd.exceeded(test.usage)
+		if (reasons == "") != (test.expected == nil) {
+			t.Errorf("%+v: got %q", test.usage, reasons)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(reasons, expected) {
+				t.Errorf("%+v: %q lacks %q", test.usage, reasons, expected)
+			}
+		}
+	}
+
+	// Zero ceilings are not enforced.
+	var unlimited watchdog
+	if unlimited.Enabled() || unlimited.exceeded(resourceUsage{1 << 20, 1 << 20, 1 << 40}) != "" {
+		t.Errorf("zero watchdog enforced a ceiling")
+	}
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	state := NewState()
+	wd := watchdog{MaxGoroutines: 100}
+	wd.check(state, resourceUsage{Goroutines: 101})
+	if !wd.Overloaded() {
+		t.Errorf("not overloaded over the ceiling")
+	}
+	wd.check(state, resourceUsage{Goroutines: 50})
+	if wd.Overloaded() {
+		t.Errorf("still overloaded after recovering")
+	}
+}
+
+func TestCountedConn(t *testing.T) {
+	before := openBackendConns.Load()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := newCountedConn(c1)
+	if n := openBackendConns.Load(); n != before+1 {
+		t.Errorf("after open: %d, expected %d", n, before+1)
+	}
+	conn.Close()
+	conn.Close()
+	if n := openBackendConns.Load(); n != before {
+		t.Errorf("after close: %d, expected %d", n, before)
+	}
+}
+
+func TestGetSessionOverloaded(t *testing.T) {
+	defer loadWatchdog.overloaded.Store(false)
+	loadWatchdog.overloaded.Store(true)
+
+	state := NewState()
+	req := httptest.NewRequest("POST", "/", nil)
+	_, err := state.GetSession("Y2FyZ28gdHJ1Y2s", req)
+	if err != errOverloaded {
+		t.Errorf("got %v, expected %v", err, errOverloaded)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+// The code in this file implements the WebSocket carrier mode, which shares
+// the listener with classic polling. A client that can use it sends a
+// WebSocket upgrade request (a GET) to "/ws", or to "ws" appended to one of
+// the --paths, with its session id in the X-Session-Id header, and then
+// carries its stream in binary messages in both directions, with no polling.
+// POST requests continue to be handled as classic polling, at "/" or "/p".
+// Which mode a client uses is up to the client.
+//
+// Only these two carriers are offered, selected by path. There is no
+// server-sent events carrier and no selection by ALPN.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"../lib/logging"
+)
+
+// The last path element of a WebSocket upgrade request.
+const webSocketPath = "ws"
+
+// Is req a request to upgrade to the WebSocket carrier mode? HTTP/2 requests
+// never are; a connection can't be taken over from the HTTP/2 server.
+func isWebSocketRequest(req *http.Request) bool {
+	return req.ProtoMajor == 1 &&
+		isWebSocketPath(req.URL.Path) &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// Is urlPath that of a WebSocket upgrade: "ws" appended to a path accepted for
+// transport requests with --paths, or exactly "/ws" without it?
+func isWebSocketPath(urlPath string) bool {
+	if options.TransportPaths == nil {
+		return urlPath == "/"+webSocketPath
+	}
+	return strings.HasSuffix(urlPath, "/"+webSocketPath) && options.TransportPaths.AllowedParent(urlPath)
+}
+
+// Check the Origin header of a WebSocket upgrade request. It may be missing, or
+// have the same host as the request (which is what meek-client sends);
+// otherwise the request is cross-origin and the origin must be allowed by
+// --cors-origins.
+func checkWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, req.Host) {
+		return nil
+	}
+	if !options.CORS.Allowed(origin) {
+		return fmt.Errorf("origin not allowed")
+	}
+	return nil
+}
+
+// Handle a WebSocket upgrade request. The session lasts as long as the
+// WebSocket connection; it is not entered in the session map, because no other
+// request ever refers to it.
+func (state *State) ServeWebSocket(w http.ResponseWriter, req *http.Request) {
+	sessionID := req.Header.Get("X-Session-Id")
+	if err := checkSessionID(sessionID); err == errNoSessionID {
+		serveProbeResponse(w, req)
+		return
+	} else if err != nil {
+		logging.Debugf("rejecting session id: %s", err)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+
+	ip, _ := originalClientIP(req)
+	if !clientACL.Allowed(ip) {
+		logging.Debugf("%s", errClientDenied)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+	if loadWatchdog.Overloaded() {
+		logging.Debugf("%s", errOverloaded)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+	if bandwidthAcct.Exhausted() {
+		logging.Debugf("%s", errBandwidthBudget)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+	if !newSessionLimiter.Allow(ip) {
+		logging.Debugf("%s", errSessionRate)
+		serveMaskMethodNotAllowed(w)
+		return
+	}
+	if ip != nil {
+		state.clients.Add(ip)
+		bridgeStatsLog.Add(ip, methodName(req))
+	}
+
+	server := websocket.Server{
+		Handshake: checkWebSocketOrigin,
+		Handler: func(ws *websocket.Conn) {
+			state.carryWebSocket(sessionID, ws, getUseraddr(req), methodName(req), ip, qosTable.Class(req.Header.Get(credentialHeader), sessionID))
+		},
+	}
+	server.ServeHTTP(w, req)
+}
+
+// Copy data between ws and a new backend connection until either side closes.
+func (state *State) carryWebSocket(sessionID string, ws *websocket.Conn, useraddr, methodName string, ip net.IP, class *qosClass) {
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	// Clear any deadlines left over from the HTTP server.
+	ws.SetDeadline(time.Time{})
+
+	or, err := state.backend.DialBackend(useraddr, methodName)
+	if err != nil {
+		logging.Warnf("%s", err)
+		return
+	}
+	defer or.Close()
+	state.webSockets.Add(1)
+	defer state.webSockets.Add(-1)
+	session := NewSession(or)
+	session.Country = usageByCountry.Open(ip)
+	session.QoS = class
+	auditLog.Open(sessionID, session)
+
+	// Enforce --max-session-age by closing the WebSocket, which sends the
+	// client a close frame.
+	var tooOld atomic.Bool
+	if options.MaxSessionAge > 0 {
+		timer := time.AfterFunc(options.MaxSessionAge, func() {
+			tooOld.Store(true)
+			ws.Close()
+		})
+		defer timer.Stop()
+	}
+
+	var wg sync.WaitGroup
+	var upErr, downErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var n int64
+		n, upErr = io.Copy(or, ws)
+		session.BytesUp.Add(n)
+		bandwidthAcct.Add(n)
+		// Unblock the other direction.
+		or.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		var n int64
+		var down io.Reader = or
+		if fairSched != nil {
+			down = &fairReader{Reader: or, sched: fairSched, session: session}
+		}
+		n, downErr = io.Copy(ws, down)
+		session.BytesDown.Add(n)
+		bandwidthAcct.Add(n)
+		ws.Close()
+	}()
+	wg.Wait()
+
+	// Whichever side finished first closed the other, so one error is
+	// expected. Only if both failed did the first one fail with an error
+	// rather than a clean close.
+	reason := closeReasonExplicit
+	if tooOld.Load() {
+		reason = closeReasonMaxAge
+	} else if upErr != nil && downErr != nil {
+		reason = closeReasonError
+	}
+	auditLog.Close(sessionID, session, reason)
+	usageByCountry.Close(session)
+}
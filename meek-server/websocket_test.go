@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestIsWebSocketRequest(t *testing.T) {
+	defer func(saved *transportPaths) { options.TransportPaths = saved }(options.TransportPaths)
+	meekPaths, err := parseTransportPaths("/meek/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		paths         *transportPaths
+		path, upgrade string
+		expected      bool
+	}{
+		{nil, "/ws", "websocket", true},
+		{nil, "/ws", "WebSocket", true},
+		{nil, "/meek/ws", "websocket", false},
+		{nil, "/ws/", "websocket", false},
+		{nil, "/ws", "", false},
+		{nil, "/", "websocket", false},
+		{nil, "/wss", "websocket", false},
+		{meekPaths, "/meek/ws", "websocket", true},
+		{meekPaths, "/ws", "websocket", false},
+		{meekPaths, "/other/ws", "websocket", false},
+	} {
+		options.TransportPaths = test.paths
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.upgrade != "" {
+			req.Header.Set("Upgrade", test.upgrade)
+		}
+		if isWebSocketRequest(req) != test.expected {
+			t.Errorf("%v %q %q: expected %v", test.paths, test.path, test.upgrade, test.expected)
+		}
+	}
+	options.TransportPaths = nil
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.ProtoMajor = 2
+	if isWebSocketRequest(req) {
+		t.Errorf("HTTP/2 request taken as WebSocket")
+	}
+}
+
+// Start an echo server and make it the backend.
+func useEchoBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	saved := ptInfo
+	t.Cleanup(func() { ptInfo = saved })
+	ptInfo.OrAddr = ln.Addr().(*net.TCPAddr)
+	ptInfo.ExtendedOrAddr = nil
+}
+
+func dialTestWebSocket(t *testing.T, server *httptest.Server, sessionID, origin string) (*websocket.Conn, error) {
+	if origin == "" {
+		origin = server.URL
+	}
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("X-Session-Id", sessionID)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func TestServeWebSocket(t *testing.T) {
+	useEchoBackend(t)
+	server := httptest.NewServer(NewState())
+	defer server.Close()
+
+	ws, err := dialTestWebSocket(t, server, "Y2FyZ28gdHJ1Y2s", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, err = ws.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(ws, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q", buf)
+	}
+}
+
+func TestServeWebSocketRejected(t *testing.T) {
+	useEchoBackend(t)
+	server := httptest.NewServer(NewState())
+	defer server.Close()
+
+	// Session id too short.
+	_, err := dialTestWebSocket(t, server, "short", "")
+	if err == nil {
+		t.Errorf("short session id accepted")
+	}
+	// Origin not allowed by CORS.
+	_, err = dialTestWebSocket(t, server, "Y2FyZ28gdHJ1Y2s", "https://evil.example/")
+	if err == nil {
+		t.Errorf("disallowed origin accepted")
+	}
+
+	// Without an Upgrade header it's a plain GET.
+	resp, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Errorf("plain GET upgraded")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+// The code in this file answers the paths that automated scanners probe on
+// every host they find (--mask-well-known): /robots.txt, /favicon.ico, the
+// sitemap, and the WordPress login and XML-RPC endpoints. A host that answers
+// all of them with 404, or with the same page, is easy to set apart from an
+// ordinary site. The responses are made from templates, filled in with the
+// host name the request was for, and follow one of these profiles:
+//	static     a static site: robots.txt, favicon.ico, and sitemap.xml; the
+//	           WordPress paths are not found.
+//	wordpress  a WordPress site: robots.txt and sitemap as WordPress writes
+//	           them, its login page (and its answer to a login attempt),
+//	           its REST API index, and XML-RPC's answer to GET.
+// Files of the decoy content (--mask-dir, --mask-template, --mask-mirror)
+// take precedence over generated ones.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// A host name, or an IPv4 address, that can go into a template.
+var wellKnownHostRegexp = regexp.MustCompile(`^[A-Za-z0-9.-]{1,253}$`)
+
+// The values filled into well-known path templates.
+type wellKnownData struct {
+	// The host of the request, without a port, and "https" or "http".
+	Host   string
+	Scheme string
+	// The date the decoy content seems to have been last changed.
+	Date string
+	// Whether the request is a POST, as of a login form.
+	Post bool
+}
+
+// A well-known path handler.
+type wellKnownHandler func(w http.ResponseWriter, req *http.Request, data *wellKnownData)
+
+// The profiles that --mask-well-known may name, mapping paths to handlers.
+var wellKnownProfiles = map[string]map[string]wellKnownHandler{
+	"static": {
+		"/robots.txt":  wellKnownTemplate("text/plain; charset=utf-8", robotsStaticTemplate),
+		"/favicon.ico": serveFavicon,
+		"/sitemap.xml": wellKnownTemplate("application/xml; charset=utf-8", sitemapTemplate),
+	},
+	"wordpress": {
+		"/robots.txt":     wellKnownTemplate("text/plain; charset=utf-8", robotsWordPressTemplate),
+		"/favicon.ico":    serveFavicon,
+		"/sitemap.xml":    wellKnownRedirect("/wp-sitemap.xml"),
+		"/wp-sitemap.xml": wellKnownTemplate("application/xml; charset=utf-8", sitemapTemplate),
+		"/wp-login.php":   wellKnownTemplate("text/html; charset=UTF-8", wpLoginTemplate),
+		"/wp-admin":       wellKnownRedirect("/wp-admin/"),
+		"/wp-admin/":      wellKnownRedirect("/wp-login.php?redirect_to=%2Fwp-admin%2F&reauth=1"),
+		"/xmlrpc.php":     serveXMLRPC,
+		"/wp-json":        wellKnownRedirect("/wp-json/"),
+		"/wp-json/":       wellKnownTemplate("application/json; charset=UTF-8", wpJSONTemplate),
+		"/wp-content/":    serveWellKnownEmpty,
+	},
+}
+
+// The paths of each profile that answer POST requests that are not transport
+// requests, the way the site would. Scanners that find a login page go on to
+// try passwords on it.
+var wellKnownPostProfiles = map[string]map[string]wellKnownHandler{
+	"wordpress": {
+		"/wp-login.php": wellKnownPostTemplate("text/html; charset=UTF-8", wpLoginTemplate),
+	},
+}
+
+// Return the names of the --mask-well-known profiles.
+func wellKnownProfileNames() []string {
+	var names []string
+	for name := range wellKnownProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return an error if name is not "" or the name of a profile.
+func checkWellKnownProfile(name string) error {
+	if _, ok := wellKnownProfiles[name]; name != "" && !ok {
+		return fmt.Errorf("unknown profile %q; must be one of %s", name, strings.Join(wellKnownProfileNames(), ", "))
+	}
+	return nil
+}
+
+// Answer req if its path is one of profile's (for POST, one of those in
+// wellKnownPostProfiles), and fsys, if not nil, has no file of its own at that
+// path. Returns false if req was not answered.
+func serveWellKnown(w http.ResponseWriter, req *http.Request, profile string, fsys http.FileSystem) bool {
+	profiles := wellKnownProfiles
+	if req.Method == "POST" {
+		profiles = wellKnownPostProfiles
+	}
+	handler := profiles[profile][req.URL.Path]
+	if handler == nil {
+		return false
+	}
+	if fsys != nil {
+		if f, err := fsys.Open(path.Clean(req.URL.Path)); err == nil {
+			f.Close()
+			return false
+		}
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// The host goes into HTML, XML, and JSON unescaped.
+	if !wellKnownHostRegexp.MatchString(host) {
+		return false
+	}
+	data := &wellKnownData{
+		Host:   host,
+		Scheme: "http",
+		Date:   maskStartTime.UTC().Format("2006-01-02"),
+		Post:   req.Method == "POST",
+	}
+	if isHTTPSRequest(req) {
+		data.Scheme = "https"
+	}
+	handler(w, req, data)
+	return true
+}
+
+// Return a handler that serves text, a template.
+func wellKnownTemplate(contentType, text string) wellKnownHandler {
+	tmpl := template.Must(template.New("").Parse(text))
+	return func(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		serveMaskContent(w, req, path.Base(req.URL.Path), maskStartTime, int64(buf.Len()), bytes.NewReader(buf.Bytes()))
+	}
+}
+
+// Return a handler that answers a POST with text, a template, the way a
+// dynamic page does: with no validators, and not cached.
+func wellKnownPostTemplate(contentType, text string) wellKnownHandler {
+	tmpl := template.Must(template.New("").Parse(text))
+	return func(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+			return
+		}
+		// A POST is answered by serveProbeResponse, not Get, so the
+		// decoy headers aren't set yet.
+		options.MaskHeaders.Set(w, req)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache, must-revalidate, max-age=0, no-store, private")
+		w.Write(buf.Bytes())
+	}
+}
+
+// Return a handler that redirects to location.
+func wellKnownRedirect(location string) wellKnownHandler {
+	return func(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+		http.Redirect(w, req, location, http.StatusMovedPermanently)
+	}
+}
+
+// Serve an empty page, which is what WordPress puts in its directories to keep
+// them from being listed.
+func serveWellKnownEmpty(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	serveMaskContent(w, req, "index.php", maskStartTime, 0, bytes.NewReader(nil))
+}
+
+// Answer a GET of xmlrpc.php the way WordPress does.
+func serveXMLRPC(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+	w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+	w.Header().Set("Allow", "POST")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	if req.Method != "HEAD" {
+		w.Write([]byte("XML-RPC server accepts POST requests only."))
+	}
+}
+
+// Serve a 16×16 icon of a color that depends on the host name, so that hosts
+// don't all have the same one.
+func serveFavicon(w http.ResponseWriter, req *http.Request, data *wellKnownData) {
+	ico := makeFavicon(data.Host)
+	w.Header().Set("Content-Type", "image/x-icon")
+	serveMaskContent(w, req, "favicon.ico", maskStartTime, int64(len(ico)), bytes.NewReader(ico))
+}
+
+// Make an ICO file with one 16×16 PNG image: a square of a color chosen by
+// the hash of host, with a lighter border.
+func makeFavicon(host string) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(host)))
+	sum := h.Sum32()
+	fill := color.RGBA{uint8(sum>>16) / 2, uint8(sum>>8) / 2, uint8(sum) / 2, 0xff}
+	border := color.RGBA{fill.R + 0x60, fill.G + 0x60, fill.B + 0x60, 0xff}
+	const size = 16
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := fill
+			if x == 0 || y == 0 || x == size-1 || y == size-1 {
+				c = border
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, img)
+
+	var ico bytes.Buffer
+	// ICONDIR: reserved, type 1 (icon), one image.
+	binary.Write(&ico, binary.LittleEndian, [3]uint16{0, 1, 1})
+	// ICONDIRENTRY: width, height, no palette, reserved, one plane, 32
+	// bits per pixel, the size of the image, and its offset.
+	ico.Write([]byte{size, size, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, [2]uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, [2]uint32{uint32(pngData.Len()), 6 + 16})
+	ico.Write(pngData.Bytes())
+	return ico.Bytes()
+}
+
+const robotsStaticTemplate = `User-agent: *
+Disallow:
+
+Sitemap: {{.Scheme}}://{{.Host}}/sitemap.xml
+`
+
+const robotsWordPressTemplate = `User-agent: *
+Disallow: /wp-admin/
+Allow: /wp-admin/admin-ajax.php
+
+Sitemap: {{.Scheme}}://{{.Host}}/wp-sitemap.xml
+`
+
+const sitemapTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>{{.Scheme}}://{{.Host}}/</loc><lastmod>{{.Date}}</lastmod></url>
+</urlset>
+`
+
+const wpJSONTemplate = `{"name":"{{.Host}}","description":"","url":"{{.Scheme}}:\/\/{{.Host}}","home":"{{.Scheme}}:\/\/{{.Host}}","gmt_offset":"0","timezone_string":"","namespaces":["oembed\/1.0","wp\/v2","wp-site-health\/v1"],"authentication":[],"routes":{}}`
+
+// WordPress's login page. In answer to a POST, it has the error WordPress
+// shows when the browser hasn't sent back its test cookie, as a scanner
+// trying passwords doesn't.
+const wpLoginTemplate = `<!DOCTYPE html>
+<html lang="en-US">
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+<title>Log In &lsaquo; {{.Host}} &#8212; WordPress</title>
+<meta name='robots' content='max-image-preview:large, noindex, noarchive' />
+<link rel='stylesheet' id='login-css' href='{{.Scheme}}://{{.Host}}/wp-admin/css/login.min.css' media='all' />
+<meta name='referrer' content='strict-origin-when-cross-origin' />
+<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+</head>
+<body class="login no-js login-action-login wp-core-ui locale-en-us">
+<div id="login">
+<h1><a href="https://wordpress.org/">Powered by WordPress</a></h1>
+{{if .Post}}<div id="login_error" class="notice notice-error"><p><strong>Error:</strong> Cookies are blocked or not supported by your browser. You must <a href="https://developer.wordpress.org/advanced-administration/wordpress/cookies/#enable-cookies-in-your-browser">enable cookies</a> to use WordPress.</p></div>
+{{end}}<form name="loginform" id="loginform" action="{{.Scheme}}://{{.Host}}/wp-login.php" method="post">
+<p>
+<label for="user_login">Username or Email Address</label>
+<input type="text" name="log" id="user_login" class="input" value="" size="20" autocapitalize="off" autocomplete="username" required="required" />
+</p>
+<div class="user-pass-wrap">
+<label for="user_pass">Password</label>
+<div class="wp-pwd">
+<input type="password" name="pwd" id="user_pass" class="input password-input" value="" size="20" autocomplete="current-password" spellcheck="false" required="required" />
+</div>
+</div>
+<p class="forgetmenot"><input name="rememberme" type="checkbox" id="rememberme" value="forever" /> <label for="rememberme">Remember Me</label></p>
+<p class="submit">
+<input type="submit" name="wp-submit" id="wp-submit" class="button button-primary button-large" value="Log In" />
+<input type="hidden" name="redirect_to" value="{{.Scheme}}://{{.Host}}/wp-admin/" />
+<input type="hidden" name="testcookie" value="1" />
+</p>
+</form>
+<p id="nav"><a class="wp-login-lost-password" href="{{.Scheme}}://{{.Host}}/wp-login.php?action=lostpassword">Lost your password?</a></p>
+<p id="backtoblog"><a href="{{.Scheme}}://{{.Host}}/">&larr; Go to {{.Host}}</a></p>
+</div>
+</body>
+</html>
+`
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCheckWellKnownProfile(t *testing.T) {
+	for _, name := range []string{"", "static", "wordpress"} {
+		if err := checkWellKnownProfile(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if err := checkWellKnownProfile("drupal"); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestServeWellKnown(t *testing.T) {
+	for _, test := range []struct {
+		profile, path string
+		code          int
+		contains      string
+	}{
+		{"static", "/robots.txt", http.StatusOK, "Sitemap: http://www.example.com/sitemap.xml"},
+		{"static", "/sitemap.xml", http.StatusOK, "<loc>http://www.example.com/</loc>"},
+		{"static", "/favicon.ico", http.StatusOK, ""},
+		{"static", "/wp-login.php", 0, ""},
+		{"wordpress", "/robots.txt", http.StatusOK, "Disallow: /wp-admin/"},
+		{"wordpress", "/sitemap.xml", http.StatusMovedPermanently, ""},
+		{"wordpress", "/wp-login.php", http.StatusOK, `action="http://www.example.com/wp-login.php"`},
+		{"wordpress", "/wp-admin/", http.StatusMovedPermanently, ""},
+		{"wordpress", "/xmlrpc.php", http.StatusMethodNotAllowed, "XML-RPC server accepts POST requests only."},
+		{"wordpress", "/index.html", 0, ""},
+	} {
+		req := httptest.NewRequest("GET", "http://www.example.com:80"+test.path, nil)
+		rec := httptest.NewRecorder()
+		served := serveWellKnown(rec, req, test.profile, nil)
+		if !served {
+			if test.code != 0 {
+				t.Errorf("%s %s: not served", test.profile, test.path)
+			}
+			continue
+		}
+		if rec.Code != test.code || !strings.Contains(rec.Body.String(), test.contains) {
+			t.Errorf("%s %s: %d %q", test.profile, test.path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// A login attempt gets the login page with an error, instead of the probe
+// response; other POSTs get the probe response.
+func TestServeWellKnownPost(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.MaskWellKnown = "wordpress"
+	options.ProbeResponse = probeResponseNotFound
+
+	rec := httptest.NewRecorder()
+	serveProbeResponse(rec, httptest.NewRequest("POST", "http://www.example.com/wp-login.php", strings.NewReader("log=admin&pwd=admin")))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<div id="login_error"`) {
+		t.Errorf("login: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != "" || rec.Header().Get("Last-Modified") != "" {
+		t.Errorf("login: validators in %v", rec.Header())
+	}
+	for _, path := range []string{"/xmlrpc.php", "/robots.txt", "/"} {
+		rec := httptest.NewRecorder()
+		serveProbeResponse(rec, httptest.NewRequest("POST", "http://www.example.com"+path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: %d", path, rec.Code)
+		}
+	}
+	// GET has no error.
+	rec = httptest.NewRecorder()
+	serveWellKnown(rec, httptest.NewRequest("GET", "http://www.example.com/wp-login.php", nil), "wordpress", nil)
+	if strings.Contains(rec.Body.String(), "login_error") {
+		t.Errorf("GET: error in %q", rec.Body.String())
+	}
+}
+
+// Files of the decoy content take precedence, and host names that can't go
+// into a template are not answered.
+func TestServeWellKnownNotServed(t *testing.T) {
+	fsys := http.FS(fstest.MapFS{"robots.txt": {Data: []byte("User-agent: *\n")}})
+	req := httptest.NewRequest("GET", "/robots.txt", nil)
+	if serveWellKnown(httptest.NewRecorder(), req, "static", fsys) {
+		t.Errorf("served over a file of the decoy content")
+	}
+	req.Host = "<script>"
+	if serveWellKnown(httptest.NewRecorder(), req, "static", nil) {
+		t.Errorf("served for host %q", req.Host)
+	}
+}
+
+func TestMakeFavicon(t *testing.T) {
+	ico := makeFavicon("www.example.com")
+	if !bytes.HasPrefix(ico, []byte{0, 0, 1, 0, 1, 0, 16, 16}) {
+		t.Fatalf("bad header % x", ico[:8])
+	}
+	img, err := png.Decode(bytes.NewReader(ico[22:]))
+	if err != nil || img.Bounds().Dx() != 16 {
+		t.Fatalf("bad image: %v", err)
+	}
+	if bytes.Equal(ico, makeFavicon("other.example.com")) {
+		t.Errorf("same icon for different hosts")
+	}
+}